@@ -12,23 +12,26 @@ import (
 	"github.com/cockroachdb/pebble"
 
 	"github.com/sensorwave-dev/sensorwave/compresor"
+	"github.com/sensorwave-dev/sensorwave/middleware"
 	"github.com/sensorwave-dev/sensorwave/tipos"
 )
 
 type GestorBorde struct {
-	nodoID        string            // ID único del nodo borde
-	direccion     string            // dirección pública para uso de API REST
-	puertoHTTP    string            // Puerto HTTP para la API REST (legacy, opcional)
-	brokerMQTT    string            // Broker MQTT para federación con la nube
-	tags          map[string]string // Metadatos libres del nodo (nombre, ubicación, etc.)
-	db            *pebble.DB        // Base de datos Pebble local
-	cache         *Cache            // Cache en memoria de configuraciones de series
-	coordinadores sync.Map          // Map de coordinadores de series (gestión de compresión)
-	mu            sync.RWMutex      // Mutex para proteger el contador
-	contador      int               // Contador para generar IDs únicos de series
-	motorReglas   *MotorReglas      // Motor de reglas integrado
-	finalizado    chan struct{}     // Canal para señalizar cierre del gestor
-	federacion    *federacionMQTT   // Worker de federación MQTT (nil si no está activo)
+	nodoID        string                // ID único del nodo borde
+	direccion     string                // dirección pública para uso de API REST
+	puertoHTTP    string                // Puerto HTTP para la API REST (legacy, opcional)
+	brokerMQTT    string                // Broker MQTT para federación con la nube
+	tags          map[string]string     // Metadatos libres del nodo (nombre, ubicación, etc.)
+	db            *pebble.DB            // Base de datos Pebble local
+	cache         *Cache                // Cache en memoria de configuraciones de series
+	coordinadores sync.Map              // Map de coordinadores de series (gestión de compresión)
+	mu            sync.RWMutex          // Mutex para proteger el contador
+	contador      int                   // Contador para generar IDs únicos de series
+	motorReglas   *MotorReglas          // Motor de reglas integrado
+	finalizado    chan struct{}         // Canal para señalizar cierre del gestor
+	federacion    *federacionMQTT       // Worker de federación MQTT (nil si no está activo)
+	dispositivos  *registroDispositivos // Registro de dispositivos y aprovisionamiento
+	sombras       *registroSombras      // Sombras de dispositivos (estado deseado vs reportado)
 }
 
 type Cache struct {
@@ -514,6 +517,16 @@ func Crear(opts Opciones) (*GestorBorde, error) {
 		return &GestorBorde{}, fmt.Errorf("error al cargar reglas: %v", err)
 	}
 
+	// Cargar el registro de dispositivos
+	gestor.dispositivos, err = cargarRegistroDispositivos(db)
+	if err != nil {
+		return &GestorBorde{}, fmt.Errorf("error al cargar dispositivos: %v", err)
+	}
+	gestor.sombras, err = cargarRegistroSombras(db)
+	if err != nil {
+		return &GestorBorde{}, fmt.Errorf("error al cargar sombras: %v", err)
+	}
+
 	// Si S3 está configurado y se pudo conectar, registrar el nodo (incluye reglas)
 	if clienteS3 != nil {
 		if err := gestor.registrarEnS3(); err != nil {
@@ -655,6 +668,13 @@ func (me *GestorBorde) Cerrar() {
 		me.federacion.cerrar()
 	}
 
+	// Detener los reintentos y escalamientos de comandos y los webhooks en curso antes
+	// de cerrar la base
+	if me.motorReglas != nil {
+		me.motorReglas.detenerComandos()
+		me.motorReglas.detenerWebhooks()
+	}
+
 	// Cerrar todos los coordinadores individuales
 	me.coordinadores.Range(func(clave, valor interface{}) bool {
 		cs := valor.(*CoordinadorSerie)
@@ -853,6 +873,19 @@ func (me *GestorBorde) coordinarCompresion(cs *CoordinadorSerie) {
 
 // Insertar agrega un nuevo dato a la serie especificada
 func (me *GestorBorde) Insertar(path string, tiempo int64, dato interface{}) error {
+	if err := me.insertarPunto(path, tiempo, dato); err != nil {
+		return err
+	}
+
+	// Evaluar reglas
+	me.motorReglas.evaluarReglas(time.Unix(0, tiempo))
+
+	return nil
+}
+
+// insertarPunto persiste un punto en la serie sin evaluar reglas.
+// Lo usan Insertar y el ejecutor escribir_serie (que reevalúa las reglas por su cuenta).
+func (me *GestorBorde) insertarPunto(path string, tiempo int64, dato interface{}) error {
 	// Obtener el coordinador para la serie
 	csInterface, ok := me.coordinadores.Load(path)
 	if !ok {
@@ -889,8 +922,10 @@ func (me *GestorBorde) Insertar(path string, tiempo int64, dato interface{}) err
 		}
 	}
 
-	// 4. Evaluar reglas
-	me.motorReglas.evaluarReglas(time.Unix(0, tiempo))
+	// 4. Confirmar comandos de actuadores que esperan este dato
+	if me.motorReglas != nil {
+		me.motorReglas.verificarConfirmacionSerie(path, dato)
+	}
 
 	return nil
 }
@@ -929,6 +964,44 @@ func (me *GestorBorde) ObtenerRegla(id string) (*Regla, error) {
 	return me.motorReglas.ObtenerRegla(id)
 }
 
+// ObtenerHistorialRegla devuelve las últimas ejecuciones de acciones de una regla
+func (me *GestorBorde) ObtenerHistorialRegla(id string) ([]RegistroEjecucion, error) {
+	if _, err := me.motorReglas.ObtenerRegla(id); err != nil {
+		return nil, err
+	}
+	return me.motorReglas.ObtenerHistorial(id), nil
+}
+
+// ProbarRegla reproduce una regla sobre datos históricos sin ejecutar acciones (ver MotorReglas.ProbarRegla)
+func (me *GestorBorde) ProbarRegla(regla *Regla, inicio, fin time.Time, paso time.Duration) (*ResultadoPruebaRegla, error) {
+	return me.motorReglas.ProbarRegla(regla, inicio, fin, paso)
+}
+
+// ListarComandos retorna los comandos con confirmación (filtrados por regla si reglaID no es vacío)
+func (me *GestorBorde) ListarComandos(reglaID string) []ComandoActuador {
+	return me.motorReglas.ListarComandos(reglaID)
+}
+
+// ObtenerComando retorna el estado de un comando con confirmación
+func (me *GestorBorde) ObtenerComando(id string) (ComandoActuador, error) {
+	return me.motorReglas.ObtenerComando(id)
+}
+
+// RegistrarClienteConfirmacion configura el cliente usado para escuchar tópicos de retroalimentación
+func (me *GestorBorde) RegistrarClienteConfirmacion(cliente middleware.Cliente) {
+	me.motorReglas.RegistrarClienteConfirmacion(cliente)
+}
+
+// ConfirmarComando confirma manualmente un comando pendiente
+func (me *GestorBorde) ConfirmarComando(id string) error {
+	return me.motorReglas.ConfirmarComando(id)
+}
+
+// FallarComando marca un comando pendiente como fallido y ejecuta su escalamiento
+func (me *GestorBorde) FallarComando(id, motivo string) error {
+	return me.motorReglas.FallarComando(id, motivo)
+}
+
 func (me *GestorBorde) HabilitarMotorReglas(habilitado bool) {
 	me.motorReglas.Habilitar(habilitado)
 }
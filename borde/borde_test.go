@@ -3,6 +3,7 @@ package borde
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -717,6 +718,243 @@ func TestEvaluarCondicionesRegla_SinCondiciones(t *testing.T) {
 	t.Log("✓ evaluarCondicionesRegla retorna false sin condiciones")
 }
 
+// crearGestorConSeriesReales crea un gestor con series Real e inserta un valor en cada una
+func crearGestorConSeriesReales(t *testing.T, ahora time.Time, valores map[string]float64) *GestorBorde {
+	gestor := crearGestorBordeParaTest(t)
+	for path, valor := range valores {
+		require.NoError(t, gestor.CrearSerie(tipos.Serie{
+			Path:             path,
+			TipoDatos:        tipos.Real,
+			TamañoBloque:     100,
+			CompresionBloque: tipos.Ninguna,
+			CompresionBytes:  tipos.SinCompresion,
+		}))
+		require.NoError(t, gestor.insertarPunto(path, ahora.UnixNano(), valor))
+	}
+	return gestor
+}
+
+// TestEvaluarCondicionesRegla_GruposAnidados verifica (A AND B) OR C
+func TestEvaluarCondicionesRegla_GruposAnidados(t *testing.T) {
+	ahora := time.Now()
+	gestor := crearGestorConSeriesReales(t, ahora, map[string]float64{"s/a": 10, "s/b": 1, "s/c": 0})
+	mr := gestor.motorReglas
+
+	cond := func(path string, umbral float64) Condicion {
+		return Condicion{Path: path, VentanaT: time.Minute, Operador: OperadorMayor, Valor: umbral}
+	}
+
+	regla := &Regla{
+		ID:          "grupos",
+		Logica:      LogicaOR,
+		Condiciones: []Condicion{cond("s/c", 5)}, // C falso
+		Grupos: []GrupoCondiciones{
+			{Logica: LogicaAND, Condiciones: []Condicion{cond("s/a", 5), cond("s/b", 0)}}, // A y B verdaderos
+		},
+		Acciones: []Accion{{Tipo: "log", Destino: "x"}},
+	}
+	require.NoError(t, mr.validarRegla(regla))
+	assert.True(t, mr.evaluarCondicionesRegla(regla, ahora))
+
+	// B falso: (A AND B) falso, C falso
+	regla.Grupos[0].Condiciones[1] = cond("s/b", 5)
+	assert.False(t, mr.evaluarCondicionesRegla(regla, ahora))
+
+	// Solo grupos, sin condiciones de primer nivel
+	soloGrupos := &Regla{
+		ID: "solo_grupos",
+		Grupos: []GrupoCondiciones{
+			{Logica: LogicaOR, Condiciones: []Condicion{cond("s/c", 5)}, Grupos: []GrupoCondiciones{
+				{Condiciones: []Condicion{cond("s/a", 5)}},
+			}},
+		},
+		Acciones: []Accion{{Tipo: "log", Destino: "x"}},
+	}
+	require.NoError(t, mr.validarRegla(soloGrupos))
+	assert.Equal(t, LogicaAND, soloGrupos.Grupos[0].Grupos[0].Logica, "grupo sin lógica usa AND")
+	assert.True(t, mr.evaluarCondicionesRegla(soloGrupos, ahora))
+	assert.Len(t, condicionesRegla(soloGrupos), 2)
+}
+
+// TestEvaluarCondicion_ReferenciaSerie verifica temp_interior > temp_exterior + 5
+func TestEvaluarCondicion_ReferenciaSerie(t *testing.T) {
+	ahora := time.Now()
+	gestor := crearGestorConSeriesReales(t, ahora, map[string]float64{
+		"casa/temp_interior": 24,
+		"casa/temp_exterior": 17,
+	})
+	mr := gestor.motorReglas
+
+	condicion := Condicion{
+		Path:     "casa/temp_interior",
+		VentanaT: time.Minute,
+		Operador: OperadorMayor,
+		Referencia: &ReferenciaSerie{
+			Path:           "casa/temp_exterior",
+			Desplazamiento: 5,
+		},
+	}
+	require.NoError(t, mr.validarCondicion(&condicion))
+	assert.True(t, mr.evaluarCondicion(&condicion, ahora), "24 > 17 + 5")
+
+	condicion.Referencia.Desplazamiento = 10
+	assert.False(t, mr.evaluarCondicion(&condicion, ahora), "24 > 17 + 10")
+
+	// Referencia con agregación sobre un patrón
+	condicion.Referencia = &ReferenciaSerie{Path: "casa/*", Agregacion: AgregacionMaximo}
+	assert.False(t, mr.evaluarCondicion(&condicion, ahora.Add(time.Millisecond)), "24 > max(24, 17) es falso")
+	condicion.Operador = OperadorMayorIgual
+	assert.True(t, mr.evaluarCondicion(&condicion, ahora.Add(time.Millisecond)))
+
+	// Referencia inexistente: la condición no se cumple
+	condicion.Referencia = &ReferenciaSerie{Path: "casa/inexistente"}
+	assert.False(t, mr.evaluarCondicion(&condicion, ahora))
+}
+
+// crearGestorConHistoricoTemp crea "sensor/temp" con una medición por minuto:
+// 10, 20, 30, 20, 10, 30 (comenzando en inicio)
+func crearGestorConHistoricoTemp(t *testing.T, inicio time.Time) *GestorBorde {
+	gestor := crearGestorBordeParaTest(t)
+	require.NoError(t, gestor.CrearSerie(tipos.Serie{
+		Path:             "sensor/temp",
+		TipoDatos:        tipos.Real,
+		TamañoBloque:     100,
+		CompresionBloque: tipos.Ninguna,
+		CompresionBytes:  tipos.SinCompresion,
+	}))
+	for i, v := range []float64{10, 20, 30, 20, 10, 30} {
+		require.NoError(t, gestor.insertarPunto("sensor/temp", inicio.Add(time.Duration(i)*time.Minute).UnixNano(), v))
+	}
+	return gestor
+}
+
+// TestProbarRegla_DisparosHistoricos verifica la reproducción de una regla sobre datos históricos
+func TestProbarRegla_DisparosHistoricos(t *testing.T) {
+	inicio := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	gestor := crearGestorConHistoricoTemp(t, inicio)
+
+	ejecutada := false
+	gestor.motorReglas.ejecutores["contar"] = func(Accion, *Regla, map[string]interface{}) error {
+		ejecutada = true
+		return nil
+	}
+
+	regla := &Regla{
+		Condiciones: []Condicion{{Path: "sensor/temp", VentanaT: 30 * time.Second, Operador: OperadorMayor, Valor: 15.0}},
+		Acciones:    []Accion{{Tipo: "contar", Destino: "x"}},
+	}
+
+	resultado, err := gestor.ProbarRegla(regla, inicio, inicio.Add(5*time.Minute), time.Minute)
+	require.NoError(t, err)
+
+	assert.Equal(t, 6, resultado.Evaluaciones)
+	require.Len(t, resultado.Disparos, 4) // minutos 1, 2, 3 y 5
+	assert.Equal(t, 2, resultado.Activaciones)
+	assert.Equal(t, inicio.Add(time.Minute), resultado.Disparos[0].Timestamp)
+	assert.Equal(t, 20.0, resultado.Disparos[0].Valores["sensor/temp"])
+	assert.Equal(t, 30.0, resultado.Disparos[3].Valores["sensor/temp"])
+
+	assert.False(t, ejecutada, "ProbarRegla no debe ejecutar acciones")
+	assert.Empty(t, regla.ID, "la regla recibida no debe modificarse")
+	assert.Empty(t, gestor.motorReglas.ObtenerHistorial("prueba"))
+}
+
+// TestProbarRegla_NoModificaLaRegla verifica que la validación no complete la lógica
+// de los grupos compartidos con la regla recibida
+func TestProbarRegla_NoModificaLaRegla(t *testing.T) {
+	inicio := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	gestor := crearGestorConHistoricoTemp(t, inicio)
+
+	condicion := Condicion{Path: "sensor/temp", VentanaT: 30 * time.Second, Operador: OperadorMayor, Valor: 15.0}
+	regla := &Regla{
+		Grupos:   []GrupoCondiciones{{Condiciones: []Condicion{condicion}, Grupos: []GrupoCondiciones{{Condiciones: []Condicion{condicion}}}}},
+		Acciones: []Accion{{Tipo: "log", Destino: "x", Parametros: map[string]string{"nivel": "info"}}},
+	}
+
+	_, err := gestor.ProbarRegla(regla, inicio, inicio.Add(5*time.Minute), time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, regla.Logica)
+	assert.Empty(t, regla.Grupos[0].Logica)
+	assert.Empty(t, regla.Grupos[0].Grupos[0].Logica)
+	assert.Equal(t, map[string]string{"nivel": "info"}, regla.Acciones[0].Parametros)
+}
+
+// TestProbarRegla_Validaciones verifica los parámetros inválidos
+func TestProbarRegla_Validaciones(t *testing.T) {
+	inicio := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	gestor := crearGestorConHistoricoTemp(t, inicio)
+
+	regla := &Regla{
+		Condiciones: []Condicion{{Path: "sensor/temp", VentanaT: time.Minute, Operador: OperadorMayor, Valor: 15.0}},
+		Acciones:    []Accion{{Tipo: "log", Destino: "x"}},
+	}
+
+	_, err := gestor.ProbarRegla(regla, inicio, inicio.Add(time.Hour), 0)
+	assert.Error(t, err, "paso cero")
+
+	_, err = gestor.ProbarRegla(regla, inicio, inicio.Add(-time.Hour), time.Minute)
+	assert.Error(t, err, "fin anterior al inicio")
+
+	_, err = gestor.ProbarRegla(regla, inicio, inicio.Add(365*24*time.Hour), time.Second)
+	assert.Error(t, err, "demasiadas evaluaciones")
+
+	_, err = gestor.ProbarRegla(&Regla{Acciones: regla.Acciones}, inicio, inicio.Add(time.Hour), time.Minute)
+	assert.Error(t, err, "regla sin condiciones")
+}
+
+// TestEjecutarComando_ReglaProbar verifica la prueba de reglas por el plano de control federado
+func TestEjecutarComando_ReglaProbar(t *testing.T) {
+	inicio := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	gestor := crearGestorConHistoricoTemp(t, inicio)
+	f := &federacionMQTT{gestor: gestor}
+
+	resultado, err := f.ejecutarComando(tipos.SolicitudControlComando{
+		Operacion: tipos.OpReglaProbar,
+		Argumentos: tipos.ComandoArgs{
+			Regla: map[string]interface{}{
+				"id": "candidata",
+				"condiciones": []interface{}{map[string]interface{}{
+					"path": "sensor/temp", "ventana_t": "30s", "operador": "<", "valor": 15.0,
+				}},
+				"acciones": []interface{}{map[string]interface{}{"tipo": "log", "destino": "x"}},
+			},
+			TiempoInicio: inicio.UnixNano(),
+			TiempoFin:    inicio.Add(5 * time.Minute).UnixNano(),
+			Paso:         int64(time.Minute),
+		},
+	})
+	require.NoError(t, err)
+
+	prueba, ok := resultado.(*ResultadoPruebaRegla)
+	require.True(t, ok)
+	assert.Equal(t, "candidata", prueba.ReglaID)
+	assert.Len(t, prueba.Disparos, 2) // minutos 0 y 4
+}
+
+// TestValidarCondicion_Referencia verifica validaciones de referencias y grupos
+func TestValidarCondicion_Referencia(t *testing.T) {
+	mr := crearMotorReglasTest()
+
+	base := func(ref *ReferenciaSerie) *Condicion {
+		return &Condicion{Path: "a", VentanaT: time.Minute, Operador: OperadorMayor, Referencia: ref}
+	}
+
+	assert.Error(t, mr.validarCondicion(base(&ReferenciaSerie{})), "path vacío")
+	assert.Error(t, mr.validarCondicion(base(&ReferenciaSerie{Path: "b/*"})), "patrón sin agregación")
+	assert.Error(t, mr.validarCondicion(base(&ReferenciaSerie{Path: "b", Agregacion: "mediana"})), "agregación inválida")
+	assert.NoError(t, mr.validarCondicion(base(&ReferenciaSerie{Path: "b/*", Agregacion: AgregacionPromedio})))
+
+	regla := &Regla{
+		ID:       "r",
+		Grupos:   []GrupoCondiciones{{Logica: "XOR", Condiciones: []Condicion{*base(&ReferenciaSerie{Path: "b"})}}},
+		Acciones: []Accion{{Tipo: "log", Destino: "x"}},
+	}
+	assert.Error(t, mr.validarRegla(regla), "lógica de grupo inválida")
+
+	regla.Grupos = []GrupoCondiciones{{}}
+	assert.Error(t, mr.validarRegla(regla), "grupo vacío")
+}
+
 // ============================================================================
 // TESTS DE CONSULTAS.GO
 // ============================================================================
@@ -784,6 +1022,140 @@ func TestGenerarClaveRegla(t *testing.T) {
 	t.Log("✓ generarClaveRegla funciona correctamente")
 }
 
+// TestDeserializarRegla_FormatoAnterior verifica que las reglas persistidas antes de
+// grupos y referencias se sigan cargando
+func TestDeserializarRegla_FormatoAnterior(t *testing.T) {
+	type condicionV1 struct {
+		Path          string
+		VentanaT      time.Duration
+		Agregacion    TipoAgregacion
+		Operador      TipoOperador
+		Valor         interface{}
+		AgregarSeries bool
+	}
+	type reglaV1 struct {
+		ID          string
+		Nombre      string
+		Condiciones []condicionV1
+		Acciones    []Accion
+		Logica      TipoLogica
+		Activa      bool
+		UltimaEval  time.Time
+	}
+
+	data, err := tipos.SerializarGob(reglaV1{
+		ID:          "vieja",
+		Condiciones: []condicionV1{{Path: "s/a", VentanaT: time.Minute, Operador: OperadorMayor, Valor: 3.5}},
+		Acciones:    []Accion{{Tipo: "log", Destino: "x"}},
+		Logica:      LogicaAND,
+		Activa:      true,
+	})
+	require.NoError(t, err)
+
+	regla, err := deserializarRegla(data)
+	require.NoError(t, err)
+	assert.Equal(t, "vieja", regla.ID)
+	require.Len(t, regla.Condiciones, 1)
+	assert.Equal(t, 3.5, regla.Condiciones[0].Valor)
+	assert.Nil(t, regla.Condiciones[0].Referencia)
+	assert.Nil(t, regla.Grupos)
+}
+
+// TestSerializarRegla_GruposYReferencias verifica el round-trip gob con grupos anidados
+func TestSerializarRegla_GruposYReferencias(t *testing.T) {
+	original := &Regla{
+		ID:     "nueva",
+		Logica: LogicaOR,
+		Grupos: []GrupoCondiciones{{
+			Logica: LogicaAND,
+			Condiciones: []Condicion{{
+				Path: "s/a", VentanaT: time.Minute, Operador: OperadorMayor,
+				Referencia: &ReferenciaSerie{Path: "s/b", Agregacion: AgregacionPromedio, Desplazamiento: 2},
+			}},
+			Grupos: []GrupoCondiciones{{Condiciones: []Condicion{{Path: "s/c", VentanaT: time.Second, Operador: OperadorIgual, Valor: true}}}},
+		}},
+		Acciones: []Accion{{Tipo: "log", Destino: "x"}},
+	}
+
+	data, err := serializarRegla(original)
+	require.NoError(t, err)
+	regla, err := deserializarRegla(data)
+	require.NoError(t, err)
+	assert.Equal(t, original.Grupos, regla.Grupos)
+}
+
+// TestParsearReglaDesdeMapa verifica la conversión de reglas recibidas por comandos federados
+func TestParsearReglaDesdeMapa(t *testing.T) {
+	original := &Regla{
+		ID:          "federada",
+		Nombre:      "Interior más caliente",
+		Logica:      LogicaOR,
+		Condiciones: []Condicion{{Path: "s/c", VentanaT: 5 * time.Minute, Operador: OperadorIgual, Valor: "abierto"}},
+		Grupos: []GrupoCondiciones{{
+			Logica: LogicaAND,
+			Condiciones: []Condicion{{
+				Path: "casa/temp_interior", VentanaT: time.Minute, Operador: OperadorMayor,
+				Referencia: &ReferenciaSerie{Path: "casa/temp_exterior", VentanaT: 10 * time.Minute, Desplazamiento: 5},
+			}},
+		}},
+		Acciones: []Accion{{Tipo: "log", Destino: "x", Parametros: map[string]string{"k": "v"}}},
+	}
+
+	// Simular el mapa recibido por MQTT (JSON de tipos.Regla)
+	data, err := json.Marshal(convertirReglaATipos(original))
+	require.NoError(t, err)
+	var mapa map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &mapa))
+
+	regla, err := parsearReglaDesdeMapa(mapa)
+	require.NoError(t, err)
+	assert.Equal(t, original.Condiciones, regla.Condiciones)
+	assert.Equal(t, original.Grupos, regla.Grupos)
+	assert.Equal(t, original.Acciones, regla.Acciones)
+	assert.Equal(t, original.Logica, regla.Logica)
+	assert.NoError(t, crearMotorReglasTest().validarRegla(regla))
+
+	// Ventana inválida
+	mapa["condiciones"] = []interface{}{map[string]interface{}{"path": "s/c", "ventana_t": "nunca"}}
+	_, err = parsearReglaDesdeMapa(mapa)
+	assert.Error(t, err)
+}
+
+// TestConfirmacionAccion_Serializacion verifica que la confirmación de acciones
+// se conserve en la persistencia y en la conversión a tipos
+func TestConfirmacionAccion_Serializacion(t *testing.T) {
+	original := &Regla{
+		ID:          "enfriar",
+		Condiciones: []Condicion{{Path: "s/t", VentanaT: time.Minute, Operador: OperadorMayor, Valor: 30.0}},
+		Acciones: []Accion{{
+			Tipo:    "log",
+			Destino: "actuador/valvula/set",
+			Confirmacion: &ConfirmacionAccion{
+				Topico:       "actuador/valvula/estado",
+				Valor:        "abierta",
+				Timeout:      15 * time.Second,
+				Reintentos:   2,
+				Escalamiento: []Accion{{Tipo: "log", Destino: "alertas/valvula"}},
+			},
+		}},
+	}
+
+	data, err := serializarRegla(original)
+	require.NoError(t, err)
+	regla, err := deserializarRegla(data)
+	require.NoError(t, err)
+	assert.Equal(t, original.Acciones, regla.Acciones)
+
+	convertida, err := convertirReglaDesdeTipos(convertirReglaATipos(original))
+	require.NoError(t, err)
+	assert.Equal(t, original.Acciones, convertida.Acciones)
+
+	tiposRegla := convertirReglaATipos(original)
+	tiposRegla.Acciones[0].Confirmacion.Timeout = "pronto"
+	_, err = convertirReglaDesdeTipos(tiposRegla)
+	assert.Error(t, err)
+}
+
 // ============================================================================
 // TESTS DE REGLAS.GO - HELPERS
 // ============================================================================
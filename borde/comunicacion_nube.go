@@ -41,37 +41,7 @@ func (me *GestorBorde) registrarEnS3() error {
 	reglasMap := me.motorReglas.ListarReglas()
 	var reglas []tipos.Regla
 	for _, regla := range reglasMap {
-		// Convertir condiciones
-		var condiciones []tipos.Condicion
-		for _, c := range regla.Condiciones {
-			condiciones = append(condiciones, tipos.Condicion{
-				Path:          c.Path,
-				VentanaT:      c.VentanaT.String(),
-				Agregacion:    string(c.Agregacion),
-				Operador:      string(c.Operador),
-				Valor:         c.Valor,
-				AgregarSeries: c.AgregarSeries,
-			})
-		}
-
-		// Convertir acciones
-		var acciones []tipos.Accion
-		for _, a := range regla.Acciones {
-			acciones = append(acciones, tipos.Accion{
-				Tipo:       a.Tipo,
-				Destino:    a.Destino,
-				Parametros: a.Parametros,
-			})
-		}
-
-		reglas = append(reglas, tipos.Regla{
-			ID:          regla.ID,
-			Nombre:      regla.Nombre,
-			Activa:      regla.Activa,
-			Logica:      string(regla.Logica),
-			Condiciones: condiciones,
-			Acciones:    acciones,
-		})
+		reglas = append(reglas, convertirReglaATipos(regla))
 	}
 
 	// Ordenar reglas por ID para consistencia
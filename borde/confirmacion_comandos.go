@@ -0,0 +1,555 @@
+package borde
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sensorwave-dev/sensorwave/middleware"
+)
+
+// Confirmación en lazo cerrado de acciones de reglas.
+//
+// Una acción con Confirmacion genera un comando con ID único, disponible como {comando_id}
+// en plantillas y como PayloadActuador.ComandoID. El comando queda pendiente hasta que llega
+// el valor esperado a la serie (o tópico) de retroalimentación. Si vence el timeout la acción
+// se reintenta; agotados los reintentos el comando se marca fallido y se ejecutan las
+// acciones de escalamiento. Un primer envío que falla se sigue igual que uno sin confirmar.
+//
+// El seguimiento es en memoria: los comandos pendientes no sobreviven a un reinicio del nodo.
+// Eliminar o reemplazar una regla cancela sus comandos pendientes, y detenerComandos (al
+// cerrar el gestor) detiene todos los timeouts.
+
+const (
+	timeoutConfirmacionDefecto = 30 * time.Second
+	maxComandosFinalizados     = 1000 // comandos confirmados/fallidos que se conservan para consulta
+)
+
+// ConfirmacionAccion configura la confirmación de una acción enviada a un actuador
+type ConfirmacionAccion struct {
+	Serie        string        // Serie de retroalimentación donde el actuador informa su estado (admite plantillas)
+	Topico       string        // Alternativa a Serie: tópico del middleware (requiere RegistrarClienteConfirmacion)
+	Valor        interface{}   // Valor esperado en la retroalimentación
+	Timeout      time.Duration // Espera máxima por intento (default 30s)
+	Reintentos   int           // Reenvíos de la acción antes de declarar el comando fallido
+	Escalamiento []Accion      // Acciones a ejecutar si el comando falla
+}
+
+// EstadoComando representa el estado de un comando con confirmación
+type EstadoComando string
+
+const (
+	ComandoPendiente  EstadoComando = "pendiente"
+	ComandoConfirmado EstadoComando = "confirmado"
+	ComandoFallido    EstadoComando = "fallido"
+	ComandoCancelado  EstadoComando = "cancelado" // la regla se eliminó o reemplazó
+)
+
+// ComandoActuador describe un comando enviado por una regla que requiere confirmación
+type ComandoActuador struct {
+	ID          string
+	ReglaID     string
+	Accion      string        // Tipo de acción
+	Destino     string        // Destino de la acción (plantilla sin resolver)
+	Serie       string        // Serie de retroalimentación resuelta (vacía si se usa Topico)
+	Topico      string        // Tópico de retroalimentación resuelto (vacío si se usa Serie)
+	Esperado    interface{}   // Valor esperado
+	Estado      EstadoComando // pendiente, confirmado, fallido o cancelado
+	Intentos    int           // Envíos realizados (incluye el primero)
+	Creado      time.Time
+	Actualizado time.Time
+	Error       string // Motivo del fallo (vacío si no falló)
+}
+
+// seguimientoComando contiene lo necesario para reintentar o escalar un comando
+type seguimientoComando struct {
+	comando  ComandoActuador
+	clave    string // regla/índice de acción, evita comandos duplicados
+	regla    *Regla
+	accion   Accion
+	ejecutor EjecutorAccion
+	valores  map[string]interface{} // copia del contexto del primer envío
+	timer    *time.Timer
+}
+
+// estadoComandos agrupa el seguimiento de comandos; se protege con MotorReglas.comandosMu
+type estadoComandos struct {
+	porID         map[string]*seguimientoComando
+	pendientes    map[string]string // clave regla/acción -> ID de comando pendiente
+	finalizados   []string          // IDs en orden de finalización
+	cliente       middleware.Cliente
+	suscripciones map[string]int // tópico -> comandos pendientes que lo esperan
+
+	detenido bool           // detenerComandos: no se arman ni ejecutan más timeouts
+	activos  sync.WaitGroup // timeouts en ejecución (reintento o escalamiento)
+}
+
+// estadoComandosLocked inicializa el estado de forma perezosa. Requiere mr.comandosMu.
+func (mr *MotorReglas) estadoComandosLocked() *estadoComandos {
+	if mr.comandos == nil {
+		mr.comandos = &estadoComandos{
+			porID:         make(map[string]*seguimientoComando),
+			pendientes:    make(map[string]string),
+			suscripciones: make(map[string]int),
+		}
+	}
+	return mr.comandos
+}
+
+func generarIDComando() string {
+	return uuid.New().String()
+}
+
+func claveComando(reglaID string, indice int) string {
+	return fmt.Sprintf("%s/%d", reglaID, indice)
+}
+
+// RegistrarClienteConfirmacion configura el cliente de middleware usado para suscribirse
+// a los tópicos de retroalimentación (ConfirmacionAccion.Topico).
+func (mr *MotorReglas) RegistrarClienteConfirmacion(cliente middleware.Cliente) {
+	mr.comandosMu.Lock()
+	defer mr.comandosMu.Unlock()
+	mr.estadoComandosLocked().cliente = cliente
+}
+
+// hayComandoPendiente indica si la acción de la regla tiene un comando esperando confirmación
+func (mr *MotorReglas) hayComandoPendiente(reglaID string, indice int) bool {
+	mr.comandosMu.Lock()
+	defer mr.comandosMu.Unlock()
+	_, existe := mr.estadoComandosLocked().pendientes[claveComando(reglaID, indice)]
+	return existe
+}
+
+// seguirComando registra un comando recién enviado y arma su timeout. errEnvio es el
+// error del primer envío: el comando se reintenta igual que si no se hubiera confirmado.
+func (mr *MotorReglas) seguirComando(id string, regla *Regla, indice int, accion Accion, ejecutor EjecutorAccion, valores map[string]interface{}, timestamp time.Time, errEnvio error) {
+	conf := accion.Confirmacion
+
+	copia := make(map[string]interface{}, len(valores))
+	for k, v := range valores {
+		copia[k] = v
+	}
+
+	seg := &seguimientoComando{
+		comando: ComandoActuador{
+			ID:          id,
+			ReglaID:     regla.ID,
+			Accion:      accion.Tipo,
+			Destino:     accion.Destino,
+			Esperado:    conf.Valor,
+			Estado:      ComandoPendiente,
+			Intentos:    1,
+			Creado:      timestamp,
+			Actualizado: timestamp,
+		},
+		clave:    claveComando(regla.ID, indice),
+		regla:    regla,
+		accion:   accion,
+		ejecutor: ejecutor,
+		valores:  copia,
+	}
+	if errEnvio != nil {
+		seg.comando.Error = errEnvio.Error()
+	}
+	if conf.Serie != "" {
+		seg.comando.Serie = ResolverPlantilla(conf.Serie, accion.Parametros, regla, valores)
+	} else {
+		seg.comando.Topico = ResolverPlantilla(conf.Topico, accion.Parametros, regla, valores)
+	}
+
+	mr.comandosMu.Lock()
+	estado := mr.estadoComandosLocked()
+	if estado.detenido {
+		mr.comandosMu.Unlock()
+		return
+	}
+	estado.porID[id] = seg
+	estado.pendientes[seg.clave] = id
+	seg.timer = time.AfterFunc(timeoutConfirmacion(conf), func() { mr.vencerComando(id) })
+
+	var suscribir string
+	if topico := seg.comando.Topico; topico != "" {
+		estado.suscripciones[topico]++
+		if estado.suscripciones[topico] == 1 {
+			suscribir = topico
+		}
+	}
+	cliente := estado.cliente
+	mr.comandosMu.Unlock()
+
+	if suscribir != "" {
+		if cliente == nil {
+			log.Printf("Comando '%s': no hay cliente de confirmación para el tópico '%s'", id, suscribir)
+		} else if err := cliente.Suscribir(suscribir, mr.manejarRetroalimentacion); err != nil {
+			log.Printf("Comando '%s': error suscribiendo a '%s': %v", id, suscribir, err)
+		}
+	}
+}
+
+func timeoutConfirmacion(conf *ConfirmacionAccion) time.Duration {
+	if conf.Timeout > 0 {
+		return conf.Timeout
+	}
+	return timeoutConfirmacionDefecto
+}
+
+// verificarConfirmacionSerie confirma los comandos pendientes que esperan el dato insertado en path
+func (mr *MotorReglas) verificarConfirmacionSerie(path string, dato interface{}) {
+	mr.comandosMu.Lock()
+	if mr.comandos == nil || len(mr.comandos.pendientes) == 0 {
+		mr.comandosMu.Unlock()
+		return
+	}
+
+	var desuscribir []string
+	for _, id := range mr.comandos.pendientes {
+		seg := mr.comandos.porID[id]
+		if seg.comando.Serie == path && valoresCoinciden(dato, seg.comando.Esperado) {
+			desuscribir = append(desuscribir, mr.finalizarComandoLocked(seg, ComandoConfirmado, "")...)
+		}
+	}
+	cliente := mr.comandos.cliente
+	mr.comandosMu.Unlock()
+
+	mr.desuscribirTopicos(cliente, desuscribir)
+}
+
+// manejarRetroalimentacion procesa mensajes recibidos en tópicos de retroalimentación.
+// El payload puede ser un valor JSON, texto plano o un objeto {"comando_id": ..., "valor": ...};
+// si incluye comando_id solo se confirma ese comando.
+func (mr *MotorReglas) manejarRetroalimentacion(topico string, payload []byte) {
+	valor, comandoID := decodificarRetroalimentacion(payload)
+
+	mr.comandosMu.Lock()
+	if mr.comandos == nil {
+		mr.comandosMu.Unlock()
+		return
+	}
+
+	var desuscribir []string
+	for _, id := range mr.comandos.pendientes {
+		seg := mr.comandos.porID[id]
+		if seg.comando.Topico != topico || (comandoID != "" && comandoID != id) {
+			continue
+		}
+		if valoresCoinciden(valor, seg.comando.Esperado) {
+			desuscribir = append(desuscribir, mr.finalizarComandoLocked(seg, ComandoConfirmado, "")...)
+		}
+	}
+	cliente := mr.comandos.cliente
+	mr.comandosMu.Unlock()
+
+	mr.desuscribirTopicos(cliente, desuscribir)
+}
+
+func decodificarRetroalimentacion(payload []byte) (interface{}, string) {
+	var decodificado interface{}
+	if err := json.Unmarshal(payload, &decodificado); err != nil {
+		return strings.TrimSpace(string(payload)), ""
+	}
+
+	objeto, ok := decodificado.(map[string]interface{})
+	if !ok {
+		return decodificado, ""
+	}
+	comandoID, _ := objeto["comando_id"].(string)
+	return objeto["valor"], comandoID
+}
+
+// ConfirmarComando marca manualmente un comando pendiente como confirmado
+func (mr *MotorReglas) ConfirmarComando(id string) error {
+	mr.comandosMu.Lock()
+	seg, err := mr.comandoPendienteLocked(id)
+	if err != nil {
+		mr.comandosMu.Unlock()
+		return err
+	}
+	desuscribir := mr.finalizarComandoLocked(seg, ComandoConfirmado, "")
+	cliente := mr.comandos.cliente
+	mr.comandosMu.Unlock()
+
+	mr.desuscribirTopicos(cliente, desuscribir)
+	return nil
+}
+
+// FallarComando marca manualmente un comando pendiente como fallido y ejecuta su escalamiento
+func (mr *MotorReglas) FallarComando(id, motivo string) error {
+	mr.comandosMu.Lock()
+	seg, err := mr.comandoPendienteLocked(id)
+	if err != nil {
+		mr.comandosMu.Unlock()
+		return err
+	}
+	if motivo == "" {
+		motivo = "marcado como fallido"
+	}
+	desuscribir := mr.finalizarComandoLocked(seg, ComandoFallido, motivo)
+	cliente := mr.comandos.cliente
+	mr.comandosMu.Unlock()
+
+	mr.desuscribirTopicos(cliente, desuscribir)
+	mr.escalarComando(seg)
+	return nil
+}
+
+func (mr *MotorReglas) comandoPendienteLocked(id string) (*seguimientoComando, error) {
+	seg, existe := mr.estadoComandosLocked().porID[id]
+	if !existe {
+		return nil, fmt.Errorf("comando '%s' no encontrado", id)
+	}
+	if seg.comando.Estado != ComandoPendiente {
+		return nil, fmt.Errorf("comando '%s' ya está %s", id, seg.comando.Estado)
+	}
+	return seg, nil
+}
+
+// vencerComando se ejecuta al vencer el timeout de un intento: reintenta o declara el fallo
+func (mr *MotorReglas) vencerComando(id string) {
+	mr.comandosMu.Lock()
+	seg, err := mr.comandoPendienteLocked(id)
+	if err != nil || mr.comandos.detenido {
+		mr.comandosMu.Unlock()
+		return
+	}
+	// detenerComandos espera a que termine el reintento o escalamiento en curso
+	mr.comandos.activos.Add(1)
+	defer mr.comandos.activos.Done()
+
+	conf := seg.accion.Confirmacion
+	if seg.comando.Intentos > conf.Reintentos {
+		motivo := fmt.Sprintf("sin confirmación tras %d intento(s)", seg.comando.Intentos)
+		desuscribir := mr.finalizarComandoLocked(seg, ComandoFallido, motivo)
+		cliente := mr.comandos.cliente
+		mr.comandosMu.Unlock()
+
+		log.Printf("Comando '%s' de regla '%s' fallido: %s", id, seg.comando.ReglaID, motivo)
+		mr.desuscribirTopicos(cliente, desuscribir)
+		mr.escalarComando(seg)
+		return
+	}
+
+	seg.comando.Intentos++
+	intento := seg.comando.Intentos
+	mr.comandosMu.Unlock()
+
+	// Reenviar fuera del lock: el ejecutor puede hacer I/O
+	valores := copiarContexto(seg.valores)
+	errEnvio := mr.registrarResultado(RegistroEjecucion{
+		ReglaID:   seg.comando.ReglaID,
+		Timestamp: time.Now(),
+		Accion:    seg.accion.Tipo,
+		Destino:   seg.accion.Destino,
+		Respuesta: fmt.Sprintf("reintento %d de comando %s", intento-1, id),
+	}, seg.ejecutor(seg.accion, seg.regla, valores))
+
+	mr.comandosMu.Lock()
+	defer mr.comandosMu.Unlock()
+	if seg.comando.Estado != ComandoPendiente || mr.comandos.detenido {
+		return // confirmado o cancelado mientras se reenviaba
+	}
+	seg.comando.Actualizado = time.Now()
+	if errEnvio != nil {
+		seg.comando.Error = errEnvio.Error()
+	}
+	seg.timer = time.AfterFunc(timeoutConfirmacion(conf), func() { mr.vencerComando(id) })
+}
+
+// cancelarComandosRegla cancela sin escalamiento los comandos pendientes de una regla
+// eliminada o reemplazada
+func (mr *MotorReglas) cancelarComandosRegla(reglaID string) {
+	mr.comandosMu.Lock()
+	if mr.comandos == nil {
+		mr.comandosMu.Unlock()
+		return
+	}
+	var desuscribir []string
+	for _, id := range mr.comandos.pendientes {
+		seg := mr.comandos.porID[id]
+		if seg.comando.ReglaID == reglaID {
+			desuscribir = append(desuscribir, mr.finalizarComandoLocked(seg, ComandoCancelado, "regla eliminada o reemplazada")...)
+		}
+	}
+	cliente := mr.comandos.cliente
+	mr.comandosMu.Unlock()
+
+	mr.desuscribirTopicos(cliente, desuscribir)
+}
+
+// detenerComandos detiene los timeouts pendientes y espera los reintentos o
+// escalamientos en curso. Se invoca al cerrar el gestor, antes de cerrar la base.
+func (mr *MotorReglas) detenerComandos() {
+	mr.comandosMu.Lock()
+	estado := mr.estadoComandosLocked()
+	estado.detenido = true
+	for _, id := range estado.pendientes {
+		if seg := estado.porID[id]; seg.timer != nil {
+			seg.timer.Stop()
+		}
+	}
+	mr.comandosMu.Unlock()
+
+	estado.activos.Wait()
+}
+
+// finalizarComandoLocked cambia el estado final de un comando. Requiere mr.comandosMu.
+// Retorna los tópicos que ya no tienen comandos pendientes (para desuscribir fuera del lock).
+func (mr *MotorReglas) finalizarComandoLocked(seg *seguimientoComando, estado EstadoComando, motivo string) []string {
+	if seg.timer != nil {
+		seg.timer.Stop()
+	}
+	seg.comando.Estado = estado
+	seg.comando.Error = motivo
+	seg.comando.Actualizado = time.Now()
+
+	comandos := mr.comandos
+	delete(comandos.pendientes, seg.clave)
+
+	comandos.finalizados = append(comandos.finalizados, seg.comando.ID)
+	if len(comandos.finalizados) > maxComandosFinalizados {
+		delete(comandos.porID, comandos.finalizados[0])
+		comandos.finalizados = comandos.finalizados[1:]
+	}
+
+	var desuscribir []string
+	if topico := seg.comando.Topico; topico != "" {
+		comandos.suscripciones[topico]--
+		if comandos.suscripciones[topico] <= 0 {
+			delete(comandos.suscripciones, topico)
+			desuscribir = append(desuscribir, topico)
+		}
+	}
+	return desuscribir
+}
+
+func (mr *MotorReglas) desuscribirTopicos(cliente middleware.Cliente, topicos []string) {
+	if cliente == nil {
+		return
+	}
+	for _, topico := range topicos {
+		if err := cliente.Desuscribir(topico); err != nil {
+			log.Printf("Error desuscribiendo de '%s': %v", topico, err)
+		}
+	}
+}
+
+// escalarComando ejecuta las acciones de escalamiento de un comando fallido
+func (mr *MotorReglas) escalarComando(seg *seguimientoComando) {
+	for _, accion := range seg.accion.Confirmacion.Escalamiento {
+		mr.mu.RLock()
+		ejecutor, existe := mr.ejecutores[accion.Tipo]
+		mr.mu.RUnlock()
+		if !existe {
+			log.Printf("Ejecutor no encontrado para acción de escalamiento: %s", accion.Tipo)
+			continue
+		}
+
+		valores := copiarContexto(seg.valores)
+		mr.registrarResultado(RegistroEjecucion{
+			ReglaID:   seg.comando.ReglaID,
+			Timestamp: time.Now(),
+			Accion:    accion.Tipo,
+			Destino:   accion.Destino,
+			Respuesta: fmt.Sprintf("escalamiento de comando %s", seg.comando.ID),
+		}, ejecutor(accion, seg.regla, valores))
+	}
+}
+
+func copiarContexto(valores map[string]interface{}) map[string]interface{} {
+	copia := make(map[string]interface{}, len(valores))
+	for k, v := range valores {
+		copia[k] = v
+	}
+	return copia
+}
+
+// valoresCoinciden compara el valor recibido con el esperado.
+// Los números se comparan como float64 y los strings sin distinguir mayúsculas.
+func valoresCoinciden(recibido, esperado interface{}) bool {
+	if r, ok := aFloat64(recibido); ok {
+		e, ok := aFloat64(esperado)
+		return ok && math.Abs(r-e) < 1e-9
+	}
+	switch r := recibido.(type) {
+	case bool:
+		e, ok := esperado.(bool)
+		return ok && r == e
+	case string:
+		e, ok := esperado.(string)
+		return ok && strings.EqualFold(r, e)
+	}
+	return false
+}
+
+func aFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// ObtenerComando retorna el estado de un comando por su ID
+func (mr *MotorReglas) ObtenerComando(id string) (ComandoActuador, error) {
+	mr.comandosMu.Lock()
+	defer mr.comandosMu.Unlock()
+
+	seg, existe := mr.estadoComandosLocked().porID[id]
+	if !existe {
+		return ComandoActuador{}, fmt.Errorf("comando '%s' no encontrado", id)
+	}
+	return seg.comando, nil
+}
+
+// ListarComandos retorna los comandos conocidos, del más antiguo al más reciente.
+// Si reglaID no es vacío, filtra por regla.
+func (mr *MotorReglas) ListarComandos(reglaID string) []ComandoActuador {
+	mr.comandosMu.Lock()
+	defer mr.comandosMu.Unlock()
+
+	comandos := make([]ComandoActuador, 0)
+	for _, seg := range mr.estadoComandosLocked().porID {
+		if reglaID == "" || seg.comando.ReglaID == reglaID {
+			comandos = append(comandos, seg.comando)
+		}
+	}
+	sort.Slice(comandos, func(i, j int) bool {
+		return comandos[i].Creado.Before(comandos[j].Creado)
+	})
+	return comandos
+}
+
+// validarConfirmacion valida la configuración de confirmación de una acción
+func (mr *MotorReglas) validarConfirmacion(conf *ConfirmacionAccion) error {
+	if (conf.Serie == "") == (conf.Topico == "") {
+		return fmt.Errorf("confirmación requiere serie o tópico de retroalimentación (uno solo)")
+	}
+	if conf.Valor == nil {
+		return fmt.Errorf("confirmación requiere el valor esperado")
+	}
+	if conf.Timeout < 0 {
+		return fmt.Errorf("timeout de confirmación no puede ser negativo")
+	}
+	if conf.Reintentos < 0 {
+		return fmt.Errorf("reintentos no puede ser negativo")
+	}
+
+	for i, accion := range conf.Escalamiento {
+		if accion.Confirmacion != nil {
+			return fmt.Errorf("acción de escalamiento %d no puede requerir confirmación", i)
+		}
+		if err := mr.validarAccion(&accion); err != nil {
+			return fmt.Errorf("acción de escalamiento %d inválida: %v", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,530 @@
+package borde
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/google/uuid"
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/tipos"
+)
+
+// Registro de dispositivos y aprovisionamiento.
+//
+// Un dispositivo se anuncia publicando un AnuncioDispositivo en TopicoAnuncioDispositivo
+// (o por la API REST) y queda pendiente. Al aprobarlo, el gestor crea sus series a
+// partir de la plantilla de su TipoDispositivo en dispositivos/<id>/<serie>, le asigna
+// los tópicos de comando dispositivos/<id>/comandos/<comando> y genera su credencial,
+// que se retorna una sola vez: el registro guarda solo su hash. Cada cambio de estado se
+// publica retenido en aprovisionamiento/<id>/estado para que el dispositivo lo conozca.
+//
+// Con SuscribirDispositivos, cualquier publicación de un dispositivo registrado en
+// dispositivos/<id>/..., salvo sus comandos, actualiza su última actividad. La actividad se persiste como
+// mucho una vez por intervaloPersistenciaActividad; tras un reinicio puede perderse el
+// último tramo.
+
+const (
+	TopicoAnuncioDispositivo = "aprovisionamiento/anuncio"
+	prefijoDispositivos      = "dispositivos"
+
+	intervaloPersistenciaActividad = time.Minute
+
+	// maximoDispositivosPendientes acota los anuncios sin resolver: cualquiera puede
+	// anunciarse y cada anuncio nuevo se persiste
+	maximoDispositivosPendientes = 1000
+)
+
+// EstadoDispositivo es la etapa del aprovisionamiento de un dispositivo
+type EstadoDispositivo string
+
+const (
+	DispositivoPendiente EstadoDispositivo = "pendiente"
+	DispositivoAprobado  EstadoDispositivo = "aprobado"
+	DispositivoRechazado EstadoDispositivo = "rechazado"
+)
+
+// TipoDispositivo es la plantilla de un tipo de dispositivo. El Path de cada serie es
+// relativo al dispositivo ("temperatura" -> dispositivos/<id>/temperatura); los valores
+// de compresión y tamaño de bloque vacíos toman los defaults de las series de ingesta.
+type TipoDispositivo struct {
+	Nombre      string        `json:"nombre"`
+	Descripcion string        `json:"descripcion,omitempty"`
+	Series      []tipos.Serie `json:"series"`
+	Comandos    []string      `json:"comandos,omitempty"`
+}
+
+// AnuncioDispositivo es lo que publica un dispositivo para registrarse
+type AnuncioDispositivo struct {
+	ID       string            `json:"id"`
+	Tipo     string            `json:"tipo"`
+	Firmware string            `json:"firmware,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Token    string            `json:"token,omitempty"` // Credencial, requerida si ya está aprobado
+}
+
+// Dispositivo es la entrada del registro
+type Dispositivo struct {
+	ID              string            `json:"id"`
+	Tipo            string            `json:"tipo"`
+	Firmware        string            `json:"firmware,omitempty"`
+	Tags            map[string]string `json:"tags,omitempty"`
+	Estado          EstadoDispositivo `json:"estado"`
+	Credencial      string            `json:"-"` // "sha256:<hex>" del token (vacío hasta la aprobación)
+	Series          []string          `json:"series,omitempty"`
+	TopicosComando  []string          `json:"topicos_comando,omitempty"`
+	Anunciado       time.Time         `json:"anunciado"`
+	Aprobado        time.Time         `json:"aprobado"`
+	UltimaActividad time.Time         `json:"ultima_actividad"`
+}
+
+// registroDispositivos mantiene en memoria el registro persistido en Pebble
+type registroDispositivos struct {
+	mu           sync.RWMutex
+	dispositivos map[string]*Dispositivo
+	tipos        map[string]TipoDispositivo
+	persistido   map[string]time.Time // última persistencia de la actividad por dispositivo
+	cliente      middleware.Cliente   // publica los cambios de estado (nil = sin publicación)
+}
+
+func generarClaveDispositivo(id string) []byte {
+	return []byte("dispositivos/" + id)
+}
+
+func generarClaveTipoDispositivo(nombre string) []byte {
+	return []byte("tipos_dispositivo/" + nombre)
+}
+
+// cargarRegistroDispositivos lee los dispositivos y tipos guardados
+func cargarRegistroDispositivos(db *pebble.DB) (*registroDispositivos, error) {
+	r := &registroDispositivos{
+		dispositivos: make(map[string]*Dispositivo),
+		tipos:        make(map[string]TipoDispositivo),
+		persistido:   make(map[string]time.Time),
+	}
+	err := iterarPrefijo(db, "dispositivos/", func(valor []byte) {
+		var d Dispositivo
+		if err := tipos.DeserializarGob(valor, &d); err == nil {
+			r.dispositivos[d.ID] = &d
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = iterarPrefijo(db, "tipos_dispositivo/", func(valor []byte) {
+		var t TipoDispositivo
+		if err := tipos.DeserializarGob(valor, &t); err == nil {
+			r.tipos[t.Nombre] = t
+		}
+	})
+	return r, err
+}
+
+// iterarPrefijo recorre los valores de las claves "<prefijo>..." (prefijo termina en '/')
+func iterarPrefijo(db *pebble.DB, prefijo string, procesar func(valor []byte)) error {
+	iter, err := db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefijo),
+		UpperBound: []byte(strings.TrimSuffix(prefijo, "/") + "0"),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		procesar(iter.Value())
+	}
+	return iter.Error()
+}
+
+// guardarDispositivo persiste el dispositivo. Requiere me.dispositivos.mu.
+func (me *GestorBorde) guardarDispositivo(d *Dispositivo) error {
+	datos, err := tipos.SerializarGob(d)
+	if err != nil {
+		return fmt.Errorf("error al serializar dispositivo: %v", err)
+	}
+	if err := me.db.Set(generarClaveDispositivo(d.ID), datos, pebble.Sync); err != nil {
+		return fmt.Errorf("error al guardar dispositivo: %v", err)
+	}
+	me.dispositivos.persistido[d.ID] = d.UltimaActividad
+	return nil
+}
+
+// RegistrarTipoDispositivo agrega o reemplaza la plantilla de un tipo de dispositivo.
+// Reemplazarla no modifica las series de los dispositivos ya aprobados.
+func (me *GestorBorde) RegistrarTipoDispositivo(t TipoDispositivo) error {
+	if !esPathValido(t.Nombre) || strings.Contains(t.Nombre, "/") {
+		return fmt.Errorf("nombre de tipo de dispositivo inválido: '%s'", t.Nombre)
+	}
+	nombres := make(map[string]bool)
+	for _, s := range t.Series {
+		if !esPathValido(s.Path) {
+			return fmt.Errorf("tipo '%s': path de serie inválido: '%s'", t.Nombre, s.Path)
+		}
+		if s.TipoDatos == tipos.Desconocido {
+			return fmt.Errorf("tipo '%s': la serie '%s' no tiene tipo de datos", t.Nombre, s.Path)
+		}
+		if nombres[s.Path] {
+			return fmt.Errorf("tipo '%s': serie '%s' duplicada", t.Nombre, s.Path)
+		}
+		nombres[s.Path] = true
+	}
+	for _, c := range t.Comandos {
+		if !esPathValido(c) {
+			return fmt.Errorf("tipo '%s': comando inválido: '%s'", t.Nombre, c)
+		}
+	}
+
+	datos, err := tipos.SerializarGob(t)
+	if err != nil {
+		return fmt.Errorf("error al serializar tipo de dispositivo: %v", err)
+	}
+	me.dispositivos.mu.Lock()
+	defer me.dispositivos.mu.Unlock()
+	if err := me.db.Set(generarClaveTipoDispositivo(t.Nombre), datos, pebble.Sync); err != nil {
+		return fmt.Errorf("error al guardar tipo de dispositivo: %v", err)
+	}
+	me.dispositivos.tipos[t.Nombre] = t
+	return nil
+}
+
+// ListarTiposDispositivo retorna las plantillas registradas ordenadas por nombre
+func (me *GestorBorde) ListarTiposDispositivo() []TipoDispositivo {
+	me.dispositivos.mu.RLock()
+	defer me.dispositivos.mu.RUnlock()
+	lista := make([]TipoDispositivo, 0, len(me.dispositivos.tipos))
+	for _, t := range me.dispositivos.tipos {
+		lista = append(lista, t)
+	}
+	sort.Slice(lista, func(i, j int) bool { return lista[i].Nombre < lista[j].Nombre })
+	return lista
+}
+
+// AnunciarDispositivo registra un dispositivo como pendiente. Si ya está registrado,
+// actualiza su firmware y tags y conserva su estado; un dispositivo aprobado debe
+// presentar su credencial en el anuncio.
+func (me *GestorBorde) AnunciarDispositivo(anuncio AnuncioDispositivo) (Dispositivo, error) {
+	if !esPathValido(anuncio.ID) || strings.Contains(anuncio.ID, "/") {
+		return Dispositivo{}, fmt.Errorf("id de dispositivo inválido: '%s'", anuncio.ID)
+	}
+	if anuncio.Tipo == "" {
+		return Dispositivo{}, fmt.Errorf("el dispositivo '%s' no indica su tipo", anuncio.ID)
+	}
+
+	me.dispositivos.mu.Lock()
+	defer me.dispositivos.mu.Unlock()
+	ahora := time.Now()
+	d, existe := me.dispositivos.dispositivos[anuncio.ID]
+	if existe {
+		if d.Tipo != anuncio.Tipo {
+			return Dispositivo{}, fmt.Errorf("el dispositivo '%s' ya está registrado con tipo '%s'", anuncio.ID, d.Tipo)
+		}
+		if d.Estado == DispositivoAprobado && !credencialValida(d, anuncio.Token) {
+			return Dispositivo{}, fmt.Errorf("credencial inválida para el dispositivo '%s'", anuncio.ID)
+		}
+		d.Firmware = anuncio.Firmware
+		if anuncio.Tags != nil {
+			d.Tags = anuncio.Tags
+		}
+		d.UltimaActividad = ahora
+	} else {
+		if me.dispositivos.pendientes() >= maximoDispositivosPendientes {
+			return Dispositivo{}, fmt.Errorf("hay %d dispositivos pendientes de aprobación, se rechaza '%s'", maximoDispositivosPendientes, anuncio.ID)
+		}
+		d = &Dispositivo{
+			ID:              anuncio.ID,
+			Tipo:            anuncio.Tipo,
+			Firmware:        anuncio.Firmware,
+			Tags:            anuncio.Tags,
+			Estado:          DispositivoPendiente,
+			Anunciado:       ahora,
+			UltimaActividad: ahora,
+		}
+	}
+	if err := me.guardarDispositivo(d); err != nil {
+		return Dispositivo{}, err
+	}
+	me.dispositivos.dispositivos[d.ID] = d
+	if !existe {
+		log.Printf("Dispositivo '%s' (%s) anunciado, pendiente de aprobación", d.ID, d.Tipo)
+		me.publicarEstadoDispositivo(d)
+	} else {
+		// Un dispositivo que vuelve a anunciarse se reinició: recibe su estado deseado
+		me.publicarDeltasDispositivo(d.ID)
+	}
+	return copiarDispositivo(d), nil
+}
+
+// AprobarDispositivo crea las series del dispositivo según su tipo y genera su
+// credencial. Retorna el token, que no vuelve a estar disponible.
+func (me *GestorBorde) AprobarDispositivo(id string) (string, error) {
+	me.dispositivos.mu.Lock()
+	defer me.dispositivos.mu.Unlock()
+	d, existe := me.dispositivos.dispositivos[id]
+	if !existe {
+		return "", fmt.Errorf("dispositivo '%s' no encontrado", id)
+	}
+	if d.Estado == DispositivoAprobado {
+		return "", fmt.Errorf("el dispositivo '%s' ya está aprobado", id)
+	}
+	tipo, existe := me.dispositivos.tipos[d.Tipo]
+	if !existe {
+		return "", fmt.Errorf("tipo de dispositivo '%s' no registrado", d.Tipo)
+	}
+
+	// CrearSerie no modifica las series existentes: re-aprobar tras un rechazo es seguro
+	series := make([]string, 0, len(tipo.Series))
+	for _, plantilla := range tipo.Series {
+		serie := serieDeDispositivo(d, plantilla)
+		if err := me.CrearSerie(serie); err != nil {
+			return "", fmt.Errorf("dispositivo '%s': %v", id, err)
+		}
+		series = append(series, serie.Path)
+	}
+	comandos := make([]string, 0, len(tipo.Comandos))
+	for _, c := range tipo.Comandos {
+		comandos = append(comandos, topicoComandoDispositivo(id, c))
+	}
+
+	token := uuid.New().String()
+	aprobado := *d
+	aprobado.Estado = DispositivoAprobado
+	aprobado.Aprobado = time.Now()
+	aprobado.Credencial = hashCredencial(token)
+	aprobado.Series = series
+	aprobado.TopicosComando = comandos
+	if err := me.guardarDispositivo(&aprobado); err != nil {
+		return "", err
+	}
+	*d = aprobado
+	log.Printf("Dispositivo '%s' aprobado: %d series, %d comandos", id, len(series), len(comandos))
+	me.publicarEstadoDispositivo(d)
+	return token, nil
+}
+
+// RechazarDispositivo rechaza un dispositivo y revoca su credencial. Sus series se
+// conservan con los datos ya recibidos.
+func (me *GestorBorde) RechazarDispositivo(id string) error {
+	me.dispositivos.mu.Lock()
+	defer me.dispositivos.mu.Unlock()
+	d, existe := me.dispositivos.dispositivos[id]
+	if !existe {
+		return fmt.Errorf("dispositivo '%s' no encontrado", id)
+	}
+	rechazado := *d
+	rechazado.Estado = DispositivoRechazado
+	rechazado.Credencial = ""
+	if err := me.guardarDispositivo(&rechazado); err != nil {
+		return err
+	}
+	*d = rechazado
+	log.Printf("Dispositivo '%s' rechazado", id)
+	me.publicarEstadoDispositivo(d)
+	return nil
+}
+
+// EliminarDispositivo quita el dispositivo del registro. Sus series no se eliminan
+// (ver EliminarSerie).
+func (me *GestorBorde) EliminarDispositivo(id string) error {
+	me.dispositivos.mu.Lock()
+	defer me.dispositivos.mu.Unlock()
+	if _, existe := me.dispositivos.dispositivos[id]; !existe {
+		return fmt.Errorf("dispositivo '%s' no encontrado", id)
+	}
+	if err := me.db.Delete(generarClaveDispositivo(id), pebble.Sync); err != nil {
+		return fmt.Errorf("error al eliminar dispositivo: %v", err)
+	}
+	delete(me.dispositivos.dispositivos, id)
+	delete(me.dispositivos.persistido, id)
+	return nil
+}
+
+// ObtenerDispositivo retorna un dispositivo del registro
+func (me *GestorBorde) ObtenerDispositivo(id string) (Dispositivo, error) {
+	me.dispositivos.mu.RLock()
+	defer me.dispositivos.mu.RUnlock()
+	d, existe := me.dispositivos.dispositivos[id]
+	if !existe {
+		return Dispositivo{}, fmt.Errorf("dispositivo '%s' no encontrado", id)
+	}
+	return copiarDispositivo(d), nil
+}
+
+// ListarDispositivos retorna los dispositivos ordenados por ID, filtrados por estado
+// si estado no es vacío
+func (me *GestorBorde) ListarDispositivos(estado EstadoDispositivo) []Dispositivo {
+	me.dispositivos.mu.RLock()
+	defer me.dispositivos.mu.RUnlock()
+	lista := make([]Dispositivo, 0, len(me.dispositivos.dispositivos))
+	for _, d := range me.dispositivos.dispositivos {
+		if estado == "" || d.Estado == estado {
+			lista = append(lista, copiarDispositivo(d))
+		}
+	}
+	sort.Slice(lista, func(i, j int) bool { return lista[i].ID < lista[j].ID })
+	return lista
+}
+
+// VerificarCredencialDispositivo indica si el token corresponde a un dispositivo aprobado
+func (me *GestorBorde) VerificarCredencialDispositivo(id, token string) bool {
+	me.dispositivos.mu.RLock()
+	defer me.dispositivos.mu.RUnlock()
+	d, existe := me.dispositivos.dispositivos[id]
+	return existe && credencialValida(d, token)
+}
+
+// credencialValida indica si el token corresponde al dispositivo aprobado d
+func credencialValida(d *Dispositivo, token string) bool {
+	if d.Estado != DispositivoAprobado || d.Credencial == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(d.Credencial), []byte(hashCredencial(token))) == 1
+}
+
+// pendientes cuenta los dispositivos sin resolver. Requiere mu.
+func (r *registroDispositivos) pendientes() int {
+	n := 0
+	for _, d := range r.dispositivos {
+		if d.Estado == DispositivoPendiente {
+			n++
+		}
+	}
+	return n
+}
+
+// SuscribirDispositivos escucha los anuncios en TopicoAnuncioDispositivo y el tráfico
+// de los dispositivos en dispositivos/# para actualizar su última actividad. Los
+// comandos en dispositivos/<id>/comandos/... van hacia el dispositivo y no cuentan como
+// actividad. El cliente también publica los cambios de estado del aprovisionamiento.
+func (me *GestorBorde) SuscribirDispositivos(cliente middleware.Cliente) error {
+	if cliente == nil {
+		return fmt.Errorf("se requiere un cliente del middleware para el registro de dispositivos")
+	}
+	me.dispositivos.mu.Lock()
+	me.dispositivos.cliente = cliente
+	me.dispositivos.mu.Unlock()
+
+	err := cliente.Suscribir(TopicoAnuncioDispositivo, func(topico string, payload []byte) {
+		var anuncio AnuncioDispositivo
+		if err := json.Unmarshal(payload, &anuncio); err != nil {
+			log.Printf("Anuncio de dispositivo inválido: %v", err)
+			return
+		}
+		if _, err := me.AnunciarDispositivo(anuncio); err != nil {
+			log.Printf("Anuncio de dispositivo rechazado: %v", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return cliente.Suscribir(prefijoDispositivos+"/#", func(topico string, _ []byte) {
+		partes := splitTopic(topico)
+		esComando := len(partes) >= 3 && partes[2] == "comandos"
+		if len(partes) >= 2 && partes[0] == prefijoDispositivos && !esComando {
+			me.registrarActividadDispositivo(partes[1], time.Now())
+		}
+	})
+}
+
+// registrarActividadDispositivo actualiza la última actividad de un dispositivo
+// registrado. Si el dispositivo estuvo inactivo más de umbralReconexionDispositivo se
+// considera que reconectó y se le publican los deltas de sus sombras.
+func (me *GestorBorde) registrarActividadDispositivo(id string, momento time.Time) {
+	me.dispositivos.mu.Lock()
+	defer me.dispositivos.mu.Unlock()
+	d, existe := me.dispositivos.dispositivos[id]
+	if !existe || !momento.After(d.UltimaActividad) {
+		return
+	}
+	if momento.Sub(d.UltimaActividad) >= umbralReconexionDispositivo {
+		me.publicarDeltasDispositivo(id)
+	}
+	d.UltimaActividad = momento
+	if momento.Sub(me.dispositivos.persistido[id]) < intervaloPersistenciaActividad {
+		return
+	}
+	if err := me.guardarDispositivo(d); err != nil {
+		log.Printf("Dispositivo '%s': %v", id, err)
+	}
+}
+
+// publicarEstadoDispositivo informa el estado al dispositivo. Requiere me.dispositivos.mu.
+func (me *GestorBorde) publicarEstadoDispositivo(d *Dispositivo) {
+	cliente := me.dispositivos.cliente
+	if cliente == nil {
+		return
+	}
+	estado, _ := json.Marshal(map[string]string{"id": d.ID, "estado": string(d.Estado)})
+	topico := fmt.Sprintf("aprovisionamiento/%s/estado", d.ID)
+	go func() {
+		if err := cliente.Publicar(topico, estado, middleware.ConRetencion()); err != nil {
+			log.Printf("Dispositivo '%s': error publicando estado: %v", d.ID, err)
+		}
+	}()
+}
+
+// serieDeDispositivo instancia la plantilla de una serie para el dispositivo
+func serieDeDispositivo(d *Dispositivo, plantilla tipos.Serie) tipos.Serie {
+	serie := plantilla
+	serie.SerieId = 0
+	serie.Path = prefijoDispositivos + "/" + d.ID + "/" + plantilla.Path
+	if serie.TamañoBloque <= 0 {
+		serie.TamañoBloque = 100
+	}
+	if serie.CompresionBytes == "" {
+		serie.CompresionBytes = tipos.SinCompresion
+	}
+	if serie.CompresionBloque == "" {
+		serie.CompresionBloque = tipos.LZ4
+	}
+	serie.Tags = make(map[string]string, len(plantilla.Tags)+2)
+	for k, v := range plantilla.Tags {
+		serie.Tags[k] = v
+	}
+	serie.Tags["dispositivo"] = d.ID
+	serie.Tags["tipo_dispositivo"] = d.Tipo
+	return serie
+}
+
+func topicoComandoDispositivo(id, comando string) string {
+	return prefijoDispositivos + "/" + id + "/comandos/" + comando
+}
+
+func hashCredencial(token string) string {
+	suma := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(suma[:])
+}
+
+func copiarDispositivo(d *Dispositivo) Dispositivo {
+	copia := *d
+	copia.Series = append([]string(nil), d.Series...)
+	copia.TopicosComando = append([]string(nil), d.TopicosComando...)
+	if d.Tags != nil {
+		copia.Tags = make(map[string]string, len(d.Tags))
+		for k, v := range d.Tags {
+			copia.Tags[k] = v
+		}
+	}
+	return copia
+}
+
+// parsearTipoDispositivoDesdeMapa convierte un mapa genérico (JSON con la forma de
+// TipoDispositivo) recibido por el plano de control
+func parsearTipoDispositivoDesdeMapa(m map[string]interface{}) (TipoDispositivo, error) {
+	var t TipoDispositivo
+	data, err := json.Marshal(m)
+	if err == nil {
+		err = json.Unmarshal(data, &t)
+	}
+	if err != nil {
+		return TipoDispositivo{}, fmt.Errorf("tipo de dispositivo inválido: %v", err)
+	}
+	return t, nil
+}
@@ -0,0 +1,209 @@
+package borde
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/tipos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tipoSensorClima() TipoDispositivo {
+	return TipoDispositivo{
+		Nombre: "clima",
+		Series: []tipos.Serie{
+			{Path: "temperatura", TipoDatos: tipos.Real, Tags: map[string]string{"unidad": "C"}},
+			{Path: "humedad", TipoDatos: tipos.Real},
+		},
+		Comandos: []string{"reiniciar"},
+	}
+}
+
+func TestDispositivos_Aprovisionamiento(t *testing.T) {
+	gestor := crearGestorIngesta(t)
+	require.NoError(t, gestor.RegistrarTipoDispositivo(tipoSensorClima()))
+
+	d, err := gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala1", Tipo: "clima", Firmware: "1.0"})
+	require.NoError(t, err)
+	assert.Equal(t, DispositivoPendiente, d.Estado)
+	assert.Empty(t, d.Series)
+	assert.Len(t, gestor.ListarDispositivos(DispositivoPendiente), 1)
+
+	token, err := gestor.AprobarDispositivo("sala1")
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+
+	d, err = gestor.ObtenerDispositivo("sala1")
+	require.NoError(t, err)
+	assert.Equal(t, DispositivoAprobado, d.Estado)
+	assert.Equal(t, []string{"dispositivos/sala1/temperatura", "dispositivos/sala1/humedad"}, d.Series)
+	assert.Equal(t, []string{"dispositivos/sala1/comandos/reiniciar"}, d.TopicosComando)
+	assert.NotContains(t, d.Credencial, token, "solo se guarda el hash del token")
+
+	serie, err := gestor.ObtenerSeries("dispositivos/sala1/temperatura")
+	require.NoError(t, err)
+	assert.Equal(t, tipos.Real, serie.TipoDatos)
+	assert.Equal(t, map[string]string{"unidad": "C", "dispositivo": "sala1", "tipo_dispositivo": "clima"}, serie.Tags)
+	require.NoError(t, gestor.Insertar("dispositivos/sala1/temperatura", time.Now().UnixNano(), 21.5))
+
+	assert.True(t, gestor.VerificarCredencialDispositivo("sala1", token))
+	assert.False(t, gestor.VerificarCredencialDispositivo("sala1", "otro"))
+
+	// Un dispositivo aprobado solo se vuelve a anunciar con su credencial
+	_, err = gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala1", Tipo: "clima", Firmware: "6.6.6"})
+	assert.Error(t, err, "anuncio sin credencial")
+	d, err = gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala1", Tipo: "clima", Firmware: "1.1", Token: token})
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", d.Firmware)
+
+	_, err = gestor.AprobarDispositivo("sala1")
+	assert.Error(t, err, "ya aprobado")
+
+	require.NoError(t, gestor.RechazarDispositivo("sala1"))
+	assert.False(t, gestor.VerificarCredencialDispositivo("sala1", token), "rechazar revoca la credencial")
+
+	require.NoError(t, gestor.EliminarDispositivo("sala1"))
+	_, err = gestor.ObtenerDispositivo("sala1")
+	assert.Error(t, err)
+	_, err = gestor.ObtenerSeries("dispositivos/sala1/temperatura")
+	assert.NoError(t, err, "las series del dispositivo se conservan")
+}
+
+func TestDispositivos_Validaciones(t *testing.T) {
+	gestor := crearGestorIngesta(t)
+
+	assert.Error(t, gestor.RegistrarTipoDispositivo(TipoDispositivo{Nombre: "a/b"}))
+	assert.Error(t, gestor.RegistrarTipoDispositivo(TipoDispositivo{Nombre: "x", Series: []tipos.Serie{{Path: "t"}}}), "sin tipo de datos")
+	assert.Error(t, gestor.RegistrarTipoDispositivo(TipoDispositivo{Nombre: "x", Series: []tipos.Serie{
+		{Path: "t", TipoDatos: tipos.Real}, {Path: "t", TipoDatos: tipos.Real},
+	}}), "serie duplicada")
+
+	_, err := gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "a/b", Tipo: "clima"})
+	assert.Error(t, err)
+	_, err = gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala1"})
+	assert.Error(t, err, "sin tipo")
+
+	_, err = gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala1", Tipo: "clima"})
+	require.NoError(t, err)
+	_, err = gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala1", Tipo: "otro"})
+	assert.Error(t, err, "cambio de tipo")
+	_, err = gestor.AprobarDispositivo("sala1")
+	assert.Error(t, err, "tipo no registrado")
+	_, err = gestor.AprobarDispositivo("inexistente")
+	assert.Error(t, err)
+
+	// Los anuncios pendientes están acotados
+	for i := 1; i < maximoDispositivosPendientes; i++ {
+		_, err = gestor.AnunciarDispositivo(AnuncioDispositivo{ID: fmt.Sprintf("d%d", i), Tipo: "clima"})
+		require.NoError(t, err)
+	}
+	_, err = gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "uno-mas", Tipo: "clima"})
+	assert.Error(t, err, "límite de pendientes")
+	_, err = gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala1", Tipo: "clima", Firmware: "2.0"})
+	assert.NoError(t, err, "un pendiente puede volver a anunciarse")
+}
+
+func TestDispositivos_PersistenciaEntreReinicios(t *testing.T) {
+	nombreDB := t.TempDir() + "/dispositivos.db"
+	gestor, err := Crear(Opciones{NombreDB: nombreDB, Direccion: "localhost"})
+	require.NoError(t, err)
+	require.NoError(t, gestor.RegistrarTipoDispositivo(tipoSensorClima()))
+	_, err = gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala1", Tipo: "clima", Firmware: "1.0"})
+	require.NoError(t, err)
+	_, err = gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala2", Tipo: "clima"})
+	require.NoError(t, err)
+	token, err := gestor.AprobarDispositivo("sala1")
+	require.NoError(t, err)
+	gestor.Cerrar()
+
+	gestor, err = Crear(Opciones{NombreDB: nombreDB, Direccion: "localhost"})
+	require.NoError(t, err)
+	defer gestor.Cerrar()
+
+	assert.Len(t, gestor.ListarTiposDispositivo(), 1)
+	lista := gestor.ListarDispositivos("")
+	require.Len(t, lista, 2)
+	assert.Equal(t, "sala1", lista[0].ID)
+	assert.Equal(t, DispositivoAprobado, lista[0].Estado)
+	assert.Equal(t, "1.0", lista[0].Firmware)
+	assert.Equal(t, DispositivoPendiente, lista[1].Estado)
+	assert.True(t, gestor.VerificarCredencialDispositivo("sala1", token))
+}
+
+func TestDispositivos_TraficoMiddleware(t *testing.T) {
+	gestor := crearGestorIngesta(t)
+	cliente := &clienteIngestaMock{manejadores: make(map[string]middleware.CallbackFunc)}
+	require.NoError(t, gestor.SuscribirDispositivos(cliente))
+
+	anuncio, _ := json.Marshal(AnuncioDispositivo{ID: "sala1", Tipo: "clima"})
+	cliente.manejadores[TopicoAnuncioDispositivo](TopicoAnuncioDispositivo, anuncio)
+	cliente.manejadores[TopicoAnuncioDispositivo](TopicoAnuncioDispositivo, []byte("no es json"))
+
+	d, err := gestor.ObtenerDispositivo("sala1")
+	require.NoError(t, err)
+	assert.Equal(t, DispositivoPendiente, d.Estado)
+	anterior := d.UltimaActividad
+
+	time.Sleep(time.Millisecond)
+	cliente.manejadores["dispositivos/#"]("dispositivos/sala1/temperatura", []byte("21.5"))
+	cliente.manejadores["dispositivos/#"]("dispositivos/desconocido/temperatura", []byte("1"))
+
+	d, err = gestor.ObtenerDispositivo("sala1")
+	require.NoError(t, err)
+	assert.True(t, d.UltimaActividad.After(anterior))
+
+	// Un comando hacia el dispositivo no es actividad del dispositivo
+	anterior = d.UltimaActividad
+	time.Sleep(time.Millisecond)
+	cliente.manejadores["dispositivos/#"]("dispositivos/sala1/comandos/reiniciar", []byte("{}"))
+	d, err = gestor.ObtenerDispositivo("sala1")
+	require.NoError(t, err)
+	assert.Equal(t, anterior, d.UltimaActividad)
+	assert.Len(t, gestor.ListarDispositivos(""), 1, "el tráfico no registra dispositivos")
+}
+
+// TestEjecutarComando_Dispositivos verifica la gestión de dispositivos por el plano de control federado
+func TestEjecutarComando_Dispositivos(t *testing.T) {
+	gestor := crearGestorIngesta(t)
+	f := &federacionMQTT{gestor: gestor}
+
+	var mapa map[string]interface{}
+	datos, _ := json.Marshal(tipoSensorClima())
+	require.NoError(t, json.Unmarshal(datos, &mapa))
+	_, err := f.ejecutarComando(tipos.SolicitudControlComando{
+		Operacion:  tipos.OpTipoDispositivoRegistrar,
+		Argumentos: tipos.ComandoArgs{TipoDispositivo: mapa},
+	})
+	require.NoError(t, err)
+	require.Len(t, gestor.ListarTiposDispositivo(), 1)
+	assert.Len(t, gestor.ListarTiposDispositivo()[0].Series, 2)
+
+	_, err = gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala1", Tipo: "clima"})
+	require.NoError(t, err)
+
+	resultado, err := f.ejecutarComando(tipos.SolicitudControlComando{
+		Operacion:  tipos.OpDispositivoListar,
+		Argumentos: tipos.ComandoArgs{Estado: string(DispositivoPendiente)},
+	})
+	require.NoError(t, err)
+	assert.Len(t, resultado, 1)
+
+	resultado, err = f.ejecutarComando(tipos.SolicitudControlComando{
+		Operacion:  tipos.OpDispositivoAprobar,
+		Argumentos: tipos.ComandoArgs{DispositivoID: "sala1"},
+	})
+	require.NoError(t, err)
+	token := resultado.(map[string]string)["token"]
+	assert.True(t, gestor.VerificarCredencialDispositivo("sala1", token))
+
+	_, err = f.ejecutarComando(tipos.SolicitudControlComando{
+		Operacion:  tipos.OpDispositivoEliminar,
+		Argumentos: tipos.ComandoArgs{DispositivoID: "sala1"},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, gestor.ListarDispositivos(""))
+}
@@ -4,17 +4,25 @@
 package borde
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sensorwave-dev/sensorwave/middleware"
 	"github.com/sensorwave-dev/sensorwave/middleware/cliente_coap"
 	clientehttp "github.com/sensorwave-dev/sensorwave/middleware/cliente_http"
 	"github.com/sensorwave-dev/sensorwave/middleware/cliente_mqtt"
+	"github.com/sensorwave-dev/sensorwave/tipos"
 )
 
 // PayloadActuador define la estructura estándar para mensajes de actuadores.
@@ -29,6 +37,10 @@ type PayloadActuador struct {
 	// ReglaID identifica la regla que generó este comando
 	ReglaID string `json:"regla_id"`
 
+	// ComandoID identifica el comando cuando la acción requiere confirmación.
+	// El actuador puede incluirlo en su respuesta para facilitar el seguimiento.
+	ComandoID string `json:"comando_id,omitempty"`
+
 	// Parametros contiene parámetros adicionales del comando
 	// (ej: velocidad, nivel, duración)
 	Parametros map[string]string `json:"parametros,omitempty"`
@@ -121,6 +133,9 @@ var variablesContexto = map[string]bool{
 	"serie_5":      true,
 	"regla_id":     true,
 	"regla_nombre": true,
+	"valor":        true,
+	"timestamp":    true,
+	"comando_id":   true,
 }
 
 // ValidarVariablesRequeridas verifica que las variables en la plantilla
@@ -130,6 +145,7 @@ var variablesContexto = map[string]bool{
 // Variables de contexto (no requieren estar en params):
 //   - serie, serie_0, serie_1, ... (segmentos del path de la serie)
 //   - regla_id, regla_nombre
+//   - valor (último valor de la serie principal), timestamp (RFC 3339)
 func ValidarVariablesRequeridas(plantilla string, params map[string]string) error {
 	variables := ExtraerVariables(plantilla)
 	var faltantes []string
@@ -153,12 +169,63 @@ func ValidarVariablesRequeridas(plantilla string, params map[string]string) erro
 	return nil
 }
 
+// variablesSinResolver retorna las variables de la plantilla que ResolverPlantilla
+// reemplazaría por vacío: las que no están en params ni tienen valor en el contexto.
+func variablesSinResolver(plantilla string, params map[string]string, regla *Regla, contexto map[string]interface{}) []string {
+	resultado := plantilla
+	for clave, valor := range params {
+		resultado = strings.ReplaceAll(resultado, "{"+clave+"}", valor)
+	}
+	var faltantes []string
+	for _, v := range ExtraerVariables(resultado) {
+		if !variableEnContexto(v, regla, contexto) {
+			faltantes = append(faltantes, v)
+		}
+	}
+	return faltantes
+}
+
+// variableEnContexto indica si la variable de contexto tiene valor en esta ejecución
+func variableEnContexto(nombre string, regla *Regla, contexto map[string]interface{}) bool {
+	_, ok := valorVariableContexto(nombre, regla, contexto)
+	return ok
+}
+
+// valorVariableContexto retorna el valor de una variable de contexto en esta ejecución;
+// {timestamp} se da en RFC 3339 como en ResolverPlantilla
+func valorVariableContexto(nombre string, regla *Regla, contexto map[string]interface{}) (interface{}, bool) {
+	switch nombre {
+	case "regla_id", "regla_nombre":
+		if regla == nil {
+			return nil, false
+		}
+		if nombre == "regla_id" {
+			return regla.ID, true
+		}
+		return regla.Nombre, true
+	case "valor":
+		v, ok := contexto["_valor"]
+		return v, ok
+	case "timestamp":
+		ts, ok := contexto["_timestamp"].(time.Time)
+		if !ok {
+			return nil, false
+		}
+		return ts.Format(time.RFC3339Nano), true
+	}
+	if !variablesContexto[nombre] {
+		return nil, false
+	}
+	v, ok := contexto["_"+nombre].(string)
+	return v, ok
+}
+
 // ResolverPlantilla reemplaza las variables {nombre} en una plantilla
 // con valores de params y del contexto de ejecución.
 //
 // Orden de resolución:
 //  1. Variables de params: {nombre} → params["nombre"]
-//  2. Variables de contexto: {serie}, {serie_0}, {regla_id}, etc.
+//  2. Variables de contexto: {serie}, {serie_0}, {regla_id}, {valor}, {timestamp}, etc.
 //  3. Variables no resueltas se reemplazan con string vacío
 //
 // Ejemplo:
@@ -196,6 +263,17 @@ func ResolverPlantilla(plantilla string, params map[string]string, regla *Regla,
 				resultado = strings.ReplaceAll(resultado, placeholder, valor)
 			}
 		}
+
+		// Valor de la serie principal y momento de evaluación
+		if valor, ok := contexto["_valor"]; ok {
+			resultado = strings.ReplaceAll(resultado, "{valor}", fmt.Sprint(valor))
+		}
+		if ts, ok := contexto["_timestamp"].(time.Time); ok {
+			resultado = strings.ReplaceAll(resultado, "{timestamp}", ts.Format(time.RFC3339Nano))
+		}
+		if id, ok := contexto["_comando_id"].(string); ok {
+			resultado = strings.ReplaceAll(resultado, "{comando_id}", id)
+		}
 	}
 
 	// 4. Reemplazar variables no resueltas con string vacío
@@ -239,6 +317,7 @@ func CrearEjecutorPublicar(cliente middleware.Cliente) EjecutorAccion {
 			Comando:     accion.Parametros["comando"],
 			MarcaTiempo: time.Now(),
 			ReglaID:     regla.ID,
+			ComandoID:   comandoIDDesdeContexto(valores),
 			Parametros:  filtrarParametrosInternos(accion.Parametros),
 			Contexto:    filtrarContextoPublico(valores),
 		}
@@ -274,6 +353,12 @@ func filtrarParametrosInternos(params map[string]string) map[string]string {
 	return resultado
 }
 
+// comandoIDDesdeContexto retorna el ID de comando asignado por el motor (si la acción requiere confirmación)
+func comandoIDDesdeContexto(contexto map[string]interface{}) string {
+	id, _ := contexto["_comando_id"].(string)
+	return id
+}
+
 // filtrarContextoPublico excluye metadatos internos del contexto
 func filtrarContextoPublico(contexto map[string]interface{}) map[string]interface{} {
 	resultado := make(map[string]interface{})
@@ -286,6 +371,641 @@ func filtrarContextoPublico(contexto map[string]interface{}) map[string]interfac
 	return resultado
 }
 
+// --- Ejecutor webhook ---
+
+// Parámetros reconocidos por el ejecutor webhook en Accion.Parametros
+const (
+	paramWebhookMetodo      = "metodo"       // Método HTTP (default POST)
+	paramWebhookCuerpo      = "cuerpo"       // Plantilla JSON del cuerpo (default: PayloadActuador)
+	paramWebhookTimeout     = "timeout"      // Timeout de la solicitud, formato time.Duration (default 10s)
+	paramWebhookContentType = "content_type" // Content-Type del cuerpo (default application/json)
+	prefijoWebhookHeader    = "header_"      // header_<Nombre>: plantilla del header <Nombre>
+)
+
+const (
+	timeoutWebhookDefecto    = 10 * time.Second
+	tamanoMaximoRespuestaLog = 512 // bytes de la respuesta que se guardan en el historial
+	maxWebhooksEnCurso       = 64  // webhooks del motor esperando respuesta a la vez
+)
+
+// CrearEjecutorWebhook crea un ejecutor que envía una solicitud HTTP a una URL arbitraria.
+// Si cliente es nil se usa un http.Client por defecto. El ejecutor espera la respuesta;
+// el motor de reglas registra el suyo con crearEjecutorWebhook, que la espera en
+// segundo plano.
+//
+// El ejecutor:
+//   - Resuelve la URL (Accion.Destino) con ResolverPlantilla
+//   - Construye el cuerpo desde la plantilla JSON en Parametros["cuerpo"]: las variables
+//     dentro de un string se escapan y fuera de él se insertan codificadas en JSON;
+//     {valores} se expande al objeto con los valores de las series. Sin plantilla se
+//     envía un PayloadActuador.
+//   - Agrega los headers definidos como Parametros["header_<Nombre>"] (también plantillas)
+//   - Retorna error si la respuesta no es 2xx
+//
+// Ejemplo de acción:
+//
+//	Accion{
+//	    Tipo:    "webhook",
+//	    Destino: "https://tickets.example.com/api/{cola}",
+//	    Parametros: map[string]string{
+//	        "cola":                 "mantenimiento",
+//	        "header_Authorization": "Bearer {token}",
+//	        "token":                "secreto",
+//	        "cuerpo":               `{"titulo": "{regla_nombre}", "valor": {valor}, "series": {valores}}`,
+//	    },
+//	}
+func CrearEjecutorWebhook(cliente *http.Client) EjecutorAccion {
+	if cliente == nil {
+		cliente = &http.Client{}
+	}
+
+	return func(accion Accion, regla *Regla, valores map[string]interface{}) error {
+		req, cancel, err := prepararWebhook(context.Background(), accion, regla, valores)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		_, err = enviarWebhook(cliente, req, regla)
+		return err
+	}
+}
+
+// crearEjecutorWebhook crea el ejecutor webhook del motor. La solicitud se prepara al
+// ejecutar la acción y se envía en segundo plano, para no retener el motor durante el
+// timeout; el resultado, con el código y el inicio del cuerpo de la respuesta, se
+// registra en el historial de la regla al terminar. Con maxWebhooksEnCurso esperando
+// respuesta, o con el motor detenido, el disparo se descarta y se registra como fallido.
+func (mr *MotorReglas) crearEjecutorWebhook(cliente *http.Client) EjecutorAccion {
+	if cliente == nil {
+		cliente = &http.Client{}
+	}
+
+	return func(accion Accion, regla *Regla, valores map[string]interface{}) error {
+		ctx, err := mr.reservarWebhook()
+		if err != nil {
+			log.Printf("Ejecutor: webhook '%s' descartado por regla '%s': %v", accion.Destino, regla.ID, err)
+			return err
+		}
+		req, cancel, err := prepararWebhook(ctx, accion, regla, valores)
+		if err != nil {
+			mr.liberarWebhook()
+			return err
+		}
+		momento, ok := valores["_timestamp"].(time.Time)
+		if !ok {
+			momento = time.Now()
+		}
+		go func() {
+			defer mr.liberarWebhook()
+			defer cancel()
+			respuesta, err := enviarWebhook(cliente, req, regla)
+			registro := RegistroEjecucion{
+				ReglaID:   regla.ID,
+				Timestamp: momento,
+				Accion:    accion.Tipo,
+				Destino:   accion.Destino,
+				Exito:     err == nil,
+				Respuesta: respuesta,
+			}
+			if err != nil {
+				registro.Error = err.Error()
+			}
+			mr.registrarEjecucion(registro)
+		}()
+		return errResultadoRegistrado
+	}
+}
+
+// estadoWebhooks sigue los webhooks del motor enviados en segundo plano; se protege
+// con MotorReglas.webhooksMu
+type estadoWebhooks struct {
+	ctx      context.Context // se cancela con detenerWebhooks
+	cancelar context.CancelFunc
+	activos  int
+	detenido bool
+	enCurso  sync.WaitGroup
+}
+
+// estadoWebhooksLocked inicializa el estado de forma perezosa. Requiere mr.webhooksMu.
+func (mr *MotorReglas) estadoWebhooksLocked() *estadoWebhooks {
+	if mr.webhooks == nil {
+		ctx, cancelar := context.WithCancel(context.Background())
+		mr.webhooks = &estadoWebhooks{ctx: ctx, cancelar: cancelar}
+	}
+	return mr.webhooks
+}
+
+// reservarWebhook ocupa un lugar para un webhook en segundo plano y retorna el contexto
+// de su solicitud. Falla si el motor está detenido o si no quedan lugares.
+func (mr *MotorReglas) reservarWebhook() (context.Context, error) {
+	mr.webhooksMu.Lock()
+	defer mr.webhooksMu.Unlock()
+
+	estado := mr.estadoWebhooksLocked()
+	if estado.detenido {
+		return nil, fmt.Errorf("el motor de reglas está detenido")
+	}
+	if estado.activos >= maxWebhooksEnCurso {
+		return nil, fmt.Errorf("hay %d webhooks esperando respuesta", estado.activos)
+	}
+	estado.activos++
+	estado.enCurso.Add(1)
+	return estado.ctx, nil
+}
+
+// liberarWebhook libera el lugar de un webhook terminado
+func (mr *MotorReglas) liberarWebhook() {
+	mr.webhooksMu.Lock()
+	estado := mr.webhooks
+	estado.activos--
+	mr.webhooksMu.Unlock()
+
+	estado.enCurso.Done()
+}
+
+// detenerWebhooks cancela los webhooks en curso y espera a que registren su resultado.
+// Se invoca al cerrar el gestor, antes de cerrar la base.
+func (mr *MotorReglas) detenerWebhooks() {
+	mr.webhooksMu.Lock()
+	estado := mr.estadoWebhooksLocked()
+	estado.detenido = true
+	estado.cancelar()
+	mr.webhooksMu.Unlock()
+
+	estado.enCurso.Wait()
+}
+
+// prepararWebhook construye la solicitud del webhook, derivada de ctx. La función
+// retornada libera el timeout de la solicitud.
+func prepararWebhook(ctx context.Context, accion Accion, regla *Regla, valores map[string]interface{}) (*http.Request, context.CancelFunc, error) {
+	urlDestino := ResolverPlantilla(accion.Destino, accion.Parametros, regla, valores)
+	if urlDestino == "" {
+		return nil, nil, fmt.Errorf("URL resuelta está vacía")
+	}
+
+	metodo := strings.ToUpper(accion.Parametros[paramWebhookMetodo])
+	if metodo == "" {
+		metodo = http.MethodPost
+	}
+
+	timeout := timeoutWebhookDefecto
+	if t, ok := accion.Parametros[paramWebhookTimeout]; ok {
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 {
+			return nil, nil, fmt.Errorf("timeout inválido: %s", t)
+		}
+		timeout = d
+	}
+
+	cuerpo, err := construirCuerpoWebhook(accion, regla, valores)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	req, err := http.NewRequestWithContext(ctx, metodo, urlDestino, bytes.NewReader(cuerpo))
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("error creando solicitud a '%s': %v", urlDestino, err)
+	}
+
+	contentType := accion.Parametros[paramWebhookContentType]
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	for clave, plantilla := range accion.Parametros {
+		if !strings.HasPrefix(clave, prefijoWebhookHeader) {
+			continue
+		}
+		nombre := strings.TrimPrefix(clave, prefijoWebhookHeader)
+		if nombre == "" {
+			continue
+		}
+		req.Header.Set(nombre, ResolverPlantilla(plantilla, accion.Parametros, regla, valores))
+	}
+	return req, cancel, nil
+}
+
+// enviarWebhook envía la solicitud y retorna el código y el inicio del cuerpo de la
+// respuesta. Retorna error si no hubo respuesta o si no es 2xx.
+func enviarWebhook(cliente *http.Client, req *http.Request, regla *Regla) (string, error) {
+	resp, err := cliente.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("enviando webhook a '%s': %w", req.URL, err)
+	}
+	defer resp.Body.Close()
+
+	cuerpo, _ := io.ReadAll(io.LimitReader(resp.Body, tamanoMaximoRespuestaLog))
+	respuesta := fmt.Sprintf("%d %s", resp.StatusCode, strings.TrimSpace(string(cuerpo)))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return respuesta, fmt.Errorf("webhook '%s' respondió %d", req.URL, resp.StatusCode)
+	}
+	log.Printf("Ejecutor: webhook %s '%s' por regla '%s' (%d)", req.Method, req.URL, regla.ID, resp.StatusCode)
+	return respuesta, nil
+}
+
+// construirCuerpoWebhook genera el cuerpo JSON de la solicitud del webhook.
+func construirCuerpoWebhook(accion Accion, regla *Regla, valores map[string]interface{}) ([]byte, error) {
+	plantilla, ok := accion.Parametros[paramWebhookCuerpo]
+	if !ok {
+		payload := PayloadActuador{
+			Comando:     accion.Parametros["comando"],
+			MarcaTiempo: time.Now(),
+			ReglaID:     regla.ID,
+			ComandoID:   comandoIDDesdeContexto(valores),
+			Parametros:  filtrarParametrosWebhook(accion),
+			Contexto:    filtrarContextoPublico(valores),
+		}
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("error serializando payload: %v", err)
+		}
+		return data, nil
+	}
+
+	cuerpo, err := resolverPlantillaJSON(plantilla, accion.Parametros, regla, valores)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid([]byte(cuerpo)) {
+		return nil, fmt.Errorf("el cuerpo resuelto no es JSON válido: %s", cuerpo)
+	}
+	return []byte(cuerpo), nil
+}
+
+// resolverPlantillaJSON resuelve una plantilla JSON. Una variable dentro de un string
+// se reemplaza por su texto escapado y fuera de él por su valor codificado en JSON
+// ({valor} con "abierto" da "abierto" con comillas); un parámetro cuyo texto ya es JSON
+// (30, true, {...}) se inserta tal cual. {valores} es el objeto con los valores
+// públicos de las series. Fuera de un string, una variable sin valor es un error.
+func resolverPlantillaJSON(plantilla string, params map[string]string, regla *Regla, contexto map[string]interface{}) (string, error) {
+	var resultado strings.Builder
+	enString := false
+	for i := 0; i < len(plantilla); i++ {
+		c := plantilla[i]
+		switch {
+		case enString && c == '\\' && i+1 < len(plantilla):
+			resultado.WriteString(plantilla[i : i+2])
+			i++
+			continue
+		case c == '"':
+			enString = !enString
+		case c == '{':
+			if m := variableRegex.FindStringSubmatchIndex(plantilla[i:]); m != nil && m[0] == 0 {
+				nombre := plantilla[i+m[2] : i+m[3]]
+				texto, err := valorPlantillaJSON(nombre, enString, params, regla, contexto)
+				if err != nil {
+					return "", err
+				}
+				resultado.WriteString(texto)
+				i += m[1] - 1
+				continue
+			}
+		}
+		resultado.WriteByte(c)
+	}
+	return resultado.String(), nil
+}
+
+// valorPlantillaJSON codifica el valor de una variable de una plantilla JSON
+func valorPlantillaJSON(nombre string, enString bool, params map[string]string, regla *Regla, contexto map[string]interface{}) (string, error) {
+	var valor interface{}
+	if plantilla, ok := params[nombre]; ok {
+		texto := ResolverPlantilla(plantilla, params, regla, contexto)
+		if !enString && json.Valid([]byte(texto)) {
+			return texto, nil
+		}
+		valor = texto
+	} else if nombre == "valores" {
+		valor = filtrarContextoPublico(contexto)
+	} else if v, ok := valorVariableContexto(nombre, regla, contexto); ok {
+		valor = v
+	} else if enString {
+		return "", nil
+	} else {
+		return "", fmt.Errorf("variable sin resolver en el cuerpo: %s", nombre)
+	}
+
+	if texto, esTexto := valor.(string); esTexto && enString {
+		return escaparJSON(texto), nil
+	}
+	datos, err := json.Marshal(valor)
+	if err != nil {
+		return "", fmt.Errorf("error serializando '%s': %v", nombre, err)
+	}
+	if enString {
+		return escaparJSON(string(datos)), nil
+	}
+	return string(datos), nil
+}
+
+// filtrarParametrosWebhook excluye del PayloadActuador por defecto los parámetros de
+// configuración del webhook, los internos y los que solo usan las plantillas de la URL
+// y los headers (p. ej. un token).
+func filtrarParametrosWebhook(accion Accion) map[string]string {
+	plantillas := []string{accion.Destino}
+	for k, v := range accion.Parametros {
+		if strings.HasPrefix(k, prefijoWebhookHeader) {
+			plantillas = append(plantillas, v)
+		}
+	}
+	soloPlantilla := make(map[string]bool)
+	for _, plantilla := range plantillas {
+		for _, v := range ExtraerVariables(plantilla) {
+			soloPlantilla[v] = true
+		}
+	}
+
+	resultado := filtrarParametrosInternos(accion.Parametros)
+	for k := range resultado {
+		switch {
+		case k == paramWebhookMetodo, k == paramWebhookTimeout, k == paramWebhookContentType,
+			strings.HasPrefix(k, prefijoWebhookHeader), soloPlantilla[k]:
+			delete(resultado, k)
+		}
+	}
+	return resultado
+}
+
+// escaparJSON escapa un string para insertarlo dentro de un literal string JSON.
+func escaparJSON(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data[1 : len(data)-1])
+}
+
+// --- Ejecutor escribir_serie ---
+
+// TipoAccionEscribirSerie es el tipo de acción que inserta un valor en una serie local.
+// Permite definir sensores derivados o virtuales a partir de reglas.
+const TipoAccionEscribirSerie = "escribir_serie"
+
+// Parámetros reconocidos por el ejecutor escribir_serie en Accion.Parametros
+const (
+	paramSerieValor            = "valor"             // Plantilla del valor a escribir (default "{valor}")
+	paramSerieTipoDatos        = "tipo_datos"        // Tipo de la serie si se crea (default: inferido del valor)
+	paramSerieCompresionBytes  = "compresion_bytes"  // Compresión de valores si se crea (default SinCompresion)
+	paramSerieCompresionBloque = "compresion_bloque" // Compresión de bloque si se crea (default LZ4)
+	paramSerieTamanoBloque     = "tamano_bloque"     // Tamaño de bloque si se crea (default 100)
+)
+
+// crearEjecutorEscribirSerie crea el ejecutor que inserta un valor en la serie Accion.Destino.
+//
+// El ejecutor:
+//   - Resuelve el path destino y el valor (Parametros["valor"]) con ResolverPlantilla
+//   - Crea la serie si no existe, con el tipo y compresión indicados en Parametros
+//   - Convierte el valor resuelto al tipo de la serie
+//   - Inserta el punto con el timestamp de la evaluación, sin evaluar reglas; el motor
+//     reevalúa las reglas encadenadas al terminar (ver evaluarReglasEncadenadas)
+//
+// Ejemplo de acción:
+//
+//	Accion{
+//	    Tipo:    "escribir_serie",
+//	    Destino: "estado/alarma_frio",
+//	    Parametros: map[string]string{
+//	        "valor":      "1",
+//	        "tipo_datos": "Integer",
+//	    },
+//	}
+func (mr *MotorReglas) crearEjecutorEscribirSerie() EjecutorAccion {
+	return func(accion Accion, regla *Regla, valores map[string]interface{}) error {
+		if mr.gestor == nil {
+			return fmt.Errorf("el motor de reglas no tiene gestor asociado")
+		}
+
+		path := ResolverPlantilla(accion.Destino, accion.Parametros, regla, valores)
+		if path == "" {
+			return fmt.Errorf("path de serie resuelto está vacío")
+		}
+
+		plantillaValor, ok := accion.Parametros[paramSerieValor]
+		if !ok {
+			plantillaValor = "{valor}"
+		}
+		// ResolverPlantilla deja vacías las variables sin valor: se detectan antes
+		if faltantes := variablesSinResolver(plantillaValor, accion.Parametros, regla, valores); len(faltantes) > 0 {
+			return fmt.Errorf("valor '%s' tiene variables sin resolver: %s", plantillaValor, strings.Join(faltantes, ", "))
+		}
+		texto := strings.TrimSpace(ResolverPlantilla(plantillaValor, accion.Parametros, regla, valores))
+
+		serie, err := mr.gestor.ObtenerSeries(path)
+		if err != nil {
+			serie, err = crearSerieDerivada(mr.gestor, path, texto, accion.Parametros)
+			if err != nil {
+				return err
+			}
+		}
+
+		dato, err := convertirValorSerie(texto, serie.TipoDatos)
+		if err != nil {
+			return fmt.Errorf("valor para serie '%s': %v", path, err)
+		}
+
+		tiempo := time.Now()
+		if ts, ok := valores["_timestamp"].(time.Time); ok {
+			tiempo = ts
+		}
+
+		if err := mr.gestor.insertarPunto(path, tiempo.UnixNano(), dato); err != nil {
+			return fmt.Errorf("escribiendo en serie '%s': %v", path, err)
+		}
+
+		return nil
+	}
+}
+
+// crearSerieDerivada crea la serie destino de una acción escribir_serie usando
+// la configuración de Parametros (o valores por defecto).
+func crearSerieDerivada(gestor *GestorBorde, path, texto string, params map[string]string) (tipos.Serie, error) {
+	tipoDatos := inferirTipoTexto(texto)
+	if t, ok := params[paramSerieTipoDatos]; ok {
+		tipoDatos = parsearTipoDatos(t)
+	}
+
+	serie := tipos.Serie{
+		Path:             path,
+		TipoDatos:        tipoDatos,
+		TamañoBloque:     100,
+		CompresionBytes:  tipos.SinCompresion,
+		CompresionBloque: tipos.LZ4,
+		Tags:             map[string]string{"origen": "regla"},
+	}
+	if c, ok := params[paramSerieCompresionBytes]; ok {
+		serie.CompresionBytes = tipos.TipoCompresion(c)
+	}
+	if c, ok := params[paramSerieCompresionBloque]; ok {
+		serie.CompresionBloque = tipos.TipoCompresionBloque(c)
+	}
+	if t, ok := params[paramSerieTamanoBloque]; ok {
+		tamano, err := strconv.Atoi(t)
+		if err != nil {
+			return tipos.Serie{}, fmt.Errorf("tamano_bloque inválido: %s", t)
+		}
+		serie.TamañoBloque = tamano
+	}
+
+	if err := gestor.CrearSerie(serie); err != nil {
+		return tipos.Serie{}, fmt.Errorf("creando serie '%s': %v", path, err)
+	}
+	log.Printf("Ejecutor: serie '%s' (%s) creada por regla", path, tipoDatos)
+
+	return gestor.ObtenerSeries(path)
+}
+
+// inferirTipoTexto infiere el tipo de datos de un valor resuelto como texto
+func inferirTipoTexto(texto string) tipos.TipoDatos {
+	if texto == "true" || texto == "false" {
+		return tipos.Boolean
+	}
+	if _, err := strconv.ParseInt(texto, 10, 64); err == nil {
+		return tipos.Integer
+	}
+	if _, err := strconv.ParseFloat(texto, 64); err == nil {
+		return tipos.Real
+	}
+	return tipos.Text
+}
+
+// convertirValorSerie convierte un valor resuelto como texto al tipo de datos de la serie
+func convertirValorSerie(texto string, tipoDatos tipos.TipoDatos) (interface{}, error) {
+	switch tipoDatos {
+	case tipos.Boolean:
+		b, err := strconv.ParseBool(texto)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' no es Boolean", texto)
+		}
+		return b, nil
+	case tipos.Integer:
+		if i, err := strconv.ParseInt(texto, 10, 64); err == nil {
+			return i, nil
+		}
+		// Aceptar reales sin parte decimal (p.ej. "21" formateado como 21.0)
+		f, err := strconv.ParseFloat(texto, 64)
+		if err != nil || f != math.Trunc(f) {
+			return nil, fmt.Errorf("'%s' no es Integer", texto)
+		}
+		return int64(f), nil
+	case tipos.Real:
+		f, err := strconv.ParseFloat(texto, 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' no es Real", texto)
+		}
+		return f, nil
+	case tipos.Text:
+		return texto, nil
+	default:
+		return nil, fmt.Errorf("tipo de datos no soportado: %s", tipoDatos)
+	}
+}
+
+// validarAccionEscribirSerie valida los parámetros de una acción escribir_serie al registrar la regla
+func validarAccionEscribirSerie(accion *Accion) error {
+	if plantilla, ok := accion.Parametros[paramSerieValor]; ok {
+		if err := ValidarPlantilla(plantilla); err != nil {
+			return fmt.Errorf("plantilla de valor inválida: %v", err)
+		}
+		if err := ValidarVariablesRequeridas(plantilla, accion.Parametros); err != nil {
+			return fmt.Errorf("variables faltantes en params: %v", err)
+		}
+	}
+
+	if t, ok := accion.Parametros[paramSerieTipoDatos]; ok {
+		switch strings.ToLower(t) {
+		case "boolean", "bool", "integer", "int", "real", "float", "float64", "double", "text", "string":
+		default:
+			return fmt.Errorf("tipo_datos inválido: %s", t)
+		}
+	}
+
+	return nil
+}
+
+// --- Ejecutor actualizar_sombra ---
+
+// TipoAccionActualizarSombra es el tipo de acción que escribe el estado deseado de la
+// sombra Accion.Destino (ver sombras.go). El dispositivo recibe el delta al aplicarse
+// y, si estaba desconectado, al reconectar.
+const TipoAccionActualizarSombra = "actualizar_sombra"
+
+// prefijoSombraDeseado marca en Accion.Parametros las claves del estado deseado
+const prefijoSombraDeseado = "deseado."
+
+// crearEjecutorActualizarSombra crea el ejecutor que actualiza el estado deseado de la
+// sombra Accion.Destino con los parámetros "deseado.<clave>".
+//
+// Cada valor se resuelve con ResolverPlantilla; si el texto resultante es JSON válido
+// (true, 21.5, "texto", {...}) se guarda como tal, si no como texto. "null" elimina la clave.
+//
+// Ejemplo de acción:
+//
+//	Accion{
+//	    Tipo:    "actualizar_sombra",
+//	    Destino: "{serie_1}/calefactor",
+//	    Parametros: map[string]string{
+//	        "deseado.encendido": "true",
+//	        "deseado.consigna":  "{valor}",
+//	    },
+//	}
+func (mr *MotorReglas) crearEjecutorActualizarSombra() EjecutorAccion {
+	return func(accion Accion, regla *Regla, valores map[string]interface{}) error {
+		if mr.gestor == nil {
+			return fmt.Errorf("el motor de reglas no tiene gestor asociado")
+		}
+
+		if faltantes := variablesSinResolver(accion.Destino, accion.Parametros, regla, valores); len(faltantes) > 0 {
+			return fmt.Errorf("sombra '%s' tiene variables sin resolver: %s", accion.Destino, strings.Join(faltantes, ", "))
+		}
+		id := ResolverPlantilla(accion.Destino, accion.Parametros, regla, valores)
+		cambios := make(map[string]interface{})
+		for param, plantilla := range accion.Parametros {
+			clave, ok := strings.CutPrefix(param, prefijoSombraDeseado)
+			if !ok {
+				continue
+			}
+			if faltantes := variablesSinResolver(plantilla, accion.Parametros, regla, valores); len(faltantes) > 0 {
+				return fmt.Errorf("valor de '%s' tiene variables sin resolver: %s", clave, strings.Join(faltantes, ", "))
+			}
+			texto := strings.TrimSpace(ResolverPlantilla(plantilla, accion.Parametros, regla, valores))
+			var valor interface{}
+			if err := json.Unmarshal([]byte(texto), &valor); err != nil {
+				valor = texto
+			}
+			cambios[clave] = valor
+		}
+
+		_, err := mr.gestor.ActualizarSombraDeseado(id, cambios)
+		return err
+	}
+}
+
+// validarAccionActualizarSombra valida los parámetros de una acción actualizar_sombra al registrar la regla
+func validarAccionActualizarSombra(accion *Accion) error {
+	claves := 0
+	for param, plantilla := range accion.Parametros {
+		clave, ok := strings.CutPrefix(param, prefijoSombraDeseado)
+		if !ok {
+			continue
+		}
+		if clave == "" {
+			return fmt.Errorf("parámetro '%s' sin clave", param)
+		}
+		if err := ValidarPlantilla(plantilla); err != nil {
+			return fmt.Errorf("plantilla de '%s' inválida: %v", clave, err)
+		}
+		if err := ValidarVariablesRequeridas(plantilla, accion.Parametros); err != nil {
+			return fmt.Errorf("variables faltantes en params: %v", err)
+		}
+		claves++
+	}
+	if claves == 0 {
+		return fmt.Errorf("actualizar_sombra requiere al menos un parámetro '%s<clave>'", prefijoSombraDeseado)
+	}
+	return nil
+}
+
 // --- Helpers de registro ---
 
 // RegistrarEjecutorMQTT conecta a un broker MQTT, crea un ejecutor y lo registra
@@ -2,12 +2,20 @@ package borde
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/tipos"
 )
 
 // --- Tests para ExtraerVariables ---
@@ -600,3 +608,917 @@ func TestCrearEjecutorPublicar_PropagaErrorPublicar(t *testing.T) {
 		t.Errorf("el error debería contener la causa: %v", err)
 	}
 }
+
+// --- Tests para CrearEjecutorWebhook ---
+
+type solicitudWebhook struct {
+	metodo  string
+	ruta    string
+	headers http.Header
+	cuerpo  []byte
+}
+
+func nuevoServidorWebhook(t *testing.T, status int, respuesta string) (*httptest.Server, chan solicitudWebhook) {
+	t.Helper()
+	recibidas := make(chan solicitudWebhook, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cuerpo, _ := io.ReadAll(r.Body)
+		recibidas <- solicitudWebhook{metodo: r.Method, ruta: r.URL.Path, headers: r.Header.Clone(), cuerpo: cuerpo}
+		w.WriteHeader(status)
+		w.Write([]byte(respuesta))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, recibidas
+}
+
+func TestCrearEjecutorWebhook_CuerpoYHeadersConPlantilla(t *testing.T) {
+	srv, recibidas := nuevoServidorWebhook(t, http.StatusCreated, `{"ticket": 42}`)
+	ejecutor := CrearEjecutorWebhook(srv.Client())
+
+	accion := Accion{
+		Tipo:    "webhook",
+		Destino: srv.URL + "/tickets/{cola}",
+		Parametros: map[string]string{
+			"cola":                 "mantenimiento",
+			"token":                "secreto",
+			"header_Authorization": "Bearer {token}",
+			"cuerpo":               `{"titulo": "{regla_nombre}", "nodo": "{serie_0}", "valor": {valor}, "series": {valores}}`,
+		},
+	}
+	regla := &Regla{ID: "alerta", Nombre: `Temp "alta"`}
+	valores := map[string]interface{}{
+		"nodo_01/temp": 31.5,
+		"_serie":       "nodo_01/temp",
+		"_serie_0":     "nodo_01",
+		"_serie_1":     "temp",
+		"_valor":       31.5,
+	}
+
+	if err := ejecutor(accion, regla, valores); err != nil {
+		t.Fatalf("error inesperado: %v", err)
+	}
+
+	sol := <-recibidas
+	if sol.metodo != http.MethodPost {
+		t.Errorf("método incorrecto: %s", sol.metodo)
+	}
+	if sol.ruta != "/tickets/mantenimiento" {
+		t.Errorf("ruta incorrecta: %s", sol.ruta)
+	}
+	if got := sol.headers.Get("Authorization"); got != "Bearer secreto" {
+		t.Errorf("header Authorization incorrecto: %s", got)
+	}
+	if got := sol.headers.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type incorrecto: %s", got)
+	}
+
+	var cuerpo struct {
+		Titulo string             `json:"titulo"`
+		Nodo   string             `json:"nodo"`
+		Valor  float64            `json:"valor"`
+		Series map[string]float64 `json:"series"`
+	}
+	if err := json.Unmarshal(sol.cuerpo, &cuerpo); err != nil {
+		t.Fatalf("cuerpo no es JSON válido: %v (%s)", err, sol.cuerpo)
+	}
+	if cuerpo.Titulo != `Temp "alta"` {
+		t.Errorf("título incorrecto: %s", cuerpo.Titulo)
+	}
+	if cuerpo.Nodo != "nodo_01" || cuerpo.Valor != 31.5 {
+		t.Errorf("nodo/valor incorrectos: %+v", cuerpo)
+	}
+	if len(cuerpo.Series) != 1 || cuerpo.Series["nodo_01/temp"] != 31.5 {
+		t.Errorf("series incorrectas (no deben incluir claves internas): %v", cuerpo.Series)
+	}
+	if _, ok := valores["_respuesta"]; ok {
+		t.Error("el ejecutor no debe modificar el contexto compartido")
+	}
+}
+
+func TestCrearEjecutorWebhook_CuerpoCodificaValores(t *testing.T) {
+	srv, recibidas := nuevoServidorWebhook(t, http.StatusOK, "")
+	ejecutor := CrearEjecutorWebhook(srv.Client())
+
+	accion := Accion{
+		Destino: srv.URL,
+		Parametros: map[string]string{
+			"umbral": "30",
+			"zona":   `sala "norte"`,
+			"cuerpo": `{"estado": {valor}, "texto": "estado={valor}", "umbral": {umbral}, "zona": {zona}, "llaves": "{no_es_variable"}`,
+		},
+	}
+	if err := ejecutor(accion, &Regla{ID: "r1"}, map[string]interface{}{"_valor": "abierto"}); err != nil {
+		t.Fatalf("error inesperado: %v", err)
+	}
+
+	var cuerpo map[string]interface{}
+	sol := <-recibidas
+	if err := json.Unmarshal(sol.cuerpo, &cuerpo); err != nil {
+		t.Fatalf("cuerpo no es JSON válido: %v (%s)", err, sol.cuerpo)
+	}
+	esperado := map[string]interface{}{
+		"estado": "abierto",
+		"texto":  "estado=abierto",
+		"umbral": 30.0,
+		"zona":   `sala "norte"`,
+		"llaves": "{no_es_variable",
+	}
+	if !reflect.DeepEqual(cuerpo, esperado) {
+		t.Errorf("cuerpo = %v, esperaba %v", cuerpo, esperado)
+	}
+
+	// Fuera de un string una variable sin valor no puede reemplazarse por vacío
+	accion.Parametros["cuerpo"] = `{"estado": {valor}}`
+	if err := ejecutor(accion, &Regla{ID: "r1"}, map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "sin resolver") {
+		t.Errorf("esperaba error por variable sin resolver, obtuvo: %v", err)
+	}
+}
+
+func TestEjecutorWebhookMotor_RegistraRespuestaEnSegundoPlano(t *testing.T) {
+	srv, recibidas := nuevoServidorWebhook(t, http.StatusCreated, `{"ticket": 42}`)
+	mr := crearMotorReglasTest()
+	ejecutor := mr.crearEjecutorWebhook(srv.Client())
+
+	valores := map[string]interface{}{"_timestamp": time.Unix(100, 0)}
+	if err := ejecutor(Accion{Tipo: "webhook", Destino: srv.URL}, &Regla{ID: "r1"}, valores); !errors.Is(err, errResultadoRegistrado) {
+		t.Fatalf("esperaba que el ejecutor registre su resultado, obtuvo: %v", err)
+	}
+	<-recibidas
+
+	var historial []RegistroEjecucion
+	for inicio := time.Now(); len(historial) == 0 && time.Since(inicio) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		historial = mr.ObtenerHistorial("r1")
+	}
+	if len(historial) != 1 {
+		t.Fatalf("esperaba un registro, hay %d", len(historial))
+	}
+	r := historial[0]
+	if !r.Exito || !strings.Contains(r.Respuesta, "201") || !strings.Contains(r.Respuesta, "ticket") || !r.Timestamp.Equal(time.Unix(100, 0)) {
+		t.Errorf("registro incorrecto: %+v", r)
+	}
+}
+
+func TestEjecutorWebhookMotor_LimitaYDetieneEnCurso(t *testing.T) {
+	// El servidor no responde hasta que se cancela la solicitud
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	mr := crearMotorReglasTest()
+	ejecutor := mr.crearEjecutorWebhook(srv.Client())
+	accion := Accion{Tipo: "webhook", Destino: srv.URL, Parametros: map[string]string{"timeout": "1m"}}
+
+	for i := 0; i < maxWebhooksEnCurso; i++ {
+		if err := ejecutor(accion, &Regla{ID: "r1"}, map[string]interface{}{}); !errors.Is(err, errResultadoRegistrado) {
+			t.Fatalf("disparo %d: esperaba envío en segundo plano, obtuvo: %v", i, err)
+		}
+	}
+	if err := ejecutor(accion, &Regla{ID: "r1"}, map[string]interface{}{}); err == nil || errors.Is(err, errResultadoRegistrado) {
+		t.Fatalf("esperaba descartar el disparo con el límite alcanzado, obtuvo: %v", err)
+	}
+
+	detenido := make(chan struct{})
+	go func() {
+		mr.detenerWebhooks()
+		close(detenido)
+	}()
+	select {
+	case <-detenido:
+	case <-time.After(5 * time.Second):
+		t.Fatal("detenerWebhooks no canceló los webhooks en curso")
+	}
+	historial := mr.ObtenerHistorial("r1")
+	if len(historial) != maxWebhooksEnCurso {
+		t.Fatalf("esperaba %d registros al detener, hay %d", maxWebhooksEnCurso, len(historial))
+	}
+	for _, r := range historial {
+		if r.Exito {
+			t.Errorf("un webhook cancelado no debería registrarse como exitoso: %+v", r)
+		}
+	}
+	if err := ejecutor(accion, &Regla{ID: "r1"}, map[string]interface{}{}); err == nil || errors.Is(err, errResultadoRegistrado) {
+		t.Errorf("esperaba descartar el disparo con el motor detenido, obtuvo: %v", err)
+	}
+}
+
+func TestCrearEjecutorWebhook_CuerpoPorDefecto(t *testing.T) {
+	srv, recibidas := nuevoServidorWebhook(t, http.StatusOK, "")
+	ejecutor := CrearEjecutorWebhook(srv.Client())
+
+	accion := Accion{
+		Destino: srv.URL,
+		Parametros: map[string]string{
+			"comando":        "abrir",
+			"metodo":         "put",
+			"header_X-Clave": "Clave {token}",
+			"token":          "secreto",
+			"apertura":       "50",
+		},
+	}
+
+	if err := ejecutor(accion, &Regla{ID: "r1"}, map[string]interface{}{"valvula/1": 1.0}); err != nil {
+		t.Fatalf("error inesperado: %v", err)
+	}
+
+	sol := <-recibidas
+	if sol.metodo != http.MethodPut {
+		t.Errorf("método incorrecto: %s", sol.metodo)
+	}
+
+	var payload PayloadActuador
+	if err := json.Unmarshal(sol.cuerpo, &payload); err != nil {
+		t.Fatalf("error deserializando payload: %v", err)
+	}
+	if payload.Comando != "abrir" || payload.ReglaID != "r1" {
+		t.Errorf("payload incorrecto: %+v", payload)
+	}
+	if _, ok := payload.Parametros["header_X-Clave"]; ok {
+		t.Error("los parámetros de configuración del webhook no deberían enviarse")
+	}
+	if _, ok := payload.Parametros["metodo"]; ok {
+		t.Error("el parámetro 'metodo' no debería enviarse")
+	}
+	if _, ok := payload.Parametros["token"]; ok {
+		t.Error("los parámetros que solo usan las plantillas no deberían enviarse")
+	}
+	if payload.Parametros["apertura"] != "50" {
+		t.Errorf("parámetros incorrectos: %v", payload.Parametros)
+	}
+}
+
+func TestCrearEjecutorWebhook_RespuestaNo2xx(t *testing.T) {
+	srv, _ := nuevoServidorWebhook(t, http.StatusServiceUnavailable, "ocupado")
+	ejecutor := CrearEjecutorWebhook(srv.Client())
+
+	valores := map[string]interface{}{}
+	err := ejecutor(Accion{Destino: srv.URL}, &Regla{ID: "r1"}, valores)
+	if err == nil {
+		t.Fatal("esperaba error por respuesta 503")
+	}
+	if !strings.Contains(err.Error(), "503") {
+		t.Errorf("el error debería mencionar el código: %v", err)
+	}
+}
+
+func TestCrearEjecutorWebhook_CuerpoInvalido(t *testing.T) {
+	ejecutor := CrearEjecutorWebhook(nil)
+
+	accion := Accion{
+		Destino:    "http://127.0.0.1:1/",
+		Parametros: map[string]string{"cuerpo": `{"valor": {valor}`},
+	}
+	err := ejecutor(accion, &Regla{ID: "r1"}, map[string]interface{}{"_valor": 1.0})
+	if err == nil || !strings.Contains(err.Error(), "JSON") {
+		t.Fatalf("esperaba error de JSON inválido, obtuvo: %v", err)
+	}
+}
+
+func TestCrearEjecutorWebhook_TimeoutInvalido(t *testing.T) {
+	ejecutor := CrearEjecutorWebhook(nil)
+
+	accion := Accion{
+		Destino:    "http://127.0.0.1:1/",
+		Parametros: map[string]string{"timeout": "pronto"},
+	}
+	if err := ejecutor(accion, &Regla{ID: "r1"}, nil); err == nil {
+		t.Fatal("esperaba error por timeout inválido")
+	}
+}
+
+// --- Tests para historial de ejecuciones ---
+
+func TestHistorial_RegistraYLimita(t *testing.T) {
+	mr := crearMotorReglasTest()
+
+	for i := 0; i < maxHistorialPorRegla+5; i++ {
+		mr.registrarEjecucion(RegistroEjecucion{
+			ReglaID:   "r1",
+			Timestamp: time.Unix(int64(i), 0),
+			Accion:    "webhook",
+			Exito:     true,
+		})
+	}
+
+	historial := mr.ObtenerHistorial("r1")
+	if len(historial) != maxHistorialPorRegla {
+		t.Fatalf("esperaba %d registros, obtuvo %d", maxHistorialPorRegla, len(historial))
+	}
+	if historial[0].Timestamp.Unix() != 5 {
+		t.Errorf("deberían descartarse los más antiguos, primero: %v", historial[0].Timestamp.Unix())
+	}
+
+	// La copia no debe afectar el historial interno
+	historial[0].Accion = "modificada"
+	if mr.ObtenerHistorial("r1")[0].Accion != "webhook" {
+		t.Error("ObtenerHistorial debería devolver una copia")
+	}
+
+	mr.eliminarHistorial("r1")
+	if len(mr.ObtenerHistorial("r1")) != 0 {
+		t.Error("el historial debería estar vacío tras eliminarlo")
+	}
+}
+
+// --- Tests para escribir_serie ---
+
+// crearGestorConEscribirSerie crea un gestor de test con la serie "sensor/temp" (Real)
+// y el ejecutor escribir_serie registrado.
+func crearGestorConEscribirSerie(t *testing.T) *GestorBorde {
+	t.Helper()
+	gestor := crearGestorBordeParaTest(t)
+	gestor.motorReglas.ejecutores[TipoAccionEscribirSerie] = gestor.motorReglas.crearEjecutorEscribirSerie()
+
+	err := gestor.CrearSerie(tipos.Serie{
+		Path:             "sensor/temp",
+		TipoDatos:        tipos.Real,
+		TamañoBloque:     100,
+		CompresionBloque: tipos.Ninguna,
+		CompresionBytes:  tipos.SinCompresion,
+	})
+	if err != nil {
+		t.Fatalf("error creando serie: %v", err)
+	}
+	return gestor
+}
+
+func ultimoValor(t *testing.T, gestor *GestorBorde, path string) interface{} {
+	t.Helper()
+	resultado, err := gestor.ConsultarUltimoPunto(path, nil, nil)
+	if err != nil {
+		t.Fatalf("error consultando '%s': %v", path, err)
+	}
+	if len(resultado.Valores) != 1 {
+		t.Fatalf("esperaba 1 valor en '%s', obtuvo %d", path, len(resultado.Valores))
+	}
+	return resultado.Valores[0]
+}
+
+func TestEscribirSerie_CreaSerieEInserta(t *testing.T) {
+	gestor := crearGestorConEscribirSerie(t)
+
+	err := gestor.AgregarRegla(&Regla{
+		ID:          "alarma_frio",
+		Condiciones: []Condicion{{Path: "sensor/temp", VentanaT: time.Minute, Operador: OperadorMenor, Valor: 5.0}},
+		Acciones: []Accion{{
+			Tipo:       TipoAccionEscribirSerie,
+			Destino:    "estado/alarma_frio",
+			Parametros: map[string]string{"valor": "1", "tipo_datos": "Integer", "compresion_bytes": "RLE"},
+		}},
+		Activa: true,
+	})
+	if err != nil {
+		t.Fatalf("error agregando regla: %v", err)
+	}
+
+	if err := gestor.Insertar("sensor/temp", time.Now().UnixNano(), 3.5); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+
+	serie, err := gestor.ObtenerSeries("estado/alarma_frio")
+	if err != nil {
+		t.Fatalf("la serie destino debería haberse creado: %v", err)
+	}
+	if serie.TipoDatos != tipos.Integer || serie.CompresionBytes != tipos.RLE {
+		t.Errorf("configuración de serie incorrecta: %s / %s", serie.TipoDatos, serie.CompresionBytes)
+	}
+	if v := ultimoValor(t, gestor, "estado/alarma_frio"); v != int64(1) {
+		t.Errorf("valor incorrecto: %v (%T)", v, v)
+	}
+
+	historial := gestor.motorReglas.ObtenerHistorial("alarma_frio")
+	if len(historial) != 1 || !historial[0].Exito {
+		t.Errorf("historial incorrecto: %+v", historial)
+	}
+}
+
+func TestEscribirSerie_ValorConPlantillaYReglasEncadenadas(t *testing.T) {
+	gestor := crearGestorConEscribirSerie(t)
+
+	// Sensor virtual: copia el valor de temperatura
+	err := gestor.AgregarRegla(&Regla{
+		ID:          "copia",
+		Condiciones: []Condicion{{Path: "sensor/temp", VentanaT: time.Minute, Operador: OperadorMayor, Valor: 0.0}},
+		Acciones:    []Accion{{Tipo: TipoAccionEscribirSerie, Destino: "virtual/{serie_1}"}},
+		Activa:      true,
+	})
+	if err != nil {
+		t.Fatalf("error agregando regla: %v", err)
+	}
+	// Regla que depende de la serie virtual
+	err = gestor.AgregarRegla(&Regla{
+		ID:          "alta",
+		Condiciones: []Condicion{{Path: "virtual/temp", VentanaT: time.Minute, Operador: OperadorMayor, Valor: 30.0}},
+		Acciones: []Accion{{
+			Tipo:       TipoAccionEscribirSerie,
+			Destino:    "estado/temp_alta",
+			Parametros: map[string]string{"valor": "true"},
+		}},
+		Activa: true,
+	})
+	if err != nil {
+		t.Fatalf("error agregando regla: %v", err)
+	}
+
+	if err := gestor.Insertar("sensor/temp", time.Now().UnixNano(), 31.5); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+
+	if v := ultimoValor(t, gestor, "virtual/temp"); v != 31.5 {
+		t.Errorf("valor de serie virtual incorrecto: %v", v)
+	}
+	if v := ultimoValor(t, gestor, "estado/temp_alta"); v != true {
+		t.Errorf("la regla encadenada debería haber escrito true, obtuvo %v", v)
+	}
+}
+
+func TestEscribirSerie_CicloNoSeRepite(t *testing.T) {
+	gestor := crearGestorConEscribirSerie(t)
+
+	// a escribe en b y b escribe en a: la cadena debe cortarse sin bloquearse
+	reglas := []*Regla{
+		{
+			ID:          "a",
+			Condiciones: []Condicion{{Path: "sensor/temp", VentanaT: time.Minute, Operador: OperadorMayor, Valor: 0.0}},
+			Acciones:    []Accion{{Tipo: TipoAccionEscribirSerie, Destino: "ciclo/b"}},
+			Activa:      true,
+		},
+		{
+			ID:          "b",
+			Condiciones: []Condicion{{Path: "ciclo/b", VentanaT: time.Minute, Operador: OperadorMayor, Valor: 0.0}},
+			Acciones:    []Accion{{Tipo: TipoAccionEscribirSerie, Destino: "sensor/temp", Parametros: map[string]string{"valor": "{valor}"}}},
+			Activa:      true,
+		},
+	}
+	for _, r := range reglas {
+		if err := gestor.AgregarRegla(r); err != nil {
+			t.Fatalf("error agregando regla: %v", err)
+		}
+	}
+
+	hecho := make(chan error, 1)
+	go func() { hecho <- gestor.Insertar("sensor/temp", time.Now().UnixNano(), 2.0) }()
+
+	select {
+	case err := <-hecho:
+		if err != nil {
+			t.Fatalf("error insertando: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("la evaluación de reglas encadenadas no terminó")
+	}
+
+	if n := len(gestor.motorReglas.ObtenerHistorial("a")); n != 1 {
+		t.Errorf("la regla 'a' debería ejecutarse una sola vez, se ejecutó %d", n)
+	}
+	if n := len(gestor.motorReglas.ObtenerHistorial("b")); n != 1 {
+		t.Errorf("la regla 'b' debería ejecutarse una sola vez, se ejecutó %d", n)
+	}
+}
+
+func TestEscribirSerie_ValorIncompatible(t *testing.T) {
+	gestor := crearGestorConEscribirSerie(t)
+	ejecutor := gestor.motorReglas.crearEjecutorEscribirSerie()
+
+	accion := Accion{Destino: "sensor/temp", Parametros: map[string]string{"valor": "abierto"}}
+	err := ejecutor(accion, &Regla{ID: "r1"}, map[string]interface{}{})
+	if err == nil || !strings.Contains(err.Error(), "no es Real") {
+		t.Fatalf("esperaba error de conversión, obtuvo: %v", err)
+	}
+}
+
+func TestEscribirSerie_VariablesSinResolver(t *testing.T) {
+	gestor := crearGestorConEscribirSerie(t)
+	ejecutor := gestor.motorReglas.crearEjecutorEscribirSerie()
+
+	// Sin _valor en el contexto, {valor} quedaría vacío
+	accion := Accion{Destino: "sensor/temp"}
+	err := ejecutor(accion, &Regla{ID: "r1"}, map[string]interface{}{})
+	if err == nil || !strings.Contains(err.Error(), "sin resolver: valor") {
+		t.Fatalf("esperaba error por variable sin resolver, obtuvo: %v", err)
+	}
+
+	accion.Parametros = map[string]string{"valor": "{serie_3}"}
+	err = ejecutor(accion, &Regla{ID: "r1"}, map[string]interface{}{"_serie_0": "sensor"})
+	if err == nil || !strings.Contains(err.Error(), "serie_3") {
+		t.Fatalf("esperaba error por segmento inexistente, obtuvo: %v", err)
+	}
+}
+
+func TestValidarAccion_EscribirSerieTipoInvalido(t *testing.T) {
+	mr := crearMotorReglasTest()
+
+	accion := Accion{
+		Tipo:       TipoAccionEscribirSerie,
+		Destino:    "estado/x",
+		Parametros: map[string]string{"tipo_datos": "complejo"},
+	}
+	if err := mr.validarAccion(&accion); err == nil {
+		t.Fatal("esperaba error por tipo_datos inválido")
+	}
+}
+
+func TestConvertirValorSerie(t *testing.T) {
+	casos := []struct {
+		texto    string
+		tipo     tipos.TipoDatos
+		esperado interface{}
+	}{
+		{"1", tipos.Boolean, true},
+		{"false", tipos.Boolean, false},
+		{"42", tipos.Integer, int64(42)},
+		{"21", tipos.Real, 21.0},
+		{"abierto", tipos.Text, "abierto"},
+	}
+	for _, c := range casos {
+		v, err := convertirValorSerie(c.texto, c.tipo)
+		if err != nil {
+			t.Errorf("convertir %q a %s: error inesperado %v", c.texto, c.tipo, err)
+			continue
+		}
+		if v != c.esperado {
+			t.Errorf("convertir %q a %s: obtuvo %v (%T)", c.texto, c.tipo, v, v)
+		}
+	}
+
+	if _, err := convertirValorSerie("2.5", tipos.Integer); err == nil {
+		t.Error("esperaba error al convertir 2.5 a Integer")
+	}
+}
+
+// --- Tests para confirmación de comandos ---
+
+// ejecutorContador registra cuántas veces se ejecuta una acción y el último contexto recibido
+type ejecutorContador struct {
+	mu       sync.Mutex
+	llamadas int
+	valores  map[string]interface{}
+}
+
+func (e *ejecutorContador) ejecutar(accion Accion, regla *Regla, valores map[string]interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.llamadas++
+	e.valores = copiarContexto(valores)
+	return nil
+}
+
+func (e *ejecutorContador) obtenerLlamadas() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.llamadas
+}
+
+// crearGestorConConfirmacion crea un gestor de test con las series "sensor/temp" y
+// "actuador/valvula" y una regla "enfriar" cuya acción requiere la confirmación indicada.
+func crearGestorConConfirmacion(t *testing.T, conf *ConfirmacionAccion) (*GestorBorde, *ejecutorContador, *ejecutorContador) {
+	t.Helper()
+	gestor := crearGestorConEscribirSerie(t)
+
+	comando := &ejecutorContador{}
+	alerta := &ejecutorContador{}
+	gestor.motorReglas.ejecutores["comando"] = comando.ejecutar
+	gestor.motorReglas.ejecutores["alerta"] = alerta.ejecutar
+
+	err := gestor.CrearSerie(tipos.Serie{
+		Path:             "actuador/valvula",
+		TipoDatos:        tipos.Real,
+		TamañoBloque:     100,
+		CompresionBloque: tipos.Ninguna,
+		CompresionBytes:  tipos.SinCompresion,
+	})
+	if err != nil {
+		t.Fatalf("error creando serie: %v", err)
+	}
+
+	err = gestor.AgregarRegla(&Regla{
+		ID:          "enfriar",
+		Condiciones: []Condicion{{Path: "sensor/temp", VentanaT: time.Minute, Operador: OperadorMayor, Valor: 30.0}},
+		Acciones:    []Accion{{Tipo: "comando", Destino: "actuador/valvula/set", Confirmacion: conf}},
+		Activa:      true,
+	})
+	if err != nil {
+		t.Fatalf("error agregando regla: %v", err)
+	}
+	return gestor, comando, alerta
+}
+
+func esperarEstadoComando(t *testing.T, gestor *GestorBorde, id string, estado EstadoComando) ComandoActuador {
+	t.Helper()
+	limite := time.Now().Add(5 * time.Second)
+	for {
+		comando, err := gestor.ObtenerComando(id)
+		if err != nil {
+			t.Fatalf("error obteniendo comando: %v", err)
+		}
+		if comando.Estado == estado {
+			return comando
+		}
+		if time.Now().After(limite) {
+			t.Fatalf("el comando quedó en estado %s, esperaba %s", comando.Estado, estado)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConfirmacion_SerieConfirmaComando(t *testing.T) {
+	gestor, comando, _ := crearGestorConConfirmacion(t, &ConfirmacionAccion{
+		Serie:   "actuador/valvula",
+		Valor:   1,
+		Timeout: time.Minute,
+	})
+
+	ahora := time.Now().UnixNano()
+	if err := gestor.Insertar("sensor/temp", ahora, 35.0); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+
+	comandos := gestor.ListarComandos("enfriar")
+	if len(comandos) != 1 {
+		t.Fatalf("esperaba 1 comando, obtuvo %d", len(comandos))
+	}
+	id := comandos[0].ID
+	if comandos[0].Estado != ComandoPendiente || comandos[0].Serie != "actuador/valvula" {
+		t.Errorf("comando incorrecto: %+v", comandos[0])
+	}
+	if comando.valores["_comando_id"] != id {
+		t.Errorf("el ejecutor debería recibir el ID de comando, obtuvo %v", comando.valores["_comando_id"])
+	}
+
+	// Mientras está pendiente la acción no se reenvía
+	if err := gestor.Insertar("sensor/temp", ahora+1, 36.0); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+	if n := comando.obtenerLlamadas(); n != 1 {
+		t.Errorf("la acción no debería repetirse con un comando pendiente, se ejecutó %d veces", n)
+	}
+
+	// Un valor distinto al esperado no confirma
+	if err := gestor.Insertar("actuador/valvula", ahora+2, 0.0); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+	if c, _ := gestor.ObtenerComando(id); c.Estado != ComandoPendiente {
+		t.Fatalf("el comando no debería confirmarse con otro valor: %s", c.Estado)
+	}
+
+	if err := gestor.Insertar("actuador/valvula", ahora+3, 1.0); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+	esperarEstadoComando(t, gestor, id, ComandoConfirmado)
+
+	// Confirmado el comando, la regla vuelve a enviar la acción
+	if err := gestor.Insertar("sensor/temp", ahora+4, 37.0); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+	if n := comando.obtenerLlamadas(); n != 2 {
+		t.Errorf("esperaba un nuevo envío tras la confirmación, llamadas: %d", n)
+	}
+}
+
+func TestConfirmacion_TimeoutReintentaYEscala(t *testing.T) {
+	gestor, comando, alerta := crearGestorConConfirmacion(t, &ConfirmacionAccion{
+		Serie:        "actuador/valvula",
+		Valor:        1,
+		Timeout:      20 * time.Millisecond,
+		Reintentos:   1,
+		Escalamiento: []Accion{{Tipo: "alerta", Destino: "alertas/valvula"}},
+	})
+
+	if err := gestor.Insertar("sensor/temp", time.Now().UnixNano(), 35.0); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+	comandos := gestor.ListarComandos("enfriar")
+	if len(comandos) != 1 {
+		t.Fatalf("esperaba 1 comando, obtuvo %d", len(comandos))
+	}
+
+	fallido := esperarEstadoComando(t, gestor, comandos[0].ID, ComandoFallido)
+	if fallido.Intentos != 2 || fallido.Error == "" {
+		t.Errorf("comando fallido incorrecto: %+v", fallido)
+	}
+	if n := comando.obtenerLlamadas(); n != 2 {
+		t.Errorf("esperaba envío inicial más 1 reintento, llamadas: %d", n)
+	}
+	if n := alerta.obtenerLlamadas(); n != 1 {
+		t.Errorf("esperaba 1 acción de escalamiento, llamadas: %d", n)
+	}
+
+	historial := gestor.motorReglas.ObtenerHistorial("enfriar")
+	if len(historial) != 3 {
+		t.Fatalf("esperaba envío, reintento y escalamiento en el historial, obtuvo %+v", historial)
+	}
+	if !strings.HasPrefix(historial[1].Respuesta, "reintento 1") || historial[2].Accion != "alerta" {
+		t.Errorf("historial incorrecto: %+v", historial)
+	}
+}
+
+func TestConfirmacion_TopicoRetroalimentacion(t *testing.T) {
+	gestor, _, _ := crearGestorConConfirmacion(t, &ConfirmacionAccion{
+		Topico:  "actuador/valvula/estado",
+		Valor:   "abierta",
+		Timeout: time.Minute,
+	})
+	gestor.motorReglas.RegistrarClienteConfirmacion(nuevoMockCliente())
+
+	if err := gestor.Insertar("sensor/temp", time.Now().UnixNano(), 35.0); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+	comandos := gestor.ListarComandos("")
+	if len(comandos) != 1 || comandos[0].Topico != "actuador/valvula/estado" {
+		t.Fatalf("comando incorrecto: %+v", comandos)
+	}
+	id := comandos[0].ID
+
+	mr := gestor.motorReglas
+	mr.manejarRetroalimentacion("otro/topico", []byte(`"abierta"`))
+	mr.manejarRetroalimentacion("actuador/valvula/estado", []byte(`{"comando_id": "otro", "valor": "abierta"}`))
+	if c, _ := gestor.ObtenerComando(id); c.Estado != ComandoPendiente {
+		t.Fatalf("el comando no debería confirmarse con otro tópico u otro comando_id: %s", c.Estado)
+	}
+
+	payload := fmt.Sprintf(`{"comando_id": %q, "valor": "ABIERTA"}`, id)
+	mr.manejarRetroalimentacion("actuador/valvula/estado", []byte(payload))
+	esperarEstadoComando(t, gestor, id, ComandoConfirmado)
+}
+
+func TestConfirmacion_ResolucionManual(t *testing.T) {
+	gestor, _, alerta := crearGestorConConfirmacion(t, &ConfirmacionAccion{
+		Serie:        "actuador/valvula",
+		Valor:        1,
+		Timeout:      time.Minute,
+		Escalamiento: []Accion{{Tipo: "alerta", Destino: "alertas/valvula"}},
+	})
+
+	if err := gestor.Insertar("sensor/temp", time.Now().UnixNano(), 35.0); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+	comandos := gestor.ListarComandos("enfriar")
+	id := comandos[0].ID
+
+	if err := gestor.FallarComando(id, "válvula trabada"); err != nil {
+		t.Fatalf("error marcando fallido: %v", err)
+	}
+	c, _ := gestor.ObtenerComando(id)
+	if c.Estado != ComandoFallido || c.Error != "válvula trabada" {
+		t.Errorf("comando incorrecto: %+v", c)
+	}
+	if n := alerta.obtenerLlamadas(); n != 1 {
+		t.Errorf("el fallo manual debería escalar, llamadas: %d", n)
+	}
+
+	if err := gestor.ConfirmarComando(id); err == nil {
+		t.Error("esperaba error al confirmar un comando ya finalizado")
+	}
+	if _, err := gestor.ObtenerComando("inexistente"); err == nil {
+		t.Error("esperaba error para comando inexistente")
+	}
+}
+
+func TestConfirmacion_PrimerEnvioFallidoSeReintenta(t *testing.T) {
+	gestor, _, alerta := crearGestorConConfirmacion(t, &ConfirmacionAccion{
+		Serie:        "actuador/valvula",
+		Valor:        1,
+		Timeout:      20 * time.Millisecond,
+		Reintentos:   1,
+		Escalamiento: []Accion{{Tipo: "alerta", Destino: "alertas/valvula"}},
+	})
+	var envios atomic.Int32
+	gestor.motorReglas.ejecutores["comando"] = func(Accion, *Regla, map[string]interface{}) error {
+		envios.Add(1)
+		return fmt.Errorf("actuador inaccesible")
+	}
+
+	if err := gestor.Insertar("sensor/temp", time.Now().UnixNano(), 35.0); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+	comandos := gestor.ListarComandos("enfriar")
+	if len(comandos) != 1 || comandos[0].Error == "" {
+		t.Fatalf("el envío fallido debería seguirse como comando pendiente: %+v", comandos)
+	}
+
+	fallido := esperarEstadoComando(t, gestor, comandos[0].ID, ComandoFallido)
+	if fallido.Intentos != 2 || envios.Load() != 2 {
+		t.Errorf("esperaba envío inicial más 1 reintento: %+v, envíos %d", fallido, envios.Load())
+	}
+	if n := alerta.obtenerLlamadas(); n != 1 {
+		t.Errorf("esperaba 1 acción de escalamiento, llamadas: %d", n)
+	}
+}
+
+func TestConfirmacion_EliminarReglaCancelaComandos(t *testing.T) {
+	gestor, comando, alerta := crearGestorConConfirmacion(t, &ConfirmacionAccion{
+		Serie:        "actuador/valvula",
+		Valor:        1,
+		Timeout:      20 * time.Millisecond,
+		Reintentos:   1,
+		Escalamiento: []Accion{{Tipo: "alerta", Destino: "alertas/valvula"}},
+	})
+
+	if err := gestor.Insertar("sensor/temp", time.Now().UnixNano(), 35.0); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+	id := gestor.ListarComandos("enfriar")[0].ID
+	if err := gestor.EliminarRegla("enfriar"); err != nil {
+		t.Fatalf("error eliminando regla: %v", err)
+	}
+	if c, _ := gestor.ObtenerComando(id); c.Estado != ComandoCancelado {
+		t.Fatalf("el comando debería cancelarse con la regla: %+v", c)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := comando.obtenerLlamadas(); n != 1 {
+		t.Errorf("no debería reintentarse un comando de una regla eliminada, llamadas: %d", n)
+	}
+	if n := alerta.obtenerLlamadas(); n != 0 {
+		t.Errorf("no debería escalarse un comando cancelado, llamadas: %d", n)
+	}
+}
+
+// TestConfirmacion_CerrarDetieneTimeouts verifica que tras Cerrar no se ejecuta el
+// escalamiento, que escribiría en la base ya cerrada
+func TestConfirmacion_CerrarDetieneTimeouts(t *testing.T) {
+	gestor, err := Crear(Opciones{NombreDB: t.TempDir() + "/confirmacion.db", Direccion: "localhost"})
+	if err != nil {
+		t.Fatalf("error creando gestor: %v", err)
+	}
+	comando := &ejecutorContador{}
+	gestor.motorReglas.ejecutores["comando"] = comando.ejecutar
+	for _, path := range []string{"sensor/temp", "actuador/valvula"} {
+		err := gestor.CrearSerie(tipos.Serie{Path: path, TipoDatos: tipos.Real, TamañoBloque: 100,
+			CompresionBloque: tipos.Ninguna, CompresionBytes: tipos.SinCompresion})
+		if err != nil {
+			t.Fatalf("error creando serie: %v", err)
+		}
+	}
+	err = gestor.AgregarRegla(&Regla{
+		ID:          "enfriar",
+		Condiciones: []Condicion{{Path: "sensor/temp", VentanaT: time.Minute, Operador: OperadorMayor, Valor: 30.0}},
+		Acciones: []Accion{{Tipo: "comando", Destino: "actuador/valvula/set", Confirmacion: &ConfirmacionAccion{
+			Serie:   "actuador/valvula",
+			Valor:   1,
+			Timeout: 20 * time.Millisecond,
+			Escalamiento: []Accion{{Tipo: TipoAccionEscribirSerie, Destino: "alertas/valvula",
+				Parametros: map[string]string{"valor": "1"}}},
+		}}},
+		Activa: true,
+	})
+	if err != nil {
+		t.Fatalf("error agregando regla: %v", err)
+	}
+	if err := gestor.Insertar("sensor/temp", time.Now().UnixNano(), 35.0); err != nil {
+		t.Fatalf("error insertando: %v", err)
+	}
+
+	gestor.Cerrar()
+	time.Sleep(100 * time.Millisecond)
+	if n := comando.obtenerLlamadas(); n != 1 {
+		t.Errorf("no debería reenviarse tras Cerrar, llamadas: %d", n)
+	}
+}
+
+func TestValidarConfirmacion(t *testing.T) {
+	mr := crearMotorReglasTest()
+
+	casos := []struct {
+		nombre string
+		conf   ConfirmacionAccion
+	}{
+		{"sin serie ni tópico", ConfirmacionAccion{Valor: 1}},
+		{"serie y tópico", ConfirmacionAccion{Serie: "a", Topico: "b", Valor: 1}},
+		{"sin valor", ConfirmacionAccion{Serie: "a"}},
+		{"reintentos negativos", ConfirmacionAccion{Serie: "a", Valor: 1, Reintentos: -1}},
+		{"escalamiento con confirmación", ConfirmacionAccion{Serie: "a", Valor: 1, Escalamiento: []Accion{
+			{Tipo: "alerta", Destino: "x", Confirmacion: &ConfirmacionAccion{Serie: "b", Valor: 1}},
+		}}},
+		{"escalamiento sin destino", ConfirmacionAccion{Serie: "a", Valor: 1, Escalamiento: []Accion{{Tipo: "alerta"}}}},
+	}
+	for _, c := range casos {
+		if err := mr.validarConfirmacion(&c.conf); err == nil {
+			t.Errorf("%s: esperaba error", c.nombre)
+		}
+	}
+
+	valida := ConfirmacionAccion{Topico: "actuador/{id}/estado", Valor: true, Reintentos: 2}
+	if err := mr.validarConfirmacion(&valida); err != nil {
+		t.Errorf("confirmación válida rechazada: %v", err)
+	}
+}
+
+func TestValoresCoinciden(t *testing.T) {
+	casos := []struct {
+		recibido, esperado interface{}
+		coincide           bool
+	}{
+		{1.0, 1, true},
+		{int64(3), 3.0, true},
+		{2.5, 2, false},
+		{true, true, true},
+		{true, 1, false},
+		{"Abierta", "abierta", true},
+		{"1", 1, false},
+	}
+	for _, c := range casos {
+		if valoresCoinciden(c.recibido, c.esperado) != c.coincide {
+			t.Errorf("valoresCoinciden(%v, %v) debería ser %v", c.recibido, c.esperado, c.coincide)
+		}
+	}
+}
@@ -258,8 +258,47 @@ func (f *federacionMQTT) ejecutarComando(solicitud tipos.SolicitudControlComando
 		return nil, f.gestor.ActualizarRegla(regla)
 	case tipos.OpReglaEliminar:
 		return nil, f.gestor.EliminarRegla(args.ReglaID)
+	case tipos.OpReglaProbar:
+		var regla *Regla
+		var err error
+		if args.Regla != nil {
+			regla, err = parsearReglaDesdeMapa(args.Regla)
+		} else {
+			regla, err = f.gestor.ObtenerRegla(args.ReglaID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return f.gestor.ProbarRegla(regla, time.Unix(0, args.TiempoInicio), time.Unix(0, args.TiempoFin), time.Duration(args.Paso))
 	case tipos.OpDatoInsertar:
 		return nil, f.gestor.Insertar(args.Path, args.Timestamp, args.Valor)
+	case tipos.OpDispositivoListar:
+		return f.gestor.ListarDispositivos(EstadoDispositivo(args.Estado)), nil
+	case tipos.OpDispositivoAprobar:
+		token, err := f.gestor.AprobarDispositivo(args.DispositivoID)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"dispositivo_id": args.DispositivoID, "token": token}, nil
+	case tipos.OpDispositivoRechazar:
+		return nil, f.gestor.RechazarDispositivo(args.DispositivoID)
+	case tipos.OpDispositivoEliminar:
+		return nil, f.gestor.EliminarDispositivo(args.DispositivoID)
+	case tipos.OpTipoDispositivoRegistrar:
+		if args.TipoDispositivo == nil {
+			return nil, fmt.Errorf("argumento tipo_dispositivo requerido")
+		}
+		tipo, err := parsearTipoDispositivoDesdeMapa(args.TipoDispositivo)
+		if err != nil {
+			return nil, err
+		}
+		return nil, f.gestor.RegistrarTipoDispositivo(tipo)
+	case tipos.OpSombraObtener:
+		return f.gestor.ObtenerSombra(args.SombraID)
+	case tipos.OpSombraActualizar:
+		return f.gestor.ActualizarSombraDeseado(args.SombraID, args.Deseado)
+	case tipos.OpSombraEliminar:
+		return nil, f.gestor.EliminarSombra(args.SombraID)
 	default:
 		return nil, fmt.Errorf("operación no soportada: %s", solicitud.Operacion)
 	}
@@ -345,12 +384,18 @@ func splitTopic(t string) []string {
 	return strings.Split(t, "/")
 }
 
-// parsearReglaDesdeMapa convierte un mapa genérico a una *Regla del borde.
-// Es un parser minimal para comandos federados.
+// parsearReglaDesdeMapa convierte un mapa genérico (JSON con la forma de tipos.Regla)
+// a una *Regla del borde.
 func parsearReglaDesdeMapa(m map[string]interface{}) (*Regla, error) {
-	// Como el formato exacto de reglas en JSON no está completamente definido
-	// para comandos federados, esta función es un stub que retorna error informativo.
-	// En una implementación real, se mapearía desde tipos.Regla (ya definido en tipos).
-	_ = m
-	return nil, fmt.Errorf("parseo de regla desde comando federado no implementado: usar API local del borde")
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("regla inválida: %v", err)
+	}
+
+	var regla tipos.Regla
+	if err := json.Unmarshal(data, &regla); err != nil {
+		return nil, fmt.Errorf("regla inválida: %v", err)
+	}
+
+	return convertirReglaDesdeTipos(regla)
 }
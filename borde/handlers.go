@@ -482,6 +482,77 @@ func HandlerObtenerRegla(gestor *GestorBorde) http.HandlerFunc {
 	}
 }
 
+// HandlerHistorialRegla devuelve las últimas ejecuciones de acciones de una regla
+func HandlerHistorialRegla(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if id == "" {
+			tipos.EnviarError(w, http.StatusBadRequest, "id de regla requerido")
+			return
+		}
+
+		historial, err := gestor.ObtenerHistorialRegla(id)
+		if err != nil {
+			tipos.EnviarError(w, http.StatusNotFound, fmt.Sprintf("regla '%s' no encontrada", id))
+			return
+		}
+
+		tipos.EnviarJSON(w, historial)
+	}
+}
+
+// HandlerProbarRegla reproduce una regla sobre datos históricos sin ejecutar acciones.
+// Acepta una regla candidata en "regla" o el ID de una regla existente en "regla_id".
+func HandlerProbarRegla(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			tipos.EnviarError(w, http.StatusMethodNotAllowed, "método no permitido")
+			return
+		}
+
+		var req struct {
+			ReglaID      string `json:"regla_id,omitempty"`
+			Regla        *Regla `json:"regla,omitempty"`
+			TiempoInicio int64  `json:"tiempo_inicio"`
+			TiempoFin    int64  `json:"tiempo_fin"`
+			Paso         string `json:"paso"` // ej: "1m", "30s"
+		}
+
+		if err := tipos.LeerJSON(r, &req); err != nil {
+			tipos.EnviarError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		regla := req.Regla
+		if regla == nil {
+			if req.ReglaID == "" {
+				tipos.EnviarError(w, http.StatusBadRequest, "se requiere regla o regla_id")
+				return
+			}
+			existente, err := gestor.ObtenerRegla(req.ReglaID)
+			if err != nil {
+				tipos.EnviarError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			regla = existente
+		}
+
+		paso, err := time.ParseDuration(req.Paso)
+		if err != nil {
+			tipos.EnviarError(w, http.StatusBadRequest, fmt.Sprintf("paso inválido: %s", req.Paso))
+			return
+		}
+
+		resultado, err := gestor.ProbarRegla(regla, time.Unix(0, req.TiempoInicio), time.Unix(0, req.TiempoFin), paso)
+		if err != nil {
+			tipos.EnviarError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		tipos.EnviarJSON(w, resultado)
+	}
+}
+
 // HandlerEliminarRegla elimina una regla
 func HandlerEliminarRegla(gestor *GestorBorde) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -548,6 +619,79 @@ func HandlerHabilitarRegla(gestor *GestorBorde) http.HandlerFunc {
 	}
 }
 
+// HandlerListarComandos lista los comandos con confirmación
+// Query param: ?regla=xxx (opcional, filtra por regla)
+func HandlerListarComandos(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tipos.EnviarJSON(w, gestor.ListarComandos(r.URL.Query().Get("regla")))
+	}
+}
+
+// HandlerObtenerComando obtiene el estado de un comando por ID
+func HandlerObtenerComando(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if id == "" {
+			tipos.EnviarError(w, http.StatusBadRequest, "id de comando requerido")
+			return
+		}
+
+		comando, err := gestor.ObtenerComando(id)
+		if err != nil {
+			tipos.EnviarError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		tipos.EnviarJSON(w, comando)
+	}
+}
+
+// HandlerResolverComando confirma o marca como fallido un comando pendiente
+func HandlerResolverComando(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			tipos.EnviarError(w, http.StatusMethodNotAllowed, "método no permitido")
+			return
+		}
+
+		id := r.PathValue("id")
+		if id == "" {
+			tipos.EnviarError(w, http.StatusBadRequest, "id de comando requerido")
+			return
+		}
+
+		var req struct {
+			Estado string `json:"estado"` // "confirmado" o "fallido"
+			Motivo string `json:"motivo,omitempty"`
+		}
+
+		if err := tipos.LeerJSON(r, &req); err != nil {
+			tipos.EnviarError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var err error
+		switch EstadoComando(req.Estado) {
+		case ComandoConfirmado:
+			err = gestor.ConfirmarComando(id)
+		case ComandoFallido:
+			err = gestor.FallarComando(id, req.Motivo)
+		default:
+			tipos.EnviarError(w, http.StatusBadRequest, "estado debe ser 'confirmado' o 'fallido'")
+			return
+		}
+		if err != nil {
+			tipos.EnviarError(w, http.StatusConflict, err.Error())
+			return
+		}
+
+		tipos.EnviarJSON(w, map[string]interface{}{
+			"exito":   true,
+			"mensaje": fmt.Sprintf("Comando %s %s", id, req.Estado),
+		})
+	}
+}
+
 // HandlerHabilitarMotorReglas habilita todas las reglas
 func HandlerHabilitarMotorReglas(gestor *GestorBorde) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -653,3 +797,268 @@ func parsearTipoAgregacion(s string) tipos.TipoAgregacion {
 		return ""
 	}
 }
+
+// HandlerListarDispositivos lista los dispositivos registrados
+// Query param: ?estado=pendiente|aprobado|rechazado (opcional)
+func HandlerListarDispositivos(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tipos.EnviarJSON(w, gestor.ListarDispositivos(EstadoDispositivo(r.URL.Query().Get("estado"))))
+	}
+}
+
+// HandlerObtenerDispositivo obtiene un dispositivo por ID
+func HandlerObtenerDispositivo(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if id == "" {
+			tipos.EnviarError(w, http.StatusBadRequest, "id de dispositivo requerido")
+			return
+		}
+
+		dispositivo, err := gestor.ObtenerDispositivo(id)
+		if err != nil {
+			tipos.EnviarError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		tipos.EnviarJSON(w, dispositivo)
+	}
+}
+
+// HandlerAnunciarDispositivo registra un dispositivo como pendiente de aprobación
+func HandlerAnunciarDispositivo(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			tipos.EnviarError(w, http.StatusMethodNotAllowed, "método no permitido")
+			return
+		}
+
+		var anuncio AnuncioDispositivo
+		if err := tipos.LeerJSON(r, &anuncio); err != nil {
+			tipos.EnviarError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		dispositivo, err := gestor.AnunciarDispositivo(anuncio)
+		if err != nil {
+			tipos.EnviarError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		tipos.EnviarJSON(w, dispositivo)
+	}
+}
+
+// HandlerResolverDispositivo aprueba o rechaza un dispositivo. Al aprobarlo la
+// respuesta incluye el token del dispositivo, que no vuelve a estar disponible.
+func HandlerResolverDispositivo(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			tipos.EnviarError(w, http.StatusMethodNotAllowed, "método no permitido")
+			return
+		}
+
+		id := r.PathValue("id")
+		if id == "" {
+			tipos.EnviarError(w, http.StatusBadRequest, "id de dispositivo requerido")
+			return
+		}
+
+		var req struct {
+			Estado string `json:"estado"` // "aprobado" o "rechazado"
+		}
+
+		if err := tipos.LeerJSON(r, &req); err != nil {
+			tipos.EnviarError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		respuesta := map[string]interface{}{
+			"exito":   true,
+			"mensaje": fmt.Sprintf("Dispositivo %s %s", id, req.Estado),
+		}
+		switch EstadoDispositivo(req.Estado) {
+		case DispositivoAprobado:
+			token, err := gestor.AprobarDispositivo(id)
+			if err != nil {
+				tipos.EnviarError(w, http.StatusConflict, err.Error())
+				return
+			}
+			respuesta["token"] = token
+		case DispositivoRechazado:
+			if err := gestor.RechazarDispositivo(id); err != nil {
+				tipos.EnviarError(w, http.StatusConflict, err.Error())
+				return
+			}
+		default:
+			tipos.EnviarError(w, http.StatusBadRequest, "estado debe ser 'aprobado' o 'rechazado'")
+			return
+		}
+
+		tipos.EnviarJSON(w, respuesta)
+	}
+}
+
+// HandlerEliminarDispositivo quita un dispositivo del registro (sus series se conservan)
+func HandlerEliminarDispositivo(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			tipos.EnviarError(w, http.StatusMethodNotAllowed, "método no permitido")
+			return
+		}
+
+		id := r.PathValue("id")
+		if id == "" {
+			tipos.EnviarError(w, http.StatusBadRequest, "id de dispositivo requerido")
+			return
+		}
+
+		if err := gestor.EliminarDispositivo(id); err != nil {
+			tipos.EnviarError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		tipos.EnviarJSON(w, map[string]interface{}{
+			"exito":   true,
+			"mensaje": fmt.Sprintf("Dispositivo %s eliminado", id),
+		})
+	}
+}
+
+// HandlerListarTiposDispositivo lista las plantillas de tipos de dispositivo
+func HandlerListarTiposDispositivo(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tipos.EnviarJSON(w, gestor.ListarTiposDispositivo())
+	}
+}
+
+// HandlerRegistrarTipoDispositivo agrega o reemplaza la plantilla de un tipo de dispositivo
+func HandlerRegistrarTipoDispositivo(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			tipos.EnviarError(w, http.StatusMethodNotAllowed, "método no permitido")
+			return
+		}
+
+		var tipo TipoDispositivo
+		if err := tipos.LeerJSON(r, &tipo); err != nil {
+			tipos.EnviarError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := gestor.RegistrarTipoDispositivo(tipo); err != nil {
+			tipos.EnviarError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		tipos.EnviarJSON(w, map[string]interface{}{
+			"exito":   true,
+			"mensaje": fmt.Sprintf("Tipo de dispositivo %s registrado", tipo.Nombre),
+		})
+	}
+}
+
+// HandlerListarSombras lista las sombras de dispositivos
+func HandlerListarSombras(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tipos.EnviarJSON(w, gestor.ListarSombras())
+	}
+}
+
+// HandlerObtenerSombra obtiene una sombra por ID, con su delta pendiente.
+// El ID puede contener '/' (registrar la ruta con {id...}).
+func HandlerObtenerSombra(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if id == "" {
+			tipos.EnviarError(w, http.StatusBadRequest, "id de sombra requerido")
+			return
+		}
+
+		sombra, err := gestor.ObtenerSombra(id)
+		if err != nil {
+			tipos.EnviarError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		tipos.EnviarJSON(w, map[string]interface{}{
+			"sombra": sombra,
+			"delta":  sombra.Delta(),
+		})
+	}
+}
+
+// HandlerActualizarSombra combina cambios en el estado deseado y/o reportado de una sombra
+// Body: {"deseado": {...}, "reportado": {...}} (un valor null elimina la clave)
+func HandlerActualizarSombra(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch && r.Method != http.MethodPut {
+			tipos.EnviarError(w, http.StatusMethodNotAllowed, "método no permitido")
+			return
+		}
+
+		id := r.PathValue("id")
+		if id == "" {
+			tipos.EnviarError(w, http.StatusBadRequest, "id de sombra requerido")
+			return
+		}
+
+		var req struct {
+			Deseado   map[string]interface{} `json:"deseado"`
+			Reportado map[string]interface{} `json:"reportado"`
+		}
+
+		if err := tipos.LeerJSON(r, &req); err != nil {
+			tipos.EnviarError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(req.Deseado) == 0 && len(req.Reportado) == 0 {
+			tipos.EnviarError(w, http.StatusBadRequest, "se requiere 'deseado' o 'reportado'")
+			return
+		}
+
+		var sombra Sombra
+		var err error
+		if len(req.Reportado) > 0 {
+			sombra, err = gestor.ActualizarSombraReportado(id, req.Reportado)
+		}
+		if err == nil && len(req.Deseado) > 0 {
+			sombra, err = gestor.ActualizarSombraDeseado(id, req.Deseado)
+		}
+		if err != nil {
+			tipos.EnviarError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		tipos.EnviarJSON(w, map[string]interface{}{
+			"sombra": sombra,
+			"delta":  sombra.Delta(),
+		})
+	}
+}
+
+// HandlerEliminarSombra elimina una sombra
+func HandlerEliminarSombra(gestor *GestorBorde) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			tipos.EnviarError(w, http.StatusMethodNotAllowed, "método no permitido")
+			return
+		}
+
+		id := r.PathValue("id")
+		if id == "" {
+			tipos.EnviarError(w, http.StatusBadRequest, "id de sombra requerido")
+			return
+		}
+
+		if err := gestor.EliminarSombra(id); err != nil {
+			tipos.EnviarError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		tipos.EnviarJSON(w, map[string]interface{}{
+			"exito":   true,
+			"mensaje": fmt.Sprintf("Sombra %s eliminada", id),
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package borde
+
+import (
+	"errors"
+	"time"
+)
+
+// maxHistorialPorRegla limita la cantidad de ejecuciones que se conservan por regla.
+// Al superarse, se descartan las más antiguas.
+const maxHistorialPorRegla = 100
+
+// RegistroEjecucion describe el resultado de ejecutar una acción de una regla.
+type RegistroEjecucion struct {
+	ReglaID   string    // Regla que disparó la acción
+	Timestamp time.Time // Momento de evaluación que disparó la regla
+	Accion    string    // Tipo de acción ejecutada
+	Destino   string    // Destino de la acción (plantilla sin resolver)
+	Exito     bool      // Si la acción terminó sin error
+	Error     string    // Mensaje de error (vacío si Exito)
+	Respuesta string    // Resumen de la respuesta informada por el ejecutor (opcional)
+}
+
+// errResultadoRegistrado lo retorna un ejecutor del motor que registra él mismo el
+// resultado de la acción en el historial, p. ej. al terminar en segundo plano. Para
+// quien lo invoca la acción no falló.
+var errResultadoRegistrado = errors.New("resultado registrado por el ejecutor")
+
+// registrarResultado agrega al historial el resultado de una acción, salvo que el
+// ejecutor ya lo haya hecho, y retorna su error
+func (mr *MotorReglas) registrarResultado(registro RegistroEjecucion, err error) error {
+	if errors.Is(err, errResultadoRegistrado) {
+		return nil
+	}
+	registro.Exito = err == nil
+	if err != nil {
+		registro.Error = err.Error()
+	}
+	mr.registrarEjecucion(registro)
+	return err
+}
+
+// registrarEjecucion agrega un registro al historial en memoria de la regla.
+// Usa su propio mutex porque se invoca mientras evaluarReglas mantiene mr.mu.
+func (mr *MotorReglas) registrarEjecucion(registro RegistroEjecucion) {
+	mr.historialMu.Lock()
+	defer mr.historialMu.Unlock()
+
+	if mr.historial == nil {
+		mr.historial = make(map[string][]RegistroEjecucion)
+	}
+
+	registros := append(mr.historial[registro.ReglaID], registro)
+	if len(registros) > maxHistorialPorRegla {
+		registros = registros[len(registros)-maxHistorialPorRegla:]
+	}
+	mr.historial[registro.ReglaID] = registros
+}
+
+// ObtenerHistorial devuelve una copia del historial de ejecuciones de una regla,
+// ordenado de la más antigua a la más reciente.
+func (mr *MotorReglas) ObtenerHistorial(id string) []RegistroEjecucion {
+	mr.historialMu.Lock()
+	defer mr.historialMu.Unlock()
+
+	registros := mr.historial[id]
+	copia := make([]RegistroEjecucion, len(registros))
+	copy(copia, registros)
+	return copia
+}
+
+// eliminarHistorial descarta el historial de una regla (p.ej. al eliminarla)
+func (mr *MotorReglas) eliminarHistorial(id string) {
+	mr.historialMu.Lock()
+	defer mr.historialMu.Unlock()
+
+	delete(mr.historial, id)
+}
@@ -0,0 +1,135 @@
+package borde
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/formatos"
+	"github.com/sensorwave-dev/sensorwave/tipos"
+)
+
+// Ingesta de payloads con esquema desde tópicos del middleware.
+//
+// Una ReglaIngesta suscribe el gestor a un patrón de tópicos y convierte cada payload
+// (un pack SenML, un mensaje Sparkplug B o un registro ya normalizado por el servidor
+// en normalizado/#) en registros que se insertan en series. El path de la serie es el
+// prefijo de la regla seguido de la serie del registro, con los caracteres que no
+// admite un path reemplazados por '_' (p.ej. "urn:dev:ow:10e2:temp" -> "urn_dev_ow_10e2_temp").
+
+// FormatoIngesta indica cómo se decodifican los payloads de una regla de ingesta
+type FormatoIngesta string
+
+const (
+	IngestaSenML       FormatoIngesta = "senml"       // pack SenML JSON o CBOR (RFC 8428)
+	IngestaSparkplug   FormatoIngesta = "sparkplug"   // payload Sparkplug B del tópico spBv1.0/...
+	IngestaNormalizada FormatoIngesta = "normalizada" // registro publicado por el servidor en normalizado/<serie>
+)
+
+// ReglaIngesta asocia un patrón de tópicos con las series del gestor
+type ReglaIngesta struct {
+	Topico      string // patrón de tópicos (admite + y #)
+	Formato     FormatoIngesta
+	Prefijo     string // path antepuesto a la serie de cada registro ("" = ninguno)
+	CrearSeries bool   // crea las series inexistentes con el tipo del primer valor recibido
+}
+
+// decodificador retorna la función que convierte un payload de la regla en registros
+func (r ReglaIngesta) decodificador() (func(topico string, payload []byte) ([]formatos.Registro, error), error) {
+	switch r.Formato {
+	case IngestaSenML:
+		return func(_ string, payload []byte) ([]formatos.Registro, error) {
+			return formatos.DecodificarSenML(payload)
+		}, nil
+	case IngestaSparkplug:
+		return formatos.NuevoDecodificadorSparkplug().Decodificar, nil
+	case IngestaNormalizada:
+		return func(_ string, payload []byte) ([]formatos.Registro, error) {
+			var registro formatos.Registro
+			if err := json.Unmarshal(payload, &registro); err != nil {
+				return nil, err
+			}
+			return []formatos.Registro{registro}, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("formato de ingesta desconocido: %q", r.Formato)
+}
+
+// SuscribirIngesta suscribe el gestor a los tópicos de la regla con el cliente indicado.
+// Los payloads inválidos y los registros rechazados se informan en el log.
+func (me *GestorBorde) SuscribirIngesta(cliente middleware.Cliente, regla ReglaIngesta) error {
+	if cliente == nil {
+		return fmt.Errorf("se requiere un cliente del middleware para la ingesta")
+	}
+	if regla.Topico == "" {
+		return fmt.Errorf("la regla de ingesta no tiene tópico")
+	}
+	decodificar, err := regla.decodificador()
+	if err != nil {
+		return err
+	}
+	return cliente.Suscribir(regla.Topico, func(topico string, payload []byte) {
+		registros, err := decodificar(topico, payload)
+		if err != nil {
+			// Sparkplug retorna los registros resueltos junto con el error de los demás
+			log.Printf("Ingesta '%s': %v", topico, err)
+		}
+		if err := me.IngerirRegistros(regla.Prefijo, registros, regla.CrearSeries); err != nil {
+			log.Printf("Ingesta '%s': %v", topico, err)
+		}
+	})
+}
+
+// IngerirRegistros inserta registros decodificados en las series prefijo/<serie>.
+// Con crearSeries crea las series que no existen; si no, un registro de una serie
+// inexistente es un error. Intenta todos los registros y retorna los errores unidos.
+func (me *GestorBorde) IngerirRegistros(prefijo string, registros []formatos.Registro, crearSeries bool) error {
+	var errs []error
+	for _, r := range registros {
+		path := pathIngesta(prefijo, r.Serie)
+		if _, existe := me.coordinadores.Load(path); !existe && crearSeries {
+			if err := me.crearSerieIngesta(path, r.TipoDatos()); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		if err := me.Insertar(path, r.Tiempo, r.Valor); err != nil {
+			errs = append(errs, fmt.Errorf("serie %s: %v", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// crearSerieIngesta crea una serie con la configuración por defecto de las series
+// creadas desde la API HTTP
+func (me *GestorBorde) crearSerieIngesta(path string, tipoDatos tipos.TipoDatos) error {
+	return me.CrearSerie(tipos.Serie{
+		Path:             path,
+		TipoDatos:        tipoDatos,
+		TamañoBloque:     100,
+		CompresionBytes:  tipos.SinCompresion,
+		CompresionBloque: tipos.LZ4,
+		Tags:             map[string]string{"origen": "ingesta"},
+	})
+}
+
+// pathIngesta construye el path de la serie de un registro, reemplazando por '_' los
+// caracteres que no admite esPathValido y descartando los segmentos vacíos
+func pathIngesta(prefijo, serie string) string {
+	var segmentos []string
+	for _, segmento := range strings.Split(prefijo+"/"+serie, "/") {
+		segmento = strings.Map(func(c rune) rune {
+			if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' {
+				return c
+			}
+			return '_'
+		}, strings.TrimSpace(segmento))
+		if segmento != "" {
+			segmentos = append(segmentos, segmento)
+		}
+	}
+	return strings.Join(segmentos, "/")
+}
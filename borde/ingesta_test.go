@@ -0,0 +1,115 @@
+package borde
+
+import (
+	"testing"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/formatos"
+	"github.com/sensorwave-dev/sensorwave/tipos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clienteIngestaMock guarda los manejadores suscritos para invocarlos en el test
+type clienteIngestaMock struct {
+	manejadores map[string]middleware.CallbackFunc
+}
+
+func (c *clienteIngestaMock) Desconectar() {}
+
+func (c *clienteIngestaMock) Publicar(string, interface{}, ...middleware.PublicarOpcion) error {
+	return nil
+}
+
+func (c *clienteIngestaMock) Suscribir(topico string, manejador middleware.CallbackFunc) error {
+	c.manejadores[topico] = manejador
+	return nil
+}
+
+func (c *clienteIngestaMock) Desuscribir(topico string) error {
+	delete(c.manejadores, topico)
+	return nil
+}
+
+func crearGestorIngesta(t *testing.T) *GestorBorde {
+	t.Helper()
+	gestor, err := Crear(Opciones{NombreDB: t.TempDir() + "/ingesta.db", Direccion: "localhost"})
+	require.NoError(t, err)
+	t.Cleanup(func() { gestor.Cerrar() })
+	return gestor
+}
+
+func TestPathIngesta(t *testing.T) {
+	casos := []struct{ prefijo, serie, esperado string }{
+		{"", "planta/linea1/temp", "planta/linea1/temp"},
+		{"senml", "urn:dev:ow:10e2:temp", "senml/urn_dev_ow_10e2_temp"},
+		{"/sp/", "planta//borde1/motor.rpm", "sp/planta/borde1/motor_rpm"},
+		{"", " sala 1 /temp", "sala_1/temp"},
+	}
+	for _, c := range casos {
+		path := pathIngesta(c.prefijo, c.serie)
+		assert.Equal(t, c.esperado, path)
+		assert.True(t, esPathValido(path), "path inválido: %s", path)
+	}
+}
+
+func TestIngerirRegistros_CreaSeries(t *testing.T) {
+	gestor := crearGestorIngesta(t)
+	registros := []formatos.Registro{
+		{Serie: "dev:1/temp", Tiempo: 1000, Valor: 21.5},
+		{Serie: "dev:1/pulsos", Tiempo: 1000, Valor: int64(7)},
+		{Serie: "dev:1/temp", Tiempo: 2000, Valor: 22.0},
+	}
+	require.NoError(t, gestor.IngerirRegistros("ingesta", registros, true))
+
+	serie, err := gestor.ObtenerSeries("ingesta/dev_1/temp")
+	require.NoError(t, err)
+	assert.Equal(t, tipos.Real, serie.TipoDatos)
+	assert.Equal(t, "ingesta", serie.Tags["origen"])
+	serie, err = gestor.ObtenerSeries("ingesta/dev_1/pulsos")
+	require.NoError(t, err)
+	assert.Equal(t, tipos.Integer, serie.TipoDatos)
+
+	punto, err := gestor.ConsultarUltimoPunto("ingesta/dev_1/temp", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{2000}, punto.Tiempos)
+	assert.Equal(t, []interface{}{22.0}, punto.Valores)
+}
+
+func TestIngerirRegistros_SinCrearSeries(t *testing.T) {
+	gestor := crearGestorIngesta(t)
+	require.NoError(t, gestor.crearSerieIngesta("existente/temp", tipos.Real))
+
+	registros := []formatos.Registro{
+		{Serie: "inexistente/temp", Tiempo: 1000, Valor: 1.0},
+		{Serie: "existente/temp", Tiempo: 1000, Valor: 2.0},
+	}
+	err := gestor.IngerirRegistros("", registros, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "inexistente/temp")
+
+	// El registro de la serie existente se insertó igual
+	punto, err := gestor.ConsultarUltimoPunto("existente/temp", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{2.0}, punto.Valores)
+}
+
+func TestSuscribirIngesta_SenML(t *testing.T) {
+	gestor := crearGestorIngesta(t)
+	cliente := &clienteIngestaMock{manejadores: make(map[string]middleware.CallbackFunc)}
+
+	assert.Error(t, gestor.SuscribirIngesta(cliente, ReglaIngesta{Topico: "x", Formato: "xml"}))
+	assert.Error(t, gestor.SuscribirIngesta(nil, ReglaIngesta{Topico: "x", Formato: IngestaSenML}))
+	require.NoError(t, gestor.SuscribirIngesta(cliente, ReglaIngesta{Topico: "dispositivos/#", Formato: IngestaSenML, Prefijo: "campo", CrearSeries: true}))
+
+	manejador := cliente.manejadores["dispositivos/#"]
+	require.NotNil(t, manejador)
+	manejador("dispositivos/sala", []byte(`[{"bn":"sala/","bt":1700000000,"n":"temp","v":20.5},{"n":"abierta","vb":true}]`))
+	manejador("dispositivos/sala", []byte(`no es senml`))
+
+	punto, err := gestor.ConsultarUltimoPunto("campo/sala/*", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"campo/sala/abierta", "campo/sala/temp"}, punto.Series)
+	assert.Equal(t, []interface{}{true, 20.5}, punto.Valores)
+	assert.Equal(t, []int64{1700000000e9, 1700000000e9}, punto.Tiempos)
+}
@@ -0,0 +1,145 @@
+package borde
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxEvaluacionesPrueba limita la cantidad de pasos de una prueba de regla
+// para evitar recorridos accidentales muy largos (p.ej. un año con paso de 1s).
+const maxEvaluacionesPrueba = 100000
+
+// DisparoPrueba representa un instante en el que la regla se habría disparado
+type DisparoPrueba struct {
+	Timestamp time.Time              // Momento de evaluación
+	Valores   map[string]interface{} // Último valor de cada serie de las condiciones en ese momento
+}
+
+// ResultadoPruebaRegla contiene el resultado de reproducir una regla sobre datos históricos
+type ResultadoPruebaRegla struct {
+	ReglaID      string
+	Inicio       time.Time
+	Fin          time.Time
+	Paso         time.Duration
+	Evaluaciones int             // Cantidad de pasos evaluados
+	Activaciones int             // Transiciones de no cumplida a cumplida
+	Disparos     []DisparoPrueba // Pasos en los que las condiciones se cumplieron
+}
+
+// ProbarRegla reproduce la evaluación de condiciones de una regla sobre datos históricos,
+// desde inicio hasta fin (inclusive) cada paso, sin ejecutar sus acciones.
+// La regla no necesita estar registrada en el motor; se valida igual que en AgregarRegla.
+func (mr *MotorReglas) ProbarRegla(regla *Regla, inicio, fin time.Time, paso time.Duration) (*ResultadoPruebaRegla, error) {
+	if regla == nil {
+		return nil, fmt.Errorf("regla no puede ser nil")
+	}
+	if mr.gestor == nil {
+		return nil, fmt.Errorf("el motor de reglas no tiene gestor asociado")
+	}
+	if paso <= 0 {
+		return nil, fmt.Errorf("el paso debe ser mayor a cero")
+	}
+	if fin.Before(inicio) {
+		return nil, fmt.Errorf("el fin debe ser posterior al inicio")
+	}
+	if pasos := int64(fin.Sub(inicio)/paso) + 1; pasos > maxEvaluacionesPrueba {
+		return nil, fmt.Errorf("la prueba requiere %d evaluaciones (máximo %d), aumente el paso", pasos, maxEvaluacionesPrueba)
+	}
+
+	// Validar una copia para no modificar la regla recibida: la validación completa la
+	// lógica de los grupos y las acciones
+	copia := copiarRegla(regla)
+	if copia.ID == "" {
+		copia.ID = "prueba"
+	}
+	if err := mr.validarRegla(&copia); err != nil {
+		return nil, fmt.Errorf("regla inválida: %v", err)
+	}
+
+	resultado := &ResultadoPruebaRegla{
+		ReglaID:  copia.ID,
+		Inicio:   inicio,
+		Fin:      fin,
+		Paso:     paso,
+		Disparos: []DisparoPrueba{},
+	}
+
+	cumpliaAntes := false
+	for t := inicio; !t.After(fin); t = t.Add(paso) {
+		resultado.Evaluaciones++
+
+		cumple := mr.evaluarCondicionesRegla(&copia, t)
+		if cumple {
+			valores, _ := mr.recolectarValores(&copia, t)
+			resultado.Disparos = append(resultado.Disparos, DisparoPrueba{Timestamp: t, Valores: valores})
+			if !cumpliaAntes {
+				resultado.Activaciones++
+			}
+		}
+		cumpliaAntes = cumple
+	}
+
+	return resultado, nil
+}
+
+// copiarRegla copia la regla sin compartir condiciones, grupos ni acciones
+func copiarRegla(regla *Regla) Regla {
+	copia := *regla
+	copia.Condiciones = copiarCondiciones(regla.Condiciones)
+	copia.Grupos = copiarGrupos(regla.Grupos)
+	copia.Acciones = copiarAcciones(regla.Acciones)
+	return copia
+}
+
+func copiarCondiciones(condiciones []Condicion) []Condicion {
+	if condiciones == nil {
+		return nil
+	}
+	copia := make([]Condicion, len(condiciones))
+	for i, c := range condiciones {
+		if c.Referencia != nil {
+			referencia := *c.Referencia
+			c.Referencia = &referencia
+		}
+		copia[i] = c
+	}
+	return copia
+}
+
+func copiarGrupos(grupos []GrupoCondiciones) []GrupoCondiciones {
+	if grupos == nil {
+		return nil
+	}
+	copia := make([]GrupoCondiciones, len(grupos))
+	for i, g := range grupos {
+		copia[i] = GrupoCondiciones{
+			Logica:      g.Logica,
+			Condiciones: copiarCondiciones(g.Condiciones),
+			Grupos:      copiarGrupos(g.Grupos),
+		}
+	}
+	return copia
+}
+
+func copiarAcciones(acciones []Accion) []Accion {
+	if acciones == nil {
+		return nil
+	}
+	copia := make([]Accion, len(acciones))
+	for i, a := range acciones {
+		if a.Parametros != nil {
+			parametros := make(map[string]string, len(a.Parametros))
+			for k, v := range a.Parametros {
+				parametros[k] = v
+			}
+			a.Parametros = parametros
+		}
+		if a.Confirmacion != nil {
+			confirmacion := *a.Confirmacion
+			confirmacion.Escalamiento = copiarAcciones(confirmacion.Escalamiento)
+			a.Confirmacion = &confirmacion
+		}
+		copia[i] = a
+	}
+	return copia
+}
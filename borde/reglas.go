@@ -65,30 +65,74 @@ type Condicion struct {
 
 	// Valor umbral para la comparación.
 	// Tipos soportados: bool, int64, float64, string
+	// Se ignora si Referencia no es nil.
 	Valor interface{}
 
+	// Referencia, si no es nil, reemplaza a Valor: el lado derecho de la comparación
+	// se obtiene de otra serie (p.ej. "temp_interior > temp_exterior + 5").
+	Referencia *ReferenciaSerie
+
 	// AgregarSeries controla cómo se evalúan múltiples series (cuando Path es un patrón wildcard):
 	//   - false (default): Modo "any" - la condición es verdadera si ALGUNA serie cumple
 	//   - true: Modo "all" - primero agrega los valores de todas las series, luego evalúa
 	AgregarSeries bool
 }
 
+// ReferenciaSerie define el lado derecho de una condición a partir de otra serie.
+// El valor se calcula como el último valor (o la agregación) de la serie en su ventana
+// más Desplazamiento.
+type ReferenciaSerie struct {
+	// Path de la serie de referencia. Si es un patrón que resuelve a varias series,
+	// se requiere Agregacion para combinarlas en un único valor.
+	Path string
+
+	// VentanaT de la referencia. Si es cero se usa la ventana de la condición.
+	VentanaT time.Duration
+
+	// Agregacion sobre la ventana ("" o "last" = último valor).
+	Agregacion TipoAgregacion
+
+	// Desplazamiento que se suma al valor de referencia (solo valores numéricos).
+	Desplazamiento float64
+}
+
+// GrupoCondiciones combina condiciones y subgrupos con una misma lógica.
+// Permite expresar árboles booleanos, p.ej. (A AND B) OR C:
+//
+//	Regla{
+//	    Logica:      LogicaOR,
+//	    Condiciones: []Condicion{C},
+//	    Grupos:      []GrupoCondiciones{{Logica: LogicaAND, Condiciones: []Condicion{A, B}}},
+//	}
+type GrupoCondiciones struct {
+	Logica      TipoLogica
+	Condiciones []Condicion
+	Grupos      []GrupoCondiciones
+}
+
 type Accion struct {
 	Tipo       string
 	Destino    string
 	Parametros map[string]string
+
+	// Confirmacion, si no es nil, activa el modo de lazo cerrado: el motor espera que el
+	// actuador confirme el comando (ver ConfirmacionAccion y confirmacion_comandos.go).
+	Confirmacion *ConfirmacionAccion
 }
 
 type Regla struct {
 	ID          string
 	Nombre      string
 	Condiciones []Condicion
+	Grupos      []GrupoCondiciones // Subgrupos evaluados junto a Condiciones con la misma Logica
 	Acciones    []Accion
 	Logica      TipoLogica
 	Activa      bool
 	UltimaEval  time.Time
 }
 
+// EjecutorAccion ejecuta una acción de una regla activada. valores es el contexto de
+// la ejecución, compartido por las acciones de la regla: el ejecutor no lo modifica.
 type EjecutorAccion func(accion Accion, regla *Regla, valores map[string]interface{}) error
 
 type MotorReglas struct {
@@ -98,6 +142,15 @@ type MotorReglas struct {
 	mu         sync.RWMutex
 	gestor     *GestorBorde // Referencia al gestor padre (para acceso a datos)
 	db         *pebble.DB   // Conexión a PebbleDB para persistencia de reglas
+
+	historialMu sync.Mutex                     // Mutex propio del historial (se escribe durante evaluarReglas)
+	historial   map[string][]RegistroEjecucion // Historial de ejecuciones por ID de regla
+
+	comandosMu sync.Mutex      // Mutex propio del seguimiento de comandos con confirmación
+	comandos   *estadoComandos // Comandos con confirmación (inicialización perezosa)
+
+	webhooksMu sync.Mutex      // Mutex propio de los webhooks en segundo plano
+	webhooks   *estadoWebhooks // Webhooks esperando respuesta (inicialización perezosa)
 }
 
 // EstadoMotorReglas contiene información sobre el estado actual del motor de reglas
@@ -146,47 +199,92 @@ func (mr *MotorReglas) registrarEjecutoresPorDefecto() {
 			regla.ID, accion.Tipo, accion.Destino, valores)
 		return nil
 	}
+	// Ejecutor webhook: solicitud HTTP en segundo plano (ver crearEjecutorWebhook)
+	mr.ejecutores["webhook"] = mr.crearEjecutorWebhook(nil)
+	// Ejecutor escribir_serie: inserta un valor en una serie local (ver crearEjecutorEscribirSerie)
+	mr.ejecutores[TipoAccionEscribirSerie] = mr.crearEjecutorEscribirSerie()
+	// Ejecutor actualizar_sombra: escribe el estado deseado de una sombra (ver crearEjecutorActualizarSombra)
+	mr.ejecutores[TipoAccionActualizarSombra] = mr.crearEjecutorActualizarSombra()
 	// Nota: Para publicar a actuadores usar PUBLICAR_MQTT, PUBLICAR_HTTP o PUBLICAR_COAP
 	// registrados via RegistrarEjecutorMQTT(), RegistrarEjecutorHTTP(), RegistrarEjecutorCoAP() en ejecutores.go
 }
 
+// maxProfundidadReglas limita cuántos niveles de reglas encadenadas (una regla que escribe
+// en una serie con escribir_serie y dispara otras reglas) se evalúan por cada inserción.
+const maxProfundidadReglas = 4
+
 func (mr *MotorReglas) evaluarReglas(timestamp time.Time) error {
+	return mr.evaluarReglasEncadenadas(timestamp, nil, 0)
+}
+
+// evaluarReglasEncadenadas evalúa las reglas activas y, si alguna escribió en series locales
+// (escribir_serie), vuelve a evaluar en el siguiente nivel una vez liberado mr.mu.
+// Las reglas ya disparadas en la cadena no se reevalúan, de modo que una regla no puede
+// dispararse a sí misma; maxProfundidadReglas acota el resto de los ciclos.
+func (mr *MotorReglas) evaluarReglasEncadenadas(timestamp time.Time, disparadas map[string]bool, profundidad int) error {
 	if !mr.habilitado {
 		return nil
 	}
 
-	mr.mu.RLock()
-	defer mr.mu.RUnlock()
+	if disparadas == nil {
+		disparadas = make(map[string]bool)
+	}
+	escribioSeries := false
 
+	mr.mu.RLock()
 	for _, regla := range mr.reglas {
-		if !regla.Activa {
+		if !regla.Activa || disparadas[regla.ID] {
 			continue
 		}
 
 		if mr.evaluarCondicionesRegla(regla, timestamp) {
-			if err := mr.ejecutarAcciones(regla, timestamp); err != nil {
+			disparadas[regla.ID] = true
+			escribio, err := mr.ejecutarAcciones(regla, timestamp)
+			if err != nil {
 				log.Printf("Error ejecutando acciones de regla '%s': %v", regla.ID, err)
 			}
+			escribioSeries = escribioSeries || escribio
 		}
 
 		regla.UltimaEval = timestamp
 	}
+	mr.mu.RUnlock()
 
-	return nil
+	if !escribioSeries {
+		return nil
+	}
+	if profundidad+1 >= maxProfundidadReglas {
+		log.Printf("Reglas encadenadas superan la profundidad máxima (%d), no se reevalúan", maxProfundidadReglas)
+		return nil
+	}
+	return mr.evaluarReglasEncadenadas(timestamp, disparadas, profundidad+1)
 }
 
 func (mr *MotorReglas) evaluarCondicionesRegla(regla *Regla, timestamp time.Time) bool {
-	if len(regla.Condiciones) == 0 {
+	return mr.evaluarGrupo(&GrupoCondiciones{
+		Logica:      regla.Logica,
+		Condiciones: regla.Condiciones,
+		Grupos:      regla.Grupos,
+	}, timestamp)
+}
+
+// evaluarGrupo evalúa las condiciones y subgrupos de un grupo combinándolos con su lógica.
+// Un grupo vacío es falso.
+func (mr *MotorReglas) evaluarGrupo(grupo *GrupoCondiciones, timestamp time.Time) bool {
+	if len(grupo.Condiciones) == 0 && len(grupo.Grupos) == 0 {
 		return false
 	}
 
-	resultados := make([]bool, len(regla.Condiciones))
+	resultados := make([]bool, 0, len(grupo.Condiciones)+len(grupo.Grupos))
 
-	for i, condicion := range regla.Condiciones {
-		resultados[i] = mr.evaluarCondicion(&condicion, timestamp)
+	for _, condicion := range grupo.Condiciones {
+		resultados = append(resultados, mr.evaluarCondicion(&condicion, timestamp))
+	}
+	for i := range grupo.Grupos {
+		resultados = append(resultados, mr.evaluarGrupo(&grupo.Grupos[i], timestamp))
 	}
 
-	if regla.Logica == LogicaOR {
+	if grupo.Logica == LogicaOR {
 		for _, resultado := range resultados {
 			if resultado {
 				return true
@@ -203,6 +301,20 @@ func (mr *MotorReglas) evaluarCondicionesRegla(regla *Regla, timestamp time.Time
 	return true
 }
 
+// condicionesRegla retorna todas las condiciones de la regla, incluidas las de sus grupos
+func condicionesRegla(regla *Regla) []Condicion {
+	condiciones := append([]Condicion(nil), regla.Condiciones...)
+	var recorrer func(grupos []GrupoCondiciones)
+	recorrer = func(grupos []GrupoCondiciones) {
+		for _, g := range grupos {
+			condiciones = append(condiciones, g.Condiciones...)
+			recorrer(g.Grupos)
+		}
+	}
+	recorrer(regla.Grupos)
+	return condiciones
+}
+
 // CalcularAgregacionSimple calcula una agregación sobre un slice de valores.
 // Función pública para ser usada por consultas y reglas.
 // Solo soporta agregaciones numéricas: promedio, maximo, minimo, suma, count.
@@ -255,6 +367,16 @@ func CalcularAgregacionSimple(valores []float64, agregacion TipoAgregacion) (flo
 func (mr *MotorReglas) evaluarCondicion(condicion *Condicion, timestamp time.Time) bool {
 	tiempoInicio := timestamp.Add(-condicion.VentanaT)
 
+	// Lado derecho: valor constante o referencia a otra serie
+	umbral := condicion.Valor
+	if condicion.Referencia != nil {
+		valor, err := mr.obtenerValorReferencia(condicion.Referencia, condicion.VentanaT, timestamp)
+		if err != nil {
+			return false
+		}
+		umbral = valor
+	}
+
 	// Determinar si es agregación que requiere último valor o agregación completa
 	// Mantenemos compatibilidad con "last" como string para indicar último valor
 	agregacionVacia := condicion.Agregacion == "" || condicion.Agregacion == "last"
@@ -268,12 +390,12 @@ func (mr *MotorReglas) evaluarCondicion(condicion *Condicion, timestamp time.Tim
 
 		if condicion.AgregarSeries {
 			// Modo "all": usar el primer valor encontrado (no tiene mucho sentido sin agregación)
-			return mr.aplicarOperador(resultado.Valores[0], condicion.Operador, condicion.Valor)
+			return mr.aplicarOperador(resultado.Valores[0], condicion.Operador, umbral)
 		}
 
 		// Modo "any": si alguna serie cumple, retornar true
 		for _, valor := range resultado.Valores {
-			if mr.aplicarOperador(valor, condicion.Operador, condicion.Valor) {
+			if mr.aplicarOperador(valor, condicion.Operador, umbral) {
 				return true
 			}
 		}
@@ -295,18 +417,66 @@ func (mr *MotorReglas) evaluarCondicion(condicion *Condicion, timestamp time.Tim
 		if err != nil {
 			return false
 		}
-		return mr.aplicarOperador(valorFinal, condicion.Operador, condicion.Valor)
+		return mr.aplicarOperador(valorFinal, condicion.Operador, umbral)
 	}
 
 	// Modo "any": si alguna serie cumple
 	for _, valor := range valoresAgregacion {
-		if mr.aplicarOperador(valor, condicion.Operador, condicion.Valor) {
+		if mr.aplicarOperador(valor, condicion.Operador, umbral) {
 			return true
 		}
 	}
 	return false
 }
 
+// obtenerValorReferencia calcula el valor de una ReferenciaSerie en el momento de evaluación.
+// ventanaCondicion se usa cuando la referencia no define su propia ventana.
+func (mr *MotorReglas) obtenerValorReferencia(ref *ReferenciaSerie, ventanaCondicion time.Duration, timestamp time.Time) (interface{}, error) {
+	ventana := ref.VentanaT
+	if ventana <= 0 {
+		ventana = ventanaCondicion
+	}
+	tiempoInicio := timestamp.Add(-ventana)
+
+	var valor interface{}
+	if ref.Agregacion == "" || ref.Agregacion == "last" {
+		resultado, err := mr.gestor.ConsultarUltimoPunto(ref.Path, &tiempoInicio, &timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if len(resultado.Valores) != 1 {
+			return nil, fmt.Errorf("referencia '%s' resuelve a %d series (use una agregación)", ref.Path, len(resultado.Valores))
+		}
+		valor = resultado.Valores[0]
+	} else {
+		resultado, err := mr.gestor.ConsultarAgregacion(ref.Path, tiempoInicio, timestamp, []tipos.TipoAgregacion{ref.Agregacion})
+		if err != nil {
+			return nil, err
+		}
+		if len(resultado.Valores) == 0 || len(resultado.Valores[0]) == 0 {
+			return nil, fmt.Errorf("referencia '%s' sin datos", ref.Path)
+		}
+		agregado, err := CalcularAgregacionSimple(resultado.Valores[0], ref.Agregacion)
+		if err != nil {
+			return nil, err
+		}
+		valor = agregado
+	}
+
+	if ref.Desplazamiento == 0 {
+		return valor, nil
+	}
+
+	switch v := valor.(type) {
+	case int64:
+		return float64(v) + ref.Desplazamiento, nil
+	case float64:
+		return v + ref.Desplazamiento, nil
+	default:
+		return nil, fmt.Errorf("desplazamiento no aplicable a valor %T de '%s'", valor, ref.Path)
+	}
+}
+
 func (mr *MotorReglas) aplicarOperador(valor1 interface{}, operador TipoOperador, valor2 interface{}) bool {
 	const epsilon = 1e-9
 
@@ -398,12 +568,13 @@ func (mr *MotorReglas) aplicarOperador(valor1 interface{}, operador TipoOperador
 	return false
 }
 
-func (mr *MotorReglas) ejecutarAcciones(regla *Regla, timestamp time.Time) error {
+// recolectarValores obtiene el último valor de cada serie de las condiciones de la regla
+// en su ventana. Retorna también la serie principal (la primera encontrada).
+func (mr *MotorReglas) recolectarValores(regla *Regla, timestamp time.Time) (map[string]interface{}, string) {
 	valores := make(map[string]interface{})
 	var seriePrincipal string
 
-	// Recolectar valores de las condiciones para pasarlos a las acciones
-	for _, condicion := range regla.Condiciones {
+	for _, condicion := range condicionesRegla(regla) {
 		tiempoInicio := timestamp.Add(-condicion.VentanaT)
 
 		// Usar ConsultarUltimoPunto para obtener los valores actuales
@@ -424,6 +595,15 @@ func (mr *MotorReglas) ejecutarAcciones(regla *Regla, timestamp time.Time) error
 		}
 	}
 
+	return valores, seriePrincipal
+}
+
+// ejecutarAcciones ejecuta las acciones de una regla activada.
+// Retorna true si alguna acción escribió en una serie local (para reevaluar reglas encadenadas).
+func (mr *MotorReglas) ejecutarAcciones(regla *Regla, timestamp time.Time) (bool, error) {
+	// Recolectar valores de las condiciones para pasarlos a las acciones
+	valores, seriePrincipal := mr.recolectarValores(regla, timestamp)
+
 	// Agregar metadatos de contexto para resolución de plantillas
 	if seriePrincipal != "" {
 		valores["_serie"] = seriePrincipal
@@ -432,23 +612,53 @@ func (mr *MotorReglas) ejecutarAcciones(regla *Regla, timestamp time.Time) error
 			valores[fmt.Sprintf("_serie_%d", i)] = parte
 		}
 	}
+	if valor, ok := valores[seriePrincipal]; ok {
+		valores["_valor"] = valor
+	}
 	valores["_regla_id"] = regla.ID
 	valores["_regla_nombre"] = regla.Nombre
 	valores["_timestamp"] = timestamp
 
-	for _, accion := range regla.Acciones {
+	escribioSeries := false
+	for i, accion := range regla.Acciones {
 		ejecutor, existe := mr.ejecutores[accion.Tipo]
 		if !existe {
 			log.Printf("Ejecutor no encontrado para tipo de acción: %s", accion.Tipo)
 			continue
 		}
 
-		if err := ejecutor(accion, regla, valores); err != nil {
-			return fmt.Errorf("error ejecutando acción %s: %v", accion.Tipo, err)
+		delete(valores, "_comando_id")
+
+		// Acciones con confirmación: no reenviar mientras haya un comando pendiente
+		var comandoID string
+		if accion.Confirmacion != nil {
+			if mr.hayComandoPendiente(regla.ID, i) {
+				continue
+			}
+			comandoID = generarIDComando()
+			valores["_comando_id"] = comandoID
+		}
+
+		err := mr.registrarResultado(RegistroEjecucion{
+			ReglaID:   regla.ID,
+			Timestamp: timestamp,
+			Accion:    accion.Tipo,
+			Destino:   accion.Destino,
+		}, ejecutor(accion, regla, valores))
+
+		// Un primer envío fallido también se sigue: se reintenta y escala como uno sin confirmar
+		if comandoID != "" {
+			mr.seguirComando(comandoID, regla, i, accion, ejecutor, valores, timestamp, err)
+		}
+		if err != nil {
+			return escribioSeries, fmt.Errorf("error ejecutando acción %s: %v", accion.Tipo, err)
+		}
+		if accion.Tipo == TipoAccionEscribirSerie {
+			escribioSeries = true
 		}
 	}
 
-	return nil
+	return escribioSeries, nil
 }
 
 func (mr *MotorReglas) RegistrarEjecutor(tipoAccion string, ejecutor EjecutorAccion) error {
@@ -484,8 +694,8 @@ func (mr *MotorReglas) validarRegla(regla *Regla) error {
 		return fmt.Errorf("ID de regla no puede estar vacío")
 	}
 
-	if len(regla.Condiciones) == 0 {
-		return fmt.Errorf("regla debe tener al menos una condición")
+	if len(regla.Condiciones) == 0 && len(regla.Grupos) == 0 {
+		return fmt.Errorf("regla debe tener al menos una condición o grupo de condiciones")
 	}
 
 	if len(regla.Acciones) == 0 {
@@ -498,6 +708,12 @@ func (mr *MotorReglas) validarRegla(regla *Regla) error {
 		}
 	}
 
+	for i := range regla.Grupos {
+		if err := mr.validarGrupo(&regla.Grupos[i], 1); err != nil {
+			return fmt.Errorf("grupo %d inválido: %v", i, err)
+		}
+	}
+
 	for i, accion := range regla.Acciones {
 		if err := mr.validarAccion(&accion); err != nil {
 			return fmt.Errorf("acción %d inválida: %v", i, err)
@@ -511,6 +727,42 @@ func (mr *MotorReglas) validarRegla(regla *Regla) error {
 	return nil
 }
 
+// maxProfundidadGrupos limita el anidamiento de grupos de condiciones
+const maxProfundidadGrupos = 8
+
+// validarGrupo valida recursivamente un grupo de condiciones.
+// Un grupo sin lógica usa AND, igual que la regla.
+func (mr *MotorReglas) validarGrupo(grupo *GrupoCondiciones, profundidad int) error {
+	if profundidad > maxProfundidadGrupos {
+		return fmt.Errorf("anidamiento de grupos supera el máximo (%d)", maxProfundidadGrupos)
+	}
+
+	if len(grupo.Condiciones) == 0 && len(grupo.Grupos) == 0 {
+		return fmt.Errorf("grupo debe tener al menos una condición o subgrupo")
+	}
+
+	if grupo.Logica == "" {
+		grupo.Logica = LogicaAND
+	}
+	if grupo.Logica != LogicaAND && grupo.Logica != LogicaOR {
+		return fmt.Errorf("lógica de grupo inválida: %s", grupo.Logica)
+	}
+
+	for i, condicion := range grupo.Condiciones {
+		if err := mr.validarCondicion(&condicion); err != nil {
+			return fmt.Errorf("condición %d inválida: %v", i, err)
+		}
+	}
+
+	for i := range grupo.Grupos {
+		if err := mr.validarGrupo(&grupo.Grupos[i], profundidad+1); err != nil {
+			return fmt.Errorf("grupo %d inválido: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
 func (mr *MotorReglas) validarCondicion(condicion *Condicion) error {
 	// VALIDACIÓN 1: Path no puede estar vacío
 	if condicion.Path == "" {
@@ -535,8 +787,12 @@ func (mr *MotorReglas) validarCondicion(condicion *Condicion) error {
 		return fmt.Errorf("operador inválido: %s", condicion.Operador)
 	}
 
-	// VALIDACIÓN 4: Valor no puede ser nil
-	if condicion.Valor == nil {
+	// VALIDACIÓN 4: Valor no puede ser nil (salvo que la condición use una referencia a serie)
+	if condicion.Referencia != nil {
+		if err := validarReferencia(condicion.Referencia); err != nil {
+			return fmt.Errorf("referencia inválida: %v", err)
+		}
+	} else if condicion.Valor == nil {
 		return fmt.Errorf("valor de condición no puede ser nil")
 	}
 
@@ -544,6 +800,8 @@ func (mr *MotorReglas) validarCondicion(condicion *Condicion) error {
 	switch condicion.Valor.(type) {
 	case bool, int64, float64, string:
 		// OK
+	case nil:
+		// Solo alcanzable con Referencia (validada arriba)
 	default:
 		return fmt.Errorf("tipo de valor no soportado: %T (use bool, int64, float64 o string)", condicion.Valor)
 	}
@@ -587,6 +845,36 @@ func (mr *MotorReglas) validarCondicion(condicion *Condicion) error {
 	return nil
 }
 
+// validarReferencia valida el lado derecho de una condición que referencia otra serie
+func validarReferencia(ref *ReferenciaSerie) error {
+	if ref.Path == "" {
+		return fmt.Errorf("path de referencia no puede estar vacío")
+	}
+
+	if ref.VentanaT < 0 {
+		return fmt.Errorf("ventana temporal de referencia no puede ser negativa")
+	}
+
+	sinAgregacion := ref.Agregacion == "" || ref.Agregacion == "last"
+	if sinAgregacion && strings.Contains(ref.Path, "*") {
+		return fmt.Errorf("referencia con patrón '%s' requiere una agregación", ref.Path)
+	}
+
+	if !sinAgregacion {
+		switch ref.Agregacion {
+		case AgregacionPromedio, AgregacionMaximo, AgregacionMinimo, AgregacionSuma, AgregacionConteo:
+		default:
+			return fmt.Errorf("agregación inválida: %s (use: promedio, maximo, minimo, suma, count)", ref.Agregacion)
+		}
+	}
+
+	if math.IsNaN(ref.Desplazamiento) || math.IsInf(ref.Desplazamiento, 0) {
+		return fmt.Errorf("desplazamiento inválido: %v", ref.Desplazamiento)
+	}
+
+	return nil
+}
+
 // validarAgregacionCompatible verifica que la agregación sea compatible con los tipos de las series.
 // Usa el Path para resolver las series (puede incluir wildcards).
 func (mr *MotorReglas) validarAgregacionCompatible(condicion *Condicion) error {
@@ -651,6 +939,19 @@ func (mr *MotorReglas) validarAccion(accion *Accion) error {
 		return fmt.Errorf("variables faltantes en params: %v", err)
 	}
 
+	if accion.Confirmacion != nil {
+		if err := mr.validarConfirmacion(accion.Confirmacion); err != nil {
+			return err
+		}
+	}
+
+	if accion.Tipo == TipoAccionEscribirSerie {
+		return validarAccionEscribirSerie(accion)
+	}
+	if accion.Tipo == TipoAccionActualizarSombra {
+		return validarAccionActualizarSombra(accion)
+	}
+
 	return nil
 }
 
@@ -780,6 +1081,8 @@ func (mr *MotorReglas) AgregarRegla(regla *Regla) error {
 	if err := mr.AgregarReglaEnMemoria(regla); err != nil {
 		return err
 	}
+	// Si reemplazó una regla con el mismo ID, sus comandos pendientes ya no aplican
+	mr.cancelarComandosRegla(regla.ID)
 
 	log.Printf("Regla '%s' agregada exitosamente", regla.ID)
 
@@ -806,6 +1109,8 @@ func (mr *MotorReglas) EliminarRegla(id string) error {
 	if err := mr.EliminarReglaEnMemoria(id); err != nil {
 		return err
 	}
+	mr.cancelarComandosRegla(id)
+	mr.eliminarHistorial(id)
 
 	log.Printf("Regla '%s' eliminada", id)
 
@@ -844,6 +1149,7 @@ func (mr *MotorReglas) ActualizarRegla(regla *Regla) error {
 	if err := mr.ActualizarReglaEnMemoria(regla); err != nil {
 		return err
 	}
+	mr.cancelarComandosRegla(regla.ID)
 
 	log.Printf("Regla '%s' actualizada", regla.ID)
 
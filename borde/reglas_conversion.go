@@ -0,0 +1,205 @@
+package borde
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/tipos"
+)
+
+// Conversión entre las reglas del motor y su forma serializable (tipos.Regla),
+// usada en el registro del nodo en S3 y en los comandos federados.
+
+// convertirReglaATipos convierte una regla del motor a su forma serializable
+func convertirReglaATipos(regla *Regla) tipos.Regla {
+	return tipos.Regla{
+		ID:          regla.ID,
+		Nombre:      regla.Nombre,
+		Activa:      regla.Activa,
+		Logica:      string(regla.Logica),
+		Condiciones: convertirCondicionesATipos(regla.Condiciones),
+		Grupos:      convertirGruposATipos(regla.Grupos),
+		Acciones:    convertirAccionesATipos(regla.Acciones),
+	}
+}
+
+func convertirAccionesATipos(acciones []Accion) []tipos.Accion {
+	var resultado []tipos.Accion
+	for _, a := range acciones {
+		accion := tipos.Accion{
+			Tipo:       a.Tipo,
+			Destino:    a.Destino,
+			Parametros: a.Parametros,
+		}
+		if c := a.Confirmacion; c != nil {
+			accion.Confirmacion = &tipos.ConfirmacionAccion{
+				Serie:        c.Serie,
+				Topico:       c.Topico,
+				Valor:        c.Valor,
+				Reintentos:   c.Reintentos,
+				Escalamiento: convertirAccionesATipos(c.Escalamiento),
+			}
+			if c.Timeout > 0 {
+				accion.Confirmacion.Timeout = c.Timeout.String()
+			}
+		}
+		resultado = append(resultado, accion)
+	}
+	return resultado
+}
+
+func convertirCondicionesATipos(condiciones []Condicion) []tipos.Condicion {
+	var resultado []tipos.Condicion
+	for _, c := range condiciones {
+		condicion := tipos.Condicion{
+			Path:          c.Path,
+			VentanaT:      c.VentanaT.String(),
+			Agregacion:    string(c.Agregacion),
+			Operador:      string(c.Operador),
+			Valor:         c.Valor,
+			AgregarSeries: c.AgregarSeries,
+		}
+		if c.Referencia != nil {
+			condicion.Referencia = &tipos.ReferenciaSerie{
+				Path:           c.Referencia.Path,
+				Agregacion:     string(c.Referencia.Agregacion),
+				Desplazamiento: c.Referencia.Desplazamiento,
+			}
+			if c.Referencia.VentanaT > 0 {
+				condicion.Referencia.VentanaT = c.Referencia.VentanaT.String()
+			}
+		}
+		resultado = append(resultado, condicion)
+	}
+	return resultado
+}
+
+func convertirGruposATipos(grupos []GrupoCondiciones) []tipos.GrupoCondiciones {
+	var resultado []tipos.GrupoCondiciones
+	for _, g := range grupos {
+		resultado = append(resultado, tipos.GrupoCondiciones{
+			Logica:      string(g.Logica),
+			Condiciones: convertirCondicionesATipos(g.Condiciones),
+			Grupos:      convertirGruposATipos(g.Grupos),
+		})
+	}
+	return resultado
+}
+
+// convertirReglaDesdeTipos convierte una regla serializable a una regla del motor.
+// No valida la regla; eso lo hace AgregarRegla/ActualizarRegla.
+func convertirReglaDesdeTipos(r tipos.Regla) (*Regla, error) {
+	condiciones, err := convertirCondicionesDesdeTipos(r.Condiciones)
+	if err != nil {
+		return nil, err
+	}
+
+	grupos, err := convertirGruposDesdeTipos(r.Grupos)
+	if err != nil {
+		return nil, err
+	}
+
+	acciones, err := convertirAccionesDesdeTipos(r.Acciones)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Regla{
+		ID:          r.ID,
+		Nombre:      r.Nombre,
+		Activa:      r.Activa,
+		Logica:      TipoLogica(r.Logica),
+		Condiciones: condiciones,
+		Grupos:      grupos,
+		Acciones:    acciones,
+	}, nil
+}
+
+func convertirAccionesDesdeTipos(acciones []tipos.Accion) ([]Accion, error) {
+	var resultado []Accion
+	for i, a := range acciones {
+		accion := Accion{
+			Tipo:       a.Tipo,
+			Destino:    a.Destino,
+			Parametros: a.Parametros,
+		}
+		if c := a.Confirmacion; c != nil {
+			escalamiento, err := convertirAccionesDesdeTipos(c.Escalamiento)
+			if err != nil {
+				return nil, fmt.Errorf("acción %d: escalamiento: %v", i, err)
+			}
+			accion.Confirmacion = &ConfirmacionAccion{
+				Serie:        c.Serie,
+				Topico:       c.Topico,
+				Valor:        c.Valor,
+				Reintentos:   c.Reintentos,
+				Escalamiento: escalamiento,
+			}
+			if c.Timeout != "" {
+				accion.Confirmacion.Timeout, err = time.ParseDuration(c.Timeout)
+				if err != nil {
+					return nil, fmt.Errorf("acción %d: timeout de confirmación inválido '%s'", i, c.Timeout)
+				}
+			}
+		}
+		resultado = append(resultado, accion)
+	}
+	return resultado, nil
+}
+
+func convertirCondicionesDesdeTipos(condiciones []tipos.Condicion) ([]Condicion, error) {
+	var resultado []Condicion
+	for i, c := range condiciones {
+		ventana, err := time.ParseDuration(c.VentanaT)
+		if err != nil {
+			return nil, fmt.Errorf("condición %d: ventana_t inválida '%s'", i, c.VentanaT)
+		}
+
+		condicion := Condicion{
+			Path:          c.Path,
+			VentanaT:      ventana,
+			Agregacion:    TipoAgregacion(c.Agregacion),
+			Operador:      TipoOperador(c.Operador),
+			Valor:         c.Valor,
+			AgregarSeries: c.AgregarSeries,
+		}
+
+		if c.Referencia != nil {
+			ref := &ReferenciaSerie{
+				Path:           c.Referencia.Path,
+				Agregacion:     TipoAgregacion(c.Referencia.Agregacion),
+				Desplazamiento: c.Referencia.Desplazamiento,
+			}
+			if c.Referencia.VentanaT != "" {
+				ref.VentanaT, err = time.ParseDuration(c.Referencia.VentanaT)
+				if err != nil {
+					return nil, fmt.Errorf("condición %d: ventana_t de referencia inválida '%s'", i, c.Referencia.VentanaT)
+				}
+			}
+			condicion.Referencia = ref
+		}
+
+		resultado = append(resultado, condicion)
+	}
+	return resultado, nil
+}
+
+func convertirGruposDesdeTipos(grupos []tipos.GrupoCondiciones) ([]GrupoCondiciones, error) {
+	var resultado []GrupoCondiciones
+	for i, g := range grupos {
+		condiciones, err := convertirCondicionesDesdeTipos(g.Condiciones)
+		if err != nil {
+			return nil, fmt.Errorf("grupo %d: %v", i, err)
+		}
+		subgrupos, err := convertirGruposDesdeTipos(g.Grupos)
+		if err != nil {
+			return nil, fmt.Errorf("grupo %d: %v", i, err)
+		}
+		resultado = append(resultado, GrupoCondiciones{
+			Logica:      TipoLogica(g.Logica),
+			Condiciones: condiciones,
+			Grupos:      subgrupos,
+		})
+	}
+	return resultado, nil
+}
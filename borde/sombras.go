@@ -0,0 +1,283 @@
+package borde
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/tipos"
+)
+
+// Sombras de dispositivos (estado deseado vs reportado).
+//
+// Cada sombra se identifica por el ID de un dispositivo o de uno de sus actuadores
+// ("sala1", "sala1/valvula") y guarda dos documentos JSON planos: Deseado, que escriben
+// las reglas (acción actualizar_sombra), la API REST y la nube, y Reportado, que publica
+// el dispositivo en sombras/<id>/reportado. Las claves de Deseado cuyo valor difiere de
+// Reportado forman el delta, que se publica en sombras/<id>/delta:
+//   - al cambiar el estado deseado, y
+//   - cuando el dispositivo reconecta: vuelve a anunciarse o publica tras más de
+//     umbralReconexionDispositivo sin actividad (ver registrarActividadDispositivo).
+//
+// En ambos documentos un valor null elimina la clave.
+
+const (
+	prefijoSombras = "sombras"
+
+	umbralReconexionDispositivo = 2 * time.Minute
+)
+
+func init() {
+	// Valores JSON anidados dentro de Deseado/Reportado
+	gob.Register(map[string]interface{}{})
+}
+
+// Sombra es el documento de estado de un dispositivo o actuador
+type Sombra struct {
+	ID          string                 `json:"id"`
+	Deseado     map[string]interface{} `json:"deseado"`
+	Reportado   map[string]interface{} `json:"reportado"`
+	Version     int64                  `json:"version"`
+	Actualizado time.Time              `json:"actualizado"`
+}
+
+// Delta retorna las claves de Deseado cuyo valor difiere del reportado
+func (s Sombra) Delta() map[string]interface{} {
+	delta := make(map[string]interface{})
+	for clave, deseado := range s.Deseado {
+		if reportado, ok := s.Reportado[clave]; !ok || !reflect.DeepEqual(deseado, reportado) {
+			delta[clave] = deseado
+		}
+	}
+	return delta
+}
+
+// MensajeDeltaSombra es lo que se publica en sombras/<id>/delta
+type MensajeDeltaSombra struct {
+	ID        string                 `json:"id"`
+	Version   int64                  `json:"version"`
+	Delta     map[string]interface{} `json:"delta"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// registroSombras mantiene en memoria las sombras persistidas en Pebble
+type registroSombras struct {
+	mu      sync.RWMutex
+	sombras map[string]*Sombra
+	cliente middleware.Cliente // publica los deltas (nil = sin publicación)
+}
+
+func generarClaveSombra(id string) []byte {
+	return []byte("sombras/" + id)
+}
+
+// cargarRegistroSombras lee las sombras guardadas
+func cargarRegistroSombras(db *pebble.DB) (*registroSombras, error) {
+	r := &registroSombras{sombras: make(map[string]*Sombra)}
+	err := iterarPrefijo(db, "sombras/", func(valor []byte) {
+		var s Sombra
+		if err := tipos.DeserializarGob(valor, &s); err == nil {
+			r.sombras[s.ID] = &s
+		}
+	})
+	return r, err
+}
+
+// ActualizarSombraDeseado combina cambios en el estado deseado (creando la sombra si no
+// existe) y publica el delta resultante
+func (me *GestorBorde) ActualizarSombraDeseado(id string, cambios map[string]interface{}) (Sombra, error) {
+	sombra, err := me.actualizarSombra(id, cambios, nil)
+	if err == nil {
+		me.publicarDeltaSombra(sombra)
+	}
+	return sombra, err
+}
+
+// ActualizarSombraReportado combina cambios en el estado reportado (creando la sombra si
+// no existe)
+func (me *GestorBorde) ActualizarSombraReportado(id string, cambios map[string]interface{}) (Sombra, error) {
+	return me.actualizarSombra(id, nil, cambios)
+}
+
+func (me *GestorBorde) actualizarSombra(id string, deseado, reportado map[string]interface{}) (Sombra, error) {
+	if !esPathValido(id) {
+		return Sombra{}, fmt.Errorf("id de sombra inválido: '%s'", id)
+	}
+	if len(deseado) == 0 && len(reportado) == 0 {
+		return Sombra{}, fmt.Errorf("sombra '%s': no hay cambios", id)
+	}
+
+	me.sombras.mu.Lock()
+	defer me.sombras.mu.Unlock()
+	actual, existe := me.sombras.sombras[id]
+	if !existe {
+		actual = &Sombra{ID: id}
+	}
+	nueva := copiarSombra(actual)
+	combinarEstado(nueva.Deseado, deseado)
+	combinarEstado(nueva.Reportado, reportado)
+	nueva.Version++
+	nueva.Actualizado = time.Now()
+
+	datos, err := tipos.SerializarGob(nueva)
+	if err != nil {
+		return Sombra{}, fmt.Errorf("error al serializar sombra: %v", err)
+	}
+	if err := me.db.Set(generarClaveSombra(id), datos, pebble.Sync); err != nil {
+		return Sombra{}, fmt.Errorf("error al guardar sombra: %v", err)
+	}
+	me.sombras.sombras[id] = &nueva
+	return copiarSombra(&nueva), nil
+}
+
+// ObtenerSombra retorna una sombra
+func (me *GestorBorde) ObtenerSombra(id string) (Sombra, error) {
+	me.sombras.mu.RLock()
+	defer me.sombras.mu.RUnlock()
+	s, existe := me.sombras.sombras[id]
+	if !existe {
+		return Sombra{}, fmt.Errorf("sombra '%s' no encontrada", id)
+	}
+	return copiarSombra(s), nil
+}
+
+// ListarSombras retorna las sombras ordenadas por ID
+func (me *GestorBorde) ListarSombras() []Sombra {
+	me.sombras.mu.RLock()
+	defer me.sombras.mu.RUnlock()
+	lista := make([]Sombra, 0, len(me.sombras.sombras))
+	for _, s := range me.sombras.sombras {
+		lista = append(lista, copiarSombra(s))
+	}
+	sort.Slice(lista, func(i, j int) bool { return lista[i].ID < lista[j].ID })
+	return lista
+}
+
+// EliminarSombra elimina una sombra
+func (me *GestorBorde) EliminarSombra(id string) error {
+	me.sombras.mu.Lock()
+	defer me.sombras.mu.Unlock()
+	if _, existe := me.sombras.sombras[id]; !existe {
+		return fmt.Errorf("sombra '%s' no encontrada", id)
+	}
+	if err := me.db.Delete(generarClaveSombra(id), pebble.Sync); err != nil {
+		return fmt.Errorf("error al eliminar sombra: %v", err)
+	}
+	delete(me.sombras.sombras, id)
+	return nil
+}
+
+// SuscribirSombras escucha los estados reportados en sombras/<id>/reportado y usa el
+// cliente para publicar los deltas. El primer segmento del ID se toma como dispositivo,
+// de modo que reportar cuenta como actividad (y puede disparar la reconexión). Por el
+// middleware solo se aceptan reportes de sombras existentes o de dispositivos aprobados:
+// cualquier publicante podría crear sombras persistidas con IDs arbitrarios.
+func (me *GestorBorde) SuscribirSombras(cliente middleware.Cliente) error {
+	if cliente == nil {
+		return fmt.Errorf("se requiere un cliente del middleware para las sombras")
+	}
+	me.sombras.mu.Lock()
+	me.sombras.cliente = cliente
+	me.sombras.mu.Unlock()
+
+	return cliente.Suscribir(prefijoSombras+"/#", func(topico string, payload []byte) {
+		id, ok := strings.CutSuffix(strings.TrimPrefix(topico, prefijoSombras+"/"), "/reportado")
+		if !ok {
+			return // deltas propios u otros tópicos
+		}
+		if !me.aceptaReporteSombra(id) {
+			log.Printf("Sombra '%s': reporte ignorado, no existe ni pertenece a un dispositivo aprobado", id)
+			return
+		}
+		var reportado map[string]interface{}
+		if err := json.Unmarshal(payload, &reportado); err != nil {
+			log.Printf("Sombra '%s': estado reportado inválido: %v", id, err)
+			return
+		}
+		if _, err := me.ActualizarSombraReportado(id, reportado); err != nil {
+			log.Printf("Sombra '%s': %v", id, err)
+			return
+		}
+		me.registrarActividadDispositivo(splitTopic(id)[0], time.Now())
+	})
+}
+
+// aceptaReporteSombra indica si la sombra id existe o si su primer segmento es un
+// dispositivo aprobado
+func (me *GestorBorde) aceptaReporteSombra(id string) bool {
+	me.sombras.mu.RLock()
+	_, existe := me.sombras.sombras[id]
+	me.sombras.mu.RUnlock()
+	if existe {
+		return true
+	}
+	d, err := me.ObtenerDispositivo(splitTopic(id)[0])
+	return err == nil && d.Estado == DispositivoAprobado
+}
+
+// publicarDeltasDispositivo publica el delta pendiente de las sombras del dispositivo
+// (la suya y las de sus actuadores)
+func (me *GestorBorde) publicarDeltasDispositivo(id string) {
+	me.sombras.mu.RLock()
+	var pendientes []Sombra
+	for _, s := range me.sombras.sombras {
+		if s.ID == id || strings.HasPrefix(s.ID, id+"/") {
+			pendientes = append(pendientes, copiarSombra(s))
+		}
+	}
+	me.sombras.mu.RUnlock()
+
+	for _, s := range pendientes {
+		me.publicarDeltaSombra(s)
+	}
+}
+
+// publicarDeltaSombra publica el delta si no está vacío
+func (me *GestorBorde) publicarDeltaSombra(s Sombra) {
+	me.sombras.mu.RLock()
+	cliente := me.sombras.cliente
+	me.sombras.mu.RUnlock()
+	delta := s.Delta()
+	if cliente == nil || len(delta) == 0 {
+		return
+	}
+	mensaje, _ := json.Marshal(MensajeDeltaSombra{ID: s.ID, Version: s.Version, Delta: delta, Timestamp: time.Now()})
+	topico := fmt.Sprintf("%s/%s/delta", prefijoSombras, s.ID)
+	go func() {
+		if err := cliente.Publicar(topico, mensaje); err != nil {
+			log.Printf("Sombra '%s': error publicando delta: %v", s.ID, err)
+		}
+	}()
+}
+
+// combinarEstado aplica los cambios sobre el documento; un valor nil elimina la clave
+func combinarEstado(documento, cambios map[string]interface{}) {
+	for clave, valor := range cambios {
+		if valor == nil {
+			delete(documento, clave)
+		} else {
+			documento[clave] = valor
+		}
+	}
+}
+
+func copiarSombra(s *Sombra) Sombra {
+	copia := *s
+	copia.Deseado = make(map[string]interface{}, len(s.Deseado))
+	for k, v := range s.Deseado {
+		copia.Deseado[k] = v
+	}
+	copia.Reportado = make(map[string]interface{}, len(s.Reportado))
+	for k, v := range s.Reportado {
+		copia.Reportado[k] = v
+	}
+	return copia
+}
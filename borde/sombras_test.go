@@ -0,0 +1,250 @@
+package borde
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/tipos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clienteSombrasMock registra las publicaciones además de los manejadores
+type clienteSombrasMock struct {
+	clienteIngestaMock
+	publicados chan mensajePublicado
+}
+
+type mensajePublicado struct {
+	topico  string
+	payload []byte
+}
+
+func nuevoClienteSombrasMock() *clienteSombrasMock {
+	return &clienteSombrasMock{
+		clienteIngestaMock: clienteIngestaMock{manejadores: make(map[string]middleware.CallbackFunc)},
+		publicados:         make(chan mensajePublicado, 16),
+	}
+}
+
+func (c *clienteSombrasMock) Publicar(topico string, payload interface{}, _ ...middleware.PublicarOpcion) error {
+	datos, _ := payload.([]byte)
+	c.publicados <- mensajePublicado{topico, datos}
+	return nil
+}
+
+// esperarDelta retorna el siguiente delta publicado, ignorando otros tópicos
+func (c *clienteSombrasMock) esperarDelta(t *testing.T) (string, MensajeDeltaSombra) {
+	t.Helper()
+	for {
+		select {
+		case m := <-c.publicados:
+			var delta MensajeDeltaSombra
+			if json.Unmarshal(m.payload, &delta) != nil || delta.Delta == nil {
+				continue
+			}
+			return m.topico, delta
+		case <-time.After(2 * time.Second):
+			t.Fatal("no se publicó el delta")
+			return "", MensajeDeltaSombra{}
+		}
+	}
+}
+
+// sinDeltas verifica que no se publique ningún delta
+func (c *clienteSombrasMock) sinDeltas(t *testing.T) {
+	t.Helper()
+	for {
+		select {
+		case m := <-c.publicados:
+			if strings.HasSuffix(m.topico, "/delta") {
+				t.Fatalf("delta inesperado en %s: %s", m.topico, m.payload)
+			}
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestSombras_DeseadoReportadoYDelta(t *testing.T) {
+	gestor := crearGestorIngesta(t)
+
+	s, err := gestor.ActualizarSombraDeseado("sala1/calefactor", map[string]interface{}{"encendido": true, "consigna": 21.0})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), s.Version)
+	assert.Equal(t, map[string]interface{}{"encendido": true, "consigna": 21.0}, s.Delta())
+
+	s, err = gestor.ActualizarSombraReportado("sala1/calefactor", map[string]interface{}{"encendido": true, "consigna": 18.0})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"consigna": 21.0}, s.Delta())
+
+	s, err = gestor.ActualizarSombraDeseado("sala1/calefactor", map[string]interface{}{"consigna": nil})
+	require.NoError(t, err)
+	assert.Empty(t, s.Delta(), "null elimina la clave del deseado")
+	assert.Equal(t, int64(3), s.Version)
+
+	_, err = gestor.ActualizarSombraDeseado("sala 1", map[string]interface{}{"x": 1.0})
+	assert.Error(t, err)
+	_, err = gestor.ActualizarSombraDeseado("sala1", nil)
+	assert.Error(t, err)
+
+	require.Len(t, gestor.ListarSombras(), 1)
+	require.NoError(t, gestor.EliminarSombra("sala1/calefactor"))
+	_, err = gestor.ObtenerSombra("sala1/calefactor")
+	assert.Error(t, err)
+}
+
+func TestSombras_PersistenciaEntreReinicios(t *testing.T) {
+	nombreDB := t.TempDir() + "/sombras.db"
+	gestor, err := Crear(Opciones{NombreDB: nombreDB, Direccion: "localhost"})
+	require.NoError(t, err)
+	_, err = gestor.ActualizarSombraDeseado("sala1", map[string]interface{}{
+		"modo":   "auto",
+		"config": map[string]interface{}{"horas": []interface{}{8.0, 20.0}},
+	})
+	require.NoError(t, err)
+	_, err = gestor.ActualizarSombraReportado("sala1", map[string]interface{}{"modo": "manual"})
+	require.NoError(t, err)
+	gestor.Cerrar()
+
+	gestor, err = Crear(Opciones{NombreDB: nombreDB, Direccion: "localhost"})
+	require.NoError(t, err)
+	defer gestor.Cerrar()
+
+	s, err := gestor.ObtenerSombra("sala1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), s.Version)
+	assert.Equal(t, "manual", s.Reportado["modo"])
+	assert.Equal(t, map[string]interface{}{"horas": []interface{}{8.0, 20.0}}, s.Deseado["config"])
+	assert.Len(t, s.Delta(), 2)
+}
+
+func TestSombras_PublicaDeltaAlReconectar(t *testing.T) {
+	gestor := crearGestorIngesta(t)
+	cliente := nuevoClienteSombrasMock()
+	require.NoError(t, gestor.SuscribirDispositivos(cliente))
+	require.NoError(t, gestor.SuscribirSombras(cliente))
+
+	_, err := gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala1", Tipo: "clima"})
+	require.NoError(t, err)
+
+	// Cambiar el deseado publica el delta de inmediato
+	_, err = gestor.ActualizarSombraDeseado("sala1/calefactor", map[string]interface{}{"encendido": true})
+	require.NoError(t, err)
+	topico, delta := cliente.esperarDelta(t)
+	assert.Equal(t, "sombras/sala1/calefactor/delta", topico)
+	assert.Equal(t, map[string]interface{}{"encendido": true}, delta.Delta)
+
+	// El dispositivo reporta por el middleware: sin delta pendiente no se publica nada
+	reporte := cliente.manejadores["sombras/#"]
+	reporte("sombras/sala1/calefactor/reportado", []byte(`{"encendido": true}`))
+	s, err := gestor.ObtenerSombra("sala1/calefactor")
+	require.NoError(t, err)
+	assert.Empty(t, s.Delta())
+	reporte("sombras/sala1/calefactor/delta", []byte(`{"delta": {}}`)) // propio, se ignora
+	reporte("sombras/intruso/x/reportado", []byte(`{"encendido": true}`))
+	_, err = gestor.ObtenerSombra("intruso/x")
+	assert.Error(t, err, "no se crean sombras de dispositivos no registrados")
+	cliente.sinDeltas(t)
+
+	// Se reinicia y reporta apagado: al volver a anunciarse recibe el delta
+	reporte("sombras/sala1/calefactor/reportado", []byte(`{"encendido": false}`))
+	_, err = gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala1", Tipo: "clima"})
+	require.NoError(t, err)
+	_, delta = cliente.esperarDelta(t)
+	assert.Equal(t, "sala1/calefactor", delta.ID)
+	assert.Equal(t, map[string]interface{}{"encendido": true}, delta.Delta)
+
+	// Tráfico tras un período sin actividad también cuenta como reconexión
+	gestor.dispositivos.mu.Lock()
+	gestor.dispositivos.dispositivos["sala1"].UltimaActividad = time.Now().Add(-2 * umbralReconexionDispositivo)
+	gestor.dispositivos.mu.Unlock()
+	cliente.manejadores["dispositivos/#"]("dispositivos/sala1/temperatura", []byte("20"))
+	_, delta = cliente.esperarDelta(t)
+	assert.Equal(t, "sala1/calefactor", delta.ID)
+	cliente.manejadores["dispositivos/#"]("dispositivos/sala1/temperatura", []byte("20"))
+	cliente.sinDeltas(t)
+}
+
+func TestSombras_ReporteDispositivoAprobado(t *testing.T) {
+	gestor := crearGestorIngesta(t)
+	cliente := nuevoClienteSombrasMock()
+	require.NoError(t, gestor.SuscribirSombras(cliente))
+	require.NoError(t, gestor.RegistrarTipoDispositivo(tipoSensorClima()))
+	_, err := gestor.AnunciarDispositivo(AnuncioDispositivo{ID: "sala1", Tipo: "clima"})
+	require.NoError(t, err)
+
+	reporte := cliente.manejadores["sombras/#"]
+	reporte("sombras/sala1/reportado", []byte(`{"modo": "auto"}`))
+	_, err = gestor.ObtenerSombra("sala1")
+	assert.Error(t, err, "un dispositivo pendiente no crea su sombra")
+
+	_, err = gestor.AprobarDispositivo("sala1")
+	require.NoError(t, err)
+	reporte("sombras/sala1/reportado", []byte(`{"modo": "auto"}`))
+	s, err := gestor.ObtenerSombra("sala1")
+	require.NoError(t, err)
+	assert.Equal(t, "auto", s.Reportado["modo"])
+}
+
+func TestSombras_AccionRegla(t *testing.T) {
+	gestor := crearGestorIngesta(t)
+	accion := Accion{
+		Tipo:    TipoAccionActualizarSombra,
+		Destino: "{serie_0}/calefactor",
+		Parametros: map[string]string{
+			"deseado.encendido": "true",
+			"deseado.consigna":  "{valor}",
+			"deseado.modo":      "auto",
+		},
+	}
+	require.NoError(t, gestor.motorReglas.validarAccion(&accion))
+
+	ejecutor := gestor.motorReglas.ejecutores[TipoAccionActualizarSombra]
+	valores := map[string]interface{}{"_serie_0": "sala1", "_valor": 19.5}
+	require.NoError(t, ejecutor(accion, &Regla{ID: "frio"}, valores))
+	assert.NotContains(t, valores, "_respuesta", "el contexto se comparte entre acciones")
+
+	s, err := gestor.ObtenerSombra("sala1/calefactor")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"encendido": true, "consigna": 19.5, "modo": "auto"}, s.Deseado)
+
+	// Las variables sin valor en el contexto se detectan antes de resolver
+	err = ejecutor(accion, &Regla{ID: "frio"}, map[string]interface{}{"_serie_0": "sala1"})
+	assert.ErrorContains(t, err, "sin resolver: valor")
+	err = ejecutor(accion, &Regla{ID: "frio"}, map[string]interface{}{"_valor": 19.5})
+	assert.ErrorContains(t, err, "sin resolver: serie_0")
+
+	sinClaves := Accion{Tipo: TipoAccionActualizarSombra, Destino: "sala1", Parametros: map[string]string{"x": "1"}}
+	assert.Error(t, gestor.motorReglas.validarAccion(&sinClaves))
+}
+
+// TestEjecutarComando_Sombras verifica la gestión de sombras por el plano de control federado
+func TestEjecutarComando_Sombras(t *testing.T) {
+	gestor := crearGestorIngesta(t)
+	f := &federacionMQTT{gestor: gestor}
+
+	resultado, err := f.ejecutarComando(tipos.SolicitudControlComando{
+		Operacion:  tipos.OpSombraActualizar,
+		Argumentos: tipos.ComandoArgs{SombraID: "sala1", Deseado: map[string]interface{}{"encendido": true}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"encendido": true}, resultado.(Sombra).Delta())
+
+	resultado, err = f.ejecutarComando(tipos.SolicitudControlComando{
+		Operacion:  tipos.OpSombraObtener,
+		Argumentos: tipos.ComandoArgs{SombraID: "sala1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), resultado.(Sombra).Version)
+
+	_, err = f.ejecutarComando(tipos.SolicitudControlComando{
+		Operacion:  tipos.OpSombraEliminar,
+		Argumentos: tipos.ComandoArgs{SombraID: "sala1"},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, gestor.ListarSombras())
+}
@@ -284,13 +284,14 @@ func HandlerConsultarAgregacionTemporal(gestor *GestorDespachador) http.HandlerF
 
 // ReglaResponse es la respuesta JSON para una regla
 type ReglaResponse struct {
-	ID          string            `json:"id"`
-	Nombre      string            `json:"nombre"`
-	Activa      bool              `json:"activa"`
-	Logica      string            `json:"logica"`
-	NodoID      string            `json:"nodo_id"`
-	Condiciones []tipos.Condicion `json:"condiciones"`
-	Acciones    []tipos.Accion    `json:"acciones"`
+	ID          string                   `json:"id"`
+	Nombre      string                   `json:"nombre"`
+	Activa      bool                     `json:"activa"`
+	Logica      string                   `json:"logica"`
+	NodoID      string                   `json:"nodo_id"`
+	Condiciones []tipos.Condicion        `json:"condiciones"`
+	Grupos      []tipos.GrupoCondiciones `json:"grupos,omitempty"`
+	Acciones    []tipos.Accion           `json:"acciones"`
 }
 
 // HandlerListarReglas lista todas las reglas de todos los nodos
@@ -313,6 +314,7 @@ func HandlerListarReglas(gestor *GestorDespachador) http.HandlerFunc {
 				Logica:      reglaInfo.Logica,
 				NodoID:      reglaInfo.NodoID,
 				Condiciones: reglaInfo.Condiciones,
+				Grupos:      reglaInfo.Grupos,
 				Acciones:    reglaInfo.Acciones,
 			}
 		}
@@ -344,6 +346,7 @@ func HandlerObtenerRegla(gestor *GestorDespachador) http.HandlerFunc {
 			Logica:      regla.Logica,
 			NodoID:      nodoID,
 			Condiciones: regla.Condiciones,
+			Grupos:      regla.Grupos,
 			Acciones:    regla.Acciones,
 		}
 
@@ -372,6 +375,7 @@ func HandlerListarReglasPorNodo(gestor *GestorDespachador) http.HandlerFunc {
 				Logica:      regla.Logica,
 				NodoID:      nodoID,
 				Condiciones: regla.Condiciones,
+				Grupos:      regla.Grupos,
 				Acciones:    regla.Acciones,
 			}
 		}
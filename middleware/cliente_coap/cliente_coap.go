@@ -3,21 +3,30 @@ package cliente_coap
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/pion/dtls/v3"
+	coapDTLS "github.com/plgd-dev/go-coap/v3/dtls"
 	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
 	"github.com/plgd-dev/go-coap/v3/message/pool"
 	obs "github.com/plgd-dev/go-coap/v3/net/client"
+	"github.com/plgd-dev/go-coap/v3/options"
 	"github.com/plgd-dev/go-coap/v3/udp"
 	"github.com/plgd-dev/go-coap/v3/udp/client"
 	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/cola"
 	"github.com/sensorwave-dev/sensorwave/middleware/internal/errores"
 	"github.com/sensorwave-dev/sensorwave/middleware/internal/mensaje"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/qos"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/solicitudes"
 )
 
 var ruta string = "/sensorwave"
@@ -27,34 +36,164 @@ const (
 	maxIntentosReconexion = 5
 	backoffInicial        = 1 * time.Second
 	backoffFactor         = 2
+	// backoffMaximo acota la espera entre intentos de reconexión, que siguen hasta Desconectar
+	backoffMaximo = 30 * time.Second
+
+	// keepAliveDefecto es el intervalo de los pings CoAP que vigilan la conexión; debe ser
+	// menor que la inactividad tras la que el servidor cierra la sesión (16s en go-coap)
+	keepAliveDefecto = 12 * time.Second
+	// reintentosKeepAlive son los pings sin respuesta tras los que se reconecta
+	reintentosKeepAlive = 2
+	// frescuraPorKeepAlive: una observación sin notificaciones durante este múltiplo del
+	// keepalive se re-registra para comprobar que el servidor la conserva
+	frescuraPorKeepAlive = 5
+
+	// timeoutObservacion limita la espera de la respuesta al registrar una observación
+	timeoutObservacion = 10 * time.Second
+
+	// timeoutDescarga limita la descarga de un payload entregado por referencia
+	timeoutDescarga = 30 * time.Second
+
+	// timeoutPublicacion limita la espera de la respuesta a una publicación: sin
+	// servidor accesible la publicación falla en lugar de bloquearse
+	timeoutPublicacion = 30 * time.Second
 )
 
 // tipo del cliente
 type ClienteCoAP struct {
-	cliente       *client.Conn
-	direccion     string
-	mu            sync.Mutex
-	observaciones map[string]obs.Observation
-	// Guardar callbacks para re-observación tras reconexión
-	callbacks map[string]middleware.CallbackFunc
+	cliente   *client.Conn
+	direccion string
+	mu        sync.Mutex
+	// observaciones por tópico; se vuelven a registrar tras reconectar
+	observaciones map[string]*observacion
+
+	// OnError es invocado (síncronamente) cuando la reconexión agota
+	// maxIntentosReconexion intentos (se sigue reintentando) o no se puede volver a
+	// registrar una observación. Si es nil, se usa log.Printf como default.
+	OnError func(error)
+
+	// dial abre una conexión nueva con la configuración del cliente
+	dial func() (*client.Conn, error)
+	// keepAlive es el intervalo de los pings CoAP y de la verificación de observaciones
+	keepAlive time.Duration
+	// reconectando indica que una goroutine está reemplazando la conexión caída
+	reconectando bool
+	// fin se cierra con Desconectar y detiene la vigilancia y la reconexión
+	fin     chan struct{}
+	cerrado bool
+
+	// opciones Uri-Query con las credenciales, agregadas a cada solicitud
+	credenciales []message.Option
+	// opciones Uri-Query con el testamento, agregadas a cada observación
+	testamento []message.Option
+	// opción Uri-Query con el ID de sesión persistente (nil = sin sesión)
+	sesion []message.Option
+	// maximoPayload limita los payloads publicados (0 = 64 KB)
+	maximoPayload int
+	// codificacion de las publicaciones y de las notificaciones pedidas con Accept
+	codificacion middleware.Codificacion
+	// cola local de publicaciones (nil = sin store-and-forward)
+	cola *cola.Cola
+	// solicitudes en espera de respuesta (Solicitar)
+	solicitudes *solicitudes.Pendientes
+	// recibidos descarta las reentregas de mensajes QoS 2, por suscripción y MensajeID
+	recibidos *qos.Deduplicador
 }
 
-// conectar cliente con backoff exponencial
-func Conectar(host string, puerto string) (*ClienteCoAP, error) {
-	servidor := host + ":" + puerto
+// conectar cliente con backoff exponencial.
+// El cliente vigila la conexión con pings CoAP (ConKeepAlive, 12s por defecto): si el
+// servidor deja de responder o la conexión se cierra, reconecta con backoff exponencial y
+// vuelve a registrar todas las observaciones. Las observaciones sin notificaciones
+// recientes se re-registran para detectar un servidor que se reinició y las perdió.
+// Las credenciales (ConUsuario/ConToken) se envían como opciones Uri-Query en cada solicitud.
+// Con ConTLS la conexión usa DTLS con los certificados de la configuración TLS.
+// Con ConCodificacion(middleware.CodificacionCBOR) publica y observa en CBOR.
+func Conectar(host string, puerto string, opciones ...middleware.ConectarOpcion) (*ClienteCoAP, error) {
+	conexion := middleware.AplicarOpcionesConexion(opciones...)
+	var configDTLS *dtls.Config
+	if conexion.TLS != nil {
+		configDTLS = configuracionDTLS(conexion.TLS)
+	}
+	return conectar(host+":"+puerto, configDTLS, conexion)
+}
+
+// ConectarTLS conecta al servidor CoAP sobre DTLS. config admite certificados o,
+// para dispositivos restringidos, una clave precompartida (PSK + PSKIdentityHint);
+// el servidor usa el CommonName del certificado o la identidad PSK como usuario.
+func ConectarTLS(host string, puerto string, config *dtls.Config, opciones ...middleware.ConectarOpcion) (*ClienteCoAP, error) {
+	return conectar(host+":"+puerto, config, middleware.AplicarOpcionesConexion(opciones...))
+}
 
+// configuracionDTLS traduce una configuración TLS de cliente a DTLS
+func configuracionDTLS(config *tls.Config) *dtls.Config {
+	return &dtls.Config{
+		Certificates:         config.Certificates,
+		RootCAs:              config.RootCAs,
+		ServerName:           config.ServerName,
+		InsecureSkipVerify:   config.InsecureSkipVerify,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+}
+
+func conectar(servidor string, configDTLS *dtls.Config, conexion middleware.OpcionesConexion) (*ClienteCoAP, error) {
 	c := &ClienteCoAP{
 		direccion:     servidor,
-		observaciones: make(map[string]obs.Observation),
-		callbacks:     make(map[string]middleware.CallbackFunc),
+		observaciones: make(map[string]*observacion),
+		keepAlive:     keepAliveDefecto,
+		fin:           make(chan struct{}),
+		credenciales:  opcionesCredenciales(conexion.Credenciales),
+		maximoPayload: conexion.MaximoPayload,
+		codificacion:  conexion.Codificacion,
+		solicitudes:   solicitudes.Nuevas(conexion.MaximoPayload),
+		recibidos:     qos.NuevoDeduplicador(0),
+	}
+
+	// Block1/Block2 (RFC 7959) vienen habilitados en go-coap: las publicaciones y las
+	// descargas de contenidos grandes se fragmentan en bloques hasta este tamaño
+	maximo := conexion.MaximoPayload
+	if maximo <= 0 {
+		maximo = mensaje.TamanoMaximoPayloadDefecto
+	}
+	opcionesDial := []udp.Option{options.WithMaxMessageSize(uint32(mensaje.TamanoCuerpoJSON(maximo)))}
+
+	if t := conexion.Testamento; t != nil {
+		for nombre, valores := range mensaje.ParametrosTestamento(uuid.New().String(), t) {
+			c.testamento = append(c.testamento, opcionQuery(nombre, valores[0]))
+		}
+	}
+	if conexion.Sesion != "" {
+		c.sesion = []message.Option{opcionQuery(mensaje.ParamSesion, conexion.Sesion)}
+	}
+	// Los pings detectan una conexión caída y además evitan que el servidor dé por caídos
+	// la sesión y el testamento del cliente
+	if conexion.KeepAlive > 0 {
+		c.keepAlive = conexion.KeepAlive
+	}
+	opcionesDial = append(opcionesDial, options.WithKeepAlive(reintentosKeepAlive, c.keepAlive, func(cc *client.Conn) {
+		log.Printf("El servidor CoAP %s no responde al keepalive, reconectando...", servidor)
+		go c.reconectar(cc)
+	}))
+	c.dial = func() (*client.Conn, error) {
+		if configDTLS != nil {
+			return coapDTLS.Dial(servidor, configDTLS, opcionesDial...)
+		}
+		return udp.Dial(servidor, opcionesDial...)
 	}
 
 	delay := backoffInicial
 	var ultimoErr error
 	for intento := 1; intento <= maxIntentosReconexion; intento++ {
-		conn, err := udp.Dial(servidor)
+		conn, err := c.dial()
 		if err == nil {
 			c.cliente = conn
+			if conexion.ColaLocal != nil {
+				if c.cola, err = cola.Nueva(*conexion.ColaLocal, c.enviar, c.notificarError); err != nil {
+					close(c.fin)
+					conn.Close()
+					return nil, fmt.Errorf("%w: %v", errores.ErrConexion, err)
+				}
+			}
+			go c.vigilar(conn)
 			return c, nil
 		}
 		ultimoErr = err
@@ -71,93 +210,598 @@ func Conectar(host string, puerto string) (*ClienteCoAP, error) {
 		errores.ErrConexion, maxIntentosReconexion, ultimoErr)
 }
 
-// cerrar cliente
+// opcionesCredenciales codifica las credenciales como opciones Uri-Query
+func opcionesCredenciales(cred middleware.Credenciales) []message.Option {
+	var opciones []message.Option
+	agregar := func(nombre, valor string) {
+		opciones = append(opciones, opcionQuery(nombre, valor))
+	}
+	if cred.Token != "" {
+		agregar("token", cred.Token)
+	} else if !cred.Vacias() {
+		agregar("usuario", cred.Usuario)
+		agregar("clave", cred.Clave)
+	}
+	return opciones
+}
+
+func opcionQuery(nombre, valor string) message.Option {
+	return message.Option{ID: message.URIQuery, Value: []byte(nombre + "=" + url.QueryEscape(valor))}
+}
+
+// opcionesSolicitud retorna la query del tópico seguida de las credenciales
+func (c *ClienteCoAP) opcionesSolicitud(topico string) []message.Option {
+	query := message.Option{ID: message.URIQuery, Value: []byte("topico=" + url.QueryEscape(topico))}
+	return append([]message.Option{query}, c.credenciales...)
+}
+
+// cerrar cliente. Detiene el reenvío de la cola local; una cola persistida en
+// archivo conserva sus mensajes para la próxima conexión.
+//
+// c.mu se libera antes de cancelar las observaciones y de cerrar la cola: el reenvío de
+// la cola está dentro de c.enviar, que toma c.mu para leer la conexión actual.
 func (c *ClienteCoAP) Desconectar() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	if c.cerrado {
+		c.mu.Unlock()
+		return
+	}
+	c.cerrado = true
+	close(c.fin)
+	conn := c.cliente
+	observaciones := c.observaciones
+	c.observaciones = make(map[string]*observacion)
+	c.mu.Unlock()
 
-	c.cliente.Close()
-	c.observaciones = make(map[string]obs.Observation)
-	c.callbacks = make(map[string]middleware.CallbackFunc)
+	// Cancelar las observaciones avisa al servidor de una desconexión limpia (sin testamento).
+	// Con sesión persistente el servidor conserva la suscripción para la próxima conexión.
+	for topico, o := range observaciones {
+		r := o.registrada()
+		if r == nil {
+			continue
+		}
+		ctx, cancelar := context.WithTimeout(context.Background(), 2*time.Second)
+		if err := r.obs.Cancel(ctx, c.opcionesCancelacion(topico)...); err != nil {
+			log.Printf("Error al cancelar la observación de %s: %v", topico, err)
+		}
+		cancelar()
+	}
+	// Cerrar la conexión interrumpe el reenvío en curso antes de esperarlo
+	conn.Close()
+	if c.cola != nil {
+		if err := c.cola.Cerrar(); err != nil {
+			log.Printf("Error al cerrar la cola local: %v", err)
+		}
+	}
+}
+
+// opcionesCancelacion retorna las opciones para cancelar la observación de un tópico.
+// Con sesión persistente el servidor conserva la suscripción para la próxima conexión.
+func (c *ClienteCoAP) opcionesCancelacion(topico string) []message.Option {
+	opciones := c.opcionesSolicitud(topico)
+	if c.sesion != nil {
+		opciones = append(opciones, opcionQuery(mensaje.ParamConservarSesion, "1"))
+	}
+	return opciones
+}
+
+// conexion retorna la conexión actual, que cambia al reconectar
+func (c *ClienteCoAP) conexion() *client.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cliente
 }
 
-// publicar
+// publicar. Con ConColaLocal las publicaciones que no llegan al servidor se encolan
+// y se reenvían en segundo plano.
 func (c *ClienteCoAP) Publicar(topico string, payload interface{}, opciones ...middleware.PublicarOpcion) error {
-	mensaje, err := mensaje.Construir(topico, payload, opciones...)
+	mensaje, err := mensaje.ConstruirConLimite(topico, payload, c.maximoPayload, opciones...)
 	if err != nil {
 		return fmt.Errorf("%w: %v", errores.ErrPublicacion, err)
 	}
+	if c.cola != nil {
+		return c.cola.Publicar(mensaje)
+	}
+	return c.enviar(mensaje)
+}
 
-	// Serializar el mensaje a JSON
-	mensajeBytes, err := json.Marshal(mensaje)
+// enviar publica el mensaje construido. Una respuesta 4.xx (salvo 4.29, límite de
+// tasa) rechaza la publicación y se marca como permanente para la cola local, igual
+// que un mensaje que expiró esperando en ella; sin respuesta o con 5.xx se reintenta.
+func (c *ClienteCoAP) enviar(mensaje middleware.Mensaje) error {
+	topico := mensaje.Topico
+	if mensaje.Expirado() {
+		return cola.Permanente(fmt.Errorf("%w: %s: mensaje expirado", errores.ErrPublicacion, topico))
+	}
+	// Serializar el mensaje en la codificación del cliente
+	mensajeBytes, err := codificar(mensaje, c.codificacion)
 	if err != nil {
-		return fmt.Errorf("%w: %v", errores.ErrPublicacion, err)
+		return cola.Permanente(fmt.Errorf("%w: %v", errores.ErrPublicacion, err))
 	}
 
 	// publicar en el recurso
-	ctx := context.Background()
-	query := message.Option{ID: message.URIQuery, Value: []byte("topico=" + url.QueryEscape(topico))}
-	req, err := c.cliente.NewPostRequest(ctx, ruta, message.TextPlain, bytes.NewReader(mensajeBytes), query)
+	ctx, cancelar := context.WithTimeout(context.Background(), timeoutPublicacion)
+	defer cancelar()
+	conn := c.conexion()
+	req, err := conn.NewPostRequest(ctx, ruta, formatoCoAP(c.codificacion), bytes.NewReader(mensajeBytes), c.opcionesSolicitud(topico)...)
 	if err != nil {
 		return fmt.Errorf("%w: %s: %v", errores.ErrPublicacion, topico, err)
 	}
-	if mensaje.QoS == 1 {
+	// Con QoS 2 el servidor descarta las retransmisiones por MensajeID
+	if mensaje.QoS >= 1 {
 		req.SetType(message.Confirmable)
 	} else {
 		req.SetType(message.NonConfirmable)
 	}
-	if _, err := c.cliente.Do(req); err != nil {
+	resp, err := conn.Do(req)
+	if err != nil {
 		return fmt.Errorf("%w: %s: %v", errores.ErrPublicacion, topico, err)
 	}
+	if codigo := resp.Code(); codigo >= codes.BadRequest {
+		cuerpo, _ := resp.ReadBody()
+		// El registro de tópicos del servidor informa el rechazo como *errores.ErrorValidacion
+		var err error = fmt.Errorf("%w: %s: %v: %s", errores.ErrPublicacion, topico, codigo, cuerpo)
+		if ev, ok := errores.LeerErrorValidacion(cuerpo); ok {
+			err = ev
+		}
+		if codigo < codes.InternalServerError && codigo != codes.TooManyRequests {
+			return cola.Permanente(err)
+		}
+		return err
+	}
 	return nil
 }
 
+// notificarError invoca OnError si está configurado, o log.Printf por defecto.
+func (c *ClienteCoAP) notificarError(err error) {
+	if c.OnError != nil {
+		c.OnError(err)
+		return
+	}
+	log.Printf("%v", err)
+}
+
+// Pendientes devuelve la cantidad de publicaciones en la cola local (0 sin
+// ConColaLocal). No forma parte de la interfaz Cliente.
+func (c *ClienteCoAP) Pendientes() int {
+	if c.cola == nil {
+		return 0
+	}
+	return c.cola.Pendientes()
+}
+
+// Descartados devuelve la cantidad de publicaciones perdidas por la política de
+// descarte de la cola local o rechazadas al reenviarlas. No forma parte de la
+// interfaz Cliente.
+func (c *ClienteCoAP) Descartados() int64 {
+	if c.cola == nil {
+		return 0
+	}
+	return c.cola.Descartados()
+}
+
 // suscribir a tópico
 func (c *ClienteCoAP) Suscribir(topico string, callback middleware.CallbackFunc) error {
-	// subscribe al recurso
-	ctx := context.Background()
-	query := message.Option{ID: message.URIQuery, Value: []byte("topico=" + url.QueryEscape(topico))}
-	callbackInterno := func(msg *pool.Message) {
-		var mensaje middleware.Mensaje
-		if p, err := msg.ReadBody(); err == nil && len(p) > 0 {
-			err := json.Unmarshal(p, &mensaje)
+	return c.suscribir(topico, true, func(m middleware.Mensaje) {
+		callback(m.Topico, m.Payload)
+	})
+}
+
+// SuscribirMensajes observa el tópico entregando el Mensaje completo
+// (ver middleware.SuscriptorMensajes)
+func (c *ClienteCoAP) SuscribirMensajes(topico string, manejador func(middleware.Mensaje)) error {
+	return c.suscribir(topico, true, manejador)
+}
+
+// Solicitar publica una solicitud y espera su respuesta (ver middleware.ClienteRPC).
+// La solicitud no pasa por la cola local: si el servidor no es accesible falla.
+func (c *ClienteCoAP) Solicitar(topico string, payload interface{}, timeout time.Duration) ([]byte, error) {
+	return c.solicitudes.Solicitar(topico, payload, timeout, c.suscribirRespuestas, c.enviar)
+}
+
+// Responder atiende las solicitudes publicadas en topico (ver middleware.ClienteRPC)
+func (c *ClienteCoAP) Responder(topico string, manejador middleware.ManejadorSolicitud) error {
+	return c.suscribir(topico, true, solicitudes.Atender(manejador, c.maximoPayload, c.enviar))
+}
+
+// suscribirRespuestas observa el tópico de respuestas fuera de la sesión persistente:
+// es propio de esta conexión y las respuestas no tienen sentido tras reconectar
+func (c *ClienteCoAP) suscribirRespuestas(topico string, entregar func(middleware.Mensaje)) error {
+	return c.suscribir(topico, false, entregar)
+}
+
+// suscribir observa el tópico entregando el Mensaje completo; conSesion incluye la
+// observación en la sesión persistente del cliente
+func (c *ClienteCoAP) suscribir(topico string, conSesion bool, entregar func(middleware.Mensaje)) error {
+	entregas := &entregasOrdenadas{}
+	procesar := func(msg *pool.Message) {
+		mensaje, err := leerNotificacion(msg)
+		if err != nil {
+			log.Printf("Error al procesar el cuerpo de la solicitud: %v", err)
+			return
+		}
+		// si es un mensaje interno o expirado, no lo procesamos
+		if mensaje.Interno || mensaje.Expirado() {
+			return
+		}
+		// Un QoS 2 reentregado (cola de la sesión, redelivery) se entrega una sola vez
+		if mensaje.QoS == 2 && !c.recibidos.Registrar(topico+"|"+mensaje.MensajeID) {
+			return
+		}
+		if mensaje.Referencia == "" {
+			entregas.entregar(nil, func() { entregar(mensaje) })
+			return
+		}
+		descargar := func() (err error) {
+			mensaje.Payload, err = c.descargarContenido(mensaje.Referencia)
 			if err != nil {
-				log.Printf("Error al procesar el cuerpo de la solicitud: %v", err)
-				return
+				log.Printf("Error al descargar el payload de %s: %v", mensaje.Topico, err)
+				return err
 			}
+			mensaje.Referencia = ""
+			return nil
+		}
+		entregas.entregar(descargar, func() { entregar(mensaje) })
+	}
+	opciones := append(c.opcionesSolicitud(topico), c.testamento...)
+	if conSesion {
+		opciones = append(opciones, c.sesion...)
+	}
+	if c.codificacion == middleware.CodificacionCBOR {
+		opciones = append(opciones, message.Option{ID: message.Accept, Value: []byte{byte(message.AppCBOR)}})
+	}
+	o := &observacion{topico: topico, opciones: opciones, procesar: procesar}
+	if err := c.observar(c.conexion(), o); err != nil {
+		return fmt.Errorf("%w: %s: %v", errores.ErrSuscripcion, topico, err)
+	}
+
+	c.mu.Lock()
+	c.observaciones[topico] = o
+	c.mu.Unlock()
+	return nil
+}
+
+// observacion es una suscripción del cliente. Cada registro en el servidor tiene su
+// propio token; al reconectar o al detectar que el servidor la perdió se registra de nuevo.
+type observacion struct {
+	topico   string
+	opciones []message.Option // tópico, credenciales, testamento, sesión y Accept
+	procesar func(*pool.Message)
+
+	mu     sync.Mutex
+	actual *registro    // nil = sin registrar en el servidor
+	ultima atomic.Int64 // UnixNano de la última notificación o verificación
+}
+
+// registro es el alta de una observación en el servidor por una conexión
+type registro struct {
+	conn  *client.Conn
+	obs   obs.Observation
+	token message.Token
+}
+
+// registrada retorna el registro vigente, o nil si no hay uno confirmado por el servidor
+func (o *observacion) registrada() *registro {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.actual == nil || o.actual.obs == nil {
+		return nil
+	}
+	return o.actual
+}
+
+// vigente indica si r sigue siendo el registro de la observación: las notificaciones de
+// un registro reemplazado se descartan
+func (o *observacion) vigente(r *registro) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.actual == r
+}
+
+// observar registra la observación en el servidor por conn, reemplazando el registro
+// anterior
+func (c *ClienteCoAP) observar(conn *client.Conn, o *observacion) error {
+	ctx, cancelar := context.WithTimeout(context.Background(), timeoutObservacion)
+	defer cancelar()
+	req, err := conn.NewObserveRequest(ctx, ruta, o.opciones...)
+	if err != nil {
+		return err
+	}
+	defer conn.ReleaseMessage(req)
+	// El registro pasa a ser el vigente antes de enviarlo: el servidor envía los retenidos
+	// justo después de la respuesta, antes de que DoObserve retorne
+	r := &registro{conn: conn, token: req.Token()}
+	o.mu.Lock()
+	anterior := o.actual
+	o.actual = r
+	o.mu.Unlock()
+	observation, err := conn.DoObserve(req, func(msg *pool.Message) {
+		if !o.vigente(r) {
+			return
+		}
+		o.ultima.Store(time.Now().UnixNano())
+		// Una notificación sin Observe termina la observación (RFC 7641): el servidor se
+		// está cerrando
+		if !msg.HasOption(message.Observe) {
+			go c.reconectar(conn)
+			return
+		}
+		o.procesar(msg)
+	})
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err != nil {
+		if o.actual == r {
+			o.actual = anterior
 		}
-		// si es un mensaje interno, no lo procesamos
-		if mensaje.Interno {
+		return err
+	}
+	r.obs = observation
+	o.ultima.Store(time.Now().UnixNano())
+	return nil
+}
+
+// vigilar atiende una conexión hasta que se cierra o se llama a Desconectar: verifica las
+// observaciones sin notificaciones recientes y, si la conexión se cierra, reconecta
+func (c *ClienteCoAP) vigilar(conn *client.Conn) {
+	ticker := time.NewTicker(c.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.fin:
+			return
+		case <-conn.Done():
+			c.reconectar(conn)
 			return
+		case <-ticker.C:
+			c.verificarObservaciones(conn)
 		}
-		callback(mensaje.Topico, mensaje.Payload)
 	}
-	observation, err := c.cliente.Observe(ctx, ruta, callbackInterno, query)
+}
+
+// verificarObservaciones re-registra las observaciones sin registro o sin notificaciones
+// durante frescuraPorKeepAlive intervalos de keepalive
+func (c *ClienteCoAP) verificarObservaciones(conn *client.Conn) {
+	limite := time.Now().Add(-frescuraPorKeepAlive * c.keepAlive).UnixNano()
+	c.mu.Lock()
+	var verificar []*observacion
+	for _, o := range c.observaciones {
+		if o.registrada() == nil || o.ultima.Load() < limite {
+			verificar = append(verificar, o)
+		}
+	}
+	c.mu.Unlock()
+	for _, o := range verificar {
+		c.renovar(conn, o)
+	}
+}
+
+// renovar re-registra la observación con su mismo token (RFC 7641 §3.3.1). Si el servidor
+// la conservaba responde 2.03 Valid; si la había perdido (por ejemplo, porque se reinició)
+// la registra como nueva y el cliente la reemplaza por una con token nuevo, porque los
+// números de secuencia del servidor reiniciado no continúan los anteriores.
+func (c *ClienteCoAP) renovar(conn *client.Conn, o *observacion) {
+	r := o.registrada()
+	if r == nil || r.conn != conn {
+		c.reobservar(conn, o)
+		return
+	}
+	ctx, cancelar := context.WithTimeout(context.Background(), timeoutObservacion)
+	defer cancelar()
+	req, err := conn.NewObserveRequest(ctx, ruta, o.opciones...)
 	if err != nil {
-		return fmt.Errorf("%w: %s: %v", errores.ErrSuscripcion, topico, err)
+		return
+	}
+	defer conn.ReleaseMessage(req)
+	req.SetToken(r.token)
+	resp, err := conn.Do(req)
+	if err != nil {
+		// Sin respuesta: el keepalive decide si la conexión se cayó
+		return
+	}
+	if resp.Code() == codes.Valid {
+		o.ultima.Store(time.Now().UnixNano())
+		return
+	}
+	log.Printf("El servidor CoAP %s perdió la observación de %s, registrándola de nuevo", c.direccion, o.topico)
+	c.reobservar(conn, o)
+}
+
+// reobservar registra la observación con un token nuevo y cancela el registro anterior.
+// Si el anterior era de otra conexión, la cancelación viaja por conn: el servidor
+// identifica la observación por su token.
+func (c *ClienteCoAP) reobservar(conn *client.Conn, o *observacion) {
+	anterior := o.registrada()
+	if err := c.observar(conn, o); err != nil {
+		c.notificarError(fmt.Errorf("%w: %s: no se pudo registrar la observación de nuevo: %v", errores.ErrSuscripcion, o.topico, err))
+		return
+	}
+	if anterior == nil {
+		return
 	}
+	ctx, cancelar := context.WithTimeout(context.Background(), timeoutObservacion)
+	defer cancelar()
+	opciones := c.opcionesCancelacion(o.topico)
+	if anterior.conn == conn {
+		_ = anterior.obs.Cancel(ctx, opciones...)
+		return
+	}
+	req, err := conn.NewGetRequest(ctx, ruta, opciones...)
+	if err != nil {
+		return
+	}
+	defer conn.ReleaseMessage(req)
+	req.SetObserve(1)
+	req.SetToken(anterior.token)
+	_, _ = conn.Do(req)
+}
 
+// reconectar reemplaza la conexión caída: abre una nueva con backoff exponencial hasta
+// que el servidor responde un ping y vuelve a registrar las observaciones. Las llamadas
+// por una conexión que ya fue reemplazada no hacen nada.
+func (c *ClienteCoAP) reconectar(caida *client.Conn) {
 	c.mu.Lock()
-	c.observaciones[topico] = observation
-	c.callbacks[topico] = callback
+	if c.cerrado || c.reconectando || c.cliente != caida {
+		c.mu.Unlock()
+		return
+	}
+	c.reconectando = true
 	c.mu.Unlock()
-	return nil
+	caida.Close()
+
+	delay := backoffInicial
+	for intento := 1; ; intento++ {
+		conn, err := c.dial()
+		if err == nil {
+			ctx, cancelar := context.WithTimeout(context.Background(), c.keepAlive)
+			err = conn.Ping(ctx)
+			cancelar()
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			c.mu.Lock()
+			if c.cerrado {
+				c.mu.Unlock()
+				conn.Close()
+				return
+			}
+			c.cliente = conn
+			c.reconectando = false
+			observaciones := make([]*observacion, 0, len(c.observaciones))
+			for _, o := range c.observaciones {
+				observaciones = append(observaciones, o)
+			}
+			c.mu.Unlock()
+			log.Printf("Reconectado al servidor CoAP %s (intento %d)", c.direccion, intento)
+			for _, o := range observaciones {
+				c.reobservar(conn, o)
+			}
+			go c.vigilar(conn)
+			return
+		}
+		if intento == maxIntentosReconexion {
+			c.notificarError(fmt.Errorf("%w: %s: sin conexión tras %d intentos, se sigue reintentando: %v",
+				errores.ErrConexion, c.direccion, intento, err))
+		}
+		log.Printf("Error al reconectarse a %s (intento %d): %v, reintentando en %v...", c.direccion, intento, err, delay)
+		select {
+		case <-c.fin:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*backoffFactor, backoffMaximo)
+	}
+}
+
+// codificar serializa el mensaje a publicar; CBOR se anuncia con Content-Format 60
+func codificar(m middleware.Mensaje, codificacion middleware.Codificacion) ([]byte, error) {
+	return mensaje.Codificar(m, codificacion)
+}
+
+func formatoCoAP(codificacion middleware.Codificacion) message.MediaType {
+	if codificacion == middleware.CodificacionCBOR {
+		return message.AppCBOR
+	}
+	return message.TextPlain
+}
+
+// leerNotificacion decodifica una notificación según su Content-Format (JSON o CBOR).
+// Una notificación sin cuerpo equivale a un Mensaje vacío.
+func leerNotificacion(msg *pool.Message) (middleware.Mensaje, error) {
+	p, err := msg.ReadBody()
+	if err != nil || len(p) == 0 {
+		return middleware.Mensaje{}, nil
+	}
+	var codificacion middleware.Codificacion
+	if formato, err := msg.ContentFormat(); err == nil && formato == message.AppCBOR {
+		codificacion = middleware.CodificacionCBOR
+	}
+	return mensaje.Decodificar(p, codificacion)
+}
+
+// entregasOrdenadas invoca los callbacks de una observación en el orden de sus
+// notificaciones. Las descargas de payloads por referencia se hacen fuera del lector
+// de la conexión, que no debe bloquearse esperando otra respuesta.
+type entregasOrdenadas struct {
+	mu       sync.Mutex
+	anterior chan struct{} // se cierra al terminar la última entrega en curso (nil = ninguna)
+}
+
+// entregar ejecuta previo (puede ser nil) y luego entrega, salvo que previo falle.
+// Sin previo ni entregas en curso, entrega se invoca directamente.
+func (e *entregasOrdenadas) entregar(previo func() error, entrega func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	anterior := e.anterior
+	if anterior != nil {
+		select {
+		case <-anterior:
+			anterior = nil
+		default:
+		}
+	}
+	if previo == nil && anterior == nil {
+		entrega()
+		return
+	}
+	listo := make(chan struct{})
+	e.anterior = listo
+	go func() {
+		defer close(listo)
+		var err error
+		if previo != nil {
+			err = previo()
+		}
+		if anterior != nil {
+			<-anterior
+		}
+		if err == nil {
+			entrega()
+		}
+	}()
+}
+
+// descargarContenido obtiene el payload de un mensaje entregado por referencia; la
+// respuesta llega en bloques Block2 que go-coap reensambla
+func (c *ClienteCoAP) descargarContenido(referencia string) ([]byte, error) {
+	ctx, cancelar := context.WithTimeout(context.Background(), timeoutDescarga)
+	defer cancelar()
+	opciones := append([]message.Option{opcionQuery(mensaje.ParamReferencia, referencia)}, c.credenciales...)
+	resp, err := c.conexion().Get(ctx, mensaje.RutaContenido, opciones...)
+	if err != nil {
+		return nil, err
+	}
+	cuerpo, err := resp.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code() != codes.Content {
+		return nil, fmt.Errorf("%v: %s", resp.Code(), cuerpo)
+	}
+	return cuerpo, nil
 }
 
 // se desuscribe a un topico. Idempotente: retorna nil si el tópico no estaba
 // observado. Devuelve error sólo si falla la cancelación de red.
 func (c *ClienteCoAP) Desuscribir(topico string) error {
 	c.mu.Lock()
-	observation, ok := c.observaciones[topico]
+	o, ok := c.observaciones[topico]
 	if !ok {
 		c.mu.Unlock()
 		return nil
 	}
 	delete(c.observaciones, topico)
-	delete(c.callbacks, topico)
 	c.mu.Unlock()
+	r := o.registrada()
+	if r == nil {
+		return nil
+	}
 
-	if err := observation.Cancel(context.Background()); err != nil {
+	// El servidor identifica la observación por el token; el tópico y las credenciales
+	// son necesarios para que acepte la cancelación
+	if err := r.obs.Cancel(context.Background(), c.opcionesSolicitud(topico)...); err != nil {
 		return fmt.Errorf("%w: %s: %v", errores.ErrDesuscripcion, topico, err)
 	}
 	return nil
@@ -3,6 +3,7 @@ package clientehttp
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,10 +15,13 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/cola"
 	"github.com/sensorwave-dev/sensorwave/middleware/internal/errores"
 	"github.com/sensorwave-dev/sensorwave/middleware/internal/mensaje"
 	"github.com/sensorwave-dev/sensorwave/middleware/internal/qos"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/solicitudes"
 )
 
 type ClienteHTTP struct {
@@ -37,6 +41,28 @@ type ClienteHTTP struct {
 
 	// ackFallos cuenta los fallos de envío de ACK (no expuesto en la interfaz).
 	ackFallos atomic.Int64
+
+	// testamento se declara en cada suscripción con idTestamento; el servidor lo
+	// publica si se caen todos los streams sin Desuscribir.
+	testamento   *middleware.Testamento
+	idTestamento string
+
+	// sesion es el ID de sesión persistente enviado en cada suscripción ("" = sin sesión)
+	sesion string
+
+	// maximoPayload limita los payloads publicados (0 = 64 KB)
+	maximoPayload int
+	// codificacion de las publicaciones; el stream SSE siempre llega en JSON
+	codificacion middleware.Codificacion
+
+	// cola local de publicaciones (nil = sin store-and-forward)
+	cola *cola.Cola
+
+	// solicitudes en espera de respuesta (Solicitar)
+	solicitudes *solicitudes.Pendientes
+
+	// recibidos descarta las reentregas de mensajes QoS 2, por suscripción y MensajeID
+	recibidos *qos.Deduplicador
 }
 
 var ruta string = "/sensorwave"
@@ -49,39 +75,111 @@ const (
 
 	// handshakeTimeout es el timeout fijo del handshake SSE inicial.
 	handshakeTimeout = 10 * time.Second
+
+	// umbralPublicacionBinaria: los payloads mayores se publican como cuerpo binario
+	// (sin el base64 del JSON), con los demás campos del mensaje en el query
+	umbralPublicacionBinaria = 16 * 1024
 )
 
 // Conectar crea un nuevo cliente HTTP validando host y puerto.
-func Conectar(host string, puerto string) (*ClienteHTTP, error) {
+// Las credenciales (ConUsuario/ConToken) se envían en la cabecera Authorization de cada solicitud.
+func Conectar(host string, puerto string, opciones ...middleware.ConectarOpcion) (*ClienteHTTP, error) {
 	if host == "" || puerto == "" {
 		return nil, fmt.Errorf("%w: host y puerto no pueden estar vacíos", errores.ErrConexion)
 	}
-	return &ClienteHTTP{
-		baseURL:   "http://" + host + ":" + puerto,
-		cliente:   &http.Client{},
-		stopChans: make(map[string]chan struct{}),
-	}, nil
+	conexion := middleware.AplicarOpcionesConexion(opciones...)
+
+	esquema := "http://"
+	var transporte http.RoundTripper = http.DefaultTransport
+	if conexion.TLS != nil {
+		esquema = "https://"
+		base := http.DefaultTransport.(*http.Transport).Clone()
+		base.TLSClientConfig = conexion.TLS
+		transporte = base
+	}
+	if !conexion.Credenciales.Vacias() {
+		transporte = &transporteCredenciales{base: transporte, cred: conexion.Credenciales}
+	}
+	c := &ClienteHTTP{
+		baseURL:       esquema + host + ":" + puerto,
+		cliente:       &http.Client{Transport: transporte},
+		stopChans:     make(map[string]chan struct{}),
+		testamento:    conexion.Testamento,
+		sesion:        conexion.Sesion,
+		maximoPayload: conexion.MaximoPayload,
+		codificacion:  conexion.Codificacion,
+		solicitudes:   solicitudes.Nuevas(conexion.MaximoPayload),
+		recibidos:     qos.NuevoDeduplicador(0),
+	}
+	if c.testamento != nil {
+		c.idTestamento = uuid.New().String()
+	}
+	if conexion.ColaLocal != nil {
+		var err error
+		if c.cola, err = cola.Nueva(*conexion.ColaLocal, c.enviar, c.notificarError); err != nil {
+			return nil, fmt.Errorf("%w: %v", errores.ErrConexion, err)
+		}
+	}
+	return c, nil
 }
 
-// Publicar realiza un POST al servidor HTTP.
+// ConectarTLS crea un cliente HTTPS. Para TLS mutuo config debe incluir el
+// certificado del cliente; el servidor usa su CommonName como identidad.
+func ConectarTLS(host string, puerto string, config *tls.Config, opciones ...middleware.ConectarOpcion) (*ClienteHTTP, error) {
+	return Conectar(host, puerto, append(opciones, middleware.ConTLS(config))...)
+}
+
+// transporteCredenciales agrega la cabecera Authorization a todas las solicitudes
+type transporteCredenciales struct {
+	base http.RoundTripper
+	cred middleware.Credenciales
+}
+
+func (t *transporteCredenciales) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if t.cred.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.cred.Token)
+	} else {
+		req.SetBasicAuth(t.cred.Usuario, t.cred.Clave)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// Publicar realiza un POST al servidor HTTP. Los payloads grandes viajan como cuerpo
+// binario; el servidor también acepta ese cuerpo con Transfer-Encoding chunked.
+// Con ConColaLocal las publicaciones que no llegan al servidor se encolan y se
+// reenvían en segundo plano.
 func (c *ClienteHTTP) Publicar(topico string, payload interface{}, opciones ...middleware.PublicarOpcion) error {
-	mensaje, err := mensaje.Construir(topico, payload, opciones...)
+	mensaje, err := mensaje.ConstruirConLimite(topico, payload, c.maximoPayload, opciones...)
 	if err != nil {
 		return fmt.Errorf("%w: %v", errores.ErrPublicacion, err)
 	}
+	if c.cola != nil {
+		return c.cola.Publicar(mensaje)
+	}
+	return c.enviar(mensaje)
+}
 
-	// Serializar el mensaje a JSON
-	mensajeBytes, err := json.Marshal(mensaje)
+// enviar publica el mensaje construido. Las respuestas 4xx (salvo 408 y 429) son
+// rechazos del servidor y se marcan como permanentes para la cola local, igual que
+// un mensaje que expiró esperando en ella.
+func (c *ClienteHTTP) enviar(mensaje middleware.Mensaje) error {
+	topico := mensaje.Topico
+	if mensaje.Expirado() {
+		return cola.Permanente(fmt.Errorf("%w: %s: mensaje expirado", errores.ErrPublicacion, topico))
+	}
+	publicar, err := c.solicitudPublicacion(mensaje)
 	if err != nil {
-		return fmt.Errorf("%w: %v", errores.ErrPublicacion, err)
+		return cola.Permanente(fmt.Errorf("%w: %v", errores.ErrPublicacion, err))
 	}
 
-	urlPub := fmt.Sprintf("%s%s?topico=%s", c.baseURL, ruta, url.QueryEscape(topico))
-	if mensaje.QoS == 1 {
+	// QoS 1 y 2 esperan el ACK del servidor y reintentan con el mismo MensajeID; con QoS 2
+	// el servidor descarta las repeticiones
+	if mensaje.QoS >= 1 {
 		reintentos := 0
 		delay := qos.JitterAckTimeout()
 		for {
-			resp, err := c.cliente.Post(urlPub, "application/json", bytes.NewReader(mensajeBytes))
+			resp, err := publicar()
 			if err == nil {
 				body, _ := io.ReadAll(resp.Body)
 				resp.Body.Close()
@@ -92,6 +190,8 @@ func (c *ClienteHTTP) Publicar(topico string, payload interface{}, opciones ...m
 					if json.Unmarshal(body, &ack) == nil && ack.MensajeID == mensaje.MensajeID {
 						return nil
 					}
+				} else if esRechazo(resp.StatusCode) {
+					return cola.Permanente(errorRechazo(topico, body))
 				}
 			}
 			if reintentos >= qos.MaxRetransmisiones {
@@ -103,7 +203,7 @@ func (c *ClienteHTTP) Publicar(topico string, payload interface{}, opciones ...m
 		}
 	}
 
-	resp, err := c.cliente.Post(urlPub, "application/json", bytes.NewReader(mensajeBytes))
+	resp, err := publicar()
 	if err != nil {
 		return fmt.Errorf("%w: %s: %v", errores.ErrPublicacion, topico, err)
 	}
@@ -112,17 +212,97 @@ func (c *ClienteHTTP) Publicar(topico string, payload interface{}, opciones ...m
 	// Verificar el código de respuesta
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("%w: %s: %s", errores.ErrPublicacion, topico, string(body))
+		err := errorRechazo(topico, body)
+		if esRechazo(resp.StatusCode) {
+			return cola.Permanente(err)
+		}
+		return err
 	}
 	return nil
 }
 
+// errorRechazo construye el error de una respuesta de rechazo: el *errores.ErrorValidacion
+// que envía el registro de tópicos del servidor o, si no lo es, ErrPublicacion con el cuerpo
+func errorRechazo(topico string, body []byte) error {
+	if ev, ok := errores.LeerErrorValidacion(body); ok {
+		return ev
+	}
+	return fmt.Errorf("%w: %s: %s", errores.ErrPublicacion, topico, string(body))
+}
+
+// esRechazo indica si el código HTTP rechaza la publicación en sí, de modo que
+// reintentarla no sirve
+func esRechazo(codigo int) bool {
+	return codigo >= 400 && codigo < 500 && codigo != http.StatusRequestTimeout && codigo != http.StatusTooManyRequests
+}
+
+// solicitudPublicacion retorna una función que envía el POST del mensaje; cada
+// invocación crea un cuerpo nuevo para poder reintentar
+func (c *ClienteHTTP) solicitudPublicacion(m middleware.Mensaje) (func() (*http.Response, error), error) {
+	urlPub := fmt.Sprintf("%s%s?topico=%s", c.baseURL, ruta, url.QueryEscape(m.Topico))
+	if len(m.Payload) > umbralPublicacionBinaria {
+		if query := mensaje.ParametrosBinario(m).Encode(); query != "" {
+			urlPub += "&" + query
+		}
+		return func() (*http.Response, error) {
+			return c.cliente.Post(urlPub, mensaje.TipoBinario, bytes.NewReader(m.Payload))
+		}, nil
+	}
+
+	// Serializar el mensaje en la codificación del cliente
+	mensajeBytes, err := mensaje.Codificar(m, c.codificacion)
+	if err != nil {
+		return nil, err
+	}
+	tipo := mensaje.TipoContenido(c.codificacion)
+	return func() (*http.Response, error) {
+		return c.cliente.Post(urlPub, tipo, bytes.NewReader(mensajeBytes))
+	}, nil
+}
+
 // Suscribir realiza el handshake SSE síncrono (primer mensaje con clienteID)
 // con un timeout fijo de 10s. Si el handshake falla devuelve ErrSuscripcion.
 // Tras el handshake, una goroutine asíncrona lee el flujo SSE con reconexión
 // automática; los errores fatales se reportan vía OnError (default log.Printf).
 func (c *ClienteHTTP) Suscribir(topico string, callback middleware.CallbackFunc) error {
+	return c.suscribir(topico, true, func(m middleware.Mensaje) {
+		callback(m.Topico, m.Payload)
+	})
+}
+
+// SuscribirMensajes suscribe el tópico entregando el Mensaje completo
+// (ver middleware.SuscriptorMensajes)
+func (c *ClienteHTTP) SuscribirMensajes(topico string, manejador func(middleware.Mensaje)) error {
+	return c.suscribir(topico, true, manejador)
+}
+
+// Solicitar publica una solicitud y espera su respuesta (ver middleware.ClienteRPC).
+// La solicitud no pasa por la cola local: si el servidor no es accesible falla.
+func (c *ClienteHTTP) Solicitar(topico string, payload interface{}, timeout time.Duration) ([]byte, error) {
+	return c.solicitudes.Solicitar(topico, payload, timeout, c.suscribirRespuestas, c.enviar)
+}
+
+// Responder atiende las solicitudes publicadas en topico (ver middleware.ClienteRPC)
+func (c *ClienteHTTP) Responder(topico string, manejador middleware.ManejadorSolicitud) error {
+	return c.suscribir(topico, true, solicitudes.Atender(manejador, c.maximoPayload, c.enviar))
+}
+
+// suscribirRespuestas suscribe el tópico de respuestas fuera de la sesión persistente:
+// es propio de esta conexión y las respuestas no tienen sentido tras reconectar
+func (c *ClienteHTTP) suscribirRespuestas(topico string, entregar func(middleware.Mensaje)) error {
+	return c.suscribir(topico, false, entregar)
+}
+
+// suscribir abre el stream SSE del tópico entregando el Mensaje completo; conSesion
+// incluye la suscripción en la sesión persistente del cliente
+func (c *ClienteHTTP) suscribir(topico string, conSesion bool, entregar func(middleware.Mensaje)) error {
 	urlSub := fmt.Sprintf("%s%s?topico=%s", c.baseURL, ruta, url.QueryEscape(topico))
+	if c.testamento != nil {
+		urlSub += "&" + mensaje.ParametrosTestamento(c.idTestamento, c.testamento).Encode()
+	}
+	if c.sesion != "" && conSesion {
+		urlSub += "&" + mensaje.ParamSesion + "=" + url.QueryEscape(c.sesion)
+	}
 	resp, err := c.cliente.Get(urlSub)
 	if err != nil {
 		return fmt.Errorf("%w: %s: %v", errores.ErrSuscripcion, topico, err)
@@ -168,29 +348,41 @@ func (c *ClienteHTTP) Suscribir(topico string, callback middleware.CallbackFunc)
 	c.stopChans[topico] = stop
 	c.mu.Unlock()
 
-	go c.leerSSE(topico, urlSub, resp, reader, callback, stop)
+	go c.leerSSE(topico, urlSub, resp, reader, entregar, stop)
 	return nil
 }
 
 // leerSSE consume el flujo SSE con reconexión automática hasta que se cierre
 // el stop chan (Desuscribir) o se agoten los reintentos (OnError).
-func (c *ClienteHTTP) leerSSE(topico, urlSub string, resp *http.Response, reader *bufio.Reader, callback middleware.CallbackFunc, stop chan struct{}) {
+func (c *ClienteHTTP) leerSSE(topico, urlSub string, resp *http.Response, reader *bufio.Reader, entregar func(middleware.Mensaje), stop chan struct{}) {
 	procesarLinea := func(linea string) {
 		if !strings.HasPrefix(linea, "data: ") {
 			return
 		}
 		datos := strings.TrimSpace(strings.TrimPrefix(linea, "data: "))
-		var msjDatos struct {
-			MensajeID string `json:"mensajeId,omitempty"`
-			QoS       int    `json:"qos"`
-			Topico    string `json:"topico"`
-			Payload   []byte `json:"payload"`
-		}
+		var msjDatos middleware.Mensaje
 		if json.Unmarshal([]byte(datos), &msjDatos) == nil {
-			if msjDatos.QoS == 1 && msjDatos.MensajeID != "" {
+			if msjDatos.QoS >= 1 && msjDatos.MensajeID != "" {
 				c.enviarAck(msjDatos.MensajeID)
 			}
-			callback(msjDatos.Topico, msjDatos.Payload)
+			// Un QoS 2 reentregado (ACK perdido o sesión reanudada) se confirma de nuevo
+			// pero se entrega una sola vez
+			if msjDatos.QoS == 2 && !c.recibidos.Registrar(topico+"|"+msjDatos.MensajeID) {
+				return
+			}
+			if msjDatos.Expirado() {
+				return
+			}
+			if msjDatos.Referencia != "" {
+				contenido, err := c.descargarContenido(msjDatos.Referencia)
+				if err != nil {
+					log.Printf("Error al descargar el payload de %s: %v", msjDatos.Topico, err)
+					return
+				}
+				msjDatos.Payload = contenido
+				msjDatos.Referencia = ""
+			}
+			entregar(msjDatos)
 		}
 	}
 
@@ -320,16 +512,57 @@ func (c *ClienteHTTP) enviarAck(MensajeID string) {
 	defer resp.Body.Close()
 }
 
+// descargarContenido obtiene el payload de un mensaje entregado por referencia
+func (c *ClienteHTTP) descargarContenido(referencia string) ([]byte, error) {
+	urlContenido := fmt.Sprintf("%s%s?%s=%s", c.baseURL, mensaje.RutaContenido, mensaje.ParamReferencia, url.QueryEscape(referencia))
+	resp, err := c.cliente.Get(urlContenido)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return io.ReadAll(resp.Body)
+}
+
 // FallosACK devuelve el contador atómico de fallos de envío de ACK.
 // No forma parte de la interfaz Cliente.
 func (c *ClienteHTTP) FallosACK() int64 {
 	return c.ackFallos.Load()
 }
 
+// Pendientes devuelve la cantidad de publicaciones en la cola local (0 sin
+// ConColaLocal). No forma parte de la interfaz Cliente.
+func (c *ClienteHTTP) Pendientes() int {
+	if c.cola == nil {
+		return 0
+	}
+	return c.cola.Pendientes()
+}
+
+// Descartados devuelve la cantidad de publicaciones perdidas por la política de
+// descarte de la cola local o rechazadas al reenviarlas. No forma parte de la
+// interfaz Cliente.
+func (c *ClienteHTTP) Descartados() int64 {
+	if c.cola == nil {
+		return 0
+	}
+	return c.cola.Descartados()
+}
+
 // Desuscribir detiene la goroutine SSE del tópico (vía stop chan) y envía la
 // cancelación al servidor. Es idempotente: retorna nil si el tópico no estaba
 // suscrito. Devuelve error sólo si falla la cancelación de red (DELETE).
+// Con sesión persistente también termina la suscripción de la sesión.
 func (c *ClienteHTTP) Desuscribir(topico string) error {
+	return c.desuscribir(topico, false)
+}
+
+// desuscribir cancela el stream del tópico; con conservarSesion el servidor sigue
+// encolando los mensajes de la sesión para la próxima conexión
+func (c *ClienteHTTP) desuscribir(topico string, conservarSesion bool) error {
 	c.mu.Lock()
 	stop, ok := c.stopChans[topico]
 	if !ok {
@@ -347,6 +580,14 @@ func (c *ClienteHTTP) Desuscribir(topico string) error {
 	}
 
 	urlUnsub := fmt.Sprintf("%s%s?topico=%s&clienteID=%s", c.baseURL, ruta, url.QueryEscape(topico), url.QueryEscape(clienteID))
+	if c.idTestamento != "" {
+		urlUnsub += "&" + mensaje.ParamTestamentoID + "=" + url.QueryEscape(c.idTestamento)
+	}
+	if c.sesion != "" && conservarSesion {
+		urlUnsub += "&" + mensaje.ParamConservarSesion + "=1"
+	} else if c.sesion != "" {
+		urlUnsub += "&" + mensaje.ParamSesion + "=" + url.QueryEscape(c.sesion)
+	}
 	req, err := http.NewRequest("DELETE", urlUnsub, nil)
 	if err != nil {
 		return fmt.Errorf("%w: %v", errores.ErrDesuscripcion, err)
@@ -364,8 +605,29 @@ func (c *ClienteHTTP) Desuscribir(topico string) error {
 	return nil
 }
 
-// Desconectar cierra las conexiones del cliente HTTP
+// Desconectar cancela las suscripciones activas (sin disparar el testamento)
+// y cierra las conexiones del cliente HTTP. Con sesión persistente las
+// suscripciones de la sesión se conservan hasta la próxima conexión. Detiene el
+// reenvío de la cola local; una cola persistida en archivo conserva sus mensajes.
 func (c *ClienteHTTP) Desconectar() {
+	c.mu.Lock()
+	topicos := make([]string, 0, len(c.stopChans))
+	for topico := range c.stopChans {
+		topicos = append(topicos, topico)
+	}
+	c.mu.Unlock()
+	for _, topico := range topicos {
+		if err := c.desuscribir(topico, true); err != nil {
+			log.Printf("Error al desuscribir %s: %v", topico, err)
+		}
+	}
+
+	if c.cola != nil {
+		if err := c.cola.Cerrar(); err != nil {
+			log.Printf("Error al cerrar la cola local: %v", err)
+		}
+	}
+
 	if c.cliente != nil {
 		if transporte, ok := c.cliente.Transport.(*http.Transport); ok {
 			transporte.CloseIdleConnections()
@@ -1,6 +1,8 @@
 package clientehttp
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -18,7 +20,7 @@ import (
 )
 
 // nuevoClienteHTTPTest crea un ClienteHTTP apuntando a un servidor httptest.
-func nuevoClienteHTTPTest(t *testing.T, server *httptest.Server) *ClienteHTTP {
+func nuevoClienteHTTPTest(t *testing.T, server *httptest.Server, opciones ...middleware.ConectarOpcion) *ClienteHTTP {
 	t.Helper()
 	u, err := url.Parse(server.URL)
 	if err != nil {
@@ -28,7 +30,7 @@ func nuevoClienteHTTPTest(t *testing.T, server *httptest.Server) *ClienteHTTP {
 	if err != nil {
 		t.Fatal(err)
 	}
-	c, err := Conectar(host, port)
+	c, err := Conectar(host, port, opciones...)
 	if err != nil {
 		t.Fatalf("Conectar: %v", err)
 	}
@@ -50,6 +52,65 @@ func TestConectar_HostOPuertoVacios_Error(t *testing.T) {
 	}
 }
 
+// --- Credenciales ---
+
+func TestConectar_ConCredenciales_EnviaAuthorization(t *testing.T) {
+	var recibida atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recibida.Store(r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	casos := []struct {
+		opcion   middleware.ConectarOpcion
+		esperada string
+	}{
+		{middleware.ConToken("abc123"), "Bearer abc123"},
+		{middleware.ConUsuario("sensor1", "secreto"), "Basic " + base64.StdEncoding.EncodeToString([]byte("sensor1:secreto"))},
+	}
+	for _, caso := range casos {
+		c := nuevoClienteHTTPTest(t, srv, caso.opcion)
+		if err := c.Publicar("sensores/temp", "21"); err != nil {
+			t.Fatalf("Publicar: %v", err)
+		}
+		if got := recibida.Load(); got != caso.esperada {
+			t.Errorf("Authorization = %q, esperaba %q", got, caso.esperada)
+		}
+	}
+}
+
+func TestConectarTLS_UsaHTTPS(t *testing.T) {
+	var esTLS atomic.Bool
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		esTLS.Store(r.TLS != nil)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	c, err := ConectarTLS(host, port, &tls.Config{RootCAs: pool}, middleware.ConToken("abc123"))
+	if err != nil {
+		t.Fatalf("ConectarTLS: %v", err)
+	}
+	if err := c.Publicar("sensores/temp", "21"); err != nil {
+		t.Fatalf("Publicar: %v", err)
+	}
+	if !esTLS.Load() {
+		t.Error("la solicitud no llegó por TLS")
+	}
+
+	// Sin la CA del servidor el handshake falla
+	sinCA, _ := ConectarTLS(host, port, &tls.Config{})
+	if err := sinCA.Publicar("sensores/temp", "21"); err == nil {
+		t.Error("esperaba error de verificación del certificado")
+	}
+}
+
 // --- Fallo de publicación QoS0 ---
 
 func TestPublicar_QoS0_EstadoNoOK_Error(t *testing.T) {
@@ -295,6 +356,62 @@ func TestDesuscribir_Idempotente_NoSuscripto(t *testing.T) {
 	}
 }
 
+// --- Cola local: store-and-forward mientras el servidor no responde ---
+
+func TestColaLocal_EncolaYReenviaEnOrden(t *testing.T) {
+	var caido atomic.Bool
+	caido.Store(true)
+	recibidos := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if caido.Load() {
+			http.Error(w, "reiniciando", http.StatusServiceUnavailable)
+			return
+		}
+		var m middleware.Mensaje
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if m.Topico == "prohibido" {
+			http.Error(w, "no autorizado", http.StatusForbidden)
+			return
+		}
+		recibidos <- string(m.Payload)
+	}))
+	defer srv.Close()
+	c := nuevoClienteHTTPTest(t, srv, middleware.ConColaLocal(middleware.ColaLocal{Archivo: t.TempDir() + "/cola"}))
+	defer c.Desconectar()
+
+	for _, p := range []string{"1", "2", "3"} {
+		if err := c.Publicar("sensores/temp", p); err != nil {
+			t.Fatalf("Publicar %s con el servidor caído: %v", p, err)
+		}
+	}
+	if n := c.Pendientes(); n != 3 {
+		t.Errorf("Pendientes() = %d, esperaba 3", n)
+	}
+
+	caido.Store(false)
+	for _, esperado := range []string{"1", "2", "3"} {
+		select {
+		case p := <-recibidos:
+			if p != esperado {
+				t.Errorf("recibido %q, esperaba %q", p, esperado)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no se reenvió el mensaje %s", esperado)
+		}
+	}
+	if err := waitFor(func() bool { return c.Pendientes() == 0 }, time.Second); err != nil {
+		t.Errorf("la cola no se vació: %v", err)
+	}
+
+	// Un rechazo del servidor no se encola
+	if err := c.Publicar("prohibido", "x"); !errores.Es(err, errores.ErrPublicacion) || c.Pendientes() != 0 {
+		t.Errorf("Publicar rechazado = %v con %d pendientes", err, c.Pendientes())
+	}
+}
+
 // --- helpers de espera ---
 
 func int32Func(a *atomic.Int32, ok func(int32) bool) func() bool {
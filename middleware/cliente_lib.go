@@ -1,5 +1,11 @@
 package middleware
 
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
 // Tipo de callback
 type CallbackFunc func(topico string, payload []byte)
 
@@ -13,10 +19,44 @@ type Cliente interface {
 	Desuscribir(topico string) error
 }
 
+// ManejadorSolicitud atiende una solicitud recibida con Responder. Lo que retorna viaja
+// al solicitante como respuesta; un error llega como error de Solicitar.
+type ManejadorSolicitud func(topico string, payload []byte) ([]byte, error)
+
+// ClienteRPC agrega el patrón solicitud/respuesta a un Cliente. Lo implementan los
+// clientes HTTP, CoAP y MQTT; el servidor enruta las respuestas entre protocolos como
+// cualquier otra publicación, así que un cliente HTTP puede invocar a un dispositivo CoAP.
+//
+// Cada cliente recibe sus respuestas en un tópico propio bajo PrefijoRespuestas, que
+// suscribe con la primera solicitud; con ACLs el usuario necesita permiso de suscripción
+// sobre PrefijoRespuestas + "#" y el que responde, permiso de publicación.
+type ClienteRPC interface {
+	Cliente
+	// Solicitar publica una solicitud en topico y espera su respuesta hasta timeout
+	Solicitar(topico string, payload interface{}, timeout time.Duration) ([]byte, error)
+	// Responder suscribe topico y atiende con manejador cada solicitud que llega;
+	// los mensajes sin TopicoRespuesta se ignoran. Desuscribir(topico) la cancela.
+	Responder(topico string, manejador ManejadorSolicitud) error
+}
+
+// SuscriptorMensajes lo implementan los clientes que pueden entregar el Mensaje completo,
+// con sus metadatos (origen, saltos, QoS), en lugar de solo tópico y payload. Lo usan los
+// puentes entre servidores del middleware para detectar bucles.
+type SuscriptorMensajes interface {
+	SuscribirMensajes(topico string, manejador func(Mensaje)) error
+}
+
+// PrefijoRespuestas encabeza los tópicos en los que los clientes reciben las
+// respuestas a sus solicitudes
+const PrefijoRespuestas = "respuestas/"
+
 // PublicarOpcion es una función que modifica un mensaje antes de enviarlo
 type PublicarOpcion func(*Mensaje) error
 
-// ConQoS crea una opción para especificar el QoS del mensaje (0 o 1)
+// ConQoS crea una opción para especificar el QoS del mensaje. 0 entrega a lo sumo una
+// vez, 1 al menos una vez y 2 exactamente una vez: MQTT usa el flujo PUBREC/PUBREL del
+// protocolo, y en HTTP y CoAP el servidor y los clientes descartan las retransmisiones
+// por MensajeID.
 func ConQoS(qos int) PublicarOpcion {
 	return func(m *Mensaje) error {
 		m.QoS = qos
@@ -24,6 +64,201 @@ func ConQoS(qos int) PublicarOpcion {
 	}
 }
 
+// ConRetencion marca el mensaje como retenido: el servidor guarda el último mensaje
+// retenido de cada tópico y lo entrega a los nuevos suscriptores de cualquier protocolo.
+// Un mensaje retenido con payload vacío borra el retenido del tópico.
+func ConRetencion() PublicarOpcion {
+	return func(m *Mensaje) error {
+		m.Retenido = true
+		return nil
+	}
+}
+
+// ConExpiracion descarta el mensaje si no se entregó antes de ttl: el servidor no lo
+// entrega ni lo retransmite pasado ese plazo y los clientes lo ignoran al recibirlo.
+// El vencimiento es un instante absoluto, por lo que requiere relojes sincronizados.
+func ConExpiracion(ttl time.Duration) PublicarOpcion {
+	return func(m *Mensaje) error {
+		if ttl <= 0 {
+			return fmt.Errorf("expiración no positiva: %v", ttl)
+		}
+		m.Expiracion = time.Now().Add(ttl).UnixMilli()
+		return nil
+	}
+}
+
+// ConClaveOrden asigna una clave de orden: el servidor distribuye los mensajes con la
+// misma clave de a uno, en el orden en que los recibió (p. ej. los comandos de un
+// actuador). Los mensajes sin clave se distribuyen en paralelo, sin orden garantizado.
+func ConClaveOrden(clave string) PublicarOpcion {
+	return func(m *Mensaje) error {
+		m.ClaveOrden = clave
+		return nil
+	}
+}
+
+// Credenciales identifican a un cliente ante el servidor del middleware.
+// Se usa usuario/clave o un token bearer (si Token no es vacío tiene prioridad).
+type Credenciales struct {
+	Usuario string
+	Clave   string
+	Token   string
+}
+
+// Vacias indica si no se proporcionó ninguna credencial
+func (c Credenciales) Vacias() bool {
+	return c.Usuario == "" && c.Clave == "" && c.Token == ""
+}
+
+// OpcionesConexion agrupa la configuración aplicada por las ConectarOpcion
+type OpcionesConexion struct {
+	Credenciales Credenciales
+	TLS          *tls.Config // nil = conexión en texto plano
+	Testamento   *Testamento
+	Sesion       string // ID de sesión persistente ("" = sesión limpia)
+	// MaximoPayload es el tamaño máximo en bytes de los payloads que el cliente publica
+	// y descarga (0 = 64 KB)
+	MaximoPayload int
+	Codificacion  Codificacion // "" = JSON
+	ColaLocal     *ColaLocal   // nil = las publicaciones fallidas se pierden
+	// KeepAlive es el intervalo de verificación de la conexión (0 = el del protocolo)
+	KeepAlive time.Duration
+}
+
+// ColaLocal configura el almacenamiento local de publicaciones (store-and-forward).
+// Las publicaciones que no llegan al servidor se encolan y se reenvían en orden, con
+// backoff, cuando vuelve a estar accesible.
+type ColaLocal struct {
+	// Capacidad es el máximo de mensajes encolados (0 = 1000)
+	Capacidad int
+	// Archivo persiste la cola en disco para sobrevivir a reinicios ("" = en memoria)
+	Archivo string
+	// Politica decide qué mensaje se pierde con la cola llena ("" = DescartarAntiguos)
+	Politica PoliticaDescarte
+}
+
+// PoliticaDescarte indica qué hacer al encolar con la cola local llena
+type PoliticaDescarte string
+
+const (
+	// DescartarAntiguos descarta el mensaje más antiguo para encolar el nuevo
+	DescartarAntiguos PoliticaDescarte = "antiguos"
+	// DescartarNuevos rechaza la publicación nueva con ErrPublicacion
+	DescartarNuevos PoliticaDescarte = "nuevos"
+)
+
+// Codificacion es el formato en que un mensaje cruza la red
+type Codificacion string
+
+const (
+	// CodificacionJSON es el formato por defecto: JSON con el payload en base64
+	CodificacionJSON Codificacion = "json"
+	// CodificacionCBOR es un mapa CBOR (RFC 8949) con claves enteras y el payload
+	// binario, pensado para dispositivos restringidos
+	CodificacionCBOR Codificacion = "cbor"
+)
+
+// Testamento es el mensaje que el servidor publica en nombre del cliente si su
+// conexión se cae sin desconectarse (last will). En HTTP y CoAP se declara en cada
+// suscripción y se publica cuando se caen todas las suscripciones del cliente.
+type Testamento struct {
+	Topico   string
+	Payload  []byte
+	Retenido bool
+}
+
+// ConectarOpcion es una función que modifica la configuración de conexión de un cliente
+type ConectarOpcion func(*OpcionesConexion)
+
+// ConUsuario autentica al cliente con usuario y clave
+func ConUsuario(usuario, clave string) ConectarOpcion {
+	return func(o *OpcionesConexion) {
+		o.Credenciales.Usuario = usuario
+		o.Credenciales.Clave = clave
+	}
+}
+
+// ConToken autentica al cliente con un token bearer
+func ConToken(token string) ConectarOpcion {
+	return func(o *OpcionesConexion) {
+		o.Credenciales.Token = token
+	}
+}
+
+// ConTLS conecta al servidor sobre TLS (HTTPS, MQTT sobre TLS o, en CoAP, DTLS con
+// los certificados de la configuración). Para TLS mutuo incluir el certificado del
+// cliente en config.Certificates.
+func ConTLS(config *tls.Config) ConectarOpcion {
+	return func(o *OpcionesConexion) {
+		o.TLS = config
+	}
+}
+
+// ConTestamento configura el mensaje de última voluntad del cliente
+func ConTestamento(topico string, payload []byte, retenido bool) ConectarOpcion {
+	return func(o *OpcionesConexion) {
+		o.Testamento = &Testamento{Topico: topico, Payload: payload, Retenido: retenido}
+	}
+}
+
+// ConSesion usa una sesión persistente con el ID indicado, que debe ser único por
+// dispositivo. El servidor encola los mensajes de las suscripciones de la sesión
+// mientras el cliente está desconectado y los entrega al reconectar con el mismo ID.
+// Desuscribir termina la suscripción de la sesión; Desconectar la conserva.
+// En MQTT equivale a un ClientID fijo con clean-session=false.
+func ConSesion(id string) ConectarOpcion {
+	return func(o *OpcionesConexion) {
+		o.Sesion = id
+	}
+}
+
+// ConMaximoPayload cambia el tamaño máximo de payload del cliente (por defecto 64 KB).
+// Debe acompañar al límite configurado en el servidor para el protocolo; los payloads
+// grandes viajan con block-wise en CoAP y como cuerpo binario en HTTP.
+func ConMaximoPayload(bytes int) ConectarOpcion {
+	return func(o *OpcionesConexion) {
+		o.MaximoPayload = bytes
+	}
+}
+
+// ConCodificacion elige la codificación de los mensajes del cliente. El servidor
+// transcodifica entre codificaciones al distribuir a otros protocolos.
+func ConCodificacion(c Codificacion) ConectarOpcion {
+	return func(o *OpcionesConexion) {
+		o.Codificacion = c
+	}
+}
+
+// ConColaLocal habilita la cola local de publicaciones en los clientes HTTP y CoAP.
+// Si el servidor no es accesible, Publicar encola el mensaje y retorna nil; mientras
+// queden mensajes encolados las publicaciones nuevas se encolan detrás para conservar
+// el orden. Los rechazos del servidor (mensaje inválido, no autorizado) no se encolan.
+func ConColaLocal(cola ColaLocal) ConectarOpcion {
+	return func(o *OpcionesConexion) {
+		o.ColaLocal = &cola
+	}
+}
+
+// ConKeepAlive cambia el intervalo con que el cliente verifica la conexión. En CoAP es
+// el intervalo de los pings y de la verificación de las observaciones (por defecto
+// 12 s); en MQTT, el keepalive del protocolo (por defecto 30 s). HTTP lo ignora.
+func ConKeepAlive(intervalo time.Duration) ConectarOpcion {
+	return func(o *OpcionesConexion) {
+		o.KeepAlive = intervalo
+	}
+}
+
+// AplicarOpcionesConexion construye la configuración de conexión a partir de las opciones
+func AplicarOpcionesConexion(opciones ...ConectarOpcion) OpcionesConexion {
+	var o OpcionesConexion
+	for _, opcion := range opciones {
+		if opcion != nil {
+			opcion(&o)
+		}
+	}
+	return o
+}
+
 // Mensaje representa un mensaje en el sistema
 type Mensaje struct {
 	Original  bool   `json:"original"`
@@ -33,4 +268,27 @@ type Mensaje struct {
 	QoS       int    `json:"qos,omitempty"`
 	MensajeID string `json:"mensajeId,omitempty"`
 	Origen    string `json:"origen,omitempty"`
+	Retenido  bool   `json:"retenido,omitempty"`
+	// Referencia identifica un payload grande guardado en el servidor; el mensaje llega
+	// sin payload y los clientes lo descargan antes de invocar el callback
+	Referencia string `json:"referencia,omitempty"`
+	// TopicoRespuesta y Correlacion convierten el mensaje en una solicitud: la respuesta
+	// se publica en TopicoRespuesta con la misma Correlacion (ver ClienteRPC)
+	TopicoRespuesta string `json:"topicoRespuesta,omitempty"`
+	Correlacion     string `json:"correlacion,omitempty"`
+	// Error es el error con el que el manejador rechazó una solicitud; solo en respuestas
+	Error string `json:"error,omitempty"`
+	// Saltos son los IDs de las instancias del servidor que ya distribuyeron el mensaje,
+	// en orden; una instancia descarta los mensajes que la incluyen (ver servidor.Puente)
+	Saltos []string `json:"saltos,omitempty"`
+	// Expiracion es el instante, en milisegundos Unix, a partir del cual el mensaje ya no
+	// se entrega (0 = no expira, ver ConExpiracion)
+	Expiracion int64 `json:"expiracion,omitempty"`
+	// ClaveOrden agrupa los mensajes que se distribuyen en orden (ver ConClaveOrden)
+	ClaveOrden string `json:"claveOrden,omitempty"`
+}
+
+// Expirado indica si el mensaje venció y ya no debe entregarse
+func (m Mensaje) Expirado() bool {
+	return m.Expiracion > 0 && time.Now().UnixMilli() >= m.Expiracion
 }
@@ -1,7 +1,7 @@
 package cliente_mqtt
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"sync"
@@ -12,6 +12,7 @@ import (
 	"github.com/sensorwave-dev/sensorwave/middleware"
 	"github.com/sensorwave-dev/sensorwave/middleware/internal/errores"
 	"github.com/sensorwave-dev/sensorwave/middleware/internal/mensaje"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/solicitudes"
 )
 
 // Constantes de reconexión
@@ -25,19 +26,66 @@ type ClienteMQTT struct {
 	cliente       mqtt.Client
 	mu            sync.Mutex
 	suscripciones map[string]mqtt.MessageHandler
+	maximoPayload int // límite de los payloads publicados (0 = 64 KB)
+	// codificacion de las publicaciones; al recibir se detecta por el primer byte
+	codificacion middleware.Codificacion
+	// solicitudes en espera de respuesta (Solicitar)
+	solicitudes *solicitudes.Pendientes
 }
 
-// conectar cliente con backoff exponencial
-func Conectar(host string, puerto string) (*ClienteMQTT, error) {
+// ConectarTLS conecta al broker sobre TLS. Para TLS mutuo config debe incluir el
+// certificado del cliente; el servidor usa su CommonName como identidad.
+func ConectarTLS(host string, puerto string, config *tls.Config, opciones ...middleware.ConectarOpcion) (*ClienteMQTT, error) {
+	return Conectar(host, puerto, append(opciones, middleware.ConTLS(config))...)
+}
+
+// conectar cliente con backoff exponencial.
+// Las credenciales (ConUsuario/ConToken) se envían en el CONNECT; un token viaja como clave sin usuario.
+func Conectar(host string, puerto string, opciones ...middleware.ConectarOpcion) (*ClienteMQTT, error) {
+	conexion := middleware.AplicarOpcionesConexion(opciones...)
+
 	c := &ClienteMQTT{
 		suscripciones: make(map[string]mqtt.MessageHandler),
+		maximoPayload: conexion.MaximoPayload,
+		codificacion:  conexion.Codificacion,
+		solicitudes:   solicitudes.Nuevas(conexion.MaximoPayload),
 	}
 
 	// Configuración del cliente MQTT
 	servidor := "tcp://" + host + ":" + puerto
+	if conexion.TLS != nil {
+		servidor = "ssl://" + host + ":" + puerto
+	}
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(servidor)
-	opts.SetClientID("sensorwave_" + uuid.New().String())
+	if conexion.TLS != nil {
+		opts.SetTLSConfig(conexion.TLS)
+	}
+	if conexion.Sesion != "" {
+		// El broker conserva suscripciones y mensajes QoS 1 mientras el cliente está desconectado
+		opts.SetClientID(conexion.Sesion)
+		opts.SetCleanSession(false)
+	} else {
+		opts.SetClientID("sensorwave_" + uuid.New().String())
+	}
+	if t := conexion.Testamento; t != nil {
+		// El broker espera el mismo Mensaje que en las publicaciones
+		testamento, err := mensaje.Codificar(middleware.Mensaje{Original: true, Topico: t.Topico, Payload: t.Payload, Retenido: t.Retenido}, conexion.Codificacion)
+		if err != nil {
+			return nil, fmt.Errorf("%w: testamento inválido: %v", errores.ErrConexion, err)
+		}
+		opts.SetBinaryWill(t.Topico, testamento, 0, t.Retenido)
+	}
+	if cred := conexion.Credenciales; cred.Token != "" {
+		opts.SetPassword(cred.Token)
+	} else if !cred.Vacias() {
+		opts.SetUsername(cred.Usuario)
+		opts.SetPassword(cred.Clave)
+	}
+
+	if conexion.KeepAlive > 0 {
+		opts.SetKeepAlive(conexion.KeepAlive)
+	}
 
 	// Reconexión automática con re-suscripción
 	opts.SetAutoReconnect(true)
@@ -77,42 +125,82 @@ func Conectar(host string, puerto string) (*ClienteMQTT, error) {
 
 // cerrar cliente
 func (c *ClienteMQTT) Desconectar() {
+	// El tópico de respuestas es propio de esta conexión: con sesión persistente el
+	// broker lo conservaría para siempre
+	if c.solicitudes.Suscrito() {
+		if err := c.Desuscribir(c.solicitudes.Topico()); err != nil {
+			log.Printf("Error al desuscribir el tópico de respuestas: %v", err)
+		}
+	}
 	// Desconectar el cliente
 	c.cliente.Disconnect(250)
 }
 
-// publicar
+// publicar. MQTT 3.1.1 no informa al publicante los rechazos del registro de tópicos
+// del servidor: el PUBLISH que no cumple la definición del tópico se descarta.
 func (c *ClienteMQTT) Publicar(topico string, payload interface{}, opciones ...middleware.PublicarOpcion) error {
-	mensaje, err := mensaje.Construir(topico, payload, opciones...)
+	m, err := mensaje.ConstruirConLimite(topico, payload, c.maximoPayload, opciones...)
 	if err != nil {
 		return fmt.Errorf("%w: %v", errores.ErrPublicacion, err)
 	}
+	return c.enviar(m)
+}
 
-	// Serializar el mensaje a JSON
-	mensajeBytes, err := json.Marshal(mensaje)
+// enviar publica el mensaje construido
+func (c *ClienteMQTT) enviar(m middleware.Mensaje) error {
+	// Serializar el mensaje en la codificación del cliente. MQTT 3.1.1 no tiene
+	// propiedades: el servidor detecta CBOR por el primer byte.
+	mensajeBytes, err := mensaje.Codificar(m, c.codificacion)
 	if err != nil {
 		return fmt.Errorf("%w: %v", errores.ErrPublicacion, err)
 	}
 
 	// Publicar un mensaje en el tópico
-	if token := c.cliente.Publish(topico, byte(mensaje.QoS), false, mensajeBytes); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("%w: %s: %v", errores.ErrPublicacion, topico, token.Error())
+	if token := c.cliente.Publish(m.Topico, byte(m.QoS), m.Retenido, mensajeBytes); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("%w: %s: %v", errores.ErrPublicacion, m.Topico, token.Error())
 	}
 	return nil
 }
 
 // suscribir a tópico
 func (c *ClienteMQTT) Suscribir(topico string, callback middleware.CallbackFunc) error {
+	return c.suscribir(topico, func(m middleware.Mensaje) {
+		callback(m.Topico, m.Payload)
+	})
+}
+
+// SuscribirMensajes suscribe el tópico entregando el Mensaje completo
+// (ver middleware.SuscriptorMensajes)
+func (c *ClienteMQTT) SuscribirMensajes(topico string, manejador func(middleware.Mensaje)) error {
+	return c.suscribir(topico, manejador)
+}
+
+// Solicitar publica una solicitud y espera su respuesta (ver middleware.ClienteRPC)
+func (c *ClienteMQTT) Solicitar(topico string, payload interface{}, timeout time.Duration) ([]byte, error) {
+	return c.solicitudes.Solicitar(topico, payload, timeout, c.suscribir, c.enviar)
+}
+
+// Responder atiende las solicitudes publicadas en topico (ver middleware.ClienteRPC)
+func (c *ClienteMQTT) Responder(topico string, manejador middleware.ManejadorSolicitud) error {
+	return c.suscribir(topico, solicitudes.Atender(manejador, c.maximoPayload, c.enviar))
+}
+
+// suscribir registra la suscripción entregando el Mensaje completo
+func (c *ClienteMQTT) suscribir(topico string, entregar func(middleware.Mensaje)) error {
 	// Suscribirse a un tópico
 	callbackInterno := func(client mqtt.Client, msg mqtt.Message) {
 
-		var mensaje middleware.Mensaje
-		err := json.Unmarshal(msg.Payload(), &mensaje)
+		// Los publicantes MQTT pueden usar JSON o CBOR: se detecta por el primer byte
+		m, err := mensaje.Decodificar(msg.Payload(), "")
 		if err != nil {
 			log.Printf("Error al procesar el cuerpo de la solicitud: %v", err)
 			return
 		}
-		callback(msg.Topic(), mensaje.Payload)
+		if m.Expirado() {
+			return
+		}
+		m.Topico = msg.Topic()
+		entregar(m)
 	}
 
 	// Guardar callback para re-suscripción
@@ -120,7 +208,9 @@ func (c *ClienteMQTT) Suscribir(topico string, callback middleware.CallbackFunc)
 	c.suscripciones[topico] = callbackInterno
 	c.mu.Unlock()
 
-	if token := c.cliente.Subscribe(topico, 1, callbackInterno); token.Wait() && token.Error() != nil {
+	// QoS 2: el broker entrega cada mensaje con el QoS con que se publicó (PUBREC/PUBREL
+	// para los QoS 2)
+	if token := c.cliente.Subscribe(topico, 2, callbackInterno); token.Wait() && token.Error() != nil {
 		// Revertir el registro si la suscripción falló
 		c.mu.Lock()
 		delete(c.suscripciones, topico)
@@ -0,0 +1,111 @@
+// Package formatos decodifica payloads de sensores con esquema propio (SenML y
+// Sparkplug B) en registros normalizados: la ruta de la serie, la marca de tiempo y
+// un valor tipado. Los registros se insertan en las series de GestorBorde y el
+// servidor del middleware los re-publica en los tópicos canónicos normalizado/<serie>.
+package formatos
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sensorwave-dev/sensorwave/tipos"
+)
+
+// PrefijoCanonico es el prefijo de los tópicos donde se publican los registros normalizados
+const PrefijoCanonico = "normalizado/"
+
+// Registro es una medición decodificada de un payload con esquema
+type Registro struct {
+	Serie  string      // ruta de la serie, p.ej. "planta/linea1/temp"
+	Tiempo int64       // marca de tiempo Unix en nanosegundos
+	Valor  interface{} // bool, int64, float64 o string
+}
+
+// registroJSON es la forma normalizada publicada en los tópicos canónicos. El tipo
+// explícito conserva la diferencia entre Integer y Real que el número JSON pierde.
+type registroJSON struct {
+	Serie  string          `json:"serie"`
+	Tiempo int64           `json:"tiempo"`
+	Tipo   tipos.TipoDatos `json:"tipo"`
+	Valor  json.RawMessage `json:"valor"`
+}
+
+// TipoDatos retorna el tipo de serie que corresponde al valor del registro
+func (r Registro) TipoDatos() tipos.TipoDatos {
+	switch r.Valor.(type) {
+	case bool:
+		return tipos.Boolean
+	case int64:
+		return tipos.Integer
+	case float64:
+		return tipos.Real
+	case string:
+		return tipos.Text
+	}
+	return tipos.Desconocido
+}
+
+// MarshalJSON serializa el registro en su forma normalizada
+func (r Registro) MarshalJSON() ([]byte, error) {
+	tipo := r.TipoDatos()
+	if tipo == tipos.Desconocido {
+		return nil, fmt.Errorf("valor de tipo %T no soportado en la serie %s", r.Valor, r.Serie)
+	}
+	valor, err := json.Marshal(r.Valor)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(registroJSON{Serie: r.Serie, Tiempo: r.Tiempo, Tipo: tipo, Valor: valor})
+}
+
+// UnmarshalJSON lee la forma normalizada, respetando el tipo declarado
+func (r *Registro) UnmarshalJSON(datos []byte) error {
+	var crudo registroJSON
+	if err := json.Unmarshal(datos, &crudo); err != nil {
+		return err
+	}
+	decodificador := json.NewDecoder(bytes.NewReader(crudo.Valor))
+	decodificador.UseNumber()
+	var valor interface{}
+	if err := decodificador.Decode(&valor); err != nil {
+		return fmt.Errorf("valor inválido en la serie %s: %v", crudo.Serie, err)
+	}
+
+	var tipado interface{}
+	var err error
+	switch v := valor.(type) {
+	case bool:
+		if crudo.Tipo == tipos.Boolean {
+			tipado = v
+		}
+	case string:
+		if crudo.Tipo == tipos.Text {
+			tipado = v
+		}
+	case json.Number:
+		switch crudo.Tipo {
+		case tipos.Integer:
+			tipado, err = v.Int64()
+		case tipos.Real:
+			tipado, err = v.Float64()
+		}
+	}
+	if err != nil || tipado == nil {
+		return fmt.Errorf("valor %s incompatible con el tipo %s en la serie %s", crudo.Valor, crudo.Tipo, crudo.Serie)
+	}
+	*r = Registro{Serie: crudo.Serie, Tiempo: crudo.Tiempo, Valor: tipado}
+	return nil
+}
+
+// TopicoCanonico retorna el tópico donde se publica el registro normalizado de una serie
+func TopicoCanonico(serie string) string {
+	return PrefijoCanonico + strings.TrimPrefix(serie, "/")
+}
+
+// SerieDeTopicoCanonico retorna la serie de un tópico canónico (false si no lo es)
+func SerieDeTopicoCanonico(topico string) (string, bool) {
+	serie, ok := strings.CutPrefix(topico, PrefijoCanonico)
+	return serie, ok && serie != ""
+}
@@ -0,0 +1,49 @@
+package formatos
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRegistro_JSONConservaTipo(t *testing.T) {
+	casos := []Registro{
+		{Serie: "planta/contador", Tiempo: 1, Valor: int64(9007199254740993)},
+		{Serie: "planta/temp", Tiempo: 2, Valor: 21.0},
+		{Serie: "planta/puerta", Tiempo: 3, Valor: true},
+		{Serie: "planta/estado", Tiempo: 4, Valor: "ok"},
+	}
+	for _, r := range casos {
+		datos, err := json.Marshal(r)
+		if err != nil {
+			t.Fatalf("Marshal(%+v) error = %v", r, err)
+		}
+		var decodificado Registro
+		if err := json.Unmarshal(datos, &decodificado); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", datos, err)
+		}
+		if decodificado != r {
+			t.Errorf("ida y vuelta de %s = %+v, esperaba %+v", datos, decodificado, r)
+		}
+	}
+
+	if _, err := json.Marshal(Registro{Serie: "x", Valor: []int{1}}); err == nil {
+		t.Error("esperaba error con un valor no soportado")
+	}
+	var r Registro
+	if err := json.Unmarshal([]byte(`{"serie":"x","tiempo":1,"tipo":"Integer","valor":1.5}`), &r); err == nil {
+		t.Errorf("esperaba error con un valor incompatible, obtuvo %+v", r)
+	}
+}
+
+func TestTopicoCanonico(t *testing.T) {
+	topico := TopicoCanonico("/planta/temp")
+	if topico != "normalizado/planta/temp" {
+		t.Errorf("TopicoCanonico() = %q", topico)
+	}
+	if serie, ok := SerieDeTopicoCanonico(topico); !ok || serie != "planta/temp" {
+		t.Errorf("SerieDeTopicoCanonico(%q) = %q, %v", topico, serie, ok)
+	}
+	if _, ok := SerieDeTopicoCanonico("sensores/temp"); ok {
+		t.Error("sensores/temp no es un tópico canónico")
+	}
+}
@@ -0,0 +1,249 @@
+package formatos
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/mensaje"
+)
+
+// SenML (RFC 8428): un pack es un arreglo de registros cuyos campos base (bn, bt, bv,
+// bs) se aplican a los registros siguientes hasta que otro registro los cambia. Se
+// decodifican la representación JSON y la CBOR, que usa las etiquetas enteras de la
+// sección 6 de la RFC. Cada registro con valor produce un Registro cuya serie es el
+// nombre resuelto (bn + n).
+
+const (
+	TipoSenMLJSON = "application/senml+json"
+	TipoSenMLCBOR = "application/senml+cbor"
+)
+
+// etiquetasSenMLCBOR traduce las etiquetas enteras de SenML CBOR a los nombres JSON
+var etiquetasSenMLCBOR = map[int64]string{
+	-1: "bver", -2: "bn", -3: "bt", -4: "bu", -5: "bv", -6: "bs",
+	0: "n", 1: "u", 2: "v", 3: "vs", 4: "vb", 5: "s", 6: "t", 7: "ut", 8: "vd",
+}
+
+// umbralTiempoRelativo: los tiempos menores a 2^28 segundos son relativos al momento
+// de la decodificación (RFC 8428, sección 4.5.3)
+const umbralTiempoRelativo = 1 << 28
+
+// ahora se reemplaza en los tests
+var ahora = time.Now
+
+// registroSenML son los campos de un registro del pack, con los números como float64
+type registroSenML map[string]interface{}
+
+// DecodificarSenML decodifica un pack SenML en JSON o CBOR; la representación se
+// detecta por el primer byte (un arreglo JSON empieza con '[' y uno CBOR entre 0x80 y 0x9F)
+func DecodificarSenML(datos []byte) ([]Registro, error) {
+	var pack []registroSenML
+	var err error
+	if recortado := bytes.TrimSpace(datos); len(recortado) > 0 && recortado[0] == '[' {
+		pack, err = leerSenMLJSON(recortado)
+	} else {
+		pack, err = leerSenMLCBOR(datos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pack SenML inválido: %v", err)
+	}
+	return resolverSenML(pack, ahora())
+}
+
+func leerSenMLJSON(datos []byte) ([]registroSenML, error) {
+	decodificador := json.NewDecoder(bytes.NewReader(datos))
+	decodificador.UseNumber()
+	var crudo []map[string]interface{}
+	if err := decodificador.Decode(&crudo); err != nil {
+		return nil, err
+	}
+	pack := make([]registroSenML, len(crudo))
+	for i, campos := range crudo {
+		pack[i] = registroSenML{}
+		for nombre, valor := range campos {
+			if numero, ok := valor.(json.Number); ok {
+				f, err := numero.Float64()
+				if err != nil {
+					return nil, fmt.Errorf("registro %d: %s: %v", i, nombre, err)
+				}
+				valor = f
+			}
+			pack[i][nombre] = valor
+		}
+	}
+	return pack, nil
+}
+
+func leerSenMLCBOR(datos []byte) ([]registroSenML, error) {
+	valor, err := mensaje.DecodificarValorCBOR(datos)
+	if err != nil {
+		return nil, err
+	}
+	arreglo, ok := valor.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("se esperaba un arreglo")
+	}
+	pack := make([]registroSenML, len(arreglo))
+	for i, elemento := range arreglo {
+		mapa, ok := elemento.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("registro %d: se esperaba un mapa", i)
+		}
+		pack[i] = registroSenML{}
+		for clave, valor := range mapa {
+			var etiqueta int64
+			switch c := clave.(type) {
+			case int64:
+				etiqueta = c
+			case uint64:
+				etiqueta = int64(c)
+			default:
+				continue // etiqueta de texto: extensión desconocida
+			}
+			nombre, ok := etiquetasSenMLCBOR[etiqueta]
+			if !ok {
+				continue
+			}
+			switch v := valor.(type) {
+			case uint64:
+				valor = float64(v)
+			case int64:
+				valor = float64(v)
+			case []byte:
+				// vd viaja como bytes en CBOR y como base64url en JSON
+				valor = base64.RawURLEncoding.EncodeToString(v)
+			}
+			pack[i][nombre] = valor
+		}
+	}
+	return pack, nil
+}
+
+// resolverSenML aplica los campos base y convierte el pack en registros
+func resolverSenML(pack []registroSenML, momento time.Time) ([]Registro, error) {
+	var nombreBase string
+	var tiempoBase, valorBase, sumaBase float64
+	var registros []Registro
+	for i, r := range pack {
+		var err error
+		if nombreBase, err = r.texto("bn", nombreBase); err != nil {
+			return nil, fmt.Errorf("registro %d: %v", i, err)
+		}
+		if tiempoBase, err = r.numero("bt", tiempoBase); err != nil {
+			return nil, fmt.Errorf("registro %d: %v", i, err)
+		}
+		if valorBase, err = r.numero("bv", valorBase); err != nil {
+			return nil, fmt.Errorf("registro %d: %v", i, err)
+		}
+		if sumaBase, err = r.numero("bs", sumaBase); err != nil {
+			return nil, fmt.Errorf("registro %d: %v", i, err)
+		}
+
+		valor, err := r.valor(valorBase, sumaBase)
+		if err != nil {
+			return nil, fmt.Errorf("registro %d: %v", i, err)
+		}
+		if valor == nil {
+			continue // registro solo con campos base
+		}
+		n, err := r.texto("n", "")
+		if err != nil {
+			return nil, fmt.Errorf("registro %d: %v", i, err)
+		}
+		nombre := nombreBase + n
+		if !nombreSenMLValido(nombre) {
+			return nil, fmt.Errorf("registro %d: nombre inválido %q", i, nombre)
+		}
+		t, err := r.numero("t", 0)
+		if err != nil {
+			return nil, fmt.Errorf("registro %d: %v", i, err)
+		}
+
+		registros = append(registros, Registro{Serie: nombre, Tiempo: tiempoSenML(tiempoBase+t, momento), Valor: valor})
+	}
+	return registros, nil
+}
+
+// valor retorna el valor del registro: v (más bv), vs, vb, vd o, si no hay otro, s (más bs).
+// Retorna nil si el registro no tiene valor.
+func (r registroSenML) valor(valorBase, sumaBase float64) (interface{}, error) {
+	if _, ok := r["v"]; ok {
+		v, err := r.numero("v", 0)
+		return valorBase + v, err
+	}
+	if _, ok := r["vs"]; ok {
+		return r.texto("vs", "")
+	}
+	if v, ok := r["vb"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("vb no es booleano")
+		}
+		return b, nil
+	}
+	if _, ok := r["vd"]; ok {
+		return r.texto("vd", "")
+	}
+	if _, ok := r["s"]; ok {
+		s, err := r.numero("s", 0)
+		return sumaBase + s, err
+	}
+	return nil, nil
+}
+
+// numero retorna el campo numérico o porDefecto si no está
+func (r registroSenML) numero(campo string, porDefecto float64) (float64, error) {
+	v, ok := r[campo]
+	if !ok {
+		return porDefecto, nil
+	}
+	f, ok := v.(float64)
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%s no es un número", campo)
+	}
+	return f, nil
+}
+
+// texto retorna el campo de texto o porDefecto si no está
+func (r registroSenML) texto(campo string, porDefecto string) (string, error) {
+	v, ok := r[campo]
+	if !ok {
+		return porDefecto, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s no es texto", campo)
+	}
+	return s, nil
+}
+
+// tiempoSenML convierte segundos SenML (absolutos o relativos) a nanosegundos Unix
+func tiempoSenML(segundos float64, momento time.Time) int64 {
+	if segundos < umbralTiempoRelativo {
+		return momento.UnixNano() + int64(math.Round(segundos*1e9))
+	}
+	return int64(math.Round(segundos * 1e9))
+}
+
+// nombreSenMLValido aplica la regla de la RFC 8428 (sección 4.5.1): empieza con una
+// letra o un dígito y solo contiene letras, dígitos y "-:./_". Excluye los comodines
+// MQTT, de modo que el nombre sirve como ruta de serie y sufijo de tópico.
+func nombreSenMLValido(nombre string) bool {
+	if nombre == "" {
+		return false
+	}
+	for i, c := range nombre {
+		alfanumerico := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+		if i == 0 && !alfanumerico {
+			return false
+		}
+		if !alfanumerico && c != '-' && c != ':' && c != '.' && c != '/' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package formatos
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fijarAhora reemplaza el reloj de la decodificación durante el test
+func fijarAhora(t *testing.T, momento time.Time) {
+	t.Helper()
+	anterior := ahora
+	ahora = func() time.Time { return momento }
+	t.Cleanup(func() { ahora = anterior })
+}
+
+func TestSenML_JSONEjemploRFC(t *testing.T) {
+	// RFC 8428, sección 5.1.2: múltiples mediciones con campos base
+	pack := `[
+	 {"bn":"urn:dev:ow:10e2073a01080063:","bt":1.276020076001e+09,"bu":"A","bver":5,"n":"voltage","u":"V","v":120.1},
+	 {"n":"current","t":-5,"v":1.2},
+	 {"n":"current","t":-4,"v":1.3}
+	]`
+	registros, err := DecodificarSenML([]byte(pack))
+	if err != nil {
+		t.Fatalf("DecodificarSenML() error = %v", err)
+	}
+	esperados := []struct {
+		serie  string
+		tiempo int64
+		valor  float64
+	}{
+		{"urn:dev:ow:10e2073a01080063:voltage", 1276020076001000000, 120.1},
+		{"urn:dev:ow:10e2073a01080063:current", 1276020071001000000, 1.2},
+		{"urn:dev:ow:10e2073a01080063:current", 1276020072001000000, 1.3},
+	}
+	if len(registros) != len(esperados) {
+		t.Fatalf("registros = %+v, esperaba %d", registros, len(esperados))
+	}
+	for i, e := range esperados {
+		r := registros[i]
+		// bt en float64 pierde algunos nanosegundos a esta magnitud
+		if r.Serie != e.serie || r.Valor != e.valor || r.Tiempo-e.tiempo > 1000 || e.tiempo-r.Tiempo > 1000 {
+			t.Errorf("registro %d = %+v, esperaba %+v", i, r, e)
+		}
+	}
+}
+
+func TestSenML_ValoresYBases(t *testing.T) {
+	momento := time.Unix(1700000000, 0)
+	fijarAhora(t, momento)
+	pack := `[
+	 {"bn":"planta/","bv":10,"bs":100},
+	 {"n":"temp","v":1.5},
+	 {"n":"estado","vs":"ok","t":-2},
+	 {"n":"puerta","vb":true},
+	 {"n":"firma","vd":"AQID"},
+	 {"n":"energia","s":5},
+	 {"n":"sin_valor"}
+	]`
+	registros, err := DecodificarSenML([]byte(pack))
+	if err != nil {
+		t.Fatalf("DecodificarSenML() error = %v", err)
+	}
+	esperados := []Registro{
+		{Serie: "planta/temp", Tiempo: momento.UnixNano(), Valor: 11.5},
+		{Serie: "planta/estado", Tiempo: momento.Add(-2 * time.Second).UnixNano(), Valor: "ok"},
+		{Serie: "planta/puerta", Tiempo: momento.UnixNano(), Valor: true},
+		{Serie: "planta/firma", Tiempo: momento.UnixNano(), Valor: "AQID"},
+		{Serie: "planta/energia", Tiempo: momento.UnixNano(), Valor: 105.0},
+	}
+	if !reflect.DeepEqual(registros, esperados) {
+		t.Errorf("registros = %+v\nesperaba %+v", registros, esperados)
+	}
+}
+
+func TestSenML_CBOR(t *testing.T) {
+	// [{-2: "dev/", -3: 1700000000, 0: "temp", 2: 21.5 (media precisión)},
+	//  {0: "on", 4: true},
+	//  {0: "raw", 8: h'010203'}]
+	datos, _ := hex.DecodeString("83" +
+		"a4" + "21" + "646465762f" + "22" + "1a6553f100" + "00" + "6474656d70" + "02" + "f94d60" +
+		"a2" + "00" + "626f6e" + "04" + "f5" +
+		"a2" + "00" + "63726177" + "08" + "43010203")
+	registros, err := DecodificarSenML(datos)
+	if err != nil {
+		t.Fatalf("DecodificarSenML() error = %v", err)
+	}
+	tiempo := int64(1700000000) * 1e9
+	esperados := []Registro{
+		{Serie: "dev/temp", Tiempo: tiempo, Valor: 21.5},
+		{Serie: "dev/on", Tiempo: tiempo, Valor: true},
+		{Serie: "dev/raw", Tiempo: tiempo, Valor: "AQID"},
+	}
+	if !reflect.DeepEqual(registros, esperados) {
+		t.Errorf("registros = %+v\nesperaba %+v", registros, esperados)
+	}
+}
+
+func TestSenML_Invalido(t *testing.T) {
+	casos := map[string]string{
+		"no es arreglo":      `{"n":"temp","v":1}`,
+		"sin nombre":         `[{"v":1}]`,
+		"nombre inválido":    `[{"n":"-temp","v":1}]`,
+		"comodín en nombre":  `[{"n":"temp/#","v":1}]`,
+		"v no numérico":      `[{"n":"temp","v":"1"}]`,
+		"vb no booleano":     `[{"n":"temp","vb":1}]`,
+		"bn no es texto":     `[{"bn":1,"n":"temp","v":1}]`,
+		"JSON truncado":      `[{"n":"temp","v":1}`,
+		"CBOR truncado":      "\x81\xa2\x00\x64te",
+		"CBOR no es arreglo": "\xa1\x00\x61a",
+	}
+	for nombre, pack := range casos {
+		if registros, err := DecodificarSenML([]byte(pack)); err == nil {
+			t.Errorf("%s: DecodificarSenML() = %+v, esperaba error", nombre, registros)
+		}
+	}
+}
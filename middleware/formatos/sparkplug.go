@@ -0,0 +1,402 @@
+package formatos
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B (Eclipse Tahu): los nodos de borde publican por MQTT en
+// spBv1.0/<grupo>/<tipo>/<nodo>[/<dispositivo>] un Payload protobuf con métricas.
+// NBIRTH y DBIRTH declaran el nombre, el alias y el tipo de cada métrica; NDATA y
+// DDATA suelen enviar solo el alias, por eso el decodificador guarda los nacimientos
+// de cada nodo. La serie de una métrica es <grupo>/<nodo>[/<dispositivo>]/<nombre>.
+
+const PrefijoSparkplug = "spBv1.0/"
+
+// Tipos de mensaje Sparkplug que llevan métricas o cambian el estado de los alias
+const (
+	SparkplugNBIRTH = "NBIRTH"
+	SparkplugNDEATH = "NDEATH"
+	SparkplugDBIRTH = "DBIRTH"
+	SparkplugDDEATH = "DDEATH"
+	SparkplugNDATA  = "NDATA"
+	SparkplugDDATA  = "DDATA"
+)
+
+// ErrSinNacimiento indica métricas de NDATA/DDATA cuyo alias no fue declarado en un
+// NBIRTH o DBIRTH visto por el decodificador; el host debería pedir un rebirth
+var ErrSinNacimiento = errors.New("métrica sin NBIRTH/DBIRTH")
+
+// Tipos de datos de Sparkplug B
+const (
+	spInt8     = 1
+	spInt16    = 2
+	spInt32    = 3
+	spInt64    = 4
+	spUInt8    = 5
+	spUInt16   = 6
+	spUInt32   = 7
+	spUInt64   = 8
+	spFloat    = 9
+	spDouble   = 10
+	spBoolean  = 11
+	spString   = 12
+	spDateTime = 13
+	spText     = 14
+	spUUID     = 15
+)
+
+// Campos del Payload y de Payload.Metric (sparkplug_b.proto)
+const (
+	campoPayloadTimestamp protowire.Number = 1
+	campoPayloadMetrics   protowire.Number = 2
+
+	campoMetricName      protowire.Number = 1
+	campoMetricAlias     protowire.Number = 2
+	campoMetricTimestamp protowire.Number = 3
+	campoMetricDatatype  protowire.Number = 4
+	campoMetricIsNull    protowire.Number = 7
+	campoMetricInt       protowire.Number = 10
+	campoMetricLong      protowire.Number = 11
+	campoMetricFloat     protowire.Number = 12
+	campoMetricDouble    protowire.Number = 13
+	campoMetricBoolean   protowire.Number = 14
+	campoMetricString    protowire.Number = 15
+)
+
+// TopicoSparkplug son las partes de un tópico del espacio de nombres spBv1.0
+type TopicoSparkplug struct {
+	Grupo       string
+	Tipo        string // NBIRTH, NDATA, DBIRTH, DDATA, NDEATH, DDEATH, NCMD, DCMD
+	Nodo        string
+	Dispositivo string // vacío en los mensajes de nodo
+}
+
+// ParsearTopicoSparkplug separa un tópico spBv1.0; false si no pertenece al espacio de nombres
+func ParsearTopicoSparkplug(topico string) (TopicoSparkplug, bool) {
+	resto, ok := strings.CutPrefix(topico, PrefijoSparkplug)
+	if !ok {
+		return TopicoSparkplug{}, false
+	}
+	partes := strings.Split(resto, "/")
+	if len(partes) != 3 && len(partes) != 4 {
+		return TopicoSparkplug{}, false
+	}
+	for _, p := range partes {
+		if p == "" {
+			return TopicoSparkplug{}, false
+		}
+	}
+	t := TopicoSparkplug{Grupo: partes[0], Tipo: partes[1], Nodo: partes[2]}
+	if len(partes) == 4 {
+		t.Dispositivo = partes[3]
+	}
+	return t, true
+}
+
+// EsTopicoSparkplug indica si el tópico pertenece al espacio de nombres spBv1.0
+func EsTopicoSparkplug(topico string) bool {
+	return strings.HasPrefix(topico, PrefijoSparkplug)
+}
+
+// prefijoSerie retorna <grupo>/<nodo>[/<dispositivo>]
+func (t TopicoSparkplug) prefijoSerie() string {
+	prefijo := t.Grupo + "/" + t.Nodo
+	if t.Dispositivo != "" {
+		prefijo += "/" + t.Dispositivo
+	}
+	return prefijo
+}
+
+// nacimiento es lo que un BIRTH declara de una métrica
+type nacimiento struct {
+	nombre string
+	tipo   uint32
+}
+
+// nacimientosNodo guarda las métricas declaradas por un nodo y sus dispositivos.
+// Los alias son únicos dentro del nodo; los nombres, dentro de cada dispositivo.
+type nacimientosNodo struct {
+	porAlias  map[string]map[uint64]nacimiento // dispositivo ("" = nodo) -> alias
+	porNombre map[string]map[string]uint32     // dispositivo -> nombre -> tipo
+}
+
+// DecodificadorSparkplug decodifica payloads Sparkplug B recordando los nacimientos
+// de cada nodo. Es seguro para uso concurrente.
+type DecodificadorSparkplug struct {
+	mu    sync.Mutex
+	nodos map[string]*nacimientosNodo // <grupo>/<nodo>
+}
+
+// NuevoDecodificadorSparkplug crea un decodificador sin nacimientos registrados
+func NuevoDecodificadorSparkplug() *DecodificadorSparkplug {
+	return &DecodificadorSparkplug{nodos: make(map[string]*nacimientosNodo)}
+}
+
+// Decodificar procesa un mensaje Sparkplug B y retorna los registros de sus métricas.
+// NBIRTH reinicia los nacimientos del nodo y NDEATH los descarta; NCMD, DCMD, STATE y
+// las muertes no producen registros. Las métricas nulas o de tipos compuestos (DataSet,
+// Template, Bytes, File) se omiten. Si alguna métrica no puede resolverse retorna los
+// registros del resto junto con un error que envuelve ErrSinNacimiento.
+func (d *DecodificadorSparkplug) Decodificar(topico string, datos []byte) ([]Registro, error) {
+	t, ok := ParsearTopicoSparkplug(topico)
+	if !ok {
+		return nil, fmt.Errorf("tópico Sparkplug inválido: %s", topico)
+	}
+	clave := t.Grupo + "/" + t.Nodo
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch t.Tipo {
+	case SparkplugNDEATH:
+		delete(d.nodos, clave)
+		return nil, nil
+	case SparkplugNBIRTH:
+		d.nodos[clave] = nuevosNacimientos()
+	case SparkplugDBIRTH, SparkplugNDATA, SparkplugDDATA:
+	default:
+		return nil, nil
+	}
+
+	tiempoPayload, metricas, err := leerPayloadSparkplug(datos)
+	if err != nil {
+		return nil, fmt.Errorf("payload Sparkplug inválido en %s: %v", topico, err)
+	}
+	nodo := d.nodos[clave]
+	if nodo == nil && t.Tipo == SparkplugDBIRTH {
+		// DBIRTH sin NBIRTH previo (p.ej. el servidor reinició): se registra igual
+		nodo = nuevosNacimientos()
+		d.nodos[clave] = nodo
+	}
+	esNacimiento := t.Tipo == SparkplugNBIRTH || t.Tipo == SparkplugDBIRTH
+	if esNacimiento {
+		nodo.registrar(t.Dispositivo, metricas)
+	}
+
+	var registros []Registro
+	var sinNacimiento []string
+	for _, m := range metricas {
+		nombre, tipo := m.nombre, m.tipo
+		if !esNacimiento && nodo != nil {
+			nombre, tipo = nodo.resolver(t.Dispositivo, m)
+		}
+		if nombre == "" {
+			sinNacimiento = append(sinNacimiento, fmt.Sprintf("alias %d", m.alias))
+			continue
+		}
+		if m.nulo || !nombreSparkplugValido(nombre) {
+			continue
+		}
+		valor, ok := m.valorTipado(tipo)
+		if !ok {
+			continue
+		}
+		tiempo := m.tiempo
+		if !m.conTiempo {
+			tiempo = tiempoPayload
+		}
+		marca := ahora().UnixNano()
+		if tiempo > 0 {
+			marca = int64(tiempo) * 1e6
+		}
+		registros = append(registros, Registro{Serie: t.prefijoSerie() + "/" + nombre, Tiempo: marca, Valor: valor})
+	}
+	if len(sinNacimiento) > 0 {
+		return registros, fmt.Errorf("%w en %s: %s", ErrSinNacimiento, topico, strings.Join(sinNacimiento, ", "))
+	}
+	return registros, nil
+}
+
+func nuevosNacimientos() *nacimientosNodo {
+	return &nacimientosNodo{
+		porAlias:  make(map[string]map[uint64]nacimiento),
+		porNombre: make(map[string]map[string]uint32),
+	}
+}
+
+// registrar guarda alias, nombres y tipos de las métricas de un BIRTH
+func (n *nacimientosNodo) registrar(dispositivo string, metricas []metricaSparkplug) {
+	porAlias := make(map[uint64]nacimiento)
+	porNombre := make(map[string]uint32)
+	for _, m := range metricas {
+		if m.nombre == "" {
+			continue
+		}
+		if m.conAlias {
+			porAlias[m.alias] = nacimiento{nombre: m.nombre, tipo: m.tipo}
+		}
+		porNombre[m.nombre] = m.tipo
+	}
+	n.porAlias[dispositivo] = porAlias
+	n.porNombre[dispositivo] = porNombre
+}
+
+// resolver completa el nombre y el tipo de una métrica de NDATA/DDATA con los nacimientos.
+// Retorna nombre vacío si la métrica solo trae un alias desconocido.
+func (n *nacimientosNodo) resolver(dispositivo string, m metricaSparkplug) (string, uint32) {
+	nombre, tipo := m.nombre, m.tipo
+	if nombre == "" && m.conAlias {
+		if nac, ok := n.porAlias[dispositivo][m.alias]; ok {
+			nombre = nac.nombre
+			if tipo == 0 {
+				tipo = nac.tipo
+			}
+		}
+	}
+	if nombre != "" && tipo == 0 {
+		tipo = n.porNombre[dispositivo][nombre]
+	}
+	return nombre, tipo
+}
+
+// metricaSparkplug son los campos leídos de un Payload.Metric
+type metricaSparkplug struct {
+	nombre    string
+	alias     uint64
+	conAlias  bool
+	tiempo    uint64
+	conTiempo bool
+	tipo      uint32
+	nulo      bool
+
+	campoValor protowire.Number // campo oneof del valor presente (0 = ninguno)
+	entero     uint64           // int_value, long_value, float_value (bits), double_value (bits) o boolean_value
+	texto      string
+}
+
+func leerPayloadSparkplug(datos []byte) (uint64, []metricaSparkplug, error) {
+	var tiempo uint64
+	var metricas []metricaSparkplug
+	err := recorrerMensaje(datos, func(numero protowire.Number, entero uint64, crudo []byte) error {
+		switch numero {
+		case campoPayloadTimestamp:
+			tiempo = entero
+		case campoPayloadMetrics:
+			m, err := leerMetricaSparkplug(crudo)
+			if err != nil {
+				return err
+			}
+			metricas = append(metricas, m)
+		}
+		return nil
+	})
+	return tiempo, metricas, err
+}
+
+func leerMetricaSparkplug(datos []byte) (metricaSparkplug, error) {
+	var m metricaSparkplug
+	err := recorrerMensaje(datos, func(numero protowire.Number, entero uint64, crudo []byte) error {
+		switch numero {
+		case campoMetricName:
+			m.nombre = string(crudo)
+		case campoMetricAlias:
+			m.alias, m.conAlias = entero, true
+		case campoMetricTimestamp:
+			m.tiempo, m.conTiempo = entero, true
+		case campoMetricDatatype:
+			m.tipo = uint32(entero)
+		case campoMetricIsNull:
+			m.nulo = entero != 0
+		case campoMetricInt, campoMetricLong, campoMetricFloat, campoMetricDouble, campoMetricBoolean:
+			m.campoValor, m.entero = numero, entero
+		case campoMetricString:
+			m.campoValor, m.texto = numero, string(crudo)
+		}
+		return nil
+	})
+	return m, err
+}
+
+// valorTipado convierte el valor según el tipo Sparkplug (o, sin tipo, según el campo
+// presente). Los enteros con signo de 8 a 32 bits viajan en complemento a dos en int_value.
+func (m metricaSparkplug) valorTipado(tipo uint32) (interface{}, bool) {
+	if m.campoValor == 0 {
+		return nil, false
+	}
+	if tipo == 0 {
+		tipo = map[protowire.Number]uint32{
+			campoMetricInt: spInt32, campoMetricLong: spInt64, campoMetricFloat: spFloat,
+			campoMetricDouble: spDouble, campoMetricBoolean: spBoolean, campoMetricString: spString,
+		}[m.campoValor]
+	}
+	switch tipo {
+	case spInt8:
+		return int64(int8(m.entero)), true
+	case spInt16:
+		return int64(int16(m.entero)), true
+	case spInt32:
+		return int64(int32(m.entero)), true
+	case spUInt8, spUInt16, spUInt32:
+		return int64(uint32(m.entero)), true
+	case spInt64:
+		return int64(m.entero), true
+	case spUInt64, spDateTime:
+		if m.entero > math.MaxInt64 {
+			return nil, false
+		}
+		return int64(m.entero), true
+	case spFloat:
+		return float64(math.Float32frombits(uint32(m.entero))), true
+	case spDouble:
+		return math.Float64frombits(m.entero), true
+	case spBoolean:
+		return m.entero != 0, true
+	case spString, spText, spUUID:
+		return m.texto, true
+	}
+	return nil, false
+}
+
+// recorrerMensaje invoca campo por cada campo de un mensaje protobuf. Los valores
+// varint y fixed se entregan en entero (los fixed como bits) y los delimitados en crudo.
+func recorrerMensaje(datos []byte, campo func(numero protowire.Number, entero uint64, crudo []byte) error) error {
+	for len(datos) > 0 {
+		numero, tipo, n := protowire.ConsumeTag(datos)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		datos = datos[n:]
+		var entero uint64
+		var crudo []byte
+		switch tipo {
+		case protowire.VarintType:
+			entero, n = protowire.ConsumeVarint(datos)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(datos)
+			entero = uint64(v)
+		case protowire.Fixed64Type:
+			entero, n = protowire.ConsumeFixed64(datos)
+		case protowire.BytesType:
+			crudo, n = protowire.ConsumeBytes(datos)
+		default:
+			n = protowire.ConsumeFieldValue(numero, tipo, datos)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		datos = datos[n:]
+		if err := campo(numero, entero, crudo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nombreSparkplugValido descarta nombres que no sirven como ruta de serie ni tópico
+func nombreSparkplugValido(nombre string) bool {
+	if strings.ContainsAny(nombre, "+#") {
+		return false
+	}
+	for _, parte := range strings.Split(nombre, "/") {
+		if strings.TrimSpace(parte) == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package formatos
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// campoSP agrega un campo protobuf a una métrica en construcción
+type campoSP func([]byte) []byte
+
+func varintSP(numero protowire.Number, v uint64) campoSP {
+	return func(b []byte) []byte {
+		return protowire.AppendVarint(protowire.AppendTag(b, numero, protowire.VarintType), v)
+	}
+}
+
+func nombreSP(nombre string) campoSP {
+	return func(b []byte) []byte {
+		return protowire.AppendString(protowire.AppendTag(b, campoMetricName, protowire.BytesType), nombre)
+	}
+}
+
+func textoSP(texto string) campoSP {
+	return func(b []byte) []byte {
+		return protowire.AppendString(protowire.AppendTag(b, campoMetricString, protowire.BytesType), texto)
+	}
+}
+
+func floatSP(f float32) campoSP {
+	return func(b []byte) []byte {
+		return protowire.AppendFixed32(protowire.AppendTag(b, campoMetricFloat, protowire.Fixed32Type), math.Float32bits(f))
+	}
+}
+
+func doubleSP(f float64) campoSP {
+	return func(b []byte) []byte {
+		return protowire.AppendFixed64(protowire.AppendTag(b, campoMetricDouble, protowire.Fixed64Type), math.Float64bits(f))
+	}
+}
+
+// payloadSP arma un Payload con timestamp (en ms) y una métrica por lista de campos
+func payloadSP(tiempo uint64, metricas ...[]campoSP) []byte {
+	b := protowire.AppendVarint(protowire.AppendTag(nil, campoPayloadTimestamp, protowire.VarintType), tiempo)
+	for _, campos := range metricas {
+		var m []byte
+		for _, c := range campos {
+			m = c(m)
+		}
+		b = protowire.AppendBytes(protowire.AppendTag(b, campoPayloadMetrics, protowire.BytesType), m)
+	}
+	return b
+}
+
+func TestParsearTopicoSparkplug(t *testing.T) {
+	casos := map[string]struct {
+		esperado TopicoSparkplug
+		ok       bool
+	}{
+		"spBv1.0/planta/NBIRTH/borde1":         {TopicoSparkplug{Grupo: "planta", Tipo: "NBIRTH", Nodo: "borde1"}, true},
+		"spBv1.0/planta/DDATA/borde1/bomba":    {TopicoSparkplug{Grupo: "planta", Tipo: "DDATA", Nodo: "borde1", Dispositivo: "bomba"}, true},
+		"spBv1.0/planta/NDATA":                 {ok: false},
+		"spBv1.0/planta/DDATA/borde1/bomba/x":  {ok: false},
+		"spBv1.0/planta//borde1":               {ok: false},
+		"spAv1.0/planta/NDATA/borde1":          {ok: false},
+		"sensores/planta/NDATA/borde1/sensor1": {ok: false},
+	}
+	for topico, c := range casos {
+		obtenido, ok := ParsearTopicoSparkplug(topico)
+		if ok != c.ok || obtenido != c.esperado {
+			t.Errorf("ParsearTopicoSparkplug(%q) = %+v, %v; esperaba %+v, %v", topico, obtenido, ok, c.esperado, c.ok)
+		}
+	}
+}
+
+func TestSparkplug_NacimientoYDatosPorAlias(t *testing.T) {
+	d := NuevoDecodificadorSparkplug()
+	nacimiento := payloadSP(1700000000000,
+		[]campoSP{nombreSP("temp"), varintSP(campoMetricAlias, 1), varintSP(campoMetricDatatype, spFloat), floatSP(20.5)},
+		[]campoSP{nombreSP("nivel"), varintSP(campoMetricAlias, 2), varintSP(campoMetricDatatype, spInt8), varintSP(campoMetricInt, 0xFF)},
+		[]campoSP{nombreSP("motor/encendido"), varintSP(campoMetricAlias, 3), varintSP(campoMetricDatatype, spBoolean), varintSP(campoMetricBoolean, 0)},
+		[]campoSP{nombreSP("estado"), varintSP(campoMetricAlias, 4), varintSP(campoMetricDatatype, spString), textoSP("ok")},
+		[]campoSP{nombreSP("presion"), varintSP(campoMetricAlias, 5), varintSP(campoMetricDatatype, spDouble), varintSP(campoMetricIsNull, 1)},
+	)
+	registros, err := d.Decodificar("spBv1.0/planta/NBIRTH/borde1", nacimiento)
+	if err != nil {
+		t.Fatalf("NBIRTH error = %v", err)
+	}
+	tiempo := int64(1700000000000) * 1e6
+	esperados := []Registro{
+		{Serie: "planta/borde1/temp", Tiempo: tiempo, Valor: 20.5},
+		{Serie: "planta/borde1/nivel", Tiempo: tiempo, Valor: int64(-1)},
+		{Serie: "planta/borde1/motor/encendido", Tiempo: tiempo, Valor: false},
+		{Serie: "planta/borde1/estado", Tiempo: tiempo, Valor: "ok"},
+	}
+	if !reflect.DeepEqual(registros, esperados) {
+		t.Errorf("NBIRTH registros = %+v\nesperaba %+v", registros, esperados)
+	}
+
+	// NDATA solo con alias; la segunda métrica trae su propio timestamp
+	datos := payloadSP(1700000001000,
+		[]campoSP{varintSP(campoMetricAlias, 1), floatSP(21.25)},
+		[]campoSP{varintSP(campoMetricAlias, 5), varintSP(campoMetricTimestamp, 1700000000500), doubleSP(1.5)},
+	)
+	registros, err = d.Decodificar("spBv1.0/planta/NDATA/borde1", datos)
+	if err != nil {
+		t.Fatalf("NDATA error = %v", err)
+	}
+	esperados = []Registro{
+		{Serie: "planta/borde1/temp", Tiempo: int64(1700000001000) * 1e6, Valor: 21.25},
+		{Serie: "planta/borde1/presion", Tiempo: int64(1700000000500) * 1e6, Valor: 1.5},
+	}
+	if !reflect.DeepEqual(registros, esperados) {
+		t.Errorf("NDATA registros = %+v\nesperaba %+v", registros, esperados)
+	}
+}
+
+func TestSparkplug_Dispositivo(t *testing.T) {
+	d := NuevoDecodificadorSparkplug()
+	if _, err := d.Decodificar("spBv1.0/planta/NBIRTH/borde1", payloadSP(1)); err != nil {
+		t.Fatalf("NBIRTH error = %v", err)
+	}
+	nacimiento := payloadSP(1, []campoSP{nombreSP("rpm"), varintSP(campoMetricAlias, 7), varintSP(campoMetricDatatype, spInt32), varintSP(campoMetricInt, 1500)})
+	if _, err := d.Decodificar("spBv1.0/planta/DBIRTH/borde1/bomba", nacimiento); err != nil {
+		t.Fatalf("DBIRTH error = %v", err)
+	}
+	// El tipo Int32 del nacimiento interpreta int_value en complemento a dos
+	registros, err := d.Decodificar("spBv1.0/planta/DDATA/borde1/bomba", payloadSP(2, []campoSP{varintSP(campoMetricAlias, 7), varintSP(campoMetricInt, uint64(uint32(0xFFFFFFF6)))}))
+	if err != nil {
+		t.Fatalf("DDATA error = %v", err)
+	}
+	esperados := []Registro{{Serie: "planta/borde1/bomba/rpm", Tiempo: 2e6, Valor: int64(-10)}}
+	if !reflect.DeepEqual(registros, esperados) {
+		t.Errorf("DDATA registros = %+v, esperaba %+v", registros, esperados)
+	}
+}
+
+func TestSparkplug_AliasSinNacimiento(t *testing.T) {
+	fijarAhora(t, time.Unix(1700000000, 0))
+	d := NuevoDecodificadorSparkplug()
+	nacimiento := payloadSP(0, []campoSP{nombreSP("temp"), varintSP(campoMetricAlias, 1), varintSP(campoMetricDatatype, spDouble), doubleSP(1)})
+	if _, err := d.Decodificar("spBv1.0/planta/NBIRTH/borde1", nacimiento); err != nil {
+		t.Fatalf("NBIRTH error = %v", err)
+	}
+
+	// Sin timestamps se usa el momento de la decodificación
+	datos := payloadSP(0, []campoSP{varintSP(campoMetricAlias, 1), doubleSP(2)}, []campoSP{varintSP(campoMetricAlias, 9), doubleSP(3)})
+	registros, err := d.Decodificar("spBv1.0/planta/NDATA/borde1", datos)
+	if !errors.Is(err, ErrSinNacimiento) {
+		t.Errorf("error = %v, esperaba ErrSinNacimiento", err)
+	}
+	esperados := []Registro{{Serie: "planta/borde1/temp", Tiempo: time.Unix(1700000000, 0).UnixNano(), Valor: 2.0}}
+	if !reflect.DeepEqual(registros, esperados) {
+		t.Errorf("registros = %+v, esperaba %+v", registros, esperados)
+	}
+
+	// NDEATH descarta los nacimientos del nodo
+	if _, err := d.Decodificar("spBv1.0/planta/NDEATH/borde1", nil); err != nil {
+		t.Fatalf("NDEATH error = %v", err)
+	}
+	if _, err := d.Decodificar("spBv1.0/planta/NDATA/borde1", datos); !errors.Is(err, ErrSinNacimiento) {
+		t.Errorf("error tras NDEATH = %v, esperaba ErrSinNacimiento", err)
+	}
+}
+
+func TestSparkplug_Invalido(t *testing.T) {
+	d := NuevoDecodificadorSparkplug()
+	if _, err := d.Decodificar("spBv1.0/planta/NBIRTH", payloadSP(1)); err == nil {
+		t.Error("esperaba error con tópico incompleto")
+	}
+	if _, err := d.Decodificar("spBv1.0/planta/NBIRTH/borde1", []byte{0x12, 0x05, 0x0a}); err == nil {
+		t.Error("esperaba error con payload truncado")
+	}
+	if registros, err := d.Decodificar("spBv1.0/planta/NCMD/borde1", []byte{0xFF}); err != nil || registros != nil {
+		t.Errorf("NCMD = %+v, %v; esperaba ignorarlo", registros, err)
+	}
+}
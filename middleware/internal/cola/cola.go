@@ -0,0 +1,400 @@
+// Package cola implementa la cola local de publicaciones de los clientes HTTP y CoAP
+// (store-and-forward).
+//
+// Una publicación que no llega al servidor se encola y una goroutine la reenvía, en
+// orden y con backoff exponencial, hasta que el servidor la acepta. Con Archivo la
+// cola se persiste como un diario de líneas JSON: cada línea agrega un mensaje ("+")
+// o retira uno ya entregado o descartado ("-"). El diario se compacta reescribiéndolo
+// con los mensajes vigentes cuando acumula demasiados retiros.
+package cola
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/errores"
+)
+
+const (
+	// CapacidadDefecto es el máximo de mensajes encolados si la configuración no lo indica
+	CapacidadDefecto = 1000
+
+	// Backoff entre reintentos de reenvío mientras el servidor no es accesible
+	backoffInicial = 500 * time.Millisecond
+	backoffMaximo  = 30 * time.Second
+	backoffFactor  = 2
+
+	// retirosMinimosCompactacion evita reescribir el diario con cada entrega en colas pequeñas
+	retirosMinimosCompactacion = 64
+)
+
+// Envio entrega un mensaje al servidor. Los errores marcados con Permanente no se
+// reintentan; cualquier otro error se considera una falla de conectividad.
+type Envio func(middleware.Mensaje) error
+
+// errorPermanente marca un rechazo del servidor que no se resuelve reintentando
+type errorPermanente struct {
+	err error
+}
+
+func (e *errorPermanente) Error() string { return e.err.Error() }
+func (e *errorPermanente) Unwrap() error { return e.err }
+
+// Permanente marca err como un rechazo que no debe reintentarse. El error conserva
+// su categoría para errors.Is.
+func Permanente(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &errorPermanente{err: err}
+}
+
+// EsPermanente indica si err fue marcado con Permanente
+func EsPermanente(err error) bool {
+	var permanente *errorPermanente
+	return errors.As(err, &permanente)
+}
+
+// entrada es un mensaje encolado; la secuencia lo identifica en el diario
+type entrada struct {
+	Secuencia uint64             `json:"seq"`
+	Mensaje   middleware.Mensaje `json:"mensaje"`
+}
+
+// lineaDiario es una operación del diario persistido
+type lineaDiario struct {
+	Op        string              `json:"op"`
+	Secuencia uint64              `json:"seq"`
+	Mensaje   *middleware.Mensaje `json:"mensaje,omitempty"`
+}
+
+const (
+	opAgregar = "+"
+	opRetirar = "-"
+)
+
+// Cola es la cola local de publicaciones de un cliente
+type Cola struct {
+	capacidad int
+	politica  middleware.PoliticaDescarte
+	ruta      string
+	enviar    Envio
+	// notificar recibe los mensajes descartados por un rechazo del servidor
+	notificar func(error)
+
+	mu        sync.Mutex
+	entradas  []entrada
+	secuencia uint64
+	diario    *os.File
+	retiros   int // líneas de retiro en el diario desde la última compactación
+
+	descartados atomic.Int64
+	aviso       chan struct{} // se señala al encolar en una cola vacía
+	fin         chan struct{}
+	terminado   chan struct{}
+	cerrar      sync.Once
+}
+
+// Nueva crea la cola y lanza la goroutine de reenvío. Con config.Archivo recupera los
+// mensajes que quedaron pendientes en una ejecución anterior.
+func Nueva(config middleware.ColaLocal, enviar Envio, notificar func(error)) (*Cola, error) {
+	if config.Capacidad < 0 {
+		return nil, fmt.Errorf("capacidad de la cola local inválida: %d", config.Capacidad)
+	}
+	switch config.Politica {
+	case "", middleware.DescartarAntiguos, middleware.DescartarNuevos:
+	default:
+		return nil, fmt.Errorf("política de descarte desconocida: %q", config.Politica)
+	}
+	c := &Cola{
+		capacidad: config.Capacidad,
+		politica:  config.Politica,
+		ruta:      config.Archivo,
+		enviar:    enviar,
+		notificar: notificar,
+		aviso:     make(chan struct{}, 1),
+		fin:       make(chan struct{}),
+		terminado: make(chan struct{}),
+	}
+	if c.capacidad == 0 {
+		c.capacidad = CapacidadDefecto
+	}
+	if c.politica == "" {
+		c.politica = middleware.DescartarAntiguos
+	}
+	if c.ruta != "" {
+		if err := c.cargar(); err != nil {
+			return nil, fmt.Errorf("cola local %s: %v", c.ruta, err)
+		}
+	}
+	go c.reenviar(len(c.entradas) > 0)
+	return c, nil
+}
+
+// Publicar envía el mensaje directamente si la cola está vacía. Si el envío falla por
+// conectividad, o si hay mensajes esperando, lo encola y retorna nil. Los rechazos
+// permanentes del servidor se devuelven sin encolar.
+func (c *Cola) Publicar(m middleware.Mensaje) error {
+	if c.Pendientes() == 0 {
+		err := c.enviar(m)
+		if err == nil || EsPermanente(err) {
+			return err
+		}
+	}
+	return c.encolar(m)
+}
+
+// Pendientes devuelve la cantidad de mensajes encolados
+func (c *Cola) Pendientes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entradas)
+}
+
+// Descartados devuelve la cantidad de mensajes perdidos por la política de descarte o
+// rechazados por el servidor durante el reenvío
+func (c *Cola) Descartados() int64 {
+	return c.descartados.Load()
+}
+
+// Cerrar detiene el reenvío, esperando al envío en curso, y cierra el diario. Los
+// mensajes pendientes de una cola persistida se reenvían al abrirla de nuevo.
+func (c *Cola) Cerrar() error {
+	var err error
+	c.cerrar.Do(func() {
+		close(c.fin)
+		<-c.terminado
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.diario != nil {
+			err = c.diario.Close()
+			c.diario = nil
+		}
+	})
+	return err
+}
+
+// encolar agrega el mensaje al final aplicando la política de descarte
+func (c *Cola) encolar(m middleware.Mensaje) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.fin:
+		return fmt.Errorf("%w: %s: cola local cerrada", errores.ErrPublicacion, m.Topico)
+	default:
+	}
+	if len(c.entradas) >= c.capacidad {
+		if c.politica == middleware.DescartarNuevos {
+			c.descartados.Add(1)
+			return fmt.Errorf("%w: %s: cola local llena (%d mensajes)", errores.ErrPublicacion, m.Topico, c.capacidad)
+		}
+		descartada := c.entradas[0]
+		if err := c.escribir(lineaDiario{Op: opRetirar, Secuencia: descartada.Secuencia}); err != nil {
+			return fmt.Errorf("%w: %s: %v", errores.ErrPublicacion, m.Topico, err)
+		}
+		c.entradas = c.entradas[1:]
+		c.retiros++
+		c.descartados.Add(1)
+	}
+	c.secuencia++
+	e := entrada{Secuencia: c.secuencia, Mensaje: m}
+	if err := c.escribir(lineaDiario{Op: opAgregar, Secuencia: e.Secuencia, Mensaje: &e.Mensaje}); err != nil {
+		return fmt.Errorf("%w: %s: %v", errores.ErrPublicacion, m.Topico, err)
+	}
+	c.entradas = append(c.entradas, e)
+	if len(c.entradas) == 1 {
+		select {
+		case c.aviso <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// reenviar entrega los mensajes encolados en orden. Al despertar por un mensaje recién
+// encolado espera primero el backoff, ya que se encoló por una falla de envío.
+func (c *Cola) reenviar(inmediato bool) {
+	defer close(c.terminado)
+	espera := backoffInicial
+	for {
+		c.mu.Lock()
+		var primera entrada
+		hay := len(c.entradas) > 0
+		if hay {
+			primera = c.entradas[0]
+		}
+		c.mu.Unlock()
+
+		if !hay {
+			select {
+			case <-c.aviso:
+				inmediato = false
+				continue
+			case <-c.fin:
+				return
+			}
+		}
+		if !inmediato && !c.esperar(espera) {
+			return
+		}
+		inmediato = false
+
+		err := c.enviar(primera.Mensaje)
+		if err != nil && !EsPermanente(err) {
+			espera = min(espera*backoffFactor, backoffMaximo)
+			continue
+		}
+		if err != nil {
+			c.descartados.Add(1)
+			if c.notificar != nil {
+				c.notificar(fmt.Errorf("mensaje de %s descartado de la cola local: %w", primera.Mensaje.Topico, err))
+			}
+		}
+		c.retirar(primera.Secuencia)
+		// Tras una entrega el siguiente mensaje sale sin esperar
+		espera = backoffInicial
+		inmediato = true
+	}
+}
+
+// esperar duerme d interrumpible por Cerrar. Retorna false si la cola se cerró.
+func (c *Cola) esperar(d time.Duration) bool {
+	select {
+	case <-c.fin:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// retirar quita la entrada entregada; pudo haberse descartado mientras se enviaba
+func (c *Cola) retirar(secuencia uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entradas) == 0 || c.entradas[0].Secuencia != secuencia {
+		return
+	}
+	c.entradas = c.entradas[1:]
+	if err := c.escribir(lineaDiario{Op: opRetirar, Secuencia: secuencia}); err != nil && c.notificar != nil {
+		c.notificar(fmt.Errorf("cola local %s: %v", c.ruta, err))
+	}
+	c.retiros++
+	if c.diario != nil && c.retiros >= max(retirosMinimosCompactacion, len(c.entradas)) {
+		if err := c.compactar(); err != nil && c.notificar != nil {
+			c.notificar(fmt.Errorf("cola local %s: %v", c.ruta, err))
+		}
+	}
+}
+
+// escribir agrega una línea al diario (sin diario no hace nada). Debe llamarse con mu.
+func (c *Cola) escribir(linea lineaDiario) error {
+	if c.diario == nil {
+		return nil
+	}
+	datos, err := json.Marshal(linea)
+	if err != nil {
+		return err
+	}
+	if _, err := c.diario.Write(append(datos, '\n')); err != nil {
+		return err
+	}
+	return c.diario.Sync()
+}
+
+// cargar reconstruye la cola desde el diario y lo compacta. Una última línea truncada
+// (el proceso terminó durante una escritura) se ignora.
+func (c *Cola) cargar() error {
+	archivo, err := os.Open(c.ruta)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		lector := bufio.NewScanner(archivo)
+		lector.Buffer(nil, 1<<30)
+		for lector.Scan() {
+			var linea lineaDiario
+			if json.Unmarshal(lector.Bytes(), &linea) != nil {
+				continue
+			}
+			c.secuencia = max(c.secuencia, linea.Secuencia)
+			switch {
+			case linea.Op == opAgregar && linea.Mensaje != nil:
+				c.entradas = append(c.entradas, entrada{Secuencia: linea.Secuencia, Mensaje: *linea.Mensaje})
+			case linea.Op == opRetirar:
+				for i, e := range c.entradas {
+					if e.Secuencia == linea.Secuencia {
+						c.entradas = append(c.entradas[:i], c.entradas[i+1:]...)
+						break
+					}
+				}
+			}
+		}
+		err := lector.Err()
+		archivo.Close()
+		if err != nil {
+			return err
+		}
+	}
+	// Una capacidad menor que la de la ejecución anterior descarta los más antiguos
+	if exceso := len(c.entradas) - c.capacidad; exceso > 0 {
+		c.entradas = c.entradas[exceso:]
+		c.descartados.Add(int64(exceso))
+	}
+	return c.compactar()
+}
+
+// compactar reescribe el diario con las entradas vigentes y lo reabre para agregar.
+// Si la reescritura falla se sigue agregando al diario anterior, que sigue siendo
+// válido. Debe llamarse con mu (o antes de lanzar la goroutine de reenvío).
+func (c *Cola) compactar() error {
+	temporal, err := os.CreateTemp(filepath.Dir(c.ruta), "."+filepath.Base(c.ruta)+"-*")
+	if err != nil {
+		return err
+	}
+	escritor := bufio.NewWriter(temporal)
+	codificador := json.NewEncoder(escritor)
+	for i := range c.entradas {
+		e := &c.entradas[i]
+		if err = codificador.Encode(lineaDiario{Op: opAgregar, Secuencia: e.Secuencia, Mensaje: &e.Mensaje}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = escritor.Flush()
+	}
+	if err == nil {
+		err = temporal.Sync()
+	}
+	if cerrarErr := temporal.Close(); err == nil {
+		err = cerrarErr
+	}
+	if err != nil {
+		os.Remove(temporal.Name())
+		return err
+	}
+	if c.diario != nil {
+		c.diario.Close()
+		c.diario = nil
+	}
+	if err := os.Rename(temporal.Name(), c.ruta); err != nil {
+		os.Remove(temporal.Name())
+		if c.diario, _ = os.OpenFile(c.ruta, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600); c.diario == nil {
+			return fmt.Errorf("%v; el diario queda desactivado", err)
+		}
+		return err
+	}
+	c.diario, err = os.OpenFile(c.ruta, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("%v; el diario queda desactivado", err)
+	}
+	c.retiros = 0
+	return nil
+}
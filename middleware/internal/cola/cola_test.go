@@ -0,0 +1,239 @@
+package cola
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/errores"
+)
+
+var errRed = errors.New("servidor inaccesible")
+
+// servidorFalso registra los mensajes aceptados y falla mientras está caído
+type servidorFalso struct {
+	mu        sync.Mutex
+	caido     bool
+	rechazar  string // tópico que el servidor rechaza siempre
+	recibidos []string
+}
+
+func (s *servidorFalso) enviar(m middleware.Mensaje) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.Topico == s.rechazar {
+		return Permanente(errores.ErrPublicacion)
+	}
+	if s.caido {
+		return errRed
+	}
+	s.recibidos = append(s.recibidos, string(m.Payload))
+	return nil
+}
+
+func (s *servidorFalso) fijarCaido(caido bool) {
+	s.mu.Lock()
+	s.caido = caido
+	s.mu.Unlock()
+}
+
+func (s *servidorFalso) entregados() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.recibidos...)
+}
+
+func nuevaColaTest(t *testing.T, config middleware.ColaLocal, s *servidorFalso, notificar func(error)) *Cola {
+	t.Helper()
+	c, err := Nueva(config, s.enviar, notificar)
+	if err != nil {
+		t.Fatalf("Nueva error = %v", err)
+	}
+	t.Cleanup(func() { c.Cerrar() })
+	return c
+}
+
+func mensajeTest(payload string) middleware.Mensaje {
+	return middleware.Mensaje{Original: true, Topico: "sensores/temp", Payload: []byte(payload)}
+}
+
+// esperarEntregados espera a que la cola se vacíe y compara lo recibido, en orden
+func esperarEntregados(t *testing.T, c *Cola, s *servidorFalso, esperados ...string) {
+	t.Helper()
+	limite := time.Now().Add(5 * time.Second)
+	for c.Pendientes() > 0 {
+		if time.Now().After(limite) {
+			t.Fatalf("quedan %d mensajes en la cola", c.Pendientes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if obtenidos := s.entregados(); !reflect.DeepEqual(obtenidos, esperados) {
+		t.Errorf("entregados = %v, esperaba %v", obtenidos, esperados)
+	}
+}
+
+func TestCola_EncolaYReenviaEnOrden(t *testing.T) {
+	s := &servidorFalso{}
+	c := nuevaColaTest(t, middleware.ColaLocal{}, s, nil)
+
+	if err := c.Publicar(mensajeTest("1")); err != nil {
+		t.Fatalf("Publicar con el servidor accesible: %v", err)
+	}
+	s.fijarCaido(true)
+	for _, p := range []string{"2", "3", "4"} {
+		if err := c.Publicar(mensajeTest(p)); err != nil {
+			t.Fatalf("Publicar %s con el servidor caído: %v", p, err)
+		}
+	}
+	if n := c.Pendientes(); n != 3 {
+		t.Errorf("Pendientes() = %d, esperaba 3", n)
+	}
+	s.fijarCaido(false)
+	// Con mensajes esperando, uno nuevo se encola detrás aunque el servidor responda
+	if err := c.Publicar(mensajeTest("5")); err != nil {
+		t.Fatalf("Publicar: %v", err)
+	}
+	esperarEntregados(t, c, s, "1", "2", "3", "4", "5")
+}
+
+func TestCola_RechazoPermanente(t *testing.T) {
+	s := &servidorFalso{rechazar: "prohibido"}
+	notificados := make(chan error, 1)
+	c := nuevaColaTest(t, middleware.ColaLocal{}, s, func(err error) { notificados <- err })
+
+	// Con la cola vacía el rechazo se devuelve al llamador sin encolar
+	err := c.Publicar(middleware.Mensaje{Topico: "prohibido"})
+	if !errors.Is(err, errores.ErrPublicacion) || c.Pendientes() != 0 {
+		t.Fatalf("Publicar rechazado = %v con %d pendientes", err, c.Pendientes())
+	}
+
+	// Durante el reenvío el rechazo descarta el mensaje y sigue con el resto
+	s.fijarCaido(true)
+	c.Publicar(mensajeTest("1"))
+	c.Publicar(middleware.Mensaje{Topico: "prohibido"})
+	c.Publicar(mensajeTest("2"))
+	s.fijarCaido(false)
+	esperarEntregados(t, c, s, "1", "2")
+	select {
+	case err := <-notificados:
+		if !strings.Contains(err.Error(), "prohibido") {
+			t.Errorf("notificación = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("no se notificó el mensaje descartado")
+	}
+	if n := c.Descartados(); n != 1 {
+		t.Errorf("Descartados() = %d, esperaba 1", n)
+	}
+}
+
+func TestCola_PoliticasDeDescarte(t *testing.T) {
+	s := &servidorFalso{caido: true}
+	antiguos := nuevaColaTest(t, middleware.ColaLocal{Capacidad: 2}, s, nil)
+	for _, p := range []string{"1", "2", "3"} {
+		if err := antiguos.Publicar(mensajeTest(p)); err != nil {
+			t.Fatalf("Publicar %s: %v", p, err)
+		}
+	}
+	if antiguos.Pendientes() != 2 || antiguos.Descartados() != 1 {
+		t.Errorf("DescartarAntiguos: %d pendientes, %d descartados", antiguos.Pendientes(), antiguos.Descartados())
+	}
+
+	s2 := &servidorFalso{caido: true}
+	nuevos := nuevaColaTest(t, middleware.ColaLocal{Capacidad: 2, Politica: middleware.DescartarNuevos}, s2, nil)
+	nuevos.Publicar(mensajeTest("1"))
+	nuevos.Publicar(mensajeTest("2"))
+	if err := nuevos.Publicar(mensajeTest("3")); !errors.Is(err, errores.ErrPublicacion) {
+		t.Errorf("DescartarNuevos con la cola llena = %v, esperaba ErrPublicacion", err)
+	}
+
+	s.fijarCaido(false)
+	s2.fijarCaido(false)
+	esperarEntregados(t, antiguos, s, "2", "3")
+	esperarEntregados(t, nuevos, s2, "1", "2")
+
+	if _, err := Nueva(middleware.ColaLocal{Politica: "ninguna"}, s.enviar, nil); err == nil {
+		t.Error("esperaba error con una política desconocida")
+	}
+}
+
+func TestCola_PersistenciaEnArchivo(t *testing.T) {
+	archivo := filepath.Join(t.TempDir(), "cola.jsonl")
+	s := &servidorFalso{caido: true}
+	c, err := Nueva(middleware.ColaLocal{Archivo: archivo}, s.enviar, nil)
+	if err != nil {
+		t.Fatalf("Nueva error = %v", err)
+	}
+	for _, p := range []string{"1", "2", "3"} {
+		c.Publicar(mensajeTest(p))
+	}
+	if err := c.Cerrar(); err != nil {
+		t.Fatalf("Cerrar error = %v", err)
+	}
+
+	// Una línea truncada al final (corte durante una escritura) se ignora
+	diario, err := os.OpenFile(archivo, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diario.WriteString(`{"op":"+","seq":9,"mens`)
+	diario.Close()
+
+	// Al reabrir con el servidor accesible se reenvían los mensajes pendientes
+	s.fijarCaido(false)
+	reabierta := nuevaColaTest(t, middleware.ColaLocal{Archivo: archivo}, s, nil)
+	esperarEntregados(t, reabierta, s, "1", "2", "3")
+	reabierta.Publicar(mensajeTest("4"))
+
+	s.fijarCaido(true)
+	reabierta.Publicar(mensajeTest("5"))
+	reabierta.Cerrar()
+	s = &servidorFalso{}
+	// La tercera apertura solo encuentra el mensaje no entregado
+	ultima := nuevaColaTest(t, middleware.ColaLocal{Archivo: archivo, Capacidad: 1}, s, nil)
+	esperarEntregados(t, ultima, s, "5")
+}
+
+// Si la compactación no puede reescribir el diario se sigue agregando al anterior
+func TestCola_CompactacionFallidaConservaDiario(t *testing.T) {
+	directorio := filepath.Join(t.TempDir(), "datos")
+	if err := os.Mkdir(directorio, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	archivo := filepath.Join(directorio, "cola.jsonl")
+	s := &servidorFalso{caido: true}
+	c, err := Nueva(middleware.ColaLocal{Archivo: archivo}, s.enviar, nil)
+	if err != nil {
+		t.Fatalf("Nueva error = %v", err)
+	}
+	c.Publicar(mensajeTest("1"))
+
+	// Sin el directorio no puede crearse el temporal; el diario abierto sigue siendo válido
+	movido := directorio + "-movido"
+	if err := os.Rename(directorio, movido); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	err = c.compactar()
+	c.mu.Unlock()
+	if err == nil {
+		t.Fatal("compactar sin directorio no devolvió error")
+	}
+	if err := os.Rename(movido, directorio); err != nil {
+		t.Fatal(err)
+	}
+	c.Publicar(mensajeTest("2"))
+	if err := c.Cerrar(); err != nil {
+		t.Fatalf("Cerrar error = %v", err)
+	}
+
+	s.fijarCaido(false)
+	reabierta := nuevaColaTest(t, middleware.ColaLocal{Archivo: archivo}, s, nil)
+	esperarEntregados(t, reabierta, s, "1", "2")
+}
@@ -1,17 +1,21 @@
 // Package errores define los errores categorizados del middleware.
 //
 // Los errores sentinelas (ErrConexion, ErrPublicacion, ErrACK, ErrSuscripcion,
-// ErrDesuscripcion) permiten clasificar fallos mediante errors.Is, mientras que
-// ErrorACK transporta datos (MensajeID) accesibles mediante errors.As.
+// ErrDesuscripcion, ErrSolicitud, ErrValidacion) permiten clasificar fallos mediante
+// errors.Is, mientras que ErrorACK y ErrorValidacion transportan datos (MensajeID; tópico
+// y motivo del rechazo) accesibles mediante errors.As.
 //
 // Uso:
 //
 //	if errors.Is(err, errores.ErrPublicacion) { ... }
 //	var ackErr *errores.ErrorACK
 //	if errors.As(err, &ackErr) { id := ackErr.MensajeID }
+//	var valErr *errores.ErrorValidacion
+//	if errors.As(err, &valErr) && valErr.Motivo == errores.MotivoEsquema { ... }
 package errores
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 )
@@ -23,6 +27,8 @@ var (
 	ErrACK           = errors.New("error de ACK")
 	ErrSuscripcion   = errors.New("error de suscripción")
 	ErrDesuscripcion = errors.New("error de desuscripción")
+	ErrSolicitud     = errors.New("error de solicitud")
+	ErrValidacion    = errors.New("error de validación")
 )
 
 // ErrorACK representa el agotamiento de reintentos esperando el ACK de un
@@ -42,6 +48,43 @@ func (e *ErrorACK) Unwrap() error {
 	return ErrACK
 }
 
+// Motivos de rechazo de ErrorValidacion
+const (
+	MotivoEsquema       = "esquema"        // el payload no cumple el esquema del tópico
+	MotivoTipoContenido = "tipo_contenido" // el payload no es del tipo de contenido del tópico
+	MotivoPublicante    = "publicante"     // el cliente no es un publicante permitido del tópico
+)
+
+// ErrorValidacion representa el rechazo de una publicación por el registro de tópicos
+// del servidor. Se categoriza como ErrValidacion y como ErrPublicacion vía Unwrap. El
+// servidor lo envía como cuerpo JSON de la respuesta de rechazo (HTTP y CoAP).
+type ErrorValidacion struct {
+	Topico  string `json:"topico"`
+	Motivo  string `json:"motivo"`
+	Detalle string `json:"detalle"`
+}
+
+// Error devuelve la descripción del rechazo.
+func (e *ErrorValidacion) Error() string {
+	return fmt.Sprintf("publicación en %s rechazada (%s): %s", e.Topico, e.Motivo, e.Detalle)
+}
+
+// Unwrap permite que errors.Is(err, ErrValidacion) y errors.Is(err, ErrPublicacion)
+// sean verdaderos.
+func (e *ErrorValidacion) Unwrap() []error {
+	return []error{ErrValidacion, ErrPublicacion}
+}
+
+// LeerErrorValidacion reconstruye el ErrorValidacion del cuerpo de una respuesta de
+// rechazo; retorna false si el cuerpo no es un rechazo de validación.
+func LeerErrorValidacion(cuerpo []byte) (*ErrorValidacion, bool) {
+	var e ErrorValidacion
+	if json.Unmarshal(cuerpo, &e) != nil || e.Motivo == "" {
+		return nil, false
+	}
+	return &e, true
+}
+
 // Es es un helper sobre errors.Is para comparar un error contra un target.
 func Es(err, target error) bool {
 	return errors.Is(err, target)
@@ -7,7 +7,7 @@ import (
 )
 
 func TestSentinelas_NoNil(t *testing.T) {
-	sentinels := []error{ErrConexion, ErrPublicacion, ErrACK, ErrSuscripcion, ErrDesuscripcion}
+	sentinels := []error{ErrConexion, ErrPublicacion, ErrACK, ErrSuscripcion, ErrDesuscripcion, ErrSolicitud, ErrValidacion}
 	for _, s := range sentinels {
 		if s == nil {
 			t.Error("sentinela nil")
@@ -61,3 +61,21 @@ func TestErrorACK_NoEsOtrasCategorias(t *testing.T) {
 		t.Error("ErrorACK no debería ser ErrConexion")
 	}
 }
+
+func TestErrorValidacion_CategoriasYCuerpo(t *testing.T) {
+	cuerpo := []byte(`{"topico":"a/b","motivo":"esquema","detalle":"$.t: se esperaba number"}`)
+	e, ok := LeerErrorValidacion(cuerpo)
+	if !ok || e.Topico != "a/b" || e.Motivo != MotivoEsquema {
+		t.Fatalf("LeerErrorValidacion = %+v, %v", e, ok)
+	}
+	err := fmt.Errorf("envuelto: %w", e)
+	if !Es(err, ErrValidacion) || !Es(err, ErrPublicacion) {
+		t.Error("ErrorValidacion debería ser ErrValidacion y ErrPublicacion")
+	}
+	if Es(err, ErrACK) {
+		t.Error("ErrorValidacion no debería ser ErrACK")
+	}
+	if _, ok := LeerErrorValidacion([]byte("Topico invalido")); ok {
+		t.Error("un cuerpo de texto no es un rechazo de validación")
+	}
+}
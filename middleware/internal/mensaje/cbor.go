@@ -0,0 +1,596 @@
+package mensaje
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+)
+
+// Codificación CBOR (RFC 8949) del Mensaje para dispositivos restringidos.
+//
+// El mensaje es un mapa CBOR con claves enteras, que ocupan un byte, en lugar de los
+// nombres de campo del JSON; el payload viaja como byte string sin base64. Los campos
+// con valor cero se omiten y las claves desconocidas se ignoran al decodificar:
+//
+//	1 topico     text string
+//	2 payload    byte string
+//	3 qos        entero sin signo
+//	4 mensajeId  text string
+//	5 original   bool
+//	6 interno    bool
+//	7 origen     text string
+//	8 retenido   bool
+//	9 referencia text string
+//	10 topicoRespuesta text string
+//	11 correlacion     text string
+//	12 error           text string
+//	13 saltos          arreglo de text strings
+//	14 expiracion      entero sin signo (milisegundos Unix)
+//	15 claveOrden      text string
+//
+// El tipo de contenido se indica con TipoCBOR en HTTP, Content-Format 60 en CoAP y
+// ContentType en MQTT 5; sin indicación se detecta por el primer byte (un mapa CBOR
+// empieza entre 0xA0 y 0xBF, un objeto JSON con '{').
+
+const (
+	TipoJSON = "application/json"
+	TipoCBOR = "application/cbor"
+)
+
+const (
+	claveTopico = iota + 1
+	clavePayload
+	claveQoS
+	claveMensajeID
+	claveOriginal
+	claveInterno
+	claveOrigen
+	claveRetenido
+	claveReferencia
+	claveTopicoRespuesta
+	claveCorrelacion
+	claveError
+	claveSaltos
+	claveExpiracion
+	claveClaveOrden
+)
+
+// Tipos mayores de CBOR
+const (
+	cborEntero     = 0
+	cborNegativo   = 1
+	cborBytes      = 2
+	cborTexto      = 3
+	cborArreglo    = 4
+	cborMapa       = 5
+	cborEtiqueta   = 6
+	cborSimple     = 7
+	cborIndefinido = 31
+)
+
+var errCBORInvalido = errors.New("cbor inválido")
+
+// Codificar serializa m en la codificación indicada ("" = JSON)
+func Codificar(m middleware.Mensaje, c middleware.Codificacion) ([]byte, error) {
+	switch c {
+	case middleware.CodificacionCBOR:
+		return CodificarCBOR(m), nil
+	case "", middleware.CodificacionJSON:
+		return json.Marshal(m)
+	default:
+		return nil, fmt.Errorf("codificación no soportada: %q", c)
+	}
+}
+
+// Decodificar interpreta datos en la codificación indicada; con "" la detecta por el primer byte
+func Decodificar(datos []byte, c middleware.Codificacion) (middleware.Mensaje, error) {
+	if c == "" {
+		c = DetectarCodificacion(datos)
+	}
+	switch c {
+	case middleware.CodificacionCBOR:
+		return DecodificarCBOR(datos)
+	case middleware.CodificacionJSON:
+		var m middleware.Mensaje
+		err := json.Unmarshal(datos, &m)
+		return m, err
+	default:
+		return middleware.Mensaje{}, fmt.Errorf("codificación no soportada: %q", c)
+	}
+}
+
+// DetectarCodificacion distingue un mapa CBOR de un objeto JSON por su primer byte
+func DetectarCodificacion(datos []byte) middleware.Codificacion {
+	if len(datos) > 0 && datos[0]>>5 == cborMapa {
+		return middleware.CodificacionCBOR
+	}
+	return middleware.CodificacionJSON
+}
+
+// TipoContenido retorna el tipo MIME de una codificación
+func TipoContenido(c middleware.Codificacion) string {
+	if c == middleware.CodificacionCBOR {
+		return TipoCBOR
+	}
+	return TipoJSON
+}
+
+// CodificacionDeTipo retorna la codificación de un tipo MIME ("" si no es JSON ni CBOR)
+func CodificacionDeTipo(tipo string) middleware.Codificacion {
+	switch tipo {
+	case TipoCBOR:
+		return middleware.CodificacionCBOR
+	case TipoJSON:
+		return middleware.CodificacionJSON
+	}
+	return ""
+}
+
+// CodificarCBOR serializa m como mapa CBOR con claves enteras
+func CodificarCBOR(m middleware.Mensaje) []byte {
+	type campo struct {
+		clave int
+		valor func(buf []byte) []byte
+	}
+	var campos []campo
+	texto := func(clave int, v string) {
+		if v != "" {
+			campos = append(campos, campo{clave, func(buf []byte) []byte { return agregarCadena(buf, cborTexto, []byte(v)) }})
+		}
+	}
+	booleano := func(clave int, v bool) {
+		if v {
+			campos = append(campos, campo{clave, func(buf []byte) []byte { return append(buf, 0xF5) }})
+		}
+	}
+	texto(claveTopico, m.Topico)
+	if len(m.Payload) > 0 {
+		campos = append(campos, campo{clavePayload, func(buf []byte) []byte { return agregarCadena(buf, cborBytes, m.Payload) }})
+	}
+	if m.QoS > 0 {
+		campos = append(campos, campo{claveQoS, func(buf []byte) []byte { return agregarCabecera(buf, cborEntero, uint64(m.QoS)) }})
+	}
+	texto(claveMensajeID, m.MensajeID)
+	booleano(claveOriginal, m.Original)
+	booleano(claveInterno, m.Interno)
+	texto(claveOrigen, m.Origen)
+	booleano(claveRetenido, m.Retenido)
+	texto(claveReferencia, m.Referencia)
+	texto(claveTopicoRespuesta, m.TopicoRespuesta)
+	texto(claveCorrelacion, m.Correlacion)
+	texto(claveError, m.Error)
+	if len(m.Saltos) > 0 {
+		campos = append(campos, campo{claveSaltos, func(buf []byte) []byte {
+			buf = agregarCabecera(buf, cborArreglo, uint64(len(m.Saltos)))
+			for _, salto := range m.Saltos {
+				buf = agregarCadena(buf, cborTexto, []byte(salto))
+			}
+			return buf
+		}})
+	}
+	if m.Expiracion > 0 {
+		campos = append(campos, campo{claveExpiracion, func(buf []byte) []byte { return agregarCabecera(buf, cborEntero, uint64(m.Expiracion)) }})
+	}
+	texto(claveClaveOrden, m.ClaveOrden)
+
+	buf := make([]byte, 0, len(m.Payload)+len(m.Topico)+64)
+	buf = agregarCabecera(buf, cborMapa, uint64(len(campos)))
+	for _, c := range campos {
+		buf = agregarCabecera(buf, cborEntero, uint64(c.clave))
+		buf = c.valor(buf)
+	}
+	return buf
+}
+
+// DecodificarCBOR interpreta un mapa CBOR generado por CodificarCBOR o por otro
+// codificador que respete la tabla de claves. Admite mapas y cadenas de largo indefinido.
+func DecodificarCBOR(datos []byte) (middleware.Mensaje, error) {
+	var m middleware.Mensaje
+	l := &lectorCBOR{datos: datos}
+	mayor, info, cantidad, err := l.cabecera()
+	if err != nil {
+		return m, err
+	}
+	if mayor != cborMapa {
+		return m, fmt.Errorf("%w: se esperaba un mapa", errCBORInvalido)
+	}
+	for i := uint64(0); info == cborIndefinido || i < cantidad; i++ {
+		if info == cborIndefinido && l.quedaFin() {
+			break
+		}
+		clave, err := l.entero()
+		if err != nil {
+			return m, err
+		}
+		switch clave {
+		case claveTopico:
+			m.Topico, err = l.texto()
+		case clavePayload:
+			m.Payload, err = l.cadena(cborBytes)
+		case claveQoS:
+			var qos uint64
+			qos, err = l.entero()
+			if err == nil && qos > 1<<16 {
+				err = fmt.Errorf("%w: qos fuera de rango", errCBORInvalido)
+			}
+			m.QoS = int(qos)
+		case claveMensajeID:
+			m.MensajeID, err = l.texto()
+		case claveOriginal:
+			m.Original, err = l.booleano()
+		case claveInterno:
+			m.Interno, err = l.booleano()
+		case claveOrigen:
+			m.Origen, err = l.texto()
+		case claveRetenido:
+			m.Retenido, err = l.booleano()
+		case claveReferencia:
+			m.Referencia, err = l.texto()
+		case claveTopicoRespuesta:
+			m.TopicoRespuesta, err = l.texto()
+		case claveCorrelacion:
+			m.Correlacion, err = l.texto()
+		case claveError:
+			m.Error, err = l.texto()
+		case claveSaltos:
+			m.Saltos, err = l.textos()
+		case claveExpiracion:
+			var expiracion uint64
+			expiracion, err = l.entero()
+			if err == nil && expiracion > math.MaxInt64 {
+				err = fmt.Errorf("%w: expiración fuera de rango", errCBORInvalido)
+			}
+			m.Expiracion = int64(expiracion)
+		case claveClaveOrden:
+			m.ClaveOrden, err = l.texto()
+		default:
+			err = l.saltar(0)
+		}
+		if err != nil {
+			return middleware.Mensaje{}, err
+		}
+	}
+	if l.pos != len(l.datos) {
+		return middleware.Mensaje{}, fmt.Errorf("%w: datos sobrantes", errCBORInvalido)
+	}
+	return m, nil
+}
+
+func agregarCabecera(buf []byte, mayor byte, valor uint64) []byte {
+	mayor <<= 5
+	switch {
+	case valor < 24:
+		return append(buf, mayor|byte(valor))
+	case valor <= 0xFF:
+		return append(buf, mayor|24, byte(valor))
+	case valor <= 0xFFFF:
+		return binary.BigEndian.AppendUint16(append(buf, mayor|25), uint16(valor))
+	case valor <= 0xFFFFFFFF:
+		return binary.BigEndian.AppendUint32(append(buf, mayor|26), uint32(valor))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, mayor|27), valor)
+	}
+}
+
+func agregarCadena(buf []byte, mayor byte, datos []byte) []byte {
+	return append(agregarCabecera(buf, mayor, uint64(len(datos))), datos...)
+}
+
+// profundidadMaxima limita el anidamiento al saltar o decodificar valores arbitrarios
+const profundidadMaxima = 16
+
+type lectorCBOR struct {
+	datos []byte
+	pos   int
+}
+
+// cabecera lee el byte inicial de un ítem y su argumento. Con info == cborIndefinido
+// el argumento no aplica.
+func (l *lectorCBOR) cabecera() (mayor byte, info byte, argumento uint64, err error) {
+	if l.pos >= len(l.datos) {
+		return 0, 0, 0, fmt.Errorf("%w: fin inesperado", errCBORInvalido)
+	}
+	inicial := l.datos[l.pos]
+	l.pos++
+	mayor, info = inicial>>5, inicial&0x1F
+	var largo int
+	switch {
+	case info < 24:
+		return mayor, info, uint64(info), nil
+	case info == 24:
+		largo = 1
+	case info == 25:
+		largo = 2
+	case info == 26:
+		largo = 4
+	case info == 27:
+		largo = 8
+	case info == cborIndefinido && (mayor == cborBytes || mayor == cborTexto || mayor == cborArreglo || mayor == cborMapa):
+		return mayor, info, 0, nil
+	default:
+		return 0, 0, 0, fmt.Errorf("%w: cabecera 0x%02x", errCBORInvalido, inicial)
+	}
+	if len(l.datos)-l.pos < largo {
+		return 0, 0, 0, fmt.Errorf("%w: fin inesperado", errCBORInvalido)
+	}
+	for _, b := range l.datos[l.pos : l.pos+largo] {
+		argumento = argumento<<8 | uint64(b)
+	}
+	l.pos += largo
+	return mayor, info, argumento, nil
+}
+
+// quedaFin consume el marcador de fin (0xFF) de un ítem indefinido si es el próximo byte
+func (l *lectorCBOR) quedaFin() bool {
+	if l.pos < len(l.datos) && l.datos[l.pos] == 0xFF {
+		l.pos++
+		return true
+	}
+	return false
+}
+
+func (l *lectorCBOR) entero() (uint64, error) {
+	mayor, _, valor, err := l.cabecera()
+	if err != nil {
+		return 0, err
+	}
+	if mayor != cborEntero {
+		return 0, fmt.Errorf("%w: se esperaba un entero sin signo", errCBORInvalido)
+	}
+	return valor, nil
+}
+
+func (l *lectorCBOR) booleano() (bool, error) {
+	if l.pos >= len(l.datos) {
+		return false, fmt.Errorf("%w: fin inesperado", errCBORInvalido)
+	}
+	switch l.datos[l.pos] {
+	case 0xF4:
+		l.pos++
+		return false, nil
+	case 0xF5:
+		l.pos++
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: se esperaba un booleano", errCBORInvalido)
+}
+
+func (l *lectorCBOR) texto() (string, error) {
+	datos, err := l.cadena(cborTexto)
+	return string(datos), err
+}
+
+// textos lee un arreglo de text strings, de largo definido o indefinido
+func (l *lectorCBOR) textos() ([]string, error) {
+	mayor, info, cantidad, err := l.cabecera()
+	if err != nil {
+		return nil, err
+	}
+	if mayor != cborArreglo {
+		return nil, fmt.Errorf("%w: se esperaba un arreglo", errCBORInvalido)
+	}
+	var textos []string
+	for i := uint64(0); info == cborIndefinido || i < cantidad; i++ {
+		if info == cborIndefinido && l.quedaFin() {
+			break
+		}
+		texto, err := l.texto()
+		if err != nil {
+			return nil, err
+		}
+		textos = append(textos, texto)
+	}
+	return textos, nil
+}
+
+// cadena lee un byte string o text string, de largo definido o en fragmentos
+func (l *lectorCBOR) cadena(tipo byte) ([]byte, error) {
+	mayor, info, largo, err := l.cabecera()
+	if err != nil {
+		return nil, err
+	}
+	if mayor != tipo {
+		return nil, fmt.Errorf("%w: tipo %d, se esperaba %d", errCBORInvalido, mayor, tipo)
+	}
+	if info != cborIndefinido {
+		if uint64(len(l.datos)-l.pos) < largo {
+			return nil, fmt.Errorf("%w: cadena truncada", errCBORInvalido)
+		}
+		datos := append([]byte(nil), l.datos[l.pos:l.pos+int(largo)]...)
+		l.pos += int(largo)
+		return datos, nil
+	}
+	var datos []byte
+	for !l.quedaFin() {
+		// Cada fragmento es una cadena definida del mismo tipo (RFC 8949 §3.2.3); admitir
+		// fragmentos indefinidos permitiría anidarlos sin límite
+		if l.pos < len(l.datos) && l.datos[l.pos]&0x1f == cborIndefinido {
+			return nil, fmt.Errorf("%w: fragmento indefinido en una cadena indefinida", errCBORInvalido)
+		}
+		fragmento, err := l.cadena(tipo)
+		if err != nil {
+			return nil, err
+		}
+		datos = append(datos, fragmento...)
+	}
+	return datos, nil
+}
+
+// saltar descarta el próximo ítem, incluidos arreglos, mapas y etiquetas anidados
+func (l *lectorCBOR) saltar(profundidad int) error {
+	if profundidad > profundidadMaxima {
+		return fmt.Errorf("%w: anidamiento excesivo", errCBORInvalido)
+	}
+	inicio := l.pos
+	mayor, info, argumento, err := l.cabecera()
+	if err != nil {
+		return err
+	}
+	switch mayor {
+	case cborEntero, cborNegativo, cborSimple:
+		return nil
+	case cborBytes, cborTexto:
+		l.pos = inicio
+		_, err := l.cadena(mayor)
+		return err
+	case cborEtiqueta:
+		return l.saltar(profundidad + 1)
+	}
+	// arreglo o mapa: un mapa tiene dos ítems por entrada
+	items := argumento
+	if mayor == cborMapa {
+		items *= 2
+	}
+	for i := uint64(0); info == cborIndefinido || i < items; i++ {
+		if info == cborIndefinido && l.quedaFin() {
+			return nil
+		}
+		if err := l.saltar(profundidad + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodificarValorCBOR decodifica un ítem CBOR arbitrario, para formatos con esquema
+// propio como SenML. Los enteros sin signo se retornan como uint64, los negativos como
+// int64, los flotantes como float64, los mapas como map[interface{}]interface{} (con
+// claves enteras o de texto) y las etiquetas se descartan.
+func DecodificarValorCBOR(datos []byte) (interface{}, error) {
+	l := &lectorCBOR{datos: datos}
+	v, err := l.valor(0)
+	if err != nil {
+		return nil, err
+	}
+	if l.pos != len(l.datos) {
+		return nil, fmt.Errorf("%w: datos sobrantes", errCBORInvalido)
+	}
+	return v, nil
+}
+
+func (l *lectorCBOR) valor(profundidad int) (interface{}, error) {
+	if profundidad > profundidadMaxima {
+		return nil, fmt.Errorf("%w: anidamiento excesivo", errCBORInvalido)
+	}
+	if l.pos >= len(l.datos) {
+		return nil, fmt.Errorf("%w: fin inesperado", errCBORInvalido)
+	}
+	switch mayor := l.datos[l.pos] >> 5; mayor {
+	case cborBytes:
+		return l.cadena(mayor)
+	case cborTexto:
+		return l.texto()
+	case cborSimple:
+		return l.simple()
+	}
+
+	mayor, info, argumento, err := l.cabecera()
+	if err != nil {
+		return nil, err
+	}
+	switch mayor {
+	case cborEntero:
+		return argumento, nil
+	case cborNegativo:
+		if argumento > math.MaxInt64 {
+			return nil, fmt.Errorf("%w: entero negativo fuera de rango", errCBORInvalido)
+		}
+		return -1 - int64(argumento), nil
+	case cborEtiqueta:
+		return l.valor(profundidad + 1)
+	case cborArreglo:
+		var arreglo []interface{}
+		for i := uint64(0); info == cborIndefinido || i < argumento; i++ {
+			if info == cborIndefinido && l.quedaFin() {
+				break
+			}
+			v, err := l.valor(profundidad + 1)
+			if err != nil {
+				return nil, err
+			}
+			arreglo = append(arreglo, v)
+		}
+		return arreglo, nil
+	}
+	mapa := make(map[interface{}]interface{})
+	for i := uint64(0); info == cborIndefinido || i < argumento; i++ {
+		if info == cborIndefinido && l.quedaFin() {
+			break
+		}
+		clave, err := l.valor(profundidad + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch clave.(type) {
+		case uint64, int64, string:
+		default:
+			return nil, fmt.Errorf("%w: clave de mapa %T no soportada", errCBORInvalido, clave)
+		}
+		if mapa[clave], err = l.valor(profundidad + 1); err != nil {
+			return nil, err
+		}
+	}
+	return mapa, nil
+}
+
+// simple lee booleanos, null/undefined y flotantes de 16, 32 o 64 bits
+func (l *lectorCBOR) simple() (interface{}, error) {
+	inicial := l.datos[l.pos]
+	l.pos++
+	var largo int
+	switch inicial {
+	case 0xF4:
+		return false, nil
+	case 0xF5:
+		return true, nil
+	case 0xF6, 0xF7:
+		return nil, nil
+	case 0xF9:
+		largo = 2
+	case 0xFA:
+		largo = 4
+	case 0xFB:
+		largo = 8
+	default:
+		return nil, fmt.Errorf("%w: valor simple 0x%02x", errCBORInvalido, inicial)
+	}
+	if len(l.datos)-l.pos < largo {
+		return nil, fmt.Errorf("%w: fin inesperado", errCBORInvalido)
+	}
+	bits := l.datos[l.pos : l.pos+largo]
+	l.pos += largo
+	switch largo {
+	case 2:
+		return mediaPrecision(binary.BigEndian.Uint16(bits)), nil
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(bits))), nil
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(bits)), nil
+}
+
+// mediaPrecision convierte un flotante IEEE 754 de 16 bits (RFC 8949, apéndice D)
+func mediaPrecision(h uint16) float64 {
+	exponente := int(h>>10) & 0x1F
+	mantisa := float64(h & 0x3FF)
+	var v float64
+	switch exponente {
+	case 0:
+		v = math.Ldexp(mantisa, -24)
+	case 31:
+		if mantisa == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mantisa+1024, exponente-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,110 @@
+package mensaje
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+)
+
+func TestCBOR_IdaYVuelta(t *testing.T) {
+	casos := []middleware.Mensaje{
+		{Topico: "a"},
+		{Original: true, Topico: "planta/sala/temp", Payload: []byte("21.5"), QoS: 1, MensajeID: "id-1"},
+		{Topico: "x", Payload: bytes.Repeat([]byte{0xFF}, 70000), Interno: true, Origen: "nodo1", Retenido: true, Referencia: "abc"},
+		{Topico: "respuestas/c1", Payload: []byte("ok"), TopicoRespuesta: "respuestas/c2", Correlacion: "k1", Error: "falló"},
+		{Topico: "sitio1/temp", Origen: "borde1", Saltos: []string{"borde1", "sitio1"}},
+		{Topico: "actuadores/v1", Payload: []byte("abrir"), Expiracion: 1760000000000, ClaveOrden: "v1"},
+	}
+	for _, m := range casos {
+		datos := CodificarCBOR(m)
+		if DetectarCodificacion(datos) != middleware.CodificacionCBOR {
+			t.Errorf("no se detectó CBOR en %x", datos[:1])
+		}
+		decodificado, err := DecodificarCBOR(datos)
+		if err != nil {
+			t.Fatalf("DecodificarCBOR() error = %v", err)
+		}
+		if !reflect.DeepEqual(decodificado, m) {
+			t.Errorf("ida y vuelta = %+v, esperaba %+v", decodificado, m)
+		}
+	}
+}
+
+func TestCBOR_MasCompactoQueJSON(t *testing.T) {
+	m := middleware.Mensaje{Original: true, Topico: "planta/sala/temp", Payload: bytes.Repeat([]byte{1}, 300)}
+	cbor, _ := Codificar(m, middleware.CodificacionCBOR)
+	json, _ := Codificar(m, middleware.CodificacionJSON)
+	if len(cbor) >= len(json)*3/4 {
+		t.Errorf("CBOR ocupa %d bytes y JSON %d", len(cbor), len(json))
+	}
+}
+
+// TestCBOR_OtrosCodificadores decodifica mapas generados a mano como lo haría otra
+// implementación: largo indefinido, cadenas fragmentadas y claves desconocidas
+func TestCBOR_OtrosCodificadores(t *testing.T) {
+	casos := map[string]middleware.Mensaje{
+		// {1: "t", 2: h'0102', 3: 1}
+		"a3016174024201020301": {Topico: "t", Payload: []byte{1, 2}, QoS: 1},
+		// {_ 1: "t", 5: true, 2: (_ h'01', h'02')}
+		"bf01617405f5025f41014102ffff": {Topico: "t", Original: true, Payload: []byte{1, 2}},
+		// {1: "t", 99: [1, {"k": -3}], 20: 1.5}
+		"a3016174186382 01a1616b22 14f93e00": {Topico: "t"},
+	}
+	for entrada, esperado := range casos {
+		datos, _ := hex.DecodeString(string(bytes.ReplaceAll([]byte(entrada), []byte(" "), nil)))
+		m, err := Decodificar(datos, "")
+		if err != nil {
+			t.Errorf("Decodificar(%s) error = %v", entrada, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, esperado) {
+			t.Errorf("Decodificar(%s) = %+v, esperaba %+v", entrada, m, esperado)
+		}
+	}
+}
+
+func TestCBOR_Invalido(t *testing.T) {
+	casos := []string{
+		"",
+		"80",         // arreglo en lugar de mapa
+		"a101",       // falta el valor
+		"a1015a7fff", // largo mayor que los datos
+		"a10161",     // cadena sin contenido
+		"a101617400", // datos sobrantes
+		"a103f5",     // qos no entero
+		"a105617400", // original no booleano
+		"a16174f5",   // clave no entera
+		// {1: (_ (_ "t"))}: un fragmento indefinido dentro de una cadena indefinida
+		"a1017f7f6174ffff",
+		"a1017f4101ff", // fragmento de bytes en una cadena de texto
+	}
+	for _, entrada := range casos {
+		datos, _ := hex.DecodeString(entrada)
+		if _, err := DecodificarCBOR(datos); err == nil {
+			t.Errorf("DecodificarCBOR(%s) debería fallar", entrada)
+		}
+	}
+}
+
+func TestDecodificarValorCBOR(t *testing.T) {
+	// {-2: 1.5, "k": [1, -1, h'00', null, 100000.0], 3: true}
+	datos, _ := hex.DecodeString("a321f93e00616b8501204100f6fa47c3500003f5")
+	v, err := DecodificarValorCBOR(datos)
+	if err != nil {
+		t.Fatalf("DecodificarValorCBOR() error = %v", err)
+	}
+	esperado := map[interface{}]interface{}{
+		int64(-2): 1.5,
+		"k":       []interface{}{uint64(1), int64(-1), []byte{0}, nil, 100000.0},
+		uint64(3): true,
+	}
+	if !reflect.DeepEqual(v, esperado) {
+		t.Errorf("DecodificarValorCBOR() = %#v, esperaba %#v", v, esperado)
+	}
+	if _, err := DecodificarValorCBOR([]byte{0xa1, 0x80, 0x01}); err == nil {
+		t.Error("una clave arreglo debería fallar")
+	}
+}
@@ -0,0 +1,123 @@
+package mensaje
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+)
+
+// Publicación HTTP binaria: el cuerpo es el payload crudo (TipoBinario, admite
+// Transfer-Encoding chunked) y los demás campos del mensaje viajan en el query.
+// Evita el base64 del JSON en payloads grandes.
+const (
+	TipoBinario = "application/octet-stream"
+
+	ParamOriginal  = "original"
+	ParamQoS       = "qos"
+	ParamMensajeID = "mensajeId"
+	ParamOrigen    = "origen"
+	ParamRetenido  = "retenido"
+
+	ParamTopicoRespuesta = "topicoRespuesta"
+	ParamCorrelacion     = "correlacion"
+	ParamError           = "error"
+	ParamSaltos          = "saltos" // IDs de instancia separados por comas
+	ParamExpiracion      = "expiracion"
+	ParamClaveOrden      = "claveOrden"
+)
+
+// Los payloads grandes se entregan por referencia (Mensaje.Referencia) y el suscriptor
+// los descarga de RutaContenido con GET ?id=<referencia>; en CoAP la respuesta usa
+// block-wise (Block2, RFC 7959).
+const (
+	RutaContenido   = "/sensorwave/contenido"
+	ParamReferencia = "id"
+)
+
+// margenCuerpoJSON cubre los campos del Mensaje distintos del payload
+const margenCuerpoJSON = 4096
+
+// TamanoCuerpoJSON retorna el tamaño máximo de un Mensaje serializado en JSON cuyo
+// payload (codificado en base64) no supera maximoPayload bytes
+func TamanoCuerpoJSON(maximoPayload int) int {
+	return base64.StdEncoding.EncodedLen(maximoPayload) + margenCuerpoJSON
+}
+
+// ParametrosBinario codifica los campos de m, salvo tópico y payload, como query
+func ParametrosBinario(m middleware.Mensaje) url.Values {
+	valores := url.Values{}
+	if m.Original {
+		valores.Set(ParamOriginal, "1")
+	}
+	if m.QoS != 0 {
+		valores.Set(ParamQoS, strconv.Itoa(m.QoS))
+	}
+	if m.MensajeID != "" {
+		valores.Set(ParamMensajeID, m.MensajeID)
+	}
+	if m.Origen != "" {
+		valores.Set(ParamOrigen, m.Origen)
+	}
+	if m.Retenido {
+		valores.Set(ParamRetenido, "1")
+	}
+	if m.TopicoRespuesta != "" {
+		valores.Set(ParamTopicoRespuesta, m.TopicoRespuesta)
+	}
+	if m.Correlacion != "" {
+		valores.Set(ParamCorrelacion, m.Correlacion)
+	}
+	if m.Error != "" {
+		valores.Set(ParamError, m.Error)
+	}
+	if len(m.Saltos) > 0 {
+		valores.Set(ParamSaltos, strings.Join(m.Saltos, ","))
+	}
+	if m.Expiracion > 0 {
+		valores.Set(ParamExpiracion, strconv.FormatInt(m.Expiracion, 10))
+	}
+	if m.ClaveOrden != "" {
+		valores.Set(ParamClaveOrden, m.ClaveOrden)
+	}
+	return valores
+}
+
+// LeerBinario reconstruye el mensaje de una publicación binaria a partir de una
+// función que obtiene parámetros de query, el tópico y el cuerpo
+func LeerBinario(obtener func(nombre string) string, topico string, payload []byte) (middleware.Mensaje, error) {
+	m := middleware.Mensaje{
+		Topico:    topico,
+		Payload:   payload,
+		Original:  obtener(ParamOriginal) == "1",
+		MensajeID: obtener(ParamMensajeID),
+		Origen:    obtener(ParamOrigen),
+		Retenido:  obtener(ParamRetenido) == "1",
+
+		TopicoRespuesta: obtener(ParamTopicoRespuesta),
+		Correlacion:     obtener(ParamCorrelacion),
+		Error:           obtener(ParamError),
+		ClaveOrden:      obtener(ParamClaveOrden),
+	}
+	if saltos := obtener(ParamSaltos); saltos != "" {
+		m.Saltos = strings.Split(saltos, ",")
+	}
+	if expiracion := obtener(ParamExpiracion); expiracion != "" {
+		valor, err := strconv.ParseInt(expiracion, 10, 64)
+		if err != nil || valor < 0 {
+			return middleware.Mensaje{}, fmt.Errorf("expiración inválida: %q", expiracion)
+		}
+		m.Expiracion = valor
+	}
+	if qos := obtener(ParamQoS); qos != "" {
+		valor, err := strconv.Atoi(qos)
+		if err != nil {
+			return middleware.Mensaje{}, fmt.Errorf("%w: %q", errQoSInvalido, qos)
+		}
+		m.QoS = valor
+	}
+	return m, nil
+}
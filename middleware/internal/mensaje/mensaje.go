@@ -11,13 +11,23 @@ import (
 	"github.com/sensorwave-dev/sensorwave/middleware"
 )
 
-const tamanoMaximoPayload = 65536
+// TamanoMaximoPayloadDefecto es el límite de payload de clientes y servidor cuando no se configura otro
+const TamanoMaximoPayloadDefecto = 65536
 
 var errQoSInvalido = errors.New("qos invalido")
 var errPayloadMuyGrande = errors.New("payload demasiado grande")
+var errTestamentoIncompleto = errors.New("testamento incompleto: se requieren id, tópico y payload válido")
 
-// Construir crea un mensaje a partir de un payload y opciones
+// Construir crea un mensaje a partir de un payload y opciones, con el límite de payload por defecto
 func Construir(topico string, payload interface{}, opciones ...middleware.PublicarOpcion) (middleware.Mensaje, error) {
+	return ConstruirConLimite(topico, payload, TamanoMaximoPayloadDefecto, opciones...)
+}
+
+// ConstruirConLimite es Construir con un tamaño máximo de payload en bytes (0 = por defecto)
+func ConstruirConLimite(topico string, payload interface{}, maximo int, opciones ...middleware.PublicarOpcion) (middleware.Mensaje, error) {
+	if maximo <= 0 {
+		maximo = TamanoMaximoPayloadDefecto
+	}
 	mensaje := middleware.Mensaje{Original: true, Topico: topico, Interno: false}
 
 	switch v := payload.(type) {
@@ -44,9 +54,9 @@ func Construir(topico string, payload interface{}, opciones ...middleware.Public
 			}
 		}
 
-		// Validar tamaño del payload (máximo 64KB para evitar OOM)
-		if len(data) > tamanoMaximoPayload {
-			return middleware.Mensaje{}, fmt.Errorf("%w: %d bytes (máximo %d)", errPayloadMuyGrande, len(data), tamanoMaximoPayload)
+		// Validar tamaño del payload para evitar OOM
+		if len(data) > maximo {
+			return middleware.Mensaje{}, fmt.Errorf("%w: %d bytes (máximo %d)", errPayloadMuyGrande, len(data), maximo)
 		}
 
 		mensaje.Payload = data
@@ -65,10 +75,10 @@ func Construir(topico string, payload interface{}, opciones ...middleware.Public
 		}
 	}
 
-	if mensaje.QoS != 0 && mensaje.QoS != 1 {
+	if mensaje.QoS < 0 || mensaje.QoS > 2 {
 		return middleware.Mensaje{}, errQoSInvalido
 	}
-	if mensaje.QoS == 1 && mensaje.MensajeID == "" {
+	if mensaje.QoS >= 1 && mensaje.MensajeID == "" {
 		mensaje.MensajeID = generarMensajeID()
 	}
 
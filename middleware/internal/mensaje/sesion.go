@@ -0,0 +1,9 @@
+package mensaje
+
+// Parámetros de query de las sesiones persistentes de HTTP y CoAP. ParamSesion lleva
+// el ID elegido por el cliente en cada suscripción; ParamConservarSesion ("1") en una
+// desuscripción cierra el stream u observación sin terminar la sesión.
+const (
+	ParamSesion          = "sesion"
+	ParamConservarSesion = "conservar_sesion"
+)
@@ -0,0 +1,54 @@
+package mensaje
+
+import (
+	"encoding/base64"
+	"net/url"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+)
+
+// Parámetros de query con los que los clientes HTTP y CoAP declaran su testamento
+// en cada suscripción. El payload viaja en base64 URL sin relleno.
+const (
+	ParamTestamentoID       = "testamento_id"
+	ParamTestamentoTopico   = "testamento"
+	ParamTestamentoPayload  = "testamento_payload"
+	ParamTestamentoRetenido = "testamento_retenido"
+)
+
+// ParametrosTestamento codifica el testamento del cliente identificado por id
+func ParametrosTestamento(id string, t *middleware.Testamento) url.Values {
+	valores := url.Values{}
+	if t == nil {
+		return valores
+	}
+	valores.Set(ParamTestamentoID, id)
+	valores.Set(ParamTestamentoTopico, t.Topico)
+	valores.Set(ParamTestamentoPayload, base64.RawURLEncoding.EncodeToString(t.Payload))
+	if t.Retenido {
+		valores.Set(ParamTestamentoRetenido, "1")
+	}
+	return valores
+}
+
+// LeerTestamento decodifica un testamento a partir de una función que obtiene
+// parámetros de query. Retorna id vacío si la suscripción no declara testamento.
+func LeerTestamento(obtener func(nombre string) string) (string, *middleware.Testamento, error) {
+	id := obtener(ParamTestamentoID)
+	topico := obtener(ParamTestamentoTopico)
+	if id == "" && topico == "" {
+		return "", nil, nil
+	}
+	if id == "" || topico == "" {
+		return "", nil, errTestamentoIncompleto
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(obtener(ParamTestamentoPayload))
+	if err != nil {
+		return "", nil, errTestamentoIncompleto
+	}
+	return id, &middleware.Testamento{
+		Topico:   topico,
+		Payload:  payload,
+		Retenido: obtener(ParamTestamentoRetenido) == "1",
+	}, nil
+}
@@ -2,10 +2,11 @@ package qos
 
 import (
 	"math/rand/v2"
+	"sync"
 	"time"
 )
 
-// Temporizadores de retransmisión para QoS1, alineados con RFC 7252 (CoAP):
+// Temporizadores de retransmisión para QoS 1 y 2, alineados con RFC 7252 (CoAP):
 //   - ACK_TIMEOUT = 2s, aleatorizado a [ACK_TIMEOUT * (1 ± RANDOM_FACTOR)] -> [1.5s, 2.5s].
 //   - MAX_RETRANSMIT = 4   - backoff exponencial ×2 por intento.
 //
@@ -30,3 +31,51 @@ func JitterAckTimeout() time.Duration {
 	max := float64(AckTimeout) * (1 + RandomFactor)
 	return time.Duration(min + rand.Float64()*(max-min))
 }
+
+// VentanaDeduplicacion es el plazo por defecto durante el que se recuerdan los MensajeID
+// QoS 2. Cubre con holgura las retransmisiones de un mensaje: con MaxRetransmisiones y
+// backoff ×2 el último reintento sale a lo sumo ~80 s después del primer envío.
+const VentanaDeduplicacion = 5 * time.Minute
+
+// Deduplicador recuerda los MensajeID recibidos durante una ventana para que un mensaje
+// QoS 2 retransmitido (ACK perdido, reintento de la cola local, redelivery del servidor)
+// se procese una sola vez. En MQTT la entrega exactamente-una-vez la resuelve el propio
+// protocolo (PUBREC/PUBREL); HTTP y CoAP la resuelven con este registro.
+type Deduplicador struct {
+	mu       sync.Mutex
+	ventana  time.Duration
+	vistos   map[string]time.Time // clave -> instante de la primera recepción
+	limpieza time.Time            // próxima purga de las claves vencidas
+}
+
+// NuevoDeduplicador crea un registro con la ventana indicada (0 = VentanaDeduplicacion)
+func NuevoDeduplicador(ventana time.Duration) *Deduplicador {
+	if ventana <= 0 {
+		ventana = VentanaDeduplicacion
+	}
+	return &Deduplicador{ventana: ventana, vistos: make(map[string]time.Time)}
+}
+
+// Registrar retorna true si la clave no se recibió dentro de la ventana (el mensaje
+// debe procesarse) y la recuerda; false si es una repetición.
+func (d *Deduplicador) Registrar(clave string) bool {
+	return d.registrar(clave, time.Now())
+}
+
+func (d *Deduplicador) registrar(clave string, ahora time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ahora.After(d.limpieza) {
+		for k, t := range d.vistos {
+			if ahora.Sub(t) >= d.ventana {
+				delete(d.vistos, k)
+			}
+		}
+		d.limpieza = ahora.Add(d.ventana / 4)
+	}
+	if t, ok := d.vistos[clave]; ok && ahora.Sub(t) < d.ventana {
+		return false
+	}
+	d.vistos[clave] = ahora
+	return true
+}
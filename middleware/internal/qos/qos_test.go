@@ -0,0 +1,28 @@
+package qos
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplicador(t *testing.T) {
+	d := NuevoDeduplicador(time.Minute)
+	t0 := time.Now()
+
+	if !d.registrar("m1", t0) {
+		t.Fatal("la primera recepción debe procesarse")
+	}
+	if d.registrar("m1", t0.Add(30*time.Second)) {
+		t.Error("una repetición dentro de la ventana debe descartarse")
+	}
+	if !d.registrar("m2", t0.Add(30*time.Second)) {
+		t.Error("otra clave debe procesarse")
+	}
+	// Pasada la ventana la clave se olvida y la purga libera las vencidas
+	if !d.registrar("m1", t0.Add(2*time.Minute)) {
+		t.Error("pasada la ventana la clave debe procesarse de nuevo")
+	}
+	if len(d.vistos) != 1 {
+		t.Errorf("claves recordadas = %d, esperaba solo la renovada", len(d.vistos))
+	}
+}
@@ -0,0 +1,161 @@
+// Package solicitudes implementa el patrón solicitud/respuesta de
+// middleware.ClienteRPC sobre la publicación y la suscripción de cada cliente.
+//
+// Una solicitud es un Mensaje con TopicoRespuesta (el tópico de respuestas del
+// cliente) y una Correlacion única. Quien responde publica en TopicoRespuesta un
+// Mensaje con la misma Correlacion; el servidor lo distribuye como cualquier otra
+// publicación, de modo que solicitante y respondedor pueden usar protocolos distintos.
+package solicitudes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/errores"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/mensaje"
+)
+
+// Suscribir suscribe un tópico entregando cada Mensaje completo
+type Suscribir func(topico string, entregar func(middleware.Mensaje)) error
+
+// Enviar publica un mensaje ya construido, sin pasar por la cola local: una solicitud
+// encolada no tendría quién espere su respuesta
+type Enviar func(middleware.Mensaje) error
+
+// Pendientes correlaciona las solicitudes de un cliente con sus respuestas
+type Pendientes struct {
+	topico string
+	maximo int // límite de los payloads de las solicitudes (0 = 64 KB)
+
+	suscripcion sync.Mutex // serializa la suscripción del tópico de respuestas
+	suscrito    bool
+
+	mu      sync.Mutex
+	esperas map[string]chan middleware.Mensaje // correlación -> respuesta
+}
+
+// Nuevas crea el registro de solicitudes de un cliente con un tópico de respuestas propio
+func Nuevas(maximoPayload int) *Pendientes {
+	return &Pendientes{
+		topico:  middleware.PrefijoRespuestas + uuid.New().String(),
+		maximo:  maximoPayload,
+		esperas: make(map[string]chan middleware.Mensaje),
+	}
+}
+
+// Topico retorna el tópico en el que el cliente recibe sus respuestas
+func (p *Pendientes) Topico() string {
+	return p.topico
+}
+
+// Suscrito indica si el tópico de respuestas ya fue suscrito por una solicitud
+func (p *Pendientes) Suscrito() bool {
+	p.suscripcion.Lock()
+	defer p.suscripcion.Unlock()
+	return p.suscrito
+}
+
+// Solicitar publica una solicitud con enviar y espera la respuesta hasta timeout. El
+// tópico de respuestas se suscribe con suscribir en la primera solicitud. El error se
+// categoriza como errores.ErrSolicitud y, si vence el plazo, también como
+// context.DeadlineExceeded.
+func (p *Pendientes) Solicitar(topico string, payload interface{}, timeout time.Duration, suscribir Suscribir, enviar Enviar) ([]byte, error) {
+	if timeout <= 0 {
+		return nil, fmt.Errorf("%w: %s: timeout inválido: %v", errores.ErrSolicitud, topico, timeout)
+	}
+	m, err := mensaje.ConstruirConLimite(topico, payload, p.maximo)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errores.ErrSolicitud, err)
+	}
+	if err := p.suscribir(suscribir); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", errores.ErrSolicitud, topico, err)
+	}
+	m.TopicoRespuesta = p.topico
+	m.Correlacion = uuid.New().String()
+
+	// Con buffer: la respuesta no bloquea al lector de la conexión si ya no hay quién la espere
+	respuesta := make(chan middleware.Mensaje, 1)
+	p.mu.Lock()
+	p.esperas[m.Correlacion] = respuesta
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.esperas, m.Correlacion)
+		p.mu.Unlock()
+	}()
+
+	if err := enviar(m); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", errores.ErrSolicitud, topico, err)
+	}
+
+	temporizador := time.NewTimer(timeout)
+	defer temporizador.Stop()
+	select {
+	case r := <-respuesta:
+		if r.Error != "" {
+			return nil, fmt.Errorf("%w: %s: %s", errores.ErrSolicitud, topico, r.Error)
+		}
+		return r.Payload, nil
+	case <-temporizador.C:
+		return nil, fmt.Errorf("%w: %s: sin respuesta en %v: %w", errores.ErrSolicitud, topico, timeout, context.DeadlineExceeded)
+	}
+}
+
+// suscribir suscribe el tópico de respuestas una sola vez; si falla, la próxima
+// solicitud lo reintenta
+func (p *Pendientes) suscribir(suscribir Suscribir) error {
+	p.suscripcion.Lock()
+	defer p.suscripcion.Unlock()
+	if p.suscrito {
+		return nil
+	}
+	if err := suscribir(p.topico, p.entregar); err != nil {
+		return err
+	}
+	p.suscrito = true
+	return nil
+}
+
+// entregar despierta a la solicitud que espera la respuesta. Las respuestas tardías o
+// duplicadas (QoS 1) no tienen espera y se descartan.
+func (p *Pendientes) entregar(m middleware.Mensaje) {
+	p.mu.Lock()
+	respuesta, ok := p.esperas[m.Correlacion]
+	delete(p.esperas, m.Correlacion)
+	p.mu.Unlock()
+	if ok {
+		respuesta <- m
+	}
+}
+
+// Atender retorna la función de entrega de una suscripción de Responder. Cada
+// solicitud se atiende en su propia goroutine: el manejador puede tardar y la
+// respuesta no puede publicarse desde el lector de la conexión que la recibió.
+// La respuesta conserva el QoS de la solicitud.
+func Atender(manejador middleware.ManejadorSolicitud, maximoPayload int, enviar Enviar) func(middleware.Mensaje) {
+	return func(m middleware.Mensaje) {
+		if m.TopicoRespuesta == "" {
+			return
+		}
+		go func() {
+			var respuesta middleware.Mensaje
+			payload, err := manejador(m.Topico, m.Payload)
+			if err == nil {
+				respuesta, err = mensaje.ConstruirConLimite(m.TopicoRespuesta, payload, maximoPayload, middleware.ConQoS(m.QoS))
+			}
+			if err != nil {
+				respuesta, _ = mensaje.ConstruirConLimite(m.TopicoRespuesta, []byte(nil), maximoPayload, middleware.ConQoS(m.QoS))
+				respuesta.Error = err.Error()
+			}
+			respuesta.Correlacion = m.Correlacion
+			if err := enviar(respuesta); err != nil {
+				log.Printf("Error al responder la solicitud de %s: %v", m.Topico, err)
+			}
+		}()
+	}
+}
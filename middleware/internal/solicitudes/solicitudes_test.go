@@ -0,0 +1,100 @@
+package solicitudes
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/errores"
+)
+
+// bus simula el servidor: entrega cada mensaje enviado a la suscripción de su tópico
+type bus struct {
+	mu            sync.Mutex
+	suscripciones map[string]func(middleware.Mensaje)
+	suscritos     int
+}
+
+func nuevoBus() *bus {
+	return &bus{suscripciones: make(map[string]func(middleware.Mensaje))}
+}
+
+func (b *bus) suscribir(topico string, entregar func(middleware.Mensaje)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.suscripciones[topico] = entregar
+	b.suscritos++
+	return nil
+}
+
+func (b *bus) enviar(m middleware.Mensaje) error {
+	b.mu.Lock()
+	entregar := b.suscripciones[m.Topico]
+	b.mu.Unlock()
+	if entregar != nil {
+		go entregar(m)
+	}
+	return nil
+}
+
+func TestSolicitar_RespuestaYError(t *testing.T) {
+	b := nuevoBus()
+	_ = b.suscribir("plc/leer", Atender(func(_ string, payload []byte) ([]byte, error) {
+		if string(payload) == "mal" {
+			return nil, errors.New("registro desconocido")
+		}
+		return append([]byte("valor:"), payload...), nil
+	}, 0, b.enviar))
+	p := Nuevas(0)
+
+	respuesta, err := p.Solicitar("plc/leer", "40001", time.Second, b.suscribir, b.enviar)
+	if err != nil || string(respuesta) != "valor:40001" {
+		t.Fatalf("Solicitar = %q, %v", respuesta, err)
+	}
+	_, err = p.Solicitar("plc/leer", "mal", time.Second, b.suscribir, b.enviar)
+	if !errors.Is(err, errores.ErrSolicitud) || !strings.Contains(err.Error(), "registro desconocido") {
+		t.Errorf("Solicitar con error del manejador = %v", err)
+	}
+	if b.suscritos != 2 || !p.Suscrito() {
+		t.Errorf("suscripciones = %d, esperaba el respondedor y un único tópico de respuestas", b.suscritos)
+	}
+	if !strings.HasPrefix(p.Topico(), middleware.PrefijoRespuestas) {
+		t.Errorf("Topico() = %q", p.Topico())
+	}
+}
+
+func TestSolicitar_Timeout(t *testing.T) {
+	b := nuevoBus()
+	p := Nuevas(0)
+	_, err := p.Solicitar("nadie", "x", 50*time.Millisecond, b.suscribir, b.enviar)
+	if !errors.Is(err, errores.ErrSolicitud) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Solicitar sin respuesta = %v", err)
+	}
+	if len(p.esperas) != 0 {
+		t.Errorf("quedaron %d esperas pendientes", len(p.esperas))
+	}
+	// Una respuesta tardía se descarta sin bloquear
+	p.entregar(middleware.Mensaje{Correlacion: "desconocida"})
+
+	if _, err := p.Solicitar("nadie", "x", 0, b.suscribir, b.enviar); !errors.Is(err, errores.ErrSolicitud) {
+		t.Errorf("timeout 0 = %v, esperaba error", err)
+	}
+}
+
+func TestAtender_IgnoraMensajesSinTopicoRespuesta(t *testing.T) {
+	llamado := make(chan struct{}, 1)
+	atender := Atender(func(string, []byte) ([]byte, error) {
+		llamado <- struct{}{}
+		return nil, nil
+	}, 0, func(middleware.Mensaje) error { return nil })
+	atender(middleware.Mensaje{Topico: "plc/leer", Payload: []byte("x")})
+	select {
+	case <-llamado:
+		t.Error("el manejador atendió un mensaje que no es una solicitud")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
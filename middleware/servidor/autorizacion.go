@@ -0,0 +1,302 @@
+package servidor
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+)
+
+// Autenticación y ACL por tópico, aplicadas igual en MQTT, HTTP y CoAP.
+//
+// Cómo llegan las credenciales en cada protocolo:
+//   - MQTT: usuario/clave del CONNECT. Un token bearer se envía como clave con usuario vacío.
+//   - HTTP: cabecera "Authorization: Basic ..." o "Authorization: Bearer <token>".
+//   - CoAP: opciones Uri-Query "usuario=...&clave=..." o "token=...".
+//
+// Con TLS mutuo o DTLS la identidad del transporte sustituye a las credenciales (ver tls.go).
+//
+// Sin Autorizador configurado el servidor acepta a cualquiera (comportamiento histórico).
+
+// Credenciales es un alias al tipo del paquete middleware
+type Credenciales = middleware.Credenciales
+
+// AccionACL es la operación sobre un tópico que se autoriza
+type AccionACL string
+
+const (
+	AccionPublicar  AccionACL = "publicar"
+	AccionSuscribir AccionACL = "suscribir"
+)
+
+// UsuarioAnonimo es la identidad asignada a clientes sin credenciales cuando se permiten
+const UsuarioAnonimo = "anonimo"
+
+var (
+	errNoAutenticado = errors.New("no autenticado")
+	errNoAutorizado  = errors.New("no autorizado")
+)
+
+// Autorizador decide quién puede conectarse y sobre qué tópicos puede operar.
+// Las implementaciones deben ser seguras para uso concurrente.
+type Autorizador interface {
+	// Autenticar valida las credenciales y retorna la identidad del cliente
+	Autenticar(cred Credenciales) (string, error)
+	// Autorizar indica si el usuario puede realizar la acción sobre el tópico.
+	// Para AccionSuscribir el tópico puede ser un patrón con + y #.
+	Autorizar(usuario string, accion AccionACL, topico string) bool
+}
+
+// ConfiguracionAuth es un Autorizador basado en un archivo de configuración JSON
+type ConfiguracionAuth struct {
+	PermitirAnonimos bool          `json:"permitir_anonimos"` // Clientes sin credenciales se identifican como UsuarioAnonimo
+	Usuarios         []UsuarioAuth `json:"usuarios"`
+	Tokens           []TokenAuth   `json:"tokens"`
+	ACL              []ReglaACL    `json:"acl"`
+}
+
+// UsuarioAuth define un usuario con clave. La clave puede estar en texto plano
+// o como "sha256:<hex>".
+type UsuarioAuth struct {
+	Usuario string `json:"usuario"`
+	Clave   string `json:"clave"`
+}
+
+// TokenAuth asocia un token bearer a un usuario
+type TokenAuth struct {
+	Token   string `json:"token"`
+	Usuario string `json:"usuario"`
+}
+
+// ReglaACL lista los patrones de tópicos permitidos a un usuario ("*" aplica a todos).
+// Los patrones admiten + y # y la variable {usuario}, que se reemplaza por la identidad.
+type ReglaACL struct {
+	Usuario   string   `json:"usuario"`
+	Publicar  []string `json:"publicar"`
+	Suscribir []string `json:"suscribir"`
+}
+
+// CargarConfiguracionAuth lee y valida un archivo de configuración de autenticación/ACL
+func CargarConfiguracionAuth(ruta string) (*ConfiguracionAuth, error) {
+	datos, err := os.ReadFile(ruta)
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo configuración de auth: %w", err)
+	}
+
+	var config ConfiguracionAuth
+	if err := json.Unmarshal(datos, &config); err != nil {
+		return nil, fmt.Errorf("error parseando configuración de auth: %w", err)
+	}
+	if err := config.Validar(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Validar verifica que usuarios, tokens y patrones de la configuración sean correctos
+func (c *ConfiguracionAuth) Validar() error {
+	usuarios := make(map[string]bool)
+	for i, u := range c.Usuarios {
+		if u.Usuario == "" || u.Clave == "" {
+			return fmt.Errorf("usuario %d: usuario y clave son requeridos", i)
+		}
+		if usuarios[u.Usuario] {
+			return fmt.Errorf("usuario '%s' duplicado", u.Usuario)
+		}
+		usuarios[u.Usuario] = true
+	}
+	for i, t := range c.Tokens {
+		if t.Token == "" || t.Usuario == "" {
+			return fmt.Errorf("token %d: token y usuario son requeridos", i)
+		}
+	}
+	for i, regla := range c.ACL {
+		if regla.Usuario == "" {
+			return fmt.Errorf("regla ACL %d: usuario es requerido", i)
+		}
+		for _, patron := range append(append([]string{}, regla.Publicar...), regla.Suscribir...) {
+			ejemplo := strings.ReplaceAll(patron, "{usuario}", "u")
+			if _, err := normalizarYValidarTopico(ejemplo, true); err != nil {
+				return fmt.Errorf("regla ACL %d: patrón inválido '%s'", i, patron)
+			}
+		}
+	}
+	return nil
+}
+
+// Autenticar implementa Autorizador
+func (c *ConfiguracionAuth) Autenticar(cred Credenciales) (string, error) {
+	if cred.Token != "" {
+		for _, t := range c.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Token), []byte(cred.Token)) == 1 {
+				return t.Usuario, nil
+			}
+		}
+		return "", errNoAutenticado
+	}
+
+	if cred.Usuario == "" && cred.Clave == "" {
+		if c.PermitirAnonimos {
+			return UsuarioAnonimo, nil
+		}
+		return "", errNoAutenticado
+	}
+
+	for _, u := range c.Usuarios {
+		if u.Usuario == cred.Usuario && claveCoincide(u.Clave, cred.Clave) {
+			return u.Usuario, nil
+		}
+	}
+	return "", errNoAutenticado
+}
+
+// Autorizar implementa Autorizador
+func (c *ConfiguracionAuth) Autorizar(usuario string, accion AccionACL, topico string) bool {
+	for _, regla := range c.ACL {
+		if regla.Usuario != "*" && regla.Usuario != usuario {
+			continue
+		}
+		patrones := regla.Publicar
+		if accion == AccionSuscribir {
+			patrones = regla.Suscribir
+		}
+		for _, patron := range patrones {
+			patron = strings.ReplaceAll(patron, "{usuario}", usuario)
+			if accion == AccionSuscribir {
+				if patronIncluido(topico, patron) {
+					return true
+				}
+			} else if coincidePatron(topico, patron) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func claveCoincide(configurada, recibida string) bool {
+	if hash, ok := strings.CutPrefix(configurada, "sha256:"); ok {
+		suma := sha256.Sum256([]byte(recibida))
+		return subtle.ConstantTimeCompare([]byte(strings.ToLower(hash)), []byte(hex.EncodeToString(suma[:]))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(configurada), []byte(recibida)) == 1
+}
+
+// patronIncluido indica si todo tópico que coincide con el patrón solicitado
+// también coincide con el patrón permitido (p.ej. "a/+/b" está incluido en "a/#").
+func patronIncluido(solicitado, permitido string) bool {
+	partesSolicitado := strings.Split(solicitado, "/")
+	partesPermitido := strings.Split(permitido, "/")
+
+	for i, p := range partesPermitido {
+		if p == "#" {
+			return true
+		}
+		if i >= len(partesSolicitado) {
+			return false
+		}
+		s := partesSolicitado[i]
+		if s == "#" {
+			return false
+		}
+		if p == "+" {
+			continue
+		}
+		if s != p {
+			return false
+		}
+	}
+	return len(partesSolicitado) == len(partesPermitido)
+}
+
+// ConfigurarAutorizador establece el Autorizador del servidor. nil deshabilita la autenticación.
+// Puede llamarse con el servidor en marcha; las conexiones MQTT ya establecidas conservan su identidad.
+func (s *Servidor) ConfigurarAutorizador(a Autorizador) {
+	s.mu.Lock()
+	s.autorizador = a
+	s.mu.Unlock()
+}
+
+func (s *Servidor) obtenerAutorizador() Autorizador {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.autorizador
+}
+
+// autenticar valida las credenciales. Sin Autorizador todos se identifican como UsuarioAnonimo.
+// identidadTLS es la identidad verificada por el transporte (certificado de cliente o PSK);
+// se usa cuando el cliente no envía credenciales explícitas.
+func (s *Servidor) autenticar(cred Credenciales, identidadTLS string) (string, error) {
+	a := s.obtenerAutorizador()
+	if a == nil {
+		return UsuarioAnonimo, nil
+	}
+	if cred.Vacias() && identidadTLS != "" {
+		return identidadTLS, nil
+	}
+	return a.Autenticar(cred)
+}
+
+// autorizar aplica la ACL. Es el único punto de decisión para los tres protocolos.
+// Una suscripción compartida se autoriza por su filtro, sin el prefijo $share/<grupo>.
+func (s *Servidor) autorizar(usuario string, accion AccionACL, topico string) bool {
+	a := s.obtenerAutorizador()
+	if a == nil {
+		return true
+	}
+	if _, filtro, ok, err := parsearCompartida(topico); ok && err == nil {
+		topico = filtro
+	}
+	return a.Autorizar(usuario, accion, topico)
+}
+
+// autenticarYAutorizar combina autenticar y autorizar, distinguiendo el tipo de rechazo
+func (s *Servidor) autenticarYAutorizar(cred Credenciales, identidadTLS string, accion AccionACL, topico string) (string, error) {
+	usuario, err := s.autenticar(cred, identidadTLS)
+	if err != nil {
+		return "", errNoAutenticado
+	}
+	if !s.autorizar(usuario, accion, topico) {
+		return usuario, errNoAutorizado
+	}
+	return usuario, nil
+}
+
+// credencialesHTTP extrae las credenciales de la cabecera Authorization
+func credencialesHTTP(r *http.Request) Credenciales {
+	cabecera := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(cabecera, "Bearer "); ok {
+		return Credenciales{Token: strings.TrimSpace(token)}
+	}
+	if codificado, ok := strings.CutPrefix(cabecera, "Basic "); ok {
+		datos, err := base64.StdEncoding.DecodeString(strings.TrimSpace(codificado))
+		if err == nil {
+			usuario, clave, _ := strings.Cut(string(datos), ":")
+			return Credenciales{Usuario: usuario, Clave: clave}
+		}
+	}
+	return Credenciales{}
+}
+
+// responderErrorAuthHTTP traduce un error de autenticación/autorización a 401/403
+func responderErrorAuthHTTP(w http.ResponseWriter, err error) {
+	if errors.Is(err, errNoAutorizado) {
+		http.Error(w, "No autorizado para el tópico", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="sensorwave", Bearer`)
+	http.Error(w, "Credenciales inválidas", http.StatusUnauthorized)
+}
+
+// ConfigurarAutorizador establece el Autorizador de la instancia por defecto
+func ConfigurarAutorizador(a Autorizador) {
+	porDefecto().ConfigurarAutorizador(a)
+}
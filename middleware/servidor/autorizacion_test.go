@@ -0,0 +1,270 @@
+package servidor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func configuracionAuthTest() *ConfiguracionAuth {
+	suma := sha256.Sum256([]byte("clave-hash"))
+	return &ConfiguracionAuth{
+		Usuarios: []UsuarioAuth{
+			{Usuario: "sensor1", Clave: "secreto"},
+			{Usuario: "panel", Clave: "sha256:" + hex.EncodeToString(suma[:])},
+		},
+		Tokens: []TokenAuth{{Token: "tok-panel", Usuario: "panel"}},
+		ACL: []ReglaACL{
+			{Usuario: "sensor1", Publicar: []string{"planta/+/temp"}, Suscribir: []string{"dispositivos/{usuario}/#"}},
+			{Usuario: "panel", Suscribir: []string{"planta/#"}, Publicar: []string{"actuadores/#"}},
+			{Usuario: "*", Suscribir: []string{"publico/+"}},
+		},
+	}
+}
+
+func TestPatronIncluido(t *testing.T) {
+	casos := []struct {
+		solicitado, permitido string
+		espera                bool
+	}{
+		{"planta/sala/temp", "planta/#", true},
+		{"planta/+/temp", "planta/#", true},
+		{"planta", "planta/#", true},
+		{"planta/+/temp", "planta/+/temp", true},
+		{"planta/sala/temp", "planta/+/temp", true},
+		{"planta/#", "planta/+/temp", false},
+		{"#", "planta/#", false},
+		{"planta/+/temp", "planta/sala/temp", false},
+		{"planta/sala", "planta/+/temp", false},
+		{"otra/sala/temp", "planta/#", false},
+	}
+	for _, c := range casos {
+		if got := patronIncluido(c.solicitado, c.permitido); got != c.espera {
+			t.Errorf("patronIncluido(%q, %q) = %v, want %v", c.solicitado, c.permitido, got, c.espera)
+		}
+	}
+}
+
+func TestConfiguracionAuth_Autenticar(t *testing.T) {
+	config := configuracionAuthTest()
+
+	casos := []struct {
+		nombre  string
+		cred    Credenciales
+		usuario string
+		ok      bool
+	}{
+		{"clave en texto plano", Credenciales{Usuario: "sensor1", Clave: "secreto"}, "sensor1", true},
+		{"clave con hash", Credenciales{Usuario: "panel", Clave: "clave-hash"}, "panel", true},
+		{"token", Credenciales{Token: "tok-panel"}, "panel", true},
+		{"clave incorrecta", Credenciales{Usuario: "sensor1", Clave: "otra"}, "", false},
+		{"token desconocido", Credenciales{Token: "x"}, "", false},
+		{"anónimo no permitido", Credenciales{}, "", false},
+	}
+	for _, c := range casos {
+		usuario, err := config.Autenticar(c.cred)
+		if (err == nil) != c.ok || usuario != c.usuario {
+			t.Errorf("%s: usuario=%q err=%v", c.nombre, usuario, err)
+		}
+	}
+
+	config.PermitirAnonimos = true
+	if usuario, err := config.Autenticar(Credenciales{}); err != nil || usuario != UsuarioAnonimo {
+		t.Errorf("anónimo permitido: usuario=%q err=%v", usuario, err)
+	}
+}
+
+func TestConfiguracionAuth_Autorizar(t *testing.T) {
+	config := configuracionAuthTest()
+
+	casos := []struct {
+		usuario string
+		accion  AccionACL
+		topico  string
+		espera  bool
+	}{
+		{"sensor1", AccionPublicar, "planta/sala/temp", true},
+		{"sensor1", AccionPublicar, "actuadores/valvula", false},
+		{"sensor1", AccionSuscribir, "dispositivos/sensor1/config", true},
+		{"sensor1", AccionSuscribir, "dispositivos/sensor2/config", false},
+		{"sensor1", AccionSuscribir, "publico/avisos", true},
+		{"panel", AccionSuscribir, "planta/+/temp", true},
+		{"panel", AccionSuscribir, "#", false},
+		{"panel", AccionPublicar, "actuadores/valvula", true},
+		{UsuarioAnonimo, AccionSuscribir, "publico/avisos", true},
+		{UsuarioAnonimo, AccionPublicar, "publico/avisos", false},
+	}
+	for _, c := range casos {
+		if got := config.Autorizar(c.usuario, c.accion, c.topico); got != c.espera {
+			t.Errorf("Autorizar(%s, %s, %s) = %v, want %v", c.usuario, c.accion, c.topico, got, c.espera)
+		}
+	}
+}
+
+func TestCargarConfiguracionAuth(t *testing.T) {
+	dir := t.TempDir()
+
+	ruta := filepath.Join(dir, "auth.json")
+	datos, _ := json.Marshal(configuracionAuthTest())
+	if err := os.WriteFile(ruta, datos, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := CargarConfiguracionAuth(ruta)
+	if err != nil {
+		t.Fatalf("CargarConfiguracionAuth() error = %v", err)
+	}
+	if len(config.Usuarios) != 2 || len(config.ACL) != 3 {
+		t.Errorf("configuración incompleta: %+v", config)
+	}
+
+	invalida := filepath.Join(dir, "invalida.json")
+	os.WriteFile(invalida, []byte(`{"acl":[{"usuario":"x","publicar":["a/#/b"]}]}`), 0o600)
+	if _, err := CargarConfiguracionAuth(invalida); err == nil {
+		t.Error("esperaba error por patrón inválido")
+	}
+}
+
+func TestServidorHTTP_Autorizacion(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", Autorizador: configuracionAuthTest()})
+
+	publicar := func(topico string, configurar func(*http.Request)) int {
+		cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: topico, Payload: []byte("1")})
+		req, _ := http.NewRequest(http.MethodPost, "http://"+s.direccionHTTP+"/sensorwave?topico="+topico, bytes.NewReader(cuerpo))
+		if configurar != nil {
+			configurar(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error publicando: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := publicar("planta/sala/temp", nil); code != http.StatusUnauthorized {
+		t.Errorf("sin credenciales: status %d, esperaba 401", code)
+	}
+	conSensor := func(r *http.Request) { r.SetBasicAuth("sensor1", "secreto") }
+	if code := publicar("actuadores/valvula", conSensor); code != http.StatusForbidden {
+		t.Errorf("tópico no permitido: status %d, esperaba 403", code)
+	}
+	if code := publicar("planta/sala/temp", conSensor); code != http.StatusOK {
+		t.Errorf("tópico permitido: status %d, esperaba 200", code)
+	}
+	conToken := func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok-panel") }
+	if code := publicar("actuadores/valvula", conToken); code != http.StatusOK {
+		t.Errorf("token: status %d, esperaba 200", code)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+s.direccionHTTP+"/sensorwave?topico=%23", nil)
+	req.Header.Set("Authorization", "Bearer tok-panel")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error suscribiendo: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("suscripción a # no permitida: status %d, esperaba 403", resp.StatusCode)
+	}
+}
+
+// TestServidorHTTP_ClienteDeOtroUsuario verifica que solo quien creó la suscripción
+// pueda cancelarla o confirmar sus mensajes
+func TestServidorHTTP_ClienteDeOtroUsuario(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", Autorizador: configuracionAuthTest()})
+	base := "http://" + s.direccionHTTP + "/sensorwave"
+
+	req, _ := http.NewRequest(http.MethodGet, base+"?topico=planta/%23", nil)
+	req.Header.Set("Authorization", "Bearer tok-panel")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error suscribiendo: %v", err)
+	}
+	defer resp.Body.Close()
+	var inicial struct{ ClienteID string }
+	lector := bufio.NewScanner(resp.Body)
+	for inicial.ClienteID == "" && lector.Scan() {
+		if dato, ok := strings.CutPrefix(lector.Text(), "data: "); ok {
+			json.Unmarshal([]byte(dato), &inicial)
+		}
+	}
+	if inicial.ClienteID == "" {
+		t.Fatal("no se recibió el clienteID")
+	}
+
+	solicitar := func(metodo, url string, cuerpo []byte, configurar func(*http.Request)) int {
+		req, _ := http.NewRequest(metodo, url, bytes.NewReader(cuerpo))
+		configurar(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", metodo, url, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	conSensor := func(r *http.Request) { r.SetBasicAuth("sensor1", "secreto") }
+	conPanel := func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok-panel") }
+
+	ack, _ := json.Marshal(solicitudAck{ClienteID: inicial.ClienteID, MensajeID: "m1"})
+	if code := solicitar(http.MethodPost, base+"/ack", ack, conSensor); code != http.StatusForbidden {
+		t.Errorf("ACK de otro usuario: status %d, esperaba 403", code)
+	}
+	desuscribir := base + "?topico=planta/%23&clienteID=" + inicial.ClienteID
+	if code := solicitar(http.MethodDelete, desuscribir, nil, conSensor); code != http.StatusForbidden {
+		t.Errorf("desuscripción de otro usuario: status %d, esperaba 403", code)
+	}
+	if code := solicitar(http.MethodDelete, desuscribir, nil, conPanel); code != http.StatusOK {
+		t.Errorf("desuscripción propia: status %d, esperaba 200", code)
+	}
+}
+
+func TestHookAuthMQTT(t *testing.T) {
+	s := nuevoServidor(Opciones{Autorizador: configuracionAuthTest()})
+	h := &hookAuthMQTT{servidor: s}
+
+	conectar := func(usuario, clave string) (*mochi.Client, bool) {
+		cl := &mochi.Client{ID: "cliente-" + usuario}
+		var pk packets.Packet
+		pk.Connect.Username = []byte(usuario)
+		pk.Connect.Password = []byte(clave)
+		return cl, h.OnConnectAuthenticate(cl, pk)
+	}
+
+	if _, ok := conectar("sensor1", "mala"); ok {
+		t.Error("CONNECT con clave incorrecta debería rechazarse")
+	}
+
+	sensor, ok := conectar("sensor1", "secreto")
+	if !ok {
+		t.Fatal("CONNECT con usuario/clave debería aceptarse")
+	}
+	if !h.OnACLCheck(sensor, "planta/sala/temp", true) {
+		t.Error("publicación permitida rechazada")
+	}
+	if h.OnACLCheck(sensor, "actuadores/valvula", true) {
+		t.Error("publicación no permitida aceptada")
+	}
+
+	panel, ok := conectar("", "tok-panel")
+	if !ok {
+		t.Fatal("CONNECT con token como clave debería aceptarse")
+	}
+	if !h.OnACLCheck(panel, "planta/+/temp", false) {
+		t.Error("suscripción permitida rechazada")
+	}
+
+	h.OnDisconnect(panel, nil, false)
+	if h.OnACLCheck(panel, "planta/+/temp", false) {
+		t.Error("un cliente desconectado no debería tener identidad")
+	}
+}
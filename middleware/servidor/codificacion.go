@@ -0,0 +1,105 @@
+package servidor
+
+import (
+	"fmt"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/mux"
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/mensaje"
+)
+
+// Negociación de la codificación del Mensaje (JSON o CBOR, ver internal/mensaje).
+//
+// Cada publicación se decodifica según su tipo de contenido y se distribuye como
+// Mensaje, de modo que un publicante CBOR llega a suscriptores JSON y viceversa:
+//   - HTTP: Content-Type application/cbor en el POST. El stream SSE es texto y siempre
+//     entrega JSON.
+//   - CoAP: Content-Format 60 (application/cbor) en el POST; el observador pide la
+//     codificación de sus notificaciones con la opción Accept.
+//   - MQTT: ContentType application/cbor (MQTT 5), la propiedad de usuario
+//     codificacion=cbor o, en MQTT 3.1.1, el primer byte del payload. Los suscriptores
+//     MQTT reciben en la codificación del publicante lo que publicó un cliente MQTT
+//     (con el origen y los saltos registrados) y en JSON lo que ingresa por otros
+//     protocolos; los clientes detectan la codificación al leer.
+
+const (
+	tipoCBOR = mensaje.TipoCBOR
+
+	// propiedadCodificacion es la propiedad de usuario MQTT 5 que indica la codificación
+	propiedadCodificacion = "codificacion"
+)
+
+var (
+	codificarMensaje   = mensaje.Codificar
+	decodificarMensaje = mensaje.Decodificar
+)
+
+// codificacionDeFormatoCoAP traduce un Content-Format o Accept CoAP ("" si no hay)
+func codificacionDeFormatoCoAP(formato message.MediaType, err error) middleware.Codificacion {
+	if err != nil {
+		return ""
+	}
+	switch formato {
+	case message.AppCBOR:
+		return middleware.CodificacionCBOR
+	case message.AppJSON, message.TextPlain:
+		return middleware.CodificacionJSON
+	}
+	return ""
+}
+
+// codificacionObservadorCoAP retorna la codificación que pide un observador con Accept
+func codificacionObservadorCoAP(r *mux.Message) middleware.Codificacion {
+	if c := codificacionDeFormatoCoAP(r.Accept()); c != "" {
+		return c
+	}
+	return middleware.CodificacionJSON
+}
+
+// formatoCoAP retorna el Content-Format de las notificaciones de una codificación
+func formatoCoAP(c middleware.Codificacion) message.MediaType {
+	if c == middleware.CodificacionCBOR {
+		return message.AppCBOR
+	}
+	return message.TextPlain
+}
+
+// codificacionPaqueteMQTT retorna la codificación declarada en las propiedades de un
+// PUBLISH MQTT 5 ("" si no la declara y hay que detectarla)
+func codificacionPaqueteMQTT(pk packets.Packet) middleware.Codificacion {
+	if c := mensaje.CodificacionDeTipo(pk.Properties.ContentType); c != "" {
+		return c
+	}
+	for _, p := range pk.Properties.User {
+		if p.Key == propiedadCodificacion {
+			return middleware.Codificacion(p.Val)
+		}
+	}
+	return ""
+}
+
+// recodificarPaqueteMQTT reemplaza el payload de un PUBLISH por el Mensaje distribuido,
+// en la codificación del publicante, para que los suscriptores MQTT reciban los saltos
+func recodificarPaqueteMQTT(pk *packets.Packet, m Mensaje) error {
+	c := codificacionPaqueteMQTT(*pk)
+	if c == "" {
+		c = mensaje.DetectarCodificacion(pk.Payload)
+	}
+	datos, err := codificarMensaje(m, c)
+	if err != nil {
+		return err
+	}
+	pk.Payload = datos
+	return nil
+}
+
+// decodificarPaqueteMQTT decodifica el Mensaje de un PUBLISH en la codificación declarada o detectada
+func decodificarPaqueteMQTT(pk packets.Packet) (Mensaje, error) {
+	m, err := decodificarMensaje(pk.Payload, codificacionPaqueteMQTT(pk))
+	if err != nil {
+		return Mensaje{}, fmt.Errorf("no se pudo procesar el cuerpo: %v", err)
+	}
+	return m, nil
+}
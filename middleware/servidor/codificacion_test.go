@@ -0,0 +1,121 @@
+package servidor
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	clientecoap "github.com/sensorwave-dev/sensorwave/middleware/cliente_coap"
+	clientehttp "github.com/sensorwave-dev/sensorwave/middleware/cliente_http"
+	clientemqtt "github.com/sensorwave-dev/sensorwave/middleware/cliente_mqtt"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/mensaje"
+)
+
+func esperarLineaSSE(t *testing.T, lineas <-chan string, payload string) {
+	t.Helper()
+	select {
+	case dato := <-lineas:
+		var m Mensaje
+		if err := json.Unmarshal([]byte(dato), &m); err != nil || string(m.Payload) != payload {
+			t.Errorf("línea SSE = %q, esperaba JSON con payload %q", dato, payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no se recibió %q por SSE", payload)
+	}
+}
+
+// TestCodificacion_CBOREntreProtocolos publica en CBOR por CoAP, HTTP y MQTT y verifica
+// que el servidor transcodifica para suscriptores JSON y CBOR de los otros protocolos
+func TestCodificacion_CBOREntreProtocolos(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0", PuertoMQTT: "0"})
+	_, puertoCoAP, _ := net.SplitHostPort(s.direccionCoAP)
+	_, puertoHTTP, _ := net.SplitHostPort(s.direccionHTTP)
+	_, puertoMQTT, _ := net.SplitHostPort(s.direccionMQTT)
+	cbor := middleware.ConCodificacion(middleware.CodificacionCBOR)
+
+	suscribirCoAP := func(opciones ...middleware.ConectarOpcion) (*clientecoap.ClienteCoAP, <-chan string) {
+		c, err := clientecoap.Conectar("127.0.0.1", puertoCoAP, opciones...)
+		if err != nil {
+			t.Fatalf("Conectar CoAP: %v", err)
+		}
+		t.Cleanup(c.Desconectar)
+		recibidos := make(chan string, 1)
+		if err := c.Suscribir("sensores/#", func(_ string, payload []byte) { recibidos <- string(payload) }); err != nil {
+			t.Fatalf("Suscribir CoAP: %v", err)
+		}
+		return c, recibidos
+	}
+	coapCBOR, recibidosCBOR := suscribirCoAP(cbor)
+	_, recibidosJSON := suscribirCoAP()
+	lineas := suscribirSSE(t, s, "sensores/#")
+	cMQTT, err := clientemqtt.Conectar("127.0.0.1", puertoMQTT)
+	if err != nil {
+		t.Fatalf("Conectar MQTT: %v", err)
+	}
+	defer cMQTT.Desconectar()
+	recibidosMQTT := make(chan string, 1)
+	if err := cMQTT.Suscribir("sensores/#", func(_ string, payload []byte) { recibidosMQTT <- string(payload) }); err != nil {
+		t.Fatalf("Suscribir MQTT: %v", err)
+	}
+
+	// CoAP con Content-Format CBOR
+	if err := coapCBOR.Publicar("sensores/temp", "21.5"); err != nil {
+		t.Fatalf("Publicar CoAP: %v", err)
+	}
+	esperarPayload(t, recibidosCBOR, "21.5")
+	esperarPayload(t, recibidosJSON, "21.5")
+	esperarLineaSSE(t, lineas, "21.5")
+	esperarPayload(t, recibidosMQTT, "21.5")
+
+	// HTTP con Content-Type application/cbor
+	cHTTP, err := clientehttp.Conectar("localhost", puertoHTTP, cbor)
+	if err != nil {
+		t.Fatalf("Conectar HTTP: %v", err)
+	}
+	defer cHTTP.Desconectar()
+	if err := cHTTP.Publicar("sensores/hum", "60"); err != nil {
+		t.Fatalf("Publicar HTTP: %v", err)
+	}
+	esperarPayload(t, recibidosCBOR, "60")
+	esperarPayload(t, recibidosJSON, "60")
+	esperarLineaSSE(t, lineas, "60")
+	esperarPayload(t, recibidosMQTT, "60")
+
+	// MQTT 3.1.1 sin propiedades: el servidor detecta CBOR por el primer byte y los
+	// suscriptores MQTT reciben el CBOR original
+	publicadorMQTT, err := clientemqtt.Conectar("127.0.0.1", puertoMQTT, cbor)
+	if err != nil {
+		t.Fatalf("Conectar MQTT: %v", err)
+	}
+	defer publicadorMQTT.Desconectar()
+	if err := publicadorMQTT.Publicar("sensores/co2", "415"); err != nil {
+		t.Fatalf("Publicar MQTT: %v", err)
+	}
+	esperarPayload(t, recibidosCBOR, "415")
+	esperarPayload(t, recibidosJSON, "415")
+	esperarLineaSSE(t, lineas, "415")
+	esperarPayload(t, recibidosMQTT, "415")
+}
+
+func TestCodificacion_HTTPCBORInvalido(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	publicar := func(cuerpo []byte) int {
+		resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico=sensores/temp", tipoCBOR, bytes.NewReader(cuerpo))
+		if err != nil {
+			t.Fatalf("error publicando: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	valido := mensaje.CodificarCBOR(Mensaje{Original: true, Topico: "sensores/temp", Payload: []byte("1")})
+	if codigo := publicar(valido); codigo != http.StatusOK {
+		t.Errorf("publicación CBOR = %d, esperaba 200", codigo)
+	}
+	if codigo := publicar(valido[:len(valido)-1]); codigo != http.StatusBadRequest {
+		t.Errorf("publicación CBOR truncada = %d, esperaba 400", codigo)
+	}
+}
@@ -0,0 +1,469 @@
+package servidor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/sensorwave-dev/sensorwave/middleware/formatos"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/qos"
+)
+
+const LOG_COMPARTIDAS = "COMPARTIDAS"
+
+// Suscripciones compartidas ($share/<grupo>/<filtro>, como en MQTT 5): cada mensaje que
+// coincide con el filtro se entrega a un solo miembro del grupo, sin importar si el
+// miembro es un stream SSE, un WebSocket, una observación CoAP o un cliente MQTT. Los
+// miembros no se registran aparte: son las suscripciones de cada protocolo cuyo patrón
+// es el $share completo, que el fanout normal nunca alcanza porque ningún tópico de
+// publicación empieza con $share. Un QoS 1 sin ACK dentro del plazo se reentrega a otro
+// miembro del grupo con el mismo backoff que el redelivery HTTP. Un QoS 2 se reintenta
+// en el mismo miembro mientras siga en el grupo (como exige MQTT 5), que descarta las
+// repeticiones por MensajeID; a un miembro MQTT lo completa el broker con PUBREC/PUBREL.
+const prefijoCompartida = "$share/"
+
+var (
+	errCompartidaInvalida = errors.New("suscripción compartida inválida")
+	errCanalBloqueado     = errors.New("canal bloqueado")
+)
+
+// Distribucion elige a qué miembro de una suscripción compartida se entrega cada mensaje
+type Distribucion string
+
+const (
+	// DistribucionRoundRobin rota entre los miembros del grupo (por defecto)
+	DistribucionRoundRobin Distribucion = "round-robin"
+	// DistribucionMenorInflight elige al miembro con menos QoS 1 sin confirmar;
+	// los empates se resuelven en orden round-robin
+	DistribucionMenorInflight Distribucion = "menor-inflight"
+)
+
+// parsearCompartida separa un patrón normalizado $share/<grupo>/<filtro>. ok es false si
+// el patrón no es compartido; err indica un patrón compartido mal formado.
+func parsearCompartida(patron string) (grupo, filtro string, ok bool, err error) {
+	if patron == strings.TrimSuffix(prefijoCompartida, "/") {
+		return "", "", true, errCompartidaInvalida
+	}
+	resto, ok := strings.CutPrefix(patron, prefijoCompartida)
+	if !ok {
+		return "", "", false, nil
+	}
+	grupo, filtro, _ = strings.Cut(resto, "/")
+	if grupo == "" || grupo == "+" || grupo == "#" || filtro == "" {
+		return "", "", true, errCompartidaInvalida
+	}
+	return grupo, filtro, true, nil
+}
+
+// filtroSuscripcion retorna el filtro que decide qué tópicos recibe un patrón de
+// suscripción normalizado: el propio patrón o, si es compartido, el que sigue al grupo
+func filtroSuscripcion(patron string) (string, error) {
+	_, filtro, ok, err := parsearCompartida(patron)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return patron, nil
+	}
+	return filtro, nil
+}
+
+// esCompartida indica si un patrón de suscripción normalizado es compartido
+func esCompartida(patron string) bool {
+	return strings.HasPrefix(patron, prefijoCompartida)
+}
+
+// miembroCompartido es una suscripción de cualquier protocolo que integra un grupo.
+// entregar retorna true si el miembro confirmará el mensaje con un ACK.
+type miembroCompartido struct {
+	id       string
+	entregar func(m Mensaje, plazo time.Duration) (bool, error)
+}
+
+// registroCompartidas guarda el estado de la distribución entre los miembros de cada
+// grupo y los QoS 1 entregados que esperan ACK
+type registroCompartidas struct {
+	distribucion Distribucion
+
+	mu       sync.Mutex
+	ultimo   map[string]string        // patrón -> último miembro elegido
+	inflight map[string]int           // miembro -> QoS 1 sin confirmar
+	esperas  map[string]chan struct{} // mensajeID|miembro -> se cierra con el ACK
+	paquetes map[string]string        // clienteMQTT|packetID -> mensajeID
+}
+
+func nuevoRegistroCompartidas(distribucion Distribucion) *registroCompartidas {
+	if distribucion == "" {
+		distribucion = DistribucionRoundRobin
+	}
+	return &registroCompartidas{
+		distribucion: distribucion,
+		ultimo:       make(map[string]string),
+		inflight:     make(map[string]int),
+		esperas:      make(map[string]chan struct{}),
+		paquetes:     make(map[string]string),
+	}
+}
+
+func validarDistribucion(d Distribucion) error {
+	switch d {
+	case "", DistribucionRoundRobin, DistribucionMenorInflight:
+		return nil
+	}
+	return fmt.Errorf("distribución de suscripciones compartidas desconocida: %q", d)
+}
+
+// elegir retorna el próximo miembro del grupo, prefiriendo los que aún no recibieron el
+// mensaje. Los miembros se ordenan por ID para que la rotación sea estable aunque las
+// suscripciones se recolecten desde mapas.
+func (r *registroCompartidas) elegir(patron string, miembros []miembroCompartido, intentados map[string]bool) (miembroCompartido, bool) {
+	candidatos := make([]miembroCompartido, 0, len(miembros))
+	for _, m := range miembros {
+		if !intentados[m.id] {
+			candidatos = append(candidatos, m)
+		}
+	}
+	if len(candidatos) == 0 {
+		candidatos = append(candidatos, miembros...)
+	}
+	if len(candidatos) == 0 {
+		return miembroCompartido{}, false
+	}
+	sort.Slice(candidatos, func(i, j int) bool { return candidatos[i].id < candidatos[j].id })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Orden round-robin: a partir del siguiente al último elegido
+	inicio := sort.Search(len(candidatos), func(i int) bool { return candidatos[i].id > r.ultimo[patron] })
+	elegido := candidatos[inicio%len(candidatos)]
+	if r.distribucion == DistribucionMenorInflight {
+		for i := 1; i < len(candidatos); i++ {
+			c := candidatos[(inicio+i)%len(candidatos)]
+			if r.inflight[c.id] < r.inflight[elegido.id] {
+				elegido = c
+			}
+		}
+	}
+	r.ultimo[patron] = elegido.id
+	return elegido, true
+}
+
+// esperar registra un QoS 1 entregado a un miembro. El canal se cierra cuando el miembro
+// lo confirma; liberar descarta la espera y debe invocarse siempre.
+func (r *registroCompartidas) esperar(mensajeID, miembro string) (<-chan struct{}, func()) {
+	clave := mensajeID + "|" + miembro
+	confirmado := make(chan struct{})
+	r.mu.Lock()
+	r.esperas[clave] = confirmado
+	r.inflight[miembro]++
+	r.mu.Unlock()
+	return confirmado, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.esperas[clave] == confirmado {
+			delete(r.esperas, clave)
+		}
+		if r.inflight[miembro]--; r.inflight[miembro] <= 0 {
+			delete(r.inflight, miembro)
+		}
+	}
+}
+
+// confirmar registra el ACK de un miembro; un ACK sin espera pendiente se ignora
+func (r *registroCompartidas) confirmar(mensajeID, miembro string) {
+	clave := mensajeID + "|" + miembro
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if confirmado, ok := r.esperas[clave]; ok {
+		close(confirmado)
+		delete(r.esperas, clave)
+	}
+}
+
+// registrarPaqueteMQTT asocia el packet ID de una entrega MQTT con su mensaje hasta
+// que llegue el PUBACK o venza el plazo
+func (r *registroCompartidas) registrarPaqueteMQTT(cliente string, packetID uint16, mensajeID string, plazo time.Duration) {
+	clave := fmt.Sprintf("%s|%d", cliente, packetID)
+	r.mu.Lock()
+	r.paquetes[clave] = mensajeID
+	r.mu.Unlock()
+	time.AfterFunc(plazo, func() {
+		r.mu.Lock()
+		if r.paquetes[clave] == mensajeID {
+			delete(r.paquetes, clave)
+		}
+		r.mu.Unlock()
+	})
+}
+
+// confirmarPaqueteMQTT traduce el PUBACK de un cliente MQTT al ACK de su entrega
+func (r *registroCompartidas) confirmarPaqueteMQTT(cliente string, packetID uint16) {
+	clave := fmt.Sprintf("%s|%d", cliente, packetID)
+	r.mu.Lock()
+	mensajeID, ok := r.paquetes[clave]
+	delete(r.paquetes, clave)
+	r.mu.Unlock()
+	if ok {
+		r.confirmar(mensajeID, miembroMQTT(cliente))
+	}
+}
+
+func miembroHTTP(clienteID string) string { return "http:" + clienteID }
+func miembroMQTT(clienteID string) string { return "mqtt:" + clienteID }
+
+// enviarCompartidas entrega el mensaje a un solo miembro de cada suscripción compartida
+// que coincide con su tópico. Acompaña a enviarHTTP, enviarCoAP y enviarMQTT en cada
+// punto de fanout.
+func (s *Servidor) enviarCompartidas(LOG string, m Mensaje) {
+	if EsTopicoControl(m.Topico) || validarQoS(m) != nil || s.descartarExpirado(LOG, m) {
+		return
+	}
+	publicacion, err := normalizarYValidarTopico(m.Topico, false)
+	if err != nil {
+		return
+	}
+	for patron, miembros := range s.miembrosCompartidos(publicacion) {
+		e := &entregaCompartida{
+			LOG:         LOG,
+			patron:      patron,
+			publicacion: publicacion,
+			m:           m,
+			intentados:  make(map[string]bool),
+			plazo:       qos.JitterAckTimeout(),
+		}
+		s.entregarCompartida(e, miembros)
+	}
+}
+
+// entregaCompartida es el estado de la entrega de un mensaje a un grupo compartido
+// entre reintentos
+type entregaCompartida struct {
+	LOG, patron, publicacion string
+	m                        Mensaje
+	intentados               map[string]bool
+	elegido                  string
+	plazo                    time.Duration
+	intento                  int
+}
+
+// entregarCompartida entrega un mensaje a un miembro del grupo. Si la entrega falla
+// prueba con otro miembro; con todos probados vuelve a empezar la rotación, hasta agotar
+// las retransmisiones. Un QoS 2 solo cambia de miembro si el elegido dejó el grupo. La
+// elección y el envío son sincrónicos, así los mensajes llegan a los miembros en el
+// orden de publicación; solo la espera del ACK de un QoS 1 (y su reentrega) sigue en
+// segundo plano, en esperarAckCompartida.
+func (s *Servidor) entregarCompartida(e *entregaCompartida, miembros []miembroCompartido) {
+	m := e.m
+	for ; e.intento <= qos.MaxRetransmisiones; e.intento++ {
+		if e.intento > 0 {
+			if s.descartarExpirado(e.LOG, m) {
+				return
+			}
+			// Los miembros pueden haber cambiado durante la espera
+			miembros = s.miembrosCompartidos(e.publicacion)[e.patron]
+		}
+		miembro, ok := miembroCompartido{}, false
+		if m.QoS == 2 && e.elegido != "" {
+			miembro, ok = buscarMiembro(miembros, e.elegido)
+		}
+		if !ok {
+			miembro, ok = s.compartidas.elegir(e.patron, miembros, e.intentados)
+		}
+		if !ok {
+			loggerPrint(e.LOG, "Mensaje no entregado - Suscripción compartida sin miembros: %s, Tópico: %s", e.patron, m.Topico)
+			return
+		}
+		e.intentados[miembro.id] = true
+		e.elegido = miembro.id
+
+		confirmado, liberar := (<-chan struct{})(nil), func() {}
+		if m.QoS >= 1 {
+			confirmado, liberar = s.compartidas.esperar(m.MensajeID, miembro.id)
+		}
+		requiereAck, err := miembro.entregar(m, e.plazo)
+		if err != nil {
+			liberar()
+			loggerPrint(e.LOG, "Error - No se pudo entregar a miembro de suscripción compartida - Grupo: %s, Miembro: %s, Error: %v", e.patron, miembro.id, err)
+			continue
+		}
+		s.metricas.salientes.sumar("compartidas", 1)
+		if !requiereAck {
+			liberar()
+			return
+		}
+		go s.esperarAckCompartida(e, miembro.id, confirmado, liberar)
+		return
+	}
+	s.metricas.ackVencidos.sumar("compartidas", 1)
+	loggerPrint(e.LOG, "Error - Mensaje no confirmado por ningún miembro - Grupo: %s, MensajeID: %s", e.patron, m.MensajeID)
+}
+
+// esperarAckCompartida espera el ACK de una entrega compartida; si vence el plazo
+// reintenta la entrega con el backoff de retransmisión
+func (s *Servidor) esperarAckCompartida(e *entregaCompartida, miembro string, confirmado <-chan struct{}, liberar func()) {
+	select {
+	case <-confirmado:
+		liberar()
+		return
+	case <-time.After(e.plazo):
+	}
+	liberar()
+	loggerPrint(e.LOG, "ACK vencido en suscripción compartida - Grupo: %s, Miembro: %s, MensajeID: %s", e.patron, miembro, e.m.MensajeID)
+	e.plazo *= qos.FactorBackoff
+	e.intento++
+	s.entregarCompartida(e, nil)
+}
+
+func buscarMiembro(miembros []miembroCompartido, id string) (miembroCompartido, bool) {
+	for _, m := range miembros {
+		if m.id == id {
+			return m, true
+		}
+	}
+	return miembroCompartido{}, false
+}
+
+// miembrosCompartidos recolecta, por patrón $share, los miembros de todos los protocolos
+// cuyo filtro coincide con el tópico de publicación
+func (s *Servidor) miembrosCompartidos(publicacion string) map[string][]miembroCompartido {
+	grupos := make(map[string][]miembroCompartido)
+	coincide := func(patron string) bool {
+		_, filtro, ok, err := parsearCompartida(patron)
+		return ok && err == nil && coincidePatron(publicacion, filtro)
+	}
+
+	s.mutexHTTP.Lock()
+	for patron, clientes := range s.clientesPorTopico {
+		if !coincide(patron) {
+			continue
+		}
+		for _, c := range clientes {
+			if !c.estaCerrado() {
+				grupos[patron] = append(grupos[patron], s.miembroCompartidoHTTP(c))
+			}
+		}
+	}
+	s.mutexHTTP.Unlock()
+
+	s.mutexCoAP.Lock()
+	for patron, conexiones := range s.observadores {
+		if !coincide(patron) {
+			continue
+		}
+		for _, o := range conexiones {
+			grupos[patron] = append(grupos[patron], s.miembroCompartidoCoAP(o))
+		}
+	}
+	s.mutexCoAP.Unlock()
+
+	if broker := s.obtenerBrokerMQTT(); broker != nil {
+		for filtroMQTT, clientes := range broker.Topics.Subscribers(publicacion).Shared {
+			patron, err := normalizarYValidarTopico(filtroMQTT, true)
+			if err != nil || !esCompartida(patron) {
+				continue
+			}
+			for id, sub := range clientes {
+				// Una sesión persistente desconectada no es un miembro disponible
+				if cl, ok := broker.Clients.Get(id); ok && !cl.Closed() {
+					grupos[patron] = append(grupos[patron], miembroCompartidoMQTT(s.compartidas, cl, sub))
+				}
+			}
+		}
+	}
+	return grupos
+}
+
+// miembroCompartidoHTTP entrega por el canal de un stream SSE o de un WebSocket; el ACK
+// llega por POST /sensorwave/ack o por la trama ack
+func (s *Servidor) miembroCompartidoHTTP(c *Cliente) miembroCompartido {
+	return miembroCompartido{
+		id: miembroHTTP(c.ID),
+		entregar: func(m Mensaje, _ time.Duration) (bool, error) {
+			if !c.enviar(s.porReferencia(m, umbralReferenciaHTTP)) {
+				return false, errCanalBloqueado
+			}
+			return m.QoS >= 1, nil
+		},
+	}
+}
+
+// miembroCompartidoCoAP notifica a una observación. Un QoS 1 o 2 viaja como Confirmable
+// y el ACK CoAP del observador, recibido dentro del plazo, confirma la entrega.
+func (s *Servidor) miembroCompartidoCoAP(o Conexion) miembroCompartido {
+	id := "coap:" + o.conexion.RemoteAddr().String() + "/" + fmt.Sprintf("%x", o.token)
+	return miembroCompartido{
+		id: id,
+		entregar: func(m Mensaje, plazo time.Duration) (bool, error) {
+			m = s.porReferencia(m, umbralReferenciaCoAP)
+			if m.QoS == 0 {
+				return false, o.notificar(m, s.valorObserve.Add(1), tipoCoAPPorQoS(m.QoS))
+			}
+			obs := s.valorObserve.Add(1)
+			go func() {
+				ctx, cancelar := context.WithTimeout(context.Background(), plazo)
+				defer cancelar()
+				if err := o.notificarConfirmable(ctx, m, obs); err == nil {
+					s.compartidas.confirmar(m.MensajeID, id)
+				}
+			}()
+			return true, nil
+		},
+	}
+}
+
+// miembroCompartidoMQTT escribe el PUBLISH directamente al cliente elegido: el broker
+// no distribuye las suscripciones compartidas de los mensajes del fanout (ver
+// hookMQTT.OnSelectSubscribers), pero sí guarda el inflight y lo reenvía al reconectar.
+// Un QoS 2 no espera confirmación: el broker completa PUBREC/PUBREL con el cliente.
+func miembroCompartidoMQTT(r *registroCompartidas, cl *mochi.Client, sub packets.Subscription) miembroCompartido {
+	return miembroCompartido{
+		id: miembroMQTT(cl.ID),
+		entregar: func(m Mensaje, plazo time.Duration) (bool, error) {
+			datos, err := json.Marshal(m)
+			if err != nil {
+				return false, err
+			}
+			pk := packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: min(byte(m.QoS), sub.Qos)},
+				TopicName:   m.Topico,
+				Payload:     datos,
+				Created:     time.Now().Unix(),
+			}
+			if pk.FixedHeader.Qos > 0 {
+				id, err := cl.NextPacketID()
+				if err != nil {
+					return false, err
+				}
+				pk.PacketID = uint16(id)
+				if pk.FixedHeader.Qos == 1 {
+					r.registrarPaqueteMQTT(cl.ID, pk.PacketID, m.MensajeID, plazo)
+				}
+				cl.State.Inflight.Set(pk)
+			}
+			if err := cl.WritePacket(pk); err != nil {
+				if pk.FixedHeader.Qos > 0 {
+					cl.State.Inflight.Delete(pk.PacketID)
+				}
+				return false, err
+			}
+			return pk.FixedHeader.Qos == 1, nil
+		},
+	}
+}
+
+// distribuyeCompartidas indica si las suscripciones compartidas de un PUBLISH se
+// resuelven en enviarCompartidas. $SYS, el plano de control y los Sparkplug crudos no
+// pasan por el fanout y los sigue distribuyendo el broker.
+func (s *Servidor) distribuyeCompartidas(topico string) bool {
+	if esTopicoSistema(topico) || EsTopicoControl(topico) {
+		return false
+	}
+	return !(s.normalizaCargas() && formatos.EsTopicoSparkplug(topico))
+}
@@ -0,0 +1,244 @@
+package servidor
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	clientecoap "github.com/sensorwave-dev/sensorwave/middleware/cliente_coap"
+	clientemqtt "github.com/sensorwave-dev/sensorwave/middleware/cliente_mqtt"
+)
+
+func TestParsearCompartida(t *testing.T) {
+	casos := []struct {
+		patron         string
+		grupo, filtro  string
+		compartida, ok bool
+	}{
+		{"$share/trabajadores/comandos/#", "trabajadores", "comandos/#", true, true},
+		{"$share/g/+/temp", "g", "+/temp", true, true},
+		{"comandos/#", "", "", false, true},
+		{"$share", "", "", true, false},
+		{"$share/g", "", "", true, false},
+		{"$share/+/comandos", "", "", true, false},
+		{"$share/#", "", "", true, false},
+	}
+	for _, c := range casos {
+		grupo, filtro, compartida, err := parsearCompartida(c.patron)
+		if grupo != c.grupo || filtro != c.filtro || compartida != c.compartida || (err == nil) != c.ok {
+			t.Errorf("parsearCompartida(%q) = %q, %q, %v, %v", c.patron, grupo, filtro, compartida, err)
+		}
+	}
+}
+
+func TestRegistroCompartidas_MenorInflight(t *testing.T) {
+	r := nuevoRegistroCompartidas(DistribucionMenorInflight)
+	miembros := []miembroCompartido{{id: "c"}, {id: "a"}, {id: "b"}}
+	elegir := func() string {
+		m, _ := r.elegir("$share/g/x", miembros, nil)
+		return m.id
+	}
+
+	if id := elegir(); id != "a" {
+		t.Fatalf("primera elección = %s, esperaba a", id)
+	}
+	_, liberarA := r.esperar("m1", "a")
+	_, liberarB := r.esperar("m2", "a")
+	if id := elegir(); id != "b" {
+		t.Errorf("con a ocupado = %s, esperaba b", id)
+	}
+	r.esperar("m3", "b")
+	if id := elegir(); id != "c" {
+		t.Errorf("con a y b ocupados = %s, esperaba c", id)
+	}
+	r.esperar("m4", "c")
+	liberarA()
+	liberarB()
+	if id := elegir(); id != "a" {
+		t.Errorf("con a liberado = %s, esperaba a", id)
+	}
+}
+
+// TestCompartidas_DistribucionEntreProtocolos arma un grupo con un stream SSE, una
+// observación CoAP y un cliente MQTT: cada mensaje llega a un solo miembro, en rotación,
+// mientras que una suscripción normal al mismo filtro recibe todos
+func TestCompartidas_DistribucionEntreProtocolos(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0", PuertoMQTT: "0"})
+	_, puertoCoAP, _ := net.SplitHostPort(s.direccionCoAP)
+	_, puertoMQTT, _ := net.SplitHostPort(s.direccionMQTT)
+	const grupo = "$share/trabajadores/comandos/#"
+
+	var mu sync.Mutex
+	recibidos := map[string][]string{}
+	registrar := func(miembro string) func(string, []byte) {
+		return func(_ string, payload []byte) {
+			mu.Lock()
+			recibidos[miembro] = append(recibidos[miembro], string(payload))
+			mu.Unlock()
+		}
+	}
+
+	lineas := suscribirSSE(t, s, grupo)
+	go func() {
+		for dato := range lineas {
+			var m Mensaje
+			if json.Unmarshal([]byte(dato), &m) == nil {
+				registrar("sse")("", m.Payload)
+			}
+		}
+	}()
+	cCoAP, err := clientecoap.Conectar("127.0.0.1", puertoCoAP)
+	if err != nil {
+		t.Fatalf("Conectar CoAP: %v", err)
+	}
+	t.Cleanup(cCoAP.Desconectar)
+	if err := cCoAP.Suscribir(grupo, registrar("coap")); err != nil {
+		t.Fatalf("Suscribir CoAP: %v", err)
+	}
+	cMQTT, err := clientemqtt.Conectar("127.0.0.1", puertoMQTT)
+	if err != nil {
+		t.Fatalf("Conectar MQTT: %v", err)
+	}
+	t.Cleanup(cMQTT.Desconectar)
+	if err := cMQTT.Suscribir(grupo, registrar("mqtt")); err != nil {
+		t.Fatalf("Suscribir MQTT: %v", err)
+	}
+	todos := suscribirSSE(t, s, "comandos/#")
+
+	for _, p := range []string{"1", "2", "3", "4", "5", "6"} {
+		publicarHTTP(t, s, "comandos/bomba", p)
+	}
+	for range 6 {
+		select {
+		case <-todos:
+		case <-time.After(2 * time.Second):
+			t.Fatal("la suscripción normal no recibió todos los mensajes")
+		}
+	}
+
+	limite := time.Now().Add(3 * time.Second)
+	for {
+		mu.Lock()
+		total := len(recibidos["sse"]) + len(recibidos["coap"]) + len(recibidos["mqtt"])
+		mu.Unlock()
+		if total >= 6 || time.Now().After(limite) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond) // una entrega duplicada llegaría ahora
+	mu.Lock()
+	defer mu.Unlock()
+	unicos := map[string]bool{}
+	for _, miembro := range []string{"sse", "coap", "mqtt"} {
+		if n := len(recibidos[miembro]); n != 2 {
+			t.Errorf("el miembro %s recibió %d mensajes (%v), esperaba 2", miembro, n, recibidos[miembro])
+		}
+		for _, p := range recibidos[miembro] {
+			unicos[p] = true
+		}
+	}
+	if len(unicos) != 6 {
+		t.Errorf("mensajes distintos entregados al grupo = %d, esperaba 6: %v", len(unicos), recibidos)
+	}
+}
+
+// TestCompartidas_OrdenDePublicacion verifica que los mensajes con clave de orden
+// lleguen a los miembros del grupo en el orden en que se publicaron
+func TestCompartidas_OrdenDePublicacion(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	lineas := suscribirSSE(t, s, "$share/trabajadores/comandos/#")
+
+	const total = 100
+	for i := range total {
+		s.distribuir(LOG_HTTP, Mensaje{Original: true, Topico: "comandos/bomba", Payload: []byte(strconv.Itoa(i)), ClaveOrden: "comandos/bomba"}, false)
+	}
+	for i := range total {
+		if m := leerMensajeSSE(t, lineas); string(m.Payload) != strconv.Itoa(i) {
+			t.Fatalf("mensaje %d = %s, los miembros deben recibirlos en orden de publicación", i, m.Payload)
+		}
+	}
+}
+
+// TestCompartidas_RedeliveryQoS1 verifica que un QoS 1 que un miembro no confirma se
+// reentrega a otro miembro del grupo
+func TestCompartidas_RedeliveryQoS1(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	const grupo = "$share/trabajadores/comandos/#"
+
+	// El stream SSE nunca confirma; su ID numérico lo deja primero en la rotación
+	sinAck := suscribirSSE(t, s, grupo)
+	conn := conectarWS(t, s, "")
+	enviarTramaWS(t, conn, tramaWS{Tipo: tramaSuscribir, ID: "1", Topico: grupo})
+	if r := leerTramaWS(t, conn); r.Tipo != tramaOK {
+		t.Fatalf("respuesta a suscribir = %+v", r)
+	}
+
+	cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: "comandos/bomba", Payload: []byte("encender"), QoS: 1, MensajeID: "c1"})
+	resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico=comandos/bomba", "application/json", bytes.NewReader(cuerpo))
+	if err != nil {
+		t.Fatalf("POST error = %v", err)
+	}
+	resp.Body.Close()
+
+	esperarLineaSSE(t, sinAck, "encender")
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var trama tramaWS
+	if err := conn.ReadJSON(&trama); err != nil {
+		t.Fatalf("el mensaje no se reentregó al otro miembro: %v", err)
+	}
+	if trama.Tipo != tramaMensaje || trama.Mensaje == nil || trama.Mensaje.MensajeID != "c1" {
+		t.Fatalf("trama reentregada = %+v", trama)
+	}
+	enviarTramaWS(t, conn, tramaWS{Tipo: tramaAck, MensajeID: "c1"})
+
+	// Confirmado: ninguno de los dos vuelve a recibirlo
+	select {
+	case dato := <-sinAck:
+		t.Errorf("entrega repetida tras el ACK: %s", dato)
+	case <-time.After(3 * time.Second):
+	}
+}
+
+func TestCompartidas_Validaciones(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", Autorizador: configuracionAuthTest()})
+	suscribir := func(topico, query string) int {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+s.direccionHTTP+"/sensorwave?topico="+url.QueryEscape(topico)+query, nil)
+		req.Header.Set("Authorization", "Bearer tok-panel")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET error = %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	casos := []struct {
+		topico, query string
+		codigo        int
+	}{
+		{"$share/g", "", http.StatusBadRequest},
+		{"$share/+/planta/#", "", http.StatusBadRequest},
+		{"$share/g/swctl/#", "", http.StatusForbidden},
+		{"$share/g/dispositivos/#", "", http.StatusForbidden}, // la ACL se aplica al filtro
+		{"$share/g/planta/#", "&sesion=s1", http.StatusBadRequest},
+	}
+	for _, c := range casos {
+		if codigo := suscribir(c.topico, c.query); codigo != c.codigo {
+			t.Errorf("suscripción a %s%s: código %d, esperaba %d", c.topico, c.query, codigo, c.codigo)
+		}
+	}
+
+	if _, err := normalizarYValidarTopico("$share/g/planta/sala", false); err == nil {
+		t.Error("un tópico de publicación no puede empezar con $share")
+	}
+	if _, err := Crear(Opciones{PuertoHTTP: "0", DistribucionCompartida: "aleatoria"}); err == nil {
+		t.Error("esperaba error con una distribución desconocida")
+	}
+}
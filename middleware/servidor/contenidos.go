@@ -0,0 +1,182 @@
+package servidor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/mux"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/mensaje"
+)
+
+// Payloads grandes por referencia (firmware, imágenes).
+//
+// Un mensaje cuyo payload supera el umbral del protocolo se entrega a los suscriptores
+// HTTP y CoAP sin payload y con Mensaje.Referencia; el payload se guarda una sola vez
+// en el almacén de contenidos, en lugar de copiarse en el canal de cada stream SSE, y
+// el suscriptor lo descarga de /sensorwave/contenido. En CoAP la descarga usa Block2 y
+// la publicación Block1 (RFC 7959), que go-coap resuelve de forma transparente; las
+// notificaciones de una observación no admiten block-wise, por eso el umbral CoAP es
+// el de un bloque. MQTT entrega el payload completo.
+
+const (
+	rutaContenido   = mensaje.RutaContenido
+	paramReferencia = mensaje.ParamReferencia
+	tipoBinario     = mensaje.TipoBinario
+
+	umbralReferenciaHTTP = 16 * 1024
+	// umbralReferenciaCoAP deja que el Mensaje en JSON (payload en base64 más los
+	// demás campos) quepa en un bloque de 1024 bytes
+	umbralReferenciaCoAP = 512
+
+	// vigenciaContenido es el tiempo que se conserva un contenido desde su última referencia
+	vigenciaContenido = 10 * time.Minute
+	intervaloLimpieza = time.Minute
+)
+
+var (
+	// tamanoCuerpoJSON es el tamaño máximo de un Mensaje JSON con payload de hasta maximo bytes
+	tamanoCuerpoJSON = mensaje.TamanoCuerpoJSON
+	// leerMensajeBinario reconstruye una publicación HTTP binaria a partir de su query y cuerpo
+	leerMensajeBinario = mensaje.LeerBinario
+)
+
+var errContenidoInexistente = errors.New("contenido inexistente o vencido")
+
+type contenido struct {
+	topico string // la descarga requiere permiso de suscripción al tópico
+	datos  []byte
+	vence  time.Time
+}
+
+// almacenContenidos guarda en memoria los payloads entregados por referencia
+type almacenContenidos struct {
+	mu              sync.Mutex
+	porID           map[string]*contenido
+	proximaLimpieza time.Time
+}
+
+func nuevoAlmacenContenidos() *almacenContenidos {
+	return &almacenContenidos{porID: make(map[string]*contenido)}
+}
+
+// guardar retorna la referencia del payload. La referencia deriva del tópico y el
+// contenido, de modo que los fanouts HTTP y CoAP de un mismo mensaje comparten la copia
+// y cada nueva referencia extiende su vigencia.
+func (a *almacenContenidos) guardar(topico string, datos []byte) string {
+	suma := sha256.New()
+	suma.Write([]byte(topico))
+	suma.Write([]byte{0})
+	suma.Write(datos)
+	id := hex.EncodeToString(suma.Sum(nil)[:16])
+
+	ahora := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ahora.After(a.proximaLimpieza) {
+		for clave, c := range a.porID {
+			if ahora.After(c.vence) {
+				delete(a.porID, clave)
+			}
+		}
+		a.proximaLimpieza = ahora.Add(intervaloLimpieza)
+	}
+	if c := a.porID[id]; c != nil {
+		c.vence = ahora.Add(vigenciaContenido)
+		return id
+	}
+	a.porID[id] = &contenido{topico: topico, datos: datos, vence: ahora.Add(vigenciaContenido)}
+	return id
+}
+
+func (a *almacenContenidos) obtener(id string) (*contenido, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c := a.porID[id]
+	if c == nil || time.Now().After(c.vence) {
+		return nil, false
+	}
+	return c, true
+}
+
+func (l LimitesPayload) conDefectos() LimitesPayload {
+	for _, limite := range []*int{&l.HTTP, &l.CoAP, &l.MQTT} {
+		if *limite <= 0 {
+			*limite = mensaje.TamanoMaximoPayloadDefecto
+		}
+	}
+	return l
+}
+
+// porReferencia reemplaza el payload de m por una referencia al almacén si supera umbral
+func (s *Servidor) porReferencia(m Mensaje, umbral int) Mensaje {
+	if len(m.Payload) <= umbral {
+		return m
+	}
+	m.Referencia = s.contenidos.guardar(m.Topico, m.Payload)
+	m.Payload = nil
+	return m
+}
+
+// contenidoAutorizado retorna el payload referenciado si el cliente puede suscribirse a su tópico
+func (s *Servidor) contenidoAutorizado(id string, cred Credenciales, identidad string) ([]byte, error) {
+	usuario, err := s.autenticar(cred, identidad)
+	if err != nil {
+		return nil, errNoAutenticado
+	}
+	c, ok := s.contenidos.obtener(id)
+	if !ok {
+		return nil, errContenidoInexistente
+	}
+	if !s.autorizar(usuario, AccionSuscribir, c.topico) {
+		return nil, errNoAutorizado
+	}
+	return c.datos, nil
+}
+
+// manejarContenidoHTTP atiende GET /sensorwave/contenido?id=<referencia>
+func (s *Servidor) manejarContenidoHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	datos, err := s.contenidoAutorizado(r.URL.Query().Get(paramReferencia), credencialesHTTP(r), identidadTLS(r.TLS))
+	if errors.Is(err, errContenidoInexistente) {
+		http.Error(w, "Contenido no encontrado", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		responderErrorAuthHTTP(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", tipoBinario)
+	w.Header().Set("Content-Length", strconv.Itoa(len(datos)))
+	_, _ = w.Write(datos)
+}
+
+// manejadorContenidoCoAP atiende GET /sensorwave/contenido?id=<referencia>. go-coap
+// divide la respuesta en bloques Block2 cuando supera el tamaño de bloque.
+func (s *Servidor) manejadorContenidoCoAP(w mux.ResponseWriter, r *mux.Message) {
+	if r.Code() != codes.GET {
+		_ = w.SetResponse(codes.MethodNotAllowed, message.TextPlain, bytes.NewReader([]byte("Método no soportado")))
+		return
+	}
+	id, _ := obtenerQueryCoAP(r, paramReferencia)
+	datos, err := s.contenidoAutorizado(id, credencialesCoAP(r), s.identidadDTLS(w.Conn()))
+	if errors.Is(err, errContenidoInexistente) {
+		_ = w.SetResponse(codes.NotFound, message.TextPlain, bytes.NewReader([]byte("Contenido no encontrado")))
+		return
+	}
+	if err != nil {
+		responderErrorAuthCoAP(w, err)
+		return
+	}
+	_ = w.SetResponse(codes.Content, message.AppOctets, bytes.NewReader(datos))
+}
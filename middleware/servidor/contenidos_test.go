@@ -0,0 +1,197 @@
+package servidor
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	clientecoap "github.com/sensorwave-dev/sensorwave/middleware/cliente_coap"
+	clientehttp "github.com/sensorwave-dev/sensorwave/middleware/cliente_http"
+)
+
+// payloadGrande genera un payload no repetitivo de n bytes
+func payloadGrande(n int) []byte {
+	datos := make([]byte, n)
+	for i := range datos {
+		datos[i] = byte(i * 7 % 251)
+	}
+	return datos
+}
+
+func esperarPayloadGrande(t *testing.T, recibidos <-chan []byte, esperado []byte) {
+	t.Helper()
+	select {
+	case payload := <-recibidos:
+		if !bytes.Equal(payload, esperado) {
+			t.Errorf("payload de %d bytes, esperaba %d bytes iguales al publicado", len(payload), len(esperado))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no se recibió el payload de %d bytes", len(esperado))
+	}
+}
+
+func TestAlmacenContenidos(t *testing.T) {
+	a := nuevoAlmacenContenidos()
+	id := a.guardar("camara/1", []byte("imagen"))
+	if a.guardar("camara/1", []byte("imagen")) != id {
+		t.Error("el mismo tópico y contenido deberían compartir la referencia")
+	}
+	if a.guardar("camara/2", []byte("imagen")) == id {
+		t.Error("otro tópico debería tener otra referencia")
+	}
+	c, ok := a.obtener(id)
+	if !ok || c.topico != "camara/1" || string(c.datos) != "imagen" {
+		t.Errorf("obtener() = %+v, %v", c, ok)
+	}
+	if _, ok := a.obtener("inexistente"); ok {
+		t.Error("una referencia desconocida no debería existir")
+	}
+}
+
+// TestPayloadGrande_HTTPChunked publica un payload binario chunked por encima de los
+// 64 KB; el stream SSE recibe una referencia y el contenido se descarga aparte
+func TestPayloadGrande_HTTPChunked(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", LimitesPayload: LimitesPayload{HTTP: 512 * 1024}})
+	lineas := suscribirSSE(t, s, "firmware/nodo1")
+
+	publicar := func(datos []byte) int {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+s.direccionHTTP+"/sensorwave?topico=firmware/nodo1&original=1", bytes.NewReader(datos))
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error publicando: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	firmware := payloadGrande(300 * 1024)
+	if codigo := publicar(firmware); codigo != http.StatusOK {
+		t.Fatalf("publicación = %d, esperaba 200", codigo)
+	}
+	var m Mensaje
+	select {
+	case dato := <-lineas:
+		json.Unmarshal([]byte(dato), &m)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no se recibió la notificación del payload grande")
+	}
+	if m.Referencia == "" || len(m.Payload) != 0 {
+		t.Fatalf("el stream debería llevar solo la referencia: %d bytes, referencia %q", len(m.Payload), m.Referencia)
+	}
+
+	resp, err := http.Get("http://" + s.direccionHTTP + "/sensorwave/contenido?id=" + m.Referencia)
+	if err != nil {
+		t.Fatalf("error descargando: %v", err)
+	}
+	descargado, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(descargado, firmware) {
+		t.Errorf("descarga = %d con %d bytes, esperaba 200 con el firmware", resp.StatusCode, len(descargado))
+	}
+
+	if codigo := publicar(payloadGrande(600 * 1024)); codigo != http.StatusRequestEntityTooLarge {
+		t.Errorf("publicación sobre el límite = %d, esperaba 413", codigo)
+	}
+}
+
+func TestPayloadGrande_LimitePorDefecto(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: "camara/1", Payload: payloadGrande(70 * 1024)})
+	resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico=camara/1", "application/json", bytes.NewReader(cuerpo))
+	if err != nil {
+		t.Fatalf("error publicando: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("publicación de 70 KB = %d, esperaba 413", resp.StatusCode)
+	}
+}
+
+// TestPayloadGrande_ContenidoRequiereACL verifica que la descarga aplica la ACL de suscripción
+func TestPayloadGrande_ContenidoRequiereACL(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", Autorizador: configuracionAuthTest()})
+	id := s.contenidos.guardar("planta/sala/temp", []byte("datos"))
+
+	descargar := func(usuario, clave string) int {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+s.direccionHTTP+"/sensorwave/contenido?id="+id, nil)
+		if usuario != "" {
+			req.SetBasicAuth(usuario, clave)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error descargando: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if codigo := descargar("", ""); codigo != http.StatusUnauthorized {
+		t.Errorf("descarga anónima = %d, esperaba 401", codigo)
+	}
+	if codigo := descargar("sensor1", "secreto"); codigo != http.StatusForbidden {
+		t.Errorf("descarga sin permiso de suscripción = %d, esperaba 403", codigo)
+	}
+}
+
+// TestPayloadGrande_CoAPBlockwise publica por CoAP con Block1 y entrega a observadores
+// CoAP (descarga con Block2) y a suscriptores HTTP
+func TestPayloadGrande_CoAPBlockwise(t *testing.T) {
+	limites := LimitesPayload{HTTP: 256 * 1024, CoAP: 256 * 1024}
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0", LimitesPayload: limites})
+	_, puertoCoAP, _ := net.SplitHostPort(s.direccionCoAP)
+	_, puertoHTTP, _ := net.SplitHostPort(s.direccionHTTP)
+
+	observador, err := clientecoap.Conectar("127.0.0.1", puertoCoAP, middleware.ConMaximoPayload(limites.CoAP))
+	if err != nil {
+		t.Fatalf("Conectar() error = %v", err)
+	}
+	defer observador.Desconectar()
+	recibidosCoAP := make(chan []byte, 1)
+	if err := observador.Suscribir("camara/+", func(_ string, payload []byte) { recibidosCoAP <- payload }); err != nil {
+		t.Fatalf("Suscribir() error = %v", err)
+	}
+	suscriptorHTTP, _ := clientehttp.Conectar("localhost", puertoHTTP, middleware.ConMaximoPayload(limites.HTTP))
+	defer suscriptorHTTP.Desconectar()
+	recibidosHTTP := make(chan []byte, 1)
+	if err := suscriptorHTTP.Suscribir("camara/+", func(_ string, payload []byte) { recibidosHTTP <- payload }); err != nil {
+		t.Fatalf("Suscribir() error = %v", err)
+	}
+
+	publicador, err := clientecoap.Conectar("127.0.0.1", puertoCoAP, middleware.ConMaximoPayload(limites.CoAP))
+	if err != nil {
+		t.Fatalf("Conectar() error = %v", err)
+	}
+	defer publicador.Desconectar()
+	imagen := payloadGrande(150 * 1024)
+	if err := publicador.Publicar("camara/1", imagen); err != nil {
+		t.Fatalf("Publicar() error = %v", err)
+	}
+	esperarPayloadGrande(t, recibidosCoAP, imagen)
+	esperarPayloadGrande(t, recibidosHTTP, imagen)
+
+	// El cliente HTTP publica el payload grande como cuerpo binario
+	if err := suscriptorHTTP.Publicar("camara/2", imagen); err != nil {
+		t.Fatalf("Publicar() HTTP error = %v", err)
+	}
+	esperarPayloadGrande(t, recibidosCoAP, imagen)
+	esperarPayloadGrande(t, recibidosHTTP, imagen)
+
+	// Un payload pequeño sigue viajando dentro de la notificación
+	if err := publicador.Publicar("camara/1", "ok"); err != nil {
+		t.Fatalf("Publicar() error = %v", err)
+	}
+	esperarPayloadGrande(t, recibidosCoAP, []byte("ok"))
+	esperarPayloadGrande(t, recibidosHTTP, []byte("ok"))
+
+	if err := publicador.Publicar("camara/1", strings.Repeat("x", limites.CoAP+1)); err == nil {
+		t.Error("el cliente debería rechazar un payload mayor que su límite")
+	}
+}
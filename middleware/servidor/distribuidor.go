@@ -1,9 +1,105 @@
 package servidor
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
 
-func enviarCoAP(LOG string, payload Mensaje) {
-	if EsTopicoControl(payload.Topico) {
+// distribuir entrega un mensaje recibido a los suscriptores HTTP, CoAP, MQTT (si
+// haciaMQTT; el broker ya entrega lo que publicó un cliente MQTT) y compartidos, y lo
+// reenvía a los puentes. Cada destino se atiende en su propia goroutine, salvo los
+// mensajes con ClaveOrden: esos se distribuyen a cada destino de a uno por clave, en
+// orden de llegada, sin que un destino lento (p. ej. un puente) retrase a los demás.
+// LOG identifica el origen del mensaje en las métricas.
+func (s *Servidor) distribuir(LOG string, m Mensaje, haciaMQTT bool) {
+	s.metricas.entrantes.sumar(strings.ToLower(LOG), 1)
+	s.metricas.porTopico.sumar(m.Topico, 1)
+	inicio := time.Now()
+	type envio struct {
+		destino string
+		enviar  func()
+	}
+	envios := []envio{
+		{"http", func() { s.enviarHTTP(LOG, m) }},
+		{"coap", func() { s.enviarCoAP(LOG, m) }},
+		{"compartidas", func() { s.enviarCompartidas(LOG, m) }},
+		{"puentes", func() { s.reenviarUpstream(m) }},
+	}
+	if haciaMQTT {
+		envios = append(envios, envio{"mqtt", func() { s.enviarMQTT(LOG, m) }})
+	}
+	// La latencia de cada destino se mide desde que se recibió el mensaje, incluida la
+	// espera en la cola de su clave de orden
+	medir := func(destino string, enviar func()) {
+		enviar()
+		s.metricas.latencias.observar(destino, time.Since(inicio))
+	}
+	if m.ClaveOrden == "" {
+		for _, e := range envios {
+			go medir(e.destino, e.enviar)
+		}
+		return
+	}
+	for _, e := range envios {
+		if !s.orden.ejecutar(e.destino+"|"+m.ClaveOrden, func() { medir(e.destino, e.enviar) }) {
+			s.descartar(descarteColaOrden)
+			loggerPrint(LOG, "Mensaje descartado - Cola de orden llena - Destino: %s, Clave: %s, MensajeID: %s", e.destino, m.ClaveOrden, m.MensajeID)
+		}
+	}
+}
+
+// maxPendientesPorClave limita las distribuciones en espera de cada cola de orden
+const maxPendientesPorClave = 1000
+
+// colasOrden ejecuta en segundo plano las distribuciones con la misma clave de a una,
+// en el orden en que se encolaron. Cada clave con trabajo pendiente tiene una goroutine
+// que termina al vaciarse su cola.
+type colasOrden struct {
+	mu    sync.Mutex
+	colas map[string][]func()
+}
+
+func nuevasColasOrden() *colasOrden {
+	return &colasOrden{colas: make(map[string][]func())}
+}
+
+// ejecutar encola f en la cola de la clave. Retorna false, sin encolarla, si la cola
+// ya tiene maxPendientesPorClave distribuciones en espera.
+func (c *colasOrden) ejecutar(clave string, f func()) bool {
+	c.mu.Lock()
+	pendientes, activa := c.colas[clave]
+	if len(pendientes) >= maxPendientesPorClave {
+		c.mu.Unlock()
+		return false
+	}
+	c.colas[clave] = append(pendientes, f)
+	c.mu.Unlock()
+	if !activa {
+		go c.vaciar(clave)
+	}
+	return true
+}
+
+func (c *colasOrden) vaciar(clave string) {
+	for {
+		c.mu.Lock()
+		cola := c.colas[clave]
+		if len(cola) == 0 {
+			delete(c.colas, clave)
+			c.mu.Unlock()
+			return
+		}
+		f := cola[0]
+		c.colas[clave] = cola[1:]
+		c.mu.Unlock()
+		f()
+	}
+}
+
+func (s *Servidor) enviarCoAP(LOG string, payload Mensaje) {
+	if EsTopicoControl(payload.Topico) || s.descartarExpirado(LOG, payload) {
 		return
 	}
 
@@ -20,24 +116,29 @@ func enviarCoAP(LOG string, payload Mensaje) {
 		return
 	}
 
-	// notifico a todos los observadores
-	mutexCoAP.Lock()
+	// notifico a todos los observadores; las sesiones desconectadas lo encolan completo.
+	// Un payload que no cabe en una notificación se entrega por referencia.
+	s.mutexCoAP.Lock()
+	s.sesiones.encolar(protocoloCoAP, publicacion, payload)
+	payload = s.porReferencia(payload, umbralReferenciaCoAP)
 	totalEnviados := 0
 	totalErrores := 0
-	for patron, conexiones := range observadores {
+	for patron, conexiones := range s.observadores {
 		if !coincidePatron(publicacion, patron) {
 			continue
 		}
 		for _, o := range conexiones {
-			if err := enviarRespuestaConTipo(o.conexion, o.token, payload, valor.Add(1), tipoCoAPPorQoS(payload.QoS)); err != nil {
+			if err := o.notificar(payload, s.valorObserve.Add(1), tipoCoAPPorQoS(payload.QoS)); err != nil {
 				loggerPrint(LOG, "Error - No se pudo enviar a observador CoAP - Tópico: %s, Error: %v", payload.Topico, err)
+				s.descartar(descarteErrorEnvio)
 				totalErrores++
 			} else {
 				totalEnviados++
 			}
 		}
 	}
-	mutexCoAP.Unlock()
+	s.mutexCoAP.Unlock()
+	s.metricas.salientes.sumar("coap", uint64(totalEnviados))
 	if totalEnviados > 0 || totalErrores > 0 {
 		loggerPrint(LOG, "Mensaje distribuido en CoAP - Tópico: %s, Enviados: %d, Errores: %d", payload.Topico, totalEnviados, totalErrores)
 	} else {
@@ -45,8 +146,8 @@ func enviarCoAP(LOG string, payload Mensaje) {
 	}
 }
 
-func enviarHTTP(LOG string, payload Mensaje) {
-	if EsTopicoControl(payload.Topico) {
+func (s *Servidor) enviarHTTP(LOG string, payload Mensaje) {
+	if EsTopicoControl(payload.Topico) || s.descartarExpirado(LOG, payload) {
 		return
 	}
 
@@ -63,32 +164,40 @@ func enviarHTTP(LOG string, payload Mensaje) {
 		return
 	}
 
-	// Enviar el mensaje a todos los clientes suscritos al tópico
-	mutexHTTP.Lock()
+	// Enviar el mensaje a todos los clientes suscritos al tópico; las sesiones desconectadas lo
+	// encolan completo. Un payload grande se entrega por referencia para no copiarlo en cada canal.
+	s.mutexHTTP.Lock()
+	s.sesiones.encolar(protocoloHTTP, publicacion, payload)
+	payload = s.porReferencia(payload, umbralReferenciaHTTP)
 	totalEnviados := 0
 	totalClientes := 0
-	for patron, clientes := range clientesPorTopico {
+	for patron, clientes := range s.clientesPorTopico {
 		totalClientes += len(clientes)
 		if !coincidePatron(publicacion, patron) {
 			continue
 		}
 		for _, cliente := range clientes {
 			totalEnviados++
-			if payload.QoS == 1 {
-				enviarHTTPQoS1(LOG, cliente, payload)
+			s.metricas.salientes.sumar(destinoHTTP(cliente), 1)
+			if payload.QoS >= 1 {
+				s.enviarHTTPQoS1(LOG, cliente, payload)
 				continue
 			}
-			go func(c *Cliente) {
-				select {
-				case c.Canal <- payload:
-					// Éxito silencioso para evitar spam de logs
-				default:
+			enviar := func(c *Cliente) {
+				if !c.enviar(payload) {
 					loggerPrint(LOG, "Error - No se pudo enviar mensaje - ClienteID: %s, Tópico: %s, Razón: canal bloqueado", c.ID, payload.Topico)
+					s.descartar(descarteCanalBloqueado)
 				}
-			}(cliente)
+			}
+			// Con clave de orden se encola en el canal antes de distribuir el siguiente
+			if payload.ClaveOrden != "" {
+				enviar(cliente)
+			} else {
+				go enviar(cliente)
+			}
 		}
 	}
-	mutexHTTP.Unlock()
+	s.mutexHTTP.Unlock()
 	if totalEnviados > 0 {
 		loggerPrint(LOG, "Mensaje distribuido en HTTP - Tópico: %s, Clientes: %d/%d", payload.Topico, totalEnviados, totalClientes)
 	} else {
@@ -96,7 +205,15 @@ func enviarHTTP(LOG string, payload Mensaje) {
 	}
 }
 
-func enviarMQTT(LOG string, payload Mensaje) {
+// enviarMQTT publica en el broker embebido un mensaje que ingresó por otro protocolo.
+// Siempre se serializa en JSON, aunque el publicante haya usado CBOR: el broker entrega
+// los mismos bytes a todos los suscriptores y MQTT 3.1.1 no permite negociar la
+// codificación de cada uno, así que se usa la que entiende cualquier suscriptor (ver
+// codificacion.go). Lo que publica un cliente MQTT conserva su codificación.
+func (s *Servidor) enviarMQTT(LOG string, payload Mensaje) {
+	if s.descartarExpirado(LOG, payload) {
+		return
+	}
 	loggerPrint(LOG, "Distribuyendo mensaje - Destino: MQTT, Tópico: %s, QoS: %d, MensajeID: %s", payload.Topico, payload.QoS, payload.MensajeID)
 
 	mensajeBytes, err := json.Marshal(payload)
@@ -107,13 +224,32 @@ func enviarMQTT(LOG string, payload Mensaje) {
 	// Publicación in-process al broker embebido. Llega directo a los
 	// suscriptores MQTT sin roundtrip TCP. El hook OnPublish detecta el
 	// cliente inline y omite el fanout (sin bucle/rebotado).
-	if brokerMQTT == nil {
+	broker := s.obtenerBrokerMQTT()
+	if broker == nil {
 		loggerPrint(LOG, "Error - Broker MQTT no inicializado")
 		return
 	}
-	if err := brokerMQTT.Publish(payload.Topico, mensajeBytes, false, byte(payload.QoS)); err != nil {
+	if err := broker.Publish(payload.Topico, mensajeBytes, false, byte(payload.QoS)); err != nil {
 		loggerPrint(LOG, "Error - No se pudo publicar mensaje: %v", err)
 		return
 	}
 	loggerPrint(LOG, "Mensaje distribuido en MQTT - Tópico: %s, QoS: %d", payload.Topico, payload.QoS)
 }
+
+// destinoHTTP etiqueta en las métricas la entrega a un suscriptor SSE o WebSocket
+func destinoHTTP(c *Cliente) string {
+	if strings.HasPrefix(c.ID, "ws-") {
+		return "websocket"
+	}
+	return "http"
+}
+
+// descartarExpirado indica si el mensaje venció, en cuyo caso no se entrega
+func (s *Servidor) descartarExpirado(LOG string, m Mensaje) bool {
+	if !m.Expirado() {
+		return false
+	}
+	s.descartar(descarteExpirado)
+	loggerPrint(LOG, "Mensaje expirado descartado - Tópico: %s, MensajeID: %s", m.Topico, m.MensajeID)
+	return true
+}
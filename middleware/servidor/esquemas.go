@@ -0,0 +1,259 @@
+package servidor
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// esquema es el subconjunto de JSON Schema que aplica el registro de tópicos:
+//
+//	type                                  un tipo o una lista de tipos
+//	enum, const                           valores permitidos
+//	properties, required                  campos de un objeto
+//	additionalProperties                  solo booleano: false rechaza campos no declarados
+//	items, minItems, maxItems             listas
+//	minimum, maximum, exclusiveMinimum,   números
+//	exclusiveMaximum
+//	minLength, maxLength, pattern         textos (pattern es una expresión regular de Go)
+//
+// Las anotaciones ($schema, $id, title, description, default, examples) se ignoran.
+// Cualquier otra palabra clave se rechaza al registrar el tópico, para no aceptar en
+// silencio una restricción que no se aplicaría.
+type esquema struct {
+	tipos          []string
+	valores        []any // enum y const
+	propiedades    map[string]*esquema
+	requeridas     []string
+	sinAdicionales bool
+	items          *esquema
+	minItems       *int
+	maxItems       *int
+	minimo         *float64
+	maximo         *float64
+	minimoExcl     *float64
+	maximoExcl     *float64
+	minLongitud    *int
+	maxLongitud    *int
+	patron         *regexp.Regexp
+}
+
+var tiposEsquema = []string{"null", "boolean", "object", "array", "number", "integer", "string"}
+
+var anotacionesEsquema = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true, "default": true, "examples": true,
+}
+
+// compilarEsquema interpreta un JSON Schema
+func compilarEsquema(datos json.RawMessage) (*esquema, error) {
+	var palabras map[string]json.RawMessage
+	if err := json.Unmarshal(datos, &palabras); err != nil {
+		return nil, fmt.Errorf("el esquema debe ser un objeto JSON: %v", err)
+	}
+	e := &esquema{}
+	for clave, valor := range palabras {
+		var err error
+		switch clave {
+		case "type":
+			err = leerTipos(valor, &e.tipos)
+		case "enum":
+			err = json.Unmarshal(valor, &e.valores)
+		case "const":
+			var v any
+			err = json.Unmarshal(valor, &v)
+			e.valores = []any{v}
+		case "properties":
+			var propiedades map[string]json.RawMessage
+			if err = json.Unmarshal(valor, &propiedades); err == nil {
+				e.propiedades = make(map[string]*esquema, len(propiedades))
+				for nombre, sub := range propiedades {
+					if e.propiedades[nombre], err = compilarEsquema(sub); err != nil {
+						return nil, fmt.Errorf("properties.%s: %w", nombre, err)
+					}
+				}
+			}
+		case "required":
+			err = json.Unmarshal(valor, &e.requeridas)
+		case "additionalProperties":
+			var permitidas bool
+			if err = json.Unmarshal(valor, &permitidas); err != nil {
+				err = fmt.Errorf("solo se admite un booleano")
+			}
+			e.sinAdicionales = !permitidas
+		case "items":
+			if e.items, err = compilarEsquema(valor); err != nil {
+				return nil, fmt.Errorf("items: %w", err)
+			}
+		case "minItems":
+			err = json.Unmarshal(valor, &e.minItems)
+		case "maxItems":
+			err = json.Unmarshal(valor, &e.maxItems)
+		case "minimum":
+			err = json.Unmarshal(valor, &e.minimo)
+		case "maximum":
+			err = json.Unmarshal(valor, &e.maximo)
+		case "exclusiveMinimum":
+			err = json.Unmarshal(valor, &e.minimoExcl)
+		case "exclusiveMaximum":
+			err = json.Unmarshal(valor, &e.maximoExcl)
+		case "minLength":
+			err = json.Unmarshal(valor, &e.minLongitud)
+		case "maxLength":
+			err = json.Unmarshal(valor, &e.maxLongitud)
+		case "pattern":
+			var patron string
+			if err = json.Unmarshal(valor, &patron); err == nil {
+				e.patron, err = regexp.Compile(patron)
+			}
+		default:
+			if !anotacionesEsquema[clave] {
+				return nil, fmt.Errorf("palabra clave no soportada: %s", clave)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s inválido: %v", clave, err)
+		}
+	}
+	return e, nil
+}
+
+// leerTipos acepta "type" como texto o como lista de textos
+func leerTipos(valor json.RawMessage, tipos *[]string) error {
+	var uno string
+	if json.Unmarshal(valor, &uno) == nil {
+		*tipos = []string{uno}
+	} else if err := json.Unmarshal(valor, tipos); err != nil {
+		return err
+	}
+	for _, t := range *tipos {
+		if !slices.Contains(tiposEsquema, t) {
+			return fmt.Errorf("tipo desconocido %q", t)
+		}
+	}
+	return nil
+}
+
+// tiposCampos traduce los tipos de DefinicionTopico.Campos a tipos de JSON Schema
+var tiposCampos = map[string]string{
+	"numero":   "number",
+	"entero":   "integer",
+	"texto":    "string",
+	"booleano": "boolean",
+	"objeto":   "object",
+	"lista":    "array",
+}
+
+// esquemaDeCampos construye el esquema de un objeto a partir de la especificación simple
+// de campos: nombre -> tipo, con el sufijo "?" en los campos opcionales
+func esquemaDeCampos(campos map[string]string) (*esquema, error) {
+	e := &esquema{tipos: []string{"object"}, propiedades: make(map[string]*esquema, len(campos))}
+	for nombre, tipo := range campos {
+		tipo, opcional := strings.CutSuffix(tipo, "?")
+		t, ok := tiposCampos[tipo]
+		if !ok {
+			return nil, fmt.Errorf("campo %s: tipo desconocido %q", nombre, tipo)
+		}
+		e.propiedades[nombre] = &esquema{tipos: []string{t}}
+		if !opcional {
+			e.requeridas = append(e.requeridas, nombre)
+		}
+	}
+	sort.Strings(e.requeridas)
+	return e, nil
+}
+
+// validar comprueba un valor decodificado de JSON; ruta ubica el valor en los errores
+func (e *esquema) validar(valor any, ruta string) error {
+	if len(e.tipos) > 0 && !slices.ContainsFunc(e.tipos, func(t string) bool { return esDeTipo(valor, t) }) {
+		return fmt.Errorf("%s: se esperaba %s", ruta, strings.Join(e.tipos, " o "))
+	}
+	if e.valores != nil && !slices.ContainsFunc(e.valores, func(v any) bool { return reflect.DeepEqual(v, valor) }) {
+		return fmt.Errorf("%s: valor no permitido", ruta)
+	}
+	switch v := valor.(type) {
+	case map[string]any:
+		for _, nombre := range e.requeridas {
+			if _, ok := v[nombre]; !ok {
+				return fmt.Errorf("%s: falta el campo %s", ruta, nombre)
+			}
+		}
+		// Orden estable de los errores
+		nombres := make([]string, 0, len(v))
+		for nombre := range v {
+			nombres = append(nombres, nombre)
+		}
+		sort.Strings(nombres)
+		for _, nombre := range nombres {
+			sub, ok := e.propiedades[nombre]
+			if !ok {
+				if e.sinAdicionales {
+					return fmt.Errorf("%s: campo no permitido %s", ruta, nombre)
+				}
+				continue
+			}
+			if err := sub.validar(v[nombre], ruta+"."+nombre); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if e.minItems != nil && len(v) < *e.minItems {
+			return fmt.Errorf("%s: se esperaban al menos %d elementos", ruta, *e.minItems)
+		}
+		if e.maxItems != nil && len(v) > *e.maxItems {
+			return fmt.Errorf("%s: se esperaban a lo sumo %d elementos", ruta, *e.maxItems)
+		}
+		if e.items != nil {
+			for i, elemento := range v {
+				if err := e.items.validar(elemento, fmt.Sprintf("%s[%d]", ruta, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case float64:
+		switch {
+		case e.minimo != nil && v < *e.minimo:
+			return fmt.Errorf("%s: %v es menor que %v", ruta, v, *e.minimo)
+		case e.maximo != nil && v > *e.maximo:
+			return fmt.Errorf("%s: %v es mayor que %v", ruta, v, *e.maximo)
+		case e.minimoExcl != nil && v <= *e.minimoExcl:
+			return fmt.Errorf("%s: %v no es mayor que %v", ruta, v, *e.minimoExcl)
+		case e.maximoExcl != nil && v >= *e.maximoExcl:
+			return fmt.Errorf("%s: %v no es menor que %v", ruta, v, *e.maximoExcl)
+		}
+	case string:
+		longitud := utf8.RuneCountInString(v)
+		switch {
+		case e.minLongitud != nil && longitud < *e.minLongitud:
+			return fmt.Errorf("%s: se esperaban al menos %d caracteres", ruta, *e.minLongitud)
+		case e.maxLongitud != nil && longitud > *e.maxLongitud:
+			return fmt.Errorf("%s: se esperaban a lo sumo %d caracteres", ruta, *e.maxLongitud)
+		case e.patron != nil && !e.patron.MatchString(v):
+			return fmt.Errorf("%s: no coincide con %s", ruta, e.patron)
+		}
+	}
+	return nil
+}
+
+func esDeTipo(valor any, tipo string) bool {
+	switch v := valor.(type) {
+	case nil:
+		return tipo == "null"
+	case bool:
+		return tipo == "boolean"
+	case map[string]any:
+		return tipo == "object"
+	case []any:
+		return tipo == "array"
+	case string:
+		return tipo == "string"
+	case float64:
+		return tipo == "number" || (tipo == "integer" && v == math.Trunc(v))
+	}
+	return false
+}
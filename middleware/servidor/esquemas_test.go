@@ -0,0 +1,71 @@
+package servidor
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEsquema_Validar(t *testing.T) {
+	const temperatura = `{
+		"type": "object",
+		"required": ["valor", "unidad"],
+		"additionalProperties": false,
+		"properties": {
+			"valor":   {"type": "number", "minimum": -50, "maximum": 150},
+			"unidad":  {"enum": ["C", "F"]},
+			"sensor":  {"type": "string", "pattern": "^t[0-9]+$", "maxLength": 8},
+			"lecturas": {"type": "array", "items": {"type": "integer"}, "maxItems": 3}
+		}
+	}`
+	e, err := compilarEsquema(json.RawMessage(temperatura))
+	if err != nil {
+		t.Fatalf("compilarEsquema() error = %v", err)
+	}
+
+	casos := []struct {
+		payload string
+		valido  bool
+		motivo  string
+	}{
+		{payload: `{"valor": 21.5, "unidad": "C"}`, valido: true, motivo: "mínimo requerido"},
+		{payload: `{"valor": 21.5, "unidad": "C", "sensor": "t1", "lecturas": [1, 2]}`, valido: true, motivo: "campos opcionales"},
+		{payload: `{"valor": 21.5}`, valido: false, motivo: "falta un requerido"},
+		{payload: `{"valor": "21.5", "unidad": "C"}`, valido: false, motivo: "tipo incorrecto"},
+		{payload: `{"valor": 200, "unidad": "C"}`, valido: false, motivo: "fuera de rango"},
+		{payload: `{"valor": 21.5, "unidad": "K"}`, valido: false, motivo: "fuera del enum"},
+		{payload: `{"valor": 21.5, "unidad": "C", "extra": 1}`, valido: false, motivo: "campo adicional"},
+		{payload: `{"valor": 21.5, "unidad": "C", "sensor": "x1"}`, valido: false, motivo: "no coincide el patrón"},
+		{payload: `{"valor": 21.5, "unidad": "C", "lecturas": [1.5]}`, valido: false, motivo: "elemento no entero"},
+		{payload: `{"valor": 21.5, "unidad": "C", "lecturas": [1, 2, 3, 4]}`, valido: false, motivo: "demasiados elementos"},
+		{payload: `[21.5]`, valido: false, motivo: "no es un objeto"},
+	}
+	for _, caso := range casos {
+		t.Run(caso.motivo, func(t *testing.T) {
+			var valor any
+			if err := json.Unmarshal([]byte(caso.payload), &valor); err != nil {
+				t.Fatalf("payload inválido: %v", err)
+			}
+			err := e.validar(valor, "$")
+			if (err == nil) != caso.valido {
+				t.Fatalf("validar(%s) = %v, esperaba válido = %v", caso.payload, err, caso.valido)
+			}
+		})
+	}
+}
+
+func TestEsquema_RechazaPalabrasNoSoportadas(t *testing.T) {
+	for _, esquema := range []string{
+		`{"type": "object", "oneOf": []}`,
+		`{"type": "decimal"}`,
+		`{"additionalProperties": {"type": "string"}}`,
+		`{"pattern": "("}`,
+		`[]`,
+	} {
+		if _, err := compilarEsquema(json.RawMessage(esquema)); err == nil {
+			t.Errorf("compilarEsquema(%s) aceptó un esquema no soportado", esquema)
+		}
+	}
+	if _, err := compilarEsquema(json.RawMessage(`{"$schema": "x", "title": "t", "type": ["number", "null"]}`)); err != nil {
+		t.Errorf("compilarEsquema() con anotaciones error = %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package servidor
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func leerMensajeSSE(t *testing.T, lineas <-chan string) Mensaje {
+	t.Helper()
+	select {
+	case dato := <-lineas:
+		var m Mensaje
+		if err := json.Unmarshal([]byte(dato), &m); err != nil {
+			t.Fatalf("mensaje inválido: %v", err)
+		}
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("no se recibió el mensaje")
+	}
+	return Mensaje{}
+}
+
+func TestExpiracion_NoSeEntregaVencido(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	lineas := suscribirSSE(t, s, "actuadores/#")
+	vencido := time.Now().Add(-time.Second).UnixMilli()
+	vigente := time.Now().Add(time.Minute).UnixMilli()
+
+	s.distribuir(LOG_HTTP, Mensaje{Topico: "actuadores/v1", Payload: []byte("vencido"), Expiracion: vencido}, true)
+	s.distribuir(LOG_HTTP, Mensaje{Topico: "actuadores/v1", Payload: []byte("vigente"), Expiracion: vigente}, true)
+	if m := leerMensajeSSE(t, lineas); string(m.Payload) != "vigente" {
+		t.Errorf("payload = %s, esperaba solo el mensaje vigente", m.Payload)
+	}
+
+	// Un mensaje que vence esperando en el canal del suscriptor tampoco se entrega
+	s.mutexHTTP.Lock()
+	var cliente *Cliente
+	for _, c := range s.clientesPorID {
+		cliente = c
+	}
+	s.mutexHTTP.Unlock()
+	cliente.enviar(Mensaje{Topico: "actuadores/v1", Payload: []byte("encolado"), QoS: 1, MensajeID: "m1", Expiracion: vencido})
+	cliente.enviar(Mensaje{Topico: "actuadores/v1", Payload: []byte("siguiente")})
+	if m := leerMensajeSSE(t, lineas); string(m.Payload) != "siguiente" {
+		t.Errorf("payload = %s, el mensaje vencido en el canal no debía entregarse", m.Payload)
+	}
+
+	// Los retenidos vencidos no llegan a los nuevos suscriptores
+	s.retener(Mensaje{Topico: "actuadores/v2", Payload: []byte("x"), Retenido: true, Expiracion: vencido})
+	if retenidos := s.retenidos.coincidentes("actuadores/#"); len(retenidos) != 0 {
+		t.Errorf("retenidos vigentes = %+v, esperaba ninguno", retenidos)
+	}
+}
+
+func TestExpiracion_ColaDeSesion(t *testing.T) {
+	r := nuevoRegistroSesiones(Opciones{})
+	c, _, err := r.conectar(protocoloHTTP, "s1", "actuadores/#", UsuarioAnonimo, nil)
+	if err != nil {
+		t.Fatalf("conectar() error = %v", err)
+	}
+	r.desconectar(c, nil)
+	r.encolar(protocoloHTTP, "actuadores/v1", Mensaje{Topico: "actuadores/v1", Payload: []byte("breve"), Expiracion: time.Now().Add(50 * time.Millisecond).UnixMilli()})
+	r.encolar(protocoloHTTP, "actuadores/v1", Mensaje{Topico: "actuadores/v1", Payload: []byte("vencido"), Expiracion: 1})
+	r.encolar(protocoloHTTP, "actuadores/v1", Mensaje{Topico: "actuadores/v1", Payload: []byte("sin expiracion")})
+	time.Sleep(100 * time.Millisecond)
+
+	_, cola, err := r.conectar(protocoloHTTP, "s1", "actuadores/#", UsuarioAnonimo, nil)
+	if err != nil {
+		t.Fatalf("conectar() error = %v", err)
+	}
+	if got := payloads(cola); got != "sin expiracion" {
+		t.Errorf("cola reanudada = %q, esperaba solo el mensaje sin expiración", got)
+	}
+}
+
+// TestClaveOrden_EntregaEnOrden distribuye en ráfaga mensajes con la misma clave
+func TestClaveOrden_EntregaEnOrden(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	lineas := suscribirSSE(t, s, "actuadores/v1")
+
+	const total = 50
+	for i := 0; i < total; i++ {
+		s.distribuir(LOG_HTTP, Mensaje{Topico: "actuadores/v1", Payload: []byte(strconv.Itoa(i)), ClaveOrden: "v1"}, true)
+	}
+	for i := 0; i < total; i++ {
+		if m := leerMensajeSSE(t, lineas); string(m.Payload) != strconv.Itoa(i) {
+			t.Fatalf("mensaje %d = %s, se esperaba el orden de publicación", i, m.Payload)
+		}
+	}
+}
+
+// TestClaveOrden_LimitaPendientes verifica que una cola de orden llena descarte lo que
+// excede el límite sin frenar a los demás destinos ni claves
+func TestClaveOrden_LimitaPendientes(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+
+	// Un destino HTTP bloqueado con la cola de la clave llena
+	bloqueo, iniciada := make(chan struct{}), make(chan struct{})
+	defer close(bloqueo)
+	s.orden.ejecutar("http|v1", func() {
+		close(iniciada)
+		<-bloqueo
+	})
+	<-iniciada
+	for i := 0; i < maxPendientesPorClave; i++ {
+		if !s.orden.ejecutar("http|v1", func() {}) {
+			t.Fatalf("la cola rechazó la distribución %d, por debajo del límite", i)
+		}
+	}
+	if s.orden.ejecutar("http|v1", func() {}) {
+		t.Error("la cola aceptó una distribución por encima del límite")
+	}
+	if !s.orden.ejecutar("http|v2", func() {}) {
+		t.Error("la cola llena de una clave no debería afectar a otra")
+	}
+
+	s.distribuir(LOG_HTTP, Mensaje{Topico: "actuadores/v1", Payload: []byte("x"), ClaveOrden: "v1"}, false)
+	if n := s.metricas.descartes.instantanea()[descarteColaOrden]; n != 1 {
+		t.Errorf("descartes por cola de orden = %d, esperaba 1 (solo el destino HTTP)", n)
+	}
+}
@@ -0,0 +1,332 @@
+package servidor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const LOG_METRICAS = "METRICAS"
+
+// Métricas internas del servidor, sin dependencias externas. El registro acumula
+// contadores e histogramas en memoria; los medidores (conexiones, inflight) se leen del
+// estado del servidor al tomar la instantánea. Se exponen en formato de texto de
+// Prometheus en rutaMetricas y se publican cada Opciones.IntervaloEstadisticas como JSON
+// en los tópicos reservados $SYS/sensorwave/..., que solo el servidor puede publicar:
+//
+//	$SYS/sensorwave/conexiones          conexiones activas por protocolo
+//	$SYS/sensorwave/mensajes/entrantes  mensajes distribuidos por origen
+//	$SYS/sensorwave/mensajes/salientes  entregas por destino
+//	$SYS/sensorwave/mensajes/topicos    mensajes distribuidos por tópico
+//	$SYS/sensorwave/descartes           mensajes descartados por motivo
+//	$SYS/sensorwave/ack/vencidos        QoS 1 y 2 abandonados sin ACK por destino
+//	$SYS/sensorwave/inflight            QoS 1 y 2 pendientes de ACK por destino
+//	$SYS/sensorwave/latencia            histogramas de latencia del fanout por destino
+//
+// Como en MQTT, los comodines del primer nivel (# y +) no coinciden con tópicos $: hay
+// que suscribirse explícitamente a $SYS/sensorwave/#.
+
+const (
+	rutaMetricas   = "/sensorwave/metricas"
+	prefijoSistema = "$SYS/"
+
+	topicoEstadisticas              = "$SYS/sensorwave/"
+	intervaloEstadisticasPorDefecto = 10 * time.Second
+
+	// maximoTopicosMetricas acota los tópicos con contador propio; el resto se suma en topicoOtros
+	maximoTopicosMetricas = 1000
+	topicoOtros           = "_otros"
+)
+
+// Motivos de descarte de un mensaje
+const (
+	descarteCanalBloqueado = "canal_bloqueado" // canal de un suscriptor HTTP lleno
+	descarteExpirado       = "expirado"        // venció antes de entregarse
+	descarteTasa           = "tasa_excedida"   // publicación rechazada por los límites de tasa
+	descarteBufferPuente   = "buffer_puente"   // buffer de salida de un puente lleno
+	descarteErrorEnvio     = "error_envio"     // notificación CoAP fallida
+	descarteDuplicado      = "duplicado"       // QoS 2 repetido dentro de la ventana de deduplicación
+	descarteValidacion     = "validacion"      // publicación rechazada por el registro de tópicos
+	descarteColaOrden      = "cola_orden"      // cola de una clave de orden llena
+)
+
+// limitesLatencia son los límites superiores, en segundos, de los buckets del
+// histograma de latencia del fanout
+var limitesLatencia = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// contadores es una familia de contadores por etiqueta. Con maximo > 0, las etiquetas
+// nuevas que exceden ese número se acumulan en topicoOtros.
+type contadores struct {
+	mu      sync.Mutex
+	valores map[string]uint64
+	maximo  int
+}
+
+func (c *contadores) sumar(etiqueta string, n uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.valores == nil {
+		c.valores = make(map[string]uint64)
+	}
+	if _, ok := c.valores[etiqueta]; !ok && c.maximo > 0 && len(c.valores) >= c.maximo {
+		etiqueta = topicoOtros
+	}
+	c.valores[etiqueta] += n
+}
+
+func (c *contadores) instantanea() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.valores == nil {
+		return map[string]uint64{}
+	}
+	return maps.Clone(c.valores)
+}
+
+// Histograma es la distribución de una latencia en segundos
+type Histograma struct {
+	Limites []float64 `json:"limites"` // límite superior de cada bucket
+	Buckets []uint64  `json:"buckets"` // observaciones menores o iguales a cada límite (acumuladas)
+	Cuenta  uint64    `json:"cuenta"`
+	Suma    float64   `json:"suma"`
+}
+
+// histogramas es una familia de histogramas de latencia por etiqueta
+type histogramas struct {
+	mu      sync.Mutex
+	valores map[string]*Histograma
+}
+
+func (h *histogramas) observar(etiqueta string, d time.Duration) {
+	segundos := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.valores == nil {
+		h.valores = make(map[string]*Histograma)
+	}
+	hi, ok := h.valores[etiqueta]
+	if !ok {
+		hi = &Histograma{Limites: limitesLatencia, Buckets: make([]uint64, len(limitesLatencia))}
+		h.valores[etiqueta] = hi
+	}
+	for i, limite := range hi.Limites {
+		if segundos <= limite {
+			hi.Buckets[i]++
+		}
+	}
+	hi.Cuenta++
+	hi.Suma += segundos
+}
+
+func (h *histogramas) instantanea() map[string]Histograma {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	copia := make(map[string]Histograma, len(h.valores))
+	for etiqueta, hi := range h.valores {
+		c := *hi
+		c.Buckets = slices.Clone(hi.Buckets)
+		copia[etiqueta] = c
+	}
+	return copia
+}
+
+// metricas es el registro de métricas de una instancia
+type metricas struct {
+	entrantes   contadores  // mensajes distribuidos por origen (protocolo o componente)
+	salientes   contadores  // entregas por destino
+	porTopico   contadores  // mensajes distribuidos por tópico
+	descartes   contadores  // mensajes descartados por motivo
+	ackVencidos contadores  // QoS 1 y 2 abandonados tras agotar las retransmisiones, por destino
+	latencias   histogramas // desde que se distribuye un mensaje hasta que cada destino lo entrega
+}
+
+func nuevasMetricas() *metricas {
+	return &metricas{porTopico: contadores{maximo: maximoTopicosMetricas}}
+}
+
+// descartar cuenta un mensaje descartado
+func (s *Servidor) descartar(motivo string) {
+	s.metricas.descartes.sumar(motivo, 1)
+}
+
+// Estadisticas es una instantánea de las métricas del servidor
+type Estadisticas struct {
+	Conexiones  map[string]int64      `json:"conexiones"`  // http (streams SSE), websocket, coap (observaciones) y mqtt
+	Entrantes   map[string]uint64     `json:"entrantes"`   // por origen: http, coap, mqtt, puentes, testamento
+	Salientes   map[string]uint64     `json:"salientes"`   // por destino: http, websocket, coap, mqtt, compartidas
+	PorTopico   map[string]uint64     `json:"porTopico"`   // mensajes distribuidos por tópico
+	Descartes   map[string]uint64     `json:"descartes"`   // por motivo
+	AckVencidos map[string]uint64     `json:"ackVencidos"` // por destino: http, compartidas
+	Inflight    map[string]int64      `json:"inflight"`    // por destino: http, mqtt
+	Latencias   map[string]Histograma `json:"latencias"`   // fanout por destino
+}
+
+// Estadisticas retorna una instantánea de las métricas del servidor
+func (s *Servidor) Estadisticas() Estadisticas {
+	e := Estadisticas{
+		Conexiones:  make(map[string]int64),
+		Entrantes:   s.metricas.entrantes.instantanea(),
+		Salientes:   s.metricas.salientes.instantanea(),
+		PorTopico:   s.metricas.porTopico.instantanea(),
+		Descartes:   s.metricas.descartes.instantanea(),
+		AckVencidos: s.metricas.ackVencidos.instantanea(),
+		Inflight:    map[string]int64{"http": int64(s.inflightHTTP.Pendientes())},
+		Latencias:   s.metricas.latencias.instantanea(),
+	}
+
+	s.mutexHTTP.Lock()
+	for id := range s.clientesPorID {
+		if !strings.HasPrefix(id, "ws-") {
+			e.Conexiones["http"]++
+		}
+	}
+	e.Conexiones["websocket"] = int64(len(s.conexionesWS))
+	s.mutexHTTP.Unlock()
+
+	s.mutexCoAP.Lock()
+	for _, conexiones := range s.observadores {
+		e.Conexiones["coap"] += int64(len(conexiones))
+	}
+	s.mutexCoAP.Unlock()
+
+	if broker := s.obtenerBrokerMQTT(); broker != nil {
+		info := broker.Info.Clone()
+		e.Conexiones["mqtt"] = info.ClientsConnected
+		e.Salientes["mqtt"] = uint64(info.MessagesSent)
+		e.Inflight["mqtt"] = info.Inflight
+	}
+	return e
+}
+
+// escribirPrometheus escribe las estadísticas en el formato de texto de Prometheus
+func escribirPrometheus(w io.Writer, e Estadisticas) {
+	familia := func(nombre, tipo, ayuda, etiqueta string, valores map[string]string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", nombre, ayuda, nombre, tipo)
+		for _, clave := range slices.Sorted(maps.Keys(valores)) {
+			fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", nombre, etiqueta, escaparEtiqueta(clave), valores[clave])
+		}
+	}
+	formatear := func(valores any) map[string]string {
+		r := make(map[string]string)
+		switch v := valores.(type) {
+		case map[string]uint64:
+			for k, n := range v {
+				r[k] = strconv.FormatUint(n, 10)
+			}
+		case map[string]int64:
+			for k, n := range v {
+				r[k] = strconv.FormatInt(n, 10)
+			}
+		}
+		return r
+	}
+
+	familia("sensorwave_conexiones", "gauge", "Conexiones activas por protocolo.", "protocolo", formatear(e.Conexiones))
+	familia("sensorwave_mensajes_entrantes_total", "counter", "Mensajes distribuidos por origen.", "protocolo", formatear(e.Entrantes))
+	familia("sensorwave_mensajes_salientes_total", "counter", "Mensajes entregados por destino.", "protocolo", formatear(e.Salientes))
+	familia("sensorwave_mensajes_topico_total", "counter", "Mensajes distribuidos por tópico.", "topico", formatear(e.PorTopico))
+	familia("sensorwave_descartes_total", "counter", "Mensajes descartados por motivo.", "motivo", formatear(e.Descartes))
+	familia("sensorwave_ack_vencidos_total", "counter", "Mensajes QoS 1 y 2 abandonados sin ACK por destino.", "protocolo", formatear(e.AckVencidos))
+	familia("sensorwave_inflight", "gauge", "Mensajes QoS 1 y 2 pendientes de ACK por destino.", "protocolo", formatear(e.Inflight))
+
+	const latencia = "sensorwave_latencia_fanout_segundos"
+	fmt.Fprintf(w, "# HELP %s Latencia del fanout por destino.\n# TYPE %s histogram\n", latencia, latencia)
+	for _, destino := range slices.Sorted(maps.Keys(e.Latencias)) {
+		h := e.Latencias[destino]
+		etiqueta := escaparEtiqueta(destino)
+		for i, limite := range h.Limites {
+			fmt.Fprintf(w, "%s_bucket{destino=\"%s\",le=\"%s\"} %d\n", latencia, etiqueta, strconv.FormatFloat(limite, 'g', -1, 64), h.Buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{destino=\"%s\",le=\"+Inf\"} %d\n", latencia, etiqueta, h.Cuenta)
+		fmt.Fprintf(w, "%s_sum{destino=\"%s\"} %s\n", latencia, etiqueta, strconv.FormatFloat(h.Suma, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{destino=\"%s\"} %d\n", latencia, etiqueta, h.Cuenta)
+	}
+}
+
+var escaparEtiqueta = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
+
+// manejarMetricasHTTP expone las métricas a Prometheus. Con autenticación, requiere
+// permiso de suscripción a $SYS/sensorwave/#.
+func (s *Servidor) manejarMetricasHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	usuario, err := s.autenticarYAutorizar(credencialesHTTP(r), identidadTLS(r.TLS), AccionSuscribir, topicoEstadisticas+"#")
+	if err != nil {
+		loggerPrint(LOG_METRICAS, "Consulta de métricas rechazada - Usuario: %s, Razón: %v", usuario, err)
+		responderErrorAuthHTTP(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	escribirPrometheus(w, s.Estadisticas())
+}
+
+// errTopicoSistema rechaza la publicación de un cliente en un tópico $SYS/...
+var errTopicoSistema = errors.New("tópico reservado del sistema")
+
+// esTopicoSistema indica si el tópico es reservado del servidor ($SYS/...). Los clientes
+// pueden suscribirse pero no publicar en él.
+func esTopicoSistema(topico string) bool {
+	return strings.HasPrefix(topico, prefijoSistema)
+}
+
+// iniciarEstadisticas publica las estadísticas periódicamente hasta que se cierre el servidor
+func (s *Servidor) iniciarEstadisticas() {
+	intervalo := s.opts.IntervaloEstadisticas
+	if intervalo < 0 {
+		return
+	}
+	if intervalo == 0 {
+		intervalo = intervaloEstadisticasPorDefecto
+	}
+	go func() {
+		ticker := time.NewTicker(intervalo)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.finEstadisticas:
+				return
+			case <-ticker.C:
+				s.publicarEstadisticas()
+			}
+		}
+	}()
+}
+
+// publicarEstadisticas entrega la instantánea a los suscriptores locales de cada
+// $SYS/sensorwave/...; no se reenvía a los puentes ni se retiene
+func (s *Servidor) publicarEstadisticas() {
+	e := s.Estadisticas()
+	secciones := map[string]any{
+		"conexiones":         e.Conexiones,
+		"mensajes/entrantes": e.Entrantes,
+		"mensajes/salientes": e.Salientes,
+		"mensajes/topicos":   e.PorTopico,
+		"descartes":          e.Descartes,
+		"ack/vencidos":       e.AckVencidos,
+		"inflight":           e.Inflight,
+		"latencia":           e.Latencias,
+	}
+	for seccion, valor := range secciones {
+		payload, err := json.Marshal(valor)
+		if err != nil {
+			loggerPrint(LOG_METRICAS, "Error - No se pudo serializar %s: %v", seccion, err)
+			continue
+		}
+		m := Mensaje{Topico: topicoEstadisticas + seccion, Payload: payload, Origen: s.id}
+		s.enviarHTTP(LOG_METRICAS, m)
+		s.enviarCoAP(LOG_METRICAS, m)
+		if s.obtenerBrokerMQTT() != nil {
+			s.enviarMQTT(LOG_METRICAS, m)
+		}
+	}
+}
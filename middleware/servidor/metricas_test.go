@@ -0,0 +1,114 @@
+package servidor
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContadores_AcotaEtiquetas(t *testing.T) {
+	c := contadores{maximo: 2}
+	for _, topico := range []string{"a", "b", "c", "a", "d"} {
+		c.sumar(topico, 1)
+	}
+	got := c.instantanea()
+	if got["a"] != 2 || got["b"] != 1 || got[topicoOtros] != 2 || len(got) != 3 {
+		t.Errorf("contadores = %v, esperaba a=2, b=1 y el resto en %s", got, topicoOtros)
+	}
+}
+
+func TestMetricas_Prometheus(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	lineas := suscribirSSE(t, s, "sensores/#")
+	publicarHTTP(t, s, "sensores/t", "21.5")
+	leerMensajeSSE(t, lineas)
+	s.distribuir(LOG_HTTP, Mensaje{Topico: "sensores/t", Expiracion: 1}, true)
+
+	// Las latencias se registran cuando termina cada destino
+	time.Sleep(100 * time.Millisecond)
+	resp, err := http.Get("http://" + s.direccionHTTP + rutaMetricas)
+	if err != nil {
+		t.Fatalf("GET métricas: %v", err)
+	}
+	defer resp.Body.Close()
+	cuerpo, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET métricas = %d: %s", resp.StatusCode, cuerpo)
+	}
+	for _, esperada := range []string{
+		"# TYPE sensorwave_conexiones gauge",
+		`sensorwave_conexiones{protocolo="http"} 1`,
+		`sensorwave_mensajes_entrantes_total{protocolo="http"} 2`,
+		`sensorwave_mensajes_salientes_total{protocolo="http"} 1`,
+		`sensorwave_mensajes_topico_total{topico="sensores/t"} 2`,
+		`sensorwave_descartes_total{motivo="expirado"}`,
+		"# TYPE sensorwave_latencia_fanout_segundos histogram",
+		`sensorwave_latencia_fanout_segundos_bucket{destino="http",le="+Inf"} 2`,
+		`sensorwave_latencia_fanout_segundos_count{destino="http"} 2`,
+	} {
+		if !strings.Contains(string(cuerpo), esperada) {
+			t.Errorf("falta %q en:\n%s", esperada, cuerpo)
+		}
+	}
+}
+
+func TestMetricas_RequiereAutorizacion(t *testing.T) {
+	auth := &ConfiguracionAuth{
+		Usuarios: []UsuarioAuth{{Usuario: "ops", Clave: "x"}, {Usuario: "sensor", Clave: "y"}},
+		ACL:      []ReglaACL{{Usuario: "ops", Suscribir: []string{"$SYS/#"}}},
+	}
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", Autorizador: auth})
+
+	codigos := map[string]int{"": http.StatusUnauthorized, "sensor:y": http.StatusForbidden, "ops:x": http.StatusOK}
+	for credenciales, esperado := range codigos {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+s.direccionHTTP+rutaMetricas, nil)
+		if usuario, clave, ok := strings.Cut(credenciales, ":"); ok {
+			req.SetBasicAuth(usuario, clave)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET métricas: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != esperado {
+			t.Errorf("GET métricas con %q = %d, esperaba %d", credenciales, resp.StatusCode, esperado)
+		}
+	}
+}
+
+func TestEstadisticas_PublicacionEnSYS(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", IntervaloEstadisticas: 50 * time.Millisecond})
+	todos := suscribirSSE(t, s, "#")
+	conexiones := suscribirSSE(t, s, topicoEstadisticas+"conexiones")
+
+	m := leerMensajeSSE(t, conexiones)
+	var porProtocolo map[string]int64
+	if err := json.Unmarshal(m.Payload, &porProtocolo); err != nil {
+		t.Fatalf("payload de conexiones inválido: %v", err)
+	}
+	if porProtocolo["http"] != 2 || m.Origen != s.ID() {
+		t.Errorf("conexiones = %v (origen %s), esperaba los 2 streams SSE", porProtocolo, m.Origen)
+	}
+
+	// # no incluye los tópicos $SYS
+	select {
+	case dato := <-todos:
+		t.Errorf("la suscripción a # recibió %s", dato)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Solo el servidor publica en $SYS
+	cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: "$SYS/sensorwave/conexiones", Payload: []byte("{}")})
+	resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico=$SYS/sensorwave/conexiones", "application/json", bytes.NewReader(cuerpo))
+	if err != nil {
+		t.Fatalf("POST error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST en $SYS = %d, esperaba 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,90 @@
+package servidor
+
+import (
+	"encoding/json"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/sensorwave-dev/sensorwave/middleware/formatos"
+)
+
+// Normalización de cargas con esquema (Opciones.NormalizarCargas).
+//
+// Los dispositivos que hablan SenML publican el pack crudo, sin envolverlo en un
+// Mensaje: por CoAP con Content-Format 110 (senml+json) o 112 (senml+cbor) y por HTTP
+// con Content-Type application/senml+json o application/senml+cbor. El pack se
+// distribuye como payload de un Mensaje en su tópico, igual que cualquier publicación.
+// Los nodos Sparkplug B publican por MQTT en spBv1.0/#; el broker entrega el payload
+// protobuf tal cual a los suscriptores MQTT (hosts Sparkplug) y no se distribuye a
+// los otros protocolos.
+//
+// En ambos casos cada medición se re-publica en todos los protocolos y al upstream como
+// un Mensaje con un formatos.Registro en JSON en el tópico normalizado/<serie>, p.ej.
+// {"serie":"planta/linea1/temp","tiempo":1700000000000000000,"tipo":"Real","valor":21.5}.
+
+const LOG_NORMALIZACION = "NORMALIZACION"
+
+// nuevoDecodificadorSparkplug retorna nil si la normalización está deshabilitada
+func nuevoDecodificadorSparkplug(normalizar bool) *formatos.DecodificadorSparkplug {
+	if !normalizar {
+		return nil
+	}
+	return formatos.NuevoDecodificadorSparkplug()
+}
+
+// normalizaCargas indica si la instancia decodifica SenML y Sparkplug B
+func (s *Servidor) normalizaCargas() bool {
+	return s.sparkplug != nil
+}
+
+// esTipoSenML indica si un Content-Type HTTP corresponde a un pack SenML
+func esTipoSenML(tipo string) bool {
+	return tipo == formatos.TipoSenMLJSON || tipo == formatos.TipoSenMLCBOR
+}
+
+// esFormatoSenMLCoAP indica si un Content-Format CoAP corresponde a un pack SenML
+func esFormatoSenMLCoAP(formato message.MediaType, err error) bool {
+	return err == nil && (formato == message.AppSenmlJSON || formato == message.AppSenmlCbor)
+}
+
+// normalizarSparkplug decodifica un PUBLISH Sparkplug B y publica sus registros. Se
+// invoca en orden desde el hook MQTT para que cada NBIRTH preceda a sus NDATA.
+func (s *Servidor) normalizarSparkplug(usuario, conexion, topico string, payload []byte) {
+	registros, err := s.sparkplug.Decodificar(topico, payload)
+	if err != nil {
+		loggerPrint(LOG_NORMALIZACION, "Error - %v", err)
+	}
+	s.publicarNormalizados(LOG_MQTT, usuario, conexion, registros)
+}
+
+// publicarNormalizados publica cada registro en su tópico canónico, en el orden del
+// payload. Los nombres de las series los elige el publicante, así que cada tópico
+// derivado pasa por la ACL, los límites de tasa y el registro de tópicos como una
+// publicación directa de usuario desde conexion.
+func (s *Servidor) publicarNormalizados(LOG, usuario, conexion string, registros []formatos.Registro) {
+	for _, r := range registros {
+		topico, err := normalizarYValidarTopico(formatos.TopicoCanonico(r.Serie), false)
+		if err != nil {
+			loggerPrint(LOG_NORMALIZACION, "Registro descartado - Serie inválida: %q", r.Serie)
+			continue
+		}
+		if !s.autorizar(usuario, AccionPublicar, topico) {
+			loggerPrint(LOG_NORMALIZACION, "Registro descartado - Usuario: %s, Tópico: %s, Razón: %v", usuario, topico, errNoAutorizado)
+			continue
+		}
+		if !s.permitirPublicacion(LOG_NORMALIZACION, usuario, conexion, topico) {
+			continue
+		}
+		datos, err := json.Marshal(r)
+		if err != nil {
+			loggerPrint(LOG_NORMALIZACION, "Registro descartado - Serie: %s, Error: %v", r.Serie, err)
+			continue
+		}
+		// La clave de orden mantiene las mediciones de cada serie en el orden del payload
+		m := Mensaje{Topico: topico, Payload: datos, ClaveOrden: topico}
+		if err := s.validarPublicacion(LOG_NORMALIZACION, usuario, m); err != nil {
+			continue
+		}
+		s.registrarSalto(&m)
+		s.distribuir(LOG, m, true)
+	}
+}
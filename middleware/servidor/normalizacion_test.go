@@ -0,0 +1,208 @@
+package servidor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/udp"
+	"github.com/sensorwave-dev/sensorwave/middleware/formatos"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// esperarRegistrosSSE espera los registros normalizados en sus tópicos canónicos. La
+// entrega HTTP con QoS 0 no garantiza el orden, por eso se comparan como conjunto.
+func esperarRegistrosSSE(t *testing.T, lineas <-chan string, esperados ...formatos.Registro) {
+	t.Helper()
+	pendientes := make(map[formatos.Registro]bool)
+	for _, r := range esperados {
+		pendientes[r] = true
+	}
+	for range esperados {
+		select {
+		case dato := <-lineas:
+			var m Mensaje
+			if err := json.Unmarshal([]byte(dato), &m); err != nil {
+				t.Fatalf("línea SSE inválida %q: %v", dato, err)
+			}
+			var r formatos.Registro
+			if err := json.Unmarshal(m.Payload, &r); err != nil {
+				t.Fatalf("registro inválido %s: %v", m.Payload, err)
+			}
+			if !pendientes[r] || m.Topico != formatos.TopicoCanonico(r.Serie) {
+				t.Errorf("recibido %s en %s, no esperado", m.Payload, m.Topico)
+			}
+			delete(pendientes, r)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no se recibieron los registros %+v", pendientes)
+		}
+	}
+}
+
+func TestNormalizacion_SenMLPorHTTPYCoAP(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0", NormalizarCargas: true})
+	normalizados := suscribirSSE(t, s, "normalizado/#")
+	crudos := suscribirSSE(t, s, "dispositivos/#")
+
+	pack := `[{"bn":"planta/sala/","bt":1700000000,"n":"temp","v":21.5},{"n":"puerta","vb":true}]`
+	resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico=dispositivos/sala", formatos.TipoSenMLJSON, bytes.NewReader([]byte(pack)))
+	if err != nil {
+		t.Fatalf("POST error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST SenML: código %d", resp.StatusCode)
+	}
+	// El pack crudo se distribuye en su tópico y cada medición en el canónico
+	esperarLineaSSE(t, crudos, pack)
+	esperarRegistrosSSE(t, normalizados,
+		formatos.Registro{Serie: "planta/sala/temp", Tiempo: 1700000000e9, Valor: 21.5},
+		formatos.Registro{Serie: "planta/sala/puerta", Tiempo: 1700000000e9, Valor: true})
+
+	conn, err := udp.Dial(s.direccionCoAP)
+	if err != nil {
+		t.Fatalf("Dial CoAP error = %v", err)
+	}
+	defer conn.Close()
+	ctx, cancelar := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelar()
+	// [{-2: "planta/", 0: "humedad", -3: 1700000000, 2: 40}] en SenML CBOR
+	cbor := []byte{0x81, 0xa4, 0x21, 0x67, 'p', 'l', 'a', 'n', 't', 'a', '/', 0x00, 0x67, 'h', 'u', 'm', 'e', 'd', 'a', 'd', 0x22, 0x1a, 0x65, 0x53, 0xf1, 0x00, 0x02, 0x18, 0x28}
+	respCoAP, err := conn.Post(ctx, "/sensorwave", message.AppSenmlCbor, bytes.NewReader(cbor), message.Option{ID: message.URIQuery, Value: []byte("topico=dispositivos/humedad")})
+	if err != nil {
+		t.Fatalf("POST CoAP error = %v", err)
+	}
+	if respCoAP.Code() != codes.Created {
+		t.Fatalf("POST CoAP SenML: código %v", respCoAP.Code())
+	}
+	esperarLineaSSE(t, crudos, string(cbor))
+	esperarRegistrosSSE(t, normalizados, formatos.Registro{Serie: "planta/humedad", Tiempo: 1700000000e9, Valor: 40.0})
+}
+
+func TestNormalizacion_SenMLInvalidoODeshabilitado(t *testing.T) {
+	publicar := func(s *Servidor, pack string) int {
+		resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico=dispositivos/sala", formatos.TipoSenMLJSON, bytes.NewReader([]byte(pack)))
+		if err != nil {
+			t.Fatalf("POST error = %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	pack := `[{"n":"temp","v":21.5}]`
+
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", NormalizarCargas: true})
+	if codigo := publicar(s, `[{"n":"-temp","v":21.5}]`); codigo != http.StatusBadRequest {
+		t.Errorf("SenML inválido: código %d, esperaba 400", codigo)
+	}
+
+	// Sin la opción el pack se interpreta como un Mensaje JSON y se rechaza
+	s = iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	if codigo := publicar(s, pack); codigo != http.StatusBadRequest {
+		t.Errorf("SenML sin normalización: código %d, esperaba 400", codigo)
+	}
+}
+
+// TestNormalizacion_AutorizaTopicosDerivados verifica que los tópicos canónicos, cuyos
+// nombres elige el publicante, pasen por la ACL y por la distribución común
+func TestNormalizacion_AutorizaTopicosDerivados(t *testing.T) {
+	auth := &ConfiguracionAuth{
+		PermitirAnonimos: true,
+		ACL: []ReglaACL{{
+			Usuario:   "*",
+			Publicar:  []string{"dispositivos/#", "normalizado/planta/#"},
+			Suscribir: []string{"#"},
+		}},
+	}
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", NormalizarCargas: true, Autorizador: auth})
+	normalizados := suscribirSSE(t, s, "normalizado/#")
+
+	pack := `[{"n":"otra/temp","v":1},{"n":"planta/temp","v":21.5}]`
+	resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico=dispositivos/sala", formatos.TipoSenMLJSON, bytes.NewReader([]byte(pack)))
+	if err != nil {
+		t.Fatalf("POST error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST SenML: código %d", resp.StatusCode)
+	}
+	m := leerMensajeSSE(t, normalizados)
+	if m.Topico != "normalizado/planta/temp" {
+		t.Errorf("recibido %s en %s, esperaba solo la serie autorizada", m.Payload, m.Topico)
+	}
+	select {
+	case dato := <-normalizados:
+		t.Errorf("se distribuyó un registro no autorizado: %s", dato)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := s.Estadisticas().PorTopico["normalizado/planta/temp"]; n != 1 {
+		t.Errorf("métrica del tópico normalizado = %d, esperaba 1", n)
+	}
+}
+
+// metricaSparkplug codifica un Payload.Metric con nombre, alias, tipo Double y valor
+func metricaSparkplug(nombre string, alias uint64, valor float64) []byte {
+	var m []byte
+	if nombre != "" {
+		m = protowire.AppendString(protowire.AppendTag(m, 1, protowire.BytesType), nombre)
+		m = protowire.AppendVarint(protowire.AppendTag(m, 4, protowire.VarintType), 10)
+	}
+	m = protowire.AppendVarint(protowire.AppendTag(m, 2, protowire.VarintType), alias)
+	return protowire.AppendFixed64(protowire.AppendTag(m, 13, protowire.Fixed64Type), math.Float64bits(valor))
+}
+
+// payloadSparkplug codifica un Payload con timestamp en milisegundos
+func payloadSparkplug(tiempo uint64, metricas ...[]byte) []byte {
+	p := protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), tiempo)
+	for _, m := range metricas {
+		p = protowire.AppendBytes(protowire.AppendTag(p, 2, protowire.BytesType), m)
+	}
+	return p
+}
+
+func TestNormalizacion_SparkplugPorMQTT(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoMQTT: "0", NormalizarCargas: true})
+	normalizados := suscribirSSE(t, s, "normalizado/#")
+
+	opts := mqtt.NewClientOptions().AddBroker("tcp://" + s.direccionMQTT).SetClientID("nodo-sparkplug")
+	nodo := mqtt.NewClient(opts)
+	if token := nodo.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect MQTT: %v", token.Error())
+	}
+	defer nodo.Disconnect(100)
+
+	// Un host Sparkplug recibe el protobuf sin modificar
+	recibidos := make(chan []byte, 2)
+	if token := nodo.Subscribe("spBv1.0/#", 0, func(_ mqtt.Client, m mqtt.Message) { recibidos <- m.Payload() }); token.Wait() && token.Error() != nil {
+		t.Fatalf("Subscribe MQTT: %v", token.Error())
+	}
+
+	nacimiento := payloadSparkplug(1700000000000, metricaSparkplug("temp", 1, 20))
+	datos := payloadSparkplug(1700000001000, metricaSparkplug("", 1, 21.5))
+	for _, p := range []struct {
+		topico string
+		datos  []byte
+	}{{"spBv1.0/planta/NBIRTH/borde1", nacimiento}, {"spBv1.0/planta/NDATA/borde1", datos}} {
+		if token := nodo.Publish(p.topico, 0, false, p.datos); token.Wait() && token.Error() != nil {
+			t.Fatalf("Publish %s: %v", p.topico, token.Error())
+		}
+		select {
+		case payload := <-recibidos:
+			if !bytes.Equal(payload, p.datos) {
+				t.Errorf("payload de %s modificado por el broker", p.topico)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("el suscriptor MQTT no recibió %s", p.topico)
+		}
+	}
+
+	esperarRegistrosSSE(t, normalizados,
+		formatos.Registro{Serie: "planta/borde1/temp", Tiempo: 1700000000000e6, Valor: 20.0},
+		formatos.Registro{Serie: "planta/borde1/temp", Tiempo: 1700000001000e6, Valor: 21.5})
+}
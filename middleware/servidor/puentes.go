@@ -0,0 +1,392 @@
+package servidor
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/mensaje"
+)
+
+const LOG_PUENTES = "PUENTES"
+
+// nombreUpstream es el puente que configuran Opciones.Upstream y ConfigurarUpstream
+const nombreUpstream = "upstream"
+
+// Puente conecta la instancia con otro servidor del middleware (borde -> sitio -> nube).
+// Los mensajes locales que coinciden con Salida se publican en el remoto y los tópicos
+// remotos de Entrada se suscriben y se distribuyen localmente como cualquier publicación.
+//
+// Los bucles se detectan con la lista de saltos del mensaje (Mensaje.Saltos): cada
+// instancia se agrega al distribuir un mensaje y descarta los que ya la incluyen, de
+// modo que las jerarquías con varios puentes en ambos sentidos no reenvían un mensaje
+// a una instancia por la que ya pasó.
+type Puente struct {
+	// Nombre identifica al puente en los logs y en QuitarPuente
+	Nombre string
+	// Cliente es la conexión al servidor remoto. Para Entrada debe implementar
+	// middleware.SuscriptorMensajes (los clientes HTTP, CoAP y MQTT lo hacen): con solo
+	// Suscribir se pierden los saltos y la detección de bucles depende de los filtros.
+	Cliente middleware.Cliente
+
+	// Salida son los filtros de los tópicos locales que se publican en el remoto
+	Salida []string
+	// Entrada son los filtros de los tópicos remotos que se suscriben y se inyectan localmente
+	Entrada []string
+	// PrefijoLocal y PrefijoRemoto reescriben los tópicos: el tópico local
+	// PrefijoLocal/t cruza como PrefijoRemoto/t y viceversa. Los filtros de Salida y
+	// Entrada se aplican a t, sin prefijo ("" = sin reescritura).
+	PrefijoLocal  string
+	PrefijoRemoto string
+
+	// QoS de los mensajes que cruzan el puente, en ambos sentidos (0, 1 o 2)
+	QoS int
+	// Buffer es la cantidad de mensajes salientes que esperan su publicación en el
+	// remoto, en orden (0 = sin buffer: cada mensaje se publica en la goroutine de su
+	// fanout). Con el buffer lleno los mensajes nuevos se descartan. Para conservar los
+	// mensajes durante una caída del remoto usar un cliente con middleware.ConColaLocal.
+	Buffer int
+}
+
+// puente es un Puente validado, con sus tópicos normalizados y su estado
+type puente struct {
+	Puente
+	// soloLocales conserva el comportamiento del upstream único: solo se reenvían los
+	// mensajes originados en esta instancia
+	soloLocales bool
+
+	salida      chan Mensaje  // nil = sin buffer
+	fin         chan struct{} // se cierra al detener el puente
+	detener     sync.Once
+	remoto      atomic.Value // string: ID de la instancia remota, aprendido de los saltos entrantes
+	descartados atomic.Int64
+}
+
+// nuevoPuente valida la configuración y normaliza filtros y prefijos
+func nuevoPuente(p Puente) (*puente, error) {
+	if p.Nombre == "" {
+		return nil, fmt.Errorf("puente sin nombre")
+	}
+	if p.Cliente == nil {
+		return nil, fmt.Errorf("puente %s: falta el cliente", p.Nombre)
+	}
+	if p.QoS < 0 || p.QoS > 2 {
+		return nil, fmt.Errorf("puente %s: %w", p.Nombre, errQoSInvalido)
+	}
+	if p.Buffer < 0 {
+		return nil, fmt.Errorf("puente %s: buffer negativo", p.Nombre)
+	}
+	if len(p.Salida) == 0 && len(p.Entrada) == 0 {
+		return nil, fmt.Errorf("puente %s: sin filtros de salida ni de entrada", p.Nombre)
+	}
+	var err error
+	normalizar := func(filtros []string) []string {
+		normalizados := make([]string, 0, len(filtros))
+		for _, f := range filtros {
+			n, e := normalizarYValidarTopico(f, true)
+			if e != nil || esCompartida(n) {
+				err = fmt.Errorf("puente %s: filtro inválido: %q", p.Nombre, f)
+			}
+			normalizados = append(normalizados, n)
+		}
+		return normalizados
+	}
+	p.Salida = normalizar(p.Salida)
+	p.Entrada = normalizar(p.Entrada)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefijo := range []*string{&p.PrefijoLocal, &p.PrefijoRemoto} {
+		if *prefijo == "" {
+			continue
+		}
+		if *prefijo, err = normalizarYValidarTopico(*prefijo, false); err != nil {
+			return nil, fmt.Errorf("puente %s: prefijo inválido", p.Nombre)
+		}
+	}
+	nuevo := &puente{Puente: p, fin: make(chan struct{})}
+	if p.Buffer > 0 {
+		nuevo.salida = make(chan Mensaje, p.Buffer)
+	}
+	return nuevo, nil
+}
+
+// quitarPrefijo retorna el tópico relativo al prefijo ("" = sin prefijo)
+func quitarPrefijo(topico, prefijo string) (string, bool) {
+	if prefijo == "" {
+		return topico, true
+	}
+	return strings.CutPrefix(topico, prefijo+"/")
+}
+
+func agregarPrefijo(topico, prefijo string) string {
+	if prefijo == "" {
+		return topico
+	}
+	return prefijo + "/" + topico
+}
+
+// topicoSalida traduce un tópico local al remoto, si alguno de los filtros de Salida lo admite
+func (p *puente) topicoSalida(local string) (string, bool) {
+	relativo, ok := quitarPrefijo(local, p.PrefijoLocal)
+	if !ok || !slices.ContainsFunc(p.Salida, func(f string) bool { return coincidePatron(relativo, f) }) {
+		return "", false
+	}
+	return agregarPrefijo(relativo, p.PrefijoRemoto), true
+}
+
+// topicoEntrada traduce un tópico remoto recibido por una suscripción de Entrada al local
+func (p *puente) topicoEntrada(remoto string) (string, bool) {
+	relativo, ok := quitarPrefijo(remoto, p.PrefijoRemoto)
+	if !ok || !slices.ContainsFunc(p.Entrada, func(f string) bool { return coincidePatron(relativo, f) }) {
+		return "", false
+	}
+	return agregarPrefijo(relativo, p.PrefijoLocal), true
+}
+
+// iniciarPuente arranca el envío con buffer y suscribe los filtros de Entrada en el remoto
+func (s *Servidor) iniciarPuente(p *puente) error {
+	if p.salida != nil {
+		go p.enviarBuffer()
+	}
+	suscriptor, completo := p.Cliente.(middleware.SuscriptorMensajes)
+	for _, filtro := range p.Entrada {
+		remoto := agregarPrefijo(filtro, p.PrefijoRemoto)
+		entregar := func(m Mensaje) { s.inyectarDesdePuente(p, m) }
+		var err error
+		if completo {
+			err = suscriptor.SuscribirMensajes(remoto, entregar)
+		} else {
+			err = p.Cliente.Suscribir(remoto, func(topico string, payload []byte) {
+				entregar(Mensaje{Topico: topico, Payload: payload})
+			})
+		}
+		if err != nil {
+			s.detenerPuente(p)
+			return fmt.Errorf("puente %s: suscribiendo %s: %w", p.Nombre, remoto, err)
+		}
+	}
+	loggerPrint(LOG_PUENTES, "Puente iniciado - Nombre: %s, Salida: %v, Entrada: %v", p.Nombre, p.Salida, p.Entrada)
+	return nil
+}
+
+// detenerPuente cancela las suscripciones de Entrada y el envío con buffer. El cliente
+// pertenece a quien configuró el puente y no se desconecta.
+func (s *Servidor) detenerPuente(p *puente) {
+	p.detener.Do(func() {
+		close(p.fin)
+		for _, filtro := range p.Entrada {
+			remoto := agregarPrefijo(filtro, p.PrefijoRemoto)
+			if err := p.Cliente.Desuscribir(remoto); err != nil {
+				loggerPrint(LOG_PUENTES, "Error - Puente %s: desuscribiendo %s: %v", p.Nombre, remoto, err)
+			}
+		}
+	})
+}
+
+// reenviar publica el mensaje en el remoto si los filtros de Salida lo admiten. Retorna
+// false si se descartó por tener el buffer lleno.
+func (p *puente) reenviar(id string, m Mensaje) bool {
+	if (p.soloLocales && m.Origen != "" && m.Origen != id) || m.Expirado() {
+		return true
+	}
+	// No devolver al remoto lo que llegó desde él: lo descartaría por sus saltos
+	if remoto, _ := p.remoto.Load().(string); remoto != "" && slices.Contains(m.Saltos, remoto) {
+		return true
+	}
+	topico, ok := p.topicoSalida(m.Topico)
+	if !ok {
+		return true
+	}
+	m.Topico = topico
+	m.Original = true
+	if p.salida == nil {
+		p.publicar(m)
+		return true
+	}
+	select {
+	case p.salida <- m:
+		return true
+	default:
+		p.descartados.Add(1)
+		loggerPrint(LOG_PUENTES, "Mensaje descartado - Puente %s: buffer lleno (%d), Tópico: %s", p.Nombre, p.Buffer, m.Topico)
+		return false
+	}
+}
+
+// enviarBuffer publica en orden los mensajes del buffer hasta que el puente se detiene
+func (p *puente) enviarBuffer() {
+	for {
+		select {
+		case <-p.fin:
+			return
+		case m := <-p.salida:
+			p.publicar(m)
+		}
+	}
+}
+
+func (p *puente) publicar(m Mensaje) {
+	if err := p.Cliente.Publicar(m.Topico, m, middleware.ConQoS(p.QoS)); err != nil {
+		loggerPrint(LOG_PUENTES, "Error - Puente %s: reenviando %s: %v", p.Nombre, m.Topico, err)
+	}
+}
+
+// inyectarDesdePuente distribuye localmente un mensaje recibido por una suscripción de
+// Entrada, con el tópico reescrito y el QoS del puente
+func (s *Servidor) inyectarDesdePuente(p *puente, m Mensaje) {
+	topico, ok := p.topicoEntrada(m.Topico)
+	if !ok {
+		return
+	}
+	// El último salto es la instancia remota, que distribuyó el mensaje a este puente
+	if n := len(m.Saltos); n > 0 {
+		p.remoto.Store(m.Saltos[n-1])
+	}
+	if s.esMensajeRebotado(m) {
+		loggerPrint(LOG_PUENTES, "Mensaje ignorado - Puente %s: ya pasó por esta instancia - Tópico: %s", p.Nombre, m.Topico)
+		return
+	}
+	m.Topico = topico
+	m, err := mensaje.Construir(topico, m, middleware.ConQoS(p.QoS))
+	if err == nil {
+		err = normalizarTopicoRespuesta(&m)
+	}
+	if err != nil {
+		loggerPrint(LOG_PUENTES, "Error - Puente %s: mensaje inválido en %s: %v", p.Nombre, topico, err)
+		return
+	}
+	s.registrarSalto(&m)
+	m.Original = false
+	loggerPrint(LOG_PUENTES, "Mensaje recibido - Puente: %s, Tópico: %s, QoS: %d", p.Nombre, m.Topico, m.QoS)
+
+	s.retener(m)
+	s.distribuir(LOG_PUENTES, m, true)
+}
+
+// reenviarUpstream publica el mensaje en los puentes cuyos filtros de Salida lo admiten
+func (s *Servidor) reenviarUpstream(m Mensaje) {
+	if m.Topico == "" {
+		return
+	}
+	s.puentesMu.RLock()
+	puentes := s.puentes
+	s.puentesMu.RUnlock()
+	for _, p := range puentes {
+		if !p.reenviar(s.id, m) {
+			s.descartar(descarteBufferPuente)
+		}
+	}
+}
+
+// AgregarPuente agrega un puente con un nombre nuevo. Si el servidor ya fue iniciado,
+// suscribe de inmediato los filtros de Entrada.
+func (s *Servidor) AgregarPuente(p Puente) error {
+	nuevo, err := nuevoPuente(p)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	iniciado := s.iniciado && !s.cerrado
+	s.mu.Unlock()
+
+	s.puentesMu.Lock()
+	if slices.ContainsFunc(s.puentes, func(q *puente) bool { return q.Nombre == p.Nombre }) {
+		s.puentesMu.Unlock()
+		return fmt.Errorf("ya existe el puente %s", p.Nombre)
+	}
+	s.puentes = append(slices.Clip(s.puentes), nuevo)
+	s.puentesMu.Unlock()
+
+	if iniciado {
+		if err := s.iniciarPuente(nuevo); err != nil {
+			s.quitarPuente(p.Nombre)
+			return err
+		}
+	}
+	return nil
+}
+
+// QuitarPuente detiene y quita el puente indicado; retorna false si no existía
+func (s *Servidor) QuitarPuente(nombre string) bool {
+	p := s.quitarPuente(nombre)
+	if p == nil {
+		return false
+	}
+	s.detenerPuente(p)
+	return true
+}
+
+func (s *Servidor) quitarPuente(nombre string) *puente {
+	s.puentesMu.Lock()
+	defer s.puentesMu.Unlock()
+	i := slices.IndexFunc(s.puentes, func(p *puente) bool { return p.Nombre == nombre })
+	if i < 0 {
+		return nil
+	}
+	p := s.puentes[i]
+	s.puentes = slices.Delete(slices.Clone(s.puentes), i, i+1)
+	return p
+}
+
+// DescartadosPuente retorna los mensajes salientes que el puente descartó con el buffer lleno
+func (s *Servidor) DescartadosPuente(nombre string) int64 {
+	s.puentesMu.RLock()
+	defer s.puentesMu.RUnlock()
+	for _, p := range s.puentes {
+		if p.Nombre == nombre {
+			return p.descartados.Load()
+		}
+	}
+	return 0
+}
+
+// iniciarPuentes arranca los puentes configurados al iniciar el servidor
+func (s *Servidor) iniciarPuentes() error {
+	s.puentesMu.RLock()
+	puentes := s.puentes
+	s.puentesMu.RUnlock()
+	for _, p := range puentes {
+		if err := s.iniciarPuente(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detenerPuentes detiene todos los puentes al cerrar el servidor
+func (s *Servidor) detenerPuentes() {
+	s.puentesMu.RLock()
+	puentes := s.puentes
+	s.puentesMu.RUnlock()
+	for _, p := range puentes {
+		s.detenerPuente(p)
+	}
+}
+
+// ConfigurarUpstream establece un cliente remoto opcional para federación: equivale a
+// un puente de salida "upstream" para todos los tópicos que solo reenvía los mensajes
+// originados en esta instancia. Si cliente es nil, deshabilita el reenvío upstream.
+func (s *Servidor) ConfigurarUpstream(cliente middleware.Cliente) {
+	s.quitarPuente(nombreUpstream)
+	if cliente == nil {
+		loggerPrint("UPSTREAM", "Upstream deshabilitado")
+		return
+	}
+	s.puentesMu.Lock()
+	s.puentes = append(slices.Clip(s.puentes), puenteUpstream(cliente))
+	s.puentesMu.Unlock()
+
+	loggerPrint("UPSTREAM", "Upstream configurado - ID instancia: %s", s.id)
+}
+
+func puenteUpstream(cliente middleware.Cliente) *puente {
+	return &puente{
+		Puente:      Puente{Nombre: nombreUpstream, Cliente: cliente, Salida: []string{"#"}},
+		soloLocales: true,
+		fin:         make(chan struct{}),
+	}
+}
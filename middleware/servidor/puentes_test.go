@@ -0,0 +1,229 @@
+package servidor
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	clientemqtt "github.com/sensorwave-dev/sensorwave/middleware/cliente_mqtt"
+)
+
+func TestPuente_ReescrituraDeTopicos(t *testing.T) {
+	p, err := nuevoPuente(Puente{
+		Nombre:        "nube",
+		Cliente:       &upstreamMock{},
+		Salida:        []string{"sensores/#"},
+		Entrada:       []string{"comandos/+"},
+		PrefijoLocal:  "sitio1",
+		PrefijoRemoto: "/planta/sitio1/",
+	})
+	if err != nil {
+		t.Fatalf("nuevoPuente() error = %v", err)
+	}
+
+	salidas := []struct {
+		local, remoto string
+		ok            bool
+	}{
+		{"sitio1/sensores/temp", "planta/sitio1/sensores/temp", true},
+		{"sitio1/actuadores/v1", "", false},
+		{"sitio2/sensores/temp", "", false},
+		{"sensores/temp", "", false},
+	}
+	for _, tt := range salidas {
+		remoto, ok := p.topicoSalida(tt.local)
+		if ok != tt.ok || remoto != tt.remoto {
+			t.Errorf("topicoSalida(%q) = %q, %v; esperaba %q, %v", tt.local, remoto, ok, tt.remoto, tt.ok)
+		}
+	}
+
+	entradas := []struct {
+		remoto, local string
+		ok            bool
+	}{
+		{"planta/sitio1/comandos/abrir", "sitio1/comandos/abrir", true},
+		{"planta/sitio1/comandos/abrir/ya", "", false},
+		{"planta/sitio2/comandos/abrir", "", false},
+	}
+	for _, tt := range entradas {
+		local, ok := p.topicoEntrada(tt.remoto)
+		if ok != tt.ok || local != tt.local {
+			t.Errorf("topicoEntrada(%q) = %q, %v; esperaba %q, %v", tt.remoto, local, ok, tt.local, tt.ok)
+		}
+	}
+}
+
+func TestCrear_PuentesInvalidos(t *testing.T) {
+	mock := &upstreamMock{}
+	casos := map[string][]Puente{
+		"sin nombre":      {{Cliente: mock, Salida: []string{"#"}}},
+		"sin cliente":     {{Nombre: "p", Salida: []string{"#"}}},
+		"sin filtros":     {{Nombre: "p", Cliente: mock}},
+		"QoS inválido":    {{Nombre: "p", Cliente: mock, Salida: []string{"#"}, QoS: 3}},
+		"filtro inválido": {{Nombre: "p", Cliente: mock, Salida: []string{"a/#/b"}}},
+		"compartida":      {{Nombre: "p", Cliente: mock, Entrada: []string{"$share/g/a"}}},
+		"duplicado": {
+			{Nombre: "p", Cliente: mock, Salida: []string{"#"}},
+			{Nombre: "p", Cliente: mock, Entrada: []string{"#"}},
+		},
+	}
+	for nombre, puentes := range casos {
+		if _, err := Crear(Opciones{PuertoHTTP: "0", Puentes: puentes}); err == nil {
+			t.Errorf("%s: Crear() no retornó error", nombre)
+		}
+	}
+}
+
+// bloqueanteMock es un cliente remoto cuya publicación espera a que el test la libere
+type bloqueanteMock struct {
+	upstreamMock
+	publicando chan struct{}
+	liberar    chan struct{}
+}
+
+func (m *bloqueanteMock) Publicar(topico string, mensaje interface{}, opciones ...middleware.PublicarOpcion) error {
+	m.publicando <- struct{}{}
+	<-m.liberar
+	return m.upstreamMock.Publicar(topico, mensaje, opciones...)
+}
+
+func TestPuente_BufferLlenoDescarta(t *testing.T) {
+	remoto := &bloqueanteMock{publicando: make(chan struct{}, 10), liberar: make(chan struct{})}
+	s := nuevoServidor(Opciones{})
+	if err := s.AgregarPuente(Puente{Nombre: "nube", Cliente: remoto, Salida: []string{"#"}, Buffer: 1}); err != nil {
+		t.Fatalf("AgregarPuente() error = %v", err)
+	}
+	if err := s.iniciarPuentes(); err != nil {
+		t.Fatalf("iniciarPuentes() error = %v", err)
+	}
+	defer s.detenerPuentes()
+
+	// El primero queda publicándose, el segundo ocupa el buffer y el tercero se descarta
+	s.reenviarUpstream(Mensaje{Topico: "a/1"})
+	<-remoto.publicando
+	s.reenviarUpstream(Mensaje{Topico: "a/2"})
+	s.reenviarUpstream(Mensaje{Topico: "a/3"})
+	if n := s.DescartadosPuente("nube"); n != 1 {
+		t.Errorf("DescartadosPuente() = %d, esperaba 1", n)
+	}
+	close(remoto.liberar)
+	<-remoto.publicando
+	if !s.QuitarPuente("nube") || s.QuitarPuente("nube") {
+		t.Error("QuitarPuente debe quitar el puente una sola vez")
+	}
+}
+
+// receptor acumula los mensajes que recibe un cliente MQTT
+type receptor struct {
+	mu       sync.Mutex
+	mensajes []middleware.Mensaje
+}
+
+func recibirMQTT(t *testing.T, s *Servidor, filtro string) *receptor {
+	t.Helper()
+	r := &receptor{}
+	c := conectarMQTT(t, s)
+	err := c.SuscribirMensajes(filtro, func(m middleware.Mensaje) {
+		r.mu.Lock()
+		r.mensajes = append(r.mensajes, m)
+		r.mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("SuscribirMensajes(%s) error = %v", filtro, err)
+	}
+	return r
+}
+
+func (r *receptor) recibidos() []middleware.Mensaje {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.mensajes)
+}
+
+func conectarMQTT(t *testing.T, s *Servidor) *clientemqtt.ClienteMQTT {
+	t.Helper()
+	_, puerto, _ := net.SplitHostPort(s.direccionMQTT)
+	c, err := clientemqtt.Conectar("127.0.0.1", puerto)
+	if err != nil {
+		t.Fatalf("Conectar MQTT: %v", err)
+	}
+	t.Cleanup(c.Desconectar)
+	return c
+}
+
+// TestPuentes_JerarquiaSinBucles conecta borde -> sitio -> nube. El puente sitio-nube es
+// bidireccional para todos los tópicos, de modo que sin la lista de saltos cada mensaje
+// volvería al sitio desde la nube.
+func TestPuentes_JerarquiaSinBucles(t *testing.T) {
+	borde := iniciarServidorTest(t, Opciones{PuertoMQTT: "0"})
+	sitio := iniciarServidorTest(t, Opciones{PuertoMQTT: "0"})
+	nube := iniciarServidorTest(t, Opciones{PuertoMQTT: "0"})
+
+	err := borde.AgregarPuente(Puente{
+		Nombre:  "sitio",
+		Cliente: conectarMQTT(t, sitio),
+		Salida:  []string{"sensores/#"},
+		Entrada: []string{"comandos/#"},
+		QoS:     1,
+	})
+	if err != nil {
+		t.Fatalf("AgregarPuente(sitio) error = %v", err)
+	}
+	err = sitio.AgregarPuente(Puente{
+		Nombre:        "nube",
+		Cliente:       conectarMQTT(t, nube),
+		Salida:        []string{"#"},
+		Entrada:       []string{"#"},
+		PrefijoRemoto: "planta/sitio1",
+		Buffer:        10,
+	})
+	if err != nil {
+		t.Fatalf("AgregarPuente(nube) error = %v", err)
+	}
+
+	enSitio := recibirMQTT(t, sitio, "sensores/#")
+	enNube := recibirMQTT(t, nube, "planta/sitio1/#")
+	privados := recibirMQTT(t, sitio, "privado/#")
+	comandos := recibirMQTT(t, borde, "comandos/#")
+
+	if err := conectarMQTT(t, borde).Publicar("sensores/temp", "21.5"); err != nil {
+		t.Fatalf("Publicar en borde: %v", err)
+	}
+	if err := conectarMQTT(t, borde).Publicar("privado/clave", "x"); err != nil {
+		t.Fatalf("Publicar en borde: %v", err)
+	}
+	if err := conectarMQTT(t, nube).Publicar("planta/sitio1/comandos/valvula", "abrir"); err != nil {
+		t.Fatalf("Publicar en nube: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	if got := enSitio.recibidos(); len(got) != 1 {
+		t.Errorf("sitio recibió %d mensajes, esperaba 1", len(got))
+	}
+	if got := privados.recibidos(); len(got) != 0 {
+		t.Errorf("el filtro de salida dejó pasar %d mensajes privados", len(got))
+	}
+	// La nube recibe el mensaje del borde y su propio comando, una vez cada uno
+	got := enNube.recibidos()
+	if len(got) != 2 {
+		t.Fatalf("nube recibió %d mensajes, esperaba 2: %+v", len(got), got)
+	}
+	i := slices.IndexFunc(got, func(m middleware.Mensaje) bool { return m.Topico == "planta/sitio1/sensores/temp" })
+	if i < 0 {
+		t.Fatalf("la nube no recibió el tópico reescrito: %+v", got)
+	}
+	if want := []string{borde.ID(), sitio.ID(), nube.ID()}; !slices.Equal(got[i].Saltos, want) || got[i].Origen != borde.ID() {
+		t.Errorf("Saltos = %v, Origen = %s; esperaba %v con origen en el borde", got[i].Saltos, got[i].Origen, want)
+	}
+
+	cmds := comandos.recibidos()
+	if len(cmds) != 1 || cmds[0].Topico != "comandos/valvula" || string(cmds[0].Payload) != "abrir" {
+		t.Fatalf("borde recibió %+v, esperaba un comando en comandos/valvula", cmds)
+	}
+	if want := []string{nube.ID(), sitio.ID(), borde.ID()}; !slices.Equal(cmds[0].Saltos, want) {
+		t.Errorf("Saltos del comando = %v, esperaba %v", cmds[0].Saltos, want)
+	}
+}
@@ -11,13 +11,11 @@ var (
 	errPayloadMuyGrande   = errors.New("payload demasiado grande")
 )
 
-const tamanoMaximoPayload = 65536
-
 func validarQoS(m Mensaje) error {
 	switch m.QoS {
 	case 0:
 		return nil
-	case 1:
+	case 1, 2:
 		if m.MensajeID == "" {
 			return errMensajeIDRequerido
 		}
@@ -27,9 +25,23 @@ func validarQoS(m Mensaje) error {
 	}
 }
 
-func validarTamanoPayload(m Mensaje) error {
-	if len(m.Payload) > tamanoMaximoPayload {
-		return fmt.Errorf("%w: %d bytes (máximo %d)", errPayloadMuyGrande, len(m.Payload), tamanoMaximoPayload)
+// duplicado indica si un QoS 2 ya se recibió dentro de Opciones.VentanaDeduplicacion: el
+// publicante lo retransmitió porque no recibió la confirmación, que se le repite sin
+// distribuir el mensaje de nuevo. El MensajeID lo elige cada publicante, así que se
+// deduplica por publicante (ver identidadPublicante).
+func (s *Servidor) duplicado(LOG, usuario, conexion string, m Mensaje) bool {
+	if m.QoS != 2 || s.deduplicador.Registrar(identidadPublicante(usuario, conexion)+"|"+m.MensajeID) {
+		return false
+	}
+	loggerPrint(LOG, "Mensaje QoS 2 repetido ignorado - Tópico: %s, MensajeID: %s", m.Topico, m.MensajeID)
+	s.descartar(descarteDuplicado)
+	return true
+}
+
+// validarTamanoPayload rechaza payloads mayores que el límite del protocolo de ingreso
+func validarTamanoPayload(m Mensaje, maximo int) error {
+	if len(m.Payload) > maximo {
+		return fmt.Errorf("%w: %d bytes (máximo %d)", errPayloadMuyGrande, len(m.Payload), maximo)
 	}
 	return nil
 }
@@ -0,0 +1,188 @@
+package servidor
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	clientecoap "github.com/sensorwave-dev/sensorwave/middleware/cliente_coap"
+	clientehttp "github.com/sensorwave-dev/sensorwave/middleware/cliente_http"
+)
+
+// TestQoS2_DescartaRepetidos publica dos veces cada QoS 2, como lo haría un publicante
+// que no recibió la confirmación: ambas se confirman y se distribuye una sola
+func TestQoS2_DescartaRepetidos(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0"})
+	lineas := suscribirSSE(t, s, "actuadores/#")
+
+	cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: "actuadores/v1", Payload: []byte("http"), QoS: 2, MensajeID: "m1"})
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico=actuadores/v1", "application/json", bytes.NewReader(cuerpo))
+		if err != nil {
+			t.Fatalf("POST error = %v", err)
+		}
+		var ack struct {
+			MensajeID string `json:"mensajeId"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&ack)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || ack.MensajeID != "m1" {
+			t.Errorf("POST %d = %d (ack %q), esperaba la confirmación de m1", i, resp.StatusCode, ack.MensajeID)
+		}
+	}
+
+	_, puertoCoAP, _ := net.SplitHostPort(s.direccionCoAP)
+	coap, err := clientecoap.Conectar("127.0.0.1", puertoCoAP)
+	if err != nil {
+		t.Fatalf("Conectar CoAP: %v", err)
+	}
+	t.Cleanup(coap.Desconectar)
+	repetido := middleware.Mensaje{Original: true, Topico: "actuadores/v1", Payload: []byte("coap"), QoS: 2, MensajeID: "m2"}
+	for i := 0; i < 2; i++ {
+		if err := coap.Publicar("actuadores/v1", repetido); err != nil {
+			t.Fatalf("Publicar CoAP %d: %v", i, err)
+		}
+	}
+
+	for _, esperado := range []string{"http", "coap"} {
+		if m := leerMensajeSSE(t, lineas); string(m.Payload) != esperado || m.QoS != 2 {
+			t.Errorf("mensaje = %s (QoS %d), esperaba %s con QoS 2", m.Payload, m.QoS, esperado)
+		}
+	}
+	select {
+	case dato := <-lineas:
+		t.Errorf("se distribuyó una repetición: %s", dato)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if n := s.metricas.descartes.instantanea()[descarteDuplicado]; n != 2 {
+		t.Errorf("descartes por duplicado = %d, esperaba 2", n)
+	}
+}
+
+// TestQoS2_ReconexionCoAPNoDuplica verifica que un publicante CoAP anónimo que reabre
+// su socket (otro puerto de origen) y reenvía el mismo MensajeID no lo entregue dos veces
+func TestQoS2_ReconexionCoAPNoDuplica(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0"})
+	lineas := suscribirSSE(t, s, "actuadores/#")
+
+	_, puertoCoAP, _ := net.SplitHostPort(s.direccionCoAP)
+	repetido := middleware.Mensaje{Original: true, Topico: "actuadores/v1", Payload: []byte("coap"), QoS: 2, MensajeID: "m1"}
+	for i := 0; i < 2; i++ {
+		coap, err := clientecoap.Conectar("127.0.0.1", puertoCoAP)
+		if err != nil {
+			t.Fatalf("Conectar CoAP %d: %v", i, err)
+		}
+		err = coap.Publicar("actuadores/v1", repetido)
+		coap.Desconectar()
+		if err != nil {
+			t.Fatalf("Publicar CoAP %d: %v", i, err)
+		}
+	}
+
+	if m := leerMensajeSSE(t, lineas); string(m.Payload) != "coap" {
+		t.Errorf("mensaje = %s, esperaba coap", m.Payload)
+	}
+	select {
+	case dato := <-lineas:
+		t.Errorf("se distribuyó la repetición desde el nuevo socket: %s", dato)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if n := s.metricas.descartes.instantanea()[descarteDuplicado]; n != 1 {
+		t.Errorf("descartes por duplicado = %d, esperaba 1", n)
+	}
+}
+
+// TestQoS2_DeduplicaPorPublicante verifica que el mismo MensajeID de dos publicantes
+// distintos no se tome como repetición
+func TestQoS2_DeduplicaPorPublicante(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", Autorizador: configuracionAuthTest()})
+	publicar := func(topico string, configurar func(*http.Request)) {
+		cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: topico, Payload: []byte("1"), QoS: 2, MensajeID: "m1"})
+		req, _ := http.NewRequest(http.MethodPost, "http://"+s.direccionHTTP+"/sensorwave?topico="+topico, bytes.NewReader(cuerpo))
+		configurar(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST error = %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST %s = %d", topico, resp.StatusCode)
+		}
+	}
+	conSensor := func(r *http.Request) { r.SetBasicAuth("sensor1", "secreto") }
+	conPanel := func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok-panel") }
+
+	publicar("planta/sala/temp", conSensor)
+	publicar("actuadores/valvula", conPanel)
+	publicar("planta/sala/temp", conSensor)
+
+	e := s.Estadisticas()
+	if e.PorTopico["actuadores/valvula"] != 1 || e.PorTopico["planta/sala/temp"] != 1 {
+		t.Errorf("distribuidos por tópico = %v, esperaba uno de cada publicante", e.PorTopico)
+	}
+	if n := e.Descartes[descarteDuplicado]; n != 1 {
+		t.Errorf("descartes por duplicado = %d, esperaba 1", n)
+	}
+}
+
+// TestQoS2_ClientesEntreganUnaVez reentrega un QoS 2 a suscriptores de cada protocolo
+func TestQoS2_ClientesEntreganUnaVez(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0", PuertoMQTT: "0"})
+	recibidos := make(chan string, 10)
+	entregar := func(protocolo string) func(middleware.Mensaje) {
+		return func(m middleware.Mensaje) { recibidos <- protocolo + ":" + string(m.Payload) }
+	}
+
+	_, puertoHTTP, _ := net.SplitHostPort(s.direccionHTTP)
+	suscriptorHTTP, err := clientehttp.Conectar("localhost", puertoHTTP)
+	if err != nil {
+		t.Fatalf("Conectar HTTP: %v", err)
+	}
+	t.Cleanup(suscriptorHTTP.Desconectar)
+	if err := suscriptorHTTP.SuscribirMensajes("actuadores/#", entregar("http")); err != nil {
+		t.Fatalf("Suscribir HTTP: %v", err)
+	}
+	_, puertoCoAP, _ := net.SplitHostPort(s.direccionCoAP)
+	suscriptorCoAP, err := clientecoap.Conectar("127.0.0.1", puertoCoAP)
+	if err != nil {
+		t.Fatalf("Conectar CoAP: %v", err)
+	}
+	t.Cleanup(suscriptorCoAP.Desconectar)
+	if err := suscriptorCoAP.SuscribirMensajes("actuadores/#", entregar("coap")); err != nil {
+		t.Fatalf("Suscribir CoAP: %v", err)
+	}
+	if err := conectarMQTT(t, s).SuscribirMensajes("actuadores/#", entregar("mqtt")); err != nil {
+		t.Fatalf("Suscribir MQTT: %v", err)
+	}
+
+	// El publicante MQTT usa el flujo PUBREC/PUBREL del broker
+	if err := conectarMQTT(t, s).Publicar("actuadores/v1", "abrir", middleware.ConQoS(2)); err != nil {
+		t.Fatalf("Publicar MQTT: %v", err)
+	}
+	esperados := map[string]bool{"http:abrir": true, "coap:abrir": true, "mqtt:abrir": true}
+	for len(esperados) > 0 {
+		select {
+		case r := <-recibidos:
+			if !esperados[r] {
+				t.Fatalf("entrega inesperada %s", r)
+			}
+			delete(esperados, r)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("faltan entregas: %v", esperados)
+		}
+	}
+
+	// El servidor reentrega un QoS 2 ya confirmado (p. ej. desde la cola de una sesión)
+	reentregado := Mensaje{Topico: "actuadores/v1", Payload: []byte("cerrar"), QoS: 2, MensajeID: "m3"}
+	s.distribuir(LOG_HTTP, reentregado, false)
+	time.Sleep(200 * time.Millisecond)
+	s.distribuir(LOG_HTTP, reentregado, false)
+	time.Sleep(300 * time.Millisecond)
+	if n := len(recibidos); n != 2 {
+		t.Errorf("entregas de la reentrega = %d, esperaba una por HTTP y una por CoAP", n)
+	}
+}
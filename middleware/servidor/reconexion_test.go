@@ -0,0 +1,192 @@
+package servidor
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	clientecoap "github.com/sensorwave-dev/sensorwave/middleware/cliente_coap"
+)
+
+// conectarCoAPVigilado conecta un cliente CoAP con un keepalive breve y se suscribe al tópico
+func conectarCoAPVigilado(t *testing.T, direccionCoAP, topico string) (*clientecoap.ClienteCoAP, <-chan string) {
+	t.Helper()
+	_, puerto, _ := net.SplitHostPort(direccionCoAP)
+	c, err := clientecoap.Conectar("127.0.0.1", puerto, middleware.ConKeepAlive(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Conectar CoAP: %v", err)
+	}
+	t.Cleanup(c.Desconectar)
+	recibidos := make(chan string, 100)
+	if err := c.Suscribir(topico, func(_ string, payload []byte) { recibidos <- string(payload) }); err != nil {
+		t.Fatalf("Suscribir CoAP: %v", err)
+	}
+	return c, recibidos
+}
+
+// esperarEntrega publica hasta que el suscriptor recibe un mensaje, mientras el cliente
+// vuelve a registrar su observación
+func esperarEntrega(t *testing.T, s *Servidor, topico string, recibidos <-chan string) {
+	t.Helper()
+	limite := time.After(10 * time.Second)
+	for {
+		publicarHTTP(t, s, topico, "1")
+		select {
+		case <-recibidos:
+			return
+		case <-time.After(200 * time.Millisecond):
+		case <-limite:
+			t.Fatal("el cliente CoAP no volvió a recibir notificaciones")
+		}
+	}
+}
+
+func observadoresCoAP(s *Servidor, topico string) int {
+	s.mutexCoAP.Lock()
+	defer s.mutexCoAP.Unlock()
+	return len(s.observadores[topico])
+}
+
+func TestClienteCoAP_ReconectaTrasReinicio(t *testing.T) {
+	anterior := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0"})
+	_, recibidos := conectarCoAPVigilado(t, anterior.direccionCoAP, "sensores/t")
+	esperarEntrega(t, anterior, "sensores/t", recibidos)
+
+	_, puerto, _ := net.SplitHostPort(anterior.direccionCoAP)
+	anterior.Cerrar()
+	// El primer intento de reconexión no encuentra servidor y se reintenta con backoff
+	time.Sleep(300 * time.Millisecond)
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: puerto})
+	esperarEntrega(t, s, "sensores/t", recibidos)
+	if n := observadoresCoAP(s, "sensores/t"); n != 1 {
+		t.Errorf("observadores tras reconectar = %d, esperaba 1", n)
+	}
+}
+
+// TestClienteCoAP_RenuevaObservacion verifica que el cliente re-registra una observación
+// que el servidor perdió, sin duplicar las que el servidor conserva
+func TestClienteCoAP_RenuevaObservacion(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0"})
+	_, recibidos := conectarCoAPVigilado(t, s.direccionCoAP, "sensores/t")
+
+	// Varias verificaciones de frescura sin notificaciones: el servidor responde 2.03
+	time.Sleep(1500 * time.Millisecond)
+	if n := observadoresCoAP(s, "sensores/t"); n != 1 {
+		t.Fatalf("observadores tras renovar = %d, esperaba 1", n)
+	}
+
+	s.mutexCoAP.Lock()
+	delete(s.observadores, "sensores/t")
+	s.mutexCoAP.Unlock()
+	esperarEntrega(t, s, "sensores/t", recibidos)
+	time.Sleep(300 * time.Millisecond)
+	if n := observadoresCoAP(s, "sensores/t"); n != 1 {
+		t.Errorf("observadores tras re-registrar = %d, esperaba 1", n)
+	}
+}
+
+func TestClienteCoAP_DesconectarDetieneReconexion(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0"})
+	c, _ := conectarCoAPVigilado(t, s.direccionCoAP, "sensores/t")
+	c.Desconectar()
+
+	s.mutexCoAP.Lock()
+	delete(s.observadores, "sensores/t")
+	s.mutexCoAP.Unlock()
+	time.Sleep(800 * time.Millisecond)
+	if n := observadoresCoAP(s, "sensores/t"); n != 0 {
+		t.Errorf("observadores tras Desconectar = %d, esperaba 0", n)
+	}
+}
+
+// reenvioUDP reenvía datagramas entre un cliente y el servidor; con cortado descarta
+// todo, como un servidor que dejó de responder sin rechazar los paquetes
+type reenvioUDP struct {
+	conn    *net.UDPConn
+	cortado atomic.Bool
+}
+
+func nuevoReenvioUDP(t *testing.T, destino string) *reenvioUDP {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	servidor, err := net.Dial("udp", destino)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(); servidor.Close() })
+	r := &reenvioUDP{conn: conn}
+	var cliente atomic.Pointer[net.UDPAddr]
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, origen, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			cliente.Store(origen)
+			if !r.cortado.Load() {
+				servidor.Write(buf[:n])
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := servidor.Read(buf)
+			if err != nil {
+				return
+			}
+			if destino := cliente.Load(); destino != nil && !r.cortado.Load() {
+				conn.WriteToUDP(buf[:n], destino)
+			}
+		}
+	}()
+	return r
+}
+
+// TestClienteCoAP_DesconectarConColaReintentando verifica que Desconectar no se bloquea
+// mientras la cola local reenvía: la cancelación de la observación agota su timeout ante
+// un servidor que no responde y entretanto vence el backoff del reenvío, que vuelve a
+// c.enviar
+func TestClienteCoAP_DesconectarConColaReintentando(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{
+		PuertoHTTP:      "0",
+		PuertoCoAP:      "0",
+		LimitePorTopico: LimiteTasa{PorSegundo: 0.01, Rafaga: 1},
+	})
+	reenvio := nuevoReenvioUDP(t, s.direccionCoAP)
+	_, puerto, _ := net.SplitHostPort(reenvio.conn.LocalAddr().String())
+	c, err := clientecoap.Conectar("127.0.0.1", puerto, middleware.ConColaLocal(middleware.ColaLocal{}))
+	if err != nil {
+		t.Fatalf("Conectar CoAP: %v", err)
+	}
+	if err := c.Suscribir("actuadores/t", func(string, []byte) {}); err != nil {
+		t.Fatalf("Suscribir CoAP: %v", err)
+	}
+	// La segunda publicación excede la tasa (4.29) y queda en la cola para reenviarse
+	for i := 0; i < 2; i++ {
+		if err := c.Publicar("sensores/t", "1"); err != nil {
+			t.Fatalf("Publicar: %v", err)
+		}
+	}
+	if c.Pendientes() != 1 {
+		t.Fatalf("Pendientes() = %d, esperaba 1", c.Pendientes())
+	}
+	reenvio.cortado.Store(true)
+
+	terminado := make(chan struct{})
+	go func() {
+		c.Desconectar()
+		close(terminado)
+	}()
+	select {
+	case <-terminado:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Desconectar quedó bloqueado con la cola reenviando")
+	}
+}
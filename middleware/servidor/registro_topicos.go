@@ -0,0 +1,352 @@
+package servidor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/mux"
+	"github.com/sensorwave-dev/sensorwave/middleware/formatos"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/errores"
+)
+
+// Registro de tópicos: validación de payloads en el ingreso.
+//
+// Cada DefinicionTopico asocia un patrón de tópicos con un tipo de contenido, un esquema
+// del payload (JSON Schema, ver esquemas.go, o la especificación simple de Campos) y los
+// publicantes permitidos. Una publicación se valida contra todas las definiciones cuyo
+// patrón coincide con su tópico; los tópicos sin definición no se validan. El rechazo es
+// un errores.ErrorValidacion, que cada protocolo informa así:
+//
+//	HTTP        422 (esquema), 415 (tipo de contenido) o 403 (publicante), con el error en JSON
+//	WebSocket   trama de error
+//	CoAP        4.00, 4.15 o 4.03, con el error en JSON
+//	MQTT 5      PUBACK "payload format invalid" o "not authorized" (QoS 1 y 2)
+//	MQTT 3.1.1  el PUBLISH se descarta sin aviso al publicante
+//
+// Las definiciones se consultan en rutaTopicos para que los desarrolladores de
+// dispositivos sepan qué espera cada tópico. Los mensajes de puentes y testamentos no se
+// validan: ya fueron validados en su ingreso o los publica el propio servidor.
+
+const rutaTopicos = "/sensorwave/topicos"
+
+// Tipos de contenido de DefinicionTopico
+const (
+	ContenidoJSON    = "application/json"
+	ContenidoSenML   = formatos.TipoSenMLJSON
+	ContenidoTexto   = "text/plain"
+	ContenidoBinario = tipoBinario
+)
+
+// DefinicionTopico describe lo que se espera de las publicaciones en los tópicos que
+// coinciden con Patron (admite + y #). Esquema y Campos son excluyentes; con cualquiera
+// de los dos el payload debe ser JSON. Campos asocia cada campo de un objeto a su tipo
+// (numero, entero, texto, booleano, objeto o lista; con el sufijo "?" es opcional).
+// Publicantes lista los usuarios autenticados que pueden publicar (vacío = todos los que
+// autoriza la ACL; sin Autorizador, el usuario es UsuarioAnonimo).
+type DefinicionTopico struct {
+	Patron        string            `json:"patron"`
+	Descripcion   string            `json:"descripcion,omitempty"`
+	TipoContenido string            `json:"tipo_contenido,omitempty"`
+	Esquema       json.RawMessage   `json:"esquema,omitempty"`
+	Campos        map[string]string `json:"campos,omitempty"`
+	Publicantes   []string          `json:"publicantes,omitempty"`
+}
+
+// definicionRegistrada es una DefinicionTopico con su esquema compilado
+type definicionRegistrada struct {
+	DefinicionTopico
+	esquema     *esquema // nil = sin esquema
+	publicantes map[string]bool
+}
+
+// registroTopicos guarda las definiciones por patrón normalizado
+type registroTopicos struct {
+	mu           sync.RWMutex
+	definiciones map[string]*definicionRegistrada
+}
+
+func nuevoRegistroTopicos() *registroTopicos {
+	return &registroTopicos{definiciones: make(map[string]*definicionRegistrada)}
+}
+
+// CargarTopicos lee un archivo JSON con una lista de definiciones de tópicos
+func CargarTopicos(ruta string) ([]DefinicionTopico, error) {
+	datos, err := os.ReadFile(ruta)
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo definiciones de tópicos: %w", err)
+	}
+	var definiciones []DefinicionTopico
+	if err := json.Unmarshal(datos, &definiciones); err != nil {
+		return nil, fmt.Errorf("error parseando definiciones de tópicos: %w", err)
+	}
+	for _, d := range definiciones {
+		if _, err := compilarDefinicion(d); err != nil {
+			return nil, err
+		}
+	}
+	return definiciones, nil
+}
+
+// compilarDefinicion valida la definición y compila su esquema
+func compilarDefinicion(d DefinicionTopico) (*definicionRegistrada, error) {
+	patron, err := normalizarYValidarTopico(d.Patron, true)
+	if err != nil {
+		return nil, fmt.Errorf("definición de tópico: patrón inválido '%s'", d.Patron)
+	}
+	if esCompartida(patron) {
+		return nil, fmt.Errorf("definición de tópico %s: el patrón no puede ser una suscripción compartida", patron)
+	}
+	d.Patron = patron
+
+	switch d.TipoContenido {
+	case "", ContenidoJSON, ContenidoSenML, ContenidoTexto, ContenidoBinario:
+	default:
+		return nil, fmt.Errorf("definición de tópico %s: tipo de contenido no soportado: %s", patron, d.TipoContenido)
+	}
+
+	r := &definicionRegistrada{DefinicionTopico: d}
+	conEsquema := len(d.Esquema) > 0 || len(d.Campos) > 0
+	if conEsquema && d.TipoContenido != "" && d.TipoContenido != ContenidoJSON {
+		return nil, fmt.Errorf("definición de tópico %s: el esquema requiere contenido %s", patron, ContenidoJSON)
+	}
+	switch {
+	case len(d.Esquema) > 0 && len(d.Campos) > 0:
+		return nil, fmt.Errorf("definición de tópico %s: esquema y campos son excluyentes", patron)
+	case len(d.Esquema) > 0:
+		r.esquema, err = compilarEsquema(d.Esquema)
+	case len(d.Campos) > 0:
+		r.esquema, err = esquemaDeCampos(d.Campos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("definición de tópico %s: %w", patron, err)
+	}
+
+	if len(d.Publicantes) > 0 {
+		r.publicantes = make(map[string]bool, len(d.Publicantes))
+		for _, p := range d.Publicantes {
+			r.publicantes[p] = true
+		}
+	}
+	return r, nil
+}
+
+// validar aplica las definiciones que coinciden con el tópico del mensaje
+func (r *registroTopicos) validar(usuario string, m Mensaje) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.definiciones) == 0 {
+		return nil
+	}
+	// Un retenido vacío borra el retenido del tópico: no es una medición
+	if m.Retenido && len(m.Payload) == 0 {
+		return nil
+	}
+	for _, patron := range r.patronesOrdenados() {
+		d := r.definiciones[patron]
+		if !coincidePatron(m.Topico, patron) {
+			continue
+		}
+		if err := d.validar(usuario, m.Payload); err != nil {
+			err.Topico = m.Topico
+			return err
+		}
+	}
+	return nil
+}
+
+// patronesOrdenados da un orden estable a la validación (y por lo tanto al error informado)
+func (r *registroTopicos) patronesOrdenados() []string {
+	patrones := make([]string, 0, len(r.definiciones))
+	for patron := range r.definiciones {
+		patrones = append(patrones, patron)
+	}
+	sort.Strings(patrones)
+	return patrones
+}
+
+// validar comprueba publicante, tipo de contenido y esquema, en ese orden
+func (d *definicionRegistrada) validar(usuario string, payload []byte) *errores.ErrorValidacion {
+	if d.publicantes != nil && !d.publicantes[usuario] {
+		return &errores.ErrorValidacion{Motivo: errores.MotivoPublicante, Detalle: fmt.Sprintf("%s no puede publicar en %s", usuario, d.Patron)}
+	}
+
+	tipo := d.TipoContenido
+	if tipo == "" && d.esquema != nil {
+		tipo = ContenidoJSON
+	}
+	var valido bool
+	switch tipo {
+	case ContenidoJSON:
+		valido = json.Valid(payload)
+	case ContenidoSenML:
+		_, err := formatos.DecodificarSenML(payload)
+		valido = err == nil
+	case ContenidoTexto:
+		valido = utf8.Valid(payload)
+	default:
+		valido = true
+	}
+	if !valido {
+		return &errores.ErrorValidacion{Motivo: errores.MotivoTipoContenido, Detalle: "se esperaba " + tipo}
+	}
+
+	if d.esquema == nil {
+		return nil
+	}
+	var valor any
+	if err := json.Unmarshal(payload, &valor); err != nil {
+		return &errores.ErrorValidacion{Motivo: errores.MotivoTipoContenido, Detalle: "se esperaba " + ContenidoJSON}
+	}
+	if err := d.esquema.validar(valor, "$"); err != nil {
+		return &errores.ErrorValidacion{Motivo: errores.MotivoEsquema, Detalle: err.Error()}
+	}
+	return nil
+}
+
+// RegistrarTopico agrega o reemplaza la definición del patrón
+func (s *Servidor) RegistrarTopico(d DefinicionTopico) error {
+	r, err := compilarDefinicion(d)
+	if err != nil {
+		return err
+	}
+	s.topicos.mu.Lock()
+	s.topicos.definiciones[r.Patron] = r
+	s.topicos.mu.Unlock()
+	return nil
+}
+
+// EliminarTopico quita la definición del patrón; retorna false si no existía
+func (s *Servidor) EliminarTopico(patron string) bool {
+	patron, err := normalizarYValidarTopico(patron, true)
+	if err != nil {
+		return false
+	}
+	s.topicos.mu.Lock()
+	defer s.topicos.mu.Unlock()
+	if _, ok := s.topicos.definiciones[patron]; !ok {
+		return false
+	}
+	delete(s.topicos.definiciones, patron)
+	return true
+}
+
+// Topicos retorna las definiciones registradas, ordenadas por patrón
+func (s *Servidor) Topicos() []DefinicionTopico {
+	return s.definicionesTopico(func(string) bool { return true })
+}
+
+// DefinicionesTopico retorna las definiciones que se aplican a las publicaciones en el tópico
+func (s *Servidor) DefinicionesTopico(topico string) []DefinicionTopico {
+	topico, err := normalizarYValidarTopico(topico, false)
+	if err != nil {
+		return nil
+	}
+	return s.definicionesTopico(func(patron string) bool { return coincidePatron(topico, patron) })
+}
+
+func (s *Servidor) definicionesTopico(incluir func(patron string) bool) []DefinicionTopico {
+	s.topicos.mu.RLock()
+	defer s.topicos.mu.RUnlock()
+	definiciones := []DefinicionTopico{}
+	for _, patron := range s.topicos.patronesOrdenados() {
+		if incluir(patron) {
+			definiciones = append(definiciones, s.topicos.definiciones[patron].DefinicionTopico)
+		}
+	}
+	return definiciones
+}
+
+// validarPublicacion aplica el registro de tópicos a una publicación de un cliente
+func (s *Servidor) validarPublicacion(LOG, usuario string, m Mensaje) error {
+	err := s.topicos.validar(usuario, m)
+	if err != nil {
+		loggerPrint(LOG, "Publicación rechazada - Usuario: %s, %v", usuario, err)
+		s.metricas.descartes.sumar(descarteValidacion, 1)
+	}
+	return err
+}
+
+// manejarTopicosHTTP lista las definiciones registradas; con ?topico= solo las que se
+// aplican a ese tópico. Con autenticación, requiere credenciales válidas.
+func (s *Servidor) manejarTopicosHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := s.autenticar(credencialesHTTP(r), identidadTLS(r.TLS)); err != nil {
+		responderErrorAuthHTTP(w, errNoAutenticado)
+		return
+	}
+	definiciones := s.Topicos()
+	if topico := r.URL.Query().Get("topico"); topico != "" {
+		if _, err := normalizarYValidarTopico(topico, false); err != nil {
+			http.Error(w, "Topico invalido", http.StatusBadRequest)
+			return
+		}
+		definiciones = s.DefinicionesTopico(topico)
+	}
+	w.Header().Set("Content-Type", ContenidoJSON)
+	_ = json.NewEncoder(w).Encode(definiciones)
+}
+
+// responderErrorValidacionHTTP informa el rechazo con el código del motivo y el error en JSON
+func responderErrorValidacionHTTP(w http.ResponseWriter, err error) {
+	var ev *errores.ErrorValidacion
+	if !errors.As(err, &ev) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	codigo := http.StatusUnprocessableEntity
+	switch ev.Motivo {
+	case errores.MotivoTipoContenido:
+		codigo = http.StatusUnsupportedMediaType
+	case errores.MotivoPublicante:
+		codigo = http.StatusForbidden
+	}
+	w.Header().Set("Content-Type", ContenidoJSON)
+	w.WriteHeader(codigo)
+	_ = json.NewEncoder(w).Encode(ev)
+}
+
+// responderErrorValidacionCoAP es el equivalente CoAP de responderErrorValidacionHTTP.
+// CoAP no tiene 4.22: un payload que no cumple el esquema se rechaza con 4.00.
+func responderErrorValidacionCoAP(w mux.ResponseWriter, err error) {
+	var ev *errores.ErrorValidacion
+	if !errors.As(err, &ev) {
+		_ = w.SetResponse(codes.BadRequest, message.TextPlain, bytes.NewReader([]byte(err.Error())))
+		return
+	}
+	codigo := codes.BadRequest
+	switch ev.Motivo {
+	case errores.MotivoTipoContenido:
+		codigo = codes.UnsupportedMediaType
+	case errores.MotivoPublicante:
+		codigo = codes.Forbidden
+	}
+	cuerpo, _ := json.Marshal(ev)
+	_ = w.SetResponse(codigo, message.AppJSON, bytes.NewReader(cuerpo))
+}
+
+// rechazoValidacionMQTT es el error que OnPublish retorna al broker: MQTT 5 informa el
+// motivo en el PUBACK; en MQTT 3.1.1 el PUBLISH se descarta
+func rechazoValidacionMQTT(cl *mochi.Client, pk packets.Packet, err error) error {
+	if cl.Properties.ProtocolVersion != 5 || pk.FixedHeader.Qos == 0 {
+		return packets.ErrRejectPacket
+	}
+	var ev *errores.ErrorValidacion
+	if errors.As(err, &ev) && ev.Motivo == errores.MotivoPublicante {
+		return packets.ErrNotAuthorized
+	}
+	return packets.ErrPayloadFormatInvalid
+}
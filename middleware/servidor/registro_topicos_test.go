@@ -0,0 +1,194 @@
+package servidor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	clientecoap "github.com/sensorwave-dev/sensorwave/middleware/cliente_coap"
+	clientehttp "github.com/sensorwave-dev/sensorwave/middleware/cliente_http"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/errores"
+)
+
+var definicionesTest = []DefinicionTopico{
+	{
+		Patron:      "sensores/+/temperatura",
+		Descripcion: "Temperatura en grados Celsius",
+		Esquema:     json.RawMessage(`{"type": "object", "required": ["valor"], "properties": {"valor": {"type": "number"}}}`),
+	},
+	{Patron: "sensores/+/estado", Campos: map[string]string{"activo": "booleano", "nota": "texto?"}},
+	{Patron: "sensores/+/nombre", TipoContenido: ContenidoTexto},
+	{Patron: "actuadores/#", Publicantes: []string{"controlador"}},
+}
+
+func TestRegistroTopicos_ClientesRecibenErrorValidacion(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0", Topicos: definicionesTest})
+	lineas := suscribirSSE(t, s, "sensores/#")
+
+	_, puertoHTTP, _ := net.SplitHostPort(s.direccionHTTP)
+	_, puertoCoAP, _ := net.SplitHostPort(s.direccionCoAP)
+	ch, err := clientehttp.Conectar("localhost", puertoHTTP)
+	if err != nil {
+		t.Fatalf("Conectar HTTP: %v", err)
+	}
+	t.Cleanup(ch.Desconectar)
+	cc, err := clientecoap.Conectar("127.0.0.1", puertoCoAP)
+	if err != nil {
+		t.Fatalf("Conectar CoAP: %v", err)
+	}
+	t.Cleanup(cc.Desconectar)
+
+	for nombre, c := range map[string]middleware.Cliente{"http": ch, "coap": cc} {
+		casos := []struct {
+			topico  string
+			payload string
+			qos     int
+			motivo  string
+		}{
+			{topico: "sensores/s1/temperatura", payload: `{"valor": "alta"}`, motivo: errores.MotivoEsquema},
+			{topico: "sensores/s1/temperatura", payload: `{"unidad": "C"}`, qos: 1, motivo: errores.MotivoEsquema},
+			{topico: "sensores/s1/temperatura", payload: `21.5 C`, motivo: errores.MotivoTipoContenido},
+			{topico: "sensores/s1/estado", payload: `{"nota": "x"}`, motivo: errores.MotivoEsquema},
+			{topico: "sensores/s1/nombre", payload: "\xff\xfe", motivo: errores.MotivoTipoContenido},
+			{topico: "actuadores/valvula", payload: "abrir", motivo: errores.MotivoPublicante},
+		}
+		for _, caso := range casos {
+			err := c.Publicar(caso.topico, caso.payload, middleware.ConQoS(caso.qos))
+			var ev *errores.ErrorValidacion
+			if !errors.As(err, &ev) || ev.Motivo != caso.motivo || ev.Topico != caso.topico {
+				t.Errorf("%s: Publicar(%s, %q) = %v, esperaba un rechazo por %s", nombre, caso.topico, caso.payload, err, caso.motivo)
+			}
+			if !errors.Is(err, errores.ErrValidacion) || !errors.Is(err, errores.ErrPublicacion) {
+				t.Errorf("%s: el error %v no se categoriza como validación y publicación", nombre, err)
+			}
+		}
+
+		if err := c.Publicar("sensores/s1/temperatura", `{"valor": 21.5}`); err != nil {
+			t.Fatalf("%s: Publicar válido error = %v", nombre, err)
+		}
+		if m := leerMensajeSSE(t, lineas); string(m.Payload) != `{"valor": 21.5}` {
+			t.Errorf("%s: mensaje = %s, esperaba la publicación válida", nombre, m.Payload)
+		}
+	}
+	select {
+	case dato := <-lineas:
+		t.Errorf("se distribuyó una publicación inválida: %s", dato)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := s.metricas.descartes.instantanea()[descarteValidacion]; n != 12 {
+		t.Errorf("descartes por validación = %d, esperaba 12", n)
+	}
+}
+
+func TestRegistroTopicos_Publicantes(t *testing.T) {
+	auth := &ConfiguracionAuth{
+		Usuarios: []UsuarioAuth{{Usuario: "controlador", Clave: "x"}, {Usuario: "sensor", Clave: "y"}},
+		ACL:      []ReglaACL{{Usuario: "*", Publicar: []string{"#"}}},
+	}
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", Autorizador: auth, Topicos: definicionesTest})
+
+	codigos := map[string]int{"controlador:x": http.StatusOK, "sensor:y": http.StatusForbidden}
+	for credenciales, esperado := range codigos {
+		usuario, clave, _ := bytes.Cut([]byte(credenciales), []byte(":"))
+		cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: "actuadores/valvula", Payload: []byte("abrir")})
+		req, _ := http.NewRequest(http.MethodPost, "http://"+s.direccionHTTP+"/sensorwave?topico=actuadores/valvula", bytes.NewReader(cuerpo))
+		req.SetBasicAuth(string(usuario), string(clave))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST error = %v", err)
+		}
+		var ev errores.ErrorValidacion
+		_ = json.NewDecoder(resp.Body).Decode(&ev)
+		resp.Body.Close()
+		if resp.StatusCode != esperado {
+			t.Errorf("POST de %s = %d, esperaba %d", usuario, resp.StatusCode, esperado)
+		}
+		if esperado == http.StatusForbidden && ev.Motivo != errores.MotivoPublicante {
+			t.Errorf("cuerpo del rechazo = %+v, esperaba el motivo %s", ev, errores.MotivoPublicante)
+		}
+	}
+}
+
+func TestRegistroTopicos_DescartaPublicacionMQTT(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoMQTT: "0", Topicos: definicionesTest})
+	lineas := suscribirSSE(t, s, "sensores/#")
+	r := recibirMQTT(t, s, "sensores/#")
+
+	// MQTT 3.1.1 descarta el PUBLISH sin PUBACK: con QoS 0 el publicante no lo espera
+	publicante := conectarMQTT(t, s)
+	if err := publicante.Publicar("sensores/s1/temperatura", `{"valor": "alta"}`); err != nil {
+		t.Fatalf("Publicar MQTT: %v", err)
+	}
+	if err := publicante.Publicar("sensores/s1/temperatura", `{"valor": 21.5}`); err != nil {
+		t.Fatalf("Publicar MQTT: %v", err)
+	}
+	if m := leerMensajeSSE(t, lineas); string(m.Payload) != `{"valor": 21.5}` {
+		t.Errorf("mensaje = %s, esperaba solo la publicación válida", m.Payload)
+	}
+	time.Sleep(200 * time.Millisecond)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.mensajes) != 1 || string(r.mensajes[0].Payload) != `{"valor": 21.5}` {
+		t.Errorf("mensajes MQTT = %d, esperaba solo la publicación válida", len(r.mensajes))
+	}
+}
+
+func TestRegistroTopicos_Consulta(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", Topicos: definicionesTest})
+	if err := s.RegistrarTopico(DefinicionTopico{Patron: "/sensores/+/humedad/", Campos: map[string]string{"valor": "numero"}}); err != nil {
+		t.Fatalf("RegistrarTopico() error = %v", err)
+	}
+
+	consultar := func(query string) []DefinicionTopico {
+		t.Helper()
+		resp, err := http.Get("http://" + s.direccionHTTP + rutaTopicos + query)
+		if err != nil {
+			t.Fatalf("GET tópicos: %v", err)
+		}
+		defer resp.Body.Close()
+		var definiciones []DefinicionTopico
+		if err := json.NewDecoder(resp.Body).Decode(&definiciones); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET tópicos = %d, %v", resp.StatusCode, err)
+		}
+		return definiciones
+	}
+
+	if todas := consultar(""); len(todas) != 5 || todas[0].Patron != "actuadores/#" {
+		t.Errorf("definiciones = %+v, esperaba las 5 ordenadas por patrón", todas)
+	}
+	aplicables := consultar("?topico=sensores/s1/temperatura")
+	if len(aplicables) != 1 || aplicables[0].Descripcion != "Temperatura en grados Celsius" || len(aplicables[0].Esquema) == 0 {
+		t.Errorf("definiciones de sensores/s1/temperatura = %+v", aplicables)
+	}
+	if aplicables := consultar("?topico=sensores/s1/humedad"); len(aplicables) != 1 || aplicables[0].Patron != "sensores/+/humedad" {
+		t.Errorf("definiciones de sensores/s1/humedad = %+v, esperaba el patrón normalizado", aplicables)
+	}
+
+	if !s.EliminarTopico("sensores/+/humedad") || s.EliminarTopico("sensores/+/humedad") {
+		t.Error("EliminarTopico() debe quitar la definición una sola vez")
+	}
+	if aplicables := consultar("?topico=otros/t"); len(aplicables) != 0 {
+		t.Errorf("definiciones de otros/t = %+v, esperaba ninguna", aplicables)
+	}
+}
+
+func TestRegistroTopicos_DefinicionesInvalidas(t *testing.T) {
+	for _, d := range []DefinicionTopico{
+		{Patron: "sensores/#/t"},
+		{Patron: "$share/g/sensores/#"},
+		{Patron: "sensores/#", TipoContenido: "application/xml"},
+		{Patron: "sensores/#", TipoContenido: ContenidoTexto, Campos: map[string]string{"valor": "numero"}},
+		{Patron: "sensores/#", Campos: map[string]string{"valor": "decimal"}},
+		{Patron: "sensores/#", Esquema: json.RawMessage(`{"type": "object"}`), Campos: map[string]string{"valor": "numero"}},
+		{Patron: "sensores/#", Esquema: json.RawMessage(`{"allOf": []}`)},
+	} {
+		if _, err := Crear(Opciones{PuertoHTTP: "0", Topicos: []DefinicionTopico{d}}); err == nil {
+			t.Errorf("Crear() aceptó la definición inválida %+v", d)
+		}
+	}
+}
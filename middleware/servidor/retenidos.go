@@ -0,0 +1,162 @@
+package servidor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const LOG_RETENIDOS = "RETENIDOS"
+
+// Mensajes retenidos unificados entre protocolos: el servidor guarda el último mensaje
+// retenido de cada tópico y lo entrega al suscribirse por HTTP (SSE) o CoAP (observe).
+// El almacén se replica en el de retenidos del broker MQTT, de modo que los
+// suscriptores MQTT reciben los mismos mensajes de forma nativa.
+
+// almacenRetenidos guarda el último mensaje retenido por tópico
+type almacenRetenidos struct {
+	mu       sync.Mutex
+	ruta     string // archivo JSON de persistencia ("" = solo memoria)
+	mensajes map[string]Mensaje
+}
+
+func nuevoAlmacenRetenidos(ruta string) *almacenRetenidos {
+	return &almacenRetenidos{ruta: ruta, mensajes: make(map[string]Mensaje)}
+}
+
+// cargar lee el archivo de persistencia. Un archivo inexistente equivale a un almacén vacío.
+func (a *almacenRetenidos) cargar() error {
+	if a.ruta == "" {
+		return nil
+	}
+	datos, err := os.ReadFile(a.ruta)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error leyendo mensajes retenidos: %w", err)
+	}
+
+	var mensajes []Mensaje
+	if err := json.Unmarshal(datos, &mensajes); err != nil {
+		return fmt.Errorf("error parseando mensajes retenidos: %w", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, m := range mensajes {
+		a.mensajes[m.Topico] = m
+	}
+	return nil
+}
+
+// guardar reemplaza el retenido del tópico; un payload vacío lo borra
+func (a *almacenRetenidos) guardar(m Mensaje) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(m.Payload) == 0 {
+		delete(a.mensajes, m.Topico)
+	} else {
+		a.mensajes[m.Topico] = m
+	}
+	return a.persistir()
+}
+
+// persistir escribe el almacén completo de forma atómica. Requiere a.mu tomado.
+func (a *almacenRetenidos) persistir() error {
+	if a.ruta == "" {
+		return nil
+	}
+	datos, err := json.Marshal(a.ordenados(func(string) bool { return true }))
+	if err != nil {
+		return fmt.Errorf("error serializando mensajes retenidos: %w", err)
+	}
+	if err := escribirArchivoAtomico(a.ruta, datos); err != nil {
+		return fmt.Errorf("error persistiendo mensajes retenidos: %w", err)
+	}
+	return nil
+}
+
+// coincidentes retorna los retenidos vigentes cuyo tópico coincide con el patrón, ordenados por tópico
+func (a *almacenRetenidos) coincidentes(patron string) []Mensaje {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.ordenados(func(topico string) bool { return coincidePatron(topico, patron) })
+}
+
+// ordenados filtra y ordena por tópico. Requiere a.mu tomado.
+func (a *almacenRetenidos) ordenados(filtro func(string) bool) []Mensaje {
+	var resultado []Mensaje
+	for topico, m := range a.mensajes {
+		if filtro(topico) && !m.Expirado() {
+			resultado = append(resultado, m)
+		}
+	}
+	sort.Slice(resultado, func(i, j int) bool { return resultado[i].Topico < resultado[j].Topico })
+	return resultado
+}
+
+// retener guarda un mensaje marcado como retenido y sincroniza el retenido del broker MQTT.
+// Los mensajes sin la marca se ignoran.
+func (s *Servidor) retener(m Mensaje) {
+	if !m.Retenido {
+		return
+	}
+	if err := s.retenidos.guardar(m); err != nil {
+		loggerPrint(LOG_RETENIDOS, "Error - %v", err)
+	}
+	if broker := s.obtenerBrokerMQTT(); broker != nil {
+		retenerEnBroker(broker, m)
+	}
+	if len(m.Payload) == 0 {
+		loggerPrint(LOG_RETENIDOS, "Retenido borrado - Tópico: %s", m.Topico)
+	} else {
+		loggerPrint(LOG_RETENIDOS, "Retenido actualizado - Tópico: %s", m.Topico)
+	}
+}
+
+// retenerEnBroker replica un retenido en el índice del broker MQTT. Un payload vacío lo borra.
+func retenerEnBroker(broker *mochi.Server, m Mensaje) {
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true, Qos: byte(m.QoS)},
+		TopicName:   m.Topico,
+	}
+	if len(m.Payload) > 0 {
+		datos, err := json.Marshal(m)
+		if err != nil {
+			loggerPrint(LOG_RETENIDOS, "Error - No se pudo serializar retenido: %v", err)
+			return
+		}
+		pk.Payload = datos
+	}
+	broker.Topics.RetainMessage(pk)
+}
+
+// enviarRetenidosHTTP encola en un suscriptor SSE recién registrado los retenidos de su patrón
+func (s *Servidor) enviarRetenidosHTTP(cliente *Cliente, patron string) {
+	for _, m := range s.retenidos.coincidentes(patron) {
+		m = s.porReferencia(m, umbralReferenciaHTTP)
+		if m.QoS >= 1 {
+			s.enviarHTTPQoS1(LOG_HTTP, cliente, m)
+			continue
+		}
+		if !cliente.enviar(m) {
+			loggerPrint(LOG_HTTP, "Error - No se pudo enviar retenido - ClienteID: %s, Tópico: %s", cliente.ID, m.Topico)
+		}
+	}
+}
+
+// enviarRetenidosCoAP notifica a un observador recién registrado los retenidos de su patrón
+func (s *Servidor) enviarRetenidosCoAP(o Conexion, patron string) {
+	for _, m := range s.retenidos.coincidentes(patron) {
+		m = s.porReferencia(m, umbralReferenciaCoAP)
+		if err := o.notificar(m, s.valorObserve.Add(1), tipoCoAPPorQoS(m.QoS)); err != nil {
+			loggerPrint(LOG_COAP, "Error - No se pudo enviar retenido - Tópico: %s, Error: %v", m.Topico, err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package servidor
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	clientecoap "github.com/sensorwave-dev/sensorwave/middleware/cliente_coap"
+	clientemqtt "github.com/sensorwave-dev/sensorwave/middleware/cliente_mqtt"
+)
+
+func publicarRetenidoHTTP(t *testing.T, s *Servidor, topico, payload string) {
+	t.Helper()
+	cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: topico, Payload: []byte(payload), Retenido: true})
+	resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico="+topico, "application/json", bytes.NewReader(cuerpo))
+	if err != nil {
+		t.Fatalf("error publicando: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("publicación rechazada: %d", resp.StatusCode)
+	}
+}
+
+func esperarPayload(t *testing.T, recibidos <-chan string, esperado string) {
+	t.Helper()
+	select {
+	case payload := <-recibidos:
+		if payload != esperado {
+			t.Errorf("payload = %q, esperaba %q", payload, esperado)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no se recibió %q", esperado)
+	}
+}
+
+func TestAlmacenRetenidos(t *testing.T) {
+	ruta := filepath.Join(t.TempDir(), "retenidos.json")
+	a := nuevoAlmacenRetenidos(ruta)
+
+	a.guardar(Mensaje{Topico: "valvulas/v1/estado", Payload: []byte("abierta"), Retenido: true})
+	a.guardar(Mensaje{Topico: "valvulas/v2/estado", Payload: []byte("cerrada"), Retenido: true})
+	a.guardar(Mensaje{Topico: "valvulas/v1/estado", Payload: []byte("cerrada"), Retenido: true})
+	a.guardar(Mensaje{Topico: "bombas/b1/estado", Payload: []byte("on"), Retenido: true})
+
+	coincidentes := a.coincidentes("valvulas/+/estado")
+	if len(coincidentes) != 2 || coincidentes[0].Topico != "valvulas/v1/estado" || string(coincidentes[0].Payload) != "cerrada" {
+		t.Fatalf("coincidentes inesperados: %+v", coincidentes)
+	}
+
+	// Payload vacío borra el retenido
+	a.guardar(Mensaje{Topico: "bombas/b1/estado", Retenido: true})
+	if len(a.coincidentes("#")) != 2 {
+		t.Errorf("el retenido de bombas/b1/estado debería haberse borrado")
+	}
+
+	recargado := nuevoAlmacenRetenidos(ruta)
+	if err := recargado.cargar(); err != nil {
+		t.Fatalf("cargar() error = %v", err)
+	}
+	if len(recargado.coincidentes("#")) != 2 {
+		t.Errorf("el archivo debería tener 2 retenidos, tiene %d", len(recargado.coincidentes("#")))
+	}
+
+	if err := nuevoAlmacenRetenidos(filepath.Join(t.TempDir(), "no-existe.json")).cargar(); err != nil {
+		t.Errorf("un archivo inexistente debería equivaler a un almacén vacío: %v", err)
+	}
+}
+
+// TestRetenidos_EntregaEntreProtocolos verifica que un retenido publicado por HTTP
+// se entrega al suscribirse por HTTP, CoAP y MQTT
+func TestRetenidos_EntregaEntreProtocolos(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0", PuertoMQTT: "0"})
+	publicarRetenidoHTTP(t, s, "actuadores/valvula1/estado", "abierta")
+	publicarHTTP(t, s, "actuadores/valvula1/estado/temporal", "no retenido")
+
+	// HTTP: el retenido llega inmediatamente después del clienteID
+	lineas := suscribirSSE(t, s, "actuadores/+/estado")
+	select {
+	case dato := <-lineas:
+		var m Mensaje
+		json.Unmarshal([]byte(dato), &m)
+		if string(m.Payload) != "abierta" || !m.Retenido {
+			t.Errorf("retenido inesperado por HTTP: %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no se recibió el retenido por HTTP")
+	}
+
+	// CoAP
+	_, puertoCoAP, _ := net.SplitHostPort(s.direccionCoAP)
+	cCoAP, err := clientecoap.Conectar("127.0.0.1", puertoCoAP)
+	if err != nil {
+		t.Fatalf("Conectar CoAP: %v", err)
+	}
+	defer cCoAP.Desconectar()
+	recibidosCoAP := make(chan string, 1)
+	if err := cCoAP.Suscribir("actuadores/valvula1/estado", func(_ string, payload []byte) { recibidosCoAP <- string(payload) }); err != nil {
+		t.Fatalf("Suscribir CoAP: %v", err)
+	}
+	esperarPayload(t, recibidosCoAP, "abierta")
+
+	// MQTT: el retenido se replicó en el broker
+	_, puertoMQTT, _ := net.SplitHostPort(s.direccionMQTT)
+	cMQTT, err := clientemqtt.Conectar("127.0.0.1", puertoMQTT)
+	if err != nil {
+		t.Fatalf("Conectar MQTT: %v", err)
+	}
+	defer cMQTT.Desconectar()
+	recibidosMQTT := make(chan string, 1)
+	if err := cMQTT.Suscribir("actuadores/valvula1/estado", func(_ string, payload []byte) { recibidosMQTT <- string(payload) }); err != nil {
+		t.Fatalf("Suscribir MQTT: %v", err)
+	}
+	esperarPayload(t, recibidosMQTT, "abierta")
+
+	// Un retenido con payload vacío borra el estado para los nuevos suscriptores
+	publicarRetenidoHTTP(t, s, "actuadores/valvula1/estado", "")
+	lineas = suscribirSSE(t, s, "actuadores/valvula1/estado")
+	select {
+	case dato := <-lineas:
+		t.Errorf("no se esperaba retenido tras el borrado: %s", dato)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// TestRetenidos_PublicadoPorMQTT verifica que el flag retain de MQTT alimenta el almacén
+func TestRetenidos_PublicadoPorMQTT(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoMQTT: "0"})
+	_, puerto, _ := net.SplitHostPort(s.direccionMQTT)
+	c, err := clientemqtt.Conectar("127.0.0.1", puerto)
+	if err != nil {
+		t.Fatalf("Conectar MQTT: %v", err)
+	}
+	defer c.Desconectar()
+
+	if err := c.Publicar("planta/modo", "automatico", middleware.ConRetencion()); err != nil {
+		t.Fatalf("Publicar: %v", err)
+	}
+	limite := time.Now().Add(2 * time.Second)
+	for len(s.retenidos.coincidentes("planta/modo")) == 0 {
+		if time.Now().After(limite) {
+			t.Fatal("el retenido MQTT no llegó al almacén")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lineas := suscribirSSE(t, s, "planta/modo")
+	select {
+	case dato := <-lineas:
+		var m Mensaje
+		json.Unmarshal([]byte(dato), &m)
+		if string(m.Payload) != "automatico" {
+			t.Errorf("retenido inesperado: %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no se recibió el retenido publicado por MQTT")
+	}
+}
+
+func TestRetenidos_Persistencia(t *testing.T) {
+	ruta := filepath.Join(t.TempDir(), "retenidos.json")
+	s1 := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", ArchivoRetenidos: ruta})
+	publicarRetenidoHTTP(t, s1, "planta/modo", "manual")
+	s1.Cerrar()
+
+	s2 := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", ArchivoRetenidos: ruta})
+	lineas := suscribirSSE(t, s2, "planta/modo")
+	select {
+	case dato := <-lineas:
+		var m Mensaje
+		json.Unmarshal([]byte(dato), &m)
+		if string(m.Payload) != "manual" {
+			t.Errorf("retenido inesperado tras reiniciar: %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("el retenido no sobrevivió al reinicio")
+	}
+}
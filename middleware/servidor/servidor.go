@@ -0,0 +1,381 @@
+package servidor
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	piondtls "github.com/pion/dtls/v3"
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/formatos"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/qos"
+)
+
+// tiempoCierreHTTP es la espera máxima para que terminen las solicitudes HTTP en curso al cerrar
+const tiempoCierreHTTP = 5 * time.Second
+
+// Opciones configura la creación de un Servidor.
+// Los protocolos con puerto vacío no se inician; se requiere al menos uno.
+type Opciones struct {
+	PuertoHTTP string             // Puerto HTTP/SSE y WebSocket (opcional)
+	PuertoCoAP string             // Puerto CoAP/UDP (opcional)
+	PuertoMQTT string             // Puerto del broker MQTT embebido (opcional)
+	Upstream   middleware.Cliente // Cliente remoto para federación (opcional, ver ConfigurarUpstream)
+
+	// Puentes conecta la instancia con otros servidores del middleware, con filtros de
+	// entrada y salida y reescritura de tópicos (ver Puente). Se inician con Iniciar.
+	Puentes []Puente
+
+	// PuertoMQTTWebSocket agrega al broker un listener MQTT sobre WebSocket para
+	// navegadores (subprotocolo "mqtt", en cualquier ruta). Requiere PuertoMQTT y usa
+	// la misma configuración TLS (wss).
+	PuertoMQTTWebSocket string
+
+	// Autorizador valida credenciales y ACL por tópico (nil = sin autenticación).
+	// Ver CargarConfiguracionAuth para la implementación basada en archivo.
+	Autorizador Autorizador
+
+	// TLS habilita HTTPS y MQTT sobre TLS (nil = texto plano). Con ClientAuth
+	// RequireAndVerifyClientCert el CommonName del certificado identifica al cliente.
+	// Ver CargarConfiguracionTLS.
+	TLS *tls.Config
+	// DTLS habilita CoAP sobre DTLS con certificados o PSK (nil = UDP plano).
+	// Ver ConfiguracionDTLSDesdeTLS y ConfiguracionDTLSConPSK.
+	DTLS *piondtls.Config
+
+	// ArchivoRetenidos persiste los mensajes retenidos en un archivo JSON ("" = solo memoria)
+	ArchivoRetenidos string
+
+	// Sesiones persistentes: los suscriptores HTTP y CoAP que indican un ID de sesión
+	// reciben al reconectar los mensajes publicados mientras estaban desconectados.
+	// ExpiracionSesion también limita las sesiones MQTT con clean-session=false.
+	ExpiracionSesion   time.Duration // tiempo que se conserva una sesión desconectada (0 = 1 hora)
+	LimiteColaSesion   int           // mensajes encolados por sesión; se descartan los más antiguos (0 = 1000)
+	DirectorioSesiones string        // persiste las sesiones en disco ("" = solo memoria)
+
+	// LimitesPayload fija el tamaño máximo de payload aceptado por cada protocolo.
+	// Los payloads grandes se entregan por referencia a los suscriptores HTTP y CoAP.
+	LimitesPayload LimitesPayload
+
+	// LimitePorCliente y LimitePorTopico limitan la tasa de publicaciones que acepta el
+	// servidor (ver tasas.go). Lo que excede un límite se rechaza con 429 en HTTP, 4.29
+	// en CoAP y, en MQTT, con PUBACK de cuota excedida (MQTT 5 con QoS 1) o descartando
+	// el PUBLISH. Los mensajes de puentes y testamentos no se limitan.
+	LimitePorCliente LimiteTasa
+	LimitePorTopico  LimiteTasa
+
+	// NormalizarCargas decodifica los payloads con esquema y re-publica cada medición
+	// como registro normalizado en normalizado/<serie> (ver normalizacion.go): packs
+	// SenML publicados por HTTP o CoAP con su tipo de contenido y mensajes Sparkplug B
+	// publicados por MQTT en spBv1.0/#.
+	NormalizarCargas bool
+
+	// DistribucionCompartida elige el miembro que recibe cada mensaje de una suscripción
+	// compartida $share/<grupo>/<filtro> ("" = DistribucionRoundRobin, ver compartidas.go)
+	DistribucionCompartida Distribucion
+
+	// IntervaloEstadisticas es cada cuánto se publican las métricas en los tópicos
+	// $SYS/sensorwave/... (0 = cada 10 s, negativo = no se publican; ver metricas.go).
+	// Las métricas se consultan además en /sensorwave/metricas en formato Prometheus.
+	IntervaloEstadisticas time.Duration
+
+	// VentanaDeduplicacion es el plazo durante el que el servidor recuerda los MensajeID
+	// de las publicaciones QoS 2 recibidas por HTTP, WebSocket y CoAP: una repetición
+	// dentro del plazo se confirma sin distribuirse (0 = 5 min). En MQTT la entrega
+	// exactamente-una-vez la resuelve el broker con PUBREC/PUBREL.
+	VentanaDeduplicacion time.Duration
+
+	// Topicos registra los tipos de contenido, esquemas y publicantes esperados en los
+	// tópicos; las publicaciones que no los cumplen se rechazan (ver registro_topicos.go
+	// y CargarTopicos). Se consultan en /sensorwave/topicos.
+	Topicos []DefinicionTopico
+}
+
+// LimitesPayload es el tamaño máximo de payload, en bytes, por protocolo de ingreso (0 = 64 KB)
+type LimitesPayload struct {
+	HTTP int
+	CoAP int
+	MQTT int
+}
+
+// Servidor es una instancia del middleware: broker MQTT embebido, servidor HTTP/SSE
+// y servidor CoAP que comparten el fanout de mensajes entre protocolos.
+// Cada instancia tiene su propio estado, por lo que pueden convivir varias en un proceso.
+type Servidor struct {
+	opts Opciones
+	id   string // ID de instancia para detectar mensajes rebotados del upstream
+
+	puentesMu sync.RWMutex
+	puentes   []*puente // copy-on-write: reenviarUpstream itera una instantánea
+
+	// HTTP
+	mutexHTTP         sync.Mutex
+	clientesPorTopico map[string]map[string]*Cliente
+	clientesPorID     map[string]*Cliente
+	inflightHTTP      *InflightTracker // mensajes QoS1 pendientes de ACK por suscriptor HTTP
+	conexionesWS      map[*conexionWS]struct{}
+	servidorHTTP      *http.Server
+	direccionHTTP     string
+
+	// CoAP
+	mutexCoAP     sync.Mutex
+	observadores  map[string][]Conexion // conexiones CoAP por patrón
+	valorObserve  atomic.Int64          // número de secuencia de observación
+	servidorCoAP  servidorCoAP
+	direccionCoAP string
+	finCoAP       chan struct{} // se cierra cuando termina el Serve de CoAP
+
+	// MQTT
+	brokerMQTT      *mochi.Server
+	direccionMQTT   string
+	direccionMQTTWS string
+
+	retenidos   *almacenRetenidos
+	testamentos *registroTestamentos
+	sesiones    *registroSesiones
+	compartidas *registroCompartidas
+	contenidos  *almacenContenidos
+	limites     LimitesPayload // Opciones.LimitesPayload con los valores por defecto aplicados
+	tasas       *limitadorTasas
+	orden       *colasOrden
+	metricas    *metricas
+	sparkplug   *formatos.DecodificadorSparkplug // nil = sin normalización de cargas
+	// deduplicador recuerda los MensajeID QoS 2 recibidos (ver Opciones.VentanaDeduplicacion)
+	deduplicador *qos.Deduplicador
+	// topicos valida las publicaciones de los clientes (ver Opciones.Topicos)
+	topicos *registroTopicos
+
+	finEstadisticas chan struct{} // se cierra con Cerrar para detener la publicación en $SYS
+
+	mu          sync.Mutex
+	autorizador Autorizador
+	iniciado    bool
+	cerrado     bool
+	serviendo   sync.WaitGroup // goroutines de Serve de HTTP y CoAP
+}
+
+// Crear construye un Servidor con las opciones indicadas. No abre puertos: eso lo hace Iniciar.
+func Crear(opts Opciones) (*Servidor, error) {
+	if opts.PuertoHTTP == "" && opts.PuertoCoAP == "" && opts.PuertoMQTT == "" {
+		return nil, fmt.Errorf("se requiere al menos un puerto (HTTP, CoAP o MQTT)")
+	}
+	if opts.PuertoMQTTWebSocket != "" && opts.PuertoMQTT == "" {
+		return nil, fmt.Errorf("PuertoMQTTWebSocket requiere PuertoMQTT")
+	}
+	if err := validarDistribucion(opts.DistribucionCompartida); err != nil {
+		return nil, err
+	}
+	for _, l := range []LimiteTasa{opts.LimitePorCliente, opts.LimitePorTopico} {
+		if err := l.validar(); err != nil {
+			return nil, err
+		}
+	}
+	s := nuevoServidor(opts)
+	for _, p := range opts.Puentes {
+		if err := s.AgregarPuente(p); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range opts.Topicos {
+		if err := s.RegistrarTopico(d); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.retenidos.cargar(); err != nil {
+		return nil, err
+	}
+	if err := s.sesiones.cargar(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func nuevoServidor(opts Opciones) *Servidor {
+	s := &Servidor{
+		opts:              opts,
+		id:                generarIDInstancia(),
+		autorizador:       opts.Autorizador,
+		clientesPorTopico: make(map[string]map[string]*Cliente),
+		clientesPorID:     make(map[string]*Cliente),
+		inflightHTTP:      NewInflightTracker(),
+		conexionesWS:      make(map[*conexionWS]struct{}),
+		observadores:      make(map[string][]Conexion),
+		retenidos:         nuevoAlmacenRetenidos(opts.ArchivoRetenidos),
+		testamentos:       nuevoRegistroTestamentos(),
+		sesiones:          nuevoRegistroSesiones(opts),
+		compartidas:       nuevoRegistroCompartidas(opts.DistribucionCompartida),
+		contenidos:        nuevoAlmacenContenidos(),
+		limites:           opts.LimitesPayload.conDefectos(),
+		tasas:             nuevoLimitadorTasas(opts.LimitePorCliente, opts.LimitePorTopico),
+		orden:             nuevasColasOrden(),
+		metricas:          nuevasMetricas(),
+		deduplicador:      qos.NuevoDeduplicador(opts.VentanaDeduplicacion),
+		topicos:           nuevoRegistroTopicos(),
+		finEstadisticas:   make(chan struct{}),
+		sparkplug:         nuevoDecodificadorSparkplug(opts.NormalizarCargas),
+	}
+	if opts.Upstream != nil {
+		s.puentes = []*puente{puenteUpstream(opts.Upstream)}
+	}
+	return s
+}
+
+// ID retorna el identificador de la instancia (campo Origen de los mensajes que genera)
+func (s *Servidor) ID() string {
+	return s.id
+}
+
+// Iniciar abre los puertos configurados y retorna cuando todos aceptan conexiones.
+// Si algún protocolo falla, cierra los ya iniciados y retorna el error.
+// Al cancelarse ctx el servidor se cierra (equivalente a llamar Cerrar).
+func (s *Servidor) Iniciar(ctx context.Context) error {
+	s.mu.Lock()
+	if s.cerrado {
+		s.mu.Unlock()
+		return fmt.Errorf("el servidor está cerrado")
+	}
+	if s.iniciado {
+		s.mu.Unlock()
+		return fmt.Errorf("el servidor ya fue iniciado")
+	}
+	s.iniciado = true
+	s.mu.Unlock()
+
+	var err error
+	if s.opts.PuertoMQTT != "" {
+		err = s.iniciarMQTT(s.opts.PuertoMQTT)
+	}
+	if err == nil && s.opts.PuertoHTTP != "" {
+		err = s.iniciarHTTP(s.opts.PuertoHTTP)
+	}
+	if err == nil && s.opts.PuertoCoAP != "" {
+		err = s.iniciarCoAP(s.opts.PuertoCoAP)
+	}
+	if err == nil {
+		err = s.iniciarPuentes()
+	}
+	if err != nil {
+		s.Cerrar()
+		return err
+	}
+	s.iniciarEstadisticas()
+
+	if ctx != nil && ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			s.Cerrar()
+		}()
+	}
+	return nil
+}
+
+// Cerrar detiene el servidor de forma ordenada: termina los streams SSE (entregando
+// los mensajes ya encolados), notifica el fin de la observación a los observadores CoAP,
+// cierra el broker MQTT y espera a que terminen los servidores. Es idempotente.
+func (s *Servidor) Cerrar() error {
+	s.mu.Lock()
+	if s.cerrado {
+		s.mu.Unlock()
+		return nil
+	}
+	s.cerrado = true
+	servidorHTTP, servidorCoAP, brokerMQTT := s.servidorHTTP, s.servidorCoAP, s.brokerMQTT
+	s.mu.Unlock()
+
+	var errs []error
+
+	close(s.finEstadisticas)
+
+	// Los puentes dejan de inyectar mensajes remotos antes de cerrar los protocolos
+	s.detenerPuentes()
+
+	// HTTP: cerrar los canales de los clientes SSE para que sus manejadores retornen.
+	// Shutdown no espera las conexiones WebSocket (secuestradas), se cierran aparte.
+	s.cerrarClientesHTTP()
+	s.cerrarConexionesWS()
+	if servidorHTTP != nil {
+		ctx, cancelar := context.WithTimeout(context.Background(), tiempoCierreHTTP)
+		if err := servidorHTTP.Shutdown(ctx); err != nil {
+			servidorHTTP.Close()
+			errs = append(errs, fmt.Errorf("cerrando HTTP: %w", err))
+		}
+		cancelar()
+	}
+
+	// CoAP: avisar a los observadores que la observación terminó
+	s.cerrarObservadoresCoAP()
+	if servidorCoAP != nil {
+		servidorCoAP.Stop()
+	}
+
+	if brokerMQTT != nil {
+		if err := brokerMQTT.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("cerrando MQTT: %w", err))
+		}
+	}
+
+	s.serviendo.Wait()
+	s.sesiones.detener()
+	loggerPrint("SERVIDOR", "Servidor cerrado - ID instancia: %s", s.id)
+	return errors.Join(errs...)
+}
+
+// estaCerrado indica si se llamó a Cerrar
+func (s *Servidor) estaCerrado() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cerrado
+}
+
+// --- Instancia por defecto ---
+//
+// IniciarHTTP, IniciarCoAP, IniciarMQTT y ConfigurarUpstream operan sobre una
+// instancia compartida del paquete, manteniendo la API anterior a Servidor.
+
+var (
+	servidorDefecto     *Servidor
+	servidorDefectoOnce sync.Once
+)
+
+func porDefecto() *Servidor {
+	servidorDefectoOnce.Do(func() {
+		servidorDefecto = nuevoServidor(Opciones{})
+	})
+	return servidorDefecto
+}
+
+// IniciarHTTP inicia un servidor HTTP en el puerto especificado.
+// La función retorna cuando el servidor está listo para aceptar conexiones.
+func IniciarHTTP(puerto string) {
+	if err := porDefecto().iniciarHTTP(puerto); err != nil {
+		loggerFatal(LOG_HTTP, "Error al iniciar listener: %v", err)
+	}
+}
+
+// IniciarCoAP inicia el servidor CoAP en el puerto especificado y bloquea mientras atienda.
+func IniciarCoAP(puerto string) {
+	s := porDefecto()
+	if err := s.iniciarCoAP(puerto); err != nil {
+		loggerFatal(LOG_COAP, "Error al iniciar el servidor: %v", err)
+	}
+	<-s.finCoAP
+}
+
+// IniciarMQTT arranca el broker MQTT embebido en el puerto indicado.
+func IniciarMQTT(puerto string) {
+	if err := porDefecto().iniciarMQTT(puerto); err != nil {
+		loggerFatal(LOG_MQTT, "%v", err)
+	}
+}
+
+// ConfigurarUpstream establece un cliente remoto opcional para federación.
+// Si cliente es nil, deshabilita el reenvío upstream.
+func ConfigurarUpstream(cliente middleware.Cliente) {
+	porDefecto().ConfigurarUpstream(cliente)
+}
@@ -33,73 +33,70 @@ func (m *upstreamMock) Desuscribir(topico string) error {
 	return nil
 }
 
-func prepararClientesHTTP(cantidad int, patron string) {
-	mutexHTTP.Lock()
-	defer mutexHTTP.Unlock()
+func prepararClientesHTTP(cantidad int, patron string) *Servidor {
+	s := nuevoServidor(Opciones{})
+	s.mutexHTTP.Lock()
+	defer s.mutexHTTP.Unlock()
 
-	clientesPorTopico = map[string]map[string]*Cliente{}
-	clientesPorID = map[string]*Cliente{}
-
-	clientesPorTopico[patron] = make(map[string]*Cliente, cantidad)
+	s.clientesPorTopico[patron] = make(map[string]*Cliente, cantidad)
 	for i := 0; i < cantidad; i++ {
 		id := fmt.Sprintf("bench-%d", i)
 		c := &Cliente{
 			ID:    id,
 			Canal: make(chan Mensaje, 1),
 		}
-		clientesPorTopico[patron][id] = c
-		clientesPorID[id] = c
+		s.clientesPorTopico[patron][id] = c
+		s.clientesPorID[id] = c
 	}
+	return s
 }
 
 func BenchmarkEnviarHTTPQoS0_1Cliente(b *testing.B) {
-	prepararClientesHTTP(1, "sensores/+/temperatura")
+	s := prepararClientesHTTP(1, "sensores/+/temperatura")
 	payload := Mensaje{Topico: "sensores/sala1/temperatura", Payload: []byte("25.1"), QoS: 0}
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		enviarHTTP("BENCH", payload)
+		s.enviarHTTP("BENCH", payload)
 	}
 }
 
 func BenchmarkEnviarHTTPQoS0_100Clientes(b *testing.B) {
-	prepararClientesHTTP(100, "sensores/+/temperatura")
+	s := prepararClientesHTTP(100, "sensores/+/temperatura")
 	payload := Mensaje{Topico: "sensores/sala1/temperatura", Payload: []byte("25.1"), QoS: 0}
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		enviarHTTP("BENCH", payload)
+		s.enviarHTTP("BENCH", payload)
 	}
 }
 
 func BenchmarkReenviarUpstream_SinUpstream(b *testing.B) {
-	ConfigurarUpstream(nil)
+	s := nuevoServidor(Opciones{})
 	m := Mensaje{Topico: "sensores/temperatura", Payload: []byte("25")}
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		reenviarUpstream(m)
+		s.reenviarUpstream(m)
 	}
 }
 
 func BenchmarkReenviarUpstream_OrigenLocal(b *testing.B) {
-	mock := &upstreamMock{}
-	ConfigurarUpstream(mock)
-	m := Mensaje{Topico: "sensores/temperatura", Payload: []byte("25"), Origen: obtenerIDInstancia()}
+	s := nuevoServidor(Opciones{Upstream: &upstreamMock{}})
+	m := Mensaje{Topico: "sensores/temperatura", Payload: []byte("25"), Origen: s.ID()}
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		reenviarUpstream(m)
+		s.reenviarUpstream(m)
 	}
 }
 
 func BenchmarkReenviarUpstream_OrigenRemoto(b *testing.B) {
-	mock := &upstreamMock{}
-	ConfigurarUpstream(mock)
+	s := nuevoServidor(Opciones{Upstream: &upstreamMock{}})
 	m := Mensaje{Topico: "sensores/temperatura", Payload: []byte("25"), Origen: "instancia-remota"}
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		reenviarUpstream(m)
+		s.reenviarUpstream(m)
 	}
 }
@@ -3,53 +3,120 @@ package servidor
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
 	"strings"
-	"sync"
-	"sync/atomic"
 
-	coap "github.com/plgd-dev/go-coap/v3"
+	"github.com/plgd-dev/go-coap/v3/dtls"
 	"github.com/plgd-dev/go-coap/v3/message"
 	"github.com/plgd-dev/go-coap/v3/message/codes"
 	"github.com/plgd-dev/go-coap/v3/mux"
+	coapNet "github.com/plgd-dev/go-coap/v3/net"
+	"github.com/plgd-dev/go-coap/v3/options"
+	coap "github.com/plgd-dev/go-coap/v3/udp"
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/formatos"
 )
 
 const LOG_COAP = "COAP"
 
+// servidorCoAP es el servidor UDP o DTLS de go-coap
+type servidorCoAP interface {
+	Stop()
+}
+
 // datos de las conexiones de los observadores
 type Conexion struct {
-	conexion mux.Conn
-	token    []byte
+	conexion   mux.Conn
+	token      []byte
+	testamento string         // ID de testamento declarado en la observación ("" = sin testamento)
+	sesion     conexionSesion // sesión persistente de la observación (clave vacía = sin sesión)
+	// codificacion de las notificaciones, pedida con la opción Accept al observar
+	codificacion middleware.Codificacion
 }
 
-// Almacena observadores por ruta
-var (
-	valor        atomic.Int64                  // valor de observación
-	observadores = make(map[string][]Conexion) // conexiones CoAP
-	mutexCoAP    sync.Mutex                    // Mutex para proteger el acceso a `clientesPorTopico`
-)
-
-// Iniciar el servidor CoAP
-func IniciarCoAP(puerto string) {
+// iniciarCoAP abre el puerto UDP (DTLS si Opciones.DTLS no es nil) y atiende en segundo plano
+func (s *Servidor) iniciarCoAP(puerto string) error {
 	r := mux.NewRouter()
 	// Manejador para /sensorwave
-	r.Handle("/sensorwave", mux.HandlerFunc(manejadorCoAP))
+	r.Handle("/sensorwave", mux.HandlerFunc(s.manejadorCoAP))
+	r.Handle(rutaContenido, mux.HandlerFunc(s.manejadorContenidoCoAP))
 	r.DefaultHandle(mux.HandlerFunc(func(w mux.ResponseWriter, r *mux.Message) {
 		_ = w.SetResponse(codes.NotFound, message.TextPlain, bytes.NewReader([]byte("Ruta no encontrada")))
 	}))
 
-	// Iniciar el servidor en el puerto especificado
+	// Block1/Block2 (RFC 7959) vienen habilitados en go-coap; el tamaño máximo de mensaje
+	// acota el cuerpo reensamblado de una publicación block-wise
+	maximoMensaje := options.WithMaxMessageSize(uint32(tamanoCuerpoJSON(s.limites.CoAP)))
+
+	var server servidorCoAP
+	var listener interface{ Close() error }
+	var direccion string
+	var servir func() error
+	if s.opts.DTLS != nil {
+		l, err := coapNet.NewDTLSListener("udp", ":"+puerto, s.opts.DTLS)
+		if err != nil {
+			return fmt.Errorf("no se pudo abrir el puerto CoAP/DTLS %s: %w", puerto, err)
+		}
+		srv := dtls.NewServer(options.WithMux(r), maximoMensaje)
+		server, listener, direccion = srv, l, l.Addr().String()
+		servir = func() error { return srv.Serve(l) }
+	} else {
+		l, err := coapNet.NewListenUDP("udp", ":"+puerto)
+		if err != nil {
+			return fmt.Errorf("no se pudo abrir el puerto CoAP %s: %w", puerto, err)
+		}
+		srv := coap.NewServer(options.WithMux(r), maximoMensaje)
+		server, listener, direccion = srv, l, l.LocalAddr().String()
+		servir = func() error { return srv.Serve(l) }
+	}
+
+	s.mu.Lock()
+	if s.cerrado || s.servidorCoAP != nil {
+		s.mu.Unlock()
+		listener.Close()
+		return fmt.Errorf("servidor CoAP cerrado o ya iniciado")
+	}
+	s.servidorCoAP = server
+	s.direccionCoAP = direccion
+	s.finCoAP = make(chan struct{})
+	s.mu.Unlock()
+
 	loggerPrint(LOG_COAP, "Servidor iniciado - Puerto: %s", puerto)
-	err := coap.ListenAndServe("udp", ":"+puerto, r)
-	if err != nil {
-		loggerFatal(LOG_COAP, "Error al iniciar el servidor: %v", err)
+
+	s.serviendo.Add(1)
+	go func() {
+		defer s.serviendo.Done()
+		defer close(s.finCoAP)
+		defer listener.Close()
+		if err := servir(); err != nil {
+			loggerPrint(LOG_COAP, "Error - El servidor terminó: %v", err)
+		}
+	}()
+	return nil
+}
+
+// cerrarObservadoresCoAP envía a cada observador una notificación sin opción Observe,
+// que según RFC 7641 finaliza la observación, y vacía el registro
+func (s *Servidor) cerrarObservadoresCoAP() {
+	s.mutexCoAP.Lock()
+	defer s.mutexCoAP.Unlock()
+	for patron, conexiones := range s.observadores {
+		for _, o := range conexiones {
+			if err := enviarRespuesta(o.conexion, o.token, Mensaje{Interno: true}, -1, o.codificacion); err != nil {
+				loggerPrint(LOG_COAP, "Error - No se pudo notificar cierre a observador - Tópico: %s, Error: %v", patron, err)
+			}
+			if o.sesion.clave != "" {
+				s.sesiones.desconectar(o.sesion, nil)
+			}
+		}
 	}
+	s.observadores = make(map[string][]Conexion)
 }
 
 // handleAll maneja todas las solicitudes CoAP, independientemente de la ruta
-func manejadorCoAP(w mux.ResponseWriter, r *mux.Message) {
+func (s *Servidor) manejadorCoAP(w mux.ResponseWriter, r *mux.Message) {
 	metodo := r.Code()
 	topico, err := obtenerTopicoCoAP(r)
 	if err != nil {
@@ -72,30 +139,71 @@ func manejadorCoAP(w mux.ResponseWriter, r *mux.Message) {
 	// obtengo si tiene observe
 	obs, err := r.Options().Observe()
 
-	if EsTopicoControl(normalizado) {
+	filtro, err := filtroSuscripcion(normalizado)
+	if err != nil {
+		_ = w.SetResponse(codes.BadRequest, message.TextPlain, bytes.NewReader([]byte("Suscripción compartida inválida")))
+		return
+	}
+	if EsTopicoControl(filtro) {
 		_ = w.SetResponse(codes.Forbidden, message.TextPlain, bytes.NewReader([]byte("Tópico de control no permitido por CoAP")))
 		return
 	}
 
+	// Autenticación y ACL (la cancelación de una observación solo requiere autenticación)
+	cred := credencialesCoAP(r)
+	identidad := s.identidadDTLS(w.Conn())
+	var errAuth error
+	var usuario string
+	switch {
+	case metodo == codes.GET && err == nil && obs != 0:
+		_, errAuth = s.autenticar(cred, identidad)
+	case metodo == codes.GET:
+		usuario, errAuth = s.autenticarYAutorizar(cred, identidad, AccionSuscribir, normalizado)
+	case metodo == codes.POST:
+		usuario, errAuth = s.autenticarYAutorizar(cred, identidad, AccionPublicar, normalizado)
+	}
+	if errAuth != nil {
+		loggerPrint(LOG_COAP, "Solicitud rechazada - Usuario: %s, Tópico: %s, Razón: %v", usuario, normalizado, errAuth)
+		responderErrorAuthCoAP(w, errAuth)
+		return
+	}
+
 	// Responder según el método
 	switch {
 	// suscribirse
 	case metodo == codes.GET && err == nil && obs == 0:
-		manejarSuscripcionCoAP(w, r, normalizado)
+		s.manejarSuscripcionCoAP(w, r, normalizado, usuario)
 	// desuscribirse
 	case metodo == codes.GET && err == nil && obs != 0:
-		eliminarSuscripcionCoAP(w, r, normalizado)
+		s.eliminarSuscripcionCoAP(w, r, normalizado)
 	// publicar
 	case metodo == codes.POST:
-		// Obtener la carga útil de la solicitud, si hay alguna
-		var mensaje Mensaje
+		if esTopicoSistema(normalizado) {
+			_ = w.SetResponse(codes.Forbidden, message.TextPlain, bytes.NewReader([]byte("Tópico reservado del sistema")))
+			return
+		}
+		conexion := conexionRemota("coap", w.Conn().RemoteAddr().String())
+		if !s.permitirPublicacion(LOG_COAP, usuario, conexion, normalizado) {
+			_ = w.SetResponse(codes.TooManyRequests, message.TextPlain, bytes.NewReader([]byte("Límite de publicación excedido")))
+			return
+		}
+		// Obtener la carga útil de la solicitud, si hay alguna; el Content-Format indica
+		// la codificación (sin él se detecta por el primer byte)
 		cuerpo, err := r.Message.ReadBody()
 		if err != nil {
 			loggerPrint(LOG_COAP, "Error - No se pudo procesar el cuerpo: %v", err)
 			return
 		}
 
-		err = json.Unmarshal(cuerpo, &mensaje)
+		var mensaje Mensaje
+		var registros []formatos.Registro
+		if s.normalizaCargas() && esFormatoSenMLCoAP(r.ContentFormat()) {
+			// Pack SenML crudo de un dispositivo (ver normalizacion.go)
+			registros, err = formatos.DecodificarSenML(cuerpo)
+			mensaje = Mensaje{Original: true, Topico: normalizado, Payload: cuerpo}
+		} else {
+			mensaje, err = decodificarMensaje(cuerpo, codificacionDeFormatoCoAP(r.ContentFormat()))
+		}
 		if err != nil {
 			loggerPrint(LOG_COAP, "Error - No se pudo convertir el cuerpo: %v", err)
 			_ = w.SetResponse(codes.BadRequest, message.TextPlain, bytes.NewReader([]byte("Cuerpo invalido")))
@@ -114,7 +222,11 @@ func manejadorCoAP(w mux.ResponseWriter, r *mux.Message) {
 			_ = w.SetResponse(codes.BadRequest, message.TextPlain, bytes.NewReader([]byte("QoS invalido")))
 			return
 		}
-		if err := validarTamanoPayload(mensaje); err != nil {
+		if err := normalizarTopicoRespuesta(&mensaje); err != nil {
+			_ = w.SetResponse(codes.BadRequest, message.TextPlain, bytes.NewReader([]byte("Topico de respuesta invalido")))
+			return
+		}
+		if err := validarTamanoPayload(mensaje, s.limites.CoAP); err != nil {
 			_ = w.SetResponse(codes.RequestEntityTooLarge, message.TextPlain, bytes.NewReader([]byte("Payload demasiado grande")))
 			return
 		}
@@ -123,8 +235,17 @@ func manejadorCoAP(w mux.ResponseWriter, r *mux.Message) {
 			return
 		}
 		mensaje.Topico = mensajeTopico
+		if err := s.validarPublicacion(LOG_COAP, usuario, mensaje); err != nil {
+			responderErrorValidacionCoAP(w, err)
+			return
+		}
+		if s.duplicado(LOG_COAP, usuario, conexion, mensaje) {
+			_ = w.SetResponse(codes.Created, message.TextPlain, nil)
+			return
+		}
 		loggerPrint(LOG_COAP, "Mensaje recibido - Tópico: %s, QoS: %d, MensajeID: %s", mensaje.Topico, mensaje.QoS, mensaje.MensajeID)
-		manejarPublicacionCoAP(w, r, normalizado, mensaje)
+		s.manejarPublicacionCoAP(w, r, normalizado, mensaje)
+		s.publicarNormalizados(LOG_COAP, usuario, conexion, registros)
 	default:
 		loggerPrint(LOG_COAP, "Error - Método no soportado: %v", metodo)
 		err := w.SetResponse(codes.MethodNotAllowed, message.TextPlain, bytes.NewReader([]byte("Método no soportado")))
@@ -135,24 +256,160 @@ func manejadorCoAP(w mux.ResponseWriter, r *mux.Message) {
 }
 
 // manejarSuscripcionCoAP maneja las solicitudes GET con observe
-func manejarSuscripcionCoAP(w mux.ResponseWriter, r *mux.Message, topico string) {
+func (s *Servidor) manejarSuscripcionCoAP(w mux.ResponseWriter, r *mux.Message, topico string, usuario string) {
+	idTestamento, testamento, err := s.leerTestamento(func(nombre string) string {
+		valor, _ := obtenerQueryCoAP(r, nombre)
+		return valor
+	}, usuario)
+	if errors.Is(err, errNoAutorizado) {
+		responderErrorAuthCoAP(w, err)
+		return
+	}
+	if err != nil {
+		_ = w.SetResponse(codes.BadRequest, message.TextPlain, bytes.NewReader([]byte("Testamento invalido")))
+		return
+	}
 
-	// agrego observadores
-	mutexCoAP.Lock()
-	datosConexion := Conexion{w.Conn(), r.Token()}
-	observadores[topico] = append(observadores[topico], datosConexion)
-	loggerPrint(LOG_COAP, "Observador agregado - Tópico: %s, Total observadores: %d", topico, len(observadores[topico]))
-	mutexCoAP.Unlock()
+	idSesion, _ := obtenerQueryCoAP(r, paramSesion)
+	if idSesion != "" && esCompartida(topico) {
+		_ = w.SetResponse(codes.BadRequest, message.TextPlain, bytes.NewReader([]byte("Las suscripciones compartidas no admiten sesión persistente")))
+		return
+	}
+
+	// agrego observadores. La respuesta de registro y la cola de la sesión se envían bajo
+	// el mismo mutex que el fanout, antes que cualquier notificación nueva.
+	s.mutexCoAP.Lock()
+	if s.renovarObservadorCoAP(w, r, topico) {
+		s.mutexCoAP.Unlock()
+		return
+	}
+	datosConexion := Conexion{conexion: w.Conn(), token: r.Token(), testamento: idTestamento, codificacion: codificacionObservadorCoAP(r)}
+	var cola []Mensaje
+	var desplazados []Conexion
+	if idSesion != "" {
+		datosConexion.sesion, cola, err = s.sesiones.conectar(protocoloCoAP, idSesion, topico, usuario, nil)
+		if err != nil {
+			s.mutexCoAP.Unlock()
+			loggerPrint(LOG_COAP, "Suscripción rechazada - Usuario: %s, Sesión: %s, Razón: %v", usuario, idSesion, err)
+			responderErrorAuthCoAP(w, err)
+			return
+		}
+		desplazados = s.quitarObservadoresSesion(topico, datosConexion.sesion.clave)
+	}
+	s.observadores[topico] = append(s.observadores[topico], datosConexion)
+	loggerPrint(LOG_COAP, "Observador agregado - Tópico: %s, Total observadores: %d", topico, len(s.observadores[topico]))
 
 	// enviar respuesta
-	err := enviarRespuesta(w.Conn(), r.Token(), Mensaje{Interno: true}, valor.Add(1))
+	err = datosConexion.notificar(Mensaje{Interno: true}, s.valorObserve.Add(1), message.NonConfirmable)
 	if err != nil {
 		loggerPrint(LOG_COAP, "Error - No se pudo transmitir respuesta: %v", err)
 	}
+	for _, m := range cola {
+		m = s.porReferencia(m, umbralReferenciaCoAP)
+		if err := datosConexion.notificar(m, s.valorObserve.Add(1), tipoCoAPPorQoS(m.QoS)); err != nil {
+			loggerPrint(LOG_SESIONES, "Error - No se pudo entregar mensaje encolado - Sesión: %s, Tópico: %s, Error: %v", idSesion, m.Topico, err)
+		}
+	}
+	s.mutexCoAP.Unlock()
+
+	// La observación anterior de la sesión fue reemplazada: su testamento pasa a la nueva
+	for _, o := range desplazados {
+		if o.testamento != "" {
+			s.desvincularTestamento(o.testamento, true)
+		}
+	}
+	if idTestamento != "" {
+		s.vincularTestamento(idTestamento, testamento)
+	}
+	if idTestamento != "" || idSesion != "" {
+		conexion := w.Conn()
+		conexion.AddOnClose(func() { s.conexionCoAPCerrada(conexion) })
+	}
+	// Una sesión reanudada ya recibió los retenidos al observar por primera vez
+	if !datosConexion.sesion.reanudada {
+		s.enviarRetenidosCoAP(datosConexion, topico)
+	}
+}
+
+// renovarObservadorCoAP atiende el re-registro de una observación vigente (mismo
+// cliente y token, RFC 7641 §3.3.1), con el que el cliente comprueba que el servidor la
+// conserva: responde 2.03 Valid sin repetir retenidos ni la cola de la sesión. Retorna
+// false si la observación no existe. Requiere s.mutexCoAP tomado.
+func (s *Servidor) renovarObservadorCoAP(w mux.ResponseWriter, r *mux.Message, topico string) bool {
+	direccion := w.Conn().RemoteAddr().String()
+	for i, o := range s.observadores[topico] {
+		if !bytes.Equal(o.token, r.Token()) || o.conexion.RemoteAddr().String() != direccion {
+			continue
+		}
+		// La sesión UDP pudo renovarse desde el registro original
+		s.observadores[topico][i].conexion = w.Conn()
+		if err := w.SetResponse(codes.Valid, message.TextPlain, nil); err != nil {
+			loggerPrint(LOG_COAP, "Error - No se pudo transmitir respuesta: %v", err)
+			return true
+		}
+		w.Message().SetObserve(uint32(s.valorObserve.Add(1)))
+		return true
+	}
+	return false
+}
+
+// quitarObservadoresSesion quita las observaciones previas de una sesión que reconecta
+// y las retorna. Requiere s.mutexCoAP tomado.
+func (s *Servidor) quitarObservadoresSesion(topico, clave string) []Conexion {
+	var quitados []Conexion
+	conservados := s.observadores[topico][:0]
+	for _, o := range s.observadores[topico] {
+		if o.sesion.clave == clave {
+			quitados = append(quitados, o)
+			continue
+		}
+		conservados = append(conservados, o)
+	}
+	s.observadores[topico] = conservados
+	return quitados
+}
+
+// conexionCoAPCerrada se invoca cuando el servidor cierra la sesión de un cliente
+// (inactividad o fin de DTLS). Los observadores sin sesión persistente siguen
+// registrados, porque en UDP plano las notificaciones se envían por el socket
+// compartido, pero sus testamentos se consideran caídos: un cliente con testamento
+// debe mantener viva la sesión. Los observadores con sesión se quitan y su sesión
+// pasa a encolar hasta que el cliente vuelva a observar.
+func (s *Servidor) conexionCoAPCerrada(conexion mux.Conn) {
+	var caidos []string
+	s.mutexCoAP.Lock()
+	for patron, conexiones := range s.observadores {
+		conservados := conexiones[:0]
+		for _, o := range conexiones {
+			if o.conexion != conexion {
+				conservados = append(conservados, o)
+				continue
+			}
+			if o.testamento != "" {
+				caidos = append(caidos, o.testamento)
+				o.testamento = ""
+			}
+			if o.sesion.clave != "" {
+				s.sesiones.desconectar(o.sesion, nil)
+				continue
+			}
+			conservados = append(conservados, o)
+		}
+		if len(conservados) == 0 {
+			delete(s.observadores, patron)
+		} else {
+			s.observadores[patron] = conservados
+		}
+	}
+	s.mutexCoAP.Unlock()
+
+	for _, id := range caidos {
+		s.desvincularTestamento(id, false)
+	}
 }
 
 // manejarPublicacionCoAP envía una publicación a los observadores de una ruta
-func manejarPublicacionCoAP(w mux.ResponseWriter, r *mux.Message, topico string, payload Mensaje) {
+func (s *Servidor) manejarPublicacionCoAP(w mux.ResponseWriter, r *mux.Message, topico string, payload Mensaje) {
 
 	err := w.SetResponse(codes.Created, message.TextPlain, nil)
 	if err != nil {
@@ -162,71 +419,93 @@ func manejarPublicacionCoAP(w mux.ResponseWriter, r *mux.Message, topico string,
 	// Si el mensaje fue originado por esta instancia y regresó del upstream, no distribuir localmente.
 	// Detectar rebote ANTES de estampar el origen local: un mensaje que regresa
 	// del upstream ya viene con Origen == idLocal.
-	if esMensajeRebotado(payload) {
+	if s.esMensajeRebotado(payload) {
 		loggerPrint(LOG_COAP, "Mensaje ignorado - Regresó del upstream, ya fue distribuido localmente - Tópico: %s", payload.Topico)
 		return
 	}
-	asignarOrigenSiVacio(&payload)
+	s.registrarSalto(&payload)
 
 	// enviar publicaciones a los protocolos
 	if payload.Original {
 		payload.Original = false
-		go enviarCoAP(LOG_COAP, payload)
-		go enviarHTTP(LOG_COAP, payload)
-		go enviarMQTT(LOG_COAP, payload)
-		go reenviarUpstream(payload)
+		s.retener(payload)
+		s.distribuir(LOG_COAP, payload, true)
 	}
 }
 
-func eliminarSuscripcionCoAP(w mux.ResponseWriter, r *mux.Message, ruta string) {
-	err := enviarRespuesta(w.Conn(), r.Token(), Mensaje{Interno: true}, -1)
+func (s *Servidor) eliminarSuscripcionCoAP(w mux.ResponseWriter, r *mux.Message, ruta string) {
+	err := enviarRespuesta(w.Conn(), r.Token(), Mensaje{Interno: true}, -1, codificacionObservadorCoAP(r))
 	if err != nil {
 		loggerPrint(LOG_COAP, "Error - No se pudo enviar respuesta: %v", err)
 	}
-	// quito el observador
-	mutexCoAP.Lock()
-	for i, o := range observadores[ruta] {
+	// quito el observador; con conservar_sesion=1 la sesión pasa a encolar en vez de terminar
+	conservarSesion, _ := obtenerQueryCoAP(r, paramConservarSesion)
+	s.mutexCoAP.Lock()
+	idTestamento := ""
+	for i, o := range s.observadores[ruta] {
 		if bytes.Equal(o.token, r.Token()) {
-			observadores[ruta] = append(observadores[ruta][:i], observadores[ruta][i+1:]...)
+			idTestamento = o.testamento
+			s.observadores[ruta] = append(s.observadores[ruta][:i], s.observadores[ruta][i+1:]...)
+			if o.sesion.clave != "" && conservarSesion == "1" {
+				s.sesiones.desconectar(o.sesion, nil)
+			} else if o.sesion.clave != "" {
+				s.sesiones.terminar(o.sesion)
+			}
 			break
 		}
 	}
 	// Si no hay más observadores en la ruta, eliminar la ruta
-	if len(observadores[ruta]) == 0 {
-		delete(observadores, ruta)
+	if len(s.observadores[ruta]) == 0 {
+		delete(s.observadores, ruta)
+	}
+	s.mutexCoAP.Unlock()
+
+	if idTestamento != "" {
+		s.desvincularTestamento(idTestamento, true)
 	}
-	mutexCoAP.Unlock()
 }
 
 func tipoCoAPPorQoS(qos int) message.Type {
-	if qos == 1 {
+	if qos >= 1 {
 		return message.Confirmable
 	}
 	return message.NonConfirmable
 }
 
-func enviarRespuesta(cc mux.Conn, token []byte, mensaje Mensaje, obs int64) error {
-	return enviarRespuestaConTipo(cc, token, mensaje, obs, message.NonConfirmable)
+// notificar envía un mensaje al observador en la codificación que pidió
+func (o Conexion) notificar(mensaje Mensaje, obs int64, tipo message.Type) error {
+	return enviarRespuestaConTipo(context.Background(), o.conexion, o.token, mensaje, obs, tipo, o.codificacion)
 }
 
-func enviarRespuestaConTipo(cc mux.Conn, token []byte, mensaje Mensaje, obs int64, tipo message.Type) error {
+// notificarConfirmable envía una notificación Confirmable y espera el ACK del
+// observador hasta que ctx venza
+func (o Conexion) notificarConfirmable(ctx context.Context, mensaje Mensaje, obs int64) error {
+	return enviarRespuestaConTipo(ctx, o.conexion, o.token, mensaje, obs, message.Confirmable, o.codificacion)
+}
+
+func enviarRespuesta(cc mux.Conn, token []byte, mensaje Mensaje, obs int64, codificacion middleware.Codificacion) error {
+	return enviarRespuestaConTipo(context.Background(), cc, token, mensaje, obs, message.NonConfirmable, codificacion)
+}
+
+func enviarRespuestaConTipo(ctx context.Context, cc mux.Conn, token []byte, mensaje Mensaje, obs int64, tipo message.Type, codificacion middleware.Codificacion) error {
 	if cc == nil {
 		return fmt.Errorf("conexión CoAP nula")
 	}
 
 	// En CoAP/UDP no usamos el contexto de la conexión porque UDP es stateless
-	// y el contexto expira rápidamente. Usamos context.Background() para el mensaje.
-	m := cc.AcquireMessage(context.Background())
+	// y el contexto expira rápidamente. El contexto del mensaje solo acota la
+	// espera del ACK de una notificación Confirmable.
+	m := cc.AcquireMessage(ctx)
 	defer cc.ReleaseMessage(m)
 	m.SetCode(codes.Content)
 	m.SetType(tipo)
 	m.SetToken(token)
-	mensajeBytes, err := json.Marshal(mensaje)
+	mensajeBytes, err := codificarMensaje(mensaje, codificacion)
 	if err != nil {
 		return fmt.Errorf("error al serializar mensaje: %v", err)
 	}
 	m.SetBody(bytes.NewReader(mensajeBytes))
-	m.SetContentFormat(message.TextPlain)
+	m.SetContentFormat(formatoCoAP(codificacion))
 	if obs >= 0 {
 		m.SetObserve(uint32(obs))
 	}
@@ -240,6 +519,29 @@ func enviarRespuestaConTipo(cc mux.Conn, token []byte, mensaje Mensaje, obs int6
 }
 
 func obtenerTopicoCoAP(r *mux.Message) (string, error) {
+	return obtenerQueryCoAP(r, "topico")
+}
+
+// credencialesCoAP extrae las credenciales de las opciones Uri-Query usuario, clave y token
+func credencialesCoAP(r *mux.Message) Credenciales {
+	var cred Credenciales
+	cred.Usuario, _ = obtenerQueryCoAP(r, "usuario")
+	cred.Clave, _ = obtenerQueryCoAP(r, "clave")
+	cred.Token, _ = obtenerQueryCoAP(r, "token")
+	return cred
+}
+
+// responderErrorAuthCoAP traduce un error de autenticación/autorización a 4.01/4.03
+func responderErrorAuthCoAP(w mux.ResponseWriter, err error) {
+	if errors.Is(err, errNoAutorizado) {
+		_ = w.SetResponse(codes.Forbidden, message.TextPlain, bytes.NewReader([]byte("No autorizado para el tópico")))
+		return
+	}
+	_ = w.SetResponse(codes.Unauthorized, message.TextPlain, bytes.NewReader([]byte("Credenciales inválidas")))
+}
+
+// obtenerQueryCoAP retorna el valor de un parámetro de las opciones Uri-Query ("" si no está)
+func obtenerQueryCoAP(r *mux.Message, nombre string) (string, error) {
 	queries, err := r.Options().Queries()
 	if err != nil {
 		return "", err
@@ -249,7 +551,7 @@ func obtenerTopicoCoAP(r *mux.Message) (string, error) {
 		if len(partes) == 0 {
 			continue
 		}
-		if partes[0] != "topico" {
+		if partes[0] != nombre {
 			continue
 		}
 		if len(partes) == 2 {
@@ -12,7 +12,8 @@ func init() {
 
 // TestEsMensajeRebotado verifica la detección de mensajes que regresaron al origen
 func TestEsMensajeRebotado(t *testing.T) {
-	idLocal := obtenerIDInstancia()
+	s := nuevoServidor(Opciones{})
+	idLocal := s.ID()
 
 	tests := []struct {
 		name     string
@@ -38,7 +39,7 @@ func TestEsMensajeRebotado(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := esMensajeRebotado(tt.mensaje)
+			got := s.esMensajeRebotado(tt.mensaje)
 			if got != tt.expected {
 				t.Errorf("esMensajeRebotado() = %v, want %v", got, tt.expected)
 			}
@@ -50,17 +51,16 @@ func TestEsMensajeRebotado(t *testing.T) {
 // SÍ se reenvía upstream (reenviarUpstream solo bloquea mensajes de otra instancia)
 func TestReenviarUpstream_SiReenviaLocal(t *testing.T) {
 	mock := &upstreamMock{}
-	ConfigurarUpstream(mock)
-	defer ConfigurarUpstream(nil)
+	s := nuevoServidor(Opciones{Upstream: mock})
 
 	m := Mensaje{
 		Topico:   "sensores/temperatura",
 		Payload:  []byte("25"),
-		Origen:   obtenerIDInstancia(),
+		Origen:   s.ID(),
 		Original: true,
 	}
 
-	reenviarUpstream(m)
+	s.reenviarUpstream(m)
 
 	if mock.publicaciones.Load() != 1 {
 		t.Errorf("reenviarUpstream no reenvió mensaje local; publicaciones = %d, want 1", mock.publicaciones.Load())
@@ -71,8 +71,7 @@ func TestReenviarUpstream_SiReenviaLocal(t *testing.T) {
 // NO se reenvía upstream (protección contra bucles de reenvío)
 func TestReenviarUpstream_NoReenviaRemoto(t *testing.T) {
 	mock := &upstreamMock{}
-	ConfigurarUpstream(mock)
-	defer ConfigurarUpstream(nil)
+	s := nuevoServidor(Opciones{Upstream: mock})
 
 	m := Mensaje{
 		Topico:   "sensores/temperatura",
@@ -81,7 +80,7 @@ func TestReenviarUpstream_NoReenviaRemoto(t *testing.T) {
 		Original: true,
 	}
 
-	reenviarUpstream(m)
+	s.reenviarUpstream(m)
 
 	if mock.publicaciones.Load() != 0 {
 		t.Errorf("reenviarUpstream reenvió mensaje remoto; publicaciones = %d, want 0", mock.publicaciones.Load())
@@ -95,7 +94,8 @@ func TestReenviarUpstream_NoReenviaRemoto(t *testing.T) {
 // 4. esMensajeRebotado detecta que regresó al origen
 // 5. Los manejadores de entrada lo descartan para evitar doble entrega
 func TestTopologiaSimetrica_NoDobleEntrega(t *testing.T) {
-	idLocal := obtenerIDInstancia()
+	s := nuevoServidor(Opciones{})
+	idLocal := s.ID()
 
 	// Mensaje que "regresó" del upstream (como si la otra instancia lo reenvió)
 	mensajeDeVuelta := Mensaje{
@@ -106,7 +106,7 @@ func TestTopologiaSimetrica_NoDobleEntrega(t *testing.T) {
 	}
 
 	// Paso 4: esMensajeRebotado debe detectar que regresó al origen
-	if !esMensajeRebotado(mensajeDeVuelta) {
+	if !s.esMensajeRebotado(mensajeDeVuelta) {
 		t.Fatal("esMensajeRebotado debería devolver true para mensaje que regresó al origen")
 	}
 
@@ -1,13 +1,20 @@
 package servidor
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/formatos"
 	"github.com/sensorwave-dev/sensorwave/middleware/internal/qos"
 )
 
@@ -16,6 +23,113 @@ type Cliente struct {
 	Canal   chan Mensaje
 	cerrado bool
 	mu      sync.Mutex
+
+	// usuario es la identidad que creó la suscripción: solo ella puede cancelarla o
+	// confirmar sus mensajes
+	usuario string
+
+	// Con sesión persistente: conservarSesion indica que el cierre del stream no termina
+	// la sesión, y sinConfirmar guarda los QoS 1 entregados que esperan ACK
+	sesion          conexionSesion
+	conservarSesion bool
+	sinConfirmar    []Mensaje
+}
+
+// enviar encola un mensaje sin bloquear. Retorna false si el canal está lleno o cerrado.
+func (c *Cliente) enviar(msg Mensaje) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cerrado {
+		return false
+	}
+	select {
+	case c.Canal <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// cerrar cierra el canal del cliente; el stream SSE termina tras entregar lo encolado
+func (c *Cliente) cerrar() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.cerrado {
+		close(c.Canal)
+		c.cerrado = true
+	}
+}
+
+// estaCerrado indica si el canal ya fue cerrado por una desuscripción o por el cierre del servidor
+func (c *Cliente) estaCerrado() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cerrado
+}
+
+// cerrarConservandoSesion cierra el stream sin terminar su sesión persistente
+func (c *Cliente) cerrarConservandoSesion() {
+	c.mu.Lock()
+	c.conservarSesion = true
+	c.mu.Unlock()
+	c.cerrar()
+}
+
+func (c *Cliente) conservaSesion() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conservarSesion
+}
+
+// registrarSinConfirmar guarda un QoS 1 entregado a un cliente con sesión
+func (c *Cliente) registrarSinConfirmar(msg Mensaje) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sesion.clave != "" {
+		c.sinConfirmar = append(c.sinConfirmar, msg)
+	}
+}
+
+// confirmar descarta un QoS 1 confirmado por el cliente
+func (c *Cliente) confirmar(mensajeID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, msg := range c.sinConfirmar {
+		if msg.MensajeID == mensajeID {
+			c.sinConfirmar = append(c.sinConfirmar[:i], c.sinConfirmar[i+1:]...)
+			return
+		}
+	}
+}
+
+// noEntregados retira lo que el stream no llegó a escribir y le antepone los QoS 1
+// sin confirmar que siguen en redelivery, sin repetir los que estaban en ambos
+func (c *Cliente) noEntregados(enCurso func(mensajeID string) bool) []Mensaje {
+	c.mu.Lock()
+	var resultado []Mensaje
+	incluidos := make(map[string]bool)
+	for _, msg := range c.sinConfirmar {
+		if enCurso(msg.MensajeID) {
+			resultado = append(resultado, msg)
+			incluidos[msg.MensajeID] = true
+		}
+	}
+	c.mu.Unlock()
+
+	for {
+		select {
+		case msg, ok := <-c.Canal:
+			if !ok {
+				return resultado
+			}
+			if msg.QoS >= 1 && incluidos[msg.MensajeID] {
+				continue
+			}
+			resultado = append(resultado, msg)
+		default:
+			return resultado
+		}
+	}
 }
 
 // InflightTracker rastrea mensajes QoS1 pendientes de ACK por suscriptor HTTP
@@ -93,70 +207,103 @@ func (t *InflightTracker) EliminarSuscriptor(suscriptorID string) int {
 	return n
 }
 
-var (
-	clientesPorTopico = make(map[string]map[string]*Cliente)
-	clientesPorID     = make(map[string]*Cliente)
-	mutexHTTP         sync.Mutex
-
-	// inflightHTTP rastrea los mensajes QoS1 pendientes de ACK por suscriptor
-	// HTTP, con backoff RFC 7252 (constantes compartidas en middleware/internal/qos).
-	inflightHTTP = NewInflightTracker()
-)
+// Pendientes retorna la cantidad de pares (MensajeID, SuscriptorID) pendientes de ACK.
+func (t *InflightTracker) Pendientes() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, subs := range t.pend {
+		n += len(subs)
+	}
+	return n
+}
 
 const LOG_HTTP string = "HTTP"
 
-// IniciarHTTP inicia un servidor HTTP en el puerto especificado.
-// La función retorna cuando el servidor está listo para aceptar conexiones.
-func IniciarHTTP(puerto string) {
-	listo := make(chan struct{})
+// iniciarHTTP abre el listener HTTP y atiende en segundo plano.
+// Retorna cuando el servidor está listo para aceptar conexiones.
+func (s *Servidor) iniciarHTTP(puerto string) error {
+	// Crear un ServeMux individual para esta instancia (evita conflictos de registro)
+	mux := http.NewServeMux()
 
-	go func() {
-		// Crear un ServeMux individual para esta instancia (evita conflictos de registro)
-		mux := http.NewServeMux()
+	// Endpoint para manejar conexiones
+	mux.HandleFunc("/sensorwave", s.manejadorHTTP)
+	mux.HandleFunc("/sensorwave/ack", s.manejarAckHTTP)
+	mux.HandleFunc(rutaWebSocket, s.manejarWebSocket)
+	mux.HandleFunc(rutaContenido, s.manejarContenidoHTTP)
+	mux.HandleFunc(rutaMetricas, s.manejarMetricasHTTP)
+	mux.HandleFunc(rutaTopicos, s.manejarTopicosHTTP)
 
-		// Endpoint para manejar conexiones
-		mux.HandleFunc("/sensorwave", manejadorHTTP)
-		mux.HandleFunc("/sensorwave/ack", manejarAckHTTP)
+	// Crear listener primero para saber cuándo está listo
+	listener, err := net.Listen("tcp", ":"+puerto)
+	if err != nil {
+		return fmt.Errorf("no se pudo abrir el puerto HTTP %s: %w", puerto, err)
+	}
+	if s.opts.TLS != nil {
+		listener = tls.NewListener(listener, s.opts.TLS)
+	}
 
-		// Crear listener primero para saber cuándo está listo
-		listener, err := net.Listen("tcp", ":"+puerto)
-		if err != nil {
-			loggerFatal(LOG_HTTP, "Error al iniciar listener: %v", err)
-		}
+	// Configurar servidor HTTP con timeouts apropiados para SSE
+	// ReadTimeout: 0 (sin límite) para permitir conexiones largas
+	// WriteTimeout: 0 (sin límite) para permitir streaming SSE indefinido
+	server := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  0, // Sin timeout de lectura
+		WriteTimeout: 0, // Sin timeout de escritura (crítico para SSE)
+		IdleTimeout:  0, // Sin timeout de idle
+	}
 
-		// Configurar servidor HTTP con timeouts apropiados para SSE
-		// ReadTimeout: 0 (sin límite) para permitir conexiones largas
-		// WriteTimeout: 0 (sin límite) para permitir streaming SSE indefinido
-		server := &http.Server{
-			Handler:      mux,
-			ReadTimeout:  0, // Sin timeout de lectura
-			WriteTimeout: 0, // Sin timeout de escritura (crítico para SSE)
-			IdleTimeout:  0, // Sin timeout de idle
-		}
+	s.mu.Lock()
+	if s.cerrado || s.servidorHTTP != nil {
+		s.mu.Unlock()
+		listener.Close()
+		return fmt.Errorf("servidor HTTP cerrado o ya iniciado")
+	}
+	s.servidorHTTP = server
+	s.direccionHTTP = listener.Addr().String()
+	s.mu.Unlock()
 
-		loggerPrint(LOG_HTTP, "Servidor iniciado - Puerto: %s", puerto)
-		close(listo) // Señalizar que está listo para aceptar conexiones
+	loggerPrint(LOG_HTTP, "Servidor iniciado - Puerto: %s", puerto)
 
-		server.Serve(listener)
+	s.serviendo.Add(1)
+	go func() {
+		defer s.serviendo.Done()
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			loggerPrint(LOG_HTTP, "Error - El servidor terminó: %v", err)
+		}
 	}()
+	return nil
+}
+
+// cerrarClientesHTTP cierra los streams SSE activos y descarta sus inflight
+func (s *Servidor) cerrarClientesHTTP() {
+	s.mutexHTTP.Lock()
+	clientes := make([]*Cliente, 0, len(s.clientesPorID))
+	for _, c := range s.clientesPorID {
+		clientes = append(clientes, c)
+	}
+	s.mutexHTTP.Unlock()
 
-	<-listo // Esperar a que la goroutine avise que está listo
+	for _, c := range clientes {
+		c.cerrar()
+		s.inflightHTTP.EliminarSuscriptor(c.ID)
+	}
 }
 
 // manejador es el punto de entrada para todas las solicitudes HTTP
-func manejadorHTTP(w http.ResponseWriter, r *http.Request) {
+func (s *Servidor) manejadorHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		manejarSuscripcionHTTP(w, r)
+		s.manejarSuscripcionHTTP(w, r)
 	}
 	if r.Method == http.MethodPost {
-		manejarPublicacionHTTP(w, r)
+		s.manejarPublicacionHTTP(w, r)
 	}
 	if r.Method == http.MethodDelete {
-		manejarDesuscripcionHTTP(w, r)
+		s.manejarDesuscripcionHTTP(w, r)
 	}
 }
 
-func manejarSuscripcionHTTP(w http.ResponseWriter, r *http.Request) {
+func (s *Servidor) manejarSuscripcionHTTP(w http.ResponseWriter, r *http.Request) {
 	topico := r.URL.Query().Get("topico")
 	if topico == "" {
 		http.Error(w, "Falta el parámetro 'topico'", http.StatusBadRequest)
@@ -168,10 +315,74 @@ func manejarSuscripcionHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Topico invalido", http.StatusBadRequest)
 		return
 	}
-	if EsTopicoControl(normalizado) {
+	filtro, err := filtroSuscripcion(normalizado)
+	if err != nil {
+		http.Error(w, "Suscripción compartida inválida", http.StatusBadRequest)
+		return
+	}
+	if EsTopicoControl(filtro) {
 		http.Error(w, "Tópico de control no permitido por HTTP", http.StatusForbidden)
 		return
 	}
+	usuario, err := s.autenticarYAutorizar(credencialesHTTP(r), identidadTLS(r.TLS), AccionSuscribir, normalizado)
+	if err != nil {
+		loggerPrint(LOG_HTTP, "Suscripción rechazada - Usuario: %s, Tópico: %s, Razón: %v", usuario, normalizado, err)
+		responderErrorAuthHTTP(w, err)
+		return
+	}
+	idTestamento, testamento, err := s.leerTestamento(r.URL.Query().Get, usuario)
+	if errors.Is(err, errNoAutorizado) {
+		loggerPrint(LOG_HTTP, "Suscripción rechazada - Usuario: %s, Testamento: %s, Razón: %v", usuario, testamento.Topico, err)
+		responderErrorAuthHTTP(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Testamento invalido", http.StatusBadRequest)
+		return
+	}
+
+	idSesion := r.URL.Query().Get(paramSesion)
+	// Los mensajes de un grupo los recibe otro miembro mientras este está desconectado
+	if idSesion != "" && esCompartida(normalizado) {
+		http.Error(w, "Las suscripciones compartidas no admiten sesión persistente", http.StatusBadRequest)
+		return
+	}
+
+	clienteID := fmt.Sprintf("%d", time.Now().UnixNano())
+	cliente := &Cliente{
+		ID:      clienteID,
+		Canal:   make(chan Mensaje, 10000),
+		cerrado: false,
+		usuario: usuario,
+	}
+
+	// Con sesión, la cola se encola en el canal antes de registrar al cliente y bajo el
+	// mismo mutex que el fanout: los mensajes nuevos llegan después de los pendientes
+	s.mutexHTTP.Lock()
+	if idSesion != "" {
+		var cola []Mensaje
+		cliente.sesion, cola, err = s.sesiones.conectar(protocoloHTTP, idSesion, normalizado, usuario, cliente.cerrarConservandoSesion)
+		if err != nil {
+			s.mutexHTTP.Unlock()
+			loggerPrint(LOG_HTTP, "Suscripción rechazada - Usuario: %s, Sesión: %s, Razón: %v", usuario, idSesion, err)
+			responderErrorAuthHTTP(w, err)
+			return
+		}
+		for _, m := range cola {
+			m = s.porReferencia(m, umbralReferenciaHTTP)
+			if m.QoS >= 1 {
+				s.enviarHTTPQoS1(LOG_SESIONES, cliente, m)
+			} else if !cliente.enviar(m) {
+				loggerPrint(LOG_SESIONES, "Error - No se pudo entregar mensaje encolado - Sesión: %s, Tópico: %s", idSesion, m.Topico)
+			}
+		}
+	}
+	if s.clientesPorTopico[normalizado] == nil {
+		s.clientesPorTopico[normalizado] = make(map[string]*Cliente)
+	}
+	s.clientesPorTopico[normalizado][clienteID] = cliente
+	s.clientesPorID[clienteID] = cliente
+	s.mutexHTTP.Unlock()
 
 	// Configurar cabeceras SSE antes de escribir el status
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -182,40 +393,42 @@ func manejarSuscripcionHTTP(w http.ResponseWriter, r *http.Request) {
 	// Escribir status 200 explícitamente para iniciar la respuesta
 	w.WriteHeader(http.StatusOK)
 
-	clienteID := fmt.Sprintf("%d", time.Now().UnixNano())
-	cliente := &Cliente{
-		ID:      clienteID,
-		Canal:   make(chan Mensaje, 10000),
-		cerrado: false,
+	// Un cierre que llegó durante el registro ya no verá a este cliente
+	if s.estaCerrado() {
+		cliente.cerrar()
+	}
+	// Una sesión reanudada ya recibió los retenidos al suscribirse por primera vez
+	if !cliente.sesion.reanudada {
+		s.enviarRetenidosHTTP(cliente, normalizado)
 	}
 
-	mutexHTTP.Lock()
-	if clientesPorTopico[normalizado] == nil {
-		clientesPorTopico[normalizado] = make(map[string]*Cliente)
+	// limpio indica que el stream terminó por desuscripción o cierre del servidor;
+	// cualquier otro fin (desconexión del cliente, error de escritura) publica el testamento
+	limpio := false
+	if idTestamento != "" {
+		s.vincularTestamento(idTestamento, testamento)
 	}
-	clientesPorTopico[normalizado][clienteID] = cliente
-	clientesPorID[clienteID] = cliente
-	mutexHTTP.Unlock()
 
 	defer func() {
-		mutexHTTP.Lock()
-		if clientes, exists := clientesPorTopico[normalizado]; exists {
+		s.mutexHTTP.Lock()
+		if clientes, exists := s.clientesPorTopico[normalizado]; exists {
 			delete(clientes, clienteID)
 			if len(clientes) == 0 {
-				delete(clientesPorTopico, normalizado)
+				delete(s.clientesPorTopico, normalizado)
 			}
 		}
-		delete(clientesPorID, clienteID)
-		mutexHTTP.Unlock()
+		delete(s.clientesPorID, clienteID)
+		// Solo una desuscripción explícita termina la sesión; el cierre del servidor la conserva
+		s.cerrarSesionHTTP(cliente, limpio && !cliente.conservaSesion() && !s.estaCerrado())
+		s.mutexHTTP.Unlock()
 
-		cliente.mu.Lock()
-		if !cliente.cerrado {
-			close(cliente.Canal)
-			cliente.cerrado = true
-		}
-		cliente.mu.Unlock()
+		cliente.cerrar()
 
-		inflightHTTP.EliminarSuscriptor(clienteID)
+		s.inflightHTTP.EliminarSuscriptor(clienteID)
+
+		if idTestamento != "" {
+			s.desvincularTestamento(idTestamento, limpio)
+		}
 
 		loggerPrint(LOG_HTTP, "Cliente desconectado - ID: %s, Tópico: %s", clienteID, normalizado)
 	}()
@@ -254,8 +467,14 @@ func manejarSuscripcionHTTP(w http.ResponseWriter, r *http.Request) {
 			if !ok {
 				// Canal cerrado, salir del loop
 				loggerPrint(LOG_HTTP, "Canal cerrado para cliente - ID: %s", clienteID)
+				limpio = true
 				return
 			}
+			// Un mensaje que venció esperando en el canal ya no se entrega
+			if s.descartarExpirado(LOG_HTTP, msg) {
+				s.descartarSinConfirmar(cliente, msg)
+				continue
+			}
 			jsonBytes, err := json.Marshal(msg)
 			if err != nil {
 				loggerPrint(LOG_HTTP, "Error - No se pudo serializar mensaje: %v", err)
@@ -268,6 +487,12 @@ func manejarSuscripcionHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			flusher.Flush()
 
+		case <-r.Context().Done():
+			loggerPrint(LOG_HTTP, "Conexión cerrada por el cliente - ID: %s", clienteID)
+			// Si la desuscripción llegó antes del corte, el fin sigue siendo limpio
+			limpio = cliente.estaCerrado()
+			return
+
 		case <-keepaliveTicker.C:
 			// Enviar comentario SSE (válido y no dispara callbacks) para mantener viva la conexión
 			_, err := fmt.Fprintf(w, ":keepalive\n\n")
@@ -281,7 +506,7 @@ func manejarSuscripcionHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // Manejar publicaciones de mensajes
-func manejarPublicacionHTTP(w http.ResponseWriter, r *http.Request) {
+func (s *Servidor) manejarPublicacionHTTP(w http.ResponseWriter, r *http.Request) {
 	topicoQuery := r.URL.Query().Get("topico")
 	if topicoQuery == "" {
 		http.Error(w, "Falta el parámetro 'topico'", http.StatusBadRequest)
@@ -297,10 +522,31 @@ func manejarPublicacionHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Tópico de control no permitido por HTTP", http.StatusForbidden)
 		return
 	}
+	if esTopicoSistema(topicoQuery) {
+		http.Error(w, "Tópico reservado del sistema", http.StatusForbidden)
+		return
+	}
+	// La ACL se evalúa sobre el tópico del query; más abajo se exige que coincida con el del cuerpo
+	usuario, err := s.autenticarYAutorizar(credencialesHTTP(r), identidadTLS(r.TLS), AccionPublicar, topicoQuery)
+	if err != nil {
+		loggerPrint(LOG_HTTP, "Publicación rechazada - Usuario: %s, Tópico: %s, Razón: %v", usuario, topicoQuery, err)
+		responderErrorAuthHTTP(w, err)
+		return
+	}
+	if !s.permitirPublicacion(LOG_HTTP, usuario, conexionRemota("http", r.RemoteAddr), topicoQuery) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Límite de publicación excedido", http.StatusTooManyRequests)
+		return
+	}
 
-	// Leer el cuerpo de la solicitud
-	var mensaje Mensaje
-	err = json.NewDecoder(r.Body).Decode(&mensaje)
+	// Leer el cuerpo de la solicitud: un Mensaje JSON o, con Content-Type binario, el
+	// payload crudo (puede llegar chunked). El límite corta la lectura sin cargar el exceso.
+	mensaje, registros, err := s.leerPublicacionHTTP(w, r, topicoQuery)
+	var excedido *http.MaxBytesError
+	if errors.As(err, &excedido) {
+		http.Error(w, "Payload demasiado grande", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error al procesar el cuerpo de la solicitud: "+err.Error(), http.StatusBadRequest)
 		return
@@ -320,7 +566,11 @@ func manejarPublicacionHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "QoS invalido", http.StatusBadRequest)
 		return
 	}
-	if err := validarTamanoPayload(mensaje); err != nil {
+	if err := normalizarTopicoRespuesta(&mensaje); err != nil {
+		http.Error(w, "Topico de respuesta invalido", http.StatusBadRequest)
+		return
+	}
+	if err := validarTamanoPayload(mensaje, s.limites.HTTP); err != nil {
 		http.Error(w, "Payload demasiado grande", http.StatusRequestEntityTooLarge)
 		return
 	}
@@ -329,28 +579,16 @@ func manejarPublicacionHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	mensaje.Topico = mensajeTopico
-
-	// Detectar rebote ANTES de estampar el origen local: un mensaje que
-	// regresa del upstream ya viene con Origen == idLocal. Si estampáramos
-	// primero, todo mensaje local fresco (Orgen="") se marcaría como rebotado.
-	if esMensajeRebotado(mensaje) {
-		loggerPrint(LOG_HTTP, "Mensaje ignorado - Regresó del upstream, ya fue distribuido localmente - Tópico: %s", mensaje.Topico)
+	if err := s.validarPublicacion(LOG_HTTP, usuario, mensaje); err != nil {
+		responderErrorValidacionHTTP(w, err)
 		return
 	}
-	asignarOrigenSiVacio(&mensaje)
 
-	loggerPrint(LOG_HTTP, "Mensaje recibido - Tópico: %s, QoS: %d, MensajeID: %s", mensaje.Topico, mensaje.QoS, mensaje.MensajeID)
-
-	// enviar a los protocolos
-	if mensaje.Original {
-		mensaje.Original = false
-		go enviarHTTP(LOG_HTTP, mensaje)
-		go enviarCoAP(LOG_HTTP, mensaje)
-		go enviarMQTT(LOG_HTTP, mensaje)
-		go reenviarUpstream(mensaje)
+	if !s.distribuirPublicacionHTTP(LOG_HTTP, usuario, conexionRemota("http", r.RemoteAddr), mensaje, registros) {
+		return
 	}
 	// Responder al cliente que envió el POST
-	if mensaje.QoS == 1 {
+	if mensaje.QoS >= 1 {
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(map[string]string{
 			"ack":       "ok",
@@ -361,7 +599,70 @@ func manejarPublicacionHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func manejarDesuscripcionHTTP(w http.ResponseWriter, r *http.Request) {
+// distribuirPublicacionHTTP distribuye una publicación validada que llegó por POST o por
+// WebSocket. Retorna false si el mensaje regresó del upstream y se ignoró; un QoS 2
+// repetido se confirma sin distribuirse. usuario y conexion identifican al publicante,
+// para la deduplicación y los registros normalizados.
+func (s *Servidor) distribuirPublicacionHTTP(LOG, usuario, conexion string, mensaje Mensaje, registros []formatos.Registro) bool {
+	// Detectar rebote ANTES de estampar el origen local: un mensaje que
+	// regresa del upstream ya viene con Origen == idLocal. Si estampáramos
+	// primero, todo mensaje local fresco (Orgen="") se marcaría como rebotado.
+	if s.esMensajeRebotado(mensaje) {
+		loggerPrint(LOG, "Mensaje ignorado - Regresó del upstream, ya fue distribuido localmente - Tópico: %s", mensaje.Topico)
+		return false
+	}
+	if s.duplicado(LOG, usuario, conexion, mensaje) {
+		return true
+	}
+	s.registrarSalto(&mensaje)
+
+	loggerPrint(LOG, "Mensaje recibido - Tópico: %s, QoS: %d, MensajeID: %s", mensaje.Topico, mensaje.QoS, mensaje.MensajeID)
+
+	// enviar a los protocolos
+	if mensaje.Original {
+		mensaje.Original = false
+		s.retener(mensaje)
+		s.distribuir(LOG, mensaje, true)
+		s.publicarNormalizados(LOG, usuario, conexion, registros)
+	}
+	return true
+}
+
+// leerPublicacionHTTP decodifica el cuerpo de una publicación (JSON, CBOR, binario o,
+// con normalización de cargas, un pack SenML cuyos registros también retorna)
+// limitando su tamaño
+func (s *Servidor) leerPublicacionHTTP(w http.ResponseWriter, r *http.Request, topico string) (Mensaje, []formatos.Registro, error) {
+	tipo := r.Header.Get("Content-Type")
+	if s.normalizaCargas() && esTipoSenML(tipo) {
+		datos, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.limites.HTTP)))
+		if err != nil {
+			return Mensaje{}, nil, err
+		}
+		registros, err := formatos.DecodificarSenML(datos)
+		return Mensaje{Original: true, Topico: topico, Payload: datos}, registros, err
+	}
+	switch tipo {
+	case tipoBinario:
+		datos, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.limites.HTTP)))
+		if err != nil {
+			return Mensaje{}, nil, err
+		}
+		m, err := leerMensajeBinario(r.URL.Query().Get, topico, datos)
+		return m, nil, err
+	case tipoCBOR:
+		datos, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(tamanoCuerpoJSON(s.limites.HTTP))))
+		if err != nil {
+			return Mensaje{}, nil, err
+		}
+		m, err := decodificarMensaje(datos, middleware.CodificacionCBOR)
+		return m, nil, err
+	}
+	var m Mensaje
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(tamanoCuerpoJSON(s.limites.HTTP)))).Decode(&m)
+	return m, nil, err
+}
+
+func (s *Servidor) manejarDesuscripcionHTTP(w http.ResponseWriter, r *http.Request) {
 	topico := r.URL.Query().Get("topico")
 	clienteID := r.URL.Query().Get("clienteID")
 
@@ -369,53 +670,103 @@ func manejarDesuscripcionHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Faltan parámetros 'topico' o 'clienteID'", http.StatusBadRequest)
 		return
 	}
+	usuario, err := s.autenticar(credencialesHTTP(r), identidadTLS(r.TLS))
+	if err != nil {
+		responderErrorAuthHTTP(w, errNoAutenticado)
+		return
+	}
+	// Si el stream ya se cerró, la desuscripción explícita descarta el testamento pendiente
+	if id := r.URL.Query().Get(paramTestamentoID); id != "" {
+		s.cancelarTestamento(id)
+	}
 
 	normalizado, err := normalizarYValidarTopico(topico, true)
 	if err != nil {
 		http.Error(w, "Topico invalido", http.StatusBadRequest)
 		return
 	}
+	conservarSesion := r.URL.Query().Get(paramConservarSesion) == "1"
 
-	mutexHTTP.Lock()
+	s.mutexHTTP.Lock()
 	var clienteEncontrado *Cliente
-	if clientes, exists := clientesPorTopico[normalizado]; exists {
+	if clientes, exists := s.clientesPorTopico[normalizado]; exists {
 		if cliente, existe := clientes[clienteID]; existe {
+			if cliente.usuario != usuario {
+				s.mutexHTTP.Unlock()
+				loggerPrint(LOG_HTTP, "Desuscripción rechazada - Usuario: %s, ClienteID: %s, Razón: cliente de otro usuario", usuario, clienteID)
+				http.Error(w, "El cliente pertenece a otro usuario", http.StatusForbidden)
+				return
+			}
 			clienteEncontrado = cliente
 			delete(clientes, clienteID)
 			if len(clientes) == 0 {
-				delete(clientesPorTopico, normalizado)
+				delete(s.clientesPorTopico, normalizado)
+			}
+			// La sesión conservada empieza a encolar en cuanto el cliente deja de recibir
+			if conservarSesion {
+				s.cerrarSesionHTTP(cliente, false)
 			}
 		}
 	}
-	mutexHTTP.Unlock()
+	s.mutexHTTP.Unlock()
+
+	// Igual que con el testamento, la sesión de un stream ya caído se termina directamente
+	terminada := false
+	if id := r.URL.Query().Get(paramSesion); id != "" && clienteEncontrado == nil && !conservarSesion {
+		terminada = s.sesiones.terminarDesconectada(protocoloHTTP, id, normalizado, usuario)
+	}
 
 	if clienteEncontrado != nil {
-		clienteEncontrado.mu.Lock()
-		if !clienteEncontrado.cerrado {
-			close(clienteEncontrado.Canal)
-			clienteEncontrado.cerrado = true
+		if conservarSesion {
+			clienteEncontrado.cerrarConservandoSesion()
+		} else {
+			clienteEncontrado.cerrar()
 		}
-		clienteEncontrado.mu.Unlock()
 
-		inflightHTTP.EliminarSuscriptor(clienteID)
+		s.inflightHTTP.EliminarSuscriptor(clienteID)
 
 		loggerPrint(LOG_HTTP, "Cliente desuscrito - ID: %s, Tópico: %s", clienteID, normalizado)
 		w.WriteHeader(http.StatusOK)
+	} else if terminada {
+		w.WriteHeader(http.StatusOK)
 	} else {
 		http.Error(w, "Cliente no encontrado", http.StatusNotFound)
 	}
 }
 
+// cerrarSesionHTTP termina o suspende la sesión persistente de un cliente que deja de
+// recibir. Requiere s.mutexHTTP tomado en la misma sección crítica en que el cliente se
+// quita del registro, para que el fanout lo encole sin huecos.
+func (s *Servidor) cerrarSesionHTTP(c *Cliente, terminar bool) {
+	if c.sesion.clave == "" {
+		return
+	}
+	if terminar {
+		s.sesiones.terminar(c.sesion)
+		return
+	}
+	s.sesiones.desconectar(c.sesion, func() []Mensaje {
+		return c.noEntregados(func(mensajeID string) bool {
+			return s.inflightHTTP.Existe(mensajeID, c.ID)
+		})
+	})
+}
+
 type solicitudAck struct {
 	ClienteID string `json:"clienteId"`
 	MensajeID string `json:"mensajeId"`
 }
 
-func manejarAckHTTP(w http.ResponseWriter, r *http.Request) {
+func (s *Servidor) manejarAckHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	usuario, err := s.autenticar(credencialesHTTP(r), identidadTLS(r.TLS))
+	if err != nil {
+		responderErrorAuthHTTP(w, errNoAutenticado)
+		return
+	}
 
 	var ack solicitudAck
 	if err := json.NewDecoder(r.Body).Decode(&ack); err != nil {
@@ -427,49 +778,447 @@ func manejarAckHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mutexHTTP.Lock()
-	cliente := clientesPorID[ack.ClienteID]
-	mutexHTTP.Unlock()
+	s.mutexHTTP.Lock()
+	cliente := s.clientesPorID[ack.ClienteID]
+	s.mutexHTTP.Unlock()
 	if cliente == nil {
 		http.Error(w, "Cliente no encontrado", http.StatusNotFound)
 		return
 	}
+	if cliente.usuario != usuario {
+		loggerPrint(LOG_HTTP, "ACK rechazado - Usuario: %s, ClienteID: %s, Razón: cliente de otro usuario", usuario, ack.ClienteID)
+		http.Error(w, "El cliente pertenece a otro usuario", http.StatusForbidden)
+		return
+	}
 
-	inflightHTTP.Ack(ack.MensajeID, ack.ClienteID)
+	s.inflightHTTP.Ack(ack.MensajeID, ack.ClienteID)
+	cliente.confirmar(ack.MensajeID)
+	s.compartidas.confirmar(ack.MensajeID, miembroHTTP(ack.ClienteID))
 	loggerPrint(LOG_HTTP, "ACK recibido - ClienteID: %s, MensajeID: %s", ack.ClienteID, ack.MensajeID)
 	w.WriteHeader(http.StatusOK)
 }
 
-func enviarHTTPQoS1(LOG string, c *Cliente, msg Mensaje) {
+// descartarSinConfirmar libera el QoS 1 o 2 de un mensaje vencido que ya no se entregará
+func (s *Servidor) descartarSinConfirmar(c *Cliente, msg Mensaje) {
+	if msg.QoS >= 1 {
+		s.inflightHTTP.Ack(msg.MensajeID, c.ID)
+		c.confirmar(msg.MensajeID)
+	}
+}
+
+func (s *Servidor) enviarHTTPQoS1(LOG string, c *Cliente, msg Mensaje) {
 	if msg.MensajeID == "" {
 		loggerPrint(LOG, "Error - QoS 1 sin MensajeID, no se envía")
 		return
 	}
 	// Registrar en el tracker compartido. Si ya estaba pendiente (dedup), no
 	// iniciar un nuevo ciclo de redelivery.
-	if !inflightHTTP.Registrar(msg.MensajeID, c.ID) {
+	if !s.inflightHTTP.Registrar(msg.MensajeID, c.ID) {
 		return
 	}
+	c.registrarSinConfirmar(msg)
+
+	// El primer envío es síncrono para respetar el orden de entrega de quien llama
+	// (p. ej. la cola de una sesión); los reintentos siguen en segundo plano.
+	enviar := func(intento int) {
+		// El éxito no se loguea: el ACK confirmará la recepción
+		if !c.enviar(msg) {
+			loggerPrint(LOG, "Error - No se pudo enviar mensaje QoS 1 - MensajeID: %s, Intento: %d, Razón: canal bloqueado", msg.MensajeID, intento)
+		}
+	}
+	enviar(0)
 
 	go func() {
 		// Backoff RFC 7252: ACK_TIMEOUT aleatorizado + ×2 por reintento.
 		delay := qos.JitterAckTimeout()
-		for intento := 0; intento <= qos.MaxRetransmisiones; intento++ {
-			if !inflightHTTP.Existe(msg.MensajeID, c.ID) {
+		agotado := true
+		for intento := 1; intento <= qos.MaxRetransmisiones; intento++ {
+			time.Sleep(delay)
+			delay *= qos.FactorBackoff
+			if !s.inflightHTTP.Existe(msg.MensajeID, c.ID) {
 				return
 			}
+			// Un QoS 1 vencido deja de retransmitirse
+			if s.descartarExpirado(LOG, msg) {
+				agotado = false
+				break
+			}
+			enviar(intento)
+		}
+		if agotado {
+			s.metricas.ackVencidos.sumar(destinoHTTP(c), 1)
+		}
+		s.inflightHTTP.Ack(msg.MensajeID, c.ID) // agotado o vencido: liberar
+		c.confirmar(msg.MensajeID)
+	}()
+}
+
+// --- WebSocket nativo ---
+//
+// rutaWebSocket ofrece a los navegadores suscripción, desuscripción, publicación y ACK
+// sobre una sola conexión, con tramas JSON de texto:
+//
+//	{"tipo":"suscribir","id":"1","topico":"sensores/#"}
+//	{"tipo":"desuscribir","id":"2","topico":"sensores/#"}
+//	{"tipo":"publicar","id":"3","mensaje":{"original":true,"topico":"a/b","payload":"MjE=","qos":1,"mensajeId":"m1"}}
+//	{"tipo":"ack","mensajeId":"m1"}
+//
+// El servidor entrega cada mensaje como {"tipo":"mensaje","mensaje":{...}} y responde
+// {"tipo":"ok","id":...} a las suscripciones, desuscripciones y publicaciones QoS 1
+// (con su mensajeId), o {"tipo":"error","id":...,"error":...} a cualquier trama rechazada.
+// Cada suscripción se registra como un Cliente del fanout HTTP, por lo que la
+// distribución, los retenidos y el redelivery QoS 1 son los de SSE. Como el navegador
+// no puede enviar la cabecera Authorization en un WebSocket, las credenciales también
+// se aceptan en la query (usuario y clave, o token).
+
+const (
+	rutaWebSocket = "/sensorwave/ws"
+
+	tramaSuscribir   = "suscribir"
+	tramaDesuscribir = "desuscribir"
+	tramaPublicar    = "publicar"
+	tramaAck         = "ack"
+	tramaMensaje     = "mensaje"
+	tramaOK          = "ok"
+	tramaError       = "error"
+
+	// intervaloPingWS mantiene viva la conexión igual que el keepalive SSE; sin pong
+	// durante esperaPongWS la conexión se da por caída
+	intervaloPingWS   = 5 * time.Second
+	esperaPongWS      = 3 * intervaloPingWS
+	esperaEscrituraWS = 10 * time.Second
+	margenTramaWS     = 512 // campos de la trama alrededor del Mensaje
+	capacidadCanalWS  = 10000
+)
+
+// tramaWS es una trama del WebSocket nativo en cualquiera de los dos sentidos
+type tramaWS struct {
+	Tipo      string   `json:"tipo"`
+	ID        string   `json:"id,omitempty"` // correlaciona la respuesta con la trama del cliente
+	Topico    string   `json:"topico,omitempty"`
+	Mensaje   *Mensaje `json:"mensaje,omitempty"`
+	MensajeID string   `json:"mensajeId,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// actualizadorWS acepta cualquier origen: los tableros se sirven desde otros dominios y
+// la autorización no depende de cookies sino de las credenciales explícitas
+var actualizadorWS = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// conexionWS es un cliente del WebSocket nativo con sus suscripciones
+type conexionWS struct {
+	conn     *websocket.Conn
+	usuario  string
+	conexion string // identifica al publicante sin autenticar (ver tasas.go)
+
+	escritura sync.Mutex // la conexión admite un solo escritor a la vez
+
+	mu            sync.Mutex
+	suscripciones map[string]*Cliente // patrón normalizado -> cliente del fanout HTTP
+}
+
+// escribir envía una trama; un error de escritura cierra la conexión y termina su lectura
+func (c *conexionWS) escribir(t tramaWS) error {
+	c.escritura.Lock()
+	defer c.escritura.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(esperaEscrituraWS))
+	if err := c.conn.WriteJSON(t); err != nil {
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *conexionWS) responder(id string, err error) {
+	if err != nil {
+		_ = c.escribir(tramaWS{Tipo: tramaError, ID: id, Error: err.Error()})
+		return
+	}
+	_ = c.escribir(tramaWS{Tipo: tramaOK, ID: id})
+}
+
+// credencialesWebSocket toma las credenciales de la cabecera Authorization o, si no
+// está, de la query
+func credencialesWebSocket(r *http.Request) Credenciales {
+	cred := credencialesHTTP(r)
+	if cred.Vacias() {
+		query := r.URL.Query()
+		cred = Credenciales{Usuario: query.Get("usuario"), Clave: query.Get("clave"), Token: query.Get("token")}
+	}
+	return cred
+}
+
+func (s *Servidor) manejarWebSocket(w http.ResponseWriter, r *http.Request) {
+	usuario, err := s.autenticar(credencialesWebSocket(r), identidadTLS(r.TLS))
+	if err != nil {
+		responderErrorAuthHTTP(w, errNoAutenticado)
+		return
+	}
+	conn, err := actualizadorWS.Upgrade(w, r, nil)
+	if err != nil {
+		loggerPrint(LOG_HTTP, "Error - No se pudo abrir el WebSocket: %v", err)
+		return
+	}
+	c := &conexionWS{conn: conn, usuario: usuario, conexion: conexionRemota("http", r.RemoteAddr), suscripciones: make(map[string]*Cliente)}
+
+	s.mutexHTTP.Lock()
+	s.conexionesWS[c] = struct{}{}
+	s.mutexHTTP.Unlock()
+	if s.estaCerrado() {
+		conn.Close()
+	}
+	defer s.cerrarWebSocket(c)
+	loggerPrint(LOG_HTTP, "WebSocket conectado - Usuario: %s, Dirección: %s", usuario, r.RemoteAddr)
+
+	conn.SetReadLimit(int64(tamanoCuerpoJSON(s.limites.HTTP) + margenTramaWS))
+	_ = conn.SetReadDeadline(time.Now().Add(esperaPongWS))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(esperaPongWS))
+	})
+	fin := make(chan struct{})
+	defer close(fin)
+	go func() {
+		ticker := time.NewTicker(intervaloPingWS)
+		defer ticker.Stop()
+		for {
 			select {
-			case c.Canal <- msg:
-				// Éxito silencioso - el ACK confirmará la recepción
-			default:
-				loggerPrint(LOG, "Error - No se pudo enviar mensaje QoS 1 - MensajeID: %s, Intento: %d, Razón: canal bloqueado", msg.MensajeID, intento)
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(esperaEscrituraWS)); err != nil {
+					return
+				}
+			case <-fin:
+				return
+			}
+		}
+	}()
+
+	for {
+		_, datos, err := conn.ReadMessage()
+		if err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				loggerPrint(LOG_HTTP, "WebSocket cerrado - Usuario: %s, Razón: trama demasiado grande", usuario)
+			}
+			return
+		}
+		var t tramaWS
+		if err := json.Unmarshal(datos, &t); err != nil {
+			c.responder("", fmt.Errorf("trama inválida: %v", err))
+			continue
+		}
+		switch t.Tipo {
+		case tramaSuscribir:
+			s.suscribirWebSocket(c, t)
+		case tramaDesuscribir:
+			c.responder(t.ID, s.desuscribirWebSocket(c, t.Topico))
+		case tramaPublicar:
+			s.publicarWebSocket(c, t)
+		case tramaAck:
+			s.confirmarWebSocket(c, t.MensajeID)
+		default:
+			c.responder(t.ID, fmt.Errorf("tipo de trama desconocido: %q", t.Tipo))
+		}
+	}
+}
+
+// suscribirWebSocket registra la suscripción en el fanout HTTP y reenvía sus mensajes
+// por la conexión. Suscribirse dos veces al mismo patrón no duplica la entrega.
+func (s *Servidor) suscribirWebSocket(c *conexionWS, t tramaWS) {
+	normalizado, err := normalizarYValidarTopico(t.Topico, true)
+	if err != nil {
+		c.responder(t.ID, errTopicoInvalido)
+		return
+	}
+	filtro, err := filtroSuscripcion(normalizado)
+	if err != nil {
+		c.responder(t.ID, err)
+		return
+	}
+	if EsTopicoControl(filtro) {
+		c.responder(t.ID, fmt.Errorf("tópico de control no permitido por WebSocket"))
+		return
+	}
+	if !s.autorizar(c.usuario, AccionSuscribir, normalizado) {
+		loggerPrint(LOG_HTTP, "Suscripción WebSocket rechazada - Usuario: %s, Tópico: %s", c.usuario, normalizado)
+		c.responder(t.ID, errNoAutorizado)
+		return
+	}
+
+	c.mu.Lock()
+	if _, existe := c.suscripciones[normalizado]; existe {
+		c.mu.Unlock()
+		c.responder(t.ID, nil)
+		return
+	}
+	cliente := &Cliente{
+		ID:      "ws-" + uuid.NewString(),
+		Canal:   make(chan Mensaje, capacidadCanalWS),
+		usuario: c.usuario,
+	}
+	c.suscripciones[normalizado] = cliente
+	c.mu.Unlock()
+
+	s.mutexHTTP.Lock()
+	if s.clientesPorTopico[normalizado] == nil {
+		s.clientesPorTopico[normalizado] = make(map[string]*Cliente)
+	}
+	s.clientesPorTopico[normalizado][cliente.ID] = cliente
+	s.clientesPorID[cliente.ID] = cliente
+	s.mutexHTTP.Unlock()
+	if s.estaCerrado() {
+		cliente.cerrar()
+	}
+
+	// La confirmación precede a los retenidos y a los mensajes de la suscripción
+	c.responder(t.ID, nil)
+	s.enviarRetenidosHTTP(cliente, normalizado)
+	go func() {
+		for msg := range cliente.Canal {
+			if s.descartarExpirado(LOG_HTTP, msg) {
+				s.descartarSinConfirmar(cliente, msg)
+				continue
 			}
-			if intento == qos.MaxRetransmisiones {
-				inflightHTTP.Ack(msg.MensajeID, c.ID) // agotado: liberar
+			if err := c.escribir(tramaWS{Tipo: tramaMensaje, Mensaje: &msg}); err != nil {
+				loggerPrint(LOG_HTTP, "Error al escribir mensaje por WebSocket - ID: %s, Error: %v", cliente.ID, err)
 				return
 			}
-			time.Sleep(delay)
-			delay *= qos.FactorBackoff
 		}
 	}()
+	loggerPrint(LOG_HTTP, "Cliente WebSocket suscrito - ID: %s, Tópico: %s", cliente.ID, normalizado)
+}
+
+// desuscribirWebSocket quita una suscripción de la conexión
+func (s *Servidor) desuscribirWebSocket(c *conexionWS, topico string) error {
+	normalizado, err := normalizarYValidarTopico(topico, true)
+	if err != nil {
+		return errTopicoInvalido
+	}
+	c.mu.Lock()
+	cliente := c.suscripciones[normalizado]
+	delete(c.suscripciones, normalizado)
+	c.mu.Unlock()
+	if cliente == nil {
+		return fmt.Errorf("sin suscripción a %s", normalizado)
+	}
+	s.quitarClienteHTTP(normalizado, cliente)
+	loggerPrint(LOG_HTTP, "Cliente WebSocket desuscrito - ID: %s, Tópico: %s", cliente.ID, normalizado)
+	return nil
+}
+
+// publicarWebSocket valida y distribuye una publicación con las mismas reglas que el POST
+func (s *Servidor) publicarWebSocket(c *conexionWS, t tramaWS) {
+	if t.Mensaje == nil {
+		c.responder(t.ID, fmt.Errorf("falta el mensaje"))
+		return
+	}
+	mensaje := *t.Mensaje
+	topico, err := normalizarYValidarTopico(mensaje.Topico, false)
+	if err != nil {
+		c.responder(t.ID, errTopicoInvalido)
+		return
+	}
+	if EsTopicoControl(topico) {
+		c.responder(t.ID, fmt.Errorf("tópico de control no permitido por WebSocket"))
+		return
+	}
+	if esTopicoSistema(topico) {
+		c.responder(t.ID, errTopicoSistema)
+		return
+	}
+	if !s.autorizar(c.usuario, AccionPublicar, topico) {
+		loggerPrint(LOG_HTTP, "Publicación WebSocket rechazada - Usuario: %s, Tópico: %s", c.usuario, topico)
+		c.responder(t.ID, errNoAutorizado)
+		return
+	}
+	if !s.permitirPublicacion(LOG_HTTP, c.usuario, c.conexion, topico) {
+		c.responder(t.ID, errTasaExcedida)
+		return
+	}
+	if err := validarQoS(mensaje); err != nil {
+		c.responder(t.ID, err)
+		return
+	}
+	if err := normalizarTopicoRespuesta(&mensaje); err != nil {
+		c.responder(t.ID, err)
+		return
+	}
+	if err := validarTamanoPayload(mensaje, s.limites.HTTP); err != nil {
+		c.responder(t.ID, err)
+		return
+	}
+	mensaje.Topico = topico
+	if err := s.validarPublicacion(LOG_HTTP, c.usuario, mensaje); err != nil {
+		c.responder(t.ID, err)
+		return
+	}
+
+	if s.distribuirPublicacionHTTP(LOG_HTTP, c.usuario, c.conexion, mensaje, nil) && mensaje.QoS >= 1 {
+		_ = c.escribir(tramaWS{Tipo: tramaOK, ID: t.ID, MensajeID: mensaje.MensajeID})
+	}
+}
+
+// confirmarWebSocket libera el QoS 1 en todas las suscripciones de la conexión que lo esperan
+func (s *Servidor) confirmarWebSocket(c *conexionWS, mensajeID string) {
+	if mensajeID == "" {
+		c.responder("", fmt.Errorf("falta el mensajeId del ack"))
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cliente := range c.suscripciones {
+		if s.inflightHTTP.Existe(mensajeID, cliente.ID) {
+			s.inflightHTTP.Ack(mensajeID, cliente.ID)
+			cliente.confirmar(mensajeID)
+		}
+		s.compartidas.confirmar(mensajeID, miembroHTTP(cliente.ID))
+	}
+}
+
+// quitarClienteHTTP saca un cliente del fanout, cierra su canal y descarta sus inflight
+func (s *Servidor) quitarClienteHTTP(patron string, cliente *Cliente) {
+	s.mutexHTTP.Lock()
+	if clientes, existe := s.clientesPorTopico[patron]; existe {
+		delete(clientes, cliente.ID)
+		if len(clientes) == 0 {
+			delete(s.clientesPorTopico, patron)
+		}
+	}
+	delete(s.clientesPorID, cliente.ID)
+	s.mutexHTTP.Unlock()
+	cliente.cerrar()
+	s.inflightHTTP.EliminarSuscriptor(cliente.ID)
+}
+
+// cerrarWebSocket quita las suscripciones de una conexión terminada
+func (s *Servidor) cerrarWebSocket(c *conexionWS) {
+	c.mu.Lock()
+	suscripciones := c.suscripciones
+	c.suscripciones = make(map[string]*Cliente)
+	c.mu.Unlock()
+	for patron, cliente := range suscripciones {
+		s.quitarClienteHTTP(patron, cliente)
+	}
+
+	s.mutexHTTP.Lock()
+	delete(s.conexionesWS, c)
+	s.mutexHTTP.Unlock()
+	c.conn.Close()
+	loggerPrint(LOG_HTTP, "WebSocket desconectado - Usuario: %s", c.usuario)
+}
+
+// cerrarConexionesWS avisa el cierre del servidor a los clientes WebSocket y corta sus conexiones
+func (s *Servidor) cerrarConexionesWS() {
+	s.mutexHTTP.Lock()
+	conexiones := make([]*conexionWS, 0, len(s.conexionesWS))
+	for c := range s.conexionesWS {
+		conexiones = append(conexiones, c)
+	}
+	s.mutexHTTP.Unlock()
+
+	for _, c := range conexiones {
+		cierre := websocket.FormatCloseMessage(websocket.CloseGoingAway, "servidor cerrado")
+		_ = c.conn.WriteControl(websocket.CloseMessage, cierre, time.Now().Add(time.Second))
+		c.conn.Close()
+	}
 }
@@ -4,7 +4,9 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"log"
-	"sync"
+	"os"
+	"path/filepath"
+	"slices"
 
 	"github.com/sensorwave-dev/sensorwave/middleware"
 )
@@ -12,14 +14,6 @@ import (
 // Mensaje es un alias al tipo del paquete middleware para unificar la estructura
 type Mensaje = middleware.Mensaje
 
-var (
-	idInstanciaServidor string
-	idInstanciaOnce     sync.Once
-
-	upstreamMu      sync.RWMutex
-	clienteUpstream middleware.Cliente
-)
-
 func generarIDInstancia() string {
 	buf := make([]byte, 8)
 	if _, err := rand.Read(buf); err == nil {
@@ -28,65 +22,44 @@ func generarIDInstancia() string {
 	return "sw-unknown"
 }
 
-func obtenerIDInstancia() string {
-	idInstanciaOnce.Do(func() {
-		idInstanciaServidor = generarIDInstancia()
-	})
-	return idInstanciaServidor
-}
-
-// ConfigurarUpstream establece un cliente remoto opcional para federación.
-// Si cliente es nil, deshabilita el reenvío upstream.
-func ConfigurarUpstream(cliente middleware.Cliente) {
-	upstreamMu.Lock()
-	clienteUpstream = cliente
-	upstreamMu.Unlock()
-
-	if cliente == nil {
-		loggerPrint("UPSTREAM", "Upstream deshabilitado")
-		return
+// registrarSalto estampa el origen si falta y agrega esta instancia a los saltos del
+// mensaje antes de distribuirlo
+func (s *Servidor) registrarSalto(m *Mensaje) {
+	if m.Origen == "" {
+		m.Origen = s.id
 	}
-
-	loggerPrint("UPSTREAM", "Upstream configurado - ID instancia: %s", obtenerIDInstancia())
-}
-
-func asignarOrigenSiVacio(m *Mensaje) {
-	if m.Origen != "" {
-		return
+	if !slices.Contains(m.Saltos, s.id) {
+		m.Saltos = append(slices.Clip(m.Saltos), s.id)
 	}
-	m.Origen = obtenerIDInstancia()
 }
 
-// esMensajeRebotado indica si un mensaje fue originado por esta instancia
-// y regresó del upstream. En ese caso no debe distribuirse localmente otra vez.
-func esMensajeRebotado(m Mensaje) bool {
-	idLocal := obtenerIDInstancia()
-	return m.Origen != "" && m.Origen == idLocal
+// esMensajeRebotado indica si un mensaje ya pasó por esta instancia (por su origen o
+// por sus saltos) y regresó por un puente. En ese caso no debe distribuirse localmente otra vez.
+func (s *Servidor) esMensajeRebotado(m Mensaje) bool {
+	return (m.Origen != "" && m.Origen == s.id) || slices.Contains(m.Saltos, s.id)
 }
 
-func reenviarUpstream(m Mensaje) {
-	upstreamMu.RLock()
-	cliente := clienteUpstream
-	upstreamMu.RUnlock()
-
-	if cliente == nil {
-		return
+// escribirArchivoAtomico reemplaza el contenido de ruta escribiendo primero un archivo
+// temporal en el mismo directorio, de modo que una caída no deje el archivo a medias
+func escribirArchivoAtomico(ruta string, datos []byte) error {
+	temporal, err := os.CreateTemp(filepath.Dir(ruta), "."+filepath.Base(ruta)+"-*")
+	if err != nil {
+		return err
 	}
-
-	idLocal := obtenerIDInstancia()
-	// Si el mensaje vino de otra instancia, no reenviar para evitar bucles.
-	if m.Origen != "" && m.Origen != idLocal {
-		return
+	if _, err := temporal.Write(datos); err != nil {
+		temporal.Close()
+		os.Remove(temporal.Name())
+		return err
 	}
-
-	if m.Topico == "" {
-		return
+	if err := temporal.Close(); err != nil {
+		os.Remove(temporal.Name())
+		return err
 	}
-
-	m.Original = true
-	if err := cliente.Publicar(m.Topico, m); err != nil {
-		loggerPrint("UPSTREAM", "error reenviando %s: %v", m.Topico, err)
+	if err := os.Rename(temporal.Name(), ruta); err != nil {
+		os.Remove(temporal.Name())
+		return err
 	}
+	return nil
 }
 
 // loggerFatal imprime un mensaje en la consola de log y termina
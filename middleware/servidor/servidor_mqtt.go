@@ -1,23 +1,31 @@
 package servidor
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/gorilla/websocket"
 	mochi "github.com/mochi-mqtt/server/v2"
-	"github.com/mochi-mqtt/server/v2/hooks/auth"
 	"github.com/mochi-mqtt/server/v2/listeners"
 	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/sensorwave-dev/sensorwave/middleware/formatos"
 	"github.com/sensorwave-dev/sensorwave/tipos"
 )
 
 const LOG_MQTT = "MQTT"
 
-// brokerMQTT es el broker MQTT embebido (mochi-mqtt). Reemplaza la dependencia
+// El broker MQTT embebido (mochi-mqtt, Servidor.brokerMQTT) reemplaza la dependencia
 // de un broker externo (mosquitto, etc.). El middleware actúa como broker y a la
 // vez popula el fanout a los otros protocolos desde un hook OnPublish en proceso,
 // eliminando el roundtrip TCP y el hack de mensaje rebotado.
-var brokerMQTT *mochi.Server
 
 // hookMQTTOptions contiene la configuración del hook de SensorWave.
 type hookMQTTOptions struct{}
@@ -29,12 +37,15 @@ type hookMQTTOptions struct{}
 // el hook se omite: el broker entregará a los suscriptores MQTT sin re-fanout.
 type hookMQTT struct {
 	mochi.HookBase
+	servidor *Servidor
+	auth     *hookAuthMQTT // identidad de los clientes para los límites de tasa
 }
 
 func (h *hookMQTT) ID() string { return "sensorwave-mqtt" }
 
 func (h *hookMQTT) Provides(b byte) bool {
-	return b == mochi.OnPublish
+	return b == mochi.OnPublish || b == mochi.OnWillSent ||
+		b == mochi.OnSelectSubscribers || b == mochi.OnPacketRead
 }
 
 // OnPublish maneja los PUBLISHes entrantes de clientes externos.
@@ -53,40 +64,36 @@ func (h *hookMQTT) OnPublish(cl *mochi.Client, pk packets.Packet) (packets.Packe
 		return pk, nil
 	}
 
-	topicoMQTT, err := normalizarYValidarTopico(pk.TopicName, false)
-	if err != nil {
-		loggerPrint(LOG_MQTT, "Error - Tópico inválido: %v", pk.TopicName)
+	if !h.servidor.permitirPublicacion(LOG_MQTT, h.auth.usuario(cl), "mqtt/"+cl.ID, pk.TopicName) {
+		// MQTT 5 informa el rechazo en el PUBACK; en MQTT 3.1.1 el PUBLISH se descarta
+		if cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 {
+			return pk, packets.ErrQuotaExceeded
+		}
 		return pk, packets.ErrRejectPacket
 	}
 
-	var mensaje Mensaje
-	if err := json.Unmarshal(pk.Payload, &mensaje); err != nil {
-		loggerPrint(LOG_MQTT, "Error - No se pudo procesar el cuerpo: %v", err)
-		return pk, packets.ErrRejectPacket
-	}
-	if mensaje.Topico == "" {
-		loggerPrint(LOG_MQTT, "Error - Mensaje sin tópico en body")
-		return pk, packets.ErrRejectPacket
+	// Sparkplug B: el payload es protobuf, no un Mensaje; el broker lo entrega tal cual
+	// a los suscriptores MQTT y el resto de los protocolos recibe los registros normalizados
+	if h.servidor.normalizaCargas() && formatos.EsTopicoSparkplug(pk.TopicName) {
+		h.servidor.normalizarSparkplug(h.auth.usuario(cl), "mqtt/"+cl.ID, pk.TopicName, pk.Payload)
+		return pk, nil
 	}
-	mensajeTopico, err := normalizarYValidarTopico(mensaje.Topico, false)
+
+	mensaje, err := mensajeDesdePaquete(pk, h.servidor.limites.MQTT)
 	if err != nil {
-		loggerPrint(LOG_MQTT, "Error - Tópico en body inválido: %v", mensaje.Topico)
-		return pk, packets.ErrRejectPacket
-	}
-	if err := validarQoS(mensaje); err != nil {
-		loggerPrint(LOG_MQTT, "Error - QoS inválido: %v", err)
+		loggerPrint(LOG_MQTT, "Error - %v", err)
 		return pk, packets.ErrRejectPacket
 	}
-	if err := validarTamanoPayload(mensaje); err != nil {
-		loggerPrint(LOG_MQTT, "Error - Payload demasiado grande: %v", err)
-		return pk, packets.ErrRejectPacket
+	s := h.servidor
+	if err := s.validarPublicacion(LOG_MQTT, h.auth.usuario(cl), mensaje); err != nil {
+		return pk, rechazoValidacionMQTT(cl, pk, err)
 	}
-	if mensajeTopico != topicoMQTT {
-		loggerPrint(LOG_MQTT, "Error - Tópico MQTT y body no coincieren: %s != %s", topicoMQTT, mensajeTopico)
-		return pk, packets.ErrRejectPacket
+	// Un mensaje que ya pasó por esta instancia se confirma pero no se distribuye
+	if s.esMensajeRebotado(mensaje) {
+		loggerPrint(LOG_MQTT, "Mensaje ignorado - Ya pasó por esta instancia - Tópico: %s", mensaje.Topico)
+		return pk, packets.CodeSuccessIgnore
 	}
-	mensaje.Topico = mensajeTopico
-	asignarOrigenSiVacio(&mensaje)
+	s.registrarSalto(&mensaje)
 	loggerPrint(LOG_MQTT, "Mensaje recibido - Tópico: %s, QoS: %d, MensajeID: %s", mensaje.Topico, mensaje.QoS, mensaje.MensajeID)
 
 	// En proceso: el broker entrega a suscriptores MQTT automáticamente al
@@ -95,49 +102,384 @@ func (h *hookMQTT) OnPublish(cl *mochi.Client, pk packets.Packet) (packets.Packe
 		mensaje.Original = false
 		if tipos.EsTopicoControl(mensaje.Topico) {
 			// Plano de control: solo federación upstream, no fanout a HTTP/CoAP.
-			go reenviarUpstream(mensaje)
+			s.recodificarParaSuscriptores(&pk, mensaje)
+			go s.reenviarUpstream(mensaje)
 			return pk, nil
 		}
-		go enviarCoAP(LOG_MQTT, mensaje)
-		go enviarHTTP(LOG_MQTT, mensaje)
-		go reenviarUpstream(mensaje)
+		// El flag retain del PUBLISH equivale a Retenido. retener replica el mensaje en
+		// el broker, que no debe guardar el paquete por su cuenta: un borrado (payload
+		// vacío dentro del JSON) llegaría como paquete no vacío y quedaría retenido.
+		if pk.FixedHeader.Retain {
+			mensaje.Retenido = true
+		}
+		pk.FixedHeader.Retain = false
+		s.recodificarParaSuscriptores(&pk, mensaje)
+		s.retener(mensaje)
+		s.distribuir(LOG_MQTT, mensaje, false)
+	}
+
+	return pk, nil
+}
+
+// recodificarParaSuscriptores entrega a los suscriptores MQTT el mensaje con los saltos
+// registrados; si no se puede recodificar, el broker entrega el payload original
+func (s *Servidor) recodificarParaSuscriptores(pk *packets.Packet, m Mensaje) {
+	if err := recodificarPaqueteMQTT(pk, m); err != nil {
+		loggerPrint(LOG_MQTT, "Error - No se pudo recodificar el mensaje: %v", err)
+	}
+}
+
+// OnWillSent distribuye a HTTP, CoAP y upstream el testamento de un cliente MQTT,
+// que el broker ya entregó a los suscriptores MQTT
+func (h *hookMQTT) OnWillSent(cl *mochi.Client, pk packets.Packet) {
+	// El NDEATH de un nodo Sparkplug descarta sus nacimientos
+	if h.servidor.normalizaCargas() && formatos.EsTopicoSparkplug(pk.TopicName) {
+		h.servidor.normalizarSparkplug(h.auth.usuario(cl), "mqtt/"+cl.ID, pk.TopicName, pk.Payload)
+		return
+	}
+	mensaje, err := mensajeDesdePaquete(pk, h.servidor.limites.MQTT)
+	if err != nil {
+		loggerPrint(LOG_MQTT, "Testamento no distribuido - Cliente: %s, Error: %v", cl.ID, err)
+		return
+	}
+	s := h.servidor
+	s.registrarSalto(&mensaje)
+	mensaje.Original = false
+	if pk.FixedHeader.Retain {
+		mensaje.Retenido = true
+	}
+	loggerPrint(LOG_MQTT, "Testamento recibido - Cliente: %s, Tópico: %s", cl.ID, mensaje.Topico)
+
+	if tipos.EsTopicoControl(mensaje.Topico) {
+		go s.reenviarUpstream(mensaje)
+		return
+	}
+	s.retener(mensaje)
+	s.distribuir(LOG_MQTT, mensaje, false)
+}
+
+// OnSelectSubscribers quita las suscripciones compartidas de los mensajes del fanout:
+// enviarCompartidas elige un solo miembro entre todos los protocolos y le escribe el
+// PUBLISH directamente. Los tópicos que no pasan por el fanout conservan la selección
+// del broker.
+func (h *hookMQTT) OnSelectSubscribers(subs *mochi.Subscribers, pk packets.Packet) *mochi.Subscribers {
+	if h.servidor.distribuyeCompartidas(pk.TopicName) {
+		subs.Shared = map[string]map[string]packets.Subscription{}
+		subs.SharedSelected = map[string]packets.Subscription{}
 	}
+	return subs
+}
 
+// OnPacketRead confirma las entregas QoS 1 de suscripciones compartidas con el PUBACK
+// del cliente
+func (h *hookMQTT) OnPacketRead(cl *mochi.Client, pk packets.Packet) (packets.Packet, error) {
+	if pk.FixedHeader.Type == packets.Puback {
+		h.servidor.compartidas.confirmarPaqueteMQTT(cl.ID, pk.PacketID)
+	}
 	return pk, nil
 }
 
-// IniciarMQTT arranca el broker MQTT embebido en el puerto indicado.
+// mensajeDesdePaquete decodifica (JSON o CBOR) y valida el Mensaje de un PUBLISH
+func mensajeDesdePaquete(pk packets.Packet, maximoPayload int) (Mensaje, error) {
+	topicoMQTT, err := normalizarYValidarTopico(pk.TopicName, false)
+	if err != nil {
+		return Mensaje{}, fmt.Errorf("tópico inválido: %v", pk.TopicName)
+	}
+
+	mensaje, err := decodificarPaqueteMQTT(pk)
+	if err != nil {
+		return Mensaje{}, err
+	}
+	if mensaje.Topico == "" {
+		return Mensaje{}, fmt.Errorf("mensaje sin tópico en body")
+	}
+	mensajeTopico, err := normalizarYValidarTopico(mensaje.Topico, false)
+	if err != nil {
+		return Mensaje{}, fmt.Errorf("tópico en body inválido: %v", mensaje.Topico)
+	}
+	if err := validarQoS(mensaje); err != nil {
+		return Mensaje{}, fmt.Errorf("QoS inválido: %v", err)
+	}
+	if err := normalizarTopicoRespuesta(&mensaje); err != nil {
+		return Mensaje{}, err
+	}
+	if err := validarTamanoPayload(mensaje, maximoPayload); err != nil {
+		return Mensaje{}, fmt.Errorf("payload demasiado grande: %v", err)
+	}
+	if mensajeTopico != topicoMQTT {
+		return Mensaje{}, fmt.Errorf("tópico MQTT y body no coinciden: %s != %s", topicoMQTT, mensajeTopico)
+	}
+	mensaje.Topico = mensajeTopico
+	return mensaje, nil
+}
+
+// hookAuthMQTT autentica el CONNECT y aplica la ACL a PUBLISH/SUBSCRIBE.
+// Un token bearer se envía como clave con usuario vacío.
+type hookAuthMQTT struct {
+	mochi.HookBase
+	servidor *Servidor
+	usuarios sync.Map // *mochi.Client -> identidad autenticada (por puntero: sobrevive a la toma de sesión)
+}
+
+func (h *hookAuthMQTT) ID() string { return "sensorwave-auth" }
+
+func (h *hookAuthMQTT) Provides(b byte) bool {
+	return b == mochi.OnConnectAuthenticate || b == mochi.OnACLCheck || b == mochi.OnDisconnect
+}
+
+func (h *hookAuthMQTT) OnConnectAuthenticate(cl *mochi.Client, pk packets.Packet) bool {
+	cred := Credenciales{Usuario: string(pk.Connect.Username), Clave: string(pk.Connect.Password)}
+	if cred.Usuario == "" && cred.Clave != "" {
+		cred = Credenciales{Token: cred.Clave}
+	}
+
+	usuario, err := h.servidor.autenticar(cred, identidadConexionTLS(cl.Net.Conn))
+	if err != nil {
+		loggerPrint(LOG_MQTT, "Conexión rechazada - Cliente: %s, Razón: %v", cl.ID, err)
+		return false
+	}
+	// El testamento se publica en nombre del cliente: requiere permiso de publicación
+	if pk.Connect.WillFlag && !h.servidor.autorizar(usuario, AccionPublicar, pk.Connect.WillTopic) {
+		loggerPrint(LOG_MQTT, "Conexión rechazada - Cliente: %s, Testamento no autorizado: %s", cl.ID, pk.Connect.WillTopic)
+		return false
+	}
+	h.usuarios.Store(cl, usuario)
+	return true
+}
+
+func (h *hookAuthMQTT) OnACLCheck(cl *mochi.Client, topico string, escritura bool) bool {
+	if cl.Net.Inline {
+		return true
+	}
+	valor, ok := h.usuarios.Load(cl)
+	if !ok {
+		return false
+	}
+	usuario := valor.(string)
+
+	accion := AccionSuscribir
+	if escritura {
+		accion = AccionPublicar
+	}
+	if !h.servidor.autorizar(usuario, accion, topico) {
+		loggerPrint(LOG_MQTT, "Operación rechazada - Usuario: %s, Acción: %s, Tópico: %s", usuario, accion, topico)
+		return false
+	}
+	return true
+}
+
+// usuario retorna la identidad autenticada del cliente ("" si no la tiene)
+func (h *hookAuthMQTT) usuario(cl *mochi.Client) string {
+	valor, _ := h.usuarios.Load(cl)
+	usuario, _ := valor.(string)
+	return usuario
+}
+
+func (h *hookAuthMQTT) OnDisconnect(cl *mochi.Client, err error, expire bool) {
+	h.usuarios.Delete(cl)
+}
+
+// iniciarMQTT arranca el broker MQTT embebido en el puerto indicado.
 // A diferencia de la implementación anterior (cliente paho contra un broker
 // externo), ahora el middleware es el broker: los dispositivos MQTT se conectan
 // directamente a este proceso.
-func IniciarMQTT(puerto string) {
-	brokerMQTT = mochi.New(&mochi.Options{
+func (s *Servidor) iniciarMQTT(puerto string) error {
+	// Las sesiones MQTT con clean-session=false expiran igual que las de HTTP y CoAP
+	capacidades := mochi.NewDefaultServerCapabilities()
+	capacidades.MaximumSessionExpiryInterval = uint32(s.sesiones.ttl / time.Second)
+	// Un PUBLISH que no puede contener un payload dentro del límite se descarta sin decodificarlo
+	capacidades.MaximumPacketSize = uint32(tamanoCuerpoJSON(s.limites.MQTT))
+	broker := mochi.New(&mochi.Options{
 		InlineClient: true, // habilita server.Publish/Subscribe para egress in-process.
+		Capabilities: capacidades,
 	})
 
-	// Por defecto mochi rechaza todas las conexiones; permitir todas.
-	if err := brokerMQTT.AddHook(new(auth.AllowHook), nil); err != nil {
-		loggerFatal(LOG_MQTT, "Error - No se pudo agregar hook de auth: %v", err)
+	// Por defecto mochi rechaza todas las conexiones; el hook de auth delega en el
+	// Autorizador del servidor (sin Autorizador permite todas).
+	auth := &hookAuthMQTT{servidor: s}
+	if err := broker.AddHook(auth, nil); err != nil {
+		return fmt.Errorf("no se pudo agregar hook de auth: %w", err)
 	}
 
 	// Hook de SensorWave: fanout a HTTP/CoAP/upstream + control de PUBACK.
-	if err := brokerMQTT.AddHook(new(hookMQTT), hookMQTTOptions{}); err != nil {
-		loggerFatal(LOG_MQTT, "Error - No se pudo agregar hook de publish: %v", err)
+	if err := broker.AddHook(&hookMQTT{servidor: s, auth: auth}, hookMQTTOptions{}); err != nil {
+		return fmt.Errorf("no se pudo agregar hook de publish: %w", err)
 	}
 
 	tcp := listeners.NewTCP(listeners.Config{
-		ID:      "sensorwave-tcp",
-		Address: ":" + puerto,
+		ID:        "sensorwave-tcp",
+		Address:   ":" + puerto,
+		TLSConfig: s.opts.TLS,
 	})
-	if err := brokerMQTT.AddListener(tcp); err != nil {
-		loggerFatal(LOG_MQTT, "Error - No se pudo agregar listener TCP: %v", err)
+	if err := broker.AddListener(tcp); err != nil {
+		return fmt.Errorf("no se pudo agregar listener TCP: %w", err)
+	}
+	var ws *listenerWebSocket
+	if s.opts.PuertoMQTTWebSocket != "" {
+		ws = &listenerWebSocket{id: "sensorwave-ws", direccion: ":" + s.opts.PuertoMQTTWebSocket, tls: s.opts.TLS}
+		if err := broker.AddListener(ws); err != nil {
+			broker.Close()
+			return fmt.Errorf("no se pudo agregar listener WebSocket: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	if s.cerrado || s.brokerMQTT != nil {
+		s.mu.Unlock()
+		broker.Close()
+		return fmt.Errorf("broker MQTT cerrado o ya iniciado")
+	}
+	s.brokerMQTT = broker
+	s.direccionMQTT = tcp.Address()
+	if ws != nil {
+		s.direccionMQTTWS = ws.Address()
+	}
+	s.mu.Unlock()
+
+	// Los retenidos cargados del archivo quedan disponibles para los suscriptores MQTT
+	for _, m := range s.retenidos.coincidentes("#") {
+		retenerEnBroker(broker, m)
+	}
+
+	// Serve inicia los listeners en segundo plano y retorna
+	if err := broker.Serve(); err != nil {
+		return fmt.Errorf("no se pudo iniciar el broker: %w", err)
 	}
 
 	loggerPrint(LOG_MQTT, "Servidor iniciado - Broker embebido en puerto: %s", puerto)
+	if ws != nil {
+		loggerPrint(LOG_MQTT, "Listener WebSocket iniciado - Puerto: %s", s.opts.PuertoMQTTWebSocket)
+	}
+	return nil
+}
+
+// actualizadorMQTTWS acepta conexiones de cualquier origen: la autenticación es la del
+// CONNECT MQTT, igual que en el listener TCP
+var actualizadorMQTTWS = websocket.Upgrader{
+	Subprotocols: []string{"mqtt"},
+	CheckOrigin:  func(*http.Request) bool { return true },
+}
+
+// listenerWebSocket es un listener del broker que sirve MQTT sobre WebSocket. Reemplaza
+// a listeners.Websocket de mochi, que no informa la dirección real cuando el puerto es
+// "0" ni expone el estado TLS de la conexión para identificar al cliente.
+type listenerWebSocket struct {
+	id        string
+	direccion string
+	tls       *tls.Config
+
+	listener   net.Listener
+	servidor   *http.Server
+	establecer listeners.EstablishFn
+}
+
+func (l *listenerWebSocket) ID() string { return l.id }
+
+func (l *listenerWebSocket) Address() string {
+	if l.listener != nil {
+		return l.listener.Addr().String()
+	}
+	return l.direccion
+}
+
+func (l *listenerWebSocket) Protocol() string {
+	if l.tls != nil {
+		return "wss"
+	}
+	return "ws"
+}
 
-	go func() {
-		if err := brokerMQTT.Serve(); err != nil {
-			loggerFatal(LOG_MQTT, "Error - No se pudo iniciar el broker: %v", err)
+// Init abre el puerto al agregar el listener, como el listener TCP de mochi
+func (l *listenerWebSocket) Init(*slog.Logger) error {
+	listener, err := net.Listen("tcp", l.direccion)
+	if err != nil {
+		return err
+	}
+	if l.tls != nil {
+		listener = tls.NewListener(listener, l.tls)
+	}
+	l.listener = listener
+	l.servidor = &http.Server{Handler: http.HandlerFunc(l.manejar), ReadHeaderTimeout: 10 * time.Second}
+	return nil
+}
+
+func (l *listenerWebSocket) Serve(establecer listeners.EstablishFn) {
+	l.establecer = establecer
+	if err := l.servidor.Serve(l.listener); err != nil && err != http.ErrServerClosed {
+		loggerPrint(LOG_MQTT, "Error - El listener WebSocket terminó: %v", err)
+	}
+}
+
+// Close deja de aceptar conexiones y cierra las de los clientes del listener
+func (l *listenerWebSocket) Close(cerrarClientes listeners.CloseFn) {
+	ctx, cancelar := context.WithTimeout(context.Background(), tiempoCierreHTTP)
+	defer cancelar()
+	_ = l.servidor.Shutdown(ctx)
+	_ = l.listener.Close() // por si Serve nunca se invocó
+	cerrarClientes(l.id)
+}
+
+func (l *listenerWebSocket) manejar(w http.ResponseWriter, r *http.Request) {
+	conn, err := actualizadorMQTTWS.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if err := l.establecer(l.id, &conexionMQTTWS{Conn: conn.NetConn(), ws: conn}); err != nil {
+		loggerPrint(LOG_MQTT, "Conexión WebSocket terminada - Dirección: %s, Razón: %v", r.RemoteAddr, err)
+	}
+}
+
+// conexionMQTTWS presenta una conexión WebSocket como el flujo de bytes que espera el
+// broker: cada mensaje binario lleva uno o más paquetes MQTT (o parte de uno)
+type conexionMQTTWS struct {
+	net.Conn
+	ws     *websocket.Conn
+	lector io.Reader // mensaje en curso (nil = leer el siguiente)
+}
+
+func (c *conexionMQTTWS) Read(p []byte) (int, error) {
+	for {
+		if c.lector == nil {
+			tipo, lector, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if tipo != websocket.BinaryMessage {
+				return 0, fmt.Errorf("mensaje WebSocket no binario")
+			}
+			c.lector = lector
+		}
+		n, err := c.lector.Read(p)
+		if err == io.EOF {
+			c.lector = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
 		}
-	}()
-}
\ No newline at end of file
+		return n, err
+	}
+}
+
+func (c *conexionMQTTWS) Write(p []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ConnectionState expone el estado TLS de la conexión subyacente (ver identidadConexionTLS)
+func (c *conexionMQTTWS) ConnectionState() tls.ConnectionState {
+	if conn, ok := c.Conn.(*tls.Conn); ok {
+		return conn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// obtenerBrokerMQTT retorna el broker embebido (nil si MQTT no fue iniciado)
+func (s *Servidor) obtenerBrokerMQTT() *mochi.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.brokerMQTT
+}
@@ -0,0 +1,175 @@
+package servidor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func iniciarServidorTest(t *testing.T, opts Opciones) *Servidor {
+	t.Helper()
+	s, err := Crear(opts)
+	if err != nil {
+		t.Fatalf("Crear() error = %v", err)
+	}
+	if err := s.Iniciar(context.Background()); err != nil {
+		t.Fatalf("Iniciar() error = %v", err)
+	}
+	t.Cleanup(func() { s.Cerrar() })
+	return s
+}
+
+// suscribirSSE abre un stream SSE y retorna las líneas "data:" recibidas por un canal,
+// que se cierra cuando el servidor termina el stream
+func suscribirSSE(t *testing.T, s *Servidor, topico string) <-chan string {
+	t.Helper()
+	resp, err := http.Get("http://" + s.direccionHTTP + "/sensorwave?topico=" + url.QueryEscape(topico))
+	if err != nil {
+		t.Fatalf("error suscribiendo: %v", err)
+	}
+
+	lineas := make(chan string, 10)
+	go func() {
+		defer close(lineas)
+		defer resp.Body.Close()
+		lector := bufio.NewScanner(resp.Body)
+		for lector.Scan() {
+			if dato, ok := strings.CutPrefix(lector.Text(), "data: "); ok {
+				lineas <- dato
+			}
+		}
+	}()
+
+	// El primer evento (clienteID) confirma que la suscripción está registrada
+	select {
+	case <-lineas:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no se recibió el clienteID")
+	}
+	return lineas
+}
+
+func publicarHTTP(t *testing.T, s *Servidor, topico, payload string) {
+	t.Helper()
+	cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: topico, Payload: []byte(payload)})
+	resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico="+topico, "application/json", bytes.NewReader(cuerpo))
+	if err != nil {
+		t.Fatalf("error publicando: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("publicación rechazada: %d", resp.StatusCode)
+	}
+}
+
+func TestCrear_SinPuertos(t *testing.T) {
+	if _, err := Crear(Opciones{}); err == nil {
+		t.Fatal("Crear() sin puertos debería fallar")
+	}
+}
+
+// TestServidor_InstanciasAisladas verifica que dos servidores en el mismo proceso
+// no comparten suscriptores
+func TestServidor_InstanciasAisladas(t *testing.T) {
+	s1 := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	s2 := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	if s1.ID() == s2.ID() {
+		t.Fatal("las instancias deberían tener IDs distintos")
+	}
+
+	lineas := suscribirSSE(t, s1, "sensores/temp")
+
+	publicarHTTP(t, s2, "sensores/temp", "otro")
+	publicarHTTP(t, s1, "sensores/temp", "propio")
+
+	select {
+	case dato := <-lineas:
+		var m Mensaje
+		if err := json.Unmarshal([]byte(dato), &m); err != nil {
+			t.Fatalf("mensaje inválido: %v", err)
+		}
+		if string(m.Payload) != "propio" || m.Origen != s1.ID() {
+			t.Errorf("mensaje inesperado: payload=%s origen=%s", m.Payload, m.Origen)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no se recibió la publicación")
+	}
+}
+
+// TestServidor_CerrarTerminaStreams verifica que Cerrar finaliza los streams SSE
+// y que el servidor no puede reiniciarse
+func TestServidor_CerrarTerminaStreams(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0", PuertoMQTT: "0"})
+	if err := s.Iniciar(context.Background()); err == nil {
+		t.Error("un segundo Iniciar() debería fallar")
+	}
+
+	lineas := suscribirSSE(t, s, "sensores/#")
+
+	cerrado := make(chan error, 1)
+	go func() { cerrado <- s.Cerrar() }()
+	select {
+	case err := <-cerrado:
+		if err != nil {
+			t.Errorf("Cerrar() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cerrar() no terminó")
+	}
+
+	select {
+	case _, abierto := <-lineas:
+		if abierto {
+			t.Error("no se esperaban más mensajes tras Cerrar()")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("el stream SSE sigue abierto tras Cerrar()")
+	}
+
+	if err := s.Cerrar(); err != nil {
+		t.Errorf("Cerrar() debería ser idempotente, error = %v", err)
+	}
+	if err := s.Iniciar(context.Background()); err == nil {
+		t.Error("Iniciar() tras Cerrar() debería fallar")
+	}
+}
+
+func TestServidor_CerrarAlCancelarContexto(t *testing.T) {
+	s, err := Crear(Opciones{PuertoHTTP: "0"})
+	if err != nil {
+		t.Fatalf("Crear() error = %v", err)
+	}
+	ctx, cancelar := context.WithCancel(context.Background())
+	if err := s.Iniciar(ctx); err != nil {
+		t.Fatalf("Iniciar() error = %v", err)
+	}
+
+	cancelar()
+	limite := time.Now().Add(2 * time.Second)
+	for !s.estaCerrado() {
+		if time.Now().After(limite) {
+			t.Fatal("el servidor no se cerró al cancelar el contexto")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServidor_PuertoOcupado(t *testing.T) {
+	s1 := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	puerto := s1.direccionHTTP[strings.LastIndex(s1.direccionHTTP, ":")+1:]
+
+	s2, err := Crear(Opciones{PuertoHTTP: puerto})
+	if err != nil {
+		t.Fatalf("Crear() error = %v", err)
+	}
+	if err := s2.Iniciar(context.Background()); err == nil {
+		s2.Cerrar()
+		t.Fatal("Iniciar() en un puerto ocupado debería retornar error")
+	}
+}
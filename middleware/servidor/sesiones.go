@@ -0,0 +1,312 @@
+package servidor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/mensaje"
+)
+
+const LOG_SESIONES = "SESIONES"
+
+// Sesiones persistentes de suscriptores HTTP y CoAP, equivalentes a clean-session=false
+// de MQTT (en MQTT las maneja el broker).
+//
+// El cliente elige el ID de sesión y lo envía en cada suscripción. Cada par (sesión,
+// patrón) conserva su suscripción cuando el stream SSE o la observación se caen: los
+// mensajes que coinciden se encolan, con límite y descartando los más antiguos, y se
+// entregan en orden al reconectar. Una sesión desconectada expira tras
+// Opciones.ExpiracionSesion; desuscribirse la termina.
+
+const (
+	paramSesion          = mensaje.ParamSesion
+	paramConservarSesion = mensaje.ParamConservarSesion
+
+	protocoloHTTP = "http"
+	protocoloCoAP = "coap"
+
+	expiracionSesionDefecto = time.Hour
+	limiteColaSesionDefecto = 1000
+)
+
+// sesion es el estado de una suscripción persistente. Los campos exportados se
+// persisten en el directorio de sesiones.
+type sesion struct {
+	ID          string    `json:"id"`
+	Protocolo   string    `json:"protocolo"`
+	Patron      string    `json:"patron"`
+	Usuario     string    `json:"usuario"`
+	Cola        []Mensaje `json:"cola,omitempty"`
+	Descartados int       `json:"descartados,omitempty"` // mensajes perdidos por exceder el límite
+	Desconexion time.Time `json:"desconexion"`           // cero mientras está conectada
+
+	conectada  bool
+	generacion uint64      // cambia en cada conexión para ignorar cierres de conexiones desplazadas
+	desplazar  func()      // cierra la conexión vigente cuando otra toma la sesión
+	expiracion *time.Timer // descarte programado mientras está desconectada
+}
+
+// conexionSesion identifica la conexión vigente de una sesión
+type conexionSesion struct {
+	clave      string
+	generacion uint64
+	reanudada  bool // la sesión ya existía (no es una suscripción nueva)
+}
+
+// registroSesiones indexa las sesiones por protocolo, ID y patrón
+type registroSesiones struct {
+	mu         sync.Mutex
+	directorio string
+	limite     int
+	ttl        time.Duration
+	porClave   map[string]*sesion
+	generacion uint64
+	detenido   bool
+}
+
+func nuevoRegistroSesiones(opts Opciones) *registroSesiones {
+	r := &registroSesiones{
+		directorio: opts.DirectorioSesiones,
+		limite:     opts.LimiteColaSesion,
+		ttl:        opts.ExpiracionSesion,
+		porClave:   make(map[string]*sesion),
+	}
+	if r.limite <= 0 {
+		r.limite = limiteColaSesionDefecto
+	}
+	if r.ttl <= 0 {
+		r.ttl = expiracionSesionDefecto
+	}
+	return r
+}
+
+func claveSesion(protocolo, id, patron string) string {
+	return protocolo + "\x00" + id + "\x00" + patron
+}
+
+// cargar lee las sesiones persistidas. Todas quedan desconectadas; las que superaron
+// la expiración se descartan. Un directorio inexistente equivale a no tener sesiones.
+func (r *registroSesiones) cargar() error {
+	if r.directorio == "" {
+		return nil
+	}
+	entradas, err := os.ReadDir(r.directorio)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error leyendo sesiones: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entrada := range entradas {
+		if entrada.IsDir() || !strings.HasSuffix(entrada.Name(), ".json") {
+			continue
+		}
+		datos, err := os.ReadFile(filepath.Join(r.directorio, entrada.Name()))
+		if err != nil {
+			return fmt.Errorf("error leyendo sesión %s: %w", entrada.Name(), err)
+		}
+		var se sesion
+		if err := json.Unmarshal(datos, &se); err != nil {
+			return fmt.Errorf("error parseando sesión %s: %w", entrada.Name(), err)
+		}
+		// Una sesión conectada al detenerse el proceso se considera caída al cargar
+		if se.Desconexion.IsZero() {
+			se.Desconexion = time.Now()
+		}
+		clave := claveSesion(se.Protocolo, se.ID, se.Patron)
+		r.porClave[clave] = &se
+		r.programarExpiracion(clave, &se, time.Until(se.Desconexion.Add(r.ttl)))
+	}
+	return nil
+}
+
+// conectar asocia una nueva conexión a la sesión (creándola si no existe) y retorna
+// los mensajes encolados mientras estuvo desconectada. Si la sesión tenía otra
+// conexión activa, la desplaza invocando su función desplazar.
+func (r *registroSesiones) conectar(protocolo, id, patron, usuario string, desplazar func()) (conexionSesion, []Mensaje, error) {
+	clave := claveSesion(protocolo, id, patron)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	se, existe := r.porClave[clave]
+	if existe && se.Usuario != usuario {
+		return conexionSesion{}, nil, errNoAutorizado
+	}
+	if !existe {
+		se = &sesion{ID: id, Protocolo: protocolo, Patron: patron, Usuario: usuario}
+		r.porClave[clave] = se
+	}
+	if se.conectada && se.desplazar != nil {
+		loggerPrint(LOG_SESIONES, "Sesión tomada por una nueva conexión - ID: %s, Tópico: %s", id, patron)
+		se.desplazar()
+	}
+	if se.expiracion != nil {
+		se.expiracion.Stop()
+		se.expiracion = nil
+	}
+	if se.Descartados > 0 {
+		loggerPrint(LOG_SESIONES, "Sesión reanudada con mensajes descartados - ID: %s, Tópico: %s, Descartados: %d", id, patron, se.Descartados)
+	}
+
+	r.generacion++
+	// Los mensajes que vencieron mientras la sesión estaba desconectada no se entregan
+	cola := slices.DeleteFunc(se.Cola, Mensaje.Expirado)
+	se.Cola, se.Descartados, se.Desconexion = nil, 0, time.Time{}
+	se.conectada, se.generacion, se.desplazar = true, r.generacion, desplazar
+	r.persistir(clave, se)
+	return conexionSesion{clave: clave, generacion: se.generacion, reanudada: existe}, cola, nil
+}
+
+// desconectar marca la sesión como caída y empieza a encolar sus mensajes. pendientes
+// (puede ser nil) retorna los mensajes que la conexión no llegó a entregar, que se
+// reenvían primero al reconectar. Se ignora si la conexión ya fue desplazada por otra.
+func (r *registroSesiones) desconectar(c conexionSesion, pendientes func() []Mensaje) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	se := r.porClave[c.clave]
+	if se == nil || !se.conectada || se.generacion != c.generacion {
+		return
+	}
+	se.conectada, se.desplazar = false, nil
+	se.Desconexion = time.Now()
+	if pendientes != nil {
+		se.Cola = append(pendientes(), se.Cola...)
+	}
+	r.recortar(se)
+	r.persistir(c.clave, se)
+	if !r.detenido {
+		r.programarExpiracion(c.clave, se, r.ttl)
+	}
+	loggerPrint(LOG_SESIONES, "Sesión desconectada - ID: %s, Tópico: %s, Pendientes: %d", se.ID, se.Patron, len(se.Cola))
+}
+
+// terminar elimina la sesión tras una desuscripción explícita de la conexión c
+func (r *registroSesiones) terminar(c conexionSesion) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if se := r.porClave[c.clave]; se != nil && se.generacion == c.generacion {
+		r.eliminar(c.clave, se)
+		loggerPrint(LOG_SESIONES, "Sesión terminada - ID: %s, Tópico: %s", se.ID, se.Patron)
+	}
+}
+
+// terminarDesconectada elimina una sesión desconectada de usuario. Permite
+// desuscribirse después de que el stream ya se cayó. Retorna false si no existía.
+func (r *registroSesiones) terminarDesconectada(protocolo, id, patron, usuario string) bool {
+	clave := claveSesion(protocolo, id, patron)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	se := r.porClave[clave]
+	if se == nil || se.conectada || se.Usuario != usuario {
+		return false
+	}
+	r.eliminar(clave, se)
+	loggerPrint(LOG_SESIONES, "Sesión terminada - ID: %s, Tópico: %s", se.ID, se.Patron)
+	return true
+}
+
+// encolar guarda el mensaje en las sesiones desconectadas del protocolo cuyo patrón
+// coincide con el tópico. El llamador serializa encolar y conectar con el mutex del
+// protocolo, de modo que un mensaje no se pierda ni se duplique al reconectar.
+func (r *registroSesiones) encolar(protocolo, topico string, m Mensaje) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for clave, se := range r.porClave {
+		if se.conectada || se.Protocolo != protocolo || !coincidePatron(topico, se.Patron) || m.Expirado() {
+			continue
+		}
+		se.Cola = append(se.Cola, m)
+		r.recortar(se)
+		r.persistir(clave, se)
+	}
+}
+
+// detener cancela las expiraciones programadas al cerrar el servidor. Las sesiones
+// persistidas en disco se retoman en el próximo inicio.
+func (r *registroSesiones) detener() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.detenido = true
+	for _, se := range r.porClave {
+		if se.expiracion != nil {
+			se.expiracion.Stop()
+			se.expiracion = nil
+		}
+	}
+}
+
+// recortar descarta los mensajes más antiguos que exceden el límite. Requiere r.mu tomado.
+func (r *registroSesiones) recortar(se *sesion) {
+	if exceso := len(se.Cola) - r.limite; exceso > 0 {
+		se.Cola = append([]Mensaje(nil), se.Cola[exceso:]...)
+		se.Descartados += exceso
+	}
+}
+
+// programarExpiracion descarta la sesión tras espera si sigue desconectada. Requiere r.mu tomado.
+func (r *registroSesiones) programarExpiracion(clave string, se *sesion, espera time.Duration) {
+	if espera <= 0 {
+		r.eliminar(clave, se)
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(espera, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.porClave[clave] != se || se.conectada || se.expiracion != timer {
+			return
+		}
+		r.eliminar(clave, se)
+		loggerPrint(LOG_SESIONES, "Sesión expirada - ID: %s, Tópico: %s, Mensajes descartados: %d", se.ID, se.Patron, len(se.Cola))
+	})
+	se.expiracion = timer
+}
+
+// eliminar quita la sesión del índice y del disco. Requiere r.mu tomado.
+func (r *registroSesiones) eliminar(clave string, se *sesion) {
+	if se.expiracion != nil {
+		se.expiracion.Stop()
+	}
+	delete(r.porClave, clave)
+	if r.directorio != "" {
+		if err := os.Remove(r.archivo(clave)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			loggerPrint(LOG_SESIONES, "Error - No se pudo borrar la sesión %s: %v", se.ID, err)
+		}
+	}
+}
+
+// persistir escribe la sesión en su archivo si hay directorio configurado. Requiere r.mu tomado.
+func (r *registroSesiones) persistir(clave string, se *sesion) {
+	if r.directorio == "" {
+		return
+	}
+	datos, err := json.Marshal(se)
+	if err == nil {
+		err = os.MkdirAll(r.directorio, 0o755)
+	}
+	if err == nil {
+		err = escribirArchivoAtomico(r.archivo(clave), datos)
+	}
+	if err != nil {
+		loggerPrint(LOG_SESIONES, "Error - No se pudo persistir la sesión %s: %v", se.ID, err)
+	}
+}
+
+// archivo retorna la ruta del archivo de una sesión; el nombre deriva de la clave
+// porque el ID y el patrón pueden contener caracteres no válidos en rutas
+func (r *registroSesiones) archivo(clave string) string {
+	suma := sha256.Sum256([]byte(clave))
+	return filepath.Join(r.directorio, hex.EncodeToString(suma[:16])+".json")
+}
@@ -0,0 +1,262 @@
+package servidor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	clientecoap "github.com/sensorwave-dev/sensorwave/middleware/cliente_coap"
+	clientehttp "github.com/sensorwave-dev/sensorwave/middleware/cliente_http"
+)
+
+func mensajesSesion(payloads ...string) []Mensaje {
+	var mensajes []Mensaje
+	for _, p := range payloads {
+		mensajes = append(mensajes, Mensaje{Topico: "planta/sala/temp", Payload: []byte(p)})
+	}
+	return mensajes
+}
+
+func payloads(mensajes []Mensaje) string {
+	var partes []string
+	for _, m := range mensajes {
+		partes = append(partes, string(m.Payload))
+	}
+	return strings.Join(partes, ",")
+}
+
+// esperarSesionDesconectada espera a que el servidor detecte la caída de la sesión
+func esperarSesionDesconectada(t *testing.T, s *Servidor, protocolo, id, patron string) {
+	t.Helper()
+	limite := time.Now().Add(2 * time.Second)
+	for time.Now().Before(limite) {
+		s.sesiones.mu.Lock()
+		se := s.sesiones.porClave[claveSesion(protocolo, id, patron)]
+		desconectada := se != nil && !se.conectada
+		s.sesiones.mu.Unlock()
+		if desconectada {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("la sesión %s no quedó desconectada", id)
+}
+
+func existeSesion(s *Servidor, protocolo, id, patron string) bool {
+	s.sesiones.mu.Lock()
+	defer s.sesiones.mu.Unlock()
+	return s.sesiones.porClave[claveSesion(protocolo, id, patron)] != nil
+}
+
+func TestRegistroSesiones(t *testing.T) {
+	r := nuevoRegistroSesiones(Opciones{LimiteColaSesion: 2, DirectorioSesiones: t.TempDir()})
+
+	c, cola, err := r.conectar(protocoloHTTP, "disp1", "planta/+/temp", "sensor1", nil)
+	if err != nil || c.reanudada || len(cola) != 0 {
+		t.Fatalf("conectar() nueva = %+v, %v, %v", c, cola, err)
+	}
+	r.encolar(protocoloHTTP, "planta/sala/temp", mensajesSesion("conectada")[0])
+
+	r.desconectar(c, func() []Mensaje { return mensajesSesion("sin-ack") })
+	for _, m := range mensajesSesion("1", "2") {
+		r.encolar(protocoloHTTP, m.Topico, m)
+	}
+	r.encolar(protocoloCoAP, "planta/sala/temp", mensajesSesion("coap")[0])
+	r.encolar(protocoloHTTP, "planta/sala/hum", mensajesSesion("otro")[0])
+
+	if _, _, err := r.conectar(protocoloHTTP, "disp1", "planta/+/temp", "intruso", nil); !errors.Is(err, errNoAutorizado) {
+		t.Errorf("otro usuario no debería poder tomar la sesión: %v", err)
+	}
+
+	// El límite descarta los más antiguos; la sesión persiste en disco
+	recargado := nuevoRegistroSesiones(Opciones{DirectorioSesiones: r.directorio})
+	if err := recargado.cargar(); err != nil {
+		t.Fatalf("cargar() error = %v", err)
+	}
+	c, cola, err = recargado.conectar(protocoloHTTP, "disp1", "planta/+/temp", "sensor1", nil)
+	if err != nil || !c.reanudada {
+		t.Fatalf("la sesión debería reanudarse tras recargar: %+v, %v", c, err)
+	}
+	if payloads(cola) != "1,2" {
+		t.Errorf("cola = %q, esperaba \"1,2\"", payloads(cola))
+	}
+
+	recargado.terminar(c)
+	if _, _, err := recargado.conectar(protocoloHTTP, "disp1", "planta/+/temp", "otro", nil); err != nil {
+		t.Errorf("una sesión terminada debería poder crearse de nuevo: %v", err)
+	}
+}
+
+func TestRegistroSesiones_Expiracion(t *testing.T) {
+	r := nuevoRegistroSesiones(Opciones{ExpiracionSesion: 50 * time.Millisecond})
+	c, _, _ := r.conectar(protocoloCoAP, "disp1", "planta/#", "", nil)
+	r.desconectar(c, nil)
+	r.encolar(protocoloCoAP, "planta/sala/temp", mensajesSesion("1")[0])
+
+	time.Sleep(150 * time.Millisecond)
+	c, cola, _ := r.conectar(protocoloCoAP, "disp1", "planta/#", "", nil)
+	if c.reanudada || len(cola) != 0 {
+		t.Errorf("la sesión debería haber expirado: %+v, cola %d", c, len(cola))
+	}
+}
+
+// TestSesionHTTP_CaidaDelStream verifica que los mensajes publicados mientras el
+// stream SSE estaba caído se entregan en orden al reconectar con la misma sesión
+func TestSesionHTTP_CaidaDelStream(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+
+	conectar := func() (<-chan string, context.CancelFunc) {
+		ctx, cancelar := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+s.direccionHTTP+"/sensorwave?topico="+url.QueryEscape("planta/+/temp")+"&sesion=disp1", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error suscribiendo: %v", err)
+		}
+		lineas := make(chan string, 10)
+		go func() {
+			defer close(lineas)
+			defer resp.Body.Close()
+			lector := bufio.NewScanner(resp.Body)
+			for lector.Scan() {
+				if dato, ok := strings.CutPrefix(lector.Text(), "data: "); ok {
+					lineas <- dato
+				}
+			}
+		}()
+		<-lineas // clienteID
+		return lineas, cancelar
+	}
+
+	_, cortar := conectar()
+	cortar()
+	esperarSesionDesconectada(t, s, protocoloHTTP, "disp1", "planta/+/temp")
+	publicarHTTP(t, s, "planta/sala/temp", "1")
+	publicarHTTP(t, s, "planta/cocina/temp", "2")
+
+	lineas, cortar := conectar()
+	defer cortar()
+	for _, esperado := range []string{"1", "2"} {
+		select {
+		case dato := <-lineas:
+			var m Mensaje
+			json.Unmarshal([]byte(dato), &m)
+			if string(m.Payload) != esperado {
+				t.Errorf("payload = %q, esperaba %q", m.Payload, esperado)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no se recibió el mensaje encolado %q", esperado)
+		}
+	}
+}
+
+// TestSesionHTTP_Cliente verifica que Desconectar conserva la sesión y Desuscribir la termina
+func TestSesionHTTP_Cliente(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	_, puerto, _ := net.SplitHostPort(s.direccionHTTP)
+
+	c1, _ := clientehttp.Conectar("localhost", puerto, middleware.ConSesion("disp1"))
+	if err := c1.Suscribir("planta/+/temp", func(string, []byte) {}); err != nil {
+		t.Fatalf("Suscribir() error = %v", err)
+	}
+	c1.Desconectar()
+	esperarSesionDesconectada(t, s, protocoloHTTP, "disp1", "planta/+/temp")
+	publicarHTTP(t, s, "planta/sala/temp", "mientras-desconectado")
+
+	recibidos := make(chan string, 1)
+	c2, _ := clientehttp.Conectar("localhost", puerto, middleware.ConSesion("disp1"))
+	if err := c2.Suscribir("planta/+/temp", func(_ string, payload []byte) { recibidos <- string(payload) }); err != nil {
+		t.Fatalf("Suscribir() error = %v", err)
+	}
+	esperarPayload(t, recibidos, "mientras-desconectado")
+
+	if err := c2.Desuscribir("planta/+/temp"); err != nil {
+		t.Fatalf("Desuscribir() error = %v", err)
+	}
+	limite := time.Now().Add(2 * time.Second)
+	for existeSesion(s, protocoloHTTP, "disp1", "planta/+/temp") {
+		if time.Now().After(limite) {
+			t.Fatal("Desuscribir debería terminar la sesión")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSesionCoAP_Cliente(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0"})
+	_, puerto, _ := net.SplitHostPort(s.direccionCoAP)
+
+	c1, err := clientecoap.Conectar("127.0.0.1", puerto, middleware.ConSesion("disp1"))
+	if err != nil {
+		t.Fatalf("Conectar() error = %v", err)
+	}
+	if err := c1.Suscribir("planta/+/temp", func(string, []byte) {}); err != nil {
+		t.Fatalf("Suscribir() error = %v", err)
+	}
+	c1.Desconectar()
+	esperarSesionDesconectada(t, s, protocoloCoAP, "disp1", "planta/+/temp")
+	publicarHTTP(t, s, "planta/sala/temp", "1")
+	publicarHTTP(t, s, "planta/sala/temp", "2")
+
+	recibidos := make(chan string, 2)
+	c2, err := clientecoap.Conectar("127.0.0.1", puerto, middleware.ConSesion("disp1"))
+	if err != nil {
+		t.Fatalf("Conectar() error = %v", err)
+	}
+	if err := c2.Suscribir("planta/+/temp", func(_ string, payload []byte) { recibidos <- string(payload) }); err != nil {
+		t.Fatalf("Suscribir() error = %v", err)
+	}
+	esperarPayload(t, recibidos, "1")
+	esperarPayload(t, recibidos, "2")
+
+	if err := c2.Desuscribir("planta/+/temp"); err != nil {
+		t.Fatalf("Desuscribir() error = %v", err)
+	}
+	if existeSesion(s, protocoloCoAP, "disp1", "planta/+/temp") {
+		t.Error("Desuscribir debería terminar la sesión")
+	}
+	c2.Desconectar()
+}
+
+func TestSesiones_PersistenciaEntreReinicios(t *testing.T) {
+	dir := t.TempDir()
+	s1 := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", DirectorioSesiones: dir})
+	_, puerto, _ := net.SplitHostPort(s1.direccionHTTP)
+	c, _ := clientehttp.Conectar("localhost", puerto, middleware.ConSesion("disp1"))
+	if err := c.Suscribir("alarmas", func(string, []byte) {}); err != nil {
+		t.Fatalf("Suscribir() error = %v", err)
+	}
+	c.Desconectar()
+	esperarSesionDesconectada(t, s1, protocoloHTTP, "disp1", "alarmas")
+	publicarHTTP(t, s1, "alarmas", "incendio")
+	s1.Cerrar()
+
+	s2 := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", DirectorioSesiones: dir})
+	req, _ := http.NewRequest(http.MethodGet, "http://"+s2.direccionHTTP+"/sensorwave?topico=alarmas&sesion=disp1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error suscribiendo: %v", err)
+	}
+	defer resp.Body.Close()
+	lector := bufio.NewScanner(resp.Body)
+	var datos []string
+	for len(datos) < 2 && lector.Scan() {
+		if dato, ok := strings.CutPrefix(lector.Text(), "data: "); ok {
+			datos = append(datos, dato)
+		}
+	}
+	var m Mensaje
+	if len(datos) == 2 {
+		json.Unmarshal([]byte(datos[1]), &m)
+	}
+	if string(m.Payload) != "incendio" {
+		t.Errorf("mensaje encolado tras reiniciar = %q, esperaba \"incendio\"", m.Payload)
+	}
+}
@@ -0,0 +1,100 @@
+package servidor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	clientecoap "github.com/sensorwave-dev/sensorwave/middleware/cliente_coap"
+	clientehttp "github.com/sensorwave-dev/sensorwave/middleware/cliente_http"
+	clientemqtt "github.com/sensorwave-dev/sensorwave/middleware/cliente_mqtt"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/errores"
+)
+
+// TestSolicitudes_EntreProtocolos: un cliente HTTP invoca a un dispositivo CoAP y un
+// cliente MQTT a un respondedor HTTP; las respuestas cruzan protocolos por el fanout
+func TestSolicitudes_EntreProtocolos(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoCoAP: "0", PuertoMQTT: "0"})
+	hostHTTP, puertoHTTP, _ := net.SplitHostPort(s.direccionHTTP)
+	_, puertoCoAP, _ := net.SplitHostPort(s.direccionCoAP)
+	_, puertoMQTT, _ := net.SplitHostPort(s.direccionMQTT)
+
+	dispositivo, err := clientecoap.Conectar("127.0.0.1", puertoCoAP)
+	if err != nil {
+		t.Fatalf("Conectar CoAP: %v", err)
+	}
+	t.Cleanup(dispositivo.Desconectar)
+	err = dispositivo.Responder("dispositivos/plc1/leer", func(_ string, payload []byte) ([]byte, error) {
+		if string(payload) != "40001" {
+			return nil, errors.New("registro desconocido")
+		}
+		return []byte("1234"), nil
+	})
+	if err != nil {
+		t.Fatalf("Responder CoAP: %v", err)
+	}
+
+	gateway, err := clientehttp.Conectar(hostHTTP, puertoHTTP)
+	if err != nil {
+		t.Fatalf("Conectar HTTP: %v", err)
+	}
+	t.Cleanup(gateway.Desconectar)
+	var rpc middleware.ClienteRPC = gateway
+
+	respuesta, err := rpc.Solicitar("dispositivos/plc1/leer", "40001", 3*time.Second)
+	if err != nil || string(respuesta) != "1234" {
+		t.Fatalf("Solicitar HTTP->CoAP = %q, %v", respuesta, err)
+	}
+	// El error del manejador llega al solicitante
+	if _, err := rpc.Solicitar("dispositivos/plc1/leer", "49999", 3*time.Second); !errors.Is(err, errores.ErrSolicitud) || !strings.Contains(err.Error(), "registro desconocido") {
+		t.Errorf("Solicitar con error del manejador = %v", err)
+	}
+
+	err = gateway.Responder("gateway/estado", func(topico string, payload []byte) ([]byte, error) {
+		return []byte(topico + ":" + string(payload)), nil
+	})
+	if err != nil {
+		t.Fatalf("Responder HTTP: %v", err)
+	}
+	panel, err := clientemqtt.Conectar("127.0.0.1", puertoMQTT)
+	if err != nil {
+		t.Fatalf("Conectar MQTT: %v", err)
+	}
+	t.Cleanup(panel.Desconectar)
+	respuesta, err = panel.Solicitar("gateway/estado", "ping", 3*time.Second)
+	if err != nil || string(respuesta) != "gateway/estado:ping" {
+		t.Fatalf("Solicitar MQTT->HTTP = %q, %v", respuesta, err)
+	}
+
+	// Sin respondedor vence el plazo
+	inicio := time.Now()
+	_, err = panel.Solicitar("nadie/escucha", "x", 300*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, errores.ErrSolicitud) {
+		t.Errorf("Solicitar sin respondedor = %v, esperaba timeout", err)
+	}
+	if time.Since(inicio) > 2*time.Second {
+		t.Errorf("el timeout tardó %v", time.Since(inicio))
+	}
+}
+
+func TestSolicitudes_TopicoRespuestaInvalido(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	for _, respuesta := range []string{"respuestas/#", "swctl/nodos", "$share/g/x"} {
+		cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: "dispositivos/plc1", TopicoRespuesta: respuesta, Correlacion: "c1"})
+		resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico=dispositivos/plc1", "application/json", bytes.NewReader(cuerpo))
+		if err != nil {
+			t.Fatalf("POST error = %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("TopicoRespuesta %q: código %d, esperaba 400", respuesta, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package servidor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Límites de tasa de publicación por cliente y por tópico (token bucket). Cada clave
+// tiene una cubeta de Rafaga fichas que se repone a PorSegundo fichas por segundo; una
+// publicación consume una ficha de la cubeta de su cliente y otra de la de su tópico, y
+// se rechaza sin consumir ninguna si alguna está vacía.
+//
+// El cliente es el usuario autenticado, de modo que el límite es el mismo en todos los
+// protocolos. Sin autenticación es la conexión: la IP en HTTP y WebSocket, la dirección
+// UDP (IP y puerto) en CoAP y el ClientID en MQTT.
+
+// LimiteTasa es una tasa máxima de publicaciones con ráfaga
+type LimiteTasa struct {
+	PorSegundo float64 // publicaciones por segundo sostenidas (0 = sin límite)
+	Rafaga     int     // publicaciones seguidas admitidas (0 = PorSegundo redondeado hacia arriba, mínimo 1)
+}
+
+// errTasaExcedida rechaza una publicación que supera el límite de su cliente o tópico
+var errTasaExcedida = errors.New("límite de tasa de publicación excedido")
+
+// intervaloLimpiezaTasas es cada cuánto se descartan las cubetas que se llenaron sin uso
+const intervaloLimpiezaTasas = time.Minute
+
+func (l LimiteTasa) validar() error {
+	if l.PorSegundo < 0 || l.Rafaga < 0 || math.IsNaN(l.PorSegundo) || math.IsInf(l.PorSegundo, 0) {
+		return fmt.Errorf("límite de tasa inválido: %+v", l)
+	}
+	return nil
+}
+
+func (l LimiteTasa) capacidad() float64 {
+	if l.Rafaga > 0 {
+		return float64(l.Rafaga)
+	}
+	return math.Max(1, math.Ceil(l.PorSegundo))
+}
+
+type cubeta struct {
+	fichas float64
+	ultima time.Time
+}
+
+// limitadorTasas guarda las cubetas de clientes y tópicos
+type limitadorTasas struct {
+	porCliente LimiteTasa
+	porTopico  LimiteTasa
+
+	mu       sync.Mutex
+	clientes map[string]*cubeta
+	topicos  map[string]*cubeta
+	limpieza time.Time
+}
+
+func nuevoLimitadorTasas(porCliente, porTopico LimiteTasa) *limitadorTasas {
+	return &limitadorTasas{
+		porCliente: porCliente,
+		porTopico:  porTopico,
+		clientes:   make(map[string]*cubeta),
+		topicos:    make(map[string]*cubeta),
+	}
+}
+
+// permitir consume una ficha del cliente y una del tópico si ambas cubetas tienen
+func (l *limitadorTasas) permitir(cliente, topico string, ahora time.Time) bool {
+	if l.porCliente.PorSegundo == 0 && l.porTopico.PorSegundo == 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ahora.Sub(l.limpieza) > intervaloLimpiezaTasas {
+		l.limpiar(ahora)
+	}
+	c := reponer(l.clientes, cliente, l.porCliente, ahora)
+	t := reponer(l.topicos, topico, l.porTopico, ahora)
+	if (c != nil && c.fichas < 1) || (t != nil && t.fichas < 1) {
+		return false
+	}
+	for _, b := range []*cubeta{c, t} {
+		if b != nil {
+			b.fichas--
+		}
+	}
+	return true
+}
+
+// reponer retorna la cubeta de la clave con las fichas acumuladas hasta ahora
+// (nil si el límite no está configurado)
+func reponer(cubetas map[string]*cubeta, clave string, limite LimiteTasa, ahora time.Time) *cubeta {
+	if limite.PorSegundo == 0 {
+		return nil
+	}
+	b, ok := cubetas[clave]
+	if !ok {
+		b = &cubeta{fichas: limite.capacidad(), ultima: ahora}
+		cubetas[clave] = b
+		return b
+	}
+	if transcurrido := ahora.Sub(b.ultima).Seconds(); transcurrido > 0 {
+		b.fichas = math.Min(limite.capacidad(), b.fichas+transcurrido*limite.PorSegundo)
+		b.ultima = ahora
+	}
+	return b
+}
+
+// limpiar descarta las cubetas que ya se llenaron: equivalen a una cubeta nueva.
+// Requiere l.mu tomado.
+func (l *limitadorTasas) limpiar(ahora time.Time) {
+	descartarLlenas := func(cubetas map[string]*cubeta, limite LimiteTasa) {
+		for clave, b := range cubetas {
+			if b.fichas+ahora.Sub(b.ultima).Seconds()*limite.PorSegundo >= limite.capacidad() {
+				delete(cubetas, clave)
+			}
+		}
+	}
+	descartarLlenas(l.clientes, l.porCliente)
+	descartarLlenas(l.topicos, l.porTopico)
+	l.limpieza = ahora
+}
+
+// permitirPublicacion aplica los límites de tasa a una publicación. usuario es la
+// identidad autenticada y conexion identifica la conexión cuando no hay autenticación.
+func (s *Servidor) permitirPublicacion(LOG, usuario, conexion, topico string) bool {
+	cliente := identidadPublicante(usuario, conexion)
+	if s.tasas.permitir(cliente, topico, time.Now()) {
+		return true
+	}
+	loggerPrint(LOG, "Publicación rechazada - Cliente: %s, Tópico: %s, Razón: %v", cliente, topico, errTasaExcedida)
+	s.descartar(descarteTasa)
+	return false
+}
+
+// identidadPublicante identifica a un publicante por su usuario autenticado o, sin
+// autenticación, por su conexión
+func identidadPublicante(usuario, conexion string) string {
+	if usuario != "" && usuario != UsuarioAnonimo {
+		return "usuario/" + usuario
+	}
+	return conexion
+}
+
+// conexionRemota identifica a un publicante sin autenticar por su IP, sin el puerto:
+// un cliente que reabre su socket (p. ej. CoAP al reconectar) sigue siendo el mismo
+// para los límites de tasa y la deduplicación QoS 2
+func conexionRemota(protocolo, direccionRemota string) string {
+	if host, _, err := net.SplitHostPort(direccionRemota); err == nil {
+		direccionRemota = host
+	}
+	return protocolo + "/" + direccionRemota
+}
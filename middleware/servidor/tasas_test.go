@@ -0,0 +1,118 @@
+package servidor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	clientecoap "github.com/sensorwave-dev/sensorwave/middleware/cliente_coap"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/errores"
+)
+
+func TestLimitadorTasas(t *testing.T) {
+	l := nuevoLimitadorTasas(LimiteTasa{PorSegundo: 2, Rafaga: 3}, LimiteTasa{PorSegundo: 1, Rafaga: 4})
+	t0 := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !l.permitir("a", fmt.Sprintf("t%d", i), t0) {
+			t.Fatalf("publicación %d de la ráfaga rechazada", i)
+		}
+	}
+	if l.permitir("a", "otro", t0) {
+		t.Error("se esperaba el rechazo al agotar la ráfaga del cliente")
+	}
+	if !l.permitir("b", "otro", t0) {
+		t.Error("el límite de un cliente no debe afectar a otro")
+	}
+	// A 2/s, medio segundo repone una ficha
+	if !l.permitir("a", "otro", t0.Add(500*time.Millisecond)) {
+		t.Error("la cubeta del cliente no se repuso")
+	}
+
+	// Límite por tópico: el rechazo no consume la ficha del cliente
+	for i := 0; i < 2; i++ {
+		l.permitir("c", "otro", t0.Add(500*time.Millisecond))
+	}
+	if l.permitir("d", "otro", t0.Add(500*time.Millisecond)) {
+		t.Error("se esperaba el rechazo al agotar la ráfaga del tópico")
+	}
+	if c := l.clientes["d"]; c == nil || c.fichas != 3 {
+		t.Errorf("el rechazo por tópico consumió fichas del cliente: %+v", c)
+	}
+
+	// Las cubetas que se llenaron se descartan
+	l.limpiar(t0.Add(time.Hour))
+	if len(l.clientes) != 0 || len(l.topicos) != 0 {
+		t.Errorf("quedaron %d cubetas de clientes y %d de tópicos", len(l.clientes), len(l.topicos))
+	}
+}
+
+func TestCrear_LimiteTasaInvalido(t *testing.T) {
+	if _, err := Crear(Opciones{PuertoHTTP: "0", LimitePorCliente: LimiteTasa{PorSegundo: -1}}); err == nil {
+		t.Error("Crear() con tasa negativa debería fallar")
+	}
+}
+
+// TestLimitePorCliente_Protocolos agota la ráfaga de un publicante de cada protocolo
+func TestLimitePorCliente_Protocolos(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{
+		PuertoHTTP:       "0",
+		PuertoCoAP:       "0",
+		PuertoMQTT:       "0",
+		LimitePorCliente: LimiteTasa{PorSegundo: 0.01, Rafaga: 2},
+	})
+
+	// HTTP: 429 con Retry-After
+	codigos := make([]int, 3)
+	for i := range codigos {
+		cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: "sensores/t", Payload: []byte("1")})
+		resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico=sensores/t", "application/json", bytes.NewReader(cuerpo))
+		if err != nil {
+			t.Fatalf("POST error = %v", err)
+		}
+		resp.Body.Close()
+		codigos[i] = resp.StatusCode
+		if resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Error("falta Retry-After en la respuesta 429")
+		}
+	}
+	if codigos[0] != http.StatusOK || codigos[1] != http.StatusOK || codigos[2] != http.StatusTooManyRequests {
+		t.Errorf("códigos HTTP = %v, esperaba 200, 200, 429", codigos)
+	}
+
+	// CoAP: 4.29, que el cliente no marca como rechazo permanente
+	_, puertoCoAP, _ := net.SplitHostPort(s.direccionCoAP)
+	coap, err := clientecoap.Conectar("127.0.0.1", puertoCoAP)
+	if err != nil {
+		t.Fatalf("Conectar CoAP: %v", err)
+	}
+	t.Cleanup(coap.Desconectar)
+	for i := 0; i < 2; i++ {
+		if err := coap.Publicar("sensores/t", "1"); err != nil {
+			t.Fatalf("Publicar CoAP %d: %v", i, err)
+		}
+	}
+	err = coap.Publicar("sensores/t", "1")
+	if !errors.Is(err, errores.ErrPublicacion) || !strings.Contains(err.Error(), "TooManyRequests") {
+		t.Errorf("Publicar CoAP sobre el límite = %v, esperaba 4.29", err)
+	}
+
+	// MQTT 3.1.1: los PUBLISH que exceden el límite se descartan
+	recibidos := recibirMQTT(t, s, "limitado/#")
+	publicante := conectarMQTT(t, s)
+	for i := 0; i < 4; i++ {
+		if err := publicante.Publicar("limitado/t", "1"); err != nil {
+			t.Fatalf("Publicar MQTT %d: %v", i, err)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := len(recibidos.recibidos()); n != 2 {
+		t.Errorf("el suscriptor MQTT recibió %d mensajes, esperaba la ráfaga de 2", n)
+	}
+}
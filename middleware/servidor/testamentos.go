@@ -0,0 +1,136 @@
+package servidor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/mensaje"
+)
+
+const LOG_TESTAMENTO = "TESTAMENTO"
+
+// Testamentos (last will) de clientes HTTP y CoAP.
+//
+// MQTT tiene testamento nativo en el CONNECT. HTTP y CoAP no tienen sesión, así que el
+// cliente declara su testamento en cada suscripción (stream SSE u observe) junto con un
+// ID propio. El testamento se publica cuando todas las suscripciones con ese ID se caen
+// sin desuscribirse: fin anormal del stream SSE o cierre por inactividad de la conexión
+// CoAP. La publicación espera esperaTestamento para absorber reconexiones del cliente
+// y desuscripciones que llegan después de cerrar el stream.
+
+// paramTestamentoID es el parámetro de query con el ID de testamento del cliente
+const paramTestamentoID = mensaje.ParamTestamentoID
+
+// esperaTestamento es la gracia entre la caída de la última suscripción y la publicación
+var esperaTestamento = 2 * time.Second
+
+type testamento struct {
+	mensaje   Mensaje
+	vinculos  int         // suscripciones activas que declararon el testamento
+	pendiente *time.Timer // publicación programada tras una caída
+}
+
+// registroTestamentos indexa los testamentos por el ID declarado por el cliente
+type registroTestamentos struct {
+	mu    sync.Mutex
+	porID map[string]*testamento
+}
+
+func nuevoRegistroTestamentos() *registroTestamentos {
+	return &registroTestamentos{porID: make(map[string]*testamento)}
+}
+
+// leerTestamento obtiene el testamento declarado en los parámetros de una suscripción
+// y verifica que el usuario pueda publicar en su tópico
+func (s *Servidor) leerTestamento(obtener func(string) string, usuario string) (string, Mensaje, error) {
+	id, t, err := mensaje.LeerTestamento(obtener)
+	if err != nil || t == nil {
+		return "", Mensaje{}, err
+	}
+	topico, err := normalizarYValidarTopico(t.Topico, false)
+	if err != nil {
+		return "", Mensaje{}, err
+	}
+	if !s.autorizar(usuario, AccionPublicar, topico) {
+		return "", Mensaje{}, errNoAutorizado
+	}
+	return id, mensajeTestamento(topico, t), nil
+}
+
+func mensajeTestamento(topico string, t *middleware.Testamento) Mensaje {
+	return Mensaje{Topico: topico, Payload: t.Payload, Retenido: t.Retenido}
+}
+
+// vincularTestamento registra una suscripción activa del cliente id y cancela
+// una publicación pendiente (el cliente se reconectó)
+func (s *Servidor) vincularTestamento(id string, m Mensaje) {
+	s.testamentos.mu.Lock()
+	defer s.testamentos.mu.Unlock()
+	t := s.testamentos.porID[id]
+	if t == nil {
+		t = &testamento{}
+		s.testamentos.porID[id] = t
+	}
+	if t.pendiente != nil {
+		t.pendiente.Stop()
+		t.pendiente = nil
+	}
+	t.mensaje = m
+	t.vinculos++
+}
+
+// desvincularTestamento quita una suscripción del cliente id. Si era la última y terminó
+// de forma anormal, programa la publicación del testamento; si fue limpia, lo descarta.
+func (s *Servidor) desvincularTestamento(id string, limpio bool) {
+	s.testamentos.mu.Lock()
+	defer s.testamentos.mu.Unlock()
+	t := s.testamentos.porID[id]
+	if t == nil {
+		return
+	}
+	t.vinculos--
+	if t.vinculos > 0 {
+		return
+	}
+	if limpio {
+		delete(s.testamentos.porID, id)
+		return
+	}
+	t.pendiente = time.AfterFunc(esperaTestamento, func() {
+		s.testamentos.mu.Lock()
+		if s.testamentos.porID[id] != t || t.vinculos > 0 {
+			s.testamentos.mu.Unlock()
+			return
+		}
+		delete(s.testamentos.porID, id)
+		s.testamentos.mu.Unlock()
+		s.publicarTestamento(t.mensaje)
+	})
+}
+
+// cancelarTestamento descarta el testamento de un cliente que se desuscribió
+// explícitamente después de que su stream ya se hubiera cerrado
+func (s *Servidor) cancelarTestamento(id string) {
+	s.testamentos.mu.Lock()
+	defer s.testamentos.mu.Unlock()
+	t := s.testamentos.porID[id]
+	if t == nil || t.vinculos > 0 {
+		return
+	}
+	if t.pendiente != nil {
+		t.pendiente.Stop()
+	}
+	delete(s.testamentos.porID, id)
+}
+
+// publicarTestamento distribuye el testamento por todos los protocolos
+func (s *Servidor) publicarTestamento(m Mensaje) {
+	if s.estaCerrado() {
+		return
+	}
+	s.registrarSalto(&m)
+	loggerPrint(LOG_TESTAMENTO, "Publicando testamento - Tópico: %s", m.Topico)
+	s.retener(m)
+	s.distribuir(LOG_TESTAMENTO, m, true)
+}
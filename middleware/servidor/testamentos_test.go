@@ -0,0 +1,160 @@
+package servidor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	clientemqtt "github.com/sensorwave-dev/sensorwave/middleware/cliente_mqtt"
+	"github.com/sensorwave-dev/sensorwave/middleware/internal/mensaje"
+)
+
+func acortarEsperaTestamento(t *testing.T) {
+	anterior := esperaTestamento
+	esperaTestamento = 50 * time.Millisecond
+	t.Cleanup(func() { esperaTestamento = anterior })
+}
+
+// suscribirConTestamento abre un stream SSE que declara un testamento y retorna el
+// clienteID asignado y la función que corta el stream sin desuscribirse
+func suscribirConTestamento(t *testing.T, s *Servidor, topico, id string, testamento *middleware.Testamento) (string, context.CancelFunc) {
+	t.Helper()
+	ctx, cancelar := context.WithCancel(context.Background())
+	url := "http://" + s.direccionHTTP + "/sensorwave?topico=" + topico + "&" + mensaje.ParametrosTestamento(id, testamento).Encode()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancelar()
+		t.Fatalf("error suscribiendo: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		cancelar()
+		t.Fatalf("suscripción rechazada: %d", resp.StatusCode)
+	}
+	lector := bufio.NewScanner(resp.Body)
+	for lector.Scan() {
+		if dato, ok := strings.CutPrefix(lector.Text(), "data: "); ok {
+			var inicial struct{ ClienteID string }
+			json.Unmarshal([]byte(dato), &inicial)
+			return inicial.ClienteID, cancelar
+		}
+	}
+	cancelar()
+	t.Fatal("no se recibió el clienteID")
+	return "", nil
+}
+
+func TestTestamento_HTTP(t *testing.T) {
+	acortarEsperaTestamento(t)
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	observador := suscribirSSE(t, s, "estado/+")
+	testamento := &middleware.Testamento{Topico: "estado/sensor1", Payload: []byte("offline"), Retenido: true}
+
+	// Caída del stream sin desuscribirse: se publica el testamento
+	_, cortar := suscribirConTestamento(t, s, "comandos/sensor1", "t-sensor1", testamento)
+	cortar()
+	select {
+	case dato := <-observador:
+		var m Mensaje
+		json.Unmarshal([]byte(dato), &m)
+		if m.Topico != "estado/sensor1" || string(m.Payload) != "offline" {
+			t.Errorf("testamento inesperado: %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no se publicó el testamento tras la caída")
+	}
+	if len(s.retenidos.coincidentes("estado/sensor1")) != 1 {
+		t.Error("el testamento retenido debería quedar en el almacén")
+	}
+
+	// Desuscripción explícita: el testamento se descarta
+	clienteID, cortar := suscribirConTestamento(t, s, "comandos/sensor2", "t-sensor2", &middleware.Testamento{Topico: "estado/sensor2", Payload: []byte("offline")})
+	req, _ := http.NewRequest(http.MethodDelete, "http://"+s.direccionHTTP+"/sensorwave?topico=comandos/sensor2&clienteID="+clienteID+"&"+paramTestamentoID+"=t-sensor2", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error desuscribiendo: %v", err)
+	}
+	resp.Body.Close()
+	cortar()
+	select {
+	case dato := <-observador:
+		t.Errorf("no se esperaba testamento tras desuscribirse: %s", dato)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestTestamento_HTTPNoAutorizado(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", Autorizador: configuracionAuthTest()})
+	url := "http://" + s.direccionHTTP + "/sensorwave?topico=dispositivos/sensor1/config&" +
+		mensaje.ParametrosTestamento("t-sensor1", &middleware.Testamento{Topico: "actuadores/valvula", Payload: []byte("x")}).Encode()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.SetBasicAuth("sensor1", "secreto")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error suscribiendo: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("testamento en tópico sin permiso de publicación: status %d, esperaba 403", resp.StatusCode)
+	}
+}
+
+// TestTestamento_MQTT verifica que el testamento nativo de MQTT llega a los suscriptores HTTP
+func TestTestamento_MQTT(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoMQTT: "0"})
+	observador := suscribirSSE(t, s, "estado/+")
+
+	_, puerto, _ := net.SplitHostPort(s.direccionMQTT)
+	c, err := clientemqtt.Conectar("127.0.0.1", puerto, middleware.ConTestamento("estado/sensor1", []byte("offline"), false))
+	if err != nil {
+		t.Fatalf("Conectar MQTT: %v", err)
+	}
+	defer c.Desconectar()
+
+	// Corta la conexión desde el broker para simular una caída del cliente
+	for _, cl := range s.obtenerBrokerMQTT().Clients.GetAll() {
+		if !cl.Net.Inline {
+			cl.Stop(errors.New("caída simulada"))
+		}
+	}
+	select {
+	case dato := <-observador:
+		var m Mensaje
+		json.Unmarshal([]byte(dato), &m)
+		if m.Topico != "estado/sensor1" || string(m.Payload) != "offline" {
+			t.Errorf("testamento inesperado: %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("el testamento MQTT no llegó al suscriptor HTTP")
+	}
+}
+
+func TestHookAuthMQTT_TestamentoNoAutorizado(t *testing.T) {
+	s := nuevoServidor(Opciones{Autorizador: configuracionAuthTest()})
+	h := &hookAuthMQTT{servidor: s}
+
+	conectar := func(topicoTestamento string) bool {
+		var pk packets.Packet
+		pk.Connect.Username = []byte("sensor1")
+		pk.Connect.Password = []byte("secreto")
+		pk.Connect.WillFlag = true
+		pk.Connect.WillTopic = topicoTestamento
+		return h.OnConnectAuthenticate(&mochi.Client{ID: "sensor1"}, pk)
+	}
+
+	if !conectar("planta/sala/temp") {
+		t.Error("testamento en tópico permitido rechazado")
+	}
+	if conectar("actuadores/valvula") {
+		t.Error("testamento en tópico sin permiso de publicación aceptado")
+	}
+}
@@ -0,0 +1,130 @@
+package servidor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/pion/dtls/v3"
+	"github.com/plgd-dev/go-coap/v3/mux"
+)
+
+// Transporte seguro:
+//   - HTTP/SSE y MQTT usan Opciones.TLS (crypto/tls).
+//   - CoAP usa Opciones.DTLS (pion/dtls), con certificados o claves precompartidas (PSK).
+//
+// Con TLS mutuo la identidad del cliente es el CommonName de su certificado verificado;
+// con PSK es la identidad PSK. Esa identidad se usa en la ACL cuando el cliente no
+// envía credenciales explícitas (ver autenticar).
+
+// CargarConfiguracionTLS lee certificado y clave PEM del servidor. Si caClientes no es
+// vacío se exige a los clientes un certificado firmado por esa CA (TLS mutuo).
+func CargarConfiguracionTLS(certificado, clave, caClientes string) (*tls.Config, error) {
+	par, err := tls.LoadX509KeyPair(certificado, clave)
+	if err != nil {
+		return nil, fmt.Errorf("error cargando certificado TLS: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{par},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caClientes != "" {
+		pool, err := cargarPoolCA(caClientes)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ConfiguracionDTLSDesdeTLS construye la configuración DTLS de CoAP reutilizando
+// certificados y CA de clientes de una configuración TLS
+func ConfiguracionDTLSDesdeTLS(config *tls.Config) *dtls.Config {
+	dtlsConfig := &dtls.Config{
+		Certificates:         config.Certificates,
+		ClientCAs:            config.ClientCAs,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+	if config.ClientAuth == tls.RequireAndVerifyClientCert {
+		dtlsConfig.ClientAuth = dtls.RequireAndVerifyClientCert
+	}
+	return dtlsConfig
+}
+
+// ConfiguracionDTLSConPSK construye una configuración DTLS con claves precompartidas
+// indexadas por identidad PSK
+func ConfiguracionDTLSConPSK(claves map[string][]byte) *dtls.Config {
+	return &dtls.Config{
+		PSK: func(identidad []byte) ([]byte, error) {
+			clave, ok := claves[string(identidad)]
+			if !ok {
+				return nil, fmt.Errorf("identidad PSK desconocida: %s", identidad)
+			}
+			return clave, nil
+		},
+		PSKIdentityHint:      []byte("sensorwave"),
+		CipherSuites:         []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8, dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+}
+
+func cargarPoolCA(ruta string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(ruta)
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no se encontraron certificados en %s", ruta)
+	}
+	return pool, nil
+}
+
+// identidadTLS retorna el CommonName del certificado de cliente verificado, o "" si no hay
+func identidadTLS(estado *tls.ConnectionState) string {
+	if estado == nil || len(estado.VerifiedChains) == 0 || len(estado.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return estado.VerifiedChains[0][0].Subject.CommonName
+}
+
+// identidadConexionTLS aplica identidadTLS a una conexión de red (vacío si no es TLS).
+// Además de *tls.Conn admite las conexiones que envuelven una TLS, como las de MQTT sobre WebSocket.
+func identidadConexionTLS(conn net.Conn) string {
+	tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return ""
+	}
+	estado := tlsConn.ConnectionState()
+	return identidadTLS(&estado)
+}
+
+// identidadDTLS retorna la identidad PSK o el CommonName del certificado de cliente
+// de una conexión CoAP sobre DTLS, o "" si no es DTLS
+func (s *Servidor) identidadDTLS(conn mux.Conn) string {
+	dtlsConn, ok := conn.NetConn().(*dtls.Conn)
+	if !ok {
+		return ""
+	}
+	estado, ok := dtlsConn.ConnectionState()
+	if !ok {
+		return ""
+	}
+	if len(estado.IdentityHint) > 0 && s.opts.DTLS != nil && s.opts.DTLS.PSK != nil {
+		return string(estado.IdentityHint)
+	}
+	// pion no expone las cadenas verificadas: el certificado solo se considera
+	// identidad si la configuración exige verificarlo
+	if len(estado.PeerCertificates) == 0 || s.opts.DTLS == nil || s.opts.DTLS.ClientAuth < dtls.VerifyClientCertIfGiven {
+		return ""
+	}
+	certificado, err := x509.ParseCertificate(estado.PeerCertificates[0])
+	if err != nil {
+		return ""
+	}
+	return certificado.Subject.CommonName
+}
@@ -0,0 +1,242 @@
+package servidor
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v3"
+	coapDTLS "github.com/plgd-dev/go-coap/v3/dtls"
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/sensorwave-dev/sensorwave/middleware"
+	clientecoap "github.com/sensorwave-dev/sensorwave/middleware/cliente_coap"
+	clientemqtt "github.com/sensorwave-dev/sensorwave/middleware/cliente_mqtt"
+)
+
+// pkiTest es una CA autofirmada con un certificado de servidor y uno de cliente
+type pkiTest struct {
+	ca       *x509.Certificate
+	pool     *x509.CertPool
+	servidor tls.Certificate
+	cliente  tls.Certificate // CommonName "sensor1"
+}
+
+func crearPKITest(t *testing.T) *pkiTest {
+	t.Helper()
+	claveCA, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	plantillaCA := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sensorwave-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	derCA, err := x509.CreateCertificate(rand.Reader, plantillaCA, plantillaCA, &claveCA.PublicKey, claveCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(derCA)
+
+	emitir := func(serie int64, nombre string, uso x509.ExtKeyUsage) tls.Certificate {
+		clave, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		plantilla := &x509.Certificate{
+			SerialNumber: big.NewInt(serie),
+			Subject:      pkix.Name{CommonName: nombre},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{uso},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			DNSNames:     []string{"localhost"},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, plantilla, ca, &clave.PublicKey, claveCA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: clave}
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &pkiTest{
+		ca:       ca,
+		pool:     pool,
+		servidor: emitir(2, "localhost", x509.ExtKeyUsageServerAuth),
+		cliente:  emitir(3, "sensor1", x509.ExtKeyUsageClientAuth),
+	}
+}
+
+// configServidor retorna la configuración TLS del servidor exigiendo certificado de cliente
+func (p *pkiTest) configServidor() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{p.servidor},
+		ClientCAs:    p.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func TestCargarConfiguracionTLS(t *testing.T) {
+	pki := crearPKITest(t)
+	dir := t.TempDir()
+
+	escribir := func(nombre, tipo string, der []byte) string {
+		ruta := filepath.Join(dir, nombre)
+		if err := os.WriteFile(ruta, pem.EncodeToMemory(&pem.Block{Type: tipo, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return ruta
+	}
+	claveDER, _ := x509.MarshalPKCS8PrivateKey(pki.servidor.PrivateKey)
+	cert := escribir("servidor.pem", "CERTIFICATE", pki.servidor.Certificate[0])
+	clave := escribir("servidor.key", "PRIVATE KEY", claveDER)
+	ca := escribir("ca.pem", "CERTIFICATE", pki.ca.Raw)
+
+	config, err := CargarConfiguracionTLS(cert, clave, "")
+	if err != nil {
+		t.Fatalf("CargarConfiguracionTLS() error = %v", err)
+	}
+	if config.ClientAuth != tls.NoClientCert {
+		t.Error("sin CA de clientes no debería exigirse certificado")
+	}
+
+	config, err = CargarConfiguracionTLS(cert, clave, ca)
+	if err != nil {
+		t.Fatalf("CargarConfiguracionTLS() con CA error = %v", err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Error("con CA de clientes debería exigirse TLS mutuo")
+	}
+	if ConfiguracionDTLSDesdeTLS(config).ClientAuth != dtls.RequireAndVerifyClientCert {
+		t.Error("la configuración DTLS debería conservar el TLS mutuo")
+	}
+
+	if _, err := CargarConfiguracionTLS(cert, clave, clave); err == nil {
+		t.Error("esperaba error por CA sin certificados")
+	}
+}
+
+// TestServidorHTTP_TLSMutuo verifica que el CommonName del certificado de cliente
+// se usa como identidad en la ACL
+func TestServidorHTTP_TLSMutuo(t *testing.T) {
+	pki := crearPKITest(t)
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", TLS: pki.configServidor(), Autorizador: configuracionAuthTest()})
+
+	clienteHTTPS := func(certificados ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pki.pool, Certificates: certificados}}}
+	}
+	_, puerto, _ := net.SplitHostPort(s.direccionHTTP)
+	publicar := func(cliente *http.Client, topico string) (int, error) {
+		cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: topico, Payload: []byte("1")})
+		resp, err := cliente.Post("https://localhost:"+puerto+"/sensorwave?topico="+topico, "application/json", bytes.NewReader(cuerpo))
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	conCertificado := clienteHTTPS(pki.cliente)
+	if code, err := publicar(conCertificado, "planta/sala/temp"); err != nil || code != http.StatusOK {
+		t.Errorf("tópico permitido a sensor1: status %d, err %v", code, err)
+	}
+	if code, err := publicar(conCertificado, "actuadores/valvula"); err != nil || code != http.StatusForbidden {
+		t.Errorf("tópico no permitido a sensor1: status %d, err %v", code, err)
+	}
+	if _, err := publicar(clienteHTTPS(), "planta/sala/temp"); err == nil {
+		t.Error("el handshake sin certificado de cliente debería fallar")
+	}
+}
+
+func TestServidorMQTT_TLSMutuo(t *testing.T) {
+	pki := crearPKITest(t)
+	s := iniciarServidorTest(t, Opciones{PuertoMQTT: "0", TLS: pki.configServidor(), Autorizador: configuracionAuthTest()})
+	_, puerto, _ := net.SplitHostPort(s.direccionMQTT)
+
+	c, err := clientemqtt.ConectarTLS("127.0.0.1", puerto, &tls.Config{RootCAs: pki.pool, Certificates: []tls.Certificate{pki.cliente}})
+	if err != nil {
+		t.Fatalf("ConectarTLS() error = %v", err)
+	}
+	defer c.Desconectar()
+
+	recibido := make(chan string, 1)
+	if err := c.Suscribir("dispositivos/sensor1/config", func(topico string, payload []byte) {
+		recibido <- string(payload)
+	}); err != nil {
+		t.Fatalf("Suscribir() error = %v", err)
+	}
+	cuerpo, _ := json.Marshal(Mensaje{Topico: "dispositivos/sensor1/config", Payload: []byte("on")})
+	if err := s.obtenerBrokerMQTT().Publish("dispositivos/sensor1/config", cuerpo, false, 0); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	select {
+	case <-recibido:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no se recibió el mensaje: la identidad del certificado no se aplicó a la ACL")
+	}
+}
+
+func TestServidorCoAP_DTLSConPSK(t *testing.T) {
+	claves := map[string][]byte{"sensor1": []byte("clave-sensor1")}
+	s := iniciarServidorTest(t, Opciones{PuertoCoAP: "0", DTLS: ConfiguracionDTLSConPSK(claves), Autorizador: configuracionAuthTest()})
+
+	conn, err := coapDTLS.Dial(s.direccionCoAP, &dtls.Config{
+		PSK:             func([]byte) ([]byte, error) { return claves["sensor1"], nil },
+		PSKIdentityHint: []byte("sensor1"),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+	})
+	if err != nil {
+		t.Fatalf("Dial DTLS error = %v", err)
+	}
+	defer conn.Close()
+
+	publicar := func(topico string) codes.Code {
+		ctx, cancelar := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancelar()
+		cuerpo, _ := json.Marshal(middleware.Mensaje{Original: true, Topico: topico, Payload: []byte("1")})
+		resp, err := conn.Post(ctx, "/sensorwave", message.TextPlain, bytes.NewReader(cuerpo), message.Option{ID: message.URIQuery, Value: []byte("topico=" + topico)})
+		if err != nil {
+			t.Fatalf("Post error = %v", err)
+		}
+		return resp.Code()
+	}
+
+	if code := publicar("planta/sala/temp"); code != codes.Created {
+		t.Errorf("tópico permitido a la identidad PSK: código %v", code)
+	}
+	if code := publicar("actuadores/valvula"); code != codes.Forbidden {
+		t.Errorf("tópico no permitido a la identidad PSK: código %v, esperaba Forbidden", code)
+	}
+
+	// El cliente del middleware acepta la misma configuración
+	_, puerto, _ := net.SplitHostPort(s.direccionCoAP)
+	c, err := clientecoap.ConectarTLS("127.0.0.1", puerto, &dtls.Config{
+		PSK:             func([]byte) ([]byte, error) { return claves["sensor1"], nil },
+		PSKIdentityHint: []byte("sensor1"),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+	})
+	if err != nil {
+		t.Fatalf("ConectarTLS() error = %v", err)
+	}
+	defer c.Desconectar()
+	if err := c.Publicar("planta/sala/temp", "21"); err != nil {
+		t.Errorf("Publicar() sobre DTLS error = %v", err)
+	}
+}
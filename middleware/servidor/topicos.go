@@ -7,7 +7,10 @@ import (
 	"github.com/sensorwave-dev/sensorwave/tipos"
 )
 
-var errTopicoInvalido = errors.New("topico invalido")
+var (
+	errTopicoInvalido          = errors.New("topico invalido")
+	errTopicoRespuestaInvalido = errors.New("topico de respuesta invalido")
+)
 
 // EsTopicoControl indica si un tópico pertenece al plano de control federado.
 func EsTopicoControl(topico string) bool {
@@ -44,6 +47,10 @@ func normalizarYValidarTopico(topico string, permitirWildcards bool) (string, er
 	}
 
 	partes := strings.Split(t, "/")
+	// $share solo encabeza suscripciones compartidas, nunca un tópico de publicación
+	if !permitirWildcards && partes[0] == strings.TrimSuffix(prefijoCompartida, "/") {
+		return "", errTopicoInvalido
+	}
 	for i, parte := range partes {
 		if parte == "" {
 			return "", errTopicoInvalido
@@ -73,3 +80,19 @@ func normalizarYValidarTopico(topico string, permitirWildcards bool) (string, er
 
 	return t, nil
 }
+
+// normalizarTopicoRespuesta valida el TopicoRespuesta de una solicitud: la respuesta se
+// publica ahí, así que debe ser un tópico de publicación fuera del plano de control.
+// Las respuestas no necesitan ruteo propio: llegan al solicitante por el fanout normal,
+// en cualquier protocolo.
+func normalizarTopicoRespuesta(m *Mensaje) error {
+	if m.TopicoRespuesta == "" {
+		return nil
+	}
+	topico, err := normalizarYValidarTopico(m.TopicoRespuesta, false)
+	if err != nil || EsTopicoControl(topico) {
+		return errTopicoRespuestaInvalido
+	}
+	m.TopicoRespuesta = topico
+	return nil
+}
@@ -0,0 +1,233 @@
+package servidor
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
+)
+
+// conectarWS abre el WebSocket nativo con la query indicada
+func conectarWS(t *testing.T, s *Servidor, query string) *websocket.Conn {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws://"+s.direccionHTTP+rutaWebSocket+query, nil)
+	if err != nil {
+		codigo := 0
+		if resp != nil {
+			codigo = resp.StatusCode
+		}
+		t.Fatalf("Dial WebSocket error = %v (código %d)", err, codigo)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// leerTramaWS espera la próxima trama del servidor
+func leerTramaWS(t *testing.T, conn *websocket.Conn) tramaWS {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var trama tramaWS
+	if err := conn.ReadJSON(&trama); err != nil {
+		t.Fatalf("ReadJSON error = %v", err)
+	}
+	return trama
+}
+
+func enviarTramaWS(t *testing.T, conn *websocket.Conn, trama tramaWS) {
+	t.Helper()
+	if err := conn.WriteJSON(trama); err != nil {
+		t.Fatalf("WriteJSON error = %v", err)
+	}
+}
+
+func TestWebSocket_SuscripcionPublicacionYAck(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	conn := conectarWS(t, s, "")
+
+	enviarTramaWS(t, conn, tramaWS{Tipo: tramaSuscribir, ID: "1", Topico: "sensores/#"})
+	if r := leerTramaWS(t, conn); r.Tipo != tramaOK || r.ID != "1" {
+		t.Fatalf("respuesta a suscribir = %+v", r)
+	}
+
+	// Una publicación por POST llega por el WebSocket
+	cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: "sensores/temp", Payload: []byte("21")})
+	resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico=sensores/temp", "application/json", bytes.NewReader(cuerpo))
+	if err != nil {
+		t.Fatalf("POST error = %v", err)
+	}
+	resp.Body.Close()
+	if r := leerTramaWS(t, conn); r.Tipo != tramaMensaje || r.Mensaje == nil || string(r.Mensaje.Payload) != "21" {
+		t.Fatalf("trama recibida = %+v, esperaba el mensaje publicado", r)
+	}
+
+	// Una publicación QoS 1 por el WebSocket se confirma y llega a SSE y al propio WebSocket
+	lineas := suscribirSSE(t, s, "sensores/#")
+	m := Mensaje{Original: true, Topico: "sensores/hum", Payload: []byte("40"), QoS: 1, MensajeID: "m1"}
+	enviarTramaWS(t, conn, tramaWS{Tipo: tramaPublicar, ID: "2", Mensaje: &m})
+	recibidas := map[string]tramaWS{}
+	for range 2 {
+		r := leerTramaWS(t, conn)
+		recibidas[r.Tipo] = r
+	}
+	if r := recibidas[tramaOK]; r.ID != "2" || r.MensajeID != "m1" {
+		t.Errorf("confirmación de la publicación = %+v", r)
+	}
+	if r := recibidas[tramaMensaje]; r.Mensaje == nil || r.Mensaje.MensajeID != "m1" || r.Mensaje.QoS != 1 {
+		t.Fatalf("mensaje QoS 1 = %+v", r)
+	}
+	esperarLineaSSE(t, lineas, "40")
+
+	// El ack libera el inflight de la suscripción WebSocket
+	var clienteWS string
+	s.mutexHTTP.Lock()
+	for id := range s.clientesPorTopico["sensores/#"] {
+		if s.inflightHTTP.Existe("m1", id) && strings.HasPrefix(id, "ws-") {
+			clienteWS = id
+		}
+	}
+	s.mutexHTTP.Unlock()
+	if clienteWS == "" {
+		t.Fatal("el mensaje QoS 1 no quedó pendiente de ack para el WebSocket")
+	}
+	enviarTramaWS(t, conn, tramaWS{Tipo: tramaAck, MensajeID: "m1"})
+	limite := time.Now().Add(2 * time.Second)
+	for s.inflightHTTP.Existe("m1", clienteWS) {
+		if time.Now().After(limite) {
+			t.Fatal("el ack no liberó el inflight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	enviarTramaWS(t, conn, tramaWS{Tipo: tramaDesuscribir, ID: "3", Topico: "sensores/#"})
+	if r := leerTramaWS(t, conn); r.Tipo != tramaOK || r.ID != "3" {
+		t.Fatalf("respuesta a desuscribir = %+v", r)
+	}
+	s.mutexHTTP.Lock()
+	_, sigue := s.clientesPorID[clienteWS]
+	s.mutexHTTP.Unlock()
+	if sigue {
+		t.Error("la desuscripción no quitó al cliente del fanout")
+	}
+}
+
+func TestWebSocket_TramasInvalidas(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	conn := conectarWS(t, s, "")
+
+	casos := []tramaWS{
+		{Tipo: tramaSuscribir, ID: "1", Topico: "a/#/b"},
+		{Tipo: tramaSuscribir, ID: "2", Topico: "swctl/#"},
+		{Tipo: tramaDesuscribir, ID: "3", Topico: "no/suscrito"},
+		{Tipo: tramaPublicar, ID: "4"},
+		{Tipo: tramaPublicar, ID: "5", Mensaje: &Mensaje{Original: true, Topico: "a/+"}},
+		{Tipo: tramaPublicar, ID: "6", Mensaje: &Mensaje{Original: true, Topico: "a/b", QoS: 3}},
+		{Tipo: "otro", ID: "7"},
+	}
+	for _, c := range casos {
+		enviarTramaWS(t, conn, c)
+		if r := leerTramaWS(t, conn); r.Tipo != tramaError || r.ID != c.ID || r.Error == "" {
+			t.Errorf("trama %+v: respuesta %+v, esperaba error", c, r)
+		}
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("{")); err != nil {
+		t.Fatalf("WriteMessage error = %v", err)
+	}
+	if r := leerTramaWS(t, conn); r.Tipo != tramaError {
+		t.Errorf("JSON inválido: respuesta %+v, esperaba error", r)
+	}
+}
+
+func TestWebSocket_Autorizacion(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", Autorizador: configuracionAuthTest()})
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+s.direccionHTTP+rutaWebSocket, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("sin credenciales: error = %v, esperaba 401", err)
+	}
+
+	// El navegador envía las credenciales en la query
+	conn := conectarWS(t, s, "?token=tok-panel")
+	enviarTramaWS(t, conn, tramaWS{Tipo: tramaSuscribir, ID: "1", Topico: "planta/#"})
+	if r := leerTramaWS(t, conn); r.Tipo != tramaOK {
+		t.Errorf("suscripción permitida: %+v", r)
+	}
+	enviarTramaWS(t, conn, tramaWS{Tipo: tramaSuscribir, ID: "2", Topico: "dispositivos/#"})
+	if r := leerTramaWS(t, conn); r.Tipo != tramaError {
+		t.Errorf("suscripción no permitida: %+v", r)
+	}
+	enviarTramaWS(t, conn, tramaWS{Tipo: tramaPublicar, ID: "3", Mensaje: &Mensaje{Original: true, Topico: "planta/sala/temp", Payload: []byte("1")}})
+	if r := leerTramaWS(t, conn); r.Tipo != tramaError {
+		t.Errorf("publicación no permitida: %+v", r)
+	}
+}
+
+func TestWebSocket_CierreDelServidor(t *testing.T) {
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0"})
+	conn := conectarWS(t, s, "")
+	enviarTramaWS(t, conn, tramaWS{Tipo: tramaSuscribir, Topico: "a/#"})
+	leerTramaWS(t, conn)
+
+	hecho := make(chan error, 1)
+	go func() { hecho <- s.Cerrar() }()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("lectura tras el cierre = %v, esperaba CloseGoingAway", err)
+	}
+	select {
+	case <-hecho:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cerrar no terminó con un WebSocket abierto")
+	}
+}
+
+func TestMQTTSobreWebSocket(t *testing.T) {
+	if _, err := Crear(Opciones{PuertoMQTTWebSocket: "0"}); err == nil {
+		t.Error("esperaba error con PuertoMQTTWebSocket sin PuertoMQTT")
+	}
+
+	s := iniciarServidorTest(t, Opciones{PuertoHTTP: "0", PuertoMQTT: "0", PuertoMQTTWebSocket: "0"})
+	lineas := suscribirSSE(t, s, "sensores/#")
+
+	opts := mqtt.NewClientOptions().AddBroker("ws://" + s.direccionMQTTWS + "/mqtt").SetClientID("navegador")
+	cliente := mqtt.NewClient(opts)
+	if token := cliente.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect MQTT sobre WebSocket: %v", token.Error())
+	}
+	defer cliente.Disconnect(100)
+
+	recibidos := make(chan []byte, 1)
+	if token := cliente.Subscribe("sensores/#", 1, func(_ mqtt.Client, m mqtt.Message) { recibidos <- m.Payload() }); token.Wait() && token.Error() != nil {
+		t.Fatalf("Subscribe: %v", token.Error())
+	}
+
+	// Publicación desde el navegador: llega a SSE
+	datos, _ := json.Marshal(Mensaje{Original: true, Topico: "sensores/ws", Payload: []byte("desde-ws")})
+	if token := cliente.Publish("sensores/ws", 1, false, datos); token.Wait() && token.Error() != nil {
+		t.Fatalf("Publish: %v", token.Error())
+	}
+	esperarLineaSSE(t, lineas, "desde-ws")
+	<-recibidos // el propio suscriptor MQTT también la recibe
+
+	// Publicación por HTTP: llega al suscriptor MQTT sobre WebSocket
+	cuerpo, _ := json.Marshal(Mensaje{Original: true, Topico: "sensores/http", Payload: []byte("desde-http")})
+	resp, err := http.Post("http://"+s.direccionHTTP+"/sensorwave?topico=sensores/http", "application/json", bytes.NewReader(cuerpo))
+	if err != nil {
+		t.Fatalf("POST error = %v", err)
+	}
+	resp.Body.Close()
+	select {
+	case payload := <-recibidos:
+		var m Mensaje
+		if err := json.Unmarshal(payload, &m); err != nil || string(m.Payload) != "desde-http" {
+			t.Errorf("payload MQTT = %s", payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("el suscriptor MQTT sobre WebSocket no recibió la publicación HTTP")
+	}
+}
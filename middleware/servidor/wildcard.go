@@ -4,11 +4,16 @@ import "strings"
 
 // coincidePatron verifica si un topico de publicacion coincide con un patron de suscripcion.
 // Soporta wildcards MQTT: + (un nivel) y # (multiples niveles, solo al final).
+// Como en MQTT, un wildcard en el primer nivel no coincide con tópicos que empiezan con $.
 func coincidePatron(topico, patron string) bool {
 	if patron == "" {
 		return false
 	}
 
+	if strings.HasPrefix(topico, "$") && (patron[0] == '#' || patron[0] == '+') {
+		return false
+	}
+
 	if patron == "#" {
 		return true
 	}
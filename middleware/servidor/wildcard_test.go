@@ -17,6 +17,9 @@ func TestCoincidePatron(t *testing.T) {
 		{topico: "casa/sala/temp", patron: "casa/#/temp", espera: false, motivo: "# en medio"},
 		{topico: "casa/sala/temp", patron: "casa/te+mp", espera: false, motivo: "+ no es segmento completo"},
 		{topico: "casa/sala/temp", patron: "casa/te#mp", espera: false, motivo: "# no es segmento completo"},
+		{topico: "$SYS/sensorwave/conexiones", patron: "#", espera: false, motivo: "# no coincide con tópicos $"},
+		{topico: "$SYS/sensorwave/conexiones", patron: "+/sensorwave/conexiones", espera: false, motivo: "+ no coincide con tópicos $"},
+		{topico: "$SYS/sensorwave/conexiones", patron: "$SYS/sensorwave/#", espera: true, motivo: "tópico $ con prefijo explícito"},
 	}
 
 	for _, caso := range casos {
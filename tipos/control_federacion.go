@@ -115,7 +115,18 @@ const (
 	OpReglaCrear      TipoOperacion = "regla.crear"
 	OpReglaActualizar TipoOperacion = "regla.actualizar"
 	OpReglaEliminar   TipoOperacion = "regla.eliminar"
+	OpReglaProbar     TipoOperacion = "regla.probar"
 	OpDatoInsertar    TipoOperacion = "dato.insertar"
+
+	OpDispositivoListar        TipoOperacion = "dispositivo.listar"
+	OpDispositivoAprobar       TipoOperacion = "dispositivo.aprobar"
+	OpDispositivoRechazar      TipoOperacion = "dispositivo.rechazar"
+	OpDispositivoEliminar      TipoOperacion = "dispositivo.eliminar"
+	OpTipoDispositivoRegistrar TipoOperacion = "tipo_dispositivo.registrar"
+
+	OpSombraObtener    TipoOperacion = "sombra.obtener"
+	OpSombraActualizar TipoOperacion = "sombra.actualizar"
+	OpSombraEliminar   TipoOperacion = "sombra.eliminar"
 )
 
 // SolicitudControlComando representa un comando de la nube al borde
@@ -141,6 +152,21 @@ type ComandoArgs struct {
 	Path      string      `json:"path,omitempty"`
 	Timestamp int64       `json:"timestamp,omitempty"`
 	Valor     interface{} `json:"valor,omitempty"`
+
+	// Para regla.probar (además de Regla o ReglaID)
+	TiempoInicio int64 `json:"tiempo_inicio,omitempty"` // Unix nanosegundos
+	TiempoFin    int64 `json:"tiempo_fin,omitempty"`    // Unix nanosegundos
+	Paso         int64 `json:"paso,omitempty"`          // Nanosegundos entre evaluaciones
+
+	// Para dispositivo.*
+	DispositivoID string `json:"dispositivo_id,omitempty"`
+	Estado        string `json:"estado,omitempty"` // Filtro de dispositivo.listar
+	// Para tipo_dispositivo.registrar (forma JSON de borde.TipoDispositivo)
+	TipoDispositivo map[string]interface{} `json:"tipo_dispositivo,omitempty"`
+
+	// Para sombra.* (sombra.actualizar escribe el estado deseado)
+	SombraID string                 `json:"sombra_id,omitempty"`
+	Deseado  map[string]interface{} `json:"deseado,omitempty"`
 }
 
 // RespuestaControlComandoFin indica que el comando terminó
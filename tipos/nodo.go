@@ -17,29 +17,57 @@ type Nodo struct {
 
 // Regla representa una regla del motor de reglas (versión serializable)
 type Regla struct {
-	ID          string      `json:"id"`
-	Nombre      string      `json:"nombre"`
-	Activa      bool        `json:"activa"`
-	Logica      string      `json:"logica"` // "AND" o "OR"
-	Condiciones []Condicion `json:"condiciones"`
-	Acciones    []Accion    `json:"acciones"`
+	ID          string             `json:"id"`
+	Nombre      string             `json:"nombre"`
+	Activa      bool               `json:"activa"`
+	Logica      string             `json:"logica"` // "AND" o "OR"
+	Condiciones []Condicion        `json:"condiciones"`
+	Grupos      []GrupoCondiciones `json:"grupos,omitempty"` // Subgrupos combinados con Logica
+	Acciones    []Accion           `json:"acciones"`
+}
+
+// GrupoCondiciones representa un grupo anidado de condiciones, p.ej. (A AND B) dentro de una regla OR
+type GrupoCondiciones struct {
+	Logica      string             `json:"logica"` // "AND" o "OR"
+	Condiciones []Condicion        `json:"condiciones,omitempty"`
+	Grupos      []GrupoCondiciones `json:"grupos,omitempty"`
 }
 
 // Condicion representa una condición de una regla
 type Condicion struct {
-	Path          string      `json:"path"`
-	VentanaT      string      `json:"ventana_t"`  // ej: "5m", "1h"
-	Agregacion    string      `json:"agregacion"` // "promedio", "maximo", etc.
-	Operador      string      `json:"operador"`   // ">=", "<", "==", etc.
-	Valor         interface{} `json:"valor"`      // número, string, bool
-	AgregarSeries bool        `json:"agregar_series"`
+	Path          string           `json:"path"`
+	VentanaT      string           `json:"ventana_t"`            // ej: "5m", "1h"
+	Agregacion    string           `json:"agregacion"`           // "promedio", "maximo", etc.
+	Operador      string           `json:"operador"`             // ">=", "<", "==", etc.
+	Valor         interface{}      `json:"valor"`                // número, string, bool
+	Referencia    *ReferenciaSerie `json:"referencia,omitempty"` // Lado derecho tomado de otra serie (reemplaza a Valor)
+	AgregarSeries bool             `json:"agregar_series"`
+}
+
+// ReferenciaSerie representa el lado derecho de una condición calculado desde otra serie
+type ReferenciaSerie struct {
+	Path           string  `json:"path"`
+	VentanaT       string  `json:"ventana_t,omitempty"`      // vacío = ventana de la condición
+	Agregacion     string  `json:"agregacion,omitempty"`     // vacío = último valor
+	Desplazamiento float64 `json:"desplazamiento,omitempty"` // se suma al valor de referencia
 }
 
 // Accion representa una acción de una regla
 type Accion struct {
-	Tipo       string            `json:"tipo"`
-	Destino    string            `json:"destino"`
-	Parametros map[string]string `json:"params"`
+	Tipo         string              `json:"tipo"`
+	Destino      string              `json:"destino"`
+	Parametros   map[string]string   `json:"params"`
+	Confirmacion *ConfirmacionAccion `json:"confirmacion,omitempty"` // Confirmación en lazo cerrado (opcional)
+}
+
+// ConfirmacionAccion representa la confirmación esperada de una acción enviada a un actuador
+type ConfirmacionAccion struct {
+	Serie        string      `json:"serie,omitempty"`        // Serie de retroalimentación
+	Topico       string      `json:"topico,omitempty"`       // Tópico de retroalimentación (alternativa a Serie)
+	Valor        interface{} `json:"valor"`                  // Valor esperado
+	Timeout      string      `json:"timeout,omitempty"`      // ej: "30s"
+	Reintentos   int         `json:"reintentos,omitempty"`   // Reenvíos antes de declarar el fallo
+	Escalamiento []Accion    `json:"escalamiento,omitempty"` // Acciones ejecutadas si el comando falla
 }
 
 // Serie representa una serie de datos de tiempo